@@ -0,0 +1,237 @@
+package coap
+
+import (
+	"bytes"
+	"slices"
+)
+
+const (
+	// MaxBlockSZX is the largest block size exponent, for blocks of 1024 bytes.
+	MaxBlockSZX = 6
+
+	// MaxBlockNum is the largest block number encodable in the 3 byte Block option.
+	MaxBlockNum = 1<<20 - 1
+)
+
+// BlockValue represents the value of Block1 or Block2 option.
+//
+// https://datatracker.ietf.org/doc/html/rfc7959#section-2.2
+type BlockValue struct {
+	// Num is the relative number of the block within the sequence of blocks of the given size.
+	Num uint32
+
+	// More indicates that more blocks follow.
+	More bool
+
+	// SZX is the size exponent, the block size is 2**(SZX+4) bytes.
+	SZX uint8
+}
+
+// BlockTransferState tracks a block-wise transfer to check the invariants RFC 7959 imposes
+// across the blocks of one representation.
+//
+// https://datatracker.ietf.org/doc/html/rfc7959#section-2.4
+type BlockTransferState struct {
+	// Block is the last checked block.
+	Block BlockValue
+
+	// ETag of the representation, nil if the blocks carry no ETag.
+	ETag []byte
+
+	// Size is the total size indicated by Size1 or Size2, nil if not indicated.
+	Size *uint32
+}
+
+// ParseBlockValue decodes the Block option value.
+//
+// Returns InvalidBlockSize if the size exponent is the reserved value 7.
+func ParseBlockValue(v uint32) (BlockValue, error) {
+	block := BlockValue{
+		Num:  v >> 4,
+		More: v&0x08 != 0,
+		SZX:  uint8(v & 0x07),
+	}
+
+	if block.SZX == 7 {
+		return BlockValue{}, InvalidBlockSize{
+			SZX: block.SZX,
+		}
+	}
+
+	return block, nil
+}
+
+// Uint returns the Block option value.
+func (b BlockValue) Uint() uint32 {
+	v := b.Num<<4 | uint32(b.SZX)
+	if b.More {
+		v |= 0x08
+	}
+
+	return v
+}
+
+// Size returns the block size in bytes.
+func (b BlockValue) Size() uint {
+	return 1 << (b.SZX + 4)
+}
+
+// Offset returns the offset of the block within the representation.
+func (b BlockValue) Offset() uint32 {
+	return b.Num * uint32(b.Size())
+}
+
+// GetBlock retrieves the value of Block1 or Block2 option.
+//
+// Returns OptionNotFound if the option is not present.
+//
+// Returns InvalidBlockSize if the size exponent is the reserved value 7.
+func (o Options) GetBlock(def OptionDef) (BlockValue, error) {
+	v, err := o.GetUint(def)
+	if err != nil {
+		return BlockValue{}, err
+	}
+
+	return ParseBlockValue(v)
+}
+
+// SetBlock creates or updates Block1 or Block2 option with the given value.
+//
+// Returns InvalidBlockSize if the size exponent is above MaxBlockSZX.
+//
+// Returns InvalidBlockNum if the block number does not fit 20 bits.
+func (o *Options) SetBlock(def OptionDef, block BlockValue) error {
+	if block.SZX > MaxBlockSZX {
+		return InvalidBlockSize{
+			SZX: block.SZX,
+		}
+	}
+
+	if block.Num > MaxBlockNum {
+		return InvalidBlockNum{
+			Num: block.Num,
+		}
+	}
+
+	return o.SetUint(def, block.Uint())
+}
+
+// Check validates the Block2 response against the state after the previous block, nil for the first block,
+// and on success sets s to the state after the response. The same state may be passed as s and prev.
+//
+// Returns OptionNotFound if the response carries no Block2 option.
+//
+// Returns BlockSizeChangedUpward if the block size grows, reducing it is allowed.
+//
+// Returns NonContiguousBlock if the block does not follow the previous block.
+//
+// Returns ETagChangedMidTransfer if the ETag differs from the previous blocks.
+//
+// Returns SizeMismatch if Size2 changes or is inconsistent with the transferred payload.
+func (s *BlockTransferState) Check(resp *Response, prev *BlockTransferState) error {
+	block, err := resp.Options.GetBlock(Block2)
+	if err != nil {
+		return err
+	}
+
+	etag, err := resp.Options.GetOpaque(ETag)
+	if err != nil {
+		etag = nil
+	}
+
+	if prev != nil && !bytes.Equal(prev.ETag, etag) {
+		return ETagChangedMidTransfer{
+			Num:      block.Num,
+			Expected: prev.ETag,
+			Actual:   etag,
+		}
+	}
+
+	size := transferSize(resp.Size2, resp.Options, Size2)
+
+	return s.check(Size2, block, etag, size, resp.Payload, prev)
+}
+
+// CheckRequest validates the Block1 request against the state after the previous block, nil for the first block,
+// and on success sets s to the state after the request. The same state may be passed as s and prev.
+//
+// Returns OptionNotFound if the request carries no Block1 option.
+//
+// Returns BlockSizeChangedUpward if the block size grows, reducing it is allowed.
+//
+// Returns NonContiguousBlock if the block does not follow the previous block.
+//
+// Returns SizeMismatch if Size1 changes or is inconsistent with the transferred payload.
+func (s *BlockTransferState) CheckRequest(req *Request, prev *BlockTransferState) error {
+	block, err := req.Options.GetBlock(Block1)
+	if err != nil {
+		return err
+	}
+
+	size := transferSize(req.Size1, req.Options, Size1)
+
+	return s.check(Size1, block, nil, size, req.Payload, prev)
+}
+
+// check validates the block against the previous state and updates the state.
+func (s *BlockTransferState) check(def OptionDef, block BlockValue, etag []byte, size *uint32, payload []byte, prev *BlockTransferState) error {
+	if prev != nil {
+		if block.Size() > prev.Block.Size() {
+			return BlockSizeChangedUpward{
+				Previous: prev.Block.Size(),
+				Size:     block.Size(),
+			}
+		}
+
+		expected := prev.Block.Offset() + uint32(prev.Block.Size())
+		if !prev.Block.More || block.Offset() != expected {
+			return NonContiguousBlock{
+				Expected: expected,
+				Actual:   block.Offset(),
+			}
+		}
+
+		if size == nil {
+			size = prev.Size
+		}
+
+		if size != nil && prev.Size != nil && *size != *prev.Size {
+			return SizeMismatch{
+				Option:   def,
+				Expected: *prev.Size,
+				Actual:   *size,
+			}
+		}
+	}
+
+	end := block.Offset() + uint32(len(payload))
+	if size != nil && (end > *size || !block.More && end != *size) {
+		return SizeMismatch{
+			Option:   def,
+			Expected: *size,
+			Actual:   end,
+		}
+	}
+
+	*s = BlockTransferState{
+		Block: block,
+		ETag:  slices.Clone(etag),
+		Size:  size,
+	}
+
+	return nil
+}
+
+// transferSize returns the total size from the field overriding the option or from the option.
+func transferSize(field *uint32, options Options, def OptionDef) *uint32 {
+	if field != nil {
+		return field
+	}
+
+	size, err := options.GetUint(def)
+	if err != nil {
+		return nil
+	}
+
+	return &size
+}
@@ -0,0 +1,293 @@
+package coap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBlockValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value uint32
+		block BlockValue
+		err   error
+	}{
+		{
+			name:  "first block",
+			value: 0x0e,
+			block: BlockValue{Num: 0, More: true, SZX: 6},
+		},
+		{
+			name:  "middle block",
+			value: 0x2a,
+			block: BlockValue{Num: 2, More: true, SZX: 2},
+		},
+		{
+			name:  "large num",
+			value: 0xfffff4,
+			block: BlockValue{Num: 0xfffff, SZX: 4},
+		},
+		{
+			name:  "reserved size",
+			value: 0x07,
+			err:   InvalidBlockSize{SZX: 7},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block, err := ParseBlockValue(test.value)
+			expectErr(t, err, test.err)
+			if err != nil {
+				return
+			}
+
+			diff := cmp.Diff(test.block, block)
+			if diff != "" {
+				t.Errorf("block mismatch (-want +got):\n%s", diff)
+			}
+
+			if v := block.Uint(); v != test.value {
+				t.Errorf("Uint() = %#x, want %#x", v, test.value)
+			}
+		})
+	}
+
+	block := BlockValue{Num: 3, SZX: 2}
+	if block.Size() != 64 || block.Offset() != 192 {
+		t.Errorf("Size() = %d, Offset() = %d, want 64, 192", block.Size(), block.Offset())
+	}
+}
+
+func TestBlockTransferStateCheck(t *testing.T) {
+	size := func(v uint32) *uint32 {
+		return &v
+	}
+
+	response := func(block BlockValue, payload int, options ...Option) *Response {
+		resp := &Response{
+			Code:    Content,
+			Options: options,
+			Payload: bytes.Repeat([]byte{0x42}, payload),
+		}
+		Must(resp.Options.SetBlock(Block2, block))
+
+		return resp
+	}
+
+	tests := []struct {
+		name  string
+		prev  *BlockTransferState
+		resp  *Response
+		state BlockTransferState
+		err   error
+	}{
+		{
+			name: "first block",
+			resp: response(BlockValue{More: true, SZX: 2}, 64, MustOptionValue(ETag, bytes4), MustOptionValue(Size2, uint32(150))),
+			state: BlockTransferState{
+				Block: BlockValue{More: true, SZX: 2},
+				ETag:  bytes4,
+				Size:  size(150),
+			},
+		},
+		{
+			name: "next block",
+			prev: &BlockTransferState{
+				Block: BlockValue{More: true, SZX: 2},
+				ETag:  bytes4,
+				Size:  size(150),
+			},
+			resp: response(BlockValue{Num: 1, More: true, SZX: 2}, 64, MustOptionValue(ETag, bytes4)),
+			state: BlockTransferState{
+				Block: BlockValue{Num: 1, More: true, SZX: 2},
+				ETag:  bytes4,
+				Size:  size(150),
+			},
+		},
+		{
+			name: "block size reduced",
+			prev: &BlockTransferState{
+				Block: BlockValue{Num: 0, More: true, SZX: 2},
+			},
+			resp: response(BlockValue{Num: 2, SZX: 1}, 10),
+			state: BlockTransferState{
+				Block: BlockValue{Num: 2, SZX: 1},
+			},
+		},
+		{
+			name: "last block",
+			prev: &BlockTransferState{
+				Block: BlockValue{Num: 1, More: true, SZX: 2},
+				Size:  size(150),
+			},
+			resp: response(BlockValue{Num: 2, SZX: 2}, 22),
+			state: BlockTransferState{
+				Block: BlockValue{Num: 2, SZX: 2},
+				Size:  size(150),
+			},
+		},
+		{
+			name: "etag changed",
+			prev: &BlockTransferState{
+				Block: BlockValue{More: true, SZX: 2},
+				ETag:  bytes4,
+			},
+			resp: response(BlockValue{Num: 1, More: true, SZX: 2}, 64, MustOptionValue(ETag, []byte{0x01})),
+			err: ETagChangedMidTransfer{
+				Num:      1,
+				Expected: bytes4,
+				Actual:   []byte{0x01},
+			},
+		},
+		{
+			name: "etag removed",
+			prev: &BlockTransferState{
+				Block: BlockValue{More: true, SZX: 2},
+				ETag:  bytes4,
+			},
+			resp: response(BlockValue{Num: 1, More: true, SZX: 2}, 64),
+			err: ETagChangedMidTransfer{
+				Num:      1,
+				Expected: bytes4,
+			},
+		},
+		{
+			name: "size changed",
+			prev: &BlockTransferState{
+				Block: BlockValue{More: true, SZX: 2},
+				Size:  size(150),
+			},
+			resp: response(BlockValue{Num: 1, More: true, SZX: 2}, 64, MustOptionValue(Size2, uint32(200))),
+			err: SizeMismatch{
+				Option:   Size2,
+				Expected: 150,
+				Actual:   200,
+			},
+		},
+		{
+			name: "payload exceeds size",
+			resp: response(BlockValue{More: true, SZX: 2}, 64, MustOptionValue(Size2, uint32(50))),
+			err: SizeMismatch{
+				Option:   Size2,
+				Expected: 50,
+				Actual:   64,
+			},
+		},
+		{
+			name: "last block short of size",
+			prev: &BlockTransferState{
+				Block: BlockValue{Num: 1, More: true, SZX: 2},
+				Size:  size(150),
+			},
+			resp: response(BlockValue{Num: 2, SZX: 2}, 10),
+			err: SizeMismatch{
+				Option:   Size2,
+				Expected: 150,
+				Actual:   138,
+			},
+		},
+		{
+			name: "skipped block",
+			prev: &BlockTransferState{
+				Block: BlockValue{More: true, SZX: 2},
+			},
+			resp: response(BlockValue{Num: 2, More: true, SZX: 2}, 64),
+			err: NonContiguousBlock{
+				Expected: 64,
+				Actual:   128,
+			},
+		},
+		{
+			name: "block after last",
+			prev: &BlockTransferState{
+				Block: BlockValue{SZX: 2},
+			},
+			resp: response(BlockValue{Num: 1, SZX: 2}, 10),
+			err: NonContiguousBlock{
+				Expected: 64,
+				Actual:   64,
+			},
+		},
+		{
+			name: "block size changed upward",
+			prev: &BlockTransferState{
+				Block: BlockValue{Num: 1, More: true, SZX: 1},
+			},
+			resp: response(BlockValue{Num: 1, More: true, SZX: 2}, 64),
+			err: BlockSizeChangedUpward{
+				Previous: 32,
+				Size:     64,
+			},
+		},
+		{
+			name: "missing block",
+			resp: &Response{Code: Content},
+			err: OptionNotFound{
+				OptionDef: Block2,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := BlockTransferState{}
+			err := state.Check(test.resp, test.prev)
+
+			// errors carrying ETags are not comparable
+			diff := cmp.Diff(test.err, err)
+			if diff != "" {
+				t.Fatalf("error mismatch (-want +got):\n%s", diff)
+			}
+
+			if err != nil {
+				return
+			}
+
+			diff = cmp.Diff(test.state, state)
+			if diff != "" {
+				t.Errorf("state mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBlockTransferStateCheckRequest(t *testing.T) {
+	state := BlockTransferState{}
+	for num, payload := range []int{32, 32, 6} {
+		total := uint32(70)
+		req := &Request{
+			Method:  PUT,
+			Size1:   &total,
+			Payload: make([]byte, payload),
+		}
+		Must(req.Options.SetBlock(Block1, BlockValue{Num: uint32(num), More: num < 2, SZX: 1}))
+
+		prev := &state
+		if num == 0 {
+			prev = nil
+		}
+
+		err := state.CheckRequest(req, prev)
+		if err != nil {
+			t.Fatalf("block %d: %v", num, err)
+		}
+	}
+
+	conflict := uint32(40)
+	req := &Request{
+		Method:  PUT,
+		Size1:   &conflict,
+		Payload: make([]byte, 32),
+	}
+	Must(req.Options.SetBlock(Block1, BlockValue{Num: 1, More: true, SZX: 1}))
+
+	err := state.CheckRequest(req, nil)
+	expectErr(t, err, SizeMismatch{
+		Option:   Size1,
+		Expected: 40,
+		Actual:   64,
+	})
+}
@@ -0,0 +1,245 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+)
+
+// Upload sends the request with its Body, or Payload if Body is nil, in Block1 blocks of the size given
+// by szx and returns the response to the last block. Body is read a block at a time, so that large
+// uploads are not held in memory.
+//
+// Blocks are Confirmable requests awaited like Do, with their own MessageID and the Token of the request,
+// assigned from TokenSource or random if empty. A body fitting a single block is sent as a single request
+// without Block1. If the server asks for smaller blocks in its Continue response, the following blocks use
+// its size. A response other than Continue to an intermediate block ends the transfer and is returned.
+//
+// Returns InvalidBlockSize if szx exceeds MaxBlockSZX.
+//
+// Returns the error of reading Body.
+//
+// Returns errors of Client.Do for any of the blocks.
+//
+// https://datatracker.ietf.org/doc/html/rfc7959#section-2.5
+func (c *Conn) Upload(ctx context.Context, req *Request, addr net.Addr, szx uint8) (*Response, error) {
+	if szx > MaxBlockSZX {
+		return nil, InvalidBlockSize{
+			SZX: szx,
+		}
+	}
+
+	template := *req
+	template.Type = Confirmable
+	template.MessageID = 0
+	template.Payload = nil
+	template.Body = nil
+	if len(template.Token) == 0 {
+		template.Token = c.token(addr)
+	}
+
+	msg, err := template.message()
+	if err != nil {
+		return nil, err
+	}
+
+	body := req.Body
+	if body == nil {
+		body = bytes.NewReader(req.Payload)
+	}
+
+	// buf holds the next block followed by a byte telling whether more blocks follow
+	buf := make([]byte, BlockValue{SZX: szx}.Size()+1)
+	buffered := 0
+	offset := uint32(0)
+	for {
+		block := BlockValue{
+			Num: offset >> (szx + 4),
+			SZX: szx,
+		}
+		size := int(block.Size())
+
+		n, err := io.ReadFull(body, buf[buffered:size+1])
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+		buffered += n
+
+		block.More = buffered > size
+
+		blockMsg := msg
+		blockMsg.Options = slices.Clone(msg.Options)
+		blockMsg.Payload = slices.Clone(buf[:min(buffered, size)])
+		if block.More || block.Num != 0 {
+			Must(blockMsg.Options.SetBlock(Block1, block))
+		}
+
+		resp, err := c.roundTrip(ctx, &blockMsg, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if !block.More || resp.Code != Continue {
+			resp.Request = req
+			return resp, nil
+		}
+
+		offset += uint32(size)
+		buffered = copy(buf, buf[size:buffered])
+
+		// https://datatracker.ietf.org/doc/html/rfc7959#section-2.5
+		if resp.Block1 != nil && resp.Block1.SZX < szx {
+			szx = resp.Block1.SZX
+		}
+	}
+}
+
+// Upload sends the request with Conn.Upload in Block1 blocks of the size given by szx and returns
+// the response to the last block.
+//
+// Returns the error of creating the Conn.
+//
+// Returns errors of Conn.Upload.
+func (c *Client) Upload(ctx context.Context, req *Request, addr net.Addr, szx uint8) (*Response, error) {
+	conn, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(conn)
+
+	return conn.Upload(ctx, req, addr, szx)
+}
+
+// download sends the GET request and requests the following Block2 blocks of the response,
+// returning the last response carrying the reassembled payload. The payload is preallocated
+// from Size2 of the first block, up to MaxReassemblyLength.
+//
+// Returns ResponseRejected if a block is answered with a code other than Content.
+//
+// Returns PayloadTooLong if the reassembled payload exceeds MaxReassemblyLength.
+//
+// https://datatracker.ietf.org/doc/html/rfc7959#section-3.1
+func (c *Client) download(ctx context.Context, req *Request) (*Response, error) {
+	// the Conn is kept for all blocks instead of being released after each of them
+	conn, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(conn)
+
+	state := BlockTransferState{}
+	var (
+		prev    *BlockTransferState
+		payload []byte
+	)
+
+	for {
+		resp, err := c.Do(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Code != Content {
+			rejected := ResponseRejected{
+				Code: resp.Code,
+			}
+
+			addr, err := c.resolve(req)
+			if err == nil {
+				rejected.Addr = addr
+			}
+
+			return nil, rejected
+		}
+
+		if resp.Block2 == nil && prev == nil {
+			return resp, nil
+		}
+
+		err = state.Check(resp, prev)
+		if err != nil {
+			return nil, err
+		}
+
+		if prev == nil {
+			// https://datatracker.ietf.org/doc/html/rfc7959#section-4
+			size, ok := resp.TotalSize()
+			if ok {
+				payload = make([]byte, 0, min(size, MaxReassemblyLength))
+			}
+		}
+
+		length := len(payload) + len(resp.Payload)
+		if length > MaxReassemblyLength {
+			return nil, PayloadTooLong{
+				Limit:  MaxReassemblyLength,
+				Length: uint(length),
+			}
+		}
+
+		payload = append(payload, resp.Payload...)
+		if !state.Block.More {
+			resp.Payload = payload
+			return resp, nil
+		}
+
+		// each block is a request of its own
+		next := *req
+		next.MessageID = 0
+		next.Token = nil
+		next.Block2 = &BlockValue{
+			Num: state.Block.Num + 1,
+			SZX: state.Block.SZX,
+		}
+
+		req = &next
+		prev = &state
+	}
+}
+
+// readBlock reads the block of body, which is read up to the offset read, seeking to the block if body
+// is an io.Seeker and discarding the data preceding it otherwise.
+//
+// Returns the rest of body following the block if more data follows it, nil otherwise.
+func readBlock(body io.Reader, read uint32, block BlockValue) ([]byte, io.Reader, error) {
+	offset := block.Offset()
+	if seeker, ok := body.(io.Seeker); ok {
+		_, err := seeker.Seek(int64(offset), io.SeekStart)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		_, err := io.CopyN(io.Discard, body, int64(offset-read))
+		if errors.Is(err, io.EOF) {
+			return nil, nil, nil // block past the end of body
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	size := int(block.Size())
+	buf := make([]byte, size+1)
+	n, err := io.ReadFull(body, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, nil, err
+	}
+
+	if n <= size {
+		return buf[:n], nil, nil
+	}
+
+	// the byte read past the block tells that more data follows, the rest starts with it
+	return buf[:size], io.MultiReader(bytes.NewReader(buf[size:]), body), nil
+}
+
+// blockBody is the rest of a response body which cannot seek following the offset, kept so that the request
+// for the next block continues reading where the previous block ended instead of discarding the body up
+// to it again.
+type blockBody struct {
+	rest   io.Reader
+	offset uint32
+}
@@ -0,0 +1,422 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// blockwiseTest serves the handler on one end of a pipe and returns the client on the other.
+func blockwiseTest(t *testing.T, handler HandlerFunc) (*Client, net.Addr) {
+	t.Helper()
+
+	a, b := newPipe()
+	server := NewConn(b, testConnOptions())
+	client := &Client{
+		ConnOptions: testConnOptions(),
+		PacketConn:  a,
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	go func() {
+		_ = NewServer(server, handler, ServerOptions{}).Serve(context.Background())
+	}()
+
+	return client, server.LocalAddr()
+}
+
+// onlyReader hides io.Seeker of the reader.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestClientUpload(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 250)
+
+	tests := []struct {
+		name    string
+		req     *Request
+		szx     uint8
+		prefer  uint8
+		reject  uint32
+		blocks  []BlockValue
+		payload []byte
+		code    ResponseCode
+	}{
+		{
+			name: "body",
+			req: &Request{
+				Method: PUT,
+				Path:   "/firmware",
+				Body:   onlyReader{bytes.NewReader(body)},
+			},
+			szx: 6,
+			blocks: []BlockValue{
+				{Num: 0, More: true, SZX: 6},
+				{Num: 1, More: true, SZX: 6},
+				{Num: 2, More: false, SZX: 6},
+			},
+			payload: body,
+			code:    Changed,
+		},
+		{
+			name: "server prefers smaller blocks",
+			req: &Request{
+				Method: PUT,
+				Path:   "/firmware",
+				Body:   bytes.NewReader(body),
+			},
+			szx:    6,
+			prefer: 5,
+			blocks: []BlockValue{
+				{Num: 0, More: true, SZX: 6},
+				{Num: 2, More: true, SZX: 5},
+				{Num: 3, More: true, SZX: 5},
+				{Num: 4, More: false, SZX: 5},
+			},
+			payload: body,
+			code:    Changed,
+		},
+		{
+			name: "single block",
+			req: &Request{
+				Method:  POST,
+				Path:    "/log",
+				Payload: []byte("short"),
+			},
+			szx:     6,
+			payload: []byte("short"),
+			code:    Changed,
+		},
+		{
+			name: "rejected",
+			req: &Request{
+				Method: PUT,
+				Path:   "/firmware",
+				Body:   strings.NewReader(string(body)),
+			},
+			szx:    4,
+			reject: 1,
+			blocks: []BlockValue{
+				{Num: 0, More: true, SZX: 4},
+				{Num: 1, More: true, SZX: 4},
+			},
+			payload: body[:512],
+			code:    RequestEntityTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				mtx      sync.Mutex
+				blocks   []BlockValue
+				received []byte
+			)
+
+			client, addr := blockwiseTest(t, func(_ context.Context, w ResponseWriter, r *Request) {
+				mtx.Lock()
+				defer mtx.Unlock()
+
+				received = append(received, r.Payload...)
+
+				block, err := r.Options.GetBlock(Block1)
+				if err != nil {
+					_ = w.Write(&Response{
+						Code: Changed,
+					})
+					return
+				}
+				blocks = append(blocks, block)
+
+				if test.reject != 0 && block.Num == test.reject {
+					_ = w.Write(&Response{
+						Code: RequestEntityTooLarge,
+					})
+					return
+				}
+
+				if !block.More {
+					_ = w.Write(&Response{
+						Code: Changed,
+					})
+					return
+				}
+
+				if test.prefer != 0 {
+					block.SZX = test.prefer
+				}
+
+				resp := &Response{
+					Code: Continue,
+				}
+				Must(resp.Options.SetBlock(Block1, block))
+				_ = w.Write(resp)
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			resp, err := client.Upload(ctx, test.req, addr, test.szx)
+			if err != nil {
+				t.Fatal("upload:", err)
+			}
+
+			if resp.Code != test.code {
+				t.Errorf("code = %s, want %s", resp.Code, test.code)
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			diff := cmp.Diff(test.blocks, blocks)
+			if diff != "" {
+				t.Errorf("blocks mismatch (-want +got):\n%s", diff)
+			}
+
+			if !bytes.Equal(received, test.payload) {
+				t.Errorf("received %d bytes, want %d", len(received), len(test.payload))
+			}
+		})
+	}
+}
+
+func TestClientUploadInvalidBlockSize(t *testing.T) {
+	a, b := newPipe()
+	client := &Client{
+		ConnOptions: testConnOptions(),
+		PacketConn:  a,
+	}
+	defer client.Close()
+
+	_, err := client.Upload(context.Background(), &Request{Method: PUT}, b.LocalAddr(), 7)
+	expectErr(t, err, InvalidBlockSize{
+		SZX: 7,
+	})
+}
+
+func TestServerBody(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 250)
+	total := uint32(len(body))
+
+	tests := []struct {
+		name    string
+		body    func() io.Reader
+		block2  *BlockValue
+		size2   bool
+		want    *BlockValue
+		payload []byte
+		total   *uint32
+	}{
+		{
+			name: "first block",
+			body: func() io.Reader {
+				return bytes.NewReader(body)
+			},
+			want:    &BlockValue{Num: 0, More: true, SZX: 6},
+			payload: body[:1024],
+			total:   &total,
+		},
+		{
+			name: "requested block",
+			body: func() io.Reader {
+				return bytes.NewReader(body)
+			},
+			block2:  &BlockValue{Num: 1, SZX: 6},
+			want:    &BlockValue{Num: 1, More: true, SZX: 6},
+			payload: body[1024:2048],
+		},
+		{
+			name: "requested size",
+			body: func() io.Reader {
+				return bytes.NewReader(body)
+			},
+			block2:  &BlockValue{Num: 1, SZX: 6},
+			size2:   true,
+			want:    &BlockValue{Num: 1, More: true, SZX: 6},
+			payload: body[1024:2048],
+			total:   &total,
+		},
+		{
+			name: "last block without seeking",
+			body: func() io.Reader {
+				return onlyReader{bytes.NewReader(body)}
+			},
+			block2:  &BlockValue{Num: 4, SZX: 5},
+			want:    &BlockValue{Num: 4, More: false, SZX: 5},
+			payload: body[2048:],
+		},
+		{
+			name: "single block",
+			body: func() io.Reader {
+				return strings.NewReader("short")
+			},
+			payload: []byte("short"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+				err := w.Write(&Response{
+					Code: Content,
+					Body: test.body(),
+				})
+				if err != nil {
+					t.Error("write:", err)
+				}
+			}))
+
+			req := testRequest()
+			if test.block2 != nil {
+				Must(req.Options.SetBlock(Block2, *test.block2))
+			}
+			if test.size2 {
+				Must(req.Options.SetUint(Size2, 0))
+			}
+			s.send(req)
+
+			resp := s.receive()
+			if resp == nil {
+				t.Fatal("expected response")
+			}
+
+			var got *BlockValue
+			block, err := resp.Options.GetBlock(Block2)
+			if err == nil {
+				got = &block
+			}
+
+			diff := cmp.Diff(test.want, got)
+			if diff != "" {
+				t.Errorf("Block2 mismatch (-want +got):\n%s", diff)
+			}
+
+			if !bytes.Equal(resp.Payload, test.payload) {
+				t.Errorf("payload of %d bytes, want %d", len(resp.Payload), len(test.payload))
+			}
+
+			var size2 *uint32
+			size, err := resp.Options.GetUint(Size2)
+			if err == nil {
+				size2 = &size
+			}
+
+			diff = cmp.Diff(test.total, size2)
+			if diff != "" {
+				t.Errorf("Size2 mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRequestBodyEncoded(t *testing.T) {
+	withBody := &Request{
+		Method: POST,
+		Body:   strings.NewReader("payload"),
+	}
+
+	withPayload := &Request{
+		Method:  POST,
+		Payload: []byte("payload"),
+	}
+
+	diff := cmp.Diff(MustValue(withPayload.MarshalBinary()), MustValue(withBody.MarshalBinary()))
+	if diff != "" {
+		t.Errorf("encoding mismatch (-want +got):\n%s", diff)
+	}
+
+	// Payload takes precedence, Body is left unread
+	body := strings.NewReader("body")
+	withBoth := &Request{
+		Method:  POST,
+		Payload: []byte("payload"),
+		Body:    body,
+	}
+
+	diff = cmp.Diff(MustValue(withPayload.MarshalBinary()), MustValue(withBoth.MarshalBinary()))
+	if diff != "" {
+		t.Errorf("encoding mismatch (-want +got):\n%s", diff)
+	}
+
+	if body.Len() != len("body") {
+		t.Errorf("%d bytes of body left, want body unread", body.Len())
+	}
+
+	// bodies longer than a single message are sent with Upload
+	long := &Request{
+		Method: POST,
+		Body:   strings.NewReader(strings.Repeat("x", 64)),
+	}
+
+	_, err := long.Encode(nil, MarshalOptions{MaxPayloadLength: 16})
+	expectErr(t, err, PayloadTooLong{Limit: 16, Length: 17})
+}
+
+// countingReader counts the bytes read from the reader.
+type countingReader struct {
+	io.Reader
+	read *atomic.Int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read.Add(int64(n))
+
+	return n, err
+}
+
+func TestServerBodyContinued(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 250)
+
+	read := &atomic.Int64{}
+	s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code: Content,
+			Body: countingReader{onlyReader{bytes.NewReader(body)}, read},
+		})
+	}))
+
+	received := []byte{}
+	for num := uint32(0); ; num++ {
+		req := testRequest()
+		req.ID += MessageID(num)
+		Must(req.Options.SetBlock(Block2, BlockValue{Num: num, SZX: 4}))
+		s.send(req)
+
+		resp := s.receive()
+		if resp == nil {
+			t.Fatalf("block %d: expected response", num)
+		}
+		received = append(received, resp.Payload...)
+
+		block, err := resp.Options.GetBlock(Block2)
+		if err != nil {
+			t.Fatalf("block %d: %v", num, err)
+		}
+
+		if !block.More {
+			break
+		}
+	}
+
+	if !bytes.Equal(received, body) {
+		t.Errorf("received %d bytes, want %d", len(received), len(body))
+	}
+
+	// blocks continue the body read for the first one instead of discarding their own up to the block
+	if read.Load() != int64(len(body)) {
+		t.Errorf("read %d bytes of bodies, want %d", read.Load(), len(body))
+	}
+}
@@ -0,0 +1,249 @@
+package coap
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// MaxPeers is the default number of peers tracked by PeerTable.
+	MaxPeers = 1024
+
+	// OverloadMaxAge is the default Max-Age in seconds of Service Unavailable responses sent to peers over budget.
+	OverloadMaxAge = 5
+)
+
+// PeerID identifies a remote peer by its address.
+type PeerID string
+
+// BudgetOptions holds per-peer limits enforced on the read path before decoding.
+type BudgetOptions struct {
+	// MaxBytesPerSecond is the sustained rate of bytes received per peer, zero disables the limit.
+	MaxBytesPerSecond uint
+
+	// MaxBurstBytes is the number of bytes a peer may send at once, defaults to MaxBytesPerSecond.
+	MaxBurstBytes uint
+
+	// MaxInFlight is the maximum number of requests per peer being handled by a Server, zero disables the limit.
+	MaxInFlight uint
+
+	// MaxPeers is the number of peers tracked, least recently seen peers are evicted, defaults to MaxPeers.
+	MaxPeers uint
+
+	// OverloadMaxAge is the Max-Age of Service Unavailable responses, defaults to OverloadMaxAge.
+	OverloadMaxAge uint32
+
+	// OverloadHandler is called with the offending peer when a datagram is rejected.
+	OverloadHandler func(peer PeerID, err error)
+}
+
+// PeerTable tracks per-peer budgets using a token bucket of received bytes and a count of requests in flight.
+type PeerTable struct {
+	opts  BudgetOptions
+	clock Clock
+
+	mtx   sync.Mutex
+	peers map[PeerID]*peerState
+}
+
+type peerState struct {
+	tokens   float64
+	updated  time.Time
+	inFlight uint
+
+	// identity is resolved on first use, see Conn.Identity
+	identity *PeerIdentity
+
+	// srtt and rttvar are the smoothed round-trip time and its variance, zero srtt if not sampled yet
+	srtt   time.Duration
+	rttvar time.Duration
+}
+
+// NewPeerTable instantiates a new PeerTable with the given options.
+//
+// If clock is nil, it defaults to RealClock.
+func NewPeerTable(opts BudgetOptions, clock Clock) *PeerTable {
+	if opts.MaxBurstBytes == 0 {
+		opts.MaxBurstBytes = opts.MaxBytesPerSecond
+	}
+
+	if opts.MaxPeers == 0 {
+		opts.MaxPeers = MaxPeers
+	}
+
+	if opts.OverloadMaxAge == 0 {
+		opts.OverloadMaxAge = OverloadMaxAge
+	}
+
+	if clock == nil {
+		clock = RealClock
+	}
+
+	return &PeerTable{
+		opts:  opts,
+		clock: clock,
+		peers: map[PeerID]*peerState{},
+	}
+}
+
+// Enabled reports whether any budget is configured.
+func (t *PeerTable) Enabled() bool {
+	return t.opts.MaxBytesPerSecond != 0 || t.opts.MaxInFlight != 0
+}
+
+// Admit charges a datagram of length n against the peer budget.
+//
+// Returns RateLimitExceeded if the peer sent more bytes than its budget allows.
+//
+// Returns InFlightLimitExceeded if the datagram is a request and the peer has too many requests in flight.
+// Requests are counted in flight by Start, not by Admit, so that datagrams failing to decode are not counted.
+func (t *PeerTable) Admit(peer PeerID, n int, request bool) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := t.clock.Now()
+	state := t.peer(peer, now)
+	t.refill(state, now)
+
+	if t.opts.MaxBytesPerSecond != 0 && state.tokens < float64(n) {
+		return RateLimitExceeded{
+			Peer:              peer,
+			MaxBytesPerSecond: t.opts.MaxBytesPerSecond,
+		}
+	}
+
+	if request && t.opts.MaxInFlight != 0 && state.inFlight >= t.opts.MaxInFlight {
+		return InFlightLimitExceeded{
+			Peer:        peer,
+			MaxInFlight: t.opts.MaxInFlight,
+		}
+	}
+
+	state.tokens -= float64(n)
+
+	return nil
+}
+
+// Start counts a decoded request from the peer in flight until Done is called.
+func (t *PeerTable) Start(peer PeerID) {
+	if t.opts.MaxInFlight == 0 {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	state := t.peer(peer, t.clock.Now())
+	state.inFlight++
+}
+
+// Done marks a request from the peer counted by Start as completed.
+func (t *PeerTable) Done(peer PeerID) {
+	if t.opts.MaxInFlight == 0 {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	state, ok := t.peers[peer]
+	if ok && state.inFlight != 0 {
+		state.inFlight--
+	}
+}
+
+// ObserveRTT updates the smoothed round-trip time of the peer and its variance with a sample.
+//
+// https://datatracker.ietf.org/doc/html/rfc6298#section-2
+func (t *PeerTable) ObserveRTT(peer PeerID, rtt time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := t.clock.Now()
+	state := t.peer(peer, now)
+	t.refill(state, now)
+
+	if state.srtt == 0 {
+		state.srtt = max(rtt, 1)
+		state.rttvar = rtt / 2
+		return
+	}
+
+	// RTTVAR <- (1 - beta) * RTTVAR + beta * |SRTT - R'| and SRTT <- (1 - alpha) * SRTT + alpha * R'
+	// with alpha = 1/8 and beta = 1/4
+	deviation := state.srtt - rtt
+	if deviation < 0 {
+		deviation = -deviation
+	}
+
+	state.rttvar = (3*state.rttvar + deviation) / 4
+	state.srtt = max((7*state.srtt+rtt)/8, 1)
+}
+
+// RTT returns the smoothed round-trip time of the peer and its variance.
+//
+// Returns false if no round-trip time of the peer was observed.
+func (t *PeerTable) RTT(peer PeerID) (srtt time.Duration, rttvar time.Duration, ok bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	state, ok := t.peers[peer]
+	if !ok || state.srtt == 0 {
+		return 0, 0, false
+	}
+
+	return state.srtt, state.rttvar, true
+}
+
+// Len returns the number of tracked peers.
+func (t *PeerTable) Len() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return len(t.peers)
+}
+
+// peer returns the state of the peer, evicting the least recently seen peer when the table is full.
+func (t *PeerTable) peer(peer PeerID, now time.Time) *peerState {
+	state, ok := t.peers[peer]
+	if ok {
+		return state
+	}
+
+	if uint(len(t.peers)) >= t.opts.MaxPeers {
+		t.evict()
+	}
+
+	state = &peerState{
+		tokens:  float64(t.opts.MaxBurstBytes),
+		updated: now,
+	}
+	t.peers[peer] = state
+
+	return state
+}
+
+// refill adds the bytes the peer earned since it was last seen to its budget and marks it seen now.
+func (t *PeerTable) refill(state *peerState, now time.Time) {
+	if t.opts.MaxBytesPerSecond != 0 {
+		elapsed := now.Sub(state.updated).Seconds()
+		state.tokens = min(state.tokens+elapsed*float64(t.opts.MaxBytesPerSecond), float64(t.opts.MaxBurstBytes))
+	}
+	state.updated = now
+}
+
+func (t *PeerTable) evict() {
+	var (
+		oldest  PeerID
+		updated time.Time
+	)
+
+	for id, state := range t.peers {
+		if updated.IsZero() || state.updated.Before(updated) {
+			oldest = id
+			updated = state.updated
+		}
+	}
+
+	delete(t.peers, oldest)
+}
@@ -0,0 +1,239 @@
+package coap
+
+import (
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uramaki-io/coap/internal/deadline"
+)
+
+func TestPeerTableRate(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	table := NewPeerTable(BudgetOptions{
+		MaxBytesPerSecond: 100,
+	}, clock)
+
+	expectErr(t, table.Admit("a", 60, false), nil)
+	expectErr(t, table.Admit("a", 60, false), RateLimitExceeded{
+		Peer:              "a",
+		MaxBytesPerSecond: 100,
+	})
+
+	// budget decays back over time
+	clock.Advance(200 * time.Millisecond)
+	expectErr(t, table.Admit("a", 60, false), nil)
+
+	// bucket never exceeds burst size
+	clock.Advance(time.Hour)
+	expectErr(t, table.Admit("a", 100, false), nil)
+	expectErr(t, table.Admit("a", 1, false), RateLimitExceeded{
+		Peer:              "a",
+		MaxBytesPerSecond: 100,
+	})
+}
+
+func TestPeerTableInFlight(t *testing.T) {
+	table := NewPeerTable(BudgetOptions{
+		MaxInFlight: 2,
+	}, newFakeClock(time.Unix(0, 0)))
+
+	// admitted requests are not counted until started
+	expectErr(t, table.Admit("a", 10, true), nil)
+	expectErr(t, table.Admit("a", 10, true), nil)
+	expectErr(t, table.Admit("a", 10, true), nil)
+
+	table.Start("a")
+	table.Start("a")
+	expectErr(t, table.Admit("a", 10, true), InFlightLimitExceeded{
+		Peer:        "a",
+		MaxInFlight: 2,
+	})
+
+	// responses are never limited
+	expectErr(t, table.Admit("a", 10, false), nil)
+
+	table.Done("a")
+	expectErr(t, table.Admit("a", 10, true), nil)
+}
+
+func TestPeerTableRTTSeen(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	table := NewPeerTable(BudgetOptions{
+		MaxPeers: 2,
+	}, clock)
+
+	expectErr(t, table.Admit("a", 10, false), nil)
+	clock.Advance(time.Millisecond)
+	expectErr(t, table.Admit("b", 10, false), nil)
+	clock.Advance(time.Millisecond)
+
+	// round-trip time samples mark the peer as seen, so b is the least recently seen
+	table.ObserveRTT("a", 100*time.Millisecond)
+	clock.Advance(time.Millisecond)
+	expectErr(t, table.Admit("c", 10, false), nil)
+
+	_, _, ok := table.RTT("a")
+	if !ok {
+		t.Error("expected round-trip time of a to be kept")
+	}
+
+	table.mtx.Lock()
+	_, ok = table.peers["b"]
+	table.mtx.Unlock()
+	if ok {
+		t.Error("expected b to be evicted")
+	}
+}
+
+func TestPeerTableEviction(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	table := NewPeerTable(BudgetOptions{
+		MaxBytesPerSecond: 100,
+		MaxPeers:          2,
+	}, clock)
+
+	for _, peer := range []PeerID{"a", "b", "c"} {
+		expectErr(t, table.Admit(peer, 100, false), nil)
+		clock.Advance(time.Millisecond)
+	}
+
+	if table.Len() != 2 {
+		t.Errorf("len = %d, want 2", table.Len())
+	}
+
+	// evicted peer starts with a full budget
+	expectErr(t, table.Admit("a", 100, false), nil)
+}
+
+// scriptedConn delivers scripted datagrams and records writes.
+type scriptedConn struct {
+	mtx    sync.Mutex
+	rx     []deadline.Datagram
+	writes []deadline.Datagram
+}
+
+func (c *scriptedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if len(c.rx) == 0 {
+		return 0, nil, io.EOF
+	}
+
+	d := c.rx[0]
+	c.rx = c.rx[1:]
+
+	return copy(b, d.Data), d.Addr, nil
+}
+
+func (c *scriptedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.writes = append(c.writes, deadline.Datagram{
+		Data: slices.Clone(b),
+		Addr: addr,
+	})
+
+	return len(b), nil
+}
+
+func (c *scriptedConn) Close() error                       { return nil }
+func (c *scriptedConn) LocalAddr() net.Addr                { return pipeAddr("scripted") }
+func (c *scriptedConn) SetDeadline(_ time.Time) error      { return nil }
+func (c *scriptedConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c *scriptedConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+func TestConnBudget(t *testing.T) {
+	hot := pipeAddr("hot")
+	quiet := pipeAddr("quiet")
+
+	delegate := &scriptedConn{}
+	for id := range MessageID(20) {
+		msg := &Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Confirmable,
+				Code:    Code(POST),
+				ID:      id,
+				Token:   bytes4,
+			},
+		}
+
+		addr := quiet
+		if id%2 == 0 {
+			addr = hot
+			msg.Payload = bytes272
+		}
+
+		data, err := msg.AppendBinary(nil)
+		if err != nil {
+			t.Fatal("encode:", err)
+		}
+
+		delegate.rx = append(delegate.rx, deadline.Datagram{
+			Data: data,
+			Addr: addr,
+		})
+	}
+
+	overloaded := map[PeerID]int{}
+	opts := testConnOptions()
+	opts.Clock = newFakeClock(time.Unix(0, 0))
+	opts.BudgetOptions = BudgetOptions{
+		MaxBytesPerSecond: 1000,
+		OverloadHandler: func(peer PeerID, _ error) {
+			overloaded[peer]++
+		},
+	}
+
+	conn := NewConn(delegate, opts)
+	defer conn.Close()
+
+	received := map[string]int{}
+	for {
+		msg := &Message{}
+		addr, err := conn.Read(msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+
+		received[addr.String()]++
+	}
+
+	if received[quiet.String()] != 10 {
+		t.Errorf("quiet peer received = %d, want 10", received[quiet.String()])
+	}
+
+	if received[hot.String()] >= 10 {
+		t.Errorf("hot peer received = %d, want throttled", received[hot.String()])
+	}
+
+	if overloaded[PeerID(hot)] != 10-received[hot.String()] || overloaded[PeerID(quiet)] != 0 {
+		t.Errorf("overloaded = %v", overloaded)
+	}
+
+	for _, d := range delegate.writes {
+		resp := &Message{}
+		_, err := resp.Decode(d.Data, MarshalOptions{})
+		if err != nil {
+			t.Fatal("decode:", err)
+		}
+
+		maxAge, err := resp.Options.GetUint(MaxAge)
+		if d.Addr != hot || resp.Type != Acknowledgement || resp.Code != Code(ServiceUnavailable) || err != nil || maxAge != OverloadMaxAge {
+			t.Errorf("unexpected write to %v: %v %v max-age %d", d.Addr, resp.Type, resp.Code, maxAge)
+		}
+	}
+
+	if len(delegate.writes) != overloaded[PeerID(hot)] {
+		t.Errorf("writes = %d, want %d", len(delegate.writes), overloaded[PeerID(hot)])
+	}
+}
@@ -0,0 +1,514 @@
+package coap
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// GatheredResponse is a response collected by Conn.Gather with the address it was received from.
+type GatheredResponse struct {
+	Resp *Response
+	From net.Addr
+}
+
+// clientCall is a request awaiting its response.
+type clientCall struct {
+	id      MessageID
+	addr    net.Addr
+	results chan callResult
+
+	// reserved is set if register reserved the MessageID, send releases it on failure
+	reserved bool
+
+	// gather keeps the call awaiting responses from any address, collected in gathered
+	gather   bool
+	gathered []callResult
+}
+
+// callResult is the response or reset received for a call, or the error completing its exchange.
+type callResult struct {
+	msg  *Message
+	from net.Addr
+	err  error
+}
+
+// Gather writes the message, typically a NonConfirmable request to a multicast or broadcast address,
+// and collects all responses with a matching token received within the window from any address.
+//
+// The message is assigned a MessageID and, if empty, a Token from TokenSource or a random one.
+// The window is measured by the Clock. Confirmable responses are acknowledged.
+//
+// Responses are read by the dispatcher of the Conn, see Read.
+//
+// Returns responses collected so far with the context error if the context is done before the window ends.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-8.2
+func (c *Conn) Gather(ctx context.Context, msg *Message, addr net.Addr, window time.Duration) ([]GatheredResponse, error) {
+	call := &clientCall{
+		gather: true,
+	}
+
+	err := c.register(msg, addr, call)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(msg, call)
+
+	err = c.send(ctx, msg, addr, call)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := c.opts.Clock.NewTimer(window)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C():
+	}
+
+	c.callMtx.Lock()
+	received := call.gathered
+	call.gathered = nil
+	c.callMtx.Unlock()
+
+	gathered := []GatheredResponse{}
+	for _, result := range received {
+		resp := &Response{}
+		if resp.fromMessage(result.msg, c.opts.MarshalOptions) != nil {
+			continue
+		}
+
+		gathered = append(gathered, GatheredResponse{
+			Resp: resp,
+			From: result.from,
+		})
+	}
+
+	return gathered, err
+}
+
+// Do sends the request to the address and returns the response.
+//
+// The request is assigned a MessageID not in flight and, if empty, a Token from TokenSource or a random one.
+// Confirmable responses are acknowledged. If the context is done before the response arrives,
+// retransmission of the request stops. A request with Body is sent with Upload in blocks of MaxBlockSZX.
+//
+// Responses are read by the dispatcher of the Conn, see Read.
+//
+// Returns ExchangeReset if the peer rejects the request with a Reset.
+//
+// Returns the error ending retransmission of a Confirmable request before it is acknowledged, such as
+// RetransmitRetryLimit, RetransmitWaitLimit or DeadlineExceeded. The error is also passed to the ErrorHandler.
+//
+// Returns ExchangeEvicted if the request is evicted from the requests awaiting responses.
+//
+// Returns the context error if the context is done before the response arrives.
+func (c *Conn) Do(ctx context.Context, req *Request, addr net.Addr) (*Response, error) {
+	if req.Body != nil {
+		return c.Upload(ctx, req, addr, MaxBlockSZX)
+	}
+
+	msg, err := req.message()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.roundTrip(ctx, &msg, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Request = req
+	return resp, nil
+}
+
+// roundTrip sends the message to the address and awaits its response.
+//
+// Returns ExchangeReset if the peer rejects the message with a Reset.
+//
+// Returns the error ending retransmission of a Confirmable message before it is acknowledged.
+//
+// Returns ExchangeEvicted if the call is evicted from the calls awaiting responses.
+//
+// Returns the context error if the context is done before the response arrives.
+func (c *Conn) roundTrip(ctx context.Context, msg *Message, addr net.Addr) (*Response, error) {
+	call := &clientCall{
+		results: make(chan callResult, 1),
+	}
+
+	err := c.register(msg, addr, call)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(msg, call)
+
+	err = c.send(ctx, msg, addr, call)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		if msg.Type == Confirmable {
+			c.cancel(msg.ID)
+		}
+
+		return nil, ctx.Err()
+	case result := <-call.results:
+		return c.response(result)
+	}
+}
+
+// register assigns the Token and MessageID of the message and registers the call awaiting its responses.
+//
+// Both are final before the call is registered, so that a response, a reset or an error completing
+// the exchange cannot arrive for a call without them. MessageIDs of Confirmable messages are reserved
+// at once, until the exchange completes or send fails.
+func (c *Conn) register(msg *Message, addr net.Addr, call *clientCall) error {
+	if len(msg.Token) == 0 {
+		msg.Token = c.token(addr)
+	}
+
+	var err error
+	msg.Token, err = c.opts.TokenPolicy.check(msg.Token)
+	if err != nil {
+		return err
+	}
+
+	if msg.ID == 0 {
+		// reserved at once, so that concurrent calls are not assigned the same ID
+		call.reserved = msg.Type == Confirmable
+		msg.ID, err = c.inflight.allocate(c.opts.MessageIDSource, call.reserved)
+		if err != nil {
+			return err
+		}
+	}
+
+	call.id = msg.ID
+	if !call.gather {
+		call.addr = addr
+	}
+
+	c.callMtx.Lock()
+	c.calls.Put(msg.Token, call, c.opts.Clock.Now().Add(ExchangeLifetime))
+	c.callMtx.Unlock()
+
+	c.dispatch()
+
+	return nil
+}
+
+// send writes the message of the call like WriteContext, releasing the MessageID reserved by register
+// if the message does not enter the retransmit queue.
+func (c *Conn) send(ctx context.Context, msg *Message, addr net.Addr, call *clientCall) error {
+	err := ctx.Err()
+	if err != nil {
+		if call.reserved {
+			c.inflight.remove(msg.ID)
+		}
+
+		return err
+	}
+
+	return c.write(ctx, msg, addr, call.reserved)
+}
+
+// unregister stops awaiting responses to the message.
+func (c *Conn) unregister(msg *Message, call *clientCall) {
+	c.callMtx.Lock()
+	// token may be reused by a registration of an observation meanwhile
+	pending, ok := c.calls.Get(msg.Token)
+	if ok && pending == call {
+		c.calls.Delete(msg.Token)
+	}
+	c.callMtx.Unlock()
+}
+
+// evict fails the call evicted from the calls awaiting responses, unless it gathers responses.
+//
+// It is called by the store of calls, with callMtx held by the caller of the store.
+func (c *Conn) evict(_ Token, call *clientCall, reason EvictionReason) {
+	if call.gather {
+		return
+	}
+
+	call.results <- callResult{
+		err: ExchangeEvicted{
+			Addr:   call.addr,
+			Reason: reason,
+		},
+	}
+}
+
+// fail passes the error completing the exchange of the Confirmable message to the call awaiting it
+// and stops awaiting it.
+func (c *Conn) fail(msg *Message, err error) {
+	c.callMtx.Lock()
+	defer c.callMtx.Unlock()
+
+	call, ok := c.calls.Get(msg.Token)
+	if !ok || call.id != msg.ID || call.gather {
+		return
+	}
+
+	c.calls.Delete(msg.Token)
+	call.results <- callResult{
+		err: err,
+	}
+}
+
+// response returns the response of the result received for a call.
+//
+// Returns ExchangeReset if the result is a Reset, or the error of the result.
+func (c *Conn) response(result callResult) (*Response, error) {
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	if result.msg.Type == Reset {
+		return nil, ExchangeReset{
+			Addr: result.from,
+		}
+	}
+
+	resp := &Response{}
+	err := resp.fromMessage(result.msg, c.opts.MarshalOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// token returns a token for a request to the address from TokenPolicy.Derive, TokenSource or a random one.
+func (c *Conn) token(addr net.Addr) Token {
+	tokenSource := c.opts.TokenSource
+	if tokenSource == nil {
+		tokenSource = RandTokenSource(TokenLength)
+	}
+
+	return c.opts.TokenPolicy.source(tokenSource, addr)
+}
+
+// divert passes a response or reset read by the dispatcher to the call awaiting it.
+//
+// Confirmable responses passed to calls are acknowledged. Responses colliding with a call awaiting
+// a response from another address are rejected and passed to TokenPolicy.OnCollision instead, late
+// responses piggybacked on acknowledgements of previous messages with the token are dropped.
+//
+// Returns false if no call awaits the message, which is then queued for Read.
+func (c *Conn) divert(msg *Message, addr net.Addr) bool {
+	if !msg.Code.IsResponse() && msg.Type != Reset {
+		return false
+	}
+
+	c.callMtx.Lock()
+	collision, collided := c.collision(msg, addr)
+	var (
+		call *clientCall
+		late bool
+	)
+	if !collided {
+		call, late = c.awaiting(msg)
+	}
+	c.callMtx.Unlock()
+
+	switch {
+	case collided:
+		if msg.Type == Confirmable {
+			_ = c.tx.Write(&Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    Reset,
+					ID:      msg.ID,
+				},
+			}, addr)
+		}
+
+		c.opts.TokenPolicy.OnCollision(collision)
+		return true
+	case late:
+		return true
+	case call == nil:
+		return false
+	}
+
+	if msg.Type == Confirmable {
+		_ = c.tx.Write(&Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Acknowledgement,
+				ID:      msg.ID,
+			},
+		}, addr)
+	}
+
+	result := callResult{
+		msg:  msg,
+		from: addr,
+	}
+
+	if call.gather {
+		c.callMtx.Lock()
+		call.gathered = append(call.gathered, result)
+		c.callMtx.Unlock()
+
+		return true
+	}
+
+	call.results <- result
+
+	return true
+}
+
+// collision returns the collision of the response with a call awaiting its response from another address,
+// if TokenPolicy.OnCollision is set.
+func (c *Conn) collision(msg *Message, addr net.Addr) (TokenCollision, bool) {
+	if c.opts.TokenPolicy.OnCollision == nil || !msg.Code.IsResponse() {
+		return TokenCollision{}, false
+	}
+
+	call, ok := c.calls.Get(msg.Token)
+	if !ok || call.gather || call.addr.String() == addr.String() {
+		return TokenCollision{}, false
+	}
+
+	return TokenCollision{
+		Token:        msg.Token,
+		RequestAddr:  call.addr,
+		RequestID:    call.id,
+		ResponseAddr: addr,
+		ResponseID:   msg.ID,
+		ResponseCode: msg.Code,
+	}, true
+}
+
+// awaiting returns the call awaiting the response or reset and stops awaiting it unless it gathers
+// responses, nil if none.
+//
+// Later messages with the token are retransmissions or notifications of an observation. Returns true
+// for a late response piggybacked on the acknowledgement of a previous message with the token, such as
+// a block of Upload.
+func (c *Conn) awaiting(msg *Message) (*clientCall, bool) {
+	switch {
+	case msg.Code.IsResponse():
+		call, ok := c.calls.Get(msg.Token)
+		if !ok || call.gather {
+			return call, false
+		}
+
+		if msg.Type == Acknowledgement && msg.ID != call.id {
+			return nil, true
+		}
+
+		c.calls.Delete(msg.Token)
+
+		return call, false
+	case msg.Type == Reset:
+		for token, pending := range c.calls.All() {
+			if pending.id == msg.ID && !pending.gather {
+				c.calls.Delete(token)
+				return pending, false
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// dispatch starts the dispatcher unless it runs or the connection is closed.
+func (c *Conn) dispatch() {
+	c.dispatchMtx.Lock()
+	defer c.dispatchMtx.Unlock()
+
+	if c.dispatching || c.closed.Load() {
+		return
+	}
+
+	c.dispatching = true
+	go c.dispatcher()
+}
+
+// dispatcher is the only reader of the connection. It passes responses and resets awaited by calls
+// to them and queues other messages and decode errors for Read. It returns once the connection is
+// closed or reading fails, the error is queued for Read and a following Read or call starts it again.
+//
+// Once receiveQueueLength messages are queued, the oldest one is dropped for each message queued,
+// so that calls still get their responses while nobody reads, see enqueue.
+func (c *Conn) dispatcher() {
+	admit := c.admit
+	if !c.peers.Enabled() {
+		admit = nil
+	}
+
+	for {
+		msg := &Message{}
+		addr, err := c.rx.read(msg, admit)
+		if err == nil && (msg.Type == Acknowledgement || msg.Type == Reset) {
+			select {
+			case <-c.done:
+				c.stopDispatcher()
+				return
+			case c.completed <- completion{id: msg.ID, at: c.opts.Clock.Now()}:
+			}
+		}
+
+		if err == nil && c.divert(msg, addr) {
+			continue
+		}
+
+		failed := err != nil && !IsDecodeError(err)
+		if failed {
+			// stopped before the error is queued, so that a Read returning it starts reading again
+			c.stopDispatcher()
+		}
+
+		select {
+		case <-c.done:
+			if !failed {
+				c.stopDispatcher()
+			}
+			return
+		default:
+		}
+
+		c.enqueue(received{msg: msg, addr: addr, err: err})
+
+		if failed {
+			return
+		}
+	}
+}
+
+// enqueue queues the message for Read. If the queue is full, the oldest queued message is dropped
+// and passed to ConnErrorHandler as ReceiveQueueFull instead of blocking the dispatcher.
+func (c *Conn) enqueue(r received) {
+	for {
+		select {
+		case c.received <- r:
+			return
+		default:
+		}
+
+		// Read may take one meanwhile, the dispatcher is the only sender
+		select {
+		case dropped := <-c.received:
+			c.opts.ConnErrorHandler(ReceiveQueueFull{
+				Addr: dropped.addr,
+				ID:   dropped.msg.ID,
+			})
+		default:
+		}
+	}
+}
+
+// stopDispatcher marks the dispatcher as stopped, so that dispatch starts it again.
+func (c *Conn) stopDispatcher() {
+	c.dispatchMtx.Lock()
+	defer c.dispatchMtx.Unlock()
+
+	c.dispatching = false
+}
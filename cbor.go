@@ -0,0 +1,223 @@
+package coap
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"unicode/utf8"
+)
+
+// CBOR major types.
+//
+// https://datatracker.ietf.org/doc/html/rfc8949#section-3.1
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// CBOR simple values.
+const (
+	cborFalse = 20
+	cborTrue  = 21
+	cborNull  = 22
+)
+
+// appendCBORHead appends the initial byte and argument of a data item in the shortest form.
+//
+// https://datatracker.ietf.org/doc/html/rfc8949#section-4.2.1
+func appendCBORHead(data []byte, major uint8, n uint64) []byte {
+	m := major << 5
+
+	switch {
+	case n < 24:
+		return append(data, m|uint8(n))
+	case n <= math.MaxUint8:
+		return append(data, m|24, uint8(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(data, m|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(data, m|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(data, m|27), n)
+	}
+}
+
+// appendCBORValue appends the value encoded as a single data item.
+//
+// Supported types are unsigned and signed integers, string, []byte and bool, nil encodes as null.
+//
+// Returns UnsupportedCBORType for values of other types.
+func appendCBORValue(data []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(data, cborSimple<<5|cborNull), nil
+	case bool:
+		if v {
+			return append(data, cborSimple<<5|cborTrue), nil
+		}
+
+		return append(data, cborSimple<<5|cborFalse), nil
+	case uint:
+		return appendCBORHead(data, cborUint, uint64(v)), nil
+	case uint8:
+		return appendCBORHead(data, cborUint, uint64(v)), nil
+	case uint16:
+		return appendCBORHead(data, cborUint, uint64(v)), nil
+	case uint32:
+		return appendCBORHead(data, cborUint, uint64(v)), nil
+	case uint64:
+		return appendCBORHead(data, cborUint, v), nil
+	case int:
+		return appendCBORInt(data, int64(v)), nil
+	case int8:
+		return appendCBORInt(data, int64(v)), nil
+	case int16:
+		return appendCBORInt(data, int64(v)), nil
+	case int32:
+		return appendCBORInt(data, int64(v)), nil
+	case int64:
+		return appendCBORInt(data, v), nil
+	case string:
+		data = appendCBORHead(data, cborText, uint64(len(v)))
+		return append(data, v...), nil
+	case []byte:
+		data = appendCBORHead(data, cborBytes, uint64(len(v)))
+		return append(data, v...), nil
+	default:
+		return data, UnsupportedCBORType{
+			Type: reflect.TypeOf(v),
+		}
+	}
+}
+
+// appendCBORInt appends the integer as an unsigned or negative integer.
+func appendCBORInt(data []byte, v int64) []byte {
+	if v < 0 {
+		// -1 - v does not overflow for math.MinInt64
+		return appendCBORHead(data, cborNegInt, uint64(-1-v))
+	}
+
+	return appendCBORHead(data, cborUint, uint64(v))
+}
+
+// cborDecoder decodes data items of the subset encoded by appendCBORValue, skipping tags.
+//
+// Indefinite lengths, floats and nested arrays and maps are not supported.
+type cborDecoder struct {
+	data   []byte
+	offset int
+}
+
+// head decodes the initial byte and argument of the next data item.
+//
+// Returns MalformedCBOR if the data is truncated or the item has indefinite length.
+func (d *cborDecoder) head() (uint8, uint64, error) {
+	if d.offset >= len(d.data) {
+		return 0, 0, d.malformed("truncated data item")
+	}
+
+	initial := d.data[d.offset]
+	major := initial >> 5
+	info := initial & 0x1f
+
+	var length int
+	switch {
+	case info < 24:
+		d.offset++
+		return major, uint64(info), nil
+	case info <= 27:
+		length = 1 << (info - 24)
+	case info == 31:
+		return 0, 0, d.malformed("indefinite length not supported")
+	default:
+		return 0, 0, d.malformed("reserved additional information")
+	}
+
+	if len(d.data)-d.offset-1 < length {
+		return 0, 0, d.malformed("truncated argument")
+	}
+
+	arg := d.data[d.offset+1 : d.offset+1+length]
+	d.offset += 1 + length
+
+	switch length {
+	case 1:
+		return major, uint64(arg[0]), nil
+	case 2:
+		return major, uint64(binary.BigEndian.Uint16(arg)), nil
+	case 4:
+		return major, uint64(binary.BigEndian.Uint32(arg)), nil
+	default:
+		return major, binary.BigEndian.Uint64(arg), nil
+	}
+}
+
+// value decodes the next data item as uint64, int64, string, []byte, bool or nil for null.
+//
+// Tags are skipped, the tagged item is returned.
+//
+// Returns MalformedCBOR if the data item is not in the subset.
+func (d *cborDecoder) value() (any, error) {
+	start := d.offset
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return n, nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			d.offset = start
+			return nil, d.malformed("negative integer out of range")
+		}
+
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		if uint64(len(d.data)-d.offset) < n {
+			d.offset = start
+			return nil, d.malformed("truncated string")
+		}
+
+		s := d.data[d.offset : d.offset+int(n)]
+		if major == cborText && !utf8.Valid(s) {
+			d.offset = start
+			return nil, d.malformed("invalid UTF-8 in text string")
+		}
+
+		d.offset += int(n)
+		if major == cborText {
+			return string(s), nil
+		}
+
+		return append([]byte{}, s...), nil
+	case cborTag:
+		return d.value()
+	case cborSimple:
+		switch n {
+		case cborFalse:
+			return false, nil
+		case cborTrue:
+			return true, nil
+		case cborNull:
+			return nil, nil
+		}
+	}
+
+	d.offset = start
+	return nil, d.malformed("unsupported data item")
+}
+
+// malformed returns MalformedCBOR at the current offset.
+func (d *cborDecoder) malformed(reason string) MalformedCBOR {
+	return MalformedCBOR{
+		Offset: uint(d.offset),
+		Reason: reason,
+	}
+}
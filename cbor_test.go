@@ -0,0 +1,147 @@
+package coap
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAppendCBORValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		data  []byte
+	}{
+		{"zero", uint64(0), []byte{0x00}},
+		{"uint immediate", uint8(23), []byte{0x17}},
+		{"uint 1 byte", uint16(24), []byte{0x18, 0x18}},
+		{"uint 2 bytes", uint32(0x0100), []byte{0x19, 0x01, 0x00}},
+		{"uint 4 bytes", uint64(0x00010000), []byte{0x1a, 0x00, 0x01, 0x00, 0x00}},
+		{"uint 8 bytes", uint64(math.MaxUint64), []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"int", 10, []byte{0x0a}},
+		{"negative int", -1, []byte{0x20}},
+		{"negative int 1 byte", int64(-100), []byte{0x38, 0x63}},
+		{"min int", int64(math.MinInt64), []byte{0x3b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"text", "IETF", []byte{0x64, 0x49, 0x45, 0x54, 0x46}},
+		{"bytes", []byte{0x01, 0x02}, []byte{0x42, 0x01, 0x02}},
+		{"false", false, []byte{0xf4}},
+		{"true", true, []byte{0xf5}},
+		{"null", nil, []byte{0xf6}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := appendCBORValue(nil, test.value)
+			if err != nil {
+				t.Fatal("append:", err)
+			}
+
+			diff := cmp.Diff(test.data, data)
+			if diff != "" {
+				t.Errorf("data mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	_, err := appendCBORValue(nil, 1.5)
+	unsupported, ok := err.(UnsupportedCBORType)
+	if !ok || unsupported.Type != reflect.TypeOf(1.5) {
+		t.Errorf("error = %v, want UnsupportedCBORType float64", err)
+	}
+}
+
+func TestCBORDecoderValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		value any
+		err   error
+	}{
+		{
+			name:  "uint 8 bytes",
+			data:  []byte{0x1b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+			value: uint64(0x0100000000),
+		},
+		{
+			name:  "negative int",
+			data:  []byte{0x38, 0x63},
+			value: int64(-100),
+		},
+		{
+			name:  "tagged text",
+			data:  []byte{0xd8, 0x20, 0x61, 0x61},
+			value: "a",
+		},
+		{
+			name:  "bytes",
+			data:  []byte{0x42, 0x01, 0x02},
+			value: []byte{0x01, 0x02},
+		},
+		{
+			name: "empty",
+			err:  MalformedCBOR{Offset: 0, Reason: "truncated data item"},
+		},
+		{
+			name: "truncated argument",
+			data: []byte{0x19, 0x01},
+			err:  MalformedCBOR{Offset: 0, Reason: "truncated argument"},
+		},
+		{
+			name: "truncated string",
+			data: []byte{0x63, 0x61, 0x62},
+			err:  MalformedCBOR{Offset: 0, Reason: "truncated string"},
+		},
+		{
+			name: "invalid UTF-8",
+			data: []byte{0x61, 0xff},
+			err:  MalformedCBOR{Offset: 0, Reason: "invalid UTF-8 in text string"},
+		},
+		{
+			name: "negative int out of range",
+			data: []byte{0x3b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			err:  MalformedCBOR{Offset: 0, Reason: "negative integer out of range"},
+		},
+		{
+			name: "indefinite length",
+			data: []byte{0x7f, 0x61, 0x61, 0xff},
+			err:  MalformedCBOR{Offset: 0, Reason: "indefinite length not supported"},
+		},
+		{
+			name: "reserved",
+			data: []byte{0x1c},
+			err:  MalformedCBOR{Offset: 0, Reason: "reserved additional information"},
+		},
+		{
+			name: "float",
+			data: []byte{0xf9, 0x3c, 0x00},
+			err:  MalformedCBOR{Offset: 0, Reason: "unsupported data item"},
+		},
+		{
+			name: "array",
+			data: []byte{0xd8, 0x20, 0x80},
+			err:  MalformedCBOR{Offset: 2, Reason: "unsupported data item"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &cborDecoder{
+				data: test.data,
+			}
+
+			value, err := d.value()
+			expectErr(t, err, test.err)
+
+			diff := cmp.Diff(test.value, value)
+			if diff != "" {
+				t.Errorf("value mismatch (-want +got):\n%s", diff)
+			}
+
+			if err == nil && d.offset != len(test.data) {
+				t.Errorf("offset = %d, want %d", d.offset, len(test.data))
+			}
+		})
+	}
+}
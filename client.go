@@ -0,0 +1,309 @@
+package coap
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client sends requests over a Conn created on first use and shared by concurrent requests,
+// responses are matched to requests by token.
+//
+// The zero value is a usable client listening on a random UDP port with default ConnOptions,
+// that is the transmission parameters of RFC 7252 and DefaultSchema. Client does not support coaps.
+//
+// A connection created by the client is closed once the last request or observation using it ends,
+// so that clients do not hold sockets while idle, the next request creates a new one.
+//
+// Requests awaiting responses are held by the Conn in an ExchangeStore of MaxExchanges entries for
+// ExchangeLifetime, requests evicted from the store by either limit fail with ExchangeEvicted.
+type Client struct {
+	// Network of the Conn, defaults to "udp".
+	Network string
+
+	// ConnOptions of the Conn, zero values default as in NewConn.
+	ConnOptions ConnOptions
+
+	// PacketConn is the connection of the Conn, if nil a connection listening on a random port
+	// of Network is created on first use. The client reads all messages from it and closes it on Close.
+	PacketConn net.PacketConn
+
+	mtx  sync.Mutex
+	conn *Conn
+	stop context.CancelFunc
+
+	// exchanges counts requests and observations using conn
+	exchanges int
+
+	observations ObservationManager
+}
+
+// DefaultClient is the Client used by Get, Post, Put and Delete.
+//
+// It may be replaced, such as by tests, before any of them is called.
+var DefaultClient = &Client{}
+
+// Get sends a GET request to the coap URL with DefaultClient, see Client.Get.
+func Get(ctx context.Context, rawURL string) (*Response, error) {
+	return DefaultClient.Get(ctx, rawURL)
+}
+
+// Post sends a POST request to the coap URL with DefaultClient, see Client.Post.
+func Post(ctx context.Context, rawURL string, mediaType MediaType, payload []byte) (*Response, error) {
+	return DefaultClient.Post(ctx, rawURL, mediaType, payload)
+}
+
+// Put sends a PUT request to the coap URL with DefaultClient, see Client.Put.
+func Put(ctx context.Context, rawURL string, mediaType MediaType, payload []byte) (*Response, error) {
+	return DefaultClient.Put(ctx, rawURL, mediaType, payload)
+}
+
+// Delete sends a DELETE request to the coap URL with DefaultClient, see Client.Delete.
+func Delete(ctx context.Context, rawURL string) (*Response, error) {
+	return DefaultClient.Delete(ctx, rawURL)
+}
+
+// Get sends a GET request to the coap URL and returns the response.
+//
+// Returns NoDTLSTransport for coaps URLs.
+//
+// Returns errors of ParseURL and Do.
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	return c.send(ctx, GET, rawURL, nil, nil)
+}
+
+// Post sends a POST request with the payload of the media type to the coap URL and returns the response.
+//
+// Returns errors of Get.
+func (c *Client) Post(ctx context.Context, rawURL string, mediaType MediaType, payload []byte) (*Response, error) {
+	return c.send(ctx, POST, rawURL, &mediaType, payload)
+}
+
+// Put sends a PUT request with the payload of the media type to the coap URL and returns the response.
+//
+// Returns errors of Get.
+func (c *Client) Put(ctx context.Context, rawURL string, mediaType MediaType, payload []byte) (*Response, error) {
+	return c.send(ctx, PUT, rawURL, &mediaType, payload)
+}
+
+// Delete sends a DELETE request to the coap URL and returns the response.
+//
+// Returns errors of Get.
+func (c *Client) Delete(ctx context.Context, rawURL string) (*Response, error) {
+	return c.send(ctx, DELETE, rawURL, nil, nil)
+}
+
+// Do sends the request to its Host and Port with Conn.Do and returns the response.
+//
+// Returns the error of creating the Conn or resolving the address of the host.
+//
+// Returns errors of Conn.Do.
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	conn, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(conn)
+
+	addr, err := c.resolve(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.Do(ctx, req, addr)
+}
+
+// Gather sends the request with Conn.Gather, typically a NonConfirmable request to a multicast or broadcast
+// address, and collects all responses with a matching token received within the window from any address.
+//
+// Returns the error of creating the Conn.
+//
+// Returns errors of Conn.Gather.
+func (c *Client) Gather(ctx context.Context, req *Request, addr net.Addr, window time.Duration) ([]GatheredResponse, error) {
+	conn, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(conn)
+
+	msg, err := req.message()
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.Gather(ctx, &msg, addr, window)
+}
+
+// Close closes the Conn of the client, if created.
+func (c *Client) Close() error {
+	c.mtx.Lock()
+	conn, stop := c.conn, c.stop
+	c.conn, c.stop, c.exchanges = nil, nil, 0
+	c.mtx.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	stop()
+
+	return conn.Close()
+}
+
+func (c *Client) send(ctx context.Context, method Method, rawURL string, mediaType *MediaType, payload []byte) (*Response, error) {
+	req, err := c.request(method, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentFormat = mediaType
+	req.Payload = payload
+
+	return c.Do(ctx, req)
+}
+
+// request returns a request of the method to the coap URL.
+func (c *Client) request(method Method, rawURL string) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err == nil && u.Scheme == SecureScheme {
+		return nil, NoDTLSTransport{
+			URL: rawURL,
+		}
+	}
+
+	req, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Method = method
+
+	return req, nil
+}
+
+// resolve returns the address of the Host and Port of the request.
+func (c *Client) resolve(req *Request) (*net.UDPAddr, error) {
+	port := req.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+
+	return net.ResolveUDPAddr(c.network(), net.JoinHostPort(req.Host, strconv.Itoa(int(port))))
+}
+
+func (c *Client) network() string {
+	if c.Network == "" {
+		return "udp"
+	}
+
+	return c.Network
+}
+
+// acquire returns the Conn for a request or observation, creating it and starting to read notifications
+// if there is none. The Conn has to be released with release once the request or observation ends.
+func (c *Client) acquire() (*Conn, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.conn == nil {
+		conn, err := c.listen(c.ConnOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, stop := context.WithCancel(context.Background())
+		c.conn = conn
+		c.stop = stop
+
+		go func() {
+			_ = conn.ReadLoop(ctx, func(msg *Message, addr net.Addr) {
+				c.receive(conn, msg, addr)
+			})
+		}()
+	}
+
+	c.exchanges++
+
+	return c.conn, nil
+}
+
+// release ends a request or observation using the Conn, the Conn is closed with the last one
+// unless it is over PacketConn, which is closed by Close only.
+func (c *Client) release(conn *Conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if conn != c.conn {
+		return // closed by Close
+	}
+
+	c.exchanges--
+	if c.exchanges != 0 || c.PacketConn != nil {
+		return
+	}
+
+	c.stop()
+	_ = c.conn.Close()
+	c.conn, c.stop = nil, nil
+}
+
+// listen creates the Conn over PacketConn, or listening on a random port of Network if it is nil.
+func (c *Client) listen(opts ConnOptions) (*Conn, error) {
+	if c.PacketConn == nil {
+		return ListenPacket(context.Background(), c.network(), ":0", opts)
+	}
+
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConn(c.PacketConn, opts), nil
+}
+
+// receive passes notifications to observations, responses and resets awaited by requests are taken
+// by the Conn before.
+//
+// Confirmable responses are acknowledged. Notifications of unknown observations are rejected, whether
+// Confirmable or not, so that the server removes the observer, as is the next notification of an observation
+// canceled lazily by CancelObserve.
+//
+// https://datatracker.ietf.org/doc/html/rfc7641#section-3.6
+func (c *Client) receive(conn *Conn, msg *Message, addr net.Addr) {
+	if !msg.Code.IsResponse() {
+		return
+	}
+
+	obs := c.observations.get(msg.Token)
+	_, notification := msg.Options.Get(Observe)
+
+	if obs != nil && notification {
+		canceling, lazy := c.observations.canceling(obs)
+		if canceling && lazy {
+			_ = conn.Reset(msg.ID, addr)
+			c.canceled(obs)
+			return
+		}
+	}
+
+	switch {
+	case obs == nil && notification:
+		_ = conn.Reset(msg.ID, addr)
+		return
+	case msg.Type == Confirmable:
+		_ = conn.tx.Write(&Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Acknowledgement,
+				ID:      msg.ID,
+			},
+		}, addr)
+	}
+
+	if obs != nil {
+		c.notify(obs, msg)
+	}
+}
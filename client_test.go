@@ -0,0 +1,647 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// clientServer serves the handler on a local UDP address and returns the coap URL of the server.
+func clientServer(t testing.TB, handler Handler) string {
+	t.Helper()
+
+	conn, err := ListenPacket(context.Background(), "udp", "127.0.0.1:0", ConnOptions{})
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		_ = NewServer(conn, handler, ServerOptions{}).Serve(context.Background())
+	}()
+
+	return "coap://" + conn.LocalAddr().String()
+}
+
+func ExampleGet() {
+	mux := NewServeMux()
+	_ = mux.HandleFunc("/hello", func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code:    Content,
+			Payload: []byte("hello"),
+		})
+	})
+
+	conn, _ := ListenPacket(context.Background(), "udp", "127.0.0.1:0", ConnOptions{})
+	defer conn.Close()
+
+	go func() {
+		_ = NewServer(conn, mux, ServerOptions{}).Serve(context.Background())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := Get(ctx, "coap://"+conn.LocalAddr().String()+"/hello")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println(resp.Code, string(resp.Payload))
+	// Output: 2.05 Content hello
+}
+
+func TestClientMethods(t *testing.T) {
+	type received struct {
+		method        Method
+		path          string
+		contentFormat uint32
+		payload       string
+	}
+
+	requests := make(chan received, 1)
+	base := clientServer(t, HandlerFunc(func(_ context.Context, w ResponseWriter, r *Request) {
+		contentFormat, _ := r.Options.GetUint(ContentFormat)
+		requests <- received{
+			method:        r.Method,
+			path:          r.Path,
+			contentFormat: contentFormat,
+			payload:       string(r.Payload),
+		}
+
+		_ = w.Write(&Response{
+			Code: Changed,
+		})
+	}))
+
+	client := &Client{}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		send func() (*Response, error)
+		want received
+	}{
+		{
+			name: "get",
+			send: func() (*Response, error) {
+				return client.Get(ctx, base+"/sensors/temp")
+			},
+			want: received{
+				method: GET,
+				path:   "/sensors/temp",
+			},
+		},
+		{
+			name: "post",
+			send: func() (*Response, error) {
+				return client.Post(ctx, base+"/log", MediaTypeTextPlain, []byte("boot"))
+			},
+			want: received{
+				method:  POST,
+				path:    "/log",
+				payload: "boot",
+			},
+		},
+		{
+			name: "put",
+			send: func() (*Response, error) {
+				return client.Put(ctx, base+"/config", MediaTypeApplicationJSON, []byte("{}"))
+			},
+			want: received{
+				method:        PUT,
+				path:          "/config",
+				contentFormat: uint32(MediaTypeApplicationJSON.Code),
+				payload:       "{}",
+			},
+		},
+		{
+			name: "delete",
+			send: func() (*Response, error) {
+				return client.Delete(ctx, base+"/config")
+			},
+			want: received{
+				method: DELETE,
+				path:   "/config",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := test.send()
+			if err != nil {
+				t.Fatal("send:", err)
+			}
+
+			if resp.Code != Changed {
+				t.Errorf("code = %s, want %s", resp.Code, Changed)
+			}
+
+			got := <-requests
+			if got != test.want {
+				t.Errorf("received %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClientPostLocation(t *testing.T) {
+	base := clientServer(t, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code:          Created,
+			LocationPath:  "/sensors/42",
+			LocationQuery: []string{"rev=1"},
+		})
+	}))
+
+	client := &Client{}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := client.Post(ctx, base+"/sensors?type=temp", MediaTypeTextPlain, []byte("20C"))
+	if err != nil {
+		t.Fatal("post:", err)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal("location:", err)
+	}
+
+	want := base + "/sensors/42?rev=1"
+	if location.String() != want {
+		t.Errorf("location = %q, want %q", location, want)
+	}
+
+	// without the request the reference is not resolved
+	resp.Request = nil
+
+	location, err = resp.Location()
+	if err != nil {
+		t.Fatal("location:", err)
+	}
+
+	if location.String() != "/sensors/42?rev=1" {
+		t.Errorf("reference = %q, want %q", location, "/sensors/42?rev=1")
+	}
+}
+
+func TestClientSecureScheme(t *testing.T) {
+	client := &Client{}
+	defer client.Close()
+
+	_, err := client.Get(context.Background(), "coaps://example.com/secret")
+	expectErr(t, err, NoDTLSTransport{
+		URL: "coaps://example.com/secret",
+	})
+
+	if client.conn != nil {
+		t.Error("expected no Conn to be created")
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	base := clientServer(t, HandlerFunc(func(ctx context.Context, _ ResponseWriter, _ *Request) {
+		<-ctx.Done()
+	}))
+
+	client := &Client{
+		ConnOptions: testConnOptions(),
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.Get(ctx, base+"/slow")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+
+	if client.conn != nil {
+		t.Error("expected Conn to be closed after the request")
+	}
+}
+
+func TestClientRelease(t *testing.T) {
+	base := clientServer(t, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{Code: Content})
+	}))
+
+	client := &Client{
+		ConnOptions: testConnOptions(),
+	}
+	defer client.Close()
+
+	for range 2 {
+		_, err := client.Get(context.Background(), base+"/idle")
+		if err != nil {
+			t.Fatal("get:", err)
+		}
+
+		if client.conn != nil {
+			t.Fatal("expected Conn to be closed after the request")
+		}
+	}
+
+	shared := &Client{
+		ConnOptions: testConnOptions(),
+		PacketConn:  listenPacket(t),
+	}
+	defer shared.Close()
+
+	_, err := shared.Get(context.Background(), base+"/idle")
+	if err != nil {
+		t.Fatal("get:", err)
+	}
+
+	if shared.conn == nil {
+		t.Error("expected Conn over PacketConn to be kept until Close")
+	}
+}
+
+func TestClientRetransmitLimit(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	defer server.Close()
+
+	handled := make(chan error, 1)
+	opts := testConnOptions()
+	opts.ErrorHandler = func(_ *Message, err error) {
+		handled <- err
+	}
+
+	client := &Client{
+		ConnOptions: opts,
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// server never acknowledges
+	_, err = client.Get(ctx, "coap://"+server.LocalAddr().String()+"/")
+	if !isError[RetransmitRetryLimit](err) {
+		t.Errorf("error = %v, want RetransmitRetryLimit", err)
+	}
+
+	if err := <-handled; !isError[RetransmitRetryLimit](err) {
+		t.Errorf("handled error = %v, want RetransmitRetryLimit", err)
+	}
+}
+
+func TestClientGather(t *testing.T) {
+	a, b := newPipe()
+	client := &Client{
+		ConnOptions: testConnOptions(),
+		PacketConn:  a,
+	}
+	defer client.Close()
+	server := NewConn(b, testConnOptions())
+	defer server.Close()
+
+	go func() {
+		req := &Message{}
+		addr, err := server.Read(req)
+		if err != nil {
+			return
+		}
+
+		for i, token := range []Token{req.Token, Token("other"), req.Token} {
+			_ = server.Write(&Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    NonConfirmable,
+					Code:    Code(Content),
+					Token:   token,
+				},
+				Payload: []byte{byte(i)},
+			}, addr)
+		}
+	}()
+
+	gathered, err := client.Gather(context.Background(), &Request{
+		Type:   NonConfirmable,
+		Method: GET,
+		Token:  bytes4,
+	}, server.LocalAddr(), 50*time.Millisecond)
+	if err != nil {
+		t.Fatal("gather:", err)
+	}
+
+	payloads := [][]byte{}
+	for _, g := range gathered {
+		if g.From.String() != server.LocalAddr().String() {
+			t.Errorf("From = %s, want %s", g.From, server.LocalAddr())
+		}
+
+		payloads = append(payloads, g.Resp.Payload)
+	}
+
+	diff := cmp.Diff([][]byte{{0}, {2}}, payloads)
+	if diff != "" {
+		t.Errorf("payloads mismatch (-want +got):\n%s", diff)
+	}
+
+	// context ends before the window
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = client.Gather(ctx, &Request{
+		Type:   NonConfirmable,
+		Method: GET,
+	}, server.LocalAddr(), time.Hour)
+	expectErr(t, err, context.DeadlineExceeded)
+}
+
+func TestClientConcurrentFirstUse(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		remotes = map[string]bool{}
+	)
+
+	base := clientServer(t, HandlerFunc(func(ctx context.Context, w ResponseWriter, _ *Request) {
+		addr, _ := RemoteAddr(ctx)
+
+		mtx.Lock()
+		remotes[addr.String()] = true
+		mtx.Unlock()
+
+		_ = w.Write(&Response{
+			Code: Content,
+		})
+	}))
+
+	client := &Client{}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	errs := make(chan error, 10)
+	for range cap(errs) {
+		go func() {
+			_, err := client.Get(ctx, base+"/")
+			errs <- err
+		}()
+	}
+
+	for range cap(errs) {
+		err := <-errs
+		if err != nil {
+			t.Error("get:", err)
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if len(remotes) != 1 {
+		t.Errorf("requests from %d addresses, want a single Conn", len(remotes))
+	}
+}
+
+func TestClientReset(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	defer server.Close()
+
+	// reject every request with a Reset
+	go func() {
+		buf := make([]byte, MaxMessageLength)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			msg := &Message{}
+			_, err = msg.Decode(buf[:n], MarshalOptions{})
+			if err != nil {
+				continue
+			}
+
+			data, _ := msg.Reject().MarshalBinary()
+			_, _ = server.WriteTo(data, addr)
+		}
+	}()
+
+	client := &Client{
+		ConnOptions: testConnOptions(),
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = client.Get(ctx, "coap://"+server.LocalAddr().String()+"/")
+	if !isError[ExchangeReset](err) {
+		t.Errorf("error = %v, want ExchangeReset", err)
+	}
+}
+
+func TestClientDoBody(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 250)
+
+	var payload []byte
+	received := make(chan []byte, 1)
+	rawURL := clientServer(t, HandlerFunc(func(_ context.Context, w ResponseWriter, r *Request) {
+		payload = append(payload, r.Payload...)
+
+		block, err := r.Options.GetBlock(Block1)
+		if err == nil && block.More {
+			resp := &Response{
+				Code: Continue,
+			}
+			Must(resp.Options.SetBlock(Block1, block))
+			_ = w.Write(resp)
+			return
+		}
+
+		received <- payload
+		_ = w.Write(&Response{
+			Code: Changed,
+		})
+	}))
+
+	req, err := ParseURL(rawURL + "/firmware")
+	if err != nil {
+		t.Fatal("parse:", err)
+	}
+	req.Method = PUT
+	req.Body = onlyReader{bytes.NewReader(body)}
+
+	client := &Client{}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := client.Do(ctx, req)
+	if err != nil {
+		t.Fatal("do:", err)
+	}
+
+	if resp.Code != Changed {
+		t.Errorf("code = %s, want %s", resp.Code, Changed)
+	}
+
+	if got := <-received; !bytes.Equal(got, body) {
+		t.Errorf("received %d bytes, want %d", len(got), len(body))
+	}
+}
+
+func TestClientExchangeEvicted(t *testing.T) {
+	// peer never responds
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	defer peer.Close()
+
+	clock := newFakeClock(time.Unix(0, 0))
+	opts := testConnOptions()
+	opts.Clock = clock
+
+	client := &Client{
+		ConnOptions: opts,
+	}
+	defer client.Close()
+
+	addr := peer.LocalAddr().(*net.UDPAddr)
+	req := &Request{
+		Type:   NonConfirmable,
+		Method: GET,
+		Host:   addr.IP.String(),
+		Port:   uint16(addr.Port),
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Do(context.Background(), req)
+		errs <- err
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		client.mtx.Lock()
+		conn := client.conn
+		client.mtx.Unlock()
+
+		if conn != nil && conn.calls.Len() == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("request not pending")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(ExchangeLifetime)
+	client.conn.calls.Sweep()
+
+	select {
+	case err := <-errs:
+		evicted, ok := err.(ExchangeEvicted)
+		if !ok || evicted.Reason != EvictionExpired || evicted.Addr.String() != addr.String() {
+			t.Errorf("error = %v, want ExchangeEvicted expired from %s", err, addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not evicted")
+	}
+}
+
+func TestClientLateAcknowledgement(t *testing.T) {
+	a, b := newPipe()
+	client := &Client{
+		ConnOptions: testConnOptions(),
+		PacketConn:  a,
+	}
+	defer client.Close()
+	defer b.Close()
+
+	ack := func(req *Message, id MessageID, code ResponseCode) {
+		msg := &Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Acknowledgement,
+				Code:    Code(code),
+				ID:      id,
+				Token:   req.Token,
+			},
+		}
+
+		data, err := msg.AppendBinary(nil)
+		if err != nil {
+			t.Error("encode:", err)
+			return
+		}
+
+		_, _ = b.WriteTo(data, a.LocalAddr())
+	}
+
+	go func() {
+		buf := make([]byte, MaxMessageLength)
+		var first MessageID
+		for num := 0; num < 2; num++ {
+			n, _, err := b.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			req := &Message{}
+			_, err = req.Decode(buf[:n], MarshalOptions{})
+			if err != nil {
+				t.Error("decode:", err)
+				return
+			}
+
+			if num == 0 {
+				first = req.ID
+				ack(req, req.ID, Continue)
+				continue
+			}
+
+			// duplicate of the acknowledgement of the first block arrives before the second one
+			ack(req, first, Continue)
+			ack(req, req.ID, Changed)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := client.Upload(ctx, &Request{
+		Method:  PUT,
+		Payload: bytes.Repeat([]byte("a"), 32),
+	}, b.LocalAddr(), 0)
+	if err != nil {
+		t.Fatal("upload:", err)
+	}
+
+	if resp.Code != Changed {
+		t.Errorf("code = %s, want %s", resp.Code, Changed)
+	}
+}
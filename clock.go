@@ -0,0 +1,18 @@
+package coap
+
+import (
+	"github.com/uramaki-io/coap/internal/clock"
+)
+
+// Clock provides current time and timers, it schedules all timed events of Conn and Server
+// such as retransmissions, piggyback deadlines, write backoff, budget refills
+// and exchange expiry.
+//
+// coaptest.FakeClock is a virtual Clock for tests.
+type Clock = clock.Clock
+
+// Timer is a single event timer created by Clock.
+type Timer = clock.Timer
+
+// RealClock is a Clock backed by the time package.
+var RealClock = clock.Real
@@ -0,0 +1,224 @@
+package coaptest
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/uramaki-io/coap"
+)
+
+// CassetteDirection is the direction of a recorded datagram.
+type CassetteDirection string
+
+const (
+	// CassetteOutbound marks datagrams written by the recording endpoint.
+	CassetteOutbound CassetteDirection = "out"
+
+	// CassetteInbound marks datagrams read by the recording endpoint.
+	CassetteInbound CassetteDirection = "in"
+)
+
+// Cassette holds datagrams of an exchange recorded by RecordingPacketConn and replayed by ReplayPacketConn.
+//
+// Cassettes are stored as JSON with datagrams hex encoded, so that they can be reviewed and diffed.
+type Cassette struct {
+	Datagrams []CassetteDatagram `json:"datagrams"`
+}
+
+// CassetteDatagram is a recorded datagram.
+type CassetteDatagram struct {
+	Direction CassetteDirection
+
+	// Offset is the time since the first datagram of the cassette.
+	Offset time.Duration
+
+	// Addr is the address of the peer the datagram was written to or read from.
+	Addr string
+
+	Data []byte
+}
+
+// cassetteDatagramJSON is the JSON representation of CassetteDatagram.
+type cassetteDatagramJSON struct {
+	Direction CassetteDirection `json:"direction"`
+	Offset    string            `json:"offset"`
+	Addr      string            `json:"addr,omitempty"`
+	Data      string            `json:"data"`
+}
+
+// RecordingPacketConn is a net.PacketConn wrapping a delegate and recording datagrams written and read
+// into a Cassette, intended for recording exchanges with real devices to be replayed by ReplayPacketConn.
+type RecordingPacketConn struct {
+	delegate net.PacketConn
+	clock    coap.Clock
+
+	mtx      sync.Mutex
+	start    time.Time
+	cassette Cassette
+}
+
+// LoadCassette reads the cassette from the JSON file.
+//
+// Returns the error of reading or decoding the file.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cassette := &Cassette{}
+	err = json.Unmarshal(data, cassette)
+	if err != nil {
+		return nil, err
+	}
+
+	return cassette, nil
+}
+
+// Save writes the cassette to the JSON file.
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d CassetteDatagram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cassetteDatagramJSON{
+		Direction: d.Direction,
+		Offset:    d.Offset.String(),
+		Addr:      d.Addr,
+		Data:      hex.EncodeToString(d.Data),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *CassetteDatagram) UnmarshalJSON(data []byte) error {
+	decoded := cassetteDatagramJSON{}
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+
+	offset, err := time.ParseDuration(decoded.Offset)
+	if err != nil {
+		return err
+	}
+
+	raw, err := hex.DecodeString(decoded.Data)
+	if err != nil {
+		return err
+	}
+
+	*d = CassetteDatagram{
+		Direction: decoded.Direction,
+		Offset:    offset,
+		Addr:      decoded.Addr,
+		Data:      raw,
+	}
+
+	return nil
+}
+
+// NewRecordingPacketConn instantiates a new RecordingPacketConn over the delegate.
+//
+// Offsets of datagrams are measured by the clock, defaults to coap.RealClock.
+func NewRecordingPacketConn(delegate net.PacketConn, clock coap.Clock) *RecordingPacketConn {
+	if clock == nil {
+		clock = coap.RealClock
+	}
+
+	return &RecordingPacketConn{
+		delegate: delegate,
+		clock:    clock,
+	}
+}
+
+// Cassette returns a copy of the datagrams recorded so far.
+func (r *RecordingPacketConn) Cassette() *Cassette {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return &Cassette{
+		Datagrams: slices.Clone(r.cassette.Datagrams),
+	}
+}
+
+// ReadFrom implements net.PacketConn, recording the datagram read.
+func (r *RecordingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := r.delegate.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+
+	r.record(CassetteInbound, b[:n], addr)
+
+	return n, addr, nil
+}
+
+// WriteTo implements net.PacketConn, recording the datagram written.
+func (r *RecordingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := r.delegate.WriteTo(b, addr)
+	if err != nil {
+		return n, err
+	}
+
+	r.record(CassetteOutbound, b, addr)
+
+	return n, nil
+}
+
+// Close implements net.PacketConn.
+func (r *RecordingPacketConn) Close() error {
+	return r.delegate.Close()
+}
+
+// LocalAddr implements net.PacketConn.
+func (r *RecordingPacketConn) LocalAddr() net.Addr {
+	return r.delegate.LocalAddr()
+}
+
+// SetDeadline implements net.PacketConn.
+func (r *RecordingPacketConn) SetDeadline(t time.Time) error {
+	return r.delegate.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (r *RecordingPacketConn) SetReadDeadline(t time.Time) error {
+	return r.delegate.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.PacketConn.
+func (r *RecordingPacketConn) SetWriteDeadline(t time.Time) error {
+	return r.delegate.SetWriteDeadline(t)
+}
+
+func (r *RecordingPacketConn) record(dir CassetteDirection, data []byte, addr net.Addr) {
+	now := r.clock.Now()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if len(r.cassette.Datagrams) == 0 {
+		r.start = now
+	}
+
+	datagram := CassetteDatagram{
+		Direction: dir,
+		Offset:    now.Sub(r.start),
+		Data:      slices.Clone(data),
+	}
+	if addr != nil {
+		datagram.Addr = addr.String()
+	}
+
+	r.cassette.Datagrams = append(r.cassette.Datagrams, datagram)
+}
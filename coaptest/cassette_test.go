@@ -0,0 +1,85 @@
+package coaptest
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRecordingPacketConn(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	clock := NewFakeClock(time.Unix(0, 0))
+	recorder := NewRecordingPacketConn(a, clock)
+
+	_, err := recorder.WriteTo([]byte{0x01, 0x02}, b.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	clock.Advance(5 * time.Millisecond)
+
+	_, err = b.WriteTo([]byte{0x03}, a.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	buf := make([]byte, 16)
+	_, _, err = recorder.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	expect := &Cassette{
+		Datagrams: []CassetteDatagram{
+			{Direction: CassetteOutbound, Addr: "pipe-b", Data: []byte{0x01, 0x02}},
+			{Direction: CassetteInbound, Offset: 5 * time.Millisecond, Addr: "pipe-b", Data: []byte{0x03}},
+		},
+	}
+
+	cassette := recorder.Cassette()
+	diff := cmp.Diff(expect, cassette)
+	if diff != "" {
+		t.Errorf("cassette mismatch (-want +got):\n%s", diff)
+	}
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	err = cassette.Save(path)
+	if err != nil {
+		t.Fatal("save:", err)
+	}
+
+	loaded, err := LoadCassette(path)
+	if err != nil {
+		t.Fatal("load:", err)
+	}
+
+	diff = cmp.Diff(expect, loaded)
+	if diff != "" {
+		t.Errorf("loaded cassette mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCassetteDatagramUnmarshalError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"invalid offset", `{"direction":"out","offset":"soon","data":"01"}`},
+		{"invalid data", `{"direction":"out","offset":"0s","data":"zz"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &CassetteDatagram{}
+			err := d.UnmarshalJSON([]byte(test.data))
+			if err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
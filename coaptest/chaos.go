@@ -0,0 +1,394 @@
+package coaptest
+
+import (
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/uramaki-io/coap"
+	"github.com/uramaki-io/coap/internal/deadline"
+)
+
+// ChaosDirection selects the datagrams a ChaosProfile applies to.
+type ChaosDirection uint8
+
+const (
+	// ChaosOutbound applies to datagrams written to the delegate.
+	ChaosOutbound ChaosDirection = iota
+
+	// ChaosInbound applies to datagrams read from the delegate.
+	ChaosInbound
+)
+
+// ChaosProfile holds impairments injected by ChaosPacketConn in one direction.
+//
+// Probabilities are in the range of 0 to 1, zero values disable the impairment.
+type ChaosProfile struct {
+	// Drop is the probability of dropping a datagram.
+	Drop float64
+
+	// Duplicate is the probability of delivering a datagram twice.
+	Duplicate float64
+
+	// Corrupt is the probability of flipping a random bit of a datagram.
+	Corrupt float64
+
+	// Latency delays every datagram.
+	Latency time.Duration
+
+	// Jitter adds a random delay up to Jitter to Latency.
+	Jitter time.Duration
+
+	// Reorder adds a random delay up to Reorder, so that datagrams sent within the window
+	// may be delivered out of order.
+	Reorder time.Duration
+}
+
+// ChaosOptions holds options for ChaosPacketConn.
+type ChaosOptions struct {
+	// Seed of the random source, the same seed injects the same impairments
+	// into the same sequence of datagrams.
+	Seed uint64
+
+	// Clock schedules delayed datagrams, defaults to coap.RealClock.
+	//
+	// With FakeClock delayed datagrams are delivered by FakeClock.Advance, so tests need not sleep.
+	Clock coap.Clock
+}
+
+// ChaosStats holds counters of impairments injected in one direction.
+type ChaosStats struct {
+	Dropped    uint
+	Duplicated uint
+	Corrupted  uint
+	Delayed    uint
+	Reordered  uint
+}
+
+// ChaosPacketConn is a net.PacketConn wrapping a delegate and injecting loss, duplication, latency,
+// reordering and corruption, intended for testing behaviour under adverse network conditions.
+//
+// Profiles can be changed with SetProfile while the connection is in use.
+type ChaosPacketConn struct {
+	delegate net.PacketConn
+	opts     ChaosOptions
+
+	mtx      sync.Mutex
+	profiles [2]ChaosProfile
+	rand     [2]*rand.Rand
+	stats    [2]ChaosStats
+
+	out *chaosQueue
+	in  *chaosQueue
+
+	rx     chan deadline.Datagram
+	reader *deadline.Reader
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// chaosQueue delivers delayed datagrams in order of their due time.
+type chaosQueue struct {
+	clock   coap.Clock
+	deliver func(d deadline.Datagram)
+
+	mtx   sync.Mutex
+	items []chaosItem
+	seq   uint64
+	last  uint64
+	wake  chan struct{}
+
+	reordered func()
+}
+
+type chaosItem struct {
+	deadline.Datagram
+
+	due time.Time
+	seq uint64
+}
+
+// NewChaosPacketConn instantiates a new ChaosPacketConn over the delegate with impairments disabled.
+func NewChaosPacketConn(delegate net.PacketConn, opts ChaosOptions) *ChaosPacketConn {
+	if opts.Clock == nil {
+		opts.Clock = coap.RealClock
+	}
+
+	c := &ChaosPacketConn{
+		delegate: delegate,
+		opts:     opts,
+		rx:       make(chan deadline.Datagram),
+		closed:   make(chan struct{}),
+	}
+	c.reader = deadline.NewReader(c.rx, c.closed)
+
+	for dir := range c.rand {
+		c.rand[dir] = rand.New(rand.NewPCG(opts.Seed, uint64(dir)))
+	}
+
+	c.out = c.newQueue(ChaosOutbound, func(d deadline.Datagram) {
+		_, _ = c.delegate.WriteTo(d.Data, d.Addr)
+	})
+	c.in = c.newQueue(ChaosInbound, c.receive)
+
+	go c.out.run(c.closed)
+	go c.in.run(c.closed)
+	go c.read()
+
+	return c
+}
+
+// SetProfile sets the impairments injected in the direction.
+func (c *ChaosPacketConn) SetProfile(dir ChaosDirection, profile ChaosProfile) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.profiles[dir] = profile
+}
+
+// Stats returns counters of impairments injected in the direction.
+func (c *ChaosPacketConn) Stats(dir ChaosDirection) ChaosStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.stats[dir]
+}
+
+// ReadFrom implements net.PacketConn.
+//
+// Datagrams larger than the buffer are truncated.
+func (c *ChaosPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.reader.ReadFrom(b)
+}
+
+// WriteTo implements net.PacketConn.
+//
+// Dropped and delayed datagrams are reported as written.
+func (c *ChaosPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	for _, item := range c.inject(ChaosOutbound, b, addr) {
+		if !item.due.IsZero() {
+			c.out.push(item)
+			continue
+		}
+
+		_, err := c.delegate.WriteTo(item.Data, item.Addr)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Close implements net.PacketConn, delayed datagrams are discarded.
+func (c *ChaosPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	return c.delegate.Close()
+}
+
+// LocalAddr implements net.PacketConn.
+func (c *ChaosPacketConn) LocalAddr() net.Addr {
+	return c.delegate.LocalAddr()
+}
+
+// SetDeadline implements net.PacketConn.
+func (c *ChaosPacketConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+//
+// Deadline applies to pending and subsequent ReadFrom calls.
+func (c *ChaosPacketConn) SetReadDeadline(t time.Time) error {
+	c.reader.SetDeadline(t)
+
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn.
+func (c *ChaosPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.delegate.SetWriteDeadline(t)
+}
+
+// read pumps datagrams from the delegate through inbound impairments until it fails.
+func (c *ChaosPacketConn) read() {
+	buf := make([]byte, coap.ReceiveBufferSize)
+	for {
+		n, addr, err := c.delegate.ReadFrom(buf)
+		if err != nil {
+			c.reader.Fail(err)
+			return
+		}
+
+		for _, item := range c.inject(ChaosInbound, buf[:n], addr) {
+			if !item.due.IsZero() {
+				c.in.push(item)
+				continue
+			}
+
+			c.receive(item.Datagram)
+		}
+	}
+}
+
+// receive passes the datagram to ReadFrom.
+func (c *ChaosPacketConn) receive(d deadline.Datagram) {
+	select {
+	case <-c.closed:
+	case c.rx <- d:
+	}
+}
+
+// inject applies the profile of the direction to the datagram and returns the copies to deliver,
+// due is zero for copies delivered immediately.
+func (c *ChaosPacketConn) inject(dir ChaosDirection, b []byte, addr net.Addr) []chaosItem {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	profile := c.profiles[dir]
+	rng := c.rand[dir]
+	stats := &c.stats[dir]
+
+	if profile.Drop > 0 && rng.Float64() < profile.Drop {
+		stats.Dropped++
+		return nil
+	}
+
+	copies := 1
+	if profile.Duplicate > 0 && rng.Float64() < profile.Duplicate {
+		stats.Duplicated++
+		copies++
+	}
+
+	now := c.opts.Clock.Now()
+	items := make([]chaosItem, 0, copies)
+	for range copies {
+		data := slices.Clone(b)
+		if profile.Corrupt > 0 && len(data) > 0 && rng.Float64() < profile.Corrupt {
+			bit := rng.IntN(len(data) * 8)
+			data[bit/8] ^= 1 << (bit % 8)
+			stats.Corrupted++
+		}
+
+		delay := profile.Latency
+		if profile.Jitter > 0 {
+			delay += time.Duration(rng.Int64N(int64(profile.Jitter)))
+		}
+
+		if profile.Reorder > 0 {
+			delay += time.Duration(rng.Int64N(int64(profile.Reorder)))
+		}
+
+		item := chaosItem{
+			Datagram: deadline.Datagram{
+				Data: data,
+				Addr: addr,
+			},
+		}
+
+		if delay > 0 {
+			stats.Delayed++
+			item.due = now.Add(delay)
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
+func (c *ChaosPacketConn) newQueue(dir ChaosDirection, deliver func(d deadline.Datagram)) *chaosQueue {
+	return &chaosQueue{
+		clock:   c.opts.Clock,
+		deliver: deliver,
+		wake:    make(chan struct{}, 1),
+		reordered: func() {
+			c.mtx.Lock()
+			c.stats[dir].Reordered++
+			c.mtx.Unlock()
+		},
+	}
+}
+
+// push schedules the item for delivery at its due time.
+func (q *chaosQueue) push(item chaosItem) {
+	q.mtx.Lock()
+	q.seq++
+	item.seq = q.seq
+
+	// items with equal due time are delivered in order of push
+	i, _ := slices.BinarySearchFunc(q.items, item, func(a, b chaosItem) int {
+		if a.due.Equal(b.due) {
+			return -1
+		}
+
+		return a.due.Compare(b.due)
+	})
+	q.items = slices.Insert(q.items, i, item)
+	q.mtx.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers items as they become due until done is closed.
+func (q *chaosQueue) run(done <-chan struct{}) {
+	t := q.clock.NewTimer(time.Hour)
+	t.Stop()
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-q.wake:
+		case <-t.C():
+		}
+
+		now := q.clock.Now()
+
+		q.mtx.Lock()
+		n := 0
+		for n < len(q.items) && !q.items[n].due.After(now) {
+			n++
+		}
+
+		due := slices.Clone(q.items[:n])
+		q.items = slices.Delete(q.items, 0, n)
+
+		var next time.Duration
+		if len(q.items) != 0 {
+			next = q.items[0].due.Sub(now)
+		}
+		q.mtx.Unlock()
+
+		for _, item := range due {
+			if item.seq < q.last {
+				q.reordered()
+			}
+			q.last = max(q.last, item.seq)
+
+			q.deliver(item.Datagram)
+		}
+
+		if next == 0 {
+			t.Stop()
+			continue
+		}
+
+		t.Reset(next)
+	}
+}
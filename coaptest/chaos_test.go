@@ -0,0 +1,403 @@
+package coaptest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/bits"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/uramaki-io/coap"
+)
+
+// onlyReader hides all methods of the reader but Read, so that bodies are streamed.
+type onlyReader struct {
+	io.Reader
+}
+
+// receiveDatagram returns the next datagram received by the endpoint, or nil if none arrives in time.
+func receiveDatagram(t *testing.T, conn net.PacketConn) ([]byte, net.Addr) {
+	t.Helper()
+
+	err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	buf := make([]byte, coap.MaxMessageLength)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil, nil
+	}
+
+	return buf[:n], from
+}
+
+func TestChaosPacketConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile ChaosProfile
+		sent    int
+		stats   ChaosStats
+	}{
+		{
+			name: "none",
+			sent: 30,
+		},
+		{
+			name: "drop",
+			profile: ChaosProfile{
+				Drop: 1,
+			},
+			stats: ChaosStats{
+				Dropped: 30,
+			},
+		},
+		{
+			name: "duplicate",
+			profile: ChaosProfile{
+				Duplicate: 1,
+			},
+			sent: 60,
+			stats: ChaosStats{
+				Duplicated: 30,
+			},
+		},
+		{
+			name: "corrupt",
+			profile: ChaosProfile{
+				Corrupt: 1,
+			},
+			sent: 30,
+			stats: ChaosStats{
+				Corrupted: 30,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := Pipe()
+			conn := NewChaosPacketConn(a, ChaosOptions{Seed: 1})
+			defer conn.Close()
+
+			conn.SetProfile(ChaosOutbound, test.profile)
+
+			// zeroed datagrams, so that corruption shows as set bits
+			for range 30 {
+				_, err := conn.WriteTo(make([]byte, 8), b.LocalAddr())
+				if err != nil {
+					t.Fatal("write:", err)
+				}
+			}
+
+			received := 0
+			for data, _ := receiveDatagram(t, b); data != nil; data, _ = receiveDatagram(t, b) {
+				received++
+
+				flipped := 0
+				for _, b := range data {
+					flipped += bits.OnesCount8(b)
+				}
+
+				if want := int(test.profile.Corrupt); flipped != want {
+					t.Errorf("datagram %x has %d flipped bits, want %d", data, flipped, want)
+				}
+			}
+
+			if received != test.sent {
+				t.Errorf("received %d datagrams, want %d", received, test.sent)
+			}
+
+			diff := cmp.Diff(test.stats, conn.Stats(ChaosOutbound))
+			if diff != "" {
+				t.Errorf("stats mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestChaosPacketConnReproducible(t *testing.T) {
+	dropped := func() []int {
+		a, b := Pipe()
+		conn := NewChaosPacketConn(a, ChaosOptions{Seed: 42})
+		defer conn.Close()
+
+		conn.SetProfile(ChaosOutbound, ChaosProfile{Drop: 0.5})
+
+		for i := range 50 {
+			_, _ = conn.WriteTo([]byte{byte(i)}, b.LocalAddr())
+		}
+
+		delivered := []int{}
+		for data, _ := receiveDatagram(t, b); data != nil; data, _ = receiveDatagram(t, b) {
+			delivered = append(delivered, int(data[0]))
+		}
+
+		return delivered
+	}
+
+	diff := cmp.Diff(dropped(), dropped())
+	if diff != "" {
+		t.Errorf("same seed delivered different datagrams (-first +second):\n%s", diff)
+	}
+}
+
+func TestChaosPacketConnLatency(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	a, b := Pipe()
+	conn := NewChaosPacketConn(b, ChaosOptions{Seed: 1, Clock: clock})
+	defer conn.Close()
+
+	conn.SetProfile(ChaosInbound, ChaosProfile{
+		Latency: time.Second,
+		Reorder: time.Second,
+	})
+
+	for i := range 20 {
+		_, err := a.WriteTo([]byte{byte(i)}, b.LocalAddr())
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+
+	// wait until all datagrams are delayed
+	for conn.Stats(ChaosInbound).Delayed != 20 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(time.Second - time.Nanosecond)
+
+	err := conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	buf := make([]byte, coap.MaxMessageLength)
+	_, _, err = conn.ReadFrom(buf)
+	if err == nil {
+		t.Fatal("datagram delivered before latency")
+	}
+
+	order := []int{}
+	go clock.Advance(time.Second)
+
+	err = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	for range 20 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+
+		order = append(order, int(buf[:n][0]))
+	}
+
+	if slices.IsSorted(order) {
+		t.Errorf("expected datagrams to be reordered, got %v", order)
+	}
+
+	if conn.Stats(ChaosInbound).Reordered == 0 {
+		t.Error("expected reordered datagrams to be counted")
+	}
+
+	slices.Sort(order)
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("datagrams lost or duplicated: %v", order)
+		}
+	}
+}
+
+// TestServerChaosLoss runs exchanges with RFC 7252 transmission parameters over 20% loss in both directions.
+func TestServerChaosLoss(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	opts := coap.ConnOptions{
+		Clock: clock,
+	}
+
+	a, b := Pipe()
+	chaos := NewChaosPacketConn(a, ChaosOptions{Seed: 7, Clock: clock})
+	loss := ChaosProfile{
+		Drop: 0.2,
+	}
+	chaos.SetProfile(ChaosOutbound, loss)
+	chaos.SetProfile(ChaosInbound, loss)
+
+	client := coap.NewConn(chaos, opts)
+	defer client.Close()
+	server := coap.NewConn(b, opts)
+	defer server.Close()
+
+	go func() {
+		_ = coap.NewServer(server, coap.HandlerFunc(func(_ context.Context, w coap.ResponseWriter, req *coap.Request) {
+			_ = w.Write(&coap.Response{
+				Code:    coap.Content,
+				Payload: req.Payload,
+			})
+		}), coap.ServerOptions{}).Serve(context.Background())
+	}()
+
+	responses := make(chan *coap.Message)
+	go func() {
+		for {
+			msg := &coap.Message{}
+			_, err := client.Read(msg)
+			if err != nil {
+				return
+			}
+
+			responses <- msg
+		}
+	}()
+
+	const exchanges = 20
+	for i := range exchanges {
+		token := coap.Token{byte(i)}
+		err := client.Write(&coap.Message{
+			Header: coap.Header{
+				Version: coap.ProtocolVersion,
+				Type:    coap.Confirmable,
+				Code:    coap.Code(coap.POST),
+				Token:   token,
+			},
+			Payload: []byte{byte(i)},
+		}, server.LocalAddr())
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+
+		var resp *coap.Message
+		for elapsed := time.Duration(0); resp == nil; elapsed += coap.ACKTimeout {
+			if elapsed > 93*time.Second {
+				t.Fatalf("exchange %d not completed within MAX_TRANSMIT_WAIT", i)
+			}
+
+			select {
+			case msg := <-responses:
+				if bytes.Equal(msg.Token, token) {
+					resp = msg
+				}
+			case <-time.After(10 * time.Millisecond):
+				clock.Advance(coap.ACKTimeout)
+			}
+		}
+
+		if !bytes.Equal(resp.Payload, []byte{byte(i)}) {
+			t.Errorf("exchange %d payload = %x", i, resp.Payload)
+		}
+	}
+
+	lost := chaos.Stats(ChaosOutbound).Dropped + chaos.Stats(ChaosInbound).Dropped
+	if lost == 0 {
+		t.Error("expected datagrams to be dropped")
+	}
+}
+
+// TestConnChaosBlockwise uploads and downloads a body in blocks over a link losing, duplicating
+// and reordering datagrams in both directions.
+func TestConnChaosBlockwise(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 100)
+
+	maxRetransmit := uint(8)
+	opts := coap.ConnOptions{
+		RetransmitOptions: coap.RetransmitOptions{
+			ACKTimeout:      10 * time.Millisecond,
+			ACKRandomFactor: 1.5,
+			MaxRetransmit:   &maxRetransmit,
+		},
+		MarshalOptions: coap.MarshalOptions{
+			MaxMessageLength: coap.MaxMessageLength,
+		},
+	}
+
+	a, b := Pipe()
+	chaos := NewChaosPacketConn(a, ChaosOptions{Seed: 11})
+	impaired := ChaosProfile{
+		Drop:      0.2,
+		Duplicate: 0.1,
+		Reorder:   5 * time.Millisecond,
+	}
+	chaos.SetProfile(ChaosOutbound, impaired)
+	chaos.SetProfile(ChaosInbound, impaired)
+
+	client := coap.NewConn(chaos, opts)
+	defer client.Close()
+	server := coap.NewConn(b, opts)
+	defer server.Close()
+
+	uploaded := make(chan []byte, 1)
+	mux := coap.NewServeMux()
+	_ = mux.Handle("/upload", coap.NewReassembler(coap.HandlerFunc(func(_ context.Context, w coap.ResponseWriter, req *coap.Request) {
+		uploaded <- req.Payload
+		_ = w.Write(&coap.Response{
+			Code: coap.Changed,
+		})
+	}), coap.ReassemblyOptions{}))
+	_ = mux.HandleFunc("/download", func(_ context.Context, w coap.ResponseWriter, _ *coap.Request) {
+		_ = w.Write(&coap.Response{
+			Code: coap.Content,
+			Body: onlyReader{bytes.NewReader(body)},
+		})
+	})
+
+	go func() {
+		_ = coap.NewServer(server, mux, coap.ServerOptions{}).Serve(context.Background())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := client.Upload(ctx, &coap.Request{
+		Method: coap.PUT,
+		Path:   "/upload",
+		Body:   bytes.NewReader(body),
+	}, server.LocalAddr(), 2)
+	if err != nil {
+		t.Fatal("upload:", err)
+	}
+
+	if resp.Code != coap.Changed {
+		t.Errorf("upload code = %s, want %s", resp.Code, coap.Changed)
+	}
+
+	if got := <-uploaded; !bytes.Equal(got, body) {
+		t.Errorf("uploaded %d bytes, want %d", len(got), len(body))
+	}
+
+	downloaded := []byte{}
+	for num := uint32(0); ; num++ {
+		req := &coap.Request{
+			Type:   coap.Confirmable,
+			Method: coap.GET,
+			Path:   "/download",
+			Block2: &coap.BlockValue{Num: num, SZX: 2},
+		}
+
+		resp, err := client.Do(ctx, req, server.LocalAddr())
+		if err != nil {
+			t.Fatalf("block %d: %v", num, err)
+		}
+		downloaded = append(downloaded, resp.Payload...)
+
+		if resp.Block2 == nil || !resp.Block2.More {
+			break
+		}
+	}
+
+	if !bytes.Equal(downloaded, body) {
+		t.Errorf("downloaded %d bytes, want %d", len(downloaded), len(body))
+	}
+
+	lost := chaos.Stats(ChaosOutbound).Dropped + chaos.Stats(ChaosInbound).Dropped
+	if lost == 0 {
+		t.Error("expected datagrams to be dropped")
+	}
+}
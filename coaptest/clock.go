@@ -0,0 +1,23 @@
+package coaptest
+
+import (
+	"time"
+
+	"github.com/uramaki-io/coap/internal/clock"
+)
+
+// FakeClock is a virtual coap.Clock that only advances when Advance is called.
+//
+// A single FakeClock shared by both ends of a connection drives retransmissions, piggyback deadlines,
+// write backoff and expiry deterministically, so that minutes of protocol time pass in
+// milliseconds of wall time.
+//
+// A timer is watched once its receiver calls C, as a select loop does each time it waits. The receiver
+// of a fired watched timer reacts until it calls C, Reset or Stop on it again, which Advance waits for.
+// Timers of After are never watched.
+type FakeClock = clock.Fake
+
+// NewFakeClock instantiates a new FakeClock starting at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return clock.NewFake(now)
+}
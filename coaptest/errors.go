@@ -0,0 +1,20 @@
+package coaptest
+
+import (
+	"fmt"
+)
+
+// UnmatchedDatagram is returned by ReplayPacketConn when a datagram written matches no recorded one.
+type UnmatchedDatagram struct {
+	// Diff describes the difference from the nearest unused recorded datagram, lines prefixed with "-"
+	// are recorded only, lines prefixed with "+" written only. Empty if no recorded datagram is left.
+	Diff string
+}
+
+func (e UnmatchedDatagram) Error() string {
+	if e.Diff == "" {
+		return "unmatched datagram, no recorded datagrams left"
+	}
+
+	return fmt.Sprintf("unmatched datagram, diff against nearest recorded (-recorded +written):\n%s", e.Diff)
+}
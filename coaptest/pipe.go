@@ -0,0 +1,74 @@
+package coaptest
+
+import (
+	"net"
+
+	"github.com/uramaki-io/coap"
+	"github.com/uramaki-io/coap/internal/pipe"
+)
+
+// PipeBacklog is the number of datagrams buffered by PipeConn before further datagrams are dropped.
+const PipeBacklog = pipe.Backlog
+
+// PipeAddr is the address of a PipeConn endpoint.
+type PipeAddr = pipe.Addr
+
+// PipeConn is an in-memory net.PacketConn delivering datagrams to other endpoints of its network.
+//
+// It never blocks on write and drops datagrams when the destination backlog is full, addressed to unknown
+// endpoint or selected by DropEvery.
+type PipeConn = pipe.Conn
+
+// Link holds impairments of datagrams written by a PipeConn endpoint.
+type Link = pipe.Link
+
+// Pipe creates a pair of connected in-memory PacketConn endpoints.
+//
+// Datagrams written by one endpoint to the address of the other are delivered to it.
+func Pipe() (*PipeConn, *PipeConn) {
+	return pipe.New()
+}
+
+// PipeMesh creates n interconnected in-memory PacketConn endpoints.
+//
+// Datagrams written by any endpoint are delivered to the endpoint with the destination address.
+func PipeMesh(n int) []*PipeConn {
+	return pipe.Mesh(n)
+}
+
+// NewConnPair creates a pair of Conns over connected in-memory endpoints.
+//
+// Optional links apply to datagrams written by the first and the second Conn respectively, their delays
+// are measured by the Clock of the options unless the link sets its own.
+func NewConnPair(opts coap.ConnOptions, links ...Link) (*coap.Conn, *coap.Conn) {
+	a, b := pipe.New()
+	endpoints := []*PipeConn{a, b}
+	for i := range min(len(links), len(endpoints)) {
+		link := links[i]
+		if link.Clock == nil {
+			link.Clock = opts.Clock
+		}
+
+		endpoints[i].SetLink(link)
+	}
+
+	return coap.NewConn(a, opts), coap.NewConn(b, opts)
+}
+
+// NewConnMesh creates n Conns over interconnected in-memory endpoints, routed by their local addresses.
+func NewConnMesh(n int, opts coap.ConnOptions) []*coap.Conn {
+	endpoints := pipe.Mesh(n)
+
+	conns := make([]*coap.Conn, n)
+	for i, endpoint := range endpoints {
+		conns[i] = coap.NewConn(endpoint, opts)
+	}
+
+	return conns
+}
+
+// ResolveAddr resolves destination addresses of messages restored from a coap.RetransmitStore, PipeAddr
+// for the "pipe" network and as coap.ResolveAddr otherwise, to be set as coap.ConnOptions.ResolveAddr.
+func ResolveAddr(network string, address string) (net.Addr, error) {
+	return pipe.Resolve(network, address)
+}
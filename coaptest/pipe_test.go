@@ -0,0 +1,114 @@
+package coaptest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/uramaki-io/coap"
+)
+
+func TestNewConnMesh(t *testing.T) {
+	conns := NewConnMesh(3, coap.ConnOptions{})
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+
+	msg := &coap.Message{
+		Header: coap.Header{
+			Version: coap.ProtocolVersion,
+			Type:    coap.NonConfirmable,
+			Code:    coap.Code(coap.GET),
+		},
+	}
+
+	err := conns[0].Write(msg, conns[2].LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	addr, err := conns[2].Read(&coap.Message{})
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	if addr != conns[0].LocalAddr() {
+		t.Errorf("addr = %v, want %v", addr, conns[0].LocalAddr())
+	}
+}
+
+func TestNewConnPairDelay(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	client, server := NewConnPair(coap.ConnOptions{
+		Clock: clock,
+	}, Link{
+		Delay: time.Second,
+	})
+	defer client.Close()
+	defer server.Close()
+
+	err := client.Write(&coap.Message{
+		Header: coap.Header{
+			Version: coap.ProtocolVersion,
+			Type:    coap.NonConfirmable,
+			Code:    coap.Code(coap.GET),
+		},
+	}, server.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := server.Read(&coap.Message{})
+		received <- err
+	}()
+
+	// the delay of the link is measured by the clock of the options
+	select {
+	case <-received:
+		t.Fatal("datagram delivered before the clock advanced")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+
+	select {
+	case err := <-received:
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("datagram not delivered after the delay")
+	}
+}
+
+func ExampleNewConnPair() {
+	client, server := NewConnPair(coap.ConnOptions{
+		MarshalOptions: coap.MarshalOptions{
+			MaxMessageLength: coap.MaxMessageLength,
+		},
+	})
+	defer client.Close()
+	defer server.Close()
+
+	req := &coap.Message{
+		Header: coap.Header{
+			Version: coap.ProtocolVersion,
+			Type:    coap.NonConfirmable,
+			Code:    coap.Code(coap.GET),
+		},
+		Options: coap.Options{
+			coap.MustOptionValue(coap.URIPath, "hello"),
+		},
+	}
+
+	_ = client.Write(req, server.LocalAddr())
+
+	received := &coap.Message{}
+	addr, _ := server.Read(received)
+	path, _ := received.Options.GetString(coap.URIPath)
+
+	fmt.Println(addr, path)
+	// Output: pipe-a hello
+}
@@ -0,0 +1,76 @@
+// Package coaptest provides helpers for testing CoAP implementations.
+//
+// FakeClock drives all timed events of connections sharing it, in-memory connections of Pipe and
+// NewConnPair, ChaosPacketConn and ReplayPacketConn stand in for networks and devices.
+//
+// Unlike the coap encoder, EncodeRaw does not validate its input and is able to produce malformed
+// messages for fuzzers and conformance tests. Do not use it to talk to peers.
+package coaptest
+
+import (
+	"encoding/binary"
+
+	"github.com/uramaki-io/coap"
+)
+
+// RawOption describes an option exactly as it is written on the wire.
+type RawOption struct {
+	// Delta is the option delta from the previous option.
+	Delta uint16
+
+	// Length is the written value length, independent of the length of Value.
+	Length uint16
+
+	// Value is written as is.
+	Value []byte
+
+	// ForceExtend overrides the option header nibbles, delta in the high and length in the low nibble.
+	//
+	// A zero nibble selects the shortest encoding. ExtendByte and ExtendDword force the extended form
+	// even if the value does not fit, any other nibble, such as ExtendInvalid, is written as is
+	// without extended bytes.
+	ForceExtend uint8
+}
+
+// EncodeRaw encodes a message exactly as described without any validation.
+//
+// The token length field is the length of the token truncated to 4 bits. The payload marker is written
+// if includeMarker is set, even if the payload is empty.
+func EncodeRaw(header coap.Header, opts []RawOption, payload []byte, includeMarker bool) []byte {
+	data := []byte{
+		header.Version<<6 | uint8(header.Type&0x03)<<4 | uint8(len(header.Token)&0x0F),
+		uint8(header.Code),
+	}
+	data = binary.BigEndian.AppendUint16(data, uint16(header.ID))
+	data = append(data, header.Token...)
+
+	for _, opt := range opts {
+		ext := []byte{}
+		delta, ext := appendExtend(ext, opt.Delta, opt.ForceExtend>>4)
+		length, ext := appendExtend(ext, opt.Length, opt.ForceExtend&0x0F)
+
+		data = append(data, delta<<4|length)
+		data = append(data, ext...)
+		data = append(data, opt.Value...)
+	}
+
+	if includeMarker {
+		data = append(data, coap.PayloadMarker)
+	}
+
+	return append(data, payload...)
+}
+
+// appendExtend encodes v in the form selected by force, see RawOption.ForceExtend.
+func appendExtend(data []byte, v uint16, force uint8) (uint8, []byte) {
+	switch force {
+	case 0:
+		return coap.EncodeExtend(data, v)
+	case coap.ExtendByte:
+		return coap.ExtendByte, append(data, uint8(v-coap.ExtendByteOffset))
+	case coap.ExtendDword:
+		return coap.ExtendDword, binary.BigEndian.AppendUint16(data, v-coap.ExtendDwordOffset)
+	default:
+		return force & 0x0F, data
+	}
+}
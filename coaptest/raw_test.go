@@ -0,0 +1,143 @@
+package coaptest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/uramaki-io/coap"
+)
+
+var header = coap.Header{
+	Version: coap.ProtocolVersion,
+	Type:    coap.Confirmable,
+	Code:    coap.Code(coap.GET),
+	ID:      0x1234,
+	Token:   coap.Token{0x01, 0x02, 0x03, 0x04},
+}
+
+func TestEncodeRaw(t *testing.T) {
+	msg := &coap.Message{
+		Header: header,
+		Options: coap.Options{
+			coap.MustOptionValue(coap.URIPath, "a"),
+			coap.MustOptionValue(coap.URIPath, string(bytes.Repeat([]byte("b"), 20))),
+		},
+		Payload: []byte("Hi"),
+	}
+
+	want, err := msg.AppendBinary(nil)
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	got := EncodeRaw(header, []RawOption{
+		{Delta: 11, Length: 1, Value: []byte("a")},
+		{Delta: 0, Length: 20, Value: bytes.Repeat([]byte("b"), 20)},
+	}, []byte("Hi"), true)
+
+	diff := cmp.Diff(want, got)
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestEncodeRawDecodeError documents how the decoder fails on malformed wire forms.
+func TestEncodeRawDecodeError(t *testing.T) {
+	tests := []struct {
+		name   string
+		header coap.Header
+		opts   []RawOption
+		err    error
+	}{
+		{
+			name: "reserved delta nibble",
+			opts: []RawOption{
+				{ForceExtend: 0xF0},
+			},
+			err: coap.UnmarshalError{
+				Offset: 9,
+				Cause:  coap.UnsupportedExtendError{},
+			},
+		},
+		{
+			name: "reserved length nibble",
+			opts: []RawOption{
+				{Delta: 11, ForceExtend: 0x0F},
+			},
+			err: coap.UnmarshalError{
+				Offset: 9,
+				Cause:  coap.UnsupportedExtendError{},
+			},
+		},
+		{
+			name: "length exceeds data",
+			opts: []RawOption{
+				{Delta: 11, Length: 4, Value: []byte("a")},
+			},
+			err: coap.UnmarshalError{
+				Offset: 9,
+				Cause: coap.TruncatedError{
+					Expected: 4,
+				},
+			},
+		},
+		{
+			name: "oversize length",
+			opts: []RawOption{
+				{Delta: 11, Length: 300, Value: bytes.Repeat([]byte("a"), 300)},
+			},
+			err: coap.UnmarshalError{
+				Offset: 11,
+				Cause: coap.InvalidOptionValueLength{
+					OptionDef: coap.URIPath,
+					Length:    300,
+				},
+			},
+		},
+		{
+			name: "repeated critical option",
+			opts: []RawOption{
+				{Delta: 3, Length: 1, Value: []byte("a")},
+				{Delta: 0, Length: 1, Value: []byte("b")},
+			},
+			err: coap.UnmarshalError{
+				Offset: 12,
+				Cause: coap.OptionNotRepeateable{
+					OptionDef: coap.URIHost,
+				},
+			},
+		},
+		{
+			name: "token too long",
+			header: coap.Header{
+				Version: coap.ProtocolVersion,
+				Token:   make(coap.Token, 9),
+			},
+			err: coap.UnmarshalError{
+				Offset: 4,
+				Cause: coap.UnsupportedTokenLength{
+					Length: 9,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := test.header
+			if h.Version == 0 {
+				h = header
+			}
+
+			msg := &coap.Message{}
+			_, err := msg.Decode(EncodeRaw(h, test.opts, nil, false), coap.MarshalOptions{})
+
+			diff := cmp.Diff(test.err, err, cmpopts.EquateErrors())
+			if diff != "" {
+				t.Errorf("error mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package coaptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uramaki-io/coap"
+	"github.com/uramaki-io/coap/internal/deadline"
+)
+
+// ReplayAddr is the local address of ReplayPacketConn.
+const ReplayAddr PipeAddr = "replay"
+
+// ReplayOptions holds options for ReplayPacketConn.
+type ReplayOptions struct {
+	// Key returns the key matching outbound messages to recorded ones, defaults to DefaultReplayKey.
+	Key func(msg *coap.Message) string
+}
+
+// ReplayPacketConn is an in-memory net.PacketConn replaying a Cassette, intended for tests of clients
+// recorded against real devices.
+//
+// Each datagram written is matched by key to the first unused recorded outbound datagram, and inbound
+// datagrams recorded after it are delivered to ReadFrom as sent by the address written to. MessageID and
+// Token of the recorded request are rewritten to those of the live one in replayed responses, MessageID only
+// in acknowledgements and resets. Datagrams are replayed immediately, recorded offsets are not waited for.
+//
+// Writes of unmatched datagrams fail with UnmatchedDatagram.
+type ReplayPacketConn struct {
+	key func(msg *coap.Message) string
+
+	mtx       sync.Mutex
+	exchanges []replayExchange
+
+	rx        chan deadline.Datagram
+	reader    *deadline.Reader
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// replayExchange is a recorded outbound datagram followed by inbound datagrams.
+type replayExchange struct {
+	key     string
+	request []byte
+	replies [][]byte
+	used    bool
+}
+
+// NewReplayPacketConn instantiates a new ReplayPacketConn replaying the cassette.
+//
+// Inbound datagrams recorded before the first outbound one are never replayed.
+func NewReplayPacketConn(cassette *Cassette, opts ReplayOptions) *ReplayPacketConn {
+	if opts.Key == nil {
+		opts.Key = DefaultReplayKey
+	}
+
+	r := &ReplayPacketConn{
+		key:    opts.Key,
+		rx:     make(chan deadline.Datagram, PipeBacklog),
+		closed: make(chan struct{}),
+	}
+	r.reader = deadline.NewReader(r.rx, r.closed)
+
+	for _, d := range cassette.Datagrams {
+		switch {
+		case d.Direction == CassetteOutbound:
+			r.exchanges = append(r.exchanges, replayExchange{
+				key:     r.datagramKey(d.Data),
+				request: d.Data,
+			})
+		case len(r.exchanges) != 0:
+			last := &r.exchanges[len(r.exchanges)-1]
+			last.replies = append(last.replies, d.Data)
+		}
+	}
+
+	return r
+}
+
+// DefaultReplayKey returns the key of the message made of its code, options forming Options.CacheKey
+// and payload. MessageID, Token and Type are left out, so that retries and fresh tokens match.
+func DefaultReplayKey(msg *coap.Message) string {
+	data := []byte{byte(msg.Code)}
+	data = msg.Options.CacheKey(data)
+	data = append(data, coap.PayloadMarker)
+	data = append(data, msg.Payload...)
+
+	return string(data)
+}
+
+// Remaining returns the number of recorded outbound datagrams not matched yet.
+func (r *ReplayPacketConn) Remaining() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	remaining := 0
+	for _, exchange := range r.exchanges {
+		if !exchange.used {
+			remaining++
+		}
+	}
+
+	return remaining
+}
+
+// ReadFrom implements net.PacketConn.
+//
+// Datagrams larger than the buffer are truncated.
+func (r *ReplayPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return r.reader.ReadFrom(b)
+}
+
+// WriteTo implements net.PacketConn, replaying datagrams recorded in response to the matching datagram.
+//
+// Returns UnmatchedDatagram if no unused recorded datagram matches.
+func (r *ReplayPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	key := r.datagramKey(b)
+
+	r.mtx.Lock()
+	index := slices.IndexFunc(r.exchanges, func(exchange replayExchange) bool {
+		return !exchange.used && exchange.key == key
+	})
+	if index < 0 {
+		err := r.unmatched(b)
+		r.mtx.Unlock()
+
+		return 0, err
+	}
+
+	exchange := &r.exchanges[index]
+	exchange.used = true
+	recorded := exchange.request
+	replies := exchange.replies
+	r.mtx.Unlock()
+
+	for _, reply := range replies {
+		d := deadline.Datagram{
+			Data: rewriteReply(reply, recorded, b),
+			Addr: addr,
+		}
+
+		select {
+		case r.rx <- d:
+		default: // backlog full
+		}
+	}
+
+	return len(b), nil
+}
+
+// Close implements net.PacketConn.
+func (r *ReplayPacketConn) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+
+	return nil
+}
+
+// LocalAddr implements net.PacketConn.
+func (r *ReplayPacketConn) LocalAddr() net.Addr {
+	return ReplayAddr
+}
+
+// SetDeadline implements net.PacketConn.
+func (r *ReplayPacketConn) SetDeadline(t time.Time) error {
+	return r.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+//
+// Deadline applies to pending and subsequent ReadFrom calls.
+func (r *ReplayPacketConn) SetReadDeadline(t time.Time) error {
+	r.reader.SetDeadline(t)
+
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn.
+//
+// Writes never block, so the deadline is ignored.
+func (r *ReplayPacketConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+// datagramKey returns the key of the datagram, undecodable datagrams only match identical ones.
+func (r *ReplayPacketConn) datagramKey(data []byte) string {
+	msg := &coap.Message{}
+	_, err := msg.Decode(data, coap.MarshalOptions{})
+	if err != nil {
+		return "raw:" + hex.EncodeToString(data)
+	}
+
+	return r.key(msg)
+}
+
+// unmatched returns UnmatchedDatagram with the diff against the unused recorded outbound datagram
+// differing the least from the datagram.
+func (r *ReplayPacketConn) unmatched(data []byte) error {
+	live := describeDatagram(data)
+
+	nearest := ""
+	best := -1
+	for _, exchange := range r.exchanges {
+		if exchange.used {
+			continue
+		}
+
+		diff, changed := diffLines(describeDatagram(exchange.request), live)
+		if best < 0 || changed < best {
+			nearest, best = diff, changed
+		}
+	}
+
+	return UnmatchedDatagram{
+		Diff: nearest,
+	}
+}
+
+// rewriteReply rewrites MessageID and Token of the recorded request in the reply to those of the live request.
+//
+// MessageID is rewritten in acknowledgements and resets only, Confirmable and NonConfirmable replies carry
+// MessageIDs of the peer.
+func rewriteReply(reply, recorded, live []byte) []byte {
+	replyID, replyToken, rest, ok := splitHeader(reply)
+	recordedID, recordedToken, _, ok1 := splitHeader(recorded)
+	liveID, liveToken, _, ok2 := splitHeader(live)
+	if !ok || !ok1 || !ok2 {
+		return slices.Clone(reply)
+	}
+
+	typ := coap.Type(reply[0] >> 4 & 0x03)
+	if (typ == coap.Acknowledgement || typ == coap.Reset) && replyID == recordedID {
+		replyID = liveID
+	}
+
+	if len(replyToken) != 0 && bytes.Equal(replyToken, recordedToken) {
+		replyToken = liveToken
+	}
+
+	rewritten := make([]byte, 0, len(reply)-len(recordedToken)+len(liveToken))
+	rewritten = append(rewritten, reply[0]&0xF0|uint8(len(replyToken)), reply[1])
+	rewritten = binary.BigEndian.AppendUint16(rewritten, uint16(replyID))
+	rewritten = append(rewritten, replyToken...)
+
+	return append(rewritten, rest...)
+}
+
+// splitHeader returns MessageID, Token and the data following them.
+func splitHeader(data []byte) (coap.MessageID, []byte, []byte, bool) {
+	if len(data) < coap.HeaderLength {
+		return 0, nil, nil, false
+	}
+
+	length := int(data[0] & 0x0F)
+	if length > coap.TokenMaxLength || len(data) < coap.HeaderLength+length {
+		return 0, nil, nil, false
+	}
+
+	id := coap.MessageID(binary.BigEndian.Uint16(data[2:4]))
+
+	return id, data[coap.HeaderLength : coap.HeaderLength+length], data[coap.HeaderLength+length:], true
+}
+
+// describeDatagram returns lines describing the message in the datagram, leaving out MessageID and Token.
+func describeDatagram(data []byte) []string {
+	msg := &coap.Message{}
+	_, err := msg.Decode(data, coap.MarshalOptions{})
+	if err != nil {
+		return []string{"undecodable " + hex.EncodeToString(data)}
+	}
+
+	lines := []string{
+		"type " + msg.Type.String(),
+		"code " + msg.Code.String(),
+	}
+	for _, opt := range msg.Options {
+		lines = append(lines, "option "+opt.String())
+	}
+
+	if len(msg.Payload) != 0 {
+		lines = append(lines, fmt.Sprintf("payload %q", msg.Payload))
+	}
+
+	return lines
+}
+
+// diffLines returns a line diff of a and b prefixed with "-" for lines only in a and "+" for lines only in b,
+// and the number of such lines.
+func diffLines(a, b []string) (string, int) {
+	// longest common subsequence table
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	diff := strings.Builder{}
+	changed := 0
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff.WriteString("- " + a[i] + "\n")
+			changed++
+			i++
+		default:
+			diff.WriteString("+ " + b[j] + "\n")
+			changed++
+			j++
+		}
+	}
+
+	return diff.String(), changed
+}
@@ -0,0 +1,271 @@
+package coaptest
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/uramaki-io/coap"
+)
+
+var recordCassettes = flag.Bool("record", false, "record cassettes in testdata against live peers instead of replaying them")
+
+// replayMessage encodes the message for cassettes.
+func replayMessage(t *testing.T, typ coap.Type, code coap.Code, id coap.MessageID, token coap.Token, path string, payload string) []byte {
+	t.Helper()
+
+	msg := &coap.Message{
+		Header: coap.Header{
+			Version: coap.ProtocolVersion,
+			Type:    typ,
+			Code:    code,
+			ID:      id,
+			Token:   token,
+		},
+		Payload: []byte(payload),
+	}
+	if path != "" {
+		coap.Must(msg.Options.SetString(coap.URIPath, path))
+	}
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	return data
+}
+
+// equateBinary shows byte slices in diffs as Go literals.
+func equateBinary() cmp.Option {
+	return cmp.Transformer("Hex", func(b []byte) string {
+		return fmt.Sprintf("%#v", b)
+	})
+}
+
+func expectErr(t testing.TB, err error, expected error) {
+	t.Helper()
+
+	diff := cmp.Diff(expected, err, cmpopts.EquateErrors())
+	if diff != "" {
+		t.Errorf("error mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRewriteReply(t *testing.T) {
+	recorded := replayMessage(t, coap.Confirmable, coap.Code(coap.GET), 0x1111, coap.Token{0xaa, 0xbb}, "temp", "")
+	live := replayMessage(t, coap.Confirmable, coap.Code(coap.GET), 0x2222, coap.Token{0x01, 0x02, 0x03, 0x04}, "temp", "")
+
+	tests := []struct {
+		name   string
+		reply  []byte
+		expect []byte
+	}{
+		{
+			name:   "piggybacked response",
+			reply:  replayMessage(t, coap.Acknowledgement, coap.Code(coap.Content), 0x1111, coap.Token{0xaa, 0xbb}, "", "20C"),
+			expect: replayMessage(t, coap.Acknowledgement, coap.Code(coap.Content), 0x2222, coap.Token{0x01, 0x02, 0x03, 0x04}, "", "20C"),
+		},
+		{
+			name:   "empty acknowledgement",
+			reply:  replayMessage(t, coap.Acknowledgement, 0, 0x1111, nil, "", ""),
+			expect: replayMessage(t, coap.Acknowledgement, 0, 0x2222, nil, "", ""),
+		},
+		{
+			name:   "reset",
+			reply:  replayMessage(t, coap.Reset, 0, 0x1111, nil, "", ""),
+			expect: replayMessage(t, coap.Reset, 0, 0x2222, nil, "", ""),
+		},
+		{
+			name:   "separate response keeps peer message ID",
+			reply:  replayMessage(t, coap.Confirmable, coap.Code(coap.Content), 0x1111, coap.Token{0xaa, 0xbb}, "", "20C"),
+			expect: replayMessage(t, coap.Confirmable, coap.Code(coap.Content), 0x1111, coap.Token{0x01, 0x02, 0x03, 0x04}, "", "20C"),
+		},
+		{
+			name:   "other token",
+			reply:  replayMessage(t, coap.NonConfirmable, coap.Code(coap.Content), 0x3333, coap.Token{0xcc}, "", "20C"),
+			expect: replayMessage(t, coap.NonConfirmable, coap.Code(coap.Content), 0x3333, coap.Token{0xcc}, "", "20C"),
+		},
+		{
+			name:   "truncated",
+			reply:  []byte{0x62, 0x45},
+			expect: []byte{0x62, 0x45},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rewritten := rewriteReply(test.reply, recorded, live)
+			diff := cmp.Diff(test.expect, rewritten, equateBinary())
+			if diff != "" {
+				t.Errorf("reply mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReplayPacketConn(t *testing.T) {
+	request := replayMessage(t, coap.Confirmable, coap.Code(coap.GET), 0x1111, coap.Token{0xaa}, "temp", "")
+	cassette := &Cassette{
+		Datagrams: []CassetteDatagram{
+			{Direction: CassetteInbound, Data: []byte{0xff}}, // before any request, never replayed
+			{Direction: CassetteOutbound, Data: request},
+			{Direction: CassetteInbound, Data: replayMessage(t, coap.Acknowledgement, coap.Code(coap.Content), 0x1111, coap.Token{0xaa}, "", "first")},
+			{Direction: CassetteOutbound, Data: request},
+			{Direction: CassetteInbound, Data: replayMessage(t, coap.Acknowledgement, coap.Code(coap.Content), 0x1111, coap.Token{0xaa}, "", "second")},
+		},
+	}
+
+	replay := NewReplayPacketConn(cassette, ReplayOptions{})
+	defer replay.Close()
+
+	peer := PipeAddr("device")
+	buf := make([]byte, coap.MaxMessageLength)
+	for i, payload := range []string{"first", "second"} {
+		id := coap.MessageID(0x2000 + i)
+		_, err := replay.WriteTo(replayMessage(t, coap.Confirmable, coap.Code(coap.GET), id, coap.Token{0x01, byte(i)}, "temp", ""), peer)
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+
+		n, from, err := replay.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+
+		expect := replayMessage(t, coap.Acknowledgement, coap.Code(coap.Content), id, coap.Token{0x01, byte(i)}, "", payload)
+		diff := cmp.Diff(expect, buf[:n], equateBinary())
+		if diff != "" {
+			t.Errorf("reply mismatch (-want +got):\n%s", diff)
+		}
+
+		if from != peer {
+			t.Errorf("reply from %v, want %v", from, peer)
+		}
+	}
+
+	if replay.Remaining() != 0 {
+		t.Errorf("remaining = %d, want 0", replay.Remaining())
+	}
+
+	_, err := replay.WriteTo(request, peer)
+	expectErr(t, err, UnmatchedDatagram{})
+}
+
+func TestReplayPacketConnUnmatched(t *testing.T) {
+	cassette := &Cassette{
+		Datagrams: []CassetteDatagram{
+			{Direction: CassetteOutbound, Data: replayMessage(t, coap.Confirmable, coap.Code(coap.POST), 0x1111, coap.Token{0xaa}, "log", "boot")},
+			{Direction: CassetteOutbound, Data: replayMessage(t, coap.Confirmable, coap.Code(coap.GET), 0x1112, coap.Token{0xab}, "temp", "")},
+		},
+	}
+
+	replay := NewReplayPacketConn(cassette, ReplayOptions{})
+	defer replay.Close()
+
+	_, err := replay.WriteTo(replayMessage(t, coap.Confirmable, coap.Code(coap.GET), 0x2222, coap.Token{0x01}, "humidity", ""), PipeAddr("device"))
+	expectErr(t, err, UnmatchedDatagram{
+		Diff: "  type CON\n" +
+			"  code 0.01\n" +
+			"- option URIPath(\"temp\")\n" +
+			"+ option URIPath(\"humidity\")\n",
+	})
+
+	if replay.Remaining() != 2 {
+		t.Errorf("remaining = %d, want 2", replay.Remaining())
+	}
+}
+
+// TestReplayBlockwiseGet replays a blockwise GET recorded from a server, run with -record to re-record it.
+func TestReplayBlockwiseGet(t *testing.T) {
+	path := filepath.Join("testdata", "blockwise_get.json")
+	body := bytes.Repeat([]byte("0123456789"), 10)
+	server := PipeAddr("pipe-b")
+
+	var delegate net.PacketConn
+	var recorder *RecordingPacketConn
+	var replay *ReplayPacketConn
+	if *recordCassettes {
+		a, b := Pipe()
+		serverConn := coap.NewConn(b, coap.ConnOptions{})
+		defer serverConn.Close()
+
+		go func() {
+			_ = coap.NewServer(serverConn, coap.HandlerFunc(func(_ context.Context, w coap.ResponseWriter, _ *coap.Request) {
+				_ = w.Write(&coap.Response{
+					Code: coap.Content,
+					Body: bytes.NewReader(body),
+				})
+			}), coap.ServerOptions{}).Serve(context.Background())
+		}()
+
+		recorder = NewRecordingPacketConn(a, nil)
+		delegate = recorder
+	} else {
+		cassette, err := LoadCassette(path)
+		if err != nil {
+			t.Fatal("load:", err)
+		}
+
+		replay = NewReplayPacketConn(cassette, ReplayOptions{})
+		delegate = replay
+	}
+
+	conn := coap.NewConn(delegate, coap.ConnOptions{})
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	received := []byte{}
+	for num := uint32(0); ; num++ {
+		req := &coap.Request{
+			Type:   coap.Confirmable,
+			Method: coap.GET,
+			Path:   "/blob",
+			Token:  coap.RandTokenSource(coap.TokenLength)(),
+		}
+		coap.Must(req.Options.SetBlock(coap.Block2, coap.BlockValue{Num: num, SZX: 1}))
+
+		resp, err := conn.Do(ctx, req, server)
+		if err != nil {
+			t.Fatalf("block %d: %v", num, err)
+		}
+
+		received = append(received, resp.Payload...)
+
+		block, err := resp.Options.GetBlock(coap.Block2)
+		if err != nil {
+			t.Fatalf("block %d: %v", num, err)
+		}
+
+		if !block.More {
+			break
+		}
+	}
+
+	diff := cmp.Diff(body, received)
+	if diff != "" {
+		t.Errorf("body mismatch (-want +got):\n%s", diff)
+	}
+
+	if recorder != nil {
+		err := recorder.Cassette().Save(path)
+		if err != nil {
+			t.Fatal("save:", err)
+		}
+
+		return
+	}
+
+	if replay.Remaining() != 0 {
+		t.Errorf("remaining = %d, want 0", replay.Remaining())
+	}
+}
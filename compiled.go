@@ -0,0 +1,259 @@
+package coap
+
+import (
+	"cmp"
+	"iter"
+	"slices"
+)
+
+// compiledDirect is the number of option codes indexed directly.
+const compiledDirect = 64
+
+// CompiledOptions is a read-only view of Options with constant time lookup by option code.
+//
+// Codes below 64, covering all options of RFC 7252 and RFC 7959, are indexed directly,
+// other codes are found by binary search.
+//
+// It is a snapshot: options are sorted by code when compiled and the view is invalidated
+// by any later mutation of the options it was compiled from.
+type CompiledOptions struct {
+	options Options
+
+	// direct indexes codes below compiledDirect, other codes are found by binary search
+	direct [compiledDirect]span
+}
+
+// span locates options with the same code in the sorted options, count of zero indicates absence.
+type span struct {
+	start uint16
+	count uint16
+}
+
+// Compile builds a CompiledOptions view of the options.
+//
+// Options which are already sorted by code, such as decoded options, are not copied.
+func (o Options) Compile() CompiledOptions {
+	sorted := func(l, r Option) int {
+		return cmp.Compare(l.Code, r.Code)
+	}
+
+	options := o
+	if !slices.IsSortedFunc(options, sorted) {
+		options = SortOptions(options)
+	}
+
+	c := CompiledOptions{
+		options: options,
+	}
+
+	for i, opt := range options {
+		if opt.Code >= compiledDirect {
+			break
+		}
+
+		s := &c.direct[opt.Code]
+		if s.count == 0 {
+			s.start = uint16(i)
+		}
+		s.count++
+	}
+
+	return c
+}
+
+// Options returns the options sorted by code.
+func (c *CompiledOptions) Options() Options {
+	return c.options
+}
+
+// Count returns the number of options matching the definition.
+func (c *CompiledOptions) Count(def OptionDef) int {
+	return int(c.span(def.Code).count)
+}
+
+// Contains checks if the given option is present.
+func (c *CompiledOptions) Contains(def OptionDef) bool {
+	return c.span(def.Code).count != 0
+}
+
+// Get retrieves the first option matching the definition.
+func (c *CompiledOptions) Get(def OptionDef) (Option, bool) {
+	s := c.span(def.Code)
+	if s.count == 0 {
+		return Option{}, false
+	}
+
+	return c.options[s.start], true
+}
+
+// GetAll retrieves all options matching the definition.
+func (c *CompiledOptions) GetAll(def OptionDef) iter.Seq[Option] {
+	s := c.span(def.Code)
+	return slices.Values(c.options[s.start : s.start+s.count])
+}
+
+// GetValue retrieves the value of the first option matching the definition.
+func (c *CompiledOptions) GetValue(def OptionDef) (any, bool) {
+	opt, ok := c.Get(def)
+	if !ok {
+		return nil, false
+	}
+
+	return opt.GetValue(), true
+}
+
+// GetUint retrieves the value of the first option matching the definition as uint32.
+//
+// Returns OptionNotFound if the option is not present.
+//
+// Returns InvalidOptionValueFormat if the option value format is not ValueFormatUint.
+func (c *CompiledOptions) GetUint(def OptionDef) (uint32, error) {
+	opt, ok := c.first(def)
+	if !ok {
+		return 0, OptionNotFound{
+			OptionDef: def,
+		}
+	}
+
+	return opt.GetUint()
+}
+
+// GetAllUint retrieves all options matching the definition as a sequence of uint32 values.
+//
+// Returns InvalidOptionValueFormat if the value format is not ValueFormatUint.
+func (c *CompiledOptions) GetAllUint(def OptionDef) (iter.Seq[uint32], error) {
+	s := c.span(def.Code)
+	return c.options[s.start : s.start+s.count].GetAllUint(def)
+}
+
+// GetBlock retrieves the value of Block1 or Block2 option.
+//
+// Returns OptionNotFound if the option is not present.
+//
+// Returns InvalidBlockSize if the size exponent is the reserved value 7.
+func (c *CompiledOptions) GetBlock(def OptionDef) (BlockValue, error) {
+	v, err := c.GetUint(def)
+	if err != nil {
+		return BlockValue{}, err
+	}
+
+	return ParseBlockValue(v)
+}
+
+// GetOpaque retrieves the value of the first option matching the definition as []byte.
+//
+// Returns OptionNotFound if the option is not present.
+//
+// Returns InvalidOptionValueFormat if the value format is not ValueFormatOpaque.
+func (c *CompiledOptions) GetOpaque(def OptionDef) ([]byte, error) {
+	opt, ok := c.first(def)
+	if !ok {
+		return nil, OptionNotFound{
+			OptionDef: def,
+		}
+	}
+
+	return opt.GetOpaque()
+}
+
+// GetAllOpaque retrieves all options matching the definition as a sequence of []byte values.
+//
+// Returns InvalidOptionValueFormat if the value format is not ValueFormatOpaque.
+func (c *CompiledOptions) GetAllOpaque(def OptionDef) (iter.Seq[[]byte], error) {
+	s := c.span(def.Code)
+	return c.options[s.start : s.start+s.count].GetAllOpaque(def)
+}
+
+// GetString retrieves the value of the first option matching the definition as string.
+//
+// Returns OptionNotFound if the option is not present.
+//
+// Returns InvalidOptionValueFormat if the value format is not ValueFormatString.
+func (c *CompiledOptions) GetString(def OptionDef) (string, error) {
+	opt, ok := c.first(def)
+	if !ok {
+		return "", OptionNotFound{
+			OptionDef: def,
+		}
+	}
+
+	return opt.GetString()
+}
+
+// GetAllString retrieves all options matching the definition as a sequence of string values.
+//
+// Returns InvalidOptionValueFormat if the value format is not ValueFormatString.
+func (c *CompiledOptions) GetAllString(def OptionDef) (iter.Seq[string], error) {
+	s := c.span(def.Code)
+	return c.options[s.start : s.start+s.count].GetAllString(def)
+}
+
+// decodedAs reports whether options with the code of the definition are present and were decoded
+// with its value format, which is not the case if the schema masks or redefines the option.
+func (c *CompiledOptions) decodedAs(def OptionDef) bool {
+	opt, ok := c.first(def)
+	return ok && opt.ValueFormat == def.ValueFormat
+}
+
+// lookupUint returns the value of the first option matching the definition if it is present and was
+// decoded as ValueFormatUint, without allocating the errors GetUint returns for absent options.
+func (c *CompiledOptions) lookupUint(def OptionDef) (uint32, bool) {
+	opt, ok := c.first(def)
+	if !ok || opt.ValueFormat != ValueFormatUint {
+		return 0, false
+	}
+
+	return opt.uintValue, true
+}
+
+// lookupBlock returns the value of Block1 or Block2 option if it is present and valid, like lookupUint.
+func (c *CompiledOptions) lookupBlock(def OptionDef) (BlockValue, bool) {
+	v, ok := c.lookupUint(def)
+	if !ok {
+		return BlockValue{}, false
+	}
+
+	block, err := ParseBlockValue(v)
+	return block, err == nil
+}
+
+// first returns the first option matching the definition without copying it.
+func (c *CompiledOptions) first(def OptionDef) (*Option, bool) {
+	s := c.span(def.Code)
+	if s.count == 0 {
+		return nil, false
+	}
+
+	return &c.options[s.start], true
+}
+
+func (c *CompiledOptions) span(code uint16) span {
+	if code < compiledDirect {
+		return c.direct[code]
+	}
+
+	// searched by hand, the comparator of slices.BinarySearchFunc costs more than the lookup in few options
+	start, end := 0, len(c.options)
+	for start < end {
+		mid := int(uint(start+end) >> 1)
+		if c.options[mid].Code < code {
+			start = mid + 1
+		} else {
+			end = mid
+		}
+	}
+
+	if start == len(c.options) || c.options[start].Code != code {
+		return span{}
+	}
+
+	end = start + 1
+	for end < len(c.options) && c.options[end].Code == code {
+		end++
+	}
+
+	return span{
+		start: uint16(start),
+		count: uint16(end - start),
+	}
+}
@@ -0,0 +1,126 @@
+package coap
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var vendorOption = OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatOpaque, MaxLen: 8}
+
+func compiledTestOptions() Options {
+	return Options{
+		MustOptionValue(URIPath, "a"),
+		MustOptionValue(vendorOption, bytes4),
+		MustOptionValue(URIHost, "example.com"),
+		MustOptionValue(URIPath, "b"),
+		MustOptionValue(Accept, uint32(MediaTypeApplicationCBOR.Code)),
+		MustOptionValue(ContentFormat, uint32(MediaTypeApplicationJSON.Code)),
+		MustOptionValue(Observe, ObserveRegister),
+		MustOptionValue(URIQuery, "x=1"),
+		MustOptionValue(URIPath, "c"),
+		MustOptionValue(URIQuery, "y=2"),
+	}
+}
+
+func TestCompiledOptions(t *testing.T) {
+	options := compiledTestOptions()
+	compiled := options.Compile()
+
+	if !slices.IsSortedFunc(compiled.Options(), func(l, r Option) int {
+		return int(l.Code) - int(r.Code)
+	}) {
+		t.Error("expected compiled options to be sorted")
+	}
+
+	path := slices.Collect(MustValue(compiled.GetAllString(URIPath)))
+	diff := cmp.Diff([]string{"a", "b", "c"}, path)
+	if diff != "" {
+		t.Errorf("path mismatch (-want +got):\n%s", diff)
+	}
+
+	if n := compiled.Count(URIQuery); n != 2 {
+		t.Errorf("Count(URIQuery) = %d, want 2", n)
+	}
+
+	if v := MustValue(compiled.GetUint(Accept)); v != uint32(MediaTypeApplicationCBOR.Code) {
+		t.Errorf("GetUint(Accept) = %d", v)
+	}
+
+	if v := MustValue(compiled.GetString(URIHost)); v != "example.com" {
+		t.Errorf("GetString(URIHost) = %q", v)
+	}
+
+	diff = cmp.Diff(bytes4, MustValue(compiled.GetOpaque(vendorOption)))
+	if diff != "" {
+		t.Errorf("vendor mismatch (-want +got):\n%s", diff)
+	}
+
+	if compiled.Contains(Size1) {
+		t.Error("expected Size1 to be absent")
+	}
+
+	_, err := compiled.GetUint(Size1)
+	expectErr(t, err, OptionNotFound{OptionDef: Size1})
+
+	_, err = compiled.GetAllUint(URIPath)
+	expectErr(t, err, InvalidOptionValueFormat{OptionDef: URIPath, Requested: ValueFormatUint})
+
+	// unsorted options are copied, so the snapshot is not affected by mutation
+	options.Clear(URIPath)
+	if n := compiled.Count(URIPath); n != 3 {
+		t.Errorf("Count(URIPath) after mutation = %d, want 3", n)
+	}
+}
+
+func BenchmarkOptionsLookup(b *testing.B) {
+	options := SortOptions(compiledTestOptions())
+
+	b.Run("options", func(b *testing.B) {
+		for b.Loop() {
+			_, _ = options.GetString(URIHost)
+			_, _ = options.GetUint(Accept)
+			_, _ = options.GetUint(ContentFormat)
+			_, _ = options.GetUint(Observe)
+			_, _ = options.GetOpaque(vendorOption)
+			_, _ = options.Get(Block1)
+			_, _ = options.Get(Size1)
+			_ = options.Contains(URIQuery)
+		}
+	})
+
+	b.Run("compiled", func(b *testing.B) {
+		for b.Loop() {
+			compiled := options.Compile()
+			_, _ = compiled.GetString(URIHost)
+			_, _ = compiled.GetUint(Accept)
+			_, _ = compiled.GetUint(ContentFormat)
+			_, _ = compiled.GetUint(Observe)
+			_, _ = compiled.GetOpaque(vendorOption)
+			_, _ = compiled.Get(Block1)
+			_, _ = compiled.Get(Size1)
+			_ = compiled.Contains(URIQuery)
+		}
+	})
+}
+
+func BenchmarkRequestDecode(b *testing.B) {
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			ID:      0x4242,
+			Token:   bytes4,
+		},
+		Options: compiledTestOptions(),
+	}
+	data := MustValue(msg.MarshalBinary())
+
+	var req Request
+	b.ReportAllocs()
+	for b.Loop() {
+		_, _ = req.Decode(data, MarshalOptions{})
+	}
+}
@@ -2,6 +2,8 @@ package coap
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"math/rand/v2"
 	"net"
 	"slices"
@@ -14,58 +16,306 @@ const (
 	ACKTimeout      = 2 * time.Second
 	ACKRandomFactor = 1.5
 	MaxRetransmit   = 4
+
+	// WriteRetries is the default maximum number of retries after a transient write error.
+	WriteRetries = 2
+
+	// WriteRetryBackoff is the default delay before each retry of a transient write error.
+	WriteRetryBackoff = 10 * time.Millisecond
+
+	// ReceiveBufferSize is the default size of the datagram receive buffer, the maximum UDP payload.
+	ReceiveBufferSize = 65535
+
+	// MinRetransmitInterval is the lower bound of RetransmitQueue.Next, so that due messages
+	// do not make the retransmit timer spin.
+	MinRetransmitInterval = time.Millisecond
+
+	// MaxRetransmitLimit is the largest MaxRetransmit for which the retransmission timeout does not overflow.
+	MaxRetransmitLimit = 31
+
+	// receiveQueueLength is the number of messages queued for Read before the oldest ones are dropped.
+	receiveQueueLength = 64
 )
 
 var NoopRetransmitErrorHandler RetransmitErrorHandler = func(_ *Message, _ error) {}
 
+// RateLimitedErrorHandler returns a RetransmitErrorHandler passing at most one error per window to inner.
+//
+// Errors within the window after the first one are suppressed and counted. At the end of the window
+// the last suppressed error is passed to inner wrapped in SuppressedErrors with the count, which starts
+// the next window, so that the summary of the last burst is not lost.
+func RateLimitedErrorHandler(inner RetransmitErrorHandler, every time.Duration) RetransmitErrorHandler {
+	return rateLimitedErrorHandler(inner, every, RealClock)
+}
+
+func rateLimitedErrorHandler(inner RetransmitErrorHandler, every time.Duration, clock Clock) RetransmitErrorHandler {
+	var (
+		mtx        sync.Mutex
+		window     time.Time
+		suppressed uint
+		lastMsg    *Message
+		lastErr    error
+	)
+
+	flush := func() {
+		mtx.Lock()
+		window = clock.Now()
+		msg, err := lastMsg, lastErr
+		n := suppressed
+		suppressed = 0
+		lastMsg, lastErr = nil, nil
+		mtx.Unlock()
+
+		inner(msg, SuppressedErrors{
+			Err:        err,
+			Suppressed: n,
+			Window:     every,
+		})
+	}
+
+	return func(msg *Message, err error) {
+		mtx.Lock()
+		now := clock.Now()
+		if !window.IsZero() && now.Before(window.Add(every)) {
+			if suppressed == 0 {
+				t := clock.NewTimer(window.Add(every).Sub(now))
+				go func() {
+					defer t.Stop()
+
+					<-t.C()
+					flush()
+				}()
+			}
+
+			suppressed++
+			lastMsg, lastErr = msg, err
+			mtx.Unlock()
+			return
+		}
+
+		window = now
+		mtx.Unlock()
+
+		inner(msg, err)
+	}
+}
+
 // Conn represents a CoAP connection over a net.PacketConn with retransmission of Confirmable messages.
 type Conn struct {
 	delegate net.PacketConn
 	opts     ConnOptions
 
-	rx *Reader
-	tx *Writer
+	rx    *Reader
+	tx    *Writer
+	peers *PeerTable
+
+	closed  atomic.Bool
+	done    chan struct{}
+	stopped chan struct{}
+	add     chan WriteOp
+	remove  chan MessageID
+
+	// handling counts calls of the ErrorHandler running from the retransmit loop or restore
+	handling atomic.Int32
+
+	// completed receives acknowledgements and resets read with the time they were received
+	completed chan completion
+
+	// inflight holds MessageIDs of pending exchanges, so that they are not reassigned
+	inflight *inflightIDs
+
+	// slots limits pending exchanges if MaxPendingExchanges is set
+	slots     chan struct{}
+	pending   atomic.Int64
+	abandoned atomic.Uint64
 
-	closed atomic.Bool
-	done   chan struct{}
-	add    chan WriteOp
-	remove chan MessageID
+	unrecognized atomic.Uint64
+
+	// restored holds messages loaded from Store until run takes over
+	restored []WriteOp
+
+	// calls holds requests awaiting responses, callMtx guards operations spanning several calls of it
+	callMtx sync.Mutex
+	calls   *ExchangeStore[*clientCall]
+
+	// received queues messages read by the dispatcher and not awaited by calls for Read,
+	// dispatching is set while the dispatcher runs
+	received    chan received
+	dispatchMtx sync.Mutex
+	dispatching bool
+}
+
+// received is a message queued by the dispatcher for Read, or the error reading it.
+type received struct {
+	msg  *Message
+	addr net.Addr
+	err  error
+}
+
+// ConnStats holds statistics of a Conn.
+type ConnStats struct {
+	// PendingExchanges is the number of Confirmable messages awaiting acknowledgement.
+	PendingExchanges uint
+
+	// AbandonedExchanges is the number of Confirmable messages still pending when the connection was closed.
+	AbandonedExchanges uint
+
+	// UnrecognizedOptions is the number of unrecognized options in received messages, including dropped elective options.
+	UnrecognizedOptions uint
+}
+
+// completion is an acknowledgement or reset of the message ID received at the time.
+type completion struct {
+	id MessageID
+	at time.Time
 }
 
 // ConnOptions holds options for creating a new CoAP connection.
 type ConnOptions struct {
 	RetransmitOptions
+	WriteRetryOptions
 	MarshalOptions
+	BudgetOptions
+
+	// Clock schedules retransmissions and write retries, defaults to RealClock.
+	Clock Clock
+
+	// MessageIDSource generates message IDs, defaults to MessageIDSequenceRandom.
+	MessageIDSource MessageIDSource
+
+	// TokenSource generates tokens for requests written without one, tokens are not assigned if nil.
+	TokenSource TokenSource
+
+	// TokenPolicy enforces the minimum length of request tokens and may derive tokens from destinations.
+	TokenPolicy TokenPolicy
+
+	// ReresolveAfter is the number of host unreachable errors without a datagram received in between
+	// after which ClientConn resolves its address again, zero disables re-resolution.
+	ReresolveAfter uint
+
+	// AddrResolver resolves the address of ClientConn, defaults to ResolveUDPAddr.
+	AddrResolver AddrResolver
+
+	// ReceiveBufferSize is the size of the datagram receive buffer, defaults to ReceiveBufferSize.
+	//
+	// It is independent of MaxMessageLength: datagrams longer than the buffer are truncated by the
+	// socket, while datagrams within the buffer but longer than MaxMessageLength are rejected with
+	// MessageTooLong.
+	ReceiveBufferSize uint
+
+	// DecodeErrorHandler is called with datagrams that cannot be decoded, which Read then skips
+	// instead of returning the decode error, so that a read loop is not terminated by a single
+	// malformed datagram. raw aliases the receive buffer only for the duration of the call.
+	//
+	// If nil, Read returns decode errors, IsDecodeError tells them from transport errors.
+	DecodeErrorHandler func(raw []byte, addr net.Addr, err error)
+
+	// ConnErrorHandler is called with errors not tied to a message, which the ErrorHandler does not get:
+	// datagrams ReadLoop cannot decode while DecodeErrorHandler is nil, messages Store fails to load,
+	// messages dropped from the full queue of Read and failed re-resolutions of ClientConn.
+	// Defaults to ignoring them.
+	ConnErrorHandler func(err error)
+
+	// IdentityResolver resolves identities of peers for Identity and Authorize,
+	// peers have no identity if nil.
+	IdentityResolver IdentityResolver
+}
+
+// MessageConn reads and writes messages, implemented by Conn and ClientConn.
+type MessageConn interface {
+	// ReadMessage reads a message and returns the address it was received from.
+	ReadMessage(msg *Message) (net.Addr, error)
+
+	// WriteMessage sends a message to the address.
+	WriteMessage(msg *Message, addr net.Addr) error
+
+	LocalAddr() net.Addr
+	Close() error
 }
 
 // RetransmitOptions holds options for reliable message transmission.
 type RetransmitOptions struct {
 	ACKTimeout      time.Duration
 	ACKRandomFactor float64
-	MaxRetransmit   uint
+
+	// MaxRetransmit is the maximum number of retransmissions of a Confirmable message, zero disables
+	// retransmission, defaults to MaxRetransmit if nil.
+	MaxRetransmit *uint
+
 	MaxTransmitWait time.Duration
 	MaxTransmitSpan time.Duration
 	ErrorHandler    RetransmitErrorHandler
+
+	// MaxPendingExchanges is the maximum number of Confirmable messages awaiting acknowledgement,
+	// zero disables the limit.
+	MaxPendingExchanges uint
+
+	// BlockWhenFull makes writes of Confirmable messages wait for a pending exchange to complete
+	// when MaxPendingExchanges is reached, instead of failing with QueueFull.
+	BlockWhenFull bool
+
+	// Store persists pending Confirmable messages across restarts, defaults to NoopRetransmitStore.
+	Store RetransmitStore
+
+	// ResolveAddr resolves destination addresses of messages restored from Store, defaults to ResolveAddr.
+	ResolveAddr func(network string, address string) (net.Addr, error)
+
+	// TimeoutStrategy computes initial timeouts of Confirmable messages per destination and observes
+	// round-trip times of completed exchanges, defaults to FixedTimeout of ACKTimeout, see AdaptiveTimeout.
+	//
+	// Timeouts are bounded by MaxTransmitWait, which is derived from ACKTimeout.
+	TimeoutStrategy TimeoutStrategy
+}
+
+// maxRetransmit returns a copy of MaxRetransmit, or MaxRetransmit if it is not set.
+func (o RetransmitOptions) maxRetransmit() *uint {
+	n := uint(MaxRetransmit)
+	if o.MaxRetransmit != nil {
+		n = *o.MaxRetransmit
+	}
+
+	return &n
 }
 
+// RetransmitErrorHandler is called with a message that failed to be delivered and the error,
+// the message is never nil, errors not tied to a message are passed to ConnOptions.ConnErrorHandler.
 type RetransmitErrorHandler func(msg *Message, err error)
 
+// WriteRetryOptions holds options for retrying writes failing with transient errors.
+type WriteRetryOptions struct {
+	// MaxWriteRetries is the maximum number of retries after a transient write error, defaults to WriteRetries.
+	MaxWriteRetries uint
+
+	// WriteRetryBackoff is the delay before each retry, defaults to WriteRetryBackoff.
+	WriteRetryBackoff time.Duration
+
+	// IsTransient classifies write errors as transient, defaults to IsTransientError.
+	IsTransient func(err error) bool
+}
+
 // Reader reads messages from net.PacketConn using provided MarshalOptions.
 type Reader struct {
 	conn net.PacketConn
 	opts MarshalOptions
 
-	mtx sync.Mutex
-	buf []byte
+	mtx           sync.Mutex
+	buf           []byte
+	onDecodeError func(raw []byte, addr net.Addr, err error)
 }
 
 // Writer writes messages to net.PacketConn using provided MarshalOptions.
+//
+// Writer is safe for concurrent use. Messages are encoded into pooled buffers and written without
+// serialization, as net.PacketConn is safe for concurrent use. The number of concurrent writes is not
+// bounded, the pool grows to a buffer per concurrent write.
 type Writer struct {
-	conn net.PacketConn
-	opts MarshalOptions
+	conn  net.PacketConn
+	opts  MarshalOptions
+	retry WriteRetryOptions
+	clock Clock
 
-	mtx sync.Mutex
-	buf []byte
+	// buffers holds *[]byte encode buffers
+	buffers sync.Pool
 }
 
 // RetransmitQueue manages retransmission of Confirmable messages until they are acknowledged or the maximum retransmission limit/time is reached.
@@ -73,6 +323,9 @@ type RetransmitQueue struct {
 	opts RetransmitOptions
 	data []WriteOp
 	out  []WriteOp
+
+	// inflight indexes MessageIDs of queued messages for Conn, nil if not shared
+	inflight *inflightIDs
 }
 
 // WriteOp represents a write operation for a Confirmable message that needs retransmission.
@@ -83,10 +336,24 @@ type WriteOp struct {
 	Retransmit uint
 	Timeout    time.Duration
 	Next       time.Time
+
+	// Deadline after which the message is no longer retransmitted, zero for none.
+	Deadline time.Time
+
+	// deferred is set by Defer until the write is retried, writeRetries counts retries of the transmission
+	deferred     bool
+	writeRetries uint
 }
 
 // ListenPacket instantiates a new Conn that listens for incoming packets on the specified network and address.
+//
+// Returns InvalidConnOptions if options are not valid.
 func ListenPacket(ctx context.Context, network string, address string, opts ConnOptions) (*Conn, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	cfg := net.ListenConfig{}
 	delegate, err := cfg.ListenPacket(ctx, network, address)
 	if err != nil {
@@ -97,86 +364,563 @@ func ListenPacket(ctx context.Context, network string, address string, opts Conn
 }
 
 // NewConn instantiates a new Conn with the provided PacketConn and options.
+//
+// Zero options are set to their defaults, options are not validated, see ConnOptions.Validate.
 func NewConn(delegate net.PacketConn, opts ConnOptions) *Conn {
-	rx := NewReader(delegate, opts.MarshalOptions)
-	tx := NewWriter(delegate, opts.MarshalOptions)
+	if opts.IsTransient == nil {
+		opts.IsTransient = IsTransientError
+	}
+
+	if opts.MaxWriteRetries == 0 {
+		opts.MaxWriteRetries = WriteRetries
+	}
+
+	if opts.WriteRetryBackoff == 0 {
+		opts.WriteRetryBackoff = WriteRetryBackoff
+	}
+
+	if opts.ACKTimeout == 0 {
+		opts.ACKTimeout = ACKTimeout
+	}
+
+	if opts.ACKRandomFactor == 0 {
+		opts.ACKRandomFactor = ACKRandomFactor
+	}
+
+	if opts.TimeoutStrategy == nil {
+		opts.TimeoutStrategy = FixedTimeout(opts.ACKTimeout)
+	}
+
+	opts.MaxRetransmit = opts.maxRetransmit()
+	maxRetransmit := *opts.MaxRetransmit
+
+	if opts.MaxTransmitSpan == 0 {
+		// https://datatracker.ietf.org/doc/html/rfc7252#section-4.8.2
+		span := float64(opts.ACKTimeout) * float64(uint(1)<<maxRetransmit-1) * opts.ACKRandomFactor
+		opts.MaxTransmitSpan = time.Duration(span)
+	}
+
+	if opts.MaxTransmitWait == 0 {
+		wait := float64(opts.ACKTimeout) * float64(uint(1)<<(maxRetransmit+1)-1) * opts.ACKRandomFactor
+		opts.MaxTransmitWait = time.Duration(wait)
+	}
+
+	if opts.MaxMessageLength == 0 {
+		opts.MaxMessageLength = MaxMessageLength
+	}
+
+	if opts.ReceiveBufferSize == 0 {
+		opts.ReceiveBufferSize = ReceiveBufferSize
+	}
+
+	if opts.Clock == nil {
+		opts.Clock = RealClock
+	}
+
+	if opts.MessageIDSource == nil {
+		opts.MessageIDSource = MessageIDSequenceRandom()
+	}
+
+	if opts.ErrorHandler == nil {
+		opts.ErrorHandler = NoopRetransmitErrorHandler
+	}
+
+	if opts.ConnErrorHandler == nil {
+		opts.ConnErrorHandler = func(error) {}
+	}
+
+	if opts.Store == nil {
+		opts.Store = NoopRetransmitStore
+	}
+
+	if opts.ResolveAddr == nil {
+		opts.ResolveAddr = ResolveAddr
+	}
 
 	conn := &Conn{
-		delegate: delegate,
-		opts:     opts,
-		rx:       rx,
-		tx:       tx,
-		add:      make(chan WriteOp, 1),
-		remove:   make(chan MessageID, 1),
-		done:     make(chan struct{}, 1),
+		delegate:  delegate,
+		opts:      opts,
+		peers:     NewPeerTable(opts.BudgetOptions, opts.Clock),
+		inflight:  &inflightIDs{},
+		add:       make(chan WriteOp),
+		remove:    make(chan MessageID, 1),
+		completed: make(chan completion, 1),
+		received:  make(chan received, receiveQueueLength),
+		done:      make(chan struct{}, 1),
+		stopped:   make(chan struct{}),
+	}
+
+	// round-trip times are estimated per Conn in its PeerTable
+	adaptive, ok := opts.TimeoutStrategy.(*AdaptiveTimeout)
+	if ok {
+		conn.opts.TimeoutStrategy = adaptive.withPeers(conn.peers)
+	}
+
+	conn.calls = NewExchangeStore(ExchangeStoreOptions[*clientCall]{
+		Clock:   opts.Clock,
+		OnEvict: conn.evict,
+	})
+
+	if opts.MaxPendingExchanges != 0 {
+		conn.slots = make(chan struct{}, opts.MaxPendingExchanges)
 	}
 
+	rxOpts := opts.MarshalOptions
+	rxOpts.OptionHook = conn.countUnrecognized(opts.OptionHook)
+	conn.rx = NewReader(delegate, rxOpts).
+		WithBufferSize(opts.ReceiveBufferSize).
+		WithDecodeErrorHandler(opts.DecodeErrorHandler)
+	conn.tx = NewWriter(delegate, opts.MarshalOptions).WithRetry(opts.WriteRetryOptions).WithClock(opts.Clock)
+	conn.restored = conn.restore()
+
 	go conn.run()
 
 	return conn
 }
 
+// Validate checks options for nonsensical values, zero values are valid and replaced by defaults in NewConn.
+//
+// Returns InvalidConnOptions if ACKRandomFactor is below 1, MaxRetransmit exceeds MaxRetransmitLimit,
+// or ReceiveBufferSize or MaxMessageLength is shorter than HeaderLength.
+func (o ConnOptions) Validate() error {
+	switch {
+	case o.ACKRandomFactor != 0 && o.ACKRandomFactor < 1:
+		return InvalidConnOptions{
+			Field:  "ACKRandomFactor",
+			Reason: "must be at least 1",
+		}
+	case o.MaxRetransmit != nil && *o.MaxRetransmit > MaxRetransmitLimit:
+		return InvalidConnOptions{
+			Field:  "MaxRetransmit",
+			Reason: fmt.Sprintf("must be at most %d", MaxRetransmitLimit),
+		}
+	case o.ReceiveBufferSize != 0 && o.ReceiveBufferSize < HeaderLength:
+		return InvalidConnOptions{
+			Field:  "ReceiveBufferSize",
+			Reason: fmt.Sprintf("must be at least %d", HeaderLength),
+		}
+	case o.MaxMessageLength != 0 && o.MaxMessageLength < HeaderLength:
+		return InvalidConnOptions{
+			Field:  "MaxMessageLength",
+			Reason: fmt.Sprintf("must be at least %d", HeaderLength),
+		}
+	}
+
+	return nil
+}
+
 // Close closes the connection and stops the retransmission queue.
+//
+// Pending exchanges are abandoned before Close returns, the ErrorHandler is called with net.ErrClosed
+// for each and their number is reported by Stats.
+//
+// Close called while the ErrorHandler runs, such as from the ErrorHandler itself, returns without waiting
+// for pending exchanges to be abandoned, Stopped is closed once they are.
 func (c *Conn) Close() error {
 	if !c.closed.Swap(true) {
 		close(c.done)
+
+		if c.handling.Load() == 0 {
+			<-c.stopped
+		}
 	}
 
 	return c.delegate.Close()
 }
 
+// Stopped returns a channel closed once the retransmission queue is stopped by Close
+// and pending exchanges are abandoned.
+func (c *Conn) Stopped() <-chan struct{} {
+	return c.stopped
+}
+
 func (c *Conn) LocalAddr() net.Addr {
 	return c.delegate.LocalAddr()
 }
 
+// NextMessageID returns the next message ID from MessageIDSource.
+//
+// The ID may be held by a message awaiting acknowledgement, see AllocateMessageID.
+func (c *Conn) NextMessageID() MessageID {
+	return c.opts.MessageIDSource()
+}
+
+// AllocateMessageID returns the next message ID from MessageIDSource skipping IDs of Confirmable messages
+// awaiting acknowledgement, so that an acknowledgement cannot complete the wrong exchange.
+//
+// Write allocates IDs of messages written without one the same way and reserves them until the exchange
+// completes. IDs returned by AllocateMessageID are not reserved until the message is written.
+//
+// Returns MessageIDsExhausted if all MessageIDCount IDs are in flight.
+func (c *Conn) AllocateMessageID() (MessageID, error) {
+	return c.inflight.allocate(c.opts.MessageIDSource, false)
+}
+
 // Read reads a message from the connection and returns the address it was received from.
+//
+// Datagrams are read by a single dispatcher of the Conn, started by the first Read or call awaiting
+// responses. Datagrams from peers over budget are skipped before decoding, see BudgetOptions. Datagrams
+// that cannot be decoded are passed to DecodeErrorHandler and skipped if it is set. Responses and resets
+// awaited by Do, Gather, Hedge or Upload are passed to them, other messages are queued for Read,
+// so Read may be called concurrently with them and with other Reads.
+//
+// Read does not change deadlines of the underlying connection.
+//
+// Returns a decode error if the datagram cannot be decoded and DecodeErrorHandler is not set,
+// see IsDecodeError. Other errors come from the underlying connection, such as net.ErrClosed
+// or os.ErrDeadlineExceeded, and are not recoverable by reading again unless the deadline is reset.
 func (c *Conn) Read(msg *Message) (addr net.Addr, err error) {
+	return c.read(context.Background(), msg)
+}
+
+// read takes the next message queued by the dispatcher, starting it if it does not run.
+//
+// Returns the context error if the context is done before a message is queued.
+func (c *Conn) read(ctx context.Context, msg *Message) (net.Addr, error) {
 	if c.closed.Load() {
 		return nil, net.ErrClosed
 	}
 
-	addr, err = c.rx.Read(msg)
+	c.dispatch()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, net.ErrClosed
+	case result := <-c.received:
+		*msg = *result.msg
+		return result.addr, result.err
+	}
+}
+
+// Write sends a message to the specified address and handles retransmission for Confirmable messages.
+//
+// Confirmable and NonConfirmable messages with zero ID are assigned one from MessageIDSource,
+// requests with empty token are assigned one from TokenPolicy.Derive or TokenSource if set. Explicit values
+// are preserved, Acknowledgement and Reset messages are never modified as they echo the ID of the message
+// they answer. Request tokens shorter than TokenPolicy.MinLength are extended if TokenPolicy.Extend is set.
+//
+// Confirmable messages are registered for retransmission before the first transmission,
+// so transient write errors are covered by retransmission and not returned. Other errors of the first
+// transmission are returned and passed to the ErrorHandler as WriteFailed.
+//
+// Returns TokenTooShort if a request token is shorter than TokenPolicy.MinLength and not extended.
+//
+// Returns QueueFull if MaxPendingExchanges is reached and BlockWhenFull is not set.
+func (c *Conn) Write(msg *Message, addr net.Addr) error {
+	return c.write(context.Background(), msg, addr, false)
+}
+
+// WriteContext sends a message to the specified address like Write.
+//
+// Confirmable messages are not retransmitted after the deadline of the context, the ErrorHandler
+// is called with DeadlineExceeded instead. Writes waiting for a pending exchange to complete
+// because of BlockWhenFull are cancelled with the context.
+//
+// Returns the context error if the context is done before the message is sent.
+func (c *Conn) WriteContext(ctx context.Context, msg *Message, addr net.Addr) error {
+	err := ctx.Err()
 	if err != nil {
-		return addr, err
+		return err
 	}
 
-	if msg.Type != Acknowledgement && msg.Type != Reset {
-		return addr, nil
+	return c.write(ctx, msg, addr, false)
+}
+
+// Stats returns statistics of the connection.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		PendingExchanges:    uint(c.pending.Load()),
+		AbandonedExchanges:  uint(c.abandoned.Load()),
+		UnrecognizedOptions: uint(c.unrecognized.Load()),
+	}
+}
+
+// countUnrecognized returns an OptionHook counting unrecognized options before calling next.
+func (c *Conn) countUnrecognized(next func(opt *Option, raw []byte) (bool, error)) func(opt *Option, raw []byte) (bool, error) {
+	return func(opt *Option, raw []byte) (bool, error) {
+		if !opt.Recognized() {
+			c.unrecognized.Add(1)
+		}
+
+		if next == nil {
+			return true, nil
+		}
+
+		return next(opt, raw)
+	}
+}
+
+// write sends the message, reserved is set if its MessageID is already reserved for it by register.
+//
+// MessageIDs reserved for the message are released if it does not enter the retransmit queue,
+// IDs supplied by the caller are left alone.
+func (c *Conn) write(ctx context.Context, msg *Message, addr net.Addr, reserved bool) error {
+	release := func() {
+		if reserved {
+			c.inflight.remove(msg.ID)
+		}
+	}
+
+	if c.closed.Load() {
+		release()
+		return net.ErrClosed
+	}
+
+	if msg.Type == Confirmable || msg.Type == NonConfirmable {
+		assigned, err := c.assign(msg, addr)
+		if err != nil {
+			release()
+			return err
+		}
+
+		reserved = reserved || assigned
+	}
+
+	if msg.Type != Confirmable {
+		return c.tx.Write(msg, addr)
+	}
+
+	err := c.acquire(ctx, addr)
+	if err != nil {
+		release()
+		return err
+	}
+
+	deadline, _ := ctx.Deadline()
+	err = c.retransmit(msg, addr, deadline)
+	if err != nil {
+		release()
+		c.release(1)
+		return err
+	}
+
+	err = c.tx.Write(msg, addr)
+	switch {
+	case err == nil:
+		return nil
+	case c.opts.IsTransient(err):
+		return nil
 	}
 
 	select {
 	case <-c.done:
-		return addr, net.ErrClosed
+		return net.ErrClosed
 	case c.remove <- msg.ID:
 	}
 
-	return addr, nil
+	// the destination fails permanently, reported like a message failing to be retransmitted
+	c.opts.ErrorHandler(msg, WriteFailed{
+		Addr: addr,
+		Err:  err,
+	})
+
+	return err
 }
 
-// Write sends a message to the specified address and handles retransmission for Confirmable messages.
-func (c *Conn) Write(msg *Message, addr net.Addr) error {
+// Reset sends an empty Reset message with the given message ID to reject a received message,
+// such as an unwanted notification to cancel an observation.
+//
+// The Reset is sent once and does not enter the retransmit queue.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-4.2
+func (c *Conn) Reset(id MessageID, addr net.Addr) error {
 	if c.closed.Load() {
 		return net.ErrClosed
 	}
 
-	err := c.tx.Write(msg, addr)
+	return c.tx.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Reset,
+			ID:      id,
+		},
+	}, addr)
+}
+
+// ReadLoop reads messages from the connection and calls fn for each until the context is done
+// or the connection is closed.
+//
+// fn owns the message and is called from the loop, so it should hand long running work over to
+// a goroutine of its own. Datagrams that cannot be decoded do not stop the loop, they are passed
+// to DecodeErrorHandler if set, otherwise the error is passed to the ConnErrorHandler.
+//
+// Returns the context error if the context is done, otherwise the error of reading from the connection,
+// such as net.ErrClosed.
+func (c *Conn) ReadLoop(ctx context.Context, fn func(msg *Message, addr net.Addr)) error {
+	for {
+		msg := &Message{}
+		addr, err := c.read(ctx, msg)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return ctx.Err()
+		case IsDecodeError(err):
+			c.opts.ConnErrorHandler(err)
+			continue
+		case err != nil:
+			return err
+		}
+
+		fn(msg, addr)
+	}
+}
+
+// ReadMessage implements MessageConn.
+func (c *Conn) ReadMessage(msg *Message) (net.Addr, error) {
+	return c.Read(msg)
+}
+
+// WriteMessage implements MessageConn.
+func (c *Conn) WriteMessage(msg *Message, addr net.Addr) error {
+	return c.Write(msg, addr)
+}
+
+// cancel removes the message from the retransmit queue without waiting for its acknowledgement.
+func (c *Conn) cancel(id MessageID) {
+	select {
+	case <-c.done:
+	case c.remove <- id:
+	}
+}
+
+// assign sets missing message ID and request token, IDs of Confirmable messages are reserved
+// until the exchange completes. Request tokens are checked against TokenPolicy.
+//
+// Returns true if the message is assigned a reserved ID.
+//
+// Returns TokenTooShort if the request token is shorter than TokenPolicy.MinLength.
+//
+// Returns MessageIDsExhausted if all IDs are in flight.
+func (c *Conn) assign(msg *Message, addr net.Addr) (bool, error) {
+	if msg.Code.IsRequest() {
+		policy := c.opts.TokenPolicy
+		if len(msg.Token) == 0 && (policy.Derive != nil || c.opts.TokenSource != nil) {
+			msg.Token = policy.source(c.opts.TokenSource, addr)
+		}
+
+		token, err := policy.check(msg.Token)
+		if err != nil {
+			return false, err
+		}
+
+		msg.Token = token
+	}
+
+	if msg.ID != 0 {
+		return false, nil
+	}
+
+	reserve := msg.Type == Confirmable
+	id, err := c.inflight.allocate(c.opts.MessageIDSource, reserve)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	if msg.Type != Confirmable {
-		return nil
+	msg.ID = id
+
+	return reserve, nil
+}
+
+// admit charges the datagram against the peer budget.
+//
+// Confirmable requests over budget are answered with Service Unavailable, other datagrams are dropped.
+func (c *Conn) admit(data []byte, addr net.Addr) bool {
+	// malformed datagrams are charged as non-requests and left to the decoder
+	h := Header{}
+	_, _ = h.Decode(data)
+
+	peer := PeerID(addr.String())
+	request := h.Code.IsRequest()
+
+	err := c.peers.Admit(peer, len(data), request)
+	if err == nil {
+		return true
+	}
+
+	if c.opts.OverloadHandler != nil {
+		c.opts.OverloadHandler(peer, err)
+	}
+
+	if request && h.Type == Confirmable {
+		// https://datatracker.ietf.org/doc/html/rfc7252#section-5.9.3.4
+		resp := &Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Acknowledgement,
+				Code:    Code(ServiceUnavailable),
+				ID:      h.ID,
+				Token:   h.Token,
+			},
+		}
+		_ = resp.Options.SetUint(MaxAge, c.peers.opts.OverloadMaxAge)
+		_ = c.tx.Write(resp, addr)
+	}
+
+	return false
+}
+
+// acquire reserves a pending exchange, waiting for one to complete if BlockWhenFull is set.
+func (c *Conn) acquire(ctx context.Context, addr net.Addr) error {
+	if c.slots != nil {
+		full := QueueFull{
+			Addr:  addr,
+			Limit: c.opts.MaxPendingExchanges,
+		}
+
+		if c.opts.BlockWhenFull {
+			select {
+			case c.slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-c.done:
+				return net.ErrClosed
+			}
+		} else {
+			select {
+			case c.slots <- struct{}{}:
+			default:
+				return full
+			}
+		}
+	}
+
+	c.pending.Add(1)
+
+	return nil
+}
+
+// release frees n pending exchanges.
+func (c *Conn) release(n int) {
+	c.pending.Add(-int64(n))
+
+	if c.slots == nil {
+		return
 	}
 
-	now := time.Now()
-	jitter := rand.N(time.Duration(float64(c.opts.ACKTimeout) * c.opts.ACKRandomFactor))
-	timeout := c.opts.ACKTimeout + jitter
+	for range n {
+		<-c.slots
+	}
+}
+
+// retransmit registers the message in the retransmit queue.
+func (c *Conn) retransmit(msg *Message, addr net.Addr, deadline time.Time) error {
+	now := c.opts.Clock.Now()
+	// initial timeout is random between ACK_TIMEOUT and ACK_TIMEOUT * ACK_RANDOM_FACTOR,
+	// with ACK_TIMEOUT of the destination given by TimeoutStrategy
+	// https://datatracker.ietf.org/doc/html/rfc7252#section-4.2
+	timeout := c.opts.TimeoutStrategy.Initial(addr)
+	spread := time.Duration(float64(timeout) * (c.opts.ACKRandomFactor - 1))
+	if spread > 0 {
+		timeout += rand.N(spread)
+	}
 	op := WriteOp{
-		Message: msg,
-		Addr:    addr,
-		Start:   now,
-		Timeout: timeout,
-		Next:    now.Add(timeout),
+		Message:  msg,
+		Addr:     addr,
+		Start:    now,
+		Timeout:  timeout,
+		Next:     now.Add(timeout),
+		Deadline: deadline,
 	}
 
 	select {
@@ -187,96 +931,389 @@ func (c *Conn) Write(msg *Message, addr net.Addr) error {
 	}
 }
 
+// complete is called with exchanges completed by an acknowledgement or reset received at the time.
+//
+// Round-trip times are passed to TimeoutStrategy only for messages sent once, as the acknowledgement
+// of a retransmitted message cannot be attributed to a transmission (Karn's algorithm).
+func (c *Conn) complete(op WriteOp, at time.Time) {
+	if op.Retransmit != 0 {
+		return
+	}
+
+	c.opts.TimeoutStrategy.Observe(op.Addr, at.Sub(op.Start))
+}
+
+// restore loads messages saved to Store by a previous process and reserves pending exchanges for them.
+//
+// Messages past MaxTransmitWait or exceeding MaxPendingExchanges are deleted and passed to the ErrorHandler,
+// messages already due are retransmitted right away. Errors loading or decoding messages are passed
+// to the ConnErrorHandler.
+func (c *Conn) restore() []WriteOp {
+	saved, err := c.opts.Store.Load()
+	if err != nil {
+		c.opts.ConnErrorHandler(err)
+		return nil
+	}
+
+	now := c.opts.Clock.Now()
+	ops := make([]WriteOp, 0, len(saved))
+	for _, s := range saved {
+		op, err := s.writeOp(c.opts.Schema, c.opts.ResolveAddr)
+		switch {
+		case err != nil:
+		case op.Start.Add(c.opts.MaxTransmitWait).Before(now):
+			err = RetransmitWaitLimit{
+				MaxTransmitWait: c.opts.MaxTransmitWait,
+			}
+		case !c.reserve():
+			err = QueueFull{
+				Addr:  op.Addr,
+				Limit: c.opts.MaxPendingExchanges,
+			}
+		default:
+			if op.Next.Before(now) {
+				op.Next = now
+			}
+
+			ops = append(ops, op)
+			continue
+		}
+
+		c.report(op.Message, err)
+
+		err = c.opts.Store.Delete(s.ID)
+		if err != nil {
+			c.report(op.Message, err)
+		}
+	}
+
+	return ops
+}
+
+// reserve reserves a pending exchange without waiting.
+func (c *Conn) reserve() bool {
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+
+	c.pending.Add(1)
+
+	return true
+}
+
 func (c *Conn) run() {
-	queue := NewRetransmitQueue(c.opts.RetransmitOptions)
+	defer close(c.stopped)
+
+	opts := c.opts.RetransmitOptions
+	opts.ErrorHandler = c.handleError
+
+	queue := NewRetransmitQueue(opts)
+	queue.inflight = c.inflight
+	queue.data = c.restored
+	c.restored = nil
+
+	for _, op := range queue.data {
+		c.inflight.add(op.Message.ID)
+	}
 
-	t := time.NewTimer(c.opts.ACKTimeout)
+	t := c.opts.Clock.NewTimer(queue.Next(c.opts.Clock.Now()))
 	defer t.Stop()
 	for {
 		select {
 		case <-c.done:
+			abandoned := len(queue.data)
 			queue.Close()
+			c.abandoned.Add(uint64(abandoned))
+			c.release(abandoned)
 			return
 		case op := <-c.add:
 			queue.Add(op)
 		case id := <-c.remove:
-			queue.Remove(id)
-		case <-t.C:
-			writes := queue.Process(time.Now())
+			_, ok := queue.Remove(id)
+			if ok {
+				c.release(1)
+			}
+		case done := <-c.completed:
+			op, ok := queue.Remove(done.id)
+			if ok {
+				c.release(1)
+				c.complete(op, done.at)
+			}
+		case <-t.C():
+			pending := len(queue.data)
+			now := c.opts.Clock.Now()
+			writes := queue.Process(now)
+			c.release(pending - len(queue.data))
+
+			// writes are not retried in place, which would hold up the queue, transient errors
+			// defer the retransmission by WriteRetryBackoff instead
 			for _, op := range writes {
-				err := c.tx.Write(op.Message, op.Addr)
-				if err != nil {
-					queue.opts.ErrorHandler(op.Message, err)
+				err := c.tx.write(op.Message, op.Addr, 0)
+				if err == nil {
+					continue
+				}
+
+				if c.opts.IsTransient(err) && queue.Defer(op.Message.ID, now.Add(c.opts.WriteRetryBackoff), c.opts.MaxWriteRetries) {
 					continue
 				}
+
+				queue.opts.ErrorHandler(op.Message, err)
 			}
 		}
 
-		t.Reset(queue.Next(time.Now()))
+		if len(queue.data) == 0 {
+			// idle until the next message is added
+			t.Stop()
+			continue
+		}
+
+		t.Reset(queue.Next(c.opts.Clock.Now()))
+	}
+}
+
+// handleError passes the error to the call awaiting the message, if any, and calls the ErrorHandler marking
+// it as running, so that Close called from the handler does not wait for the retransmit loop calling it.
+func (c *Conn) handleError(msg *Message, err error) {
+	c.fail(msg, err)
+
+	c.handling.Add(1)
+	defer c.handling.Add(-1)
+
+	c.opts.ErrorHandler(msg, err)
+}
+
+// report passes an error to the ErrorHandler, or to the ConnErrorHandler if there is no message,
+// such as for a restored message that cannot be decoded.
+func (c *Conn) report(msg *Message, err error) {
+	if msg == nil {
+		c.opts.ConnErrorHandler(err)
+		return
 	}
+
+	c.handleError(msg, err)
 }
 
 // NewReader instantiates a new Reader that can read messages from the specified PacketConn.
+//
+// The receive buffer is sized to MaxMessageLength, defaulting to MaxMessageLength, see WithBufferSize.
 func NewReader(conn net.PacketConn, opts MarshalOptions) *Reader {
+	size := opts.MaxMessageLength
+	if size == 0 {
+		size = MaxMessageLength
+	}
+
 	return &Reader{
 		conn: conn,
 		opts: opts,
-		buf:  make([]byte, opts.MaxMessageLength),
+		buf:  make([]byte, size),
 	}
 }
 
+// WithBufferSize sets the size of the receive buffer.
+//
+// Datagrams longer than the buffer are truncated by the socket, so it should be larger than
+// MaxMessageLength for oversized datagrams to be rejected rather than decoded truncated.
+func (r *Reader) WithBufferSize(size uint) *Reader {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.buf = make([]byte, size)
+
+	return r
+}
+
+// WithDecodeErrorHandler sets the handler of datagrams that cannot be decoded, which are then skipped
+// by Read instead of returning the decode error, nil restores returning decode errors.
+//
+// The handler is called with the reader locked, raw aliases the receive buffer only for the duration of the call.
+func (r *Reader) WithDecodeErrorHandler(handler func(raw []byte, addr net.Addr, err error)) *Reader {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.onDecodeError = handler
+
+	return r
+}
+
 // Read reads a message from the PacketConn and decodes it into the provided Message.
+//
+// Returns a decode error, see IsDecodeError, if the datagram cannot be decoded and no handler
+// is set by WithDecodeErrorHandler.
 func (r *Reader) Read(msg *Message) (addr net.Addr, err error) {
+	return r.read(msg, nil)
+}
+
+// ReadAll reads a datagram carrying concatenated messages from the PacketConn and decodes all of them,
+// appending them to msgs.
+//
+// Messages are framed with their length as over reliable transports, see Message.EncodeStream, since the payload
+// of a message over UDP extends to the end of the datagram. Datagrams holding a single message are read with Read.
+//
+// Returns the number of messages decoded. On error, messages decoded before the error are kept.
+//
+// Returns errors of Message.DecodeStream, offsets of UnmarshalError are relative to the datagram.
+func (r *Reader) ReadAll(msgs *[]Message) (int, net.Addr, error) {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 
-	r.buf = r.buf[:0]
-	_, addr, err = r.conn.ReadFrom(r.buf)
+	n, addr, err := r.conn.ReadFrom(r.buf[:cap(r.buf)])
 	if err != nil {
-		return addr, err
+		return 0, addr, err
+	}
+
+	count, err := decodeAll(r.buf[:n], msgs, r.opts)
+	return count, addr, err
+}
+
+// decodeAll decodes messages framed for reliable transports until data is exhausted.
+func decodeAll(data []byte, msgs *[]Message, opts MarshalOptions) (int, error) {
+	count := 0
+	offset := 0
+	for offset < len(data) {
+		msg := Message{}
+		rest, err := msg.DecodeStream(data[offset:], opts)
+		if err != nil {
+			return count, shiftUnmarshalError(err, offset)
+		}
+
+		*msgs = append(*msgs, msg)
+		count++
+		offset = len(data) - len(rest)
 	}
 
-	_, err = msg.Decode(r.buf, r.opts)
-	return addr, err
+	return count, nil
+}
+
+// read reads datagrams until admit accepts one, then decodes it into the provided Message.
+//
+// Datagrams that cannot be decoded are skipped if onDecodeError is set.
+func (r *Reader) read(msg *Message, admit func(data []byte, addr net.Addr) bool) (net.Addr, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for {
+		n, addr, err := r.conn.ReadFrom(r.buf[:cap(r.buf)])
+		if err != nil {
+			return addr, err
+		}
+
+		if admit != nil && !admit(r.buf[:n], addr) {
+			continue
+		}
+
+		_, err = msg.Decode(r.buf[:n], r.opts)
+		if err != nil && r.onDecodeError != nil {
+			r.onDecodeError(r.buf[:n], addr, err)
+			*msg = Message{} // drop fields decoded before the error
+			continue
+		}
+
+		return addr, err
+	}
 }
 
 // NewWriter instantiates a new Writer that can send messages over the specified PacketConn.
 func NewWriter(conn net.PacketConn, opts MarshalOptions) *Writer {
+	size := max(opts.MaxMessageLength, HeaderLength)
+
 	return &Writer{
-		conn: conn,
-		opts: opts,
-		buf:  make([]byte, opts.MaxMessageLength),
+		conn:  conn,
+		opts:  opts,
+		clock: RealClock,
+		buffers: sync.Pool{
+			New: func() any {
+				buf := make([]byte, 0, size)
+				return &buf
+			},
+		},
 	}
 }
 
+// WithRetry sets options for retrying transient write errors.
+//
+// Zero options are set to their defaults, IsTransient defaults to IsTransientError.
+func (w *Writer) WithRetry(opts WriteRetryOptions) *Writer {
+	if opts.IsTransient == nil {
+		opts.IsTransient = IsTransientError
+	}
+
+	if opts.MaxWriteRetries == 0 {
+		opts.MaxWriteRetries = WriteRetries
+	}
+
+	if opts.WriteRetryBackoff == 0 {
+		opts.WriteRetryBackoff = WriteRetryBackoff
+	}
+
+	w.retry = opts
+
+	return w
+}
+
+// WithClock sets the clock measuring WriteRetryBackoff, defaults to RealClock.
+func (w *Writer) WithClock(clock Clock) *Writer {
+	w.clock = clock
+
+	return w
+}
+
 // Write sends a message to the specified address.
+//
+// Transient write errors are retried up to MaxWriteRetries times after WriteRetryBackoff.
 func (w *Writer) Write(msg *Message, addr net.Addr) error {
-	w.mtx.Lock()
-	defer w.mtx.Unlock()
+	return w.write(msg, addr, w.retry.MaxWriteRetries)
+}
 
-	w.buf = w.buf[:0]
-	w.buf = msg.Encode(w.buf)
+// write sends a message retrying transient errors up to retries times, the caller waits for the backoff.
+func (w *Writer) write(msg *Message, addr net.Addr, retries uint) error {
+	buf := w.buffers.Get().(*[]byte)
+	defer w.buffers.Put(buf)
 
-	_, err := w.conn.WriteTo(w.buf, addr)
-	return err
+	var err error
+	*buf, err = msg.Encode((*buf)[:0], w.opts)
+	if err != nil {
+		return err
+	}
+
+	for retry := uint(0); ; retry++ {
+		_, err = w.conn.WriteTo(*buf, addr)
+		if err == nil || retry == retries || !w.retry.IsTransient(err) {
+			return err
+		}
+
+		<-w.clock.After(w.retry.WriteRetryBackoff)
+	}
 }
 
 // NewRetransmitQueue instantiate a new retransmit queue with the given writer and options.
 //
-// If ErrorHandler is not set, it defaults to NoopRetransmitErrorHandler.
+// If ErrorHandler is not set, it defaults to NoopRetransmitErrorHandler, if MaxRetransmit is not set,
+// it defaults to MaxRetransmit.
 func NewRetransmitQueue(opts RetransmitOptions) *RetransmitQueue {
 	if opts.ErrorHandler == nil {
 		opts.ErrorHandler = NoopRetransmitErrorHandler
 	}
 
+	if opts.Store == nil {
+		opts.Store = NoopRetransmitStore
+	}
+
+	opts.MaxRetransmit = opts.maxRetransmit()
+
 	return &RetransmitQueue{
 		opts: opts,
 	}
 }
 
-// Add adds op to the retransmit queue.
+// Add adds op to the retransmit queue and saves it to Store.
 func (q *RetransmitQueue) Add(op WriteOp) {
 	q.data = append(q.data, op)
+	q.inflight.add(op.Message.ID)
+	q.save(op)
 }
 
 // Remove removes op from the retransmit queue by its message ID.
@@ -290,17 +1327,41 @@ func (q *RetransmitQueue) Remove(id MessageID) (WriteOp, bool) {
 
 	op := q.data[i]
 	q.data = slices.Delete(q.data, i, i+1)
+	q.delete(op)
 
 	return op, true
 }
 
+// Defer reschedules a message returned by Process whose write failed with a transient error, so that
+// Process returns it again at the given time without counting another retransmission.
+//
+// Returns false if the message is no longer queued or its write was already retried maxRetries times.
+func (q *RetransmitQueue) Defer(id MessageID, at time.Time, maxRetries uint) bool {
+	i := slices.IndexFunc(q.data, func(op WriteOp) bool {
+		return op.Message.ID == id
+	})
+	if i == -1 || q.data[i].writeRetries == maxRetries {
+		return false
+	}
+
+	op := &q.data[i]
+	op.deferred = true
+	op.writeRetries++
+	op.Next = at
+
+	return true
+}
+
 // Close clears the retransmit queue and calls the error handler for each message with net.ErrClosed.
+//
+// Messages are kept in Store, so that they are restored after a restart.
 func (q *RetransmitQueue) Close() {
 	for _, op := range q.data {
 		q.opts.ErrorHandler(op.Message, net.ErrClosed)
 	}
 
 	q.data = q.data[:0]
+	q.inflight.clear()
 }
 
 // Process returns messages that need to be retransmitted and removes expired messages.
@@ -315,15 +1376,29 @@ func (q *RetransmitQueue) Process(now time.Time) []WriteOp {
 	i := 0
 	for _, op := range q.data {
 		switch {
+		// application deadline passed, retransmission is pointless
+		case !op.Deadline.IsZero() && !now.Before(op.Deadline):
+			q.opts.ErrorHandler(op.Message, DeadlineExceeded{
+				Deadline: op.Deadline,
+			})
+			q.delete(op)
+			continue
 		// noop
 		case op.Next.After(now):
 			q.data[i] = op
+		// write of the previous transmission is retried
+		case op.deferred:
+			op.deferred = false
+			op.Next = now.Add(op.Timeout)
+			q.data[i] = op
+			q.out = append(q.out, op)
 		// MAX_RETRANSMIT is the maximum number of retransmissions of a Confirmable message
-		case op.Retransmit == q.opts.MaxRetransmit:
+		case op.Retransmit == *q.opts.MaxRetransmit:
 			q.opts.ErrorHandler(op.Message, RetransmitRetryLimit{
 				Retransmit:    op.Retransmit,
-				MaxRetransmit: q.opts.MaxRetransmit,
+				MaxRetransmit: *q.opts.MaxRetransmit,
 			})
+			q.delete(op)
 			continue
 		// MAX_TRANSMIT_WAIT is the maximum time from the first transmission
 		// of a Confirmable message to the time when the sender gives up on
@@ -332,6 +1407,7 @@ func (q *RetransmitQueue) Process(now time.Time) []WriteOp {
 			q.opts.ErrorHandler(op.Message, RetransmitWaitLimit{
 				MaxTransmitWait: q.opts.MaxTransmitWait,
 			})
+			q.delete(op)
 			continue
 		// MAX_TRANSMIT_SPAN is the maximum time from the first transmission
 		// of a Confirmable message to its last retransmission.
@@ -339,11 +1415,13 @@ func (q *RetransmitQueue) Process(now time.Time) []WriteOp {
 			q.data[i] = op
 		// op needs retransmit
 		default:
-			op.Timeout *= 2
+			op.Timeout = doubleTimeout(op.Timeout, q.opts.MaxTransmitWait)
 			op.Retransmit++
+			op.writeRetries = 0
 			op.Next = now.Add(op.Timeout)
 			q.data[i] = op
 			q.out = append(q.out, op)
+			q.save(op)
 		}
 
 		i++
@@ -355,7 +1433,50 @@ func (q *RetransmitQueue) Process(now time.Time) []WriteOp {
 	return q.out
 }
 
-// Next returns the next retransmit time.
+// save saves op to Store, errors are passed to the ErrorHandler.
+func (q *RetransmitQueue) save(op WriteOp) {
+	if q.opts.Store == NoopRetransmitStore {
+		return
+	}
+
+	serialized, err := op.serialize()
+	if err == nil {
+		err = q.opts.Store.Save(serialized)
+	}
+
+	if err != nil {
+		q.opts.ErrorHandler(op.Message, err)
+	}
+}
+
+// delete deletes op from Store, errors are passed to the ErrorHandler.
+func (q *RetransmitQueue) delete(op WriteOp) {
+	q.inflight.remove(op.Message.ID)
+
+	err := q.opts.Store.Delete(op.Message.ID)
+	if err != nil {
+		q.opts.ErrorHandler(op.Message, err)
+	}
+}
+
+// doubleTimeout returns the doubled retransmit timeout clamped to limit, zero limit only guards against overflow.
+func doubleTimeout(timeout time.Duration, limit time.Duration) time.Duration {
+	if timeout > math.MaxInt64/2 {
+		timeout = math.MaxInt64
+	} else {
+		timeout *= 2
+	}
+
+	if limit > 0 && timeout > limit {
+		return limit
+	}
+
+	return timeout
+}
+
+// Next returns the duration until the next retransmit time, ACKTimeout if the queue is empty.
+//
+// The duration is at least MinRetransmitInterval, also when messages are already due.
 func (q *RetransmitQueue) Next(now time.Time) time.Duration {
 	next := now.Add(q.opts.ACKTimeout)
 
@@ -363,7 +1484,11 @@ func (q *RetransmitQueue) Next(now time.Time) time.Duration {
 		if op.Next.Before(next) {
 			next = op.Next
 		}
+
+		if !op.Deadline.IsZero() && op.Deadline.Before(next) {
+			next = op.Deadline
+		}
 	}
 
-	return next.Sub(now)
+	return max(next.Sub(now), MinRetransmitInterval)
 }
@@ -0,0 +1,1813 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/uramaki-io/coap/internal/clock"
+	"github.com/uramaki-io/coap/internal/pipe"
+)
+
+// Tests of this package use the test doubles of coaptest through the internal packages they alias,
+// as coaptest imports coap.
+type (
+	fakeClock = clock.Fake
+	pipeConn  = pipe.Conn
+	pipeAddr  = pipe.Addr
+)
+
+func newFakeClock(now time.Time) *fakeClock {
+	return clock.NewFake(now)
+}
+
+func newPipe() (*pipeConn, *pipeConn) {
+	return pipe.New()
+}
+
+func testConnOptions() ConnOptions {
+	maxRetransmit := uint(MaxRetransmit)
+
+	return ConnOptions{
+		RetransmitOptions: RetransmitOptions{
+			ACKTimeout:      10 * time.Millisecond,
+			ACKRandomFactor: 1.5,
+			MaxRetransmit:   &maxRetransmit,
+			MaxTransmitWait: time.Second,
+			MaxTransmitSpan: time.Second,
+		},
+		MarshalOptions: MarshalOptions{
+			MaxMessageLength: MaxMessageLength,
+		},
+	}
+}
+
+func TestConnRetransmit(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	errs := make(chan error, 1)
+	opts := ConnOptions{
+		RetransmitOptions: RetransmitOptions{
+			ErrorHandler: func(_ *Message, err error) {
+				errs <- err
+			},
+		},
+		Clock: clock,
+	}
+
+	// black hole, every transmission is dropped
+	a, b := newPipe()
+	a.DropEvery(1)
+	delegate := &failingConn{PacketConn: a}
+	client := NewConn(delegate, opts)
+	defer client.Close()
+
+	err := client.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			ID:      0x4242,
+			Token:   bytes4,
+		},
+	}, b.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	// MAX_TRANSMIT_WAIT with default transmission parameters
+	// https://datatracker.ietf.org/doc/html/rfc7252#section-4.8.2
+	clock.Advance(93 * time.Second)
+
+	if n := delegate.Writes(); n != 1+MaxRetransmit {
+		t.Errorf("transmissions = %d, want %d", n, 1+MaxRetransmit)
+	}
+
+	select {
+	case err = <-errs:
+	default:
+		t.Fatal("expected retransmission to give up")
+	}
+
+	expectErr(t, err, RetransmitRetryLimit{Retransmit: MaxRetransmit, MaxRetransmit: MaxRetransmit})
+
+	if n := client.Stats().PendingExchanges; n != 0 {
+		t.Errorf("PendingExchanges = %d, want 0", n)
+	}
+}
+
+func TestConnNoRetransmit(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	errs := make(chan error, 1)
+	maxRetransmit := uint(0)
+	opts := ConnOptions{
+		RetransmitOptions: RetransmitOptions{
+			MaxRetransmit: &maxRetransmit,
+			ErrorHandler: func(_ *Message, err error) {
+				errs <- err
+			},
+		},
+		Clock: clock,
+	}
+
+	a, b := newPipe()
+	a.DropEvery(1)
+	delegate := &failingConn{PacketConn: a}
+	client := NewConn(delegate, opts)
+	defer client.Close()
+
+	err := client.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			ID:      0x4242,
+			Token:   bytes4,
+		},
+	}, b.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	clock.Advance(10 * time.Second)
+
+	if n := delegate.Writes(); n != 1 {
+		t.Errorf("transmissions = %d, want 1", n)
+	}
+
+	select {
+	case err = <-errs:
+	default:
+		t.Fatal("expected retransmission to give up")
+	}
+
+	expectErr(t, err, RetransmitRetryLimit{})
+}
+
+// failingConn fails the first writes with the given error.
+type failingConn struct {
+	net.PacketConn
+
+	mtx    sync.Mutex
+	fail   int
+	err    error
+	writes int
+}
+
+func (c *failingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mtx.Lock()
+	c.writes++
+	fail := c.writes <= c.fail
+	c.mtx.Unlock()
+
+	if fail {
+		return 0, c.err
+	}
+
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *failingConn) Writes() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.writes
+}
+
+func TestConnWriteTransientError(t *testing.T) {
+	transient := errors.New("transient")
+	permanent := errors.New("permanent")
+
+	tests := []struct {
+		name   string
+		fail   int
+		err    error
+		write  error
+		writes int
+	}{
+		{
+			name:   "retried by writer",
+			fail:   WriteRetries,
+			err:    transient,
+			writes: WriteRetries + 1,
+		},
+		{
+			name:   "retransmitted",
+			fail:   WriteRetries + 1,
+			err:    transient,
+			writes: WriteRetries + 1,
+		},
+		{
+			name:   "permanent",
+			fail:   2,
+			err:    permanent,
+			write:  permanent,
+			writes: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newPipe()
+			delegate := &failingConn{
+				PacketConn: a,
+				fail:       test.fail,
+				err:        test.err,
+			}
+
+			// writes are retried WriteRetries times by default, well before the first retransmission
+			opts := testConnOptions()
+			opts.ACKTimeout = 100 * time.Millisecond
+			opts.WriteRetryBackoff = time.Millisecond
+			opts.IsTransient = func(err error) bool {
+				return errors.Is(err, transient)
+			}
+
+			handled := make(chan error, 1)
+			opts.ErrorHandler = func(_ *Message, err error) {
+				select {
+				case handled <- err:
+				default:
+				}
+			}
+
+			client := NewConn(delegate, opts)
+			defer client.Close()
+			server := NewConn(b, testConnOptions())
+			defer server.Close()
+
+			msg := &Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    Confirmable,
+					Code:    Code(GET),
+					ID:      0x4242,
+				},
+			}
+
+			err := client.Write(msg, server.LocalAddr())
+			expectErr(t, err, test.write)
+
+			if writes := delegate.Writes(); writes != test.writes {
+				t.Errorf("writes = %d, want %d", writes, test.writes)
+			}
+
+			if err != nil {
+				// permanently failing destinations are surfaced via the ErrorHandler
+				expectErr(t, <-handled, WriteFailed{
+					Addr: server.LocalAddr(),
+					Err:  test.write,
+				})
+
+				return
+			}
+
+			received := &Message{}
+			addr, err := server.Read(received)
+			if err != nil {
+				t.Fatal("read:", err)
+			}
+
+			ack := &Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    Acknowledgement,
+					ID:      received.ID,
+				},
+			}
+
+			err = server.Write(ack, addr)
+			if err != nil {
+				t.Fatal("write ack:", err)
+			}
+
+			_, err = client.Read(received)
+			if err != nil {
+				t.Fatal("read ack:", err)
+			}
+
+			// no retransmissions after acknowledgement
+			writes := delegate.Writes()
+			time.Sleep(50 * time.Millisecond)
+			if delegate.Writes() != writes {
+				t.Errorf("unexpected retransmission after acknowledgement")
+			}
+		})
+	}
+}
+
+func TestConnRetransmitClock(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	opts := testConnOptions()
+	opts.ACKTimeout = time.Hour
+	opts.MaxTransmitWait = 24 * time.Hour
+	opts.MaxTransmitSpan = 24 * time.Hour
+	opts.Clock = clock
+
+	a, b := newPipe()
+	client := NewConn(a, opts)
+	defer client.Close()
+	server := NewConn(b, testConnOptions())
+	defer server.Close()
+
+	a.DropEvery(1)
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			ID:      0x4242,
+		},
+	}
+
+	err := client.Write(msg, server.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+	a.DropEvery(0)
+
+	// initial timeout is at most ACKTimeout * ACKRandomFactor
+	clock.Advance(opts.ACKTimeout * 5 / 2)
+
+	err = b.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	received := &Message{}
+	_, err = server.Read(received)
+	if err != nil {
+		t.Fatal("read retransmission:", err)
+	}
+
+	if received.ID != msg.ID {
+		t.Errorf("received ID = %d, want %d", received.ID, msg.ID)
+	}
+}
+
+func TestConnRetransmitWriteRetry(t *testing.T) {
+	transient := errors.New("transient")
+	clock := newFakeClock(time.Now())
+
+	// the backoff only passes on the clock, the retransmit loop must not wait for it
+	opts := testConnOptions()
+	opts.ACKTimeout = time.Hour
+	opts.ACKRandomFactor = 1
+	opts.MaxTransmitWait = 24 * time.Hour
+	opts.MaxTransmitSpan = 24 * time.Hour
+	opts.WriteRetryBackoff = time.Minute
+	opts.IsTransient = func(err error) bool {
+		return errors.Is(err, transient)
+	}
+	opts.Clock = clock
+
+	a, b := newPipe()
+	delegate := &failingConn{
+		PacketConn: a,
+		err:        transient,
+	}
+	client := NewConn(delegate, opts)
+	defer client.Close()
+	server := NewConn(b, testConnOptions())
+	defer server.Close()
+
+	a.DropEvery(1)
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			ID:      0x4242,
+		},
+	}
+
+	err := client.Write(msg, server.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+	a.DropEvery(0)
+
+	// the retransmission fails once
+	delegate.mtx.Lock()
+	delegate.fail = 2
+	delegate.mtx.Unlock()
+
+	clock.BlockUntil(1)
+	clock.Advance(opts.ACKTimeout)
+	if writes := delegate.Writes(); writes != 2 {
+		t.Fatalf("writes = %d, want 2", writes)
+	}
+
+	clock.Advance(opts.WriteRetryBackoff)
+	if writes := delegate.Writes(); writes != 3 {
+		t.Fatalf("writes = %d, want 3", writes)
+	}
+
+	err = b.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	received := &Message{}
+	_, err = server.Read(received)
+	if err != nil {
+		t.Fatal("read retransmission:", err)
+	}
+
+	if received.ID != msg.ID {
+		t.Errorf("received ID = %d, want %d", received.ID, msg.ID)
+	}
+}
+
+func TestRetransmitQueueDefer(t *testing.T) {
+	maxRetransmit := uint(4)
+	queue := NewRetransmitQueue(RetransmitOptions{
+		ACKTimeout:      time.Second,
+		MaxRetransmit:   &maxRetransmit,
+		MaxTransmitWait: 93 * time.Second,
+		MaxTransmitSpan: 45 * time.Second,
+	})
+
+	start := time.Unix(0, 0)
+	queue.Add(WriteOp{
+		Message: &Message{
+			Header: Header{
+				ID: 0x4242,
+			},
+		},
+		Start:   start,
+		Timeout: time.Second,
+		Next:    start,
+	})
+
+	ops := queue.Process(start)
+	if len(ops) != 1 {
+		t.Fatalf("expected single retransmission, got %d", len(ops))
+	}
+
+	// deferred writes are returned again without counting retransmissions
+	now := start
+	for range 2 {
+		now = now.Add(10 * time.Millisecond)
+		if !queue.Defer(0x4242, now, 2) {
+			t.Fatal("Defer = false, want true")
+		}
+
+		ops = queue.Process(now)
+		if len(ops) != 1 || ops[0].Retransmit != 1 || ops[0].Timeout != 2*time.Second {
+			t.Fatalf("deferred ops = %+v, want single retransmission 1 with timeout 2s", ops)
+		}
+	}
+
+	if queue.Defer(0x4242, now, 2) {
+		t.Error("Defer after max retries = true, want false")
+	}
+
+	if queue.Defer(0x4343, now, 2) {
+		t.Error("Defer of unknown message = true, want false")
+	}
+}
+
+func TestRetransmitQueueTimeoutClamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		next    time.Duration
+	}{
+		{
+			name:    "doubled",
+			timeout: 2 * time.Second,
+			next:    4 * time.Second,
+		},
+		{
+			name:    "clamped",
+			timeout: time.Hour,
+			next:    93 * time.Second,
+		},
+		{
+			name:    "overflow",
+			timeout: math.MaxInt64/2 + 1,
+			next:    93 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maxRetransmit := uint(1)
+			queue := NewRetransmitQueue(RetransmitOptions{
+				ACKTimeout:      time.Second,
+				MaxRetransmit:   &maxRetransmit,
+				MaxTransmitWait: 93 * time.Second,
+				MaxTransmitSpan: 45 * time.Second,
+			})
+
+			start := time.Unix(0, 0)
+			queue.Add(WriteOp{
+				Message: &Message{},
+				Start:   start,
+				Timeout: test.timeout,
+				Next:    start,
+			})
+
+			ops := queue.Process(start)
+			if len(ops) != 1 {
+				t.Fatalf("expected single retransmission, got %d", len(ops))
+			}
+
+			if next := ops[0].Next.Sub(start); next != test.next {
+				t.Errorf("next retransmission in %s, want %s", next, test.next)
+			}
+
+			if next := queue.Next(start); next <= 0 {
+				t.Errorf("Next() = %s, want positive", next)
+			}
+		})
+	}
+}
+
+func TestRetransmitQueueNext(t *testing.T) {
+	start := time.Unix(0, 0)
+	queue := NewRetransmitQueue(RetransmitOptions{
+		ACKTimeout: ACKTimeout,
+	})
+
+	if next := queue.Next(start); next != ACKTimeout {
+		t.Errorf("empty queue Next() = %s, want %s", next, ACKTimeout)
+	}
+
+	queue.Add(WriteOp{
+		Message: &Message{},
+		Start:   start,
+		Timeout: ACKTimeout,
+		Next:    start.Add(time.Second),
+	})
+
+	if next := queue.Next(start); next != time.Second {
+		t.Errorf("Next() = %s, want %s", next, time.Second)
+	}
+
+	// due and overdue
+	for _, now := range []time.Time{start.Add(time.Second), start.Add(time.Minute)} {
+		if next := queue.Next(now); next != MinRetransmitInterval {
+			t.Errorf("Next() at %s = %s, want %s", now.Sub(start), next, MinRetransmitInterval)
+		}
+	}
+
+	empty := NewRetransmitQueue(RetransmitOptions{})
+	if next := empty.Next(start); next <= 0 {
+		t.Errorf("Next() without ACKTimeout = %s, want positive", next)
+	}
+}
+
+func TestReaderReadAll(t *testing.T) {
+	// type and message ID are not carried by framed messages
+	msg := Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Code:    Code(GET),
+			Token:   bytes4,
+		},
+		Payload: bytes8,
+	}
+
+	data, err := msg.EncodeStream(nil, MarshalOptions{})
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	second := msg
+	second.Payload = []byte("second")
+	batch, err := second.EncodeStream(slices.Clone(data), MarshalOptions{})
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	empty := Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Token:   Token{},
+		},
+	}
+	batch, err = empty.EncodeStream(batch, MarshalOptions{})
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		msgs  []Message
+		count int
+		err   error
+	}{
+		{
+			name:  "single message",
+			data:  data,
+			msgs:  []Message{msg},
+			count: 1,
+		},
+		{
+			name:  "concatenated messages",
+			data:  batch,
+			msgs:  []Message{msg, second, empty},
+			count: 3,
+		},
+		{
+			name: "empty datagram",
+			data: []byte{},
+			msgs: []Message{},
+		},
+		{
+			name:  "truncated message",
+			data:  batch[:len(data)+5],
+			msgs:  []Message{msg},
+			count: 1,
+			err: UnmarshalError{
+				Offset: uint(len(data)),
+				Cause: TruncatedError{
+					Expected: StreamHeaderLength + 4 + 7,
+				},
+			},
+		},
+		{
+			name: "truncated header",
+			data: data[:1],
+			msgs: []Message{},
+			err: UnmarshalError{
+				Cause: TruncatedError{
+					Expected: StreamHeaderLength,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newPipe()
+			defer a.Close()
+			defer b.Close()
+
+			_, err := a.WriteTo(test.data, b.LocalAddr())
+			if err != nil {
+				t.Fatal("write:", err)
+			}
+
+			rx := NewReader(b, MarshalOptions{
+				MaxMessageLength: MaxMessageLength,
+			})
+
+			msgs := []Message{}
+			count, addr, err := rx.ReadAll(&msgs)
+			expectErr(t, err, test.err)
+
+			if count != test.count {
+				t.Errorf("count = %d, want %d", count, test.count)
+			}
+
+			diff := cmp.Diff(test.msgs, msgs, EquateOptions())
+			if diff != "" {
+				t.Errorf("messages mismatch (-want +got):\n%s", diff)
+			}
+
+			if addr.String() != a.LocalAddr().String() {
+				t.Errorf("addr = %v, want %v", addr, a.LocalAddr())
+			}
+		})
+	}
+}
+
+func TestConnNextMessageID(t *testing.T) {
+	a, _ := newPipe()
+	opts := testConnOptions()
+	opts.MessageIDSource = MessageIDSequence(0x4241)
+
+	conn := NewConn(a, opts)
+	defer conn.Close()
+
+	if id := conn.NextMessageID(); id != 0x4242 {
+		t.Errorf("NextMessageID() = %#x, want %#x", id, 0x4242)
+	}
+}
+
+func TestConnWriteAssign(t *testing.T) {
+	tests := []struct {
+		name   string
+		header Header
+		want   Header
+	}{
+		{
+			name: "request assigned",
+			header: Header{
+				Type: NonConfirmable,
+				Code: Code(GET),
+			},
+			want: Header{
+				Type:  NonConfirmable,
+				Code:  Code(GET),
+				ID:    0x4242,
+				Token: bytes4,
+			},
+		},
+		{
+			name: "explicit values preserved",
+			header: Header{
+				Type:  Confirmable,
+				Code:  Code(GET),
+				ID:    0x0101,
+				Token: bytes8,
+			},
+			want: Header{
+				Type:  Confirmable,
+				Code:  Code(GET),
+				ID:    0x0101,
+				Token: bytes8,
+			},
+		},
+		{
+			name: "response without token",
+			header: Header{
+				Type: NonConfirmable,
+				Code: Code(Content),
+			},
+			want: Header{
+				Type: NonConfirmable,
+				Code: Code(Content),
+				ID:   0x4242,
+			},
+		},
+		{
+			name: "acknowledgement unmodified",
+			header: Header{
+				Type: Acknowledgement,
+			},
+			want: Header{
+				Type: Acknowledgement,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newPipe()
+			opts := testConnOptions()
+			opts.MessageIDSource = MessageIDSequence(0x4241)
+			opts.TokenSource = func() Token {
+				return bytes4
+			}
+
+			conn := NewConn(a, opts)
+			defer conn.Close()
+
+			test.header.Version = ProtocolVersion
+			test.want.Version = ProtocolVersion
+			msg := &Message{
+				Header: test.header,
+			}
+
+			err := conn.Write(msg, b.LocalAddr())
+			if err != nil {
+				t.Fatal("write:", err)
+			}
+
+			diff := cmp.Diff(test.want, msg.Header)
+			if diff != "" {
+				t.Errorf("header mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	a, b := newPipe()
+	client := NewConn(a, testConnOptions())
+	defer client.Close()
+	server := NewConn(b, testConnOptions())
+	defer server.Close()
+
+	err := client.Reset(0x4242, b.LocalAddr())
+	if err != nil {
+		t.Fatal("reset:", err)
+	}
+
+	msg := &Message{}
+	_, err = server.Read(msg)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	want := Header{
+		Version: ProtocolVersion,
+		Type:    Reset,
+		ID:      0x4242,
+		Token:   Token{},
+	}
+
+	diff := cmp.Diff(want, msg.Header)
+	if diff != "" {
+		t.Errorf("header mismatch (-want +got):\n%s", diff)
+	}
+
+	_ = client.Close()
+	expectErr(t, client.Reset(0x4242, b.LocalAddr()), net.ErrClosed)
+}
+
+func TestConnZeroOptions(t *testing.T) {
+	a, b := newPipe()
+	client := NewConn(a, ConnOptions{})
+	defer client.Close()
+	server := NewConn(b, ConnOptions{})
+	defer server.Close()
+
+	err := client.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			Token:   bytes4,
+		},
+		Payload: bytes16,
+	}, b.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	msg := &Message{}
+	_, err = server.Read(msg)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	diff := cmp.Diff(bytes16, msg.Payload)
+	if diff != "" {
+		t.Errorf("payload mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConnOptionsValidate(t *testing.T) {
+	tooManyRetransmits := uint(32)
+	tests := []struct {
+		name string
+		opts ConnOptions
+		err  error
+	}{
+		{
+			name: "zero",
+		},
+		{
+			name: "ack random factor",
+			opts: ConnOptions{
+				RetransmitOptions: RetransmitOptions{
+					ACKRandomFactor: 0.5,
+				},
+			},
+			err: InvalidConnOptions{
+				Field:  "ACKRandomFactor",
+				Reason: "must be at least 1",
+			},
+		},
+		{
+			name: "max retransmit",
+			opts: ConnOptions{
+				RetransmitOptions: RetransmitOptions{
+					MaxRetransmit: &tooManyRetransmits,
+				},
+			},
+			err: InvalidConnOptions{
+				Field:  "MaxRetransmit",
+				Reason: "must be at most 31",
+			},
+		},
+		{
+			name: "receive buffer",
+			opts: ConnOptions{
+				ReceiveBufferSize: 2,
+			},
+			err: InvalidConnOptions{
+				Field:  "ReceiveBufferSize",
+				Reason: "must be at least 4",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expectErr(t, test.opts.Validate(), test.err)
+
+			conn, err := ListenPacket(context.Background(), "udp", "127.0.0.1:0", test.opts)
+			expectErr(t, err, test.err)
+			if conn != nil {
+				_ = conn.Close()
+			}
+		})
+	}
+}
+
+func TestRateLimitedErrorHandler(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	errs := make(chan error, 8)
+	handler := rateLimitedErrorHandler(func(_ *Message, err error) {
+		errs <- err
+	}, time.Second, clock)
+
+	expect := func(want error) {
+		t.Helper()
+
+		diff := cmp.Diff(want, <-errs, cmpopts.EquateErrors())
+		if diff != "" {
+			t.Errorf("error mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	for range 4 {
+		handler(&Message{}, net.ErrClosed)
+	}
+	handler(&Message{}, os.ErrDeadlineExceeded)
+	expect(net.ErrClosed)
+
+	// the summary of the burst is flushed at the end of the window, starting the next one
+	clock.Advance(time.Second)
+	expect(SuppressedErrors{
+		Err:        os.ErrDeadlineExceeded,
+		Suppressed: 4,
+		Window:     time.Second,
+	})
+
+	handler(&Message{}, net.ErrClosed)
+	clock.Advance(time.Second)
+	expect(SuppressedErrors{
+		Err:        net.ErrClosed,
+		Suppressed: 1,
+		Window:     time.Second,
+	})
+
+	clock.Advance(time.Second)
+	handler(&Message{}, net.ErrClosed)
+	expect(net.ErrClosed)
+
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error %v", err)
+	default:
+	}
+}
+
+func TestConnWriteContextDeadline(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	errs := make(chan error, 1)
+	opts := testConnOptions()
+	opts.ACKTimeout = time.Hour
+	opts.MaxTransmitWait = 24 * time.Hour
+	opts.MaxTransmitSpan = 24 * time.Hour
+	opts.Clock = clock
+	opts.ErrorHandler = func(_ *Message, err error) {
+		errs <- err
+	}
+
+	a, b := newPipe()
+	client := NewConn(a, opts)
+	defer client.Close()
+	server := NewConn(b, testConnOptions())
+	defer server.Close()
+
+	deadline := clock.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	a.DropEvery(1)
+	err := client.WriteContext(ctx, &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			ID:      0x4242,
+		},
+	}, server.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+	a.DropEvery(0)
+
+	// past the deadline and the initial timeout
+	clock.Advance(opts.ACKTimeout * 5 / 2)
+
+	err = <-errs
+	expectErr(t, err, DeadlineExceeded{Deadline: deadline})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v to match context.DeadlineExceeded", err)
+	}
+
+	err = b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	_, err = server.Read(&Message{})
+	expectErr(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestConnMaxPendingExchanges(t *testing.T) {
+	tests := []struct {
+		name          string
+		blockWhenFull bool
+		err           error
+	}{
+		{
+			name: "fail",
+			err:  QueueFull{Limit: 2},
+		},
+		{
+			name:          "block",
+			blockWhenFull: true,
+			err:           context.DeadlineExceeded,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testConnOptions()
+			opts.ACKTimeout = time.Hour
+			opts.MaxTransmitWait = 24 * time.Hour
+			opts.MaxTransmitSpan = 24 * time.Hour
+			opts.Clock = newFakeClock(time.Now())
+			opts.MaxPendingExchanges = 2
+			opts.BlockWhenFull = test.blockWhenFull
+
+			// black hole, no message is ever acknowledged
+			a, b := newPipe()
+			a.DropEvery(1)
+			client := NewConn(a, opts)
+			server := NewConn(b, testConnOptions())
+			defer server.Close()
+
+			write := func(ctx context.Context, id MessageID) error {
+				return client.WriteContext(ctx, &Message{
+					Header: Header{
+						Version: ProtocolVersion,
+						Type:    Confirmable,
+						Code:    Code(GET),
+						ID:      id,
+					},
+				}, server.LocalAddr())
+			}
+
+			for id := range MessageID(2) {
+				err := write(context.Background(), id)
+				if err != nil {
+					t.Fatal("write:", err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			err := write(ctx, 2)
+			if full, ok := err.(QueueFull); ok {
+				if full.Addr.String() != server.LocalAddr().String() {
+					t.Errorf("QueueFull.Addr = %s, want %s", full.Addr, server.LocalAddr())
+				}
+				full.Addr = nil
+				err = full
+			}
+			expectErr(t, err, test.err)
+
+			diff := cmp.Diff(ConnStats{PendingExchanges: 2}, client.Stats())
+			if diff != "" {
+				t.Errorf("stats mismatch (-want +got):\n%s", diff)
+			}
+
+			err = client.Close()
+			if err != nil {
+				t.Fatal("close:", err)
+			}
+
+			diff = cmp.Diff(ConnStats{AbandonedExchanges: 2}, client.Stats())
+			if diff != "" {
+				t.Errorf("stats after close mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConnCloseFromErrorHandler(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	closed := make(chan error, 1)
+
+	var client *Conn
+	opts := testConnOptions()
+	opts.ACKTimeout = time.Hour
+	opts.MaxTransmitWait = 24 * time.Hour
+	opts.MaxTransmitSpan = 24 * time.Hour
+	opts.Clock = clock
+	opts.ErrorHandler = func(_ *Message, err error) {
+		if errors.Is(err, context.DeadlineExceeded) {
+			closed <- client.Close()
+		}
+	}
+
+	// black hole, no message is ever acknowledged
+	a, b := newPipe()
+	a.DropEvery(1)
+	client = NewConn(a, opts)
+	defer b.Close()
+
+	write := func(ctx context.Context, id MessageID) {
+		t.Helper()
+
+		err := client.WriteContext(ctx, &Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Confirmable,
+				Code:    Code(GET),
+				ID:      id,
+			},
+		}, b.LocalAddr())
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(time.Minute))
+	defer cancel()
+
+	write(ctx, 1)
+	write(context.Background(), 2)
+
+	clock.Advance(2 * time.Minute)
+
+	err := <-closed
+	if err != nil {
+		t.Fatal("close:", err)
+	}
+
+	<-client.Stopped()
+
+	diff := cmp.Diff(ConnStats{AbandonedExchanges: 1}, client.Stats())
+	if diff != "" {
+		t.Errorf("stats after close mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConnUnrecognizedOptions(t *testing.T) {
+	a, b := newPipe()
+	client := NewConn(a, testConnOptions())
+	defer client.Close()
+	server := NewConn(b, testConnOptions())
+	defer server.Close()
+
+	err := client.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(GET),
+		},
+		Options: Options{
+			MustOptionValue(URIPath, "a"),
+			MustOptionValue(OptionDef{Code: 2048, ValueFormat: ValueFormatOpaque, MaxLen: 8}, bytes4),
+		},
+	}, server.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	received := &Message{}
+	_, err = server.Read(received)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	if n := len(received.Options); n != 1 {
+		t.Errorf("received %d options, want 1", n)
+	}
+
+	if n := server.Stats().UnrecognizedOptions; n != 1 {
+		t.Errorf("UnrecognizedOptions = %d, want 1", n)
+	}
+}
+
+func TestConnGather(t *testing.T) {
+	a, b := newPipe()
+	client := NewConn(a, testConnOptions())
+	defer client.Close()
+	server := NewConn(b, testConnOptions())
+	defer server.Close()
+
+	acks := make(chan *Message, 1)
+	go func() {
+		req := &Message{}
+		addr, err := server.Read(req)
+		if err != nil {
+			return
+		}
+
+		responses := []Header{
+			{Type: NonConfirmable, Token: req.Token},
+			{Type: NonConfirmable, Token: Token("other")},
+			{Type: Confirmable, ID: 0x7001, Token: req.Token},
+		}
+		for i, header := range responses {
+			header.Version = ProtocolVersion
+			header.Code = Code(Content)
+			_ = server.Write(&Message{
+				Header:  header,
+				Payload: []byte{byte(i)},
+			}, addr)
+		}
+
+		ack := &Message{}
+		_, err = server.Read(ack)
+		if err == nil {
+			acks <- ack
+		}
+	}()
+
+	// the Conn reads responses by itself
+	gathered, err := client.Gather(context.Background(), &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(GET),
+		},
+	}, server.LocalAddr(), 50*time.Millisecond)
+	if err != nil {
+		t.Fatal("gather:", err)
+	}
+
+	payloads := [][]byte{}
+	for _, g := range gathered {
+		if g.From.String() != server.LocalAddr().String() {
+			t.Errorf("From = %s, want %s", g.From, server.LocalAddr())
+		}
+
+		payloads = append(payloads, g.Resp.Payload)
+	}
+
+	diff := cmp.Diff([][]byte{{0}, {2}}, payloads)
+	if diff != "" {
+		t.Errorf("payloads mismatch (-want +got):\n%s", diff)
+	}
+
+	select {
+	case ack := <-acks:
+		if ack.Type != Acknowledgement || ack.ID != 0x7001 {
+			t.Errorf("reply = %s %#x, want Acknowledgement 0x7001", ack.Type, ack.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("confirmable response not acknowledged")
+	}
+
+	// messages not gathered are left to Read
+	_, err = b.WriteTo(MustValue(testRequest().MarshalBinary()), a.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	msg := &Message{}
+	_, err = client.Read(msg)
+	if err != nil {
+		t.Fatal("read after gather:", err)
+	}
+
+	if string(msg.Token) != "other" {
+		t.Errorf("Token = %q, want %q", msg.Token, "other")
+	}
+
+	_, err = client.Read(msg)
+	if err != nil {
+		t.Fatal("read after gather:", err)
+	}
+
+	if msg.ID != 0x4242 {
+		t.Errorf("ID = %#x, want %#x", msg.ID, 0x4242)
+	}
+
+	// context ends before the window
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = client.Gather(ctx, &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(GET),
+		},
+	}, server.LocalAddr(), time.Hour)
+	expectErr(t, err, context.DeadlineExceeded)
+}
+
+func TestConnDoKeepsRequests(t *testing.T) {
+	a, b := newPipe()
+	delegate := &deadlineConn{PacketConn: a}
+	client := NewConn(delegate, testConnOptions())
+	defer client.Close()
+
+	go func() {
+		buf := make([]byte, MaxMessageLength)
+		n, addr, err := b.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		req := &Message{}
+		_, err = req.Decode(buf[:n], MarshalOptions{})
+		if err != nil {
+			return
+		}
+
+		// a request of the peer arrives before the response
+		_, _ = b.WriteTo(MustValue(testRequest().MarshalBinary()), addr)
+		_, _ = b.WriteTo(MustValue((&Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Acknowledgement,
+				Code:    Code(Content),
+				ID:      req.ID,
+				Token:   req.Token,
+			},
+		}).MarshalBinary()), addr)
+	}()
+
+	resp, err := client.Do(context.Background(), &Request{
+		Type:   Confirmable,
+		Method: GET,
+	}, b.LocalAddr())
+	if err != nil {
+		t.Fatal("do:", err)
+	}
+
+	if resp.Code != Content {
+		t.Errorf("Code = %v, want %v", resp.Code, Content)
+	}
+
+	msg := &Message{}
+	_, err = client.Read(msg)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	if msg.ID != 0x4242 {
+		t.Errorf("ID = %#x, want %#x", msg.ID, 0x4242)
+	}
+
+	if delegate.deadlines.Load() != 0 {
+		t.Errorf("read deadline set %d times, want none", delegate.deadlines.Load())
+	}
+}
+
+func TestConnDoReceiveQueueFull(t *testing.T) {
+	const unsolicited = receiveQueueLength + 6
+
+	// datagrams beyond the backlog of the pipe would be dropped before reaching the queue
+	a, b := listenPacket(t), listenPacket(t)
+	defer b.Close()
+
+	dropped := make(chan error, unsolicited)
+	opts := testConnOptions()
+	opts.ConnErrorHandler = func(err error) {
+		dropped <- err
+	}
+
+	client := NewConn(a, opts)
+	defer client.Close()
+
+	go func() {
+		buf := make([]byte, MaxMessageLength)
+		n, addr, err := b.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		req := &Message{}
+		_, err = req.Decode(buf[:n], MarshalOptions{})
+		if err != nil {
+			return
+		}
+
+		// nobody reads the Conn, requests of the peer fill the queue before the response arrives
+		for i := range unsolicited {
+			msg := testRequest()
+			msg.Type = NonConfirmable
+			msg.ID = MessageID(0x5000 + i)
+			_, _ = b.WriteTo(MustValue(msg.MarshalBinary()), addr)
+		}
+
+		_, _ = b.WriteTo(MustValue((&Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Acknowledgement,
+				Code:    Code(Content),
+				ID:      req.ID,
+				Token:   req.Token,
+			},
+		}).MarshalBinary()), addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := client.Do(ctx, &Request{
+		Type:   Confirmable,
+		Method: GET,
+	}, b.LocalAddr())
+	if err != nil {
+		t.Fatal("do:", err)
+	}
+
+	if resp.Code != Content {
+		t.Errorf("Code = %v, want %v", resp.Code, Content)
+	}
+
+	if len(dropped) != unsolicited-receiveQueueLength {
+		t.Errorf("dropped %d messages, want %d", len(dropped), unsolicited-receiveQueueLength)
+	}
+
+	full, ok := (<-dropped).(ReceiveQueueFull)
+	if !ok || full.ID != 0x5000 || full.Addr.String() != b.LocalAddr().String() {
+		t.Errorf("dropped %v, want ReceiveQueueFull of 0x5000 from %s", full, b.LocalAddr())
+	}
+
+	// the oldest messages are dropped
+	msg := &Message{}
+	_, err = client.Read(msg)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	if msg.ID != 0x5000+unsolicited-receiveQueueLength {
+		t.Errorf("ID = %#x, want %#x", msg.ID, 0x5000+unsolicited-receiveQueueLength)
+	}
+}
+
+// deadlineConn counts read deadlines set on the connection.
+type deadlineConn struct {
+	net.PacketConn
+
+	deadlines atomic.Int32
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadlines.Add(1)
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+func TestConnReadLoop(t *testing.T) {
+	errs := make(chan error, 1)
+	opts := testConnOptions()
+	opts.ConnErrorHandler = func(err error) {
+		errs <- err
+	}
+
+	a, b := newPipe()
+	server := NewConn(a, opts)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan *Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ReadLoop(ctx, func(msg *Message, _ net.Addr) {
+			received <- msg
+		})
+	}()
+
+	// malformed datagram is reported and skipped
+	_, err := b.WriteTo([]byte{0x40}, a.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	select {
+	case err := <-errs:
+		if !isError[UnmarshalError](err) {
+			t.Errorf("error = %v, want UnmarshalError", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("decode error not reported")
+	}
+
+	_, err = b.WriteTo(MustValue(testRequest().MarshalBinary()), a.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	select {
+	case msg := <-received:
+		if msg.ID != 0x4242 {
+			t.Errorf("ID = %#x, want %#x", msg.ID, 0x4242)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		expectErr(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("read loop not stopped by context")
+	}
+
+	// connection is still usable after the loop
+	_, err = b.WriteTo(MustValue(testRequest().MarshalBinary()), a.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	msg := &Message{}
+	_, err = server.Read(msg)
+	if err != nil {
+		t.Fatal("read after loop:", err)
+	}
+}
+
+func TestConnReadLoopClosed(t *testing.T) {
+	a, _ := newPipe()
+	server := NewConn(a, testConnOptions())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ReadLoop(context.Background(), func(_ *Message, _ net.Addr) {})
+	}()
+
+	_ = server.Close()
+
+	select {
+	case err := <-done:
+		expectErr(t, err, net.ErrClosed)
+	case <-time.After(time.Second):
+		t.Fatal("read loop not stopped by close")
+	}
+}
+
+func TestConnDecodeErrorHandler(t *testing.T) {
+	type skipped struct {
+		raw  []byte
+		addr net.Addr
+		err  error
+	}
+
+	var got []skipped
+	opts := testConnOptions()
+	opts.StrictSemantics = true
+	opts.DecodeErrorHandler = func(raw []byte, addr net.Addr, err error) {
+		got = append(got, skipped{
+			raw:  slices.Clone(raw),
+			addr: addr,
+			err:  err,
+		})
+	}
+
+	a, b := newPipe()
+	conn := NewConn(a, opts)
+	defer conn.Close()
+
+	// empty message with payload is not allowed
+	empty := []byte{0x40, 0x00, 0x12, 0x34, PayloadMarker, 0x01}
+	datagrams := [][]byte{
+		{0x40},
+		empty,
+		MustValue(testRequest().MarshalBinary()),
+	}
+	for _, data := range datagrams {
+		_, err := b.WriteTo(data, a.LocalAddr())
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+
+	msg := &Message{}
+	addr, err := conn.Read(msg)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	diff := cmp.Diff(testRequest(), msg, cmpopts.EquateEmpty())
+	if diff != "" {
+		t.Errorf("message mismatch (-want +got):\n%s", diff)
+	}
+
+	if addr != b.LocalAddr() {
+		t.Errorf("addr = %v, want %v", addr, b.LocalAddr())
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("%d datagrams skipped, want 2", len(got))
+	}
+
+	for i, want := range datagrams[:2] {
+		if !bytes.Equal(got[i].raw, want) || got[i].addr != b.LocalAddr() || !IsDecodeError(got[i].err) {
+			t.Errorf("skipped %x from %v with %v, want %x from %v with decode error",
+				got[i].raw, got[i].addr, got[i].err, want, b.LocalAddr())
+		}
+	}
+
+	expectErr(t, got[1].err, PayloadNotAllowed{
+		Code: 0,
+	})
+}
+
+func TestConnReadDecodeError(t *testing.T) {
+	a, b := newPipe()
+	conn := NewConn(a, testConnOptions())
+	defer conn.Close()
+
+	_, err := b.WriteTo([]byte{0x40}, a.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	_, err = conn.Read(&Message{})
+	if !IsDecodeError(err) {
+		t.Errorf("error = %v, want decode error", err)
+	}
+
+	_ = conn.Close()
+
+	_, err = conn.Read(&Message{})
+	if IsDecodeError(err) {
+		t.Errorf("error = %v, want transport error", err)
+	}
+}
+
+// checkingConn decodes written datagrams, checking that the payload of each matches its token.
+type checkingConn struct {
+	net.PacketConn
+
+	mtx    sync.Mutex
+	writes map[Type]int
+	err    error
+}
+
+func (c *checkingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	msg := &Message{}
+	_, err := msg.Decode(b, MarshalOptions{})
+	if err == nil && string(msg.Payload) != string(msg.Token) {
+		err = fmt.Errorf("payload %x, token %x", msg.Payload, msg.Token)
+	}
+
+	c.mtx.Lock()
+	c.writes[msg.Type]++
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	c.mtx.Unlock()
+
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *checkingConn) Writes(typ Type) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.writes[typ]
+}
+
+func TestConnConcurrentWrite(t *testing.T) {
+	a, _ := newPipe()
+	delegate := &checkingConn{
+		PacketConn: a,
+		writes:     map[Type]int{},
+	}
+
+	conn := NewConn(delegate, testConnOptions())
+	defer conn.Close()
+
+	message := func(typ Type, id MessageID, token Token) *Message {
+		return &Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    typ,
+				Code:    Code(POST),
+				ID:      id,
+				Token:   token,
+			},
+			Payload: token,
+		}
+	}
+
+	// unacknowledged, retransmitted by the retransmit loop while writers run
+	const exchanges = 4
+	for i := range exchanges {
+		err := conn.Write(message(Confirmable, MessageID(0x1000+i), Token{0xc0, byte(i)}), pipeAddr(fmt.Sprintf("peer-%d", i)))
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+
+	const writers = 8
+	const writes = 50
+	wg := sync.WaitGroup{}
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			addr := pipeAddr(fmt.Sprintf("peer-%d", w))
+			for i := range writes {
+				token := Token{0x0a, byte(w), byte(i), byte(i >> 8)}
+				err := conn.Write(message(NonConfirmable, MessageID(w<<8|i), token), addr)
+				if err != nil {
+					t.Error("write:", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for delegate.Writes(Confirmable) < 2*exchanges && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := delegate.Writes(Confirmable); n < 2*exchanges {
+		t.Errorf("confirmable writes = %d, want retransmissions", n)
+	}
+
+	if n := delegate.Writes(NonConfirmable); n != writers*writes {
+		t.Errorf("non-confirmable writes = %d, want %d", n, writers*writes)
+	}
+
+	delegate.mtx.Lock()
+	defer delegate.mtx.Unlock()
+	if delegate.err != nil {
+		t.Error("corrupted write:", delegate.err)
+	}
+}
+
+// discardConn is a net.PacketConn discarding written datagrams.
+type discardConn struct {
+	net.PacketConn
+}
+
+func (discardConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return len(b), nil
+}
+
+func BenchmarkWriterParallel(b *testing.B) {
+	message := func() *Message {
+		msg := &Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    NonConfirmable,
+				Code:    Code(Content),
+				ID:      0x4242,
+				Token:   bytes4,
+			},
+			Payload: bytes.Repeat([]byte{0x42}, 256),
+		}
+		Must(msg.Options.SetUint(ContentFormat, uint32(MediaTypeApplicationCBOR.Code)))
+
+		return msg
+	}
+
+	run := func(b *testing.B, write func(w *Writer, msg *Message, addr net.Addr) error) {
+		w := NewWriter(discardConn{}, MarshalOptions{})
+		peers := atomic.Int32{}
+
+		b.ReportAllocs()
+		// 8 goroutines per GOMAXPROCS, the pool holds a buffer per goroutine writing concurrently
+		b.SetParallelism(8)
+		b.RunParallel(func(pb *testing.PB) {
+			msg := message()
+			addr := pipeAddr(fmt.Sprintf("peer-%d", peers.Add(1)))
+			for pb.Next() {
+				err := write(w, msg, addr)
+				if err != nil {
+					b.Error("write:", err)
+					return
+				}
+			}
+		})
+	}
+
+	b.Run("concurrent", func(b *testing.B) {
+		run(b, func(w *Writer, msg *Message, addr net.Addr) error {
+			return w.Write(msg, addr)
+		})
+	})
+
+	// serialized emulates a single lock around encoding and writing
+	b.Run("serialized", func(b *testing.B) {
+		mtx := sync.Mutex{}
+		run(b, func(w *Writer, msg *Message, addr net.Addr) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			return w.Write(msg, addr)
+		})
+	})
+}
@@ -0,0 +1,350 @@
+package coap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AddrResolver resolves the address of a ClientConn to the UDP address its socket is connected to.
+type AddrResolver func(ctx context.Context, address string) (*net.UDPAddr, error)
+
+// ClientConn is a Conn bound to a single remote address over a connected UDP socket.
+//
+// Connected sockets report ICMP errors, such as port unreachable, as read and write errors.
+//
+// The Conn lives as long as the ClientConn, re-resolution only replaces its socket, so that
+// messages awaiting acknowledgement keep being retransmitted to the new address.
+type ClientConn struct {
+	address string
+	opts    ConnOptions
+	conn    *Conn
+	socket  *connectedConn
+
+	mtx    sync.RWMutex
+	remote net.Addr
+
+	unreachable atomic.Uint32
+	resolving   atomic.Bool
+}
+
+// connectedConn adapts a connected UDP socket to net.PacketConn, writes ignore the address.
+//
+// The socket is replaced on re-resolution, reads blocked on the previous socket continue on the new one.
+type connectedConn struct {
+	observe func(err error)
+
+	mtx          sync.RWMutex
+	udp          *net.UDPConn
+	readDeadline time.Time
+	closed       bool
+}
+
+// DialUDP resolves the address and instantiates a new ClientConn over a connected UDP socket.
+//
+// If ReresolveAfter is set, the address is resolved again and the socket replaced
+// after that many host unreachable errors without a datagram received in between.
+// Errors of re-resolution are passed to the ConnErrorHandler.
+//
+// Returns InvalidConnOptions if options are not valid.
+func DialUDP(ctx context.Context, address string, opts ConnOptions) (*ClientConn, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ErrorHandler == nil {
+		opts.ErrorHandler = NoopRetransmitErrorHandler
+	}
+
+	if opts.ConnErrorHandler == nil {
+		opts.ConnErrorHandler = func(error) {}
+	}
+
+	if opts.AddrResolver == nil {
+		opts.AddrResolver = ResolveUDPAddr
+	}
+
+	udp, err := dialUDP(ctx, address, opts.AddrResolver)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ClientConn{
+		address: address,
+		opts:    opts,
+		remote:  udp.RemoteAddr(),
+	}
+	c.socket = &connectedConn{
+		observe: c.observe,
+		udp:     udp,
+	}
+	c.conn = NewConn(c.socket, opts)
+
+	return c, nil
+}
+
+// ResolveUDPAddr is the default AddrResolver, it resolves a host and port with net.DefaultResolver
+// and prefers IPv4 addresses like net.ResolveUDPAddr.
+func ResolveUDPAddr(ctx context.Context, address string) (*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", service)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := ips[0]
+	for _, candidate := range ips {
+		if candidate.Unmap().Is4() {
+			ip = candidate
+			break
+		}
+	}
+
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(port))), nil
+}
+
+func dialUDP(ctx context.Context, address string, resolve AddrResolver) (*net.UDPConn, error) {
+	addr, err := resolve(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.DialUDP("udp", nil, addr)
+}
+
+// reresolve resolves the address again and replaces the socket, the counter of unreachable errors
+// is reset only if it succeeds.
+func (c *ClientConn) reresolve() {
+	defer c.resolving.Store(false)
+
+	udp, err := dialUDP(context.Background(), c.address, c.opts.AddrResolver)
+	if err != nil {
+		c.opts.ConnErrorHandler(err)
+		return
+	}
+
+	c.mtx.Lock()
+	err = c.socket.replace(udp)
+	if err == nil {
+		c.remote = udp.RemoteAddr()
+	}
+	c.mtx.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	c.unreachable.Store(0)
+}
+
+// Close closes the connection and stops the retransmission queue.
+func (c *ClientConn) Close() error {
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local address of the connected socket.
+func (c *ClientConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the resolved address of the server.
+func (c *ClientConn) RemoteAddr() net.Addr {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	return c.remote
+}
+
+// Read reads a message from the server.
+//
+// Datagrams received from other than the remote address are skipped.
+func (c *ClientConn) Read(msg *Message) error {
+	for {
+		addr, err := c.conn.Read(msg)
+		switch {
+		case err != nil:
+			return err
+		case addr == nil || addr.String() != c.RemoteAddr().String():
+			continue
+		}
+
+		return nil
+	}
+}
+
+// Write sends a message to the server and handles retransmission for Confirmable messages.
+func (c *ClientConn) Write(msg *Message) error {
+	return c.conn.Write(msg, c.RemoteAddr())
+}
+
+// ReadMessage implements MessageConn.
+func (c *ClientConn) ReadMessage(msg *Message) (net.Addr, error) {
+	err := c.Read(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.RemoteAddr(), nil
+}
+
+// WriteMessage implements MessageConn.
+//
+// Returns UnexpectedAddr if addr is neither nil nor the remote address.
+func (c *ClientConn) WriteMessage(msg *Message, addr net.Addr) error {
+	remote := c.RemoteAddr()
+	if addr != nil && addr.String() != remote.String() {
+		return UnexpectedAddr{
+			Addr:   addr,
+			Remote: remote,
+		}
+	}
+
+	return c.Write(msg)
+}
+
+// observe counts host unreachable errors of the socket, including writes retried as transient and
+// retransmissions, and starts re-resolution once ReresolveAfter is reached. A received datagram
+// resets the counter, as a successful write does not prove the server is reachable.
+func (c *ClientConn) observe(err error) {
+	switch {
+	case err == nil:
+		c.unreachable.Store(0)
+		return
+	case !isHostUnreachable(err):
+		return
+	}
+
+	count := c.unreachable.Add(1)
+	if c.opts.ReresolveAfter == 0 || count < uint32(c.opts.ReresolveAfter) {
+		return
+	}
+
+	// a single re-resolution at a time, concurrent writers keep writing to the current socket meanwhile
+	if c.resolving.CompareAndSwap(false, true) {
+		go c.reresolve()
+	}
+}
+
+func (c *connectedConn) current() (*net.UDPConn, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	return c.udp, c.closed
+}
+
+// replace swaps the socket and closes the previous one, reads blocked on it continue on udp.
+//
+// Returns net.ErrClosed and closes udp if the connection is closed.
+func (c *connectedConn) replace(udp *net.UDPConn) error {
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		_ = udp.Close()
+
+		return net.ErrClosed
+	}
+
+	_ = udp.SetReadDeadline(c.readDeadline)
+	prev := c.udp
+	c.udp = udp
+	c.mtx.Unlock()
+
+	return prev.Close()
+}
+
+// ReadFrom implements net.PacketConn by reading from the current socket.
+func (c *connectedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		udp, _ := c.current()
+
+		n, addr, err := udp.ReadFrom(b)
+		if err != nil && errors.Is(err, net.ErrClosed) {
+			current, closed := c.current()
+			if !closed && current != udp {
+				continue
+			}
+		}
+
+		switch {
+		case err == nil:
+			c.observe(nil)
+		case !errors.Is(err, net.ErrClosed):
+			c.observe(err)
+		}
+
+		return n, addr, err
+	}
+}
+
+// WriteTo implements net.PacketConn by writing to the connected address.
+//
+// Errors are observed before the Writer classifies them as transient.
+func (c *connectedConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	udp, _ := c.current()
+
+	n, err := udp.Write(b)
+	if err != nil {
+		c.observe(err)
+	}
+
+	return n, err
+}
+
+// Close closes the current socket.
+func (c *connectedConn) Close() error {
+	c.mtx.Lock()
+	c.closed = true
+	udp := c.udp
+	c.mtx.Unlock()
+
+	return udp.Close()
+}
+
+// LocalAddr returns the local address of the current socket.
+func (c *connectedConn) LocalAddr() net.Addr {
+	udp, _ := c.current()
+
+	return udp.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the current socket, the read deadline
+// carries over to replacements.
+func (c *connectedConn) SetDeadline(t time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.readDeadline = t
+
+	return c.udp.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the current socket and its replacements.
+func (c *connectedConn) SetReadDeadline(t time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.readDeadline = t
+
+	return c.udp.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the current socket.
+func (c *connectedConn) SetWriteDeadline(t time.Time) error {
+	udp, _ := c.current()
+
+	return udp.SetWriteDeadline(t)
+}
@@ -0,0 +1,259 @@
+package coap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialUDP(t *testing.T) {
+	server, err := ListenPacket(context.Background(), "udp", "127.0.0.1:0", testConnOptions())
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	defer server.Close()
+
+	client, err := DialUDP(context.Background(), server.LocalAddr().String(), testConnOptions())
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer client.Close()
+
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(GET),
+			ID:      0x4242,
+			Token:   bytes4,
+		},
+	}
+
+	err = client.Write(msg)
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	received := &Message{}
+	addr, err := server.Read(received)
+	if err != nil {
+		t.Fatal("server read:", err)
+	}
+
+	reply := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(Content),
+			ID:      received.ID,
+			Token:   received.Token,
+		},
+	}
+
+	err = server.Write(reply, addr)
+	if err != nil {
+		t.Fatal("server write:", err)
+	}
+
+	err = client.Read(received)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	if received.Code != Code(Content) {
+		t.Errorf("received code = %v, want %v", received.Code, Code(Content))
+	}
+}
+
+func TestDialUDPPortUnreachable(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ICMP errors on connected sockets are only reported on linux")
+	}
+
+	// reserve a loopback port and release it, so nothing listens there
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	address := listener.LocalAddr().String()
+	listener.Close()
+
+	client, err := DialUDP(context.Background(), address, testConnOptions())
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer client.Close()
+
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(GET),
+			ID:      0x4242,
+		},
+	}
+
+	err = client.Write(msg)
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	err = client.Read(&Message{})
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("read error = %v, want %v", err, syscall.ECONNREFUSED)
+	}
+}
+
+func TestClientConnWriteMessage(t *testing.T) {
+	client, err := DialUDP(context.Background(), "127.0.0.1:5683", testConnOptions())
+	if err != nil {
+		t.Skip("dial:", err)
+	}
+	defer client.Close()
+
+	addr := pipeAddr("pipe-b")
+	err = client.WriteMessage(&Message{}, addr)
+	expectErr(t, err, UnexpectedAddr{
+		Addr:   addr,
+		Remote: client.RemoteAddr(),
+	})
+}
+
+func TestClientConnReresolve(t *testing.T) {
+	if !isHostUnreachable(syscall.EHOSTUNREACH) {
+		t.Skip("host unreachable errors are only classified on unix")
+	}
+
+	prev, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	defer prev.Close()
+
+	next, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	defer next.Close()
+
+	// the first resolution returns the previous address, re-resolution blocks until released
+	release := make(chan struct{})
+	resolved := atomic.Uint32{}
+	opts := testConnOptions()
+	maxRetransmit := uint(8)
+	opts.MaxRetransmit = &maxRetransmit
+	opts.MaxTransmitWait = 10 * time.Second
+	opts.ReresolveAfter = 3
+	opts.AddrResolver = func(_ context.Context, _ string) (*net.UDPAddr, error) {
+		if resolved.Add(1) == 1 {
+			return prev.LocalAddr().(*net.UDPAddr), nil
+		}
+
+		<-release
+
+		return next.LocalAddr().(*net.UDPAddr), nil
+	}
+
+	client, err := DialUDP(context.Background(), "coap.example:5683", opts)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer client.Close()
+
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			ID:      0x4242,
+			Token:   bytes4,
+		},
+	}
+
+	err = client.Write(msg)
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	buf := make([]byte, MaxMessageLength)
+	_ = prev.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = prev.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("previous read:", err)
+	}
+
+	// concurrent writers failing past the threshold start a single re-resolution
+	wg := sync.WaitGroup{}
+	for range 4 * opts.ReresolveAfter {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.socket.observe(syscall.EHOSTUNREACH)
+		}()
+	}
+	wg.Wait()
+	close(release)
+
+	// the message awaiting acknowledgement is retransmitted to the new address
+	_ = next.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, err := next.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("next read:", err)
+	}
+
+	retransmitted := &Message{}
+	_, err = retransmitted.Decode(buf[:n], MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	if retransmitted.ID != msg.ID {
+		t.Errorf("retransmitted id = %v, want %v", retransmitted.ID, msg.ID)
+	}
+
+	if resolved.Load() != 2 {
+		t.Errorf("resolved = %d, want 2", resolved.Load())
+	}
+
+	if client.RemoteAddr().String() != next.LocalAddr().String() {
+		t.Errorf("remote addr = %v, want %v", client.RemoteAddr(), next.LocalAddr())
+	}
+
+	ack, err := (&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Acknowledgement,
+			Code:    Code(Content),
+			ID:      msg.ID,
+			Token:   msg.Token,
+		},
+	}).Encode(nil, MarshalOptions{})
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	_, err = next.WriteTo(ack, addr)
+	if err != nil {
+		t.Fatal("next write:", err)
+	}
+
+	received := &Message{}
+	err = client.Read(received)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	if received.Code != Code(Content) {
+		t.Errorf("received code = %v, want %v", received.Code, Code(Content))
+	}
+
+	if client.unreachable.Load() != 0 {
+		t.Errorf("unreachable = %d, want 0 after a received datagram", client.unreachable.Load())
+	}
+}
@@ -1,7 +1,10 @@
 package coap
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"reflect"
 	"time"
 )
@@ -97,12 +100,372 @@ type InvalidOptionValueFormat struct {
 	Unknown   reflect.Type
 }
 
+// OptionNameMismatch is returned when decoding an option whose name does not match the option definition
+// of its code.
+type OptionNameMismatch struct {
+	OptionDef
+	Requested string
+}
+
 // InvalidOptionValueLength is returned when the length of an option value does not match the expected length.
 type InvalidOptionValueLength struct {
 	OptionDef
 	Length uint16
 }
 
+// InvalidOptionDelta is returned when an option is encoded after an option with a greater code.
+type InvalidOptionDelta struct {
+	Code uint16
+	Prev uint16
+}
+
+// InvalidObserve is returned when a request carries Observe value other than register (0) or deregister (1).
+//
+// https://datatracker.ietf.org/doc/html/rfc7641#section-2
+type InvalidObserve struct {
+	Value uint32
+}
+
+// InvalidPattern is returned when a ServeMux pattern is malformed.
+type InvalidPattern struct {
+	Pattern string
+}
+
+// PatternConflict is returned when a ServeMux pattern matches the same paths as an already registered pattern.
+type PatternConflict struct {
+	Pattern  string
+	Existing string
+}
+
+// UnexpectedAddr is returned when ClientConn is asked to write to other than its remote address.
+type UnexpectedAddr struct {
+	Addr   net.Addr
+	Remote net.Addr
+}
+
+// RateLimitExceeded is returned when a peer sends more bytes than its budget allows.
+type RateLimitExceeded struct {
+	Peer              PeerID
+	MaxBytesPerSecond uint
+}
+
+// InFlightLimitExceeded is returned when a peer has too many requests awaiting a response.
+type InFlightLimitExceeded struct {
+	Peer        PeerID
+	MaxInFlight uint
+}
+
+// InvalidLocation is returned when a LocationPath segment is "." or "..".
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.10.7
+type InvalidLocation struct {
+	Segment string
+}
+
+// OptionPropertyMismatch is returned when a declared option property contradicts the property derived from its code.
+type OptionPropertyMismatch struct {
+	OptionDef
+	Property string
+}
+
+// InvalidOptionDef is returned when an OptionDef is internally inconsistent, such as value length bounds
+// not fitting the value format.
+type InvalidOptionDef struct {
+	OptionDef
+	Reason string
+}
+
+// UnsupportedScheme is returned when a URL scheme is neither coap nor coaps.
+type UnsupportedScheme struct {
+	Scheme string
+}
+
+// InvalidAuthority is returned when an authority is not a valid host[:port].
+type InvalidAuthority struct {
+	Authority string
+}
+
+// InvalidURL is returned when a URL cannot be used as a CoAP request URI.
+type InvalidURL struct {
+	URL string
+}
+
+// InvalidConnOptions is returned when a connection option has a nonsensical value.
+type InvalidConnOptions struct {
+	Field  string
+	Reason string
+}
+
+// SuppressedErrors wraps the last error suppressed by RateLimitedErrorHandler within a window
+// with the number of errors suppressed.
+type SuppressedErrors struct {
+	Err        error
+	Suppressed uint
+	Window     time.Duration
+}
+
+// DeadlineExceeded is passed to the ErrorHandler when a Confirmable message is not retransmitted
+// because its deadline passed, it matches context.DeadlineExceeded.
+type DeadlineExceeded struct {
+	Deadline time.Time
+}
+
+// ResponseAlreadyWritten is returned when a handler writes more than one response to a request.
+type ResponseAlreadyWritten struct{}
+
+// PayloadNotAllowed is returned in strict mode when a message carries a payload on a code that forbids it.
+type PayloadNotAllowed struct {
+	Code Code
+}
+
+// QueueFull is returned when writing a Confirmable message while MaxPendingExchanges are awaiting acknowledgement.
+type QueueFull struct {
+	Addr  net.Addr
+	Limit uint
+}
+
+// DelegateError is sent to MultiConn.Errors when reading from one of its delegates fails.
+type DelegateError struct {
+	Index int
+	Addr  net.Addr
+	Err   error
+}
+
+// WriteFailed is passed to the ErrorHandler of Conn when the first transmission of a Confirmable message
+// fails with an error other than a transient one, the message is not retransmitted.
+type WriteFailed struct {
+	Addr net.Addr
+	Err  error
+}
+
+// NoDelegates is returned by NewMultiConn without delegates to read from.
+type NoDelegates struct{}
+
+// InvalidBlockSize is returned when a Block option carries the reserved size exponent 7,
+// or is set with a size exponent above MaxBlockSZX.
+//
+// https://datatracker.ietf.org/doc/html/rfc7959#section-2.2
+type InvalidBlockSize struct {
+	SZX uint8
+}
+
+// InvalidBlockNum is returned when a Block option is set with a block number above MaxBlockNum.
+//
+// https://datatracker.ietf.org/doc/html/rfc7959#section-2.2
+type InvalidBlockNum struct {
+	Num uint32
+}
+
+// ETagChangedMidTransfer is returned when a block of a representation carries a different ETag than the previous blocks.
+//
+// https://datatracker.ietf.org/doc/html/rfc7959#section-2.4
+type ETagChangedMidTransfer struct {
+	Num      uint32
+	Expected []byte
+	Actual   []byte
+}
+
+// SizeMismatch is returned when Size1 or Size2 of a block transfer is inconsistent with previous blocks or
+// the transferred payload.
+type SizeMismatch struct {
+	Option   OptionDef
+	Expected uint32
+	Actual   uint32
+}
+
+// NonContiguousBlock is returned when a block does not start at the offset following the previous block.
+type NonContiguousBlock struct {
+	Expected uint32
+	Actual   uint32
+}
+
+// BlockSizeChangedUpward is returned when the block size grows during a transfer, only reducing it is allowed.
+//
+// https://datatracker.ietf.org/doc/html/rfc7959#section-2.4
+type BlockSizeChangedUpward struct {
+	Previous uint
+	Size     uint
+}
+
+// CannotFit is returned by FitResponse when the response exceeds the budget after trimming
+// all elements allowed by the policy.
+type CannotFit struct {
+	Budget int
+
+	// Size is the smallest achievable size of the encoded response.
+	Size int
+}
+
+// NotIdempotent is returned by Conn.Hedge for a request with a method which is not idempotent.
+type NotIdempotent struct {
+	Method Method
+}
+
+// ResponseRejected is returned by Conn.Hedge for a response which is not accepted,
+// and by Client.Discover for a response other than Content.
+type ResponseRejected struct {
+	Addr net.Addr
+	Code ResponseCode
+}
+
+// ExchangeReset is returned by Conn.Hedge when the peer rejects the request with a Reset.
+//
+// The request is deleted from the requests awaiting responses rather than evicted, ExchangeStoreOptions.OnEvict
+// is not called for it.
+type ExchangeReset struct {
+	Addr net.Addr
+}
+
+// ExchangeEvicted is returned by Client for a request evicted from the store of requests awaiting responses.
+type ExchangeEvicted struct {
+	Addr   net.Addr
+	Reason EvictionReason
+}
+
+// ReceiveQueueFull is passed to ConnOptions.ConnErrorHandler with a message dropped from the full queue
+// of Conn.Read, as nobody reads the Conn.
+type ReceiveQueueFull struct {
+	Addr net.Addr
+	ID   MessageID
+}
+
+// NoAddresses is returned by Conn.Hedge without addresses to send the request to.
+type NoAddresses struct{}
+
+// ResponseTimeout is returned by Conn.Hedge for a NonConfirmable copy of the request
+// without a response within the timeout.
+type ResponseTimeout struct {
+	Addr    net.Addr
+	Timeout time.Duration
+}
+
+// UnknownObservation is returned by Client.CancelObserve for a token without an active observation.
+type UnknownObservation struct {
+	Token Token
+}
+
+// ObservationCanceled is passed to the notify function of Client.Observe as the last call once
+// the observation is canceled by Client.CancelObserve.
+type ObservationCanceled struct {
+	Token Token
+}
+
+// NoDTLSTransport is returned by Client for coaps URLs, which require a DTLS connection.
+type NoDTLSTransport struct {
+	URL string
+}
+
+// MessageIDsExhausted is returned when all MessageIDs are held by Confirmable messages awaiting acknowledgement.
+type MessageIDsExhausted struct{}
+
+// MalformedPayloadMarker is returned when the byte following options is not PayloadMarker,
+// or with StrictPayloadMarker when the payload marker is not followed by a payload.
+type MalformedPayloadMarker struct {
+	Byte uint8
+}
+
+// OptionError is returned by Options.Validate and Options.Normalize for a violation of the option at Index.
+type OptionError struct {
+	Index int
+	Code  uint16
+
+	// Cause is the violation, such as InvalidOptionValueLength.
+	Cause error
+}
+
+// UnrecognizedOption is returned when a critical option is not defined by the schema.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.4.1
+type UnrecognizedOption struct {
+	Code uint16
+}
+
+// UnknownMediaType is returned when a ContentFormat media type is not defined by the schema.
+type UnknownMediaType struct {
+	Code uint16
+}
+
+// MalformedCBOR is returned when decoding data outside the CBOR subset implemented by the package,
+// such as ProblemDetails.
+//
+// https://datatracker.ietf.org/doc/html/rfc8949
+type MalformedCBOR struct {
+	Offset uint
+	Reason string
+}
+
+// UnsupportedCBORType is returned when encoding a value of a type outside the CBOR subset implemented by the package.
+type UnsupportedCBORType struct {
+	Type reflect.Type
+}
+
+// TokenTooShort is returned when a request token is shorter than TokenPolicy.MinLength.
+type TokenTooShort struct {
+	Length    uint
+	MinLength uint
+}
+
+// MalformedLinkFormat is returned when parsing a document which is not in CoRE Link Format.
+//
+// https://datatracker.ietf.org/doc/html/rfc6690#section-2
+type MalformedLinkFormat struct {
+	Offset uint
+	Reason string
+}
+
+// UnknownPeer is returned by IdentityResolver for a peer without identity.
+type UnknownPeer struct {
+	Peer PeerID
+}
+
+// IsDecodeError reports whether err is the failure to decode a received datagram, such as
+// UnmarshalError, MessageTooLong or PayloadTooLong.
+//
+// Decode errors concern a single datagram and reading may continue with the next one,
+// other errors returned by Read come from the underlying connection.
+func IsDecodeError(err error) bool {
+	return isError[UnmarshalError](err) ||
+		isError[MessageTooLong](err) ||
+		isError[PayloadTooLong](err) ||
+		isError[PayloadNotAllowed](err)
+}
+
+// ResponseCodeForError returns the response code for a request that failed to decode with err.
+//
+// Malformed messages map to BadRequest, repeated or unrecognized critical options to BadOption and messages
+// exceeding limits to RequestEntityTooLarge. Unexpected errors map to InternalServerError.
+func ResponseCodeForError(err error) ResponseCode {
+	switch {
+	case isError[OptionNotRepeateable](err),
+		isError[UnrecognizedOption](err):
+		return BadOption
+	case isError[MessageTooLong](err),
+		isError[PayloadTooLong](err),
+		isError[TooManyOptions](err):
+		return RequestEntityTooLarge
+	case isError[TruncatedError](err),
+		isError[UnsupportedExtendError](err),
+		isError[UnsupportedTokenLength](err),
+		isError[UnsupportedVersion](err),
+		isError[InvalidType](err),
+		isError[InvalidCode](err),
+		isError[InvalidOptionValueLength](err),
+		isError[InvalidOptionValueFormat](err),
+		isError[InvalidObserve](err),
+		isError[InvalidLocation](err),
+		isError[MalformedPayloadMarker](err),
+		isError[PayloadNotAllowed](err):
+		return BadRequest
+	default:
+		return InternalServerError
+	}
+}
+
+func isError[T error](err error) bool {
+	var target T
+	return errors.As(err, &target)
+}
+
 func (e RetransmitRetryLimit) Error() string {
 	return fmt.Sprintf("coap: retransmit retry limit exceeded: %d of %d", e.Retransmit, e.MaxRetransmit)
 }
@@ -171,6 +534,238 @@ func (e InvalidOptionValueFormat) Error() string {
 	return fmt.Sprintf("invalid option %q value format %q, actual %q", e.Name, e.Requested, e.ValueFormat)
 }
 
+func (e OptionNameMismatch) Error() string {
+	if !e.Recognized() {
+		return fmt.Sprintf("option name %q does not match unrecognized option %d", e.Requested, e.Code)
+	}
+
+	return fmt.Sprintf("option name %q does not match option %q (%d)", e.Requested, e.Name, e.Code)
+}
+
 func (e OptionNotRepeateable) Error() string {
 	return fmt.Sprintf("option %q is not repeateable", e.Name)
 }
+
+func (e InvalidObserve) Error() string {
+	return fmt.Sprintf("coap: invalid request observe value %d, expected %d or %d", e.Value, ObserveRegister, ObserveDeregister)
+}
+
+func (e InvalidPattern) Error() string {
+	return fmt.Sprintf("invalid pattern %q", e.Pattern)
+}
+
+func (e PatternConflict) Error() string {
+	return fmt.Sprintf("pattern %q conflicts with %q", e.Pattern, e.Existing)
+}
+
+func (e UnexpectedAddr) Error() string {
+	return fmt.Sprintf("unexpected address %s, connection is bound to %s", e.Addr, e.Remote)
+}
+
+func (e RateLimitExceeded) Error() string {
+	return fmt.Sprintf("peer %s exceeded rate limit of %d bytes per second", e.Peer, e.MaxBytesPerSecond)
+}
+
+func (e InFlightLimitExceeded) Error() string {
+	return fmt.Sprintf("peer %s exceeded limit of %d requests in flight", e.Peer, e.MaxInFlight)
+}
+
+func (e InvalidLocation) Error() string {
+	return fmt.Sprintf("invalid location path segment %q", e.Segment)
+}
+
+func (e ResponseAlreadyWritten) Error() string {
+	return "response already written"
+}
+
+func (e UnsupportedScheme) Error() string {
+	return fmt.Sprintf("unsupported scheme %q", e.Scheme)
+}
+
+func (e InvalidURL) Error() string {
+	return fmt.Sprintf("invalid url %q", e.URL)
+}
+
+func (e OptionPropertyMismatch) Error() string {
+	return fmt.Sprintf("option %q declared %s property contradicts code %d", e.Name, e.Property, e.Code)
+}
+
+func (e InvalidOptionDef) Error() string {
+	return fmt.Sprintf("invalid definition of option %q (%d): %s", e.Name, e.Code, e.Reason)
+}
+
+func (e PayloadNotAllowed) Error() string {
+	return fmt.Sprintf("payload not allowed with code %s", e.Code)
+}
+
+func (e InvalidOptionDelta) Error() string {
+	return fmt.Sprintf("option code %d precedes previous code %d", e.Code, e.Prev)
+}
+
+func (e InvalidConnOptions) Error() string {
+	return fmt.Sprintf("invalid conn options: %s %s", e.Field, e.Reason)
+}
+
+func (e SuppressedErrors) Error() string {
+	return fmt.Sprintf("%v (%d errors suppressed within %s)", e.Err, e.Suppressed, e.Window)
+}
+
+func (e SuppressedErrors) Unwrap() error {
+	return e.Err
+}
+
+func (e DeadlineExceeded) Error() string {
+	return fmt.Sprintf("deadline %s exceeded", e.Deadline.Format(time.RFC3339Nano))
+}
+
+func (e DeadlineExceeded) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+func (e QueueFull) Error() string {
+	return fmt.Sprintf("retransmit queue full: %d pending exchanges, dropped message to %s", e.Limit, e.Addr)
+}
+
+func (e DelegateError) Error() string {
+	return fmt.Sprintf("delegate %d at %s failed: %v", e.Index, e.Addr, e.Err)
+}
+
+func (e DelegateError) Unwrap() error {
+	return e.Err
+}
+
+func (e WriteFailed) Error() string {
+	return fmt.Sprintf("write to %s failed: %v", e.Addr, e.Err)
+}
+
+func (e WriteFailed) Unwrap() error {
+	return e.Err
+}
+
+func (e NoDelegates) Error() string {
+	return "no delegates"
+}
+
+func (e InvalidAuthority) Error() string {
+	return fmt.Sprintf("invalid authority %q", e.Authority)
+}
+
+func (e InvalidBlockSize) Error() string {
+	return fmt.Sprintf("invalid block size exponent %d", e.SZX)
+}
+
+func (e InvalidBlockNum) Error() string {
+	return fmt.Sprintf("invalid block number %d, max is %d", e.Num, MaxBlockNum)
+}
+
+func (e ETagChangedMidTransfer) Error() string {
+	return fmt.Sprintf("etag changed at block %d: expected %x, got %x", e.Num, e.Expected, e.Actual)
+}
+
+func (e SizeMismatch) Error() string {
+	return fmt.Sprintf("%s mismatch: expected %d, got %d", e.Option.Name, e.Expected, e.Actual)
+}
+
+func (e NonContiguousBlock) Error() string {
+	return fmt.Sprintf("non-contiguous block: expected offset %d, got %d", e.Expected, e.Actual)
+}
+
+func (e BlockSizeChangedUpward) Error() string {
+	return fmt.Sprintf("block size changed upward from %d to %d", e.Previous, e.Size)
+}
+
+func (e CannotFit) Error() string {
+	return fmt.Sprintf("response cannot fit %d bytes, smallest size is %d", e.Budget, e.Size)
+}
+
+func (e NotIdempotent) Error() string {
+	return fmt.Sprintf("method %s is not idempotent", e.Method)
+}
+
+func (e ResponseRejected) Error() string {
+	return fmt.Sprintf("response %s from %s rejected", e.Code, e.Addr)
+}
+
+func (e ExchangeReset) Error() string {
+	return fmt.Sprintf("exchange reset by %s", e.Addr)
+}
+
+func (e ExchangeEvicted) Error() string {
+	return fmt.Sprintf("exchange with %s evicted: %s", e.Addr, e.Reason)
+}
+
+func (e ReceiveQueueFull) Error() string {
+	return fmt.Sprintf("receive queue full, dropped message %#04x from %s", e.ID, e.Addr)
+}
+
+func (e NoAddresses) Error() string {
+	return "no addresses"
+}
+
+func (e ResponseTimeout) Error() string {
+	return fmt.Sprintf("no response from %s within %s", e.Addr, e.Timeout)
+}
+
+func (e UnknownPeer) Error() string {
+	if e.Peer == "" {
+		return "unknown peer"
+	}
+
+	return fmt.Sprintf("unknown peer %s", e.Peer)
+}
+
+func (e UnknownObservation) Error() string {
+	return fmt.Sprintf("no observation with token %x", e.Token)
+}
+
+func (e ObservationCanceled) Error() string {
+	return fmt.Sprintf("observation with token %x canceled", e.Token)
+}
+
+func (e NoDTLSTransport) Error() string {
+	return fmt.Sprintf("no DTLS transport configured for %s", e.URL)
+}
+
+func (e MessageIDsExhausted) Error() string {
+	return fmt.Sprintf("all %d message IDs are in flight", MessageIDCount)
+}
+
+func (e MalformedPayloadMarker) Error() string {
+	if e.Byte == PayloadMarker {
+		return "payload marker followed by empty payload"
+	}
+
+	return fmt.Sprintf("expected payload marker %#02x, got %#02x", PayloadMarker, e.Byte)
+}
+
+func (e OptionError) Error() string {
+	return fmt.Sprintf("option %d (code %d): %v", e.Index, e.Code, e.Cause)
+}
+
+func (e OptionError) Unwrap() error {
+	return e.Cause
+}
+
+func (e UnrecognizedOption) Error() string {
+	return fmt.Sprintf("unrecognized critical option %d", e.Code)
+}
+
+func (e UnknownMediaType) Error() string {
+	return fmt.Sprintf("unknown media type %d", e.Code)
+}
+
+func (e MalformedCBOR) Error() string {
+	return fmt.Sprintf("malformed CBOR at offset %d: %s", e.Offset, e.Reason)
+}
+
+func (e UnsupportedCBORType) Error() string {
+	return fmt.Sprintf("unsupported CBOR value type %v", e.Type)
+}
+
+func (e TokenTooShort) Error() string {
+	return fmt.Sprintf("token length %d shorter than minimum %d", e.Length, e.MinLength)
+}
+
+func (e MalformedLinkFormat) Error() string {
+	return fmt.Sprintf("malformed link format at offset %d: %s", e.Offset, e.Reason)
+}
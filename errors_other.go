@@ -0,0 +1,17 @@
+//go:build !unix
+
+package coap
+
+// IsTransientError reports whether a write error is likely to succeed when retried shortly.
+//
+// Transient errors are not classified on this platform.
+func IsTransientError(_ error) bool {
+	return false
+}
+
+// isHostUnreachable reports whether the error indicates no route to the remote host.
+//
+// Host unreachable errors are not classified on this platform.
+func isHostUnreachable(_ error) bool {
+	return false
+}
@@ -1,6 +1,7 @@
 package coap
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 )
@@ -17,62 +18,62 @@ func TestErrorStringMethods(t *testing.T) {
 					Expected: 5,
 				},
 			},
-			want: "unmarshal error at offset 10: truncated input, expected 5 bytes",
+			want: "coap: unmarshal error at offset 10: coap: truncated input, expected 5 bytes",
 		},
 		{
 			err: UnsupportedVersion{
 				Version: 2,
 			},
-			want: "unsupported version 2, expected 1",
+			want: "coap: unsupported version 2, expected 1",
 		},
 		{
 			err: InvalidType{
 				Type: 3,
 			},
-			want: "invalid type RST",
+			want: "coap: invalid type RST",
 		},
 		{
 			err: InvalidCode{
 				Code: 5,
 			},
-			want: "invalid code 0.05",
+			want: "coap: invalid code 0.05",
 		},
 		{
 			err: UnsupportedTokenLength{
 				Length: 9,
 			},
-			want: "unsupported token length 9, max is 8",
+			want: "coap: unsupported token length 9, max is 8",
 		},
 		{
 			err:  UnsupportedExtendError{},
-			want: "unsupported extend value",
+			want: "coap: unsupported extend value",
 		},
 		{
 			err: MessageTooLong{
 				Limit:  1024,
 				Length: 2048,
 			},
-			want: "message too long, max 1024 bytes, got 2048 bytes",
+			want: "coap: message too long, max 1024 bytes, got 2048 bytes",
 		},
 		{
 			err: PayloadTooLong{
 				Limit:  512,
 				Length: 1024,
 			},
-			want: "payload too long, max 512 bytes, got 1024 bytes",
+			want: "coap: payload too long, max 512 bytes, got 1024 bytes",
 		},
 		{
 			err: TooManyOptions{
 				Limit:  10,
 				Length: 15,
 			},
-			want: "too many options, max 10, got 15",
+			want: "coap: too many options, max 10, got 15",
 		},
 		{
 			err: TruncatedError{
 				Expected: 8,
 			},
-			want: "truncated input, expected 8 bytes",
+			want: "coap: truncated input, expected 8 bytes",
 		},
 		{
 			err: OptionNotFound{
@@ -119,6 +120,13 @@ func TestErrorStringMethods(t *testing.T) {
 			},
 			want: `option "Uri-Host" is not repeateable`,
 		},
+		{
+			err: InvalidOptionDelta{
+				Code: 11,
+				Prev: 12,
+			},
+			want: "option code 11 precedes previous code 12",
+		},
 	}
 
 	for _, test := range tests {
@@ -131,3 +139,75 @@ func TestErrorStringMethods(t *testing.T) {
 		})
 	}
 }
+
+func TestResponseCodeForError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want ResponseCode
+	}{
+		{
+			err: UnmarshalError{
+				Cause: TruncatedError{
+					Expected: 4,
+				},
+			},
+			want: BadRequest,
+		},
+		{
+			err: UnmarshalError{
+				Cause: UnsupportedExtendError{},
+			},
+			want: BadRequest,
+		},
+		{
+			err: InvalidOptionValueLength{
+				OptionDef: URIPort,
+				Length:    3,
+			},
+			want: BadRequest,
+		},
+		{
+			err: UnmarshalError{
+				Cause: OptionNotRepeateable{
+					OptionDef: URIHost,
+				},
+			},
+			want: BadOption,
+		},
+		{
+			err: MessageTooLong{
+				Limit:  10,
+				Length: 20,
+			},
+			want: RequestEntityTooLarge,
+		},
+		{
+			err: PayloadTooLong{
+				Limit:  10,
+				Length: 20,
+			},
+			want: RequestEntityTooLarge,
+		},
+		{
+			err: UnmarshalError{
+				Cause: TooManyOptions{
+					Limit: 1,
+				},
+			},
+			want: RequestEntityTooLarge,
+		},
+		{
+			err:  errors.New("unexpected"),
+			want: InternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.err.Error(), func(t *testing.T) {
+			got := ResponseCodeForError(test.err)
+			if got != test.want {
+				t.Errorf("ResponseCodeForError() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package coap
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsTransientError reports whether a write error is likely to succeed when retried shortly.
+//
+// Covers full socket buffers and unresolved neighbors.
+func IsTransientError(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EHOSTUNREACH)
+}
+
+// isHostUnreachable reports whether the error indicates no route to the remote host.
+func isHostUnreachable(err error) bool {
+	return errors.Is(err, syscall.EHOSTUNREACH)
+}
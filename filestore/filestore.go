@@ -0,0 +1,154 @@
+// Package filestore provides a file-backed coap.RetransmitStore, so that pending Confirmable messages
+// survive a process restart.
+package filestore
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/uramaki-io/coap"
+)
+
+// Store is a coap.RetransmitStore keeping pending messages in a JSON file.
+//
+// The file is read on first use and rewritten atomically on every change, which suits low message
+// rates such as commands queued for sleepy devices. A Store must not be shared by processes.
+type Store struct {
+	path string
+
+	mtx    sync.Mutex
+	ops    map[coap.MessageID]coap.SerializedWriteOp
+	loaded bool
+}
+
+// New instantiates a new Store persisting to the file at path, the file is created on first save.
+func New(path string) *Store {
+	return &Store{
+		path: path,
+	}
+}
+
+// Save implements coap.RetransmitStore, replacing a message with the same ID.
+func (s *Store) Save(op coap.SerializedWriteOp) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err := s.load()
+	if err != nil {
+		return err
+	}
+
+	s.ops[op.ID] = op
+
+	return s.write()
+}
+
+// Delete implements coap.RetransmitStore, deleting an unknown ID is not an error.
+func (s *Store) Delete(id coap.MessageID) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err := s.load()
+	if err != nil {
+		return err
+	}
+
+	_, ok := s.ops[id]
+	if !ok {
+		return nil
+	}
+
+	delete(s.ops, id)
+
+	return s.write()
+}
+
+// Load implements coap.RetransmitStore, messages are returned in order of their first transmission.
+func (s *Store) Load() ([]coap.SerializedWriteOp, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.sorted(), nil
+}
+
+// load reads the file unless already read, a missing file holds no messages.
+func (s *Store) load() error {
+	if s.loaded {
+		return nil
+	}
+
+	s.ops = map[coap.MessageID]coap.SerializedWriteOp{}
+
+	data, err := os.ReadFile(s.path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		s.loaded = true
+		return nil
+	case err != nil:
+		return err
+	}
+
+	ops := []coap.SerializedWriteOp{}
+	err = json.Unmarshal(data, &ops)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		s.ops[op.ID] = op
+	}
+
+	s.loaded = true
+
+	return nil
+}
+
+// write replaces the file with the current messages.
+func (s *Store) write() error {
+	data, err := json.Marshal(s.sorted())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *Store) sorted() []coap.SerializedWriteOp {
+	return slices.SortedFunc(maps.Values(s.ops), func(a, b coap.SerializedWriteOp) int {
+		return cmp.Or(a.Start.Compare(b.Start), cmp.Compare(a.ID, b.ID))
+	})
+}
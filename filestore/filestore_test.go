@@ -0,0 +1,166 @@
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/uramaki-io/coap"
+	"github.com/uramaki-io/coap/coaptest"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.json")
+	start := time.Unix(1700000000, 0).UTC()
+
+	first := coap.SerializedWriteOp{
+		ID:         0x4242,
+		Message:    []byte{0x44, 0x01, 0x42, 0x42, 0xde, 0xad, 0xbe, 0xef},
+		Network:    "udp",
+		Addr:       "192.0.2.1:5683",
+		Start:      start,
+		Retransmit: 2,
+		Timeout:    8 * time.Second,
+		Next:       start.Add(14 * time.Second),
+	}
+	second := first
+	second.ID = 0x4243
+	second.Start = start.Add(time.Second)
+
+	store := New(path)
+
+	ops, err := store.Load()
+	if err != nil {
+		t.Fatal("load missing file:", err)
+	}
+
+	if len(ops) != 0 {
+		t.Fatalf("loaded %d messages from missing file", len(ops))
+	}
+
+	for _, op := range []coap.SerializedWriteOp{second, first} {
+		err = store.Save(op)
+		if err != nil {
+			t.Fatal("save:", err)
+		}
+	}
+
+	// restart
+	ops, err = New(path).Load()
+	if err != nil {
+		t.Fatal("load:", err)
+	}
+
+	diff := cmp.Diff([]coap.SerializedWriteOp{first, second}, ops)
+	if diff != "" {
+		t.Errorf("messages mismatch (-want +got):\n%s", diff)
+	}
+
+	err = store.Delete(first.ID)
+	if err != nil {
+		t.Fatal("delete:", err)
+	}
+
+	err = store.Delete(first.ID)
+	if err != nil {
+		t.Fatal("delete unknown:", err)
+	}
+
+	ops, err = New(path).Load()
+	if err != nil {
+		t.Fatal("load:", err)
+	}
+
+	diff = cmp.Diff([]coap.SerializedWriteOp{second}, ops)
+	if diff != "" {
+		t.Errorf("messages mismatch (-want +got):\n%s", diff)
+	}
+
+	err = os.WriteFile(path, []byte("{"), 0o600)
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	_, err = New(path).Load()
+	if err == nil {
+		t.Error("expected error loading corrupt file")
+	}
+}
+
+// TestStoreConnRestart recreates a Conn around a pending message and checks that it resumes retransmission.
+func TestStoreConnRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.json")
+	clock := coaptest.NewFakeClock(time.Unix(0, 0))
+	opts := coap.ConnOptions{
+		RetransmitOptions: coap.RetransmitOptions{
+			ACKTimeout:  10 * time.Millisecond,
+			Store:       New(path),
+			ResolveAddr: coaptest.ResolveAddr,
+		},
+		Clock: clock,
+	}
+
+	a, b := coaptest.Pipe()
+	a.DropEvery(1)
+	client := coap.NewConn(a, opts)
+
+	msg := &coap.Message{
+		Header: coap.Header{
+			Version: coap.ProtocolVersion,
+			Type:    coap.Confirmable,
+			Code:    coap.Code(coap.POST),
+			ID:      0x4242,
+			Token:   coap.Token{0x01},
+		},
+		Payload: []byte("command"),
+	}
+
+	err := client.Write(msg, b.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	err = client.Close()
+	if err != nil {
+		t.Fatal("close:", err)
+	}
+
+	// restarted process with a fresh store instance reading the same file
+	opts.Store = New(path)
+	a, b = coaptest.Pipe()
+	client = coap.NewConn(a, opts)
+	defer client.Close()
+
+	if pending := client.Stats().PendingExchanges; pending != 1 {
+		t.Fatalf("restored %d pending exchanges, want 1", pending)
+	}
+
+	server := coap.NewConn(b, coap.ConnOptions{})
+	defer server.Close()
+
+	received := make(chan *coap.Message, 1)
+	go func() {
+		msg := &coap.Message{}
+		_, err := server.Read(msg)
+		if err == nil {
+			received <- msg
+		}
+	}()
+
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case <-deadline:
+			t.Fatal("restored message not retransmitted")
+		case got := <-received:
+			if got.ID != msg.ID || string(got.Payload) != "command" {
+				t.Errorf("received %#x %q, want %#x %q", got.ID, got.Payload, msg.ID, "command")
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(opts.ACKTimeout)
+		}
+	}
+}
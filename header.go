@@ -5,10 +5,13 @@
 package coap
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"hash/fnv"
+	"net"
 	"slices"
 	"sync/atomic"
 )
@@ -88,6 +91,18 @@ func MessageIDSequence(start MessageID) MessageIDSource {
 	}
 }
 
+// MessageIDSequenceRandom returns a MessageIDSequence starting from a cryptographically random value.
+//
+// Random initial value avoids message ID collisions across restarts.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-4.4
+func MessageIDSequenceRandom() MessageIDSource {
+	var start [2]byte
+	_, _ = rand.Read(start[:]) // rand.Read never returns an error
+
+	return MessageIDSequence(MessageID(binary.BigEndian.Uint16(start[:])))
+}
+
 // RandTokenSource returns a TokenSource that generates cryptographically random tokens of the length between 1-8 bytes.
 //
 // If the length is 0, it defaults to 4 bytes.
@@ -108,6 +123,87 @@ func RandTokenSource(length uint) TokenSource {
 	}
 }
 
+// DeterministicTokenSource returns a function deriving a token of the length between 1-8 bytes
+// from the request method, URI, options forming Options.CacheKey and Payload.
+//
+// Retries of the same request get the same token, so that clients can dedupe them at the application layer.
+// Body is not read, requests differing only in Body get the same token.
+//
+// Deterministic tokens are predictable by an off-path attacker and do not provide anti-spoofing entropy,
+// use them only where responses are otherwise protected.
+//
+// Fields which cannot be encoded, such as a Host longer than 255 bytes, are left out of the derivation.
+//
+// If the length is 0, it defaults to 4 bytes.
+// If the length is greater than 8, it defaults to 8 bytes.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.3.1
+func DeterministicTokenSource(length uint) func(*Request) Token {
+	switch {
+	case length == 0:
+		length = TokenLength
+	case length > TokenMaxLength:
+		length = TokenMaxLength
+	}
+
+	return func(r *Request) Token {
+		options, _ := r.options()
+
+		data := []byte{byte(r.Method)}
+		data = options.CacheKey(data)
+		data = append(data, PayloadMarker)
+		data = append(data, r.Payload...)
+
+		sum := sha256.Sum256(data)
+
+		return Token(sum[:length])
+	}
+}
+
+// PRFTokenSource derives tokens from a keyed pseudorandom function of the destination and a sequence
+// number, HMAC-SHA256 truncated to the token length. Tokens are unpredictable without the key, yet
+// reproducible from the key, destination and sequence number, such as when debugging captured traffic.
+//
+// https://datatracker.ietf.org/doc/html/rfc9175#section-4
+type PRFTokenSource struct {
+	key      []byte
+	length   uint
+	sequence atomic.Uint64
+}
+
+// NewPRFTokenSource instantiates a new PRFTokenSource with the key deriving tokens of the length between 1-8 bytes.
+//
+// If the length is 0, it defaults to 4 bytes.
+// If the length is greater than 8, it defaults to 8 bytes.
+func NewPRFTokenSource(key []byte, length uint) *PRFTokenSource {
+	switch {
+	case length == 0:
+		length = TokenLength
+	case length > TokenMaxLength:
+		length = TokenMaxLength
+	}
+
+	return &PRFTokenSource{
+		key:    slices.Clone(key),
+		length: length,
+	}
+}
+
+// Token returns the token for the destination with the next sequence number, starting at 0.
+// Suitable as TokenPolicy.Derive.
+func (s *PRFTokenSource) Token(addr net.Addr) Token {
+	return s.TokenAt(addr, s.sequence.Add(1)-1)
+}
+
+// TokenAt returns the token for the destination with the sequence number.
+func (s *PRFTokenSource) TokenAt(addr net.Addr, sequence uint64) Token {
+	mac := hmac.New(sha256.New, s.key)
+	_, _ = mac.Write([]byte(addr.String())) // hash.Hash.Write never returns an error
+	_, _ = mac.Write(binary.BigEndian.AppendUint64([]byte{0x00}, sequence))
+
+	return Token(mac.Sum(nil)[:s.length])
+}
+
 // EncodeExtend encodes a uint16 value as an extended delta or length value in the CoAP header format.
 //
 // Returns the encoded header byte and the updated data slice.
@@ -241,6 +337,40 @@ func (c Code) Detail() uint8 {
 	return uint8(c & 0x1f)
 }
 
+// IsEmpty indicates the empty message code 0.00.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-4.1
+func (c Code) IsEmpty() bool {
+	return c == 0
+}
+
+// IsRequest indicates a request method code 0.01-0.31.
+//
+// Unassigned methods are accepted so that servers can reply with MethodNotAllowed or NotImplemented.
+func (c Code) IsRequest() bool {
+	return c.Class() == 0 && c.Detail() != 0
+}
+
+// IsResponse indicates a response code of class 2-5.
+//
+// Class 1 and 6-7 are reserved and class 7 is used by signaling codes.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-12.1
+func (c Code) IsResponse() bool {
+	return c.Class() >= 2 && c.Class() <= 5
+}
+
+// PayloadAllowed indicates whether a message with the code may carry a payload.
+//
+// Empty messages and 2.03 Valid responses must not carry a payload.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-4.1
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.9.1.3
+func (c Code) PayloadAllowed() bool {
+	return !c.IsEmpty() && c != Code(Valid)
+}
+
 // String returns a string representation of the Code.
 //
 // https://datatracker.ietf.org/doc/html/rfc7252#section-12.1
@@ -1,7 +1,10 @@
 package coap
 
 import (
+	"bytes"
 	"fmt"
+	"net"
+	"slices"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -99,6 +102,40 @@ func TestCode(t *testing.T) {
 	}
 }
 
+func TestCodeKind(t *testing.T) {
+	tests := []struct {
+		code     Code
+		empty    bool
+		request  bool
+		response bool
+	}{
+		{code: 0x00, empty: true},
+		{code: Code(GET), request: true},
+		{code: 0x1f, request: true},
+		{code: 0x21},
+		{code: Code(Created), response: true},
+		{code: Code(ProxyingNotSupported), response: true},
+		{code: 0xc0},
+		{code: 0xe1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code.String(), func(t *testing.T) {
+			if got := test.code.IsEmpty(); got != test.empty {
+				t.Errorf("IsEmpty() = %v, want %v", got, test.empty)
+			}
+
+			if got := test.code.IsRequest(); got != test.request {
+				t.Errorf("IsRequest() = %v, want %v", got, test.request)
+			}
+
+			if got := test.code.IsResponse(); got != test.response {
+				t.Errorf("IsResponse() = %v, want %v", got, test.response)
+			}
+		})
+	}
+}
+
 func TestTypeString(t *testing.T) {
 	got := Confirmable.String()
 	want := "CON"
@@ -142,6 +179,115 @@ func TestRandTokenSource(t *testing.T) {
 	}
 }
 
+func TestDeterministicTokenSource(t *testing.T) {
+	size := uint32(1024)
+	base := Request{
+		Method:  GET,
+		Path:    "/sensors/temp",
+		Query:   []string{"unit=c"},
+		Payload: []byte("x"),
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *Request)
+		equal  bool
+	}{
+		{
+			name:   "retry",
+			modify: func(r *Request) { r.MessageID = 0x1234; r.Token = Token{0x01} },
+			equal:  true,
+		},
+		{
+			name: "path as options",
+			modify: func(r *Request) {
+				r.Path = ""
+				Must(r.Options.SetAllString(URIPath, slices.Values([]string{"sensors", "temp"})))
+			},
+			equal: true,
+		},
+		{
+			name:   "no cache key option",
+			modify: func(r *Request) { r.Size1 = &size },
+			equal:  true,
+		},
+		{
+			name:   "method",
+			modify: func(r *Request) { r.Method = DELETE },
+		},
+		{
+			name:   "path",
+			modify: func(r *Request) { r.Path = "/sensors/humidity" },
+		},
+		{
+			name:   "query",
+			modify: func(r *Request) { r.Query = []string{"unit=f"} },
+		},
+		{
+			name:   "payload",
+			modify: func(r *Request) { r.Payload = []byte("y") },
+		},
+	}
+
+	src := DeterministicTokenSource(0)
+	expect := src(&base)
+	if len(expect) != TokenLength {
+		t.Fatalf("DeterministicTokenSource(0) returned token of length %d, want %d", len(expect), TokenLength)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := base
+			req.Options = slices.Clone(base.Options)
+			test.modify(&req)
+
+			token := src(&req)
+			if bytes.Equal(token, expect) != test.equal {
+				t.Errorf("token %x, base token %x, want equal %v", token, expect, test.equal)
+			}
+		})
+	}
+
+	long := DeterministicTokenSource(20)(&base)
+	if len(long) != TokenMaxLength {
+		t.Errorf("DeterministicTokenSource(20) returned token of length %d, want %d", len(long), TokenMaxLength)
+	}
+}
+
+func TestPRFTokenSource(t *testing.T) {
+	first := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: DefaultPort}
+	second := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: DefaultPort}
+
+	src := NewPRFTokenSource([]byte("secret"), 8)
+
+	expect := []Token{
+		{0x8f, 0x9e, 0xc7, 0x57, 0xfb, 0x37, 0x70, 0xc8},
+		{0x87, 0x80, 0x67, 0x2c, 0xa0, 0xcd, 0xab, 0x32},
+	}
+	for sequence, token := range expect {
+		diff := cmp.Diff(token, src.Token(first))
+		if diff != "" {
+			t.Errorf("sequence %d token mismatch (-want +got):\n%s", sequence, diff)
+		}
+	}
+
+	// reproducible from the key, destination and sequence number
+	diff := cmp.Diff(expect[1], NewPRFTokenSource([]byte("secret"), 8).TokenAt(first, 1))
+	if diff != "" {
+		t.Errorf("reproduced token mismatch (-want +got):\n%s", diff)
+	}
+
+	diff = cmp.Diff(Token{0x36, 0x8d, 0xbc, 0xfa}, NewPRFTokenSource([]byte("secret"), 0).TokenAt(second, 0))
+	if diff != "" {
+		t.Errorf("other destination token mismatch (-want +got):\n%s", diff)
+	}
+
+	other := NewPRFTokenSource([]byte("other"), 8).TokenAt(first, 0)
+	if bytes.Equal(other, expect[0]) {
+		t.Error("tokens of different keys are equal")
+	}
+}
+
 func TestMessageIDSequence(t *testing.T) {
 	start := MessageID(100)
 	seq := MessageIDSequence(start)
@@ -172,3 +318,17 @@ func TestMessageIDSequence(t *testing.T) {
 		t.Errorf("Expected 0x0001, got %04x", id3)
 	}
 }
+
+func TestMessageIDSequenceRandom(t *testing.T) {
+	seq := MessageIDSequenceRandom()
+
+	prev := seq()
+	for range 5 {
+		got := seq()
+		if got != prev+1 {
+			t.Errorf("MessageIDSequenceRandom: got %d, want %d", got, prev+1)
+		}
+
+		prev = got
+	}
+}
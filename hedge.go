@@ -0,0 +1,217 @@
+package coap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// HedgeOptions configures Conn.Hedge.
+type HedgeOptions struct {
+	// Delay is the time to wait for an accepted response before the request is also sent to the next address,
+	// measured by the Clock.
+	Delay time.Duration
+
+	// Accept reports whether the response is the result of hedging, defaults to 2.xx Success responses.
+	//
+	// Responses which are not accepted fail their branch and the request is sent to the next address immediately.
+	Accept func(resp *Response) bool
+
+	// Timeout is the time a NonConfirmable copy of the request awaits a response before it fails with
+	// ResponseTimeout, measured by the Clock, defaults to MaxTransmitWait.
+	Timeout time.Duration
+
+	// AllowUnsafe allows hedging requests with methods which are not idempotent, such as POST.
+	AllowUnsafe bool
+}
+
+// hedgeBranch is a copy of the request sent to one of the addresses.
+type hedgeBranch struct {
+	msg  Message
+	call *clientCall
+}
+
+// Hedge sends the request to the first address and, if no accepted response is received within the delay,
+// also to the next one, returning the first accepted response of any of them.
+//
+// Each copy of the request gets its own MessageID and Token like Do, so that responses are matched to
+// the address the copy was sent to. Once Hedge returns, copies still awaiting acknowledgement are removed
+// from the retransmit queue instead of running to MaxTransmitWait.
+//
+// Returns NoAddresses if addrs is empty.
+//
+// Returns NotIdempotent if the method is not idempotent and AllowUnsafe is not set.
+//
+// Returns the errors of all copies joined with errors.Join if the request was sent to all addresses and
+// all copies failed to be sent, were reset with ExchangeReset, failed by the error ending their retransmission,
+// were rejected with ResponseRejected or timed out with ResponseTimeout, or the context is done.
+// A copy failing to be sent does not end copies sent before, which keep awaiting their responses.
+func (c *Conn) Hedge(ctx context.Context, req *Request, addrs []net.Addr, opts HedgeOptions) (GatheredResponse, error) {
+	if len(addrs) == 0 {
+		return GatheredResponse{}, NoAddresses{}
+	}
+
+	if !opts.AllowUnsafe && !req.Method.Idempotent() {
+		return GatheredResponse{}, NotIdempotent{
+			Method: req.Method,
+		}
+	}
+
+	accept := opts.Accept
+	if accept == nil {
+		accept = func(resp *Response) bool {
+			return Code(resp.Code).Class() == 2
+		}
+	}
+
+	msg, err := req.message()
+	if err != nil {
+		return GatheredResponse{}, err
+	}
+
+	// each branch delivers a single result, so the channel never blocks the dispatcher
+	results := make(chan callResult, len(addrs))
+	branches := make([]*hedgeBranch, 0, len(addrs))
+	defer func() {
+		for _, branch := range branches {
+			c.unregister(&branch.msg, branch.call)
+			if branch.msg.Type == Confirmable {
+				c.cancel(branch.msg.ID)
+			}
+		}
+	}()
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = c.opts.MaxTransmitWait
+	}
+
+	// done stops the timeouts of NonConfirmable copies once Hedge returns
+	done := make(chan struct{})
+	defer close(done)
+
+	timer := c.opts.Clock.NewTimer(opts.Delay)
+	defer timer.Stop()
+
+	// hedge sends the request to the next address and restarts the delay
+	next := 0
+	hedge := func() error {
+		branch := &hedgeBranch{
+			msg: msg,
+			call: &clientCall{
+				results: results,
+			},
+		}
+		branch.msg.ID = 0
+		branch.msg.Token = nil
+
+		addr := addrs[next]
+		next++
+
+		err := c.register(&branch.msg, addr, branch.call)
+		if err != nil {
+			return err
+		}
+		branches = append(branches, branch)
+
+		timer.Reset(opts.Delay)
+
+		err = c.send(ctx, &branch.msg, addr, branch.call)
+		if err != nil {
+			return err
+		}
+
+		// Confirmable copies fail by the retransmit queue once MaxTransmitWait passes
+		if branch.msg.Type != Confirmable {
+			expiry := c.opts.Clock.NewTimer(timeout)
+			go c.expire(&branch.msg, expiry, done, ResponseTimeout{
+				Addr:    addr,
+				Timeout: timeout,
+			})
+		}
+
+		return nil
+	}
+
+	// advance hedges to the next address, a copy failing to be sent fails its branch and the address
+	// after it is tried at once, while copies sent before keep awaiting their responses
+	errs := []error{}
+	advance := func() {
+		for next < len(addrs) {
+			err := hedge()
+			if err == nil {
+				return
+			}
+
+			errs = append(errs, err)
+		}
+	}
+
+	advance()
+	for {
+		// every branch failed and there is no address left to hedge to
+		if len(errs) == next && next == len(addrs) {
+			return GatheredResponse{}, errors.Join(errs...)
+		}
+
+		// the delay only matters while there is an address left to hedge to
+		var delay <-chan time.Time
+		if next < len(addrs) {
+			delay = timer.C()
+		}
+
+		select {
+		case <-ctx.Done():
+			return GatheredResponse{}, errors.Join(append(errs, ctx.Err())...)
+		case <-delay:
+			advance()
+		case result := <-results:
+			resp, err := c.response(result)
+			if err == nil && accept(resp) {
+				return GatheredResponse{
+					Resp: resp,
+					From: result.from,
+				}, nil
+			}
+
+			if err == nil {
+				err = ResponseRejected{
+					Addr: result.from,
+					Code: resp.Code,
+				}
+			}
+
+			errs = append(errs, err)
+
+			// hedge immediately instead of waiting for the delay
+			advance()
+		}
+	}
+}
+
+// expire fails the call of the message with err once the timer fires, unless done is closed first.
+func (c *Conn) expire(msg *Message, timer Timer, done <-chan struct{}, err error) {
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C():
+		c.fail(msg, err)
+	}
+}
+
+// Hedge sends the request with Conn.Hedge to the addresses, returning the first accepted response.
+//
+// Returns the error of creating the Conn.
+//
+// Returns errors of Conn.Hedge.
+func (c *Client) Hedge(ctx context.Context, req *Request, addrs []net.Addr, opts HedgeOptions) (GatheredResponse, error) {
+	conn, err := c.acquire()
+	if err != nil {
+		return GatheredResponse{}, err
+	}
+	defer c.release(conn)
+
+	return conn.Hedge(ctx, req, addrs, opts)
+}
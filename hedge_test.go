@@ -0,0 +1,406 @@
+package coap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// hedgeServer serves the handler on a local UDP address and records when the request arrived.
+func hedgeServer(t *testing.T, handler HandlerFunc) (net.Addr, <-chan time.Time) {
+	t.Helper()
+
+	conn, err := ListenPacket(context.Background(), "udp", "127.0.0.1:0", testConnOptions())
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	received := make(chan time.Time, 8)
+	server := NewServer(conn, HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Request) {
+		received <- time.Now()
+		handler(ctx, w, req)
+	}), ServerOptions{})
+
+	go func() {
+		_ = server.Serve(context.Background())
+	}()
+
+	return conn.LocalAddr(), received
+}
+
+func hedgeClient(t *testing.T) *Client {
+	t.Helper()
+
+	// the Conn over PacketConn is kept open, so that its pending exchanges can be checked
+	client := &Client{
+		ConnOptions: testConnOptions(),
+		PacketConn:  listenPacket(t),
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return client
+}
+
+// waitNoPending waits for the retransmit loop to tear down exchanges cancelled by Hedge.
+func waitNoPending(t *testing.T, conn *Conn) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for conn.Stats().PendingExchanges != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d pending exchanges after hedge, want 0", conn.Stats().PendingExchanges)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func hedgeRequest() *Request {
+	return &Request{
+		Type:   Confirmable,
+		Method: GET,
+		Path:   "/sensors/temp",
+	}
+}
+
+func TestClientHedge(t *testing.T) {
+	delay := 50 * time.Millisecond
+
+	// slow server never responds, the request is acknowledged after PiggybackDeadline
+	slow, slowReceived := hedgeServer(t, func(ctx context.Context, _ ResponseWriter, _ *Request) {
+		<-ctx.Done()
+	})
+
+	fast, fastReceived := hedgeServer(t, func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code:    Content,
+			Payload: []byte("fast"),
+		})
+	})
+
+	client := hedgeClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	got, err := client.Hedge(ctx, hedgeRequest(), []net.Addr{slow, fast}, HedgeOptions{
+		Delay: delay,
+	})
+	if err != nil {
+		t.Fatal("hedge:", err)
+	}
+
+	if got.From.String() != fast.String() || string(got.Resp.Payload) != "fast" {
+		t.Errorf("response %s from %s, want fast from %s", got.Resp.Payload, got.From, fast)
+	}
+
+	<-slowReceived
+	hedged := <-fastReceived
+	if hedged.Sub(start) < delay {
+		t.Errorf("hedged after %s, want at least %s", hedged.Sub(start), delay)
+	}
+
+	waitNoPending(t, client.conn)
+}
+
+func TestClientHedgeFirstResponds(t *testing.T) {
+	primary, _ := hedgeServer(t, func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code: Content,
+		})
+	})
+
+	secondary, secondaryReceived := hedgeServer(t, func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code: Content,
+		})
+	})
+
+	client := hedgeClient(t)
+
+	got, err := client.Hedge(context.Background(), hedgeRequest(), []net.Addr{primary, secondary}, HedgeOptions{
+		Delay: time.Second,
+	})
+	if err != nil {
+		t.Fatal("hedge:", err)
+	}
+
+	if got.From.String() != primary.String() {
+		t.Errorf("response from %s, want %s", got.From, primary)
+	}
+
+	select {
+	case <-secondaryReceived:
+		t.Error("expected request not to be hedged")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientHedgeFailed(t *testing.T) {
+	notFound, _ := hedgeServer(t, func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code: NotFound,
+		})
+	})
+
+	unavailable, _ := hedgeServer(t, func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code: ServiceUnavailable,
+		})
+	})
+
+	client := hedgeClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.Hedge(ctx, hedgeRequest(), []net.Addr{notFound, unavailable}, HedgeOptions{
+		Delay: time.Hour,
+	})
+
+	// the rejected response hedges without waiting for the delay
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("hedge took %s, want immediate hedge on rejected response", time.Since(start))
+	}
+
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("error = %v, want joined errors", err)
+	}
+
+	want := []error{
+		ResponseRejected{
+			Addr: notFound,
+			Code: NotFound,
+		},
+		ResponseRejected{
+			Addr: unavailable,
+			Code: ServiceUnavailable,
+		},
+	}
+
+	diff := cmp.Diff(want, joined.Unwrap(), cmp.Comparer(func(a, b net.Addr) bool {
+		return a.String() == b.String()
+	}))
+	if diff != "" {
+		t.Errorf("errors mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// unreachableConn fails writes to the address.
+type unreachableConn struct {
+	net.PacketConn
+	addr net.Addr
+}
+
+func (c *unreachableConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addr.String() == c.addr.String() {
+		return 0, errUnreachable
+	}
+
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+var errUnreachable = errors.New("unreachable")
+
+func TestClientHedgeSendFailed(t *testing.T) {
+	// primary answers after the request is hedged to the unreachable secondary
+	primary, _ := hedgeServer(t, func(_ context.Context, w ResponseWriter, _ *Request) {
+		time.Sleep(100 * time.Millisecond)
+		_ = w.Write(&Response{
+			Code: Content,
+		})
+	})
+
+	secondary := listenPacket(t)
+	defer secondary.Close()
+
+	client := &Client{
+		ConnOptions: testConnOptions(),
+		PacketConn: &unreachableConn{
+			PacketConn: listenPacket(t),
+			addr:       secondary.LocalAddr(),
+		},
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	got, err := client.Hedge(ctx, hedgeRequest(), []net.Addr{primary, secondary.LocalAddr()}, HedgeOptions{
+		Delay: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("hedge:", err)
+	}
+
+	if got.From.String() != primary.String() {
+		t.Errorf("response from %s, want %s", got.From, primary)
+	}
+}
+
+func TestClientHedgeAllSendsFailed(t *testing.T) {
+	unreachable := listenPacket(t)
+	defer unreachable.Close()
+
+	client := &Client{
+		ConnOptions: testConnOptions(),
+		PacketConn: &unreachableConn{
+			PacketConn: listenPacket(t),
+			addr:       unreachable.LocalAddr(),
+		},
+	}
+	defer client.Close()
+
+	addrs := []net.Addr{unreachable.LocalAddr(), unreachable.LocalAddr()}
+	_, err := client.Hedge(context.Background(), hedgeRequest(), addrs, HedgeOptions{
+		Delay: time.Hour,
+	})
+
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(joined.Unwrap()) != len(addrs) {
+		t.Fatalf("error = %v, want %d joined errors", err, len(addrs))
+	}
+
+	for _, err := range joined.Unwrap() {
+		if !errors.Is(err, errUnreachable) {
+			t.Errorf("error = %v, want %v", err, errUnreachable)
+		}
+	}
+}
+
+func TestClientHedgeTimeout(t *testing.T) {
+	silent := func(ctx context.Context, _ ResponseWriter, _ *Request) {
+		<-ctx.Done()
+	}
+
+	primary, _ := hedgeServer(t, silent)
+	secondary, secondaryReceived := hedgeServer(t, silent)
+
+	client := hedgeClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := client.Hedge(ctx, hedgeRequest(), []net.Addr{primary, secondary}, HedgeOptions{
+		Delay: 10 * time.Millisecond,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+
+	select {
+	case <-secondaryReceived:
+	default:
+		t.Error("expected request to be hedged")
+	}
+
+	waitNoPending(t, client.conn)
+}
+
+func TestClientHedgeNotIdempotent(t *testing.T) {
+	a, b := newPipe()
+	client := &Client{
+		ConnOptions: testConnOptions(),
+		PacketConn:  a,
+	}
+	defer client.Close()
+
+	req := hedgeRequest()
+	req.Method = POST
+
+	_, err := client.Hedge(context.Background(), req, []net.Addr{b.LocalAddr()}, HedgeOptions{})
+	expectErr(t, err, NotIdempotent{
+		Method: POST,
+	})
+}
+
+func TestClientHedgeNoResponse(t *testing.T) {
+	tests := []struct {
+		name  string
+		typ   Type
+		check func(err error) bool
+	}{
+		{
+			name:  "confirmable",
+			typ:   Confirmable,
+			check: isError[RetransmitRetryLimit],
+		},
+		{
+			name:  "non-confirmable",
+			typ:   NonConfirmable,
+			check: isError[ResponseTimeout],
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// peers never acknowledge nor respond
+			addrs := []net.Addr{}
+			for range 2 {
+				peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Skip("listen:", err)
+				}
+				defer peer.Close()
+
+				addrs = append(addrs, peer.LocalAddr())
+			}
+
+			client := hedgeClient(t)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			req := hedgeRequest()
+			req.Type = test.typ
+
+			_, err := client.Hedge(ctx, req, addrs, HedgeOptions{
+				Delay:   10 * time.Millisecond,
+				Timeout: 50 * time.Millisecond,
+			})
+			if ctx.Err() != nil {
+				t.Fatal("hedge returned after context:", err)
+			}
+
+			joined, ok := err.(interface{ Unwrap() []error })
+			if !ok {
+				t.Fatalf("error = %v, want joined errors", err)
+			}
+
+			errs := joined.Unwrap()
+			if len(errs) != len(addrs) {
+				t.Fatalf("errors = %v, want one per address", errs)
+			}
+
+			for _, err := range errs {
+				if !test.check(err) {
+					t.Errorf("error = %v, want %s failure", err, test.name)
+				}
+			}
+		})
+	}
+}
+
+func TestClientHedgeNoAddresses(t *testing.T) {
+	a, _ := newPipe()
+	client := &Client{
+		ConnOptions: testConnOptions(),
+		PacketConn:  a,
+	}
+	defer client.Close()
+
+	_, err := client.Hedge(context.Background(), hedgeRequest(), nil, HedgeOptions{})
+	expectErr(t, err, NoAddresses{})
+}
@@ -0,0 +1,148 @@
+package coap
+
+import (
+	"context"
+	"errors"
+)
+
+// PeerIdentity is the authenticated identity of a peer, such as the PSK identity or the certificate
+// subject established by DTLS.
+type PeerIdentity struct {
+	// Subject identifies the principal.
+	Subject string
+
+	// Claims holds attributes of the principal used by authorization policies, such as roles.
+	Claims map[string]string
+}
+
+// IdentityResolver resolves the identity of a peer.
+//
+// Returns UnknownPeer if the peer has no identity, other errors are failures to resolve it.
+type IdentityResolver func(peer PeerID) (PeerIdentity, error)
+
+// AuthorizationPolicy decides whether the identity may make the request, a non-nil error denies it.
+type AuthorizationPolicy func(identity PeerIdentity, r *Request) error
+
+// Identity returns the identity of the peer that sent the request being handled, resolved by
+// ConnOptions.IdentityResolver on first use and cached in the PeerTable of the connection.
+//
+// Returns UnknownPeer if the peer has no identity or no IdentityResolver is configured.
+func Identity(ctx context.Context) (PeerIdentity, error) {
+	peer, ok := Peer(ctx)
+	if !ok {
+		return PeerIdentity{}, UnknownPeer{}
+	}
+
+	conn, ok := ctx.Value(connKey{}).(*Conn)
+	if !ok {
+		return PeerIdentity{}, UnknownPeer{
+			Peer: peer,
+		}
+	}
+
+	return conn.Identity(peer)
+}
+
+// Authorize returns a Handler serving requests permitted by the policy with next.
+//
+// Requests from peers without identity are answered with Unauthorized, requests denied by the policy
+// with Forbidden and the error message as diagnostic payload. Failures to resolve the identity are
+// answered with InternalServerError without diagnostic payload, as they are not the fault of the peer.
+//
+// The identity is available to next via Identity.
+func Authorize(policy AuthorizationPolicy, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+		identity, err := Identity(ctx)
+		switch {
+		case isError[UnknownPeer](err):
+			_ = w.Write(&Response{
+				Code:    Unauthorized,
+				Payload: []byte(err.Error()),
+			})
+			return
+		case err != nil:
+			_ = w.Write(&Response{
+				Code: InternalServerError,
+			})
+			return
+		}
+
+		err = policy(identity, r)
+		if err != nil {
+			_ = w.Write(&Response{
+				Code:    Forbidden,
+				Payload: []byte(err.Error()),
+			})
+			return
+		}
+
+		next.ServeCOAP(ctx, w, r)
+	})
+}
+
+// Identity returns the identity of the peer resolved by IdentityResolver, cached in the PeerTable
+// until revoked by RevokeIdentity or the peer is evicted.
+//
+// Failures to resolve are not cached, so they are retried on next use.
+//
+// Returns UnknownPeer if the peer has no identity or no IdentityResolver is configured.
+func (c *Conn) Identity(peer PeerID) (PeerIdentity, error) {
+	if c.opts.IdentityResolver == nil {
+		return PeerIdentity{}, UnknownPeer{
+			Peer: peer,
+		}
+	}
+
+	return c.peers.Identity(peer, c.opts.IdentityResolver)
+}
+
+// RevokeIdentity clears the cached identity of the peer, so that it is resolved again on next use.
+//
+// The budget of the peer is kept.
+func (c *Conn) RevokeIdentity(peer PeerID) {
+	c.peers.RevokeIdentity(peer)
+}
+
+// Identity returns the cached identity of the peer, resolving and caching it on first use.
+//
+// The resolver is called without holding the table lock, errors are not cached.
+func (t *PeerTable) Identity(peer PeerID, resolve IdentityResolver) (PeerIdentity, error) {
+	t.mtx.Lock()
+	state, ok := t.peers[peer]
+	if ok && state.identity != nil {
+		identity := *state.identity
+		t.mtx.Unlock()
+
+		return identity, nil
+	}
+	t.mtx.Unlock()
+
+	identity, err := resolve(peer)
+	if err != nil {
+		var unknown UnknownPeer
+		if errors.As(err, &unknown) && unknown.Peer == "" {
+			unknown.Peer = peer
+			err = unknown
+		}
+
+		return PeerIdentity{}, err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.peer(peer, t.clock.Now()).identity = &identity
+
+	return identity, nil
+}
+
+// RevokeIdentity clears the cached identity of the peer, keeping its budget.
+func (t *PeerTable) RevokeIdentity(peer PeerID) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	state, ok := t.peers[peer]
+	if ok {
+		state.identity = nil
+	}
+}
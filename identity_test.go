@@ -0,0 +1,197 @@
+package coap
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAuthorize(t *testing.T) {
+	admin := PeerIdentity{
+		Subject: "admin",
+		Claims: map[string]string{
+			"role": "admin",
+		},
+	}
+
+	reader := PeerIdentity{
+		Subject: "reader",
+		Claims: map[string]string{
+			"role": "reader",
+		},
+	}
+
+	policy := func(identity PeerIdentity, r *Request) error {
+		if r.Method != GET && identity.Claims["role"] != "admin" {
+			return errors.New("read only")
+		}
+
+		return nil
+	}
+
+	tests := []struct {
+		name     string
+		identity PeerIdentity
+		resolve  error
+		method   Method
+		code     ResponseCode
+		payload  string
+	}{
+		{
+			name:     "allowed",
+			identity: admin,
+			method:   PUT,
+			code:     Changed,
+			payload:  "admin",
+		},
+		{
+			name:     "denied",
+			identity: reader,
+			method:   PUT,
+			code:     Forbidden,
+			payload:  "read only",
+		},
+		{
+			name:    "unknown",
+			resolve: UnknownPeer{},
+			method:  GET,
+			code:    Unauthorized,
+		},
+		{
+			name:    "resolver failure",
+			resolve: errors.New("directory unavailable"),
+			method:  GET,
+			code:    InternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testConnOptions()
+			opts.IdentityResolver = func(_ PeerID) (PeerIdentity, error) {
+				return test.identity, test.resolve
+			}
+
+			handler := Authorize(policy, HandlerFunc(func(ctx context.Context, w ResponseWriter, _ *Request) {
+				identity, err := Identity(ctx)
+				if err != nil {
+					t.Error("identity:", err)
+				}
+
+				_ = w.Write(&Response{
+					Code:    Changed,
+					Payload: []byte(identity.Subject),
+				})
+			}))
+
+			s := newServerTest(t, opts, ServerOptions{}, handler)
+
+			req := testRequest()
+			req.Code = Code(test.method)
+			s.send(req)
+
+			resp := s.receive()
+			if resp == nil {
+				t.Fatal("expected response")
+			}
+
+			if resp.Code != Code(test.code) {
+				t.Errorf("code = %s, want %s", resp.Code, test.code)
+			}
+
+			if test.payload != "" && string(resp.Payload) != test.payload {
+				t.Errorf("payload = %q, want %q", resp.Payload, test.payload)
+			}
+
+			if test.code == InternalServerError && len(resp.Payload) != 0 {
+				t.Errorf("payload = %q, want none", resp.Payload)
+			}
+		})
+	}
+}
+
+func TestConnIdentityCache(t *testing.T) {
+	resolved := atomic.Int32{}
+	opts := testConnOptions()
+	opts.IdentityResolver = func(peer PeerID) (PeerIdentity, error) {
+		resolved.Add(1)
+
+		return PeerIdentity{
+			Subject: string(peer),
+		}, nil
+	}
+
+	opts.MaxInFlight = 1
+
+	a, _ := newPipe()
+	conn := NewConn(a, opts)
+	defer conn.Close()
+
+	conn.peers.Start("peer")
+
+	for range 2 {
+		identity, err := conn.Identity("peer")
+		if err != nil {
+			t.Fatal("identity:", err)
+		}
+
+		diff := cmp.Diff(PeerIdentity{Subject: "peer"}, identity)
+		if diff != "" {
+			t.Errorf("identity mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	if n := resolved.Load(); n != 1 {
+		t.Errorf("resolved %d times, want 1", n)
+	}
+
+	conn.RevokeIdentity("peer")
+
+	_, err := conn.Identity("peer")
+	if err != nil {
+		t.Fatal("identity:", err)
+	}
+
+	if n := resolved.Load(); n != 2 {
+		t.Errorf("resolved %d times after revocation, want 2", n)
+	}
+
+	// requests in flight are kept along with the budget
+	expectErr(t, conn.peers.Admit("peer", 0, true), InFlightLimitExceeded{Peer: "peer", MaxInFlight: 1})
+}
+
+func TestConnIdentityUnknown(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver IdentityResolver
+	}{
+		{
+			name: "no resolver",
+		},
+		{
+			name: "unknown",
+			resolver: func(_ PeerID) (PeerIdentity, error) {
+				return PeerIdentity{}, UnknownPeer{}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testConnOptions()
+			opts.IdentityResolver = test.resolver
+
+			a, _ := newPipe()
+			conn := NewConn(a, opts)
+			defer conn.Close()
+
+			_, err := conn.Identity("peer")
+			expectErr(t, err, UnknownPeer{
+				Peer: "peer",
+			})
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package coap
+
+import "sync"
+
+// MessageIDCount is the number of distinct MessageIDs.
+const MessageIDCount = 1 << 16
+
+// inflightIDs is the set of MessageIDs of Confirmable messages awaiting acknowledgement,
+// shared by writers allocating IDs and the retransmit queue. Methods of nil set do nothing.
+type inflightIDs struct {
+	mtx  sync.Mutex
+	bits [MessageIDCount / 64]uint64
+	len  int
+}
+
+// add adds the ID to the set.
+func (s *inflightIDs) add(id MessageID) {
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.set(id)
+}
+
+// remove removes the ID from the set.
+func (s *inflightIDs) remove(id MessageID) {
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.has(id) {
+		s.bits[id/64] &^= 1 << (id % 64)
+		s.len--
+	}
+}
+
+// clear removes all IDs from the set.
+func (s *inflightIDs) clear() {
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	clear(s.bits[:])
+	s.len = 0
+}
+
+// contains reports whether the ID is in the set.
+func (s *inflightIDs) contains(id MessageID) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.has(id)
+}
+
+// allocate returns the first ID from next not in the set, falling back to the lowest free ID if next
+// keeps returning IDs in the set, and adds it to the set if reserve is set.
+//
+// Returns MessageIDsExhausted if all IDs are in the set.
+func (s *inflightIDs) allocate(next MessageIDSource, reserve bool) (MessageID, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.len == MessageIDCount {
+		return 0, MessageIDsExhausted{}
+	}
+
+	id := next()
+	for range MessageIDCount {
+		if !s.has(id) {
+			break
+		}
+
+		id = next()
+	}
+
+	if s.has(id) {
+		for candidate := range MessageIDCount {
+			if !s.has(MessageID(candidate)) {
+				id = MessageID(candidate)
+				break
+			}
+		}
+	}
+
+	if reserve {
+		s.set(id)
+	}
+
+	return id, nil
+}
+
+func (s *inflightIDs) has(id MessageID) bool {
+	return s.bits[id/64]&(1<<(id%64)) != 0
+}
+
+func (s *inflightIDs) set(id MessageID) {
+	if !s.has(id) {
+		s.bits[id/64] |= 1 << (id % 64)
+		s.len++
+	}
+}
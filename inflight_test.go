@@ -0,0 +1,224 @@
+package coap
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// idSource returns the IDs in order, repeating the last one.
+func idSource(ids ...MessageID) MessageIDSource {
+	return func() MessageID {
+		id := ids[0]
+		if len(ids) > 1 {
+			ids = ids[1:]
+		}
+
+		return id
+	}
+}
+
+func TestInflightIDsAllocate(t *testing.T) {
+	tests := []struct {
+		name     string
+		inflight []MessageID
+		source   MessageIDSource
+		want     MessageID
+		err      error
+	}{
+		{
+			name:   "free",
+			source: idSource(5),
+			want:   5,
+		},
+		{
+			name:     "skipped",
+			inflight: []MessageID{5, 6},
+			source:   idSource(5, 6, 7),
+			want:     7,
+		},
+		{
+			name:     "lowest free",
+			inflight: []MessageID{0, 7},
+			source:   idSource(7),
+			want:     1,
+		},
+		{
+			name: "exhausted",
+			inflight: func() []MessageID {
+				ids := make([]MessageID, 0, MessageIDCount)
+				for id := range MessageIDCount {
+					ids = append(ids, MessageID(id))
+				}
+
+				return ids
+			}(),
+			source: idSource(7),
+			err:    MessageIDsExhausted{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &inflightIDs{}
+			for _, id := range test.inflight {
+				s.add(id)
+			}
+
+			id, err := s.allocate(test.source, true)
+			expectErr(t, err, test.err)
+			if err != nil {
+				return
+			}
+
+			if id != test.want {
+				t.Errorf("id = %d, want %d", id, test.want)
+			}
+
+			if !s.contains(id) {
+				t.Errorf("id %d not reserved", id)
+			}
+		})
+	}
+}
+
+func TestConnAllocateMessageID(t *testing.T) {
+	opts := testConnOptions()
+	opts.MessageIDSource = idSource(5, 5, 6)
+
+	a, b := newPipe()
+	client := NewConn(a, opts)
+	defer client.Close()
+	server := NewConn(b, testConnOptions())
+	defer server.Close()
+
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+		},
+	}
+
+	err := client.Write(msg, server.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	if msg.ID != 5 {
+		t.Fatalf("ID = %d, want 5", msg.ID)
+	}
+
+	// 5 is awaiting acknowledgement
+	id, err := client.AllocateMessageID()
+	if err != nil {
+		t.Fatal("allocate:", err)
+	}
+
+	if id != 6 {
+		t.Errorf("allocated %d, want 6", id)
+	}
+
+	received := &Message{}
+	addr, err := server.Read(received)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	err = server.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Acknowledgement,
+			ID:      received.ID,
+		},
+	}, addr)
+	if err != nil {
+		t.Fatal("write ack:", err)
+	}
+
+	_, err = client.Read(&Message{})
+	if err != nil {
+		t.Fatal("read ack:", err)
+	}
+
+	// the ID is released along with the pending exchange
+	waitNoPending(t, client)
+
+	if client.inflight.contains(5) {
+		t.Error("ID 5 still in flight after acknowledgement")
+	}
+}
+
+func TestConnRegisterReservesMessageID(t *testing.T) {
+	opts := testConnOptions()
+	opts.MessageIDSource = idSource(5, 5, 6)
+
+	a, _ := newPipe()
+	client := NewConn(a, opts)
+	defer client.Close()
+
+	ids := []MessageID{}
+	for range 2 {
+		msg := &Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Confirmable,
+				Code:    Code(GET),
+			},
+		}
+
+		call := &clientCall{
+			results: make(chan callResult, 1),
+		}
+
+		err := client.register(msg, a.LocalAddr(), call)
+		if err != nil {
+			t.Fatal("register:", err)
+		}
+		defer client.unregister(msg, call)
+
+		ids = append(ids, msg.ID)
+	}
+
+	// 5 is reserved by the first call before it is written
+	diff := cmp.Diff([]MessageID{5, 6}, ids)
+	if diff != "" {
+		t.Errorf("IDs mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConnWriteKeepsCallerMessageID(t *testing.T) {
+	opts := testConnOptions()
+	opts.MessageIDSource = idSource(5)
+	opts.MaxPendingExchanges = 1
+
+	a, b := newPipe()
+	client := NewConn(a, opts)
+	defer client.Close()
+
+	err := client.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+		},
+	}, b.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	// the caller supplied ID is not reserved by the rejected write
+	err = client.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			ID:      5,
+		},
+	}, b.LocalAddr())
+	expectErr(t, err, QueueFull{Limit: 1, Addr: b.LocalAddr()})
+
+	if !client.inflight.contains(5) {
+		t.Error("ID 5 released while its exchange is pending")
+	}
+}
@@ -0,0 +1,102 @@
+package coap
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+const (
+	// InternerCapacity is the default number of strings kept by BoundedInterner.
+	InternerCapacity = 4096
+
+	// MaxInternedLength is the length above which BoundedInterner does not intern strings,
+	// as long values such as Proxy-Uri rarely repeat.
+	MaxInternedLength = 255
+
+	internerShards = 16
+)
+
+// StringInterner returns strings for byte values, so that equal values decoded from different
+// messages share the storage of a single string.
+//
+// Get must be safe for concurrent use and must not retain b.
+type StringInterner interface {
+	Get(b []byte) string
+}
+
+// BoundedInterner is a StringInterner keeping a bounded number of strings in lock-striped shards.
+//
+// A full shard evicts an arbitrary string, which is still valid for its holders but no longer shared
+// with later values.
+type BoundedInterner struct {
+	seed   maphash.Seed
+	limit  int
+	shards [internerShards]internerShard
+}
+
+type internerShard struct {
+	mtx     sync.Mutex
+	strings map[string]string
+}
+
+// NewBoundedInterner instantiates a BoundedInterner keeping about capacity strings,
+// defaults to InternerCapacity.
+func NewBoundedInterner(capacity int) *BoundedInterner {
+	if capacity <= 0 {
+		capacity = InternerCapacity
+	}
+
+	i := &BoundedInterner{
+		seed:  maphash.MakeSeed(),
+		limit: max(capacity/internerShards, 1),
+	}
+
+	for s := range i.shards {
+		i.shards[s].strings = map[string]string{}
+	}
+
+	return i
+}
+
+// Get implements StringInterner.
+func (i *BoundedInterner) Get(b []byte) string {
+	if len(b) > MaxInternedLength {
+		return string(b)
+	}
+
+	shard := &i.shards[maphash.Bytes(i.seed, b)%internerShards]
+
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	s, ok := shard.strings[string(b)]
+	if ok {
+		return s
+	}
+
+	if len(shard.strings) >= i.limit {
+		for evicted := range shard.strings {
+			delete(shard.strings, evicted)
+			break
+		}
+	}
+
+	s = string(b)
+	shard.strings[s] = s
+
+	return s
+}
+
+// Len returns the number of interned strings.
+func (i *BoundedInterner) Len() int {
+	n := 0
+	for s := range i.shards {
+		shard := &i.shards[s]
+
+		shard.mtx.Lock()
+		n += len(shard.strings)
+		shard.mtx.Unlock()
+	}
+
+	return n
+}
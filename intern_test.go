@@ -0,0 +1,163 @@
+package coap
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// internRequest is a proxied request with string options typical of a gateway.
+var internRequest = []byte{
+	0x44, 0x01, 0x84, 0x9e, 0x51, 0x55, 0x77, 0xe8, // Header
+	0x3b, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x2e, 0x63, 0x6f, 0x6d, // URIHost "example.com"
+	0x11, 0x01, // ETag
+	0x77, 0x73, 0x65, 0x6e, 0x73, 0x6f, 0x72, 0x73, // URIPath "sensors"
+	0x04, 0x74, 0x65, 0x6d, 0x70, // URIPath "temp"
+	0x45, 0x75, 0x6e, 0x69, 0x74, 0x3d, // URIQuery "unit="
+}
+
+func TestDecodeInterned(t *testing.T) {
+	interner := NewBoundedInterner(0)
+
+	plain := Message{}
+	_, err := plain.Decode(internRequest, MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	decoded := make([]Message, 2)
+	for i := range decoded {
+		_, err := decoded[i].Decode(internRequest, MarshalOptions{
+			Interner: interner,
+		})
+		if err != nil {
+			t.Fatal("decode:", err)
+		}
+
+		diff := cmp.Diff(plain, decoded[i], cmp.AllowUnexported(Option{}))
+		if diff != "" {
+			t.Errorf("interned decoding mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	for i, opt := range decoded[0].Options {
+		shared := decoded[1].Options[i]
+		switch opt.ValueFormat {
+		case ValueFormatString:
+			if unsafe.StringData(opt.stringValue) != unsafe.StringData(shared.stringValue) {
+				t.Errorf("%s value %q not shared", opt.Name, opt.stringValue)
+			}
+		case ValueFormatOpaque:
+			if &opt.opaqueValue[0] == &shared.opaqueValue[0] {
+				t.Errorf("%s value shared", opt.Name)
+			}
+		}
+	}
+
+	if n := interner.Len(); n != 4 {
+		t.Errorf("interned %d strings, want 4", n)
+	}
+}
+
+func TestBoundedInternerEviction(t *testing.T) {
+	interner := NewBoundedInterner(internerShards)
+
+	for i := range 1000 {
+		value := strings.Repeat("x", i%MaxInternedLength+1)
+		got := interner.Get([]byte(value))
+		if got != value {
+			t.Fatalf("Get(%q) = %q", value, got)
+		}
+	}
+
+	if n := interner.Len(); n > internerShards {
+		t.Errorf("interned %d strings, want at most %d", n, internerShards)
+	}
+
+	long := strings.Repeat("x", MaxInternedLength+1)
+	if got := interner.Get([]byte(long)); got != long {
+		t.Errorf("Get of long value = %q, want %q", got, long)
+	}
+}
+
+func TestBoundedInternerConcurrent(t *testing.T) {
+	interner := NewBoundedInterner(64)
+	segments := []string{"sensors", "temp", "humidity", "fw", "1.0"}
+
+	wg := sync.WaitGroup{}
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range 1000 {
+				segment := segments[i%len(segments)]
+				if got := interner.Get([]byte(segment)); got != segment {
+					t.Errorf("Get(%q) = %q", segment, got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkDecodeRetained decodes 10k identical requests and keeps them, as a gateway keeps
+// observe registrations, reporting heap retained per message.
+func BenchmarkDecodeRetained(b *testing.B) {
+	const count = 10000
+
+	for _, test := range []struct {
+		name     string
+		interner func() StringInterner
+	}{
+		{
+			name: "plain",
+			interner: func() StringInterner {
+				return nil
+			},
+		},
+		{
+			name: "interned",
+			interner: func() StringInterner {
+				return NewBoundedInterner(0)
+			},
+		},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			retained := uint64(0)
+			for b.Loop() {
+				opts := MarshalOptions{
+					Interner: test.interner(),
+				}
+
+				before := runtime.MemStats{}
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				msgs := make([]Message, count)
+				for i := range msgs {
+					_, err := msgs[i].Decode(internRequest, opts)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				after := runtime.MemStats{}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				runtime.KeepAlive(msgs)
+
+				retained += after.HeapAlloc - before.HeapAlloc
+			}
+
+			b.ReportMetric(float64(retained)/float64(b.N)/count, "retained-B/msg")
+		})
+	}
+}
@@ -0,0 +1,262 @@
+// Package clock implements the real and a fake Clock scheduling timed events of connections,
+// shared by the coap package and its test doubles.
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock provides current time and timers.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+
+	// After waits for the duration to elapse and then sends the current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is a single event timer created by Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// Real is a Clock backed by the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+type realTimer struct {
+	*time.Timer
+}
+
+// Fake is a virtual Clock that only advances when Advance is called.
+//
+// Intended for tests, a single Fake shared by both ends of a connection drives retransmissions,
+// piggyback deadlines and expiry deterministically, so that minutes of protocol time pass in
+// milliseconds of wall time.
+//
+// A timer is watched once its receiver calls C, as a select loop does each time it waits. The receiver
+// of a fired watched timer reacts until it calls C, Reset or Stop on it again, which Advance waits for.
+// Timers of After are never watched.
+type Fake struct {
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *Fake
+	c      chan time.Time
+	when   time.Time
+	active bool
+
+	// watched is set by C until the timer fires
+	watched bool
+
+	// reacting is set when a watched timer fires until its receiver calls C, Reset or Stop
+	reacting bool
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{
+		Timer: time.NewTimer(d),
+	}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// NewFake instantiates a new Fake starting at the given time.
+func NewFake(now time.Time) *Fake {
+	c := &Fake{
+		now: now,
+	}
+	c.cond = sync.NewCond(&c.mtx)
+
+	return c
+}
+
+// Now implements Clock.
+func (c *Fake) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.now
+}
+
+// NewTimer implements Clock.
+func (c *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		clock: c,
+		c:     make(chan time.Time, 1),
+	}
+
+	t.Reset(d)
+
+	return t
+}
+
+// After implements Clock.
+func (c *Fake) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).(*fakeTimer).c
+}
+
+// Advance moves the clock forward, firing due timers one at a time in order of their deadline.
+//
+// The clock reads the deadline of each timer when it fires. Before the next timer fires, Advance waits
+// for the receiver of a watched timer to react, so that timers reset in reaction, such as the next
+// retransmission, fire within the same call if they are due. Receivers which are not yet waiting miss
+// their reaction, see BlockUntil.
+func (c *Fake) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		t := c.due(target)
+		if t == nil {
+			break
+		}
+
+		c.now = t.when
+		t.reacting = t.watched
+		c.send(t, c.now)
+
+		for t.reacting {
+			c.cond.Wait()
+		}
+	}
+
+	c.now = target
+}
+
+// BlockUntil waits until at least n active timers are watched by their receivers, so that a following
+// Advance waits for their reactions.
+func (c *Fake) BlockUntil(n int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for c.watched() < n {
+		c.cond.Wait()
+	}
+}
+
+// watched returns the number of active watched timers.
+func (c *Fake) watched() int {
+	n := 0
+	for _, t := range c.timers {
+		if t.active && t.watched {
+			n++
+		}
+	}
+
+	return n
+}
+
+// due returns the active timer with the earliest deadline not after target.
+func (c *Fake) due(target time.Time) *fakeTimer {
+	// timers with equal deadlines fire in order of registration
+	var next *fakeTimer
+	for _, t := range c.timers {
+		if !t.active || t.when.After(target) {
+			continue
+		}
+
+		if next == nil || t.when.Before(next.when) {
+			next = t
+		}
+	}
+
+	return next
+}
+
+// fire fires timers that are due at the current time.
+func (c *Fake) fire() {
+	for t := c.due(c.now); t != nil; t = c.due(c.now) {
+		c.send(t, c.now)
+	}
+}
+
+// send fires the timer and releases it.
+func (c *Fake) send(t *fakeTimer, now time.Time) {
+	c.release(t)
+
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+// release deactivates the timer and stops tracking it, Reset registers it again.
+func (c *Fake) release(t *fakeTimer) {
+	t.active = false
+	t.watched = false
+	c.timers = slices.DeleteFunc(c.timers, func(other *fakeTimer) bool {
+		return other == t
+	})
+}
+
+// react ends the reaction to a fired timer and wakes up Advance and BlockUntil.
+func (t *fakeTimer) react() {
+	t.reacting = false
+	t.clock.cond.Broadcast()
+}
+
+// C marks the timer watched. The reaction to a fired value ends once it has been received.
+func (t *fakeTimer) C() <-chan time.Time {
+	t.clock.mtx.Lock()
+	defer t.clock.mtx.Unlock()
+
+	if len(t.c) == 0 {
+		t.react()
+	}
+
+	if t.active {
+		t.watched = true
+		t.clock.cond.Broadcast()
+	}
+
+	return t.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mtx.Lock()
+	defer t.clock.mtx.Unlock()
+
+	active := t.active
+	if !slices.Contains(t.clock.timers, t) {
+		t.clock.timers = append(t.clock.timers, t)
+	}
+
+	t.active = true
+	t.when = t.clock.now.Add(d)
+	t.react()
+	t.clock.fire()
+
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mtx.Lock()
+	defer t.clock.mtx.Unlock()
+
+	active := t.active
+	t.clock.release(t)
+	t.react()
+
+	return active
+}
@@ -0,0 +1,102 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewFake(start)
+	timer := clock.NewTimer(time.Second)
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-timer.(*fakeTimer).c:
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case now := <-timer.(*fakeTimer).c:
+		if want := start.Add(time.Second); !now.Equal(want) {
+			t.Errorf("fired at %v, want %v", now, want)
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("expected fired timer to be inactive")
+	}
+
+	if !timer.Stop() {
+		t.Error("expected reset timer to be active")
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-timer.(*fakeTimer).c:
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	timer.Reset(0)
+	select {
+	case <-timer.(*fakeTimer).c:
+	default:
+		t.Fatal("expired timer did not fire")
+	}
+}
+
+func TestFakeAdvance(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewFake(start)
+
+	// ticker resetting its timer in reaction, as the retransmit loop does
+	ticks := make(chan time.Time, 10)
+	timer := clock.NewTimer(time.Second)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 3 {
+			now := <-timer.C()
+			ticks <- now
+			timer.Reset(time.Second)
+		}
+	}()
+
+	late := clock.After(2500 * time.Millisecond)
+
+	// the ticker reacts within Advance once it waits on the timer
+	clock.BlockUntil(1)
+	clock.Advance(3 * time.Second)
+	<-done
+	close(ticks)
+
+	got := []time.Duration{}
+	for now := range ticks {
+		got = append(got, now.Sub(start))
+	}
+
+	diff := cmp.Diff([]time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, got)
+	if diff != "" {
+		t.Errorf("ticks mismatch (-want +got):\n%s", diff)
+	}
+
+	select {
+	case now := <-late:
+		if want := start.Add(2500 * time.Millisecond); !now.Equal(want) {
+			t.Errorf("After fired at %v, want %v", now, want)
+		}
+	default:
+		t.Fatal("After did not fire")
+	}
+
+	if now := clock.Now(); !now.Equal(start.Add(3 * time.Second)) {
+		t.Errorf("Now() = %v, want %v", now, start.Add(3*time.Second))
+	}
+}
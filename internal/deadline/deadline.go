@@ -0,0 +1,109 @@
+// Package deadline implements read deadlines of in-memory net.PacketConn implementations
+// delivering datagrams over a channel.
+package deadline
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var errChanged = errors.New("deadline changed")
+
+// Datagram is a datagram delivered to an in-memory connection with the address it was sent from.
+type Datagram struct {
+	Data []byte
+	Addr net.Addr
+}
+
+// Reader reads datagrams delivered over a channel until its read deadline, which applies to pending
+// and subsequent reads like the read deadline of net.PacketConn.
+type Reader struct {
+	rx     <-chan Datagram
+	closed <-chan struct{}
+
+	failOnce sync.Once
+	failed   chan struct{}
+	err      error
+
+	mtx      sync.Mutex
+	deadline time.Time
+
+	// changed is closed and replaced when the deadline changes to wake pending reads
+	changed chan struct{}
+}
+
+// NewReader instantiates a new Reader of datagrams received from rx until closed is closed.
+func NewReader(rx <-chan Datagram, closed <-chan struct{}) *Reader {
+	return &Reader{
+		rx:      rx,
+		closed:  closed,
+		failed:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetDeadline sets the deadline of pending and subsequent reads, the zero time means no deadline.
+func (r *Reader) SetDeadline(t time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.deadline = t
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Fail makes pending and subsequent reads return err, such as once the source of datagrams failed.
+// Only the first call has an effect.
+func (r *Reader) Fail(err error) {
+	r.failOnce.Do(func() {
+		r.err = err
+		close(r.failed)
+	})
+}
+
+// ReadFrom reads a datagram into b, datagrams larger than b are truncated.
+//
+// Returns net.ErrClosed once closed is closed, the error of Fail once it is called,
+// or os.ErrDeadlineExceeded once the deadline passes.
+func (r *Reader) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		r.mtx.Lock()
+		deadline := r.deadline
+		changed := r.changed
+		r.mtx.Unlock()
+
+		n, addr, err := r.readFrom(b, deadline, changed)
+		if err != errChanged {
+			return n, addr, err
+		}
+	}
+}
+
+// readFrom waits for a datagram until the deadline.
+//
+// Returns errChanged if the deadline changed while waiting.
+func (r *Reader) readFrom(b []byte, deadline time.Time, changed <-chan struct{}) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-r.closed:
+		return 0, nil, net.ErrClosed
+	case <-r.failed:
+		return 0, nil, r.err
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-changed:
+		return 0, nil, errChanged
+	case d := <-r.rx:
+		n := copy(b, d.Data)
+		return n, d.Addr, nil
+	}
+}
@@ -0,0 +1,82 @@
+package deadline
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReaderReadFrom(t *testing.T) {
+	rx := make(chan Datagram, 1)
+	closed := make(chan struct{})
+	r := NewReader(rx, closed)
+
+	addr := &net.UDPAddr{Port: 5683}
+	rx <- Datagram{
+		Data: []byte("hello"),
+		Addr: addr,
+	}
+
+	// datagrams larger than the buffer are truncated
+	b := make([]byte, 4)
+	n, from, err := r.ReadFrom(b)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	if string(b[:n]) != "hell" || from != addr {
+		t.Errorf("read %q from %v, want %q from %v", b[:n], from, "hell", addr)
+	}
+
+	r.SetDeadline(time.Now().Add(10 * time.Millisecond))
+
+	_, _, err = r.ReadFrom(b)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("error = %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	close(closed)
+
+	_, _, err = r.ReadFrom(b)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("error = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestReaderDeadlineChanged(t *testing.T) {
+	r := NewReader(make(chan Datagram), make(chan struct{}))
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := r.ReadFrom(make([]byte, 1))
+		errs <- err
+	}()
+
+	// a deadline set while reading applies to the pending read
+	time.Sleep(10 * time.Millisecond)
+	r.SetDeadline(time.Now())
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("error = %v, want os.ErrDeadlineExceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending read not interrupted")
+	}
+}
+
+func TestReaderFail(t *testing.T) {
+	r := NewReader(make(chan Datagram), make(chan struct{}))
+
+	failure := errors.New("failure")
+	r.Fail(failure)
+	r.Fail(errors.New("ignored"))
+
+	_, _, err := r.ReadFrom(make([]byte, 1))
+	if !errors.Is(err, failure) {
+		t.Errorf("error = %v, want %v", err, failure)
+	}
+}
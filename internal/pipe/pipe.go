@@ -0,0 +1,245 @@
+// Package pipe implements in-memory net.PacketConn endpoints delivering datagrams to each other,
+// the test doubles of connections shared by the coap package and coaptest.
+package pipe
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/uramaki-io/coap/internal/clock"
+	"github.com/uramaki-io/coap/internal/deadline"
+)
+
+// Backlog is the number of datagrams buffered by Conn before further datagrams are dropped.
+const Backlog = 64
+
+// Addr is the address of a Conn endpoint.
+type Addr string
+
+// Conn is an in-memory net.PacketConn delivering datagrams to other endpoints of its network.
+//
+// Intended for tests, it never blocks on write and drops datagrams when the destination backlog is full,
+// addressed to unknown endpoint or selected by DropEvery.
+type Conn struct {
+	local   Addr
+	network *network
+	rx      chan deadline.Datagram
+	reader  *deadline.Reader
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mtx       sync.Mutex
+	written   uint
+	dropEvery uint
+	delay     time.Duration
+	clock     clock.Clock
+}
+
+// Link holds impairments of datagrams written by a Conn endpoint.
+type Link struct {
+	// Delay postpones delivery of each datagram.
+	Delay time.Duration
+
+	// DropEvery drops every n-th datagram, zero disables dropping.
+	DropEvery uint
+
+	// Clock schedules delayed datagrams, defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// network routes datagrams between Conn endpoints by address.
+type network struct {
+	endpoints map[string]*Conn
+}
+
+// New creates a pair of connected in-memory PacketConn endpoints.
+//
+// Datagrams written by one endpoint to the address of the other are delivered to it.
+func New() (*Conn, *Conn) {
+	endpoints := newNetwork("pipe-a", "pipe-b")
+
+	return endpoints[0], endpoints[1]
+}
+
+// Mesh creates n interconnected in-memory PacketConn endpoints.
+//
+// Datagrams written by any endpoint are delivered to the endpoint with the destination address.
+func Mesh(n int) []*Conn {
+	addrs := make([]Addr, n)
+	for i := range addrs {
+		addrs[i] = Addr(fmt.Sprintf("pipe-%d", i))
+	}
+
+	return newNetwork(addrs...)
+}
+
+func newNetwork(addrs ...Addr) []*Conn {
+	n := &network{
+		endpoints: make(map[string]*Conn, len(addrs)),
+	}
+
+	endpoints := make([]*Conn, len(addrs))
+	for i, addr := range addrs {
+		endpoints[i] = &Conn{
+			local:   addr,
+			network: n,
+			rx:      make(chan deadline.Datagram, Backlog),
+			closed:  make(chan struct{}),
+			clock:   clock.Real,
+		}
+		endpoints[i].reader = deadline.NewReader(endpoints[i].rx, endpoints[i].closed)
+		n.endpoints[addr.String()] = endpoints[i]
+	}
+
+	return endpoints
+}
+
+// Network implements net.Addr.
+func (a Addr) Network() string {
+	return "pipe"
+}
+
+// String implements net.Addr.
+func (a Addr) String() string {
+	return string(a)
+}
+
+// DropEvery drops every n-th datagram written by the endpoint, zero disables dropping.
+func (p *Conn) DropEvery(n uint) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.dropEvery = n
+}
+
+// SetDelay delays delivery of datagrams written by the endpoint, measured by the Clock of its Link.
+func (p *Conn) SetDelay(d time.Duration) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.delay = d
+}
+
+// SetLink sets impairments of datagrams written by the endpoint.
+func (p *Conn) SetLink(link Link) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.delay = link.Delay
+	p.dropEvery = link.DropEvery
+	p.clock = link.Clock
+	if p.clock == nil {
+		p.clock = clock.Real
+	}
+}
+
+// ReadFrom implements net.PacketConn.
+//
+// Datagrams larger than the buffer are truncated.
+func (p *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return p.reader.ReadFrom(b)
+}
+
+// WriteTo implements net.PacketConn.
+func (p *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	p.mtx.Lock()
+	p.written++
+	drop := p.dropEvery != 0 && p.written%p.dropEvery == 0
+	delay := p.delay
+	clk := p.clock
+	p.mtx.Unlock()
+
+	if drop || addr == nil {
+		return len(b), nil
+	}
+
+	dst, ok := p.network.endpoints[addr.String()]
+	if !ok {
+		return len(b), nil
+	}
+
+	d := deadline.Datagram{
+		Data: slices.Clone(b),
+		Addr: p.local,
+	}
+
+	if delay == 0 {
+		dst.deliver(d)
+		return len(b), nil
+	}
+
+	// the timer is created before WriteTo returns, so that a fake clock advanced afterwards fires it
+	due := clk.After(delay)
+	go func() {
+		select {
+		case <-dst.closed:
+		case <-due:
+			dst.deliver(d)
+		}
+	}()
+
+	return len(b), nil
+}
+
+func (p *Conn) deliver(d deadline.Datagram) {
+	select {
+	case <-p.closed:
+	case p.rx <- d:
+	default: // backlog full
+	}
+}
+
+// Close implements net.PacketConn.
+func (p *Conn) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+
+	return nil
+}
+
+// LocalAddr implements net.PacketConn.
+func (p *Conn) LocalAddr() net.Addr {
+	return p.local
+}
+
+// SetDeadline implements net.PacketConn.
+func (p *Conn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+//
+// Deadline applies to pending and subsequent ReadFrom calls.
+func (p *Conn) SetReadDeadline(t time.Time) error {
+	p.reader.SetDeadline(t)
+
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn.
+//
+// Writes never block, so the deadline is ignored.
+func (p *Conn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+// Resolve resolves the address of the network, Addr for the "pipe" network and net.ResolveUDPAddr otherwise,
+// such as destination addresses of messages restored from a store.
+func Resolve(network string, address string) (net.Addr, error) {
+	if network == "pipe" {
+		return Addr(address), nil
+	}
+
+	return net.ResolveUDPAddr(network, address)
+}
@@ -0,0 +1,173 @@
+package pipe
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/uramaki-io/coap/internal/clock"
+)
+
+var data = []byte{0x01, 0x02, 0x03, 0x04}
+
+func TestPipe(t *testing.T) {
+	a, b := New()
+	defer a.Close()
+	defer b.Close()
+
+	_, err := a.WriteTo(data, b.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	buf := make([]byte, 16)
+	n, addr, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	if addr != a.LocalAddr() {
+		t.Errorf("addr = %v, want %v", addr, a.LocalAddr())
+	}
+
+	diff := cmp.Diff(data, buf[:n])
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDropEvery(t *testing.T) {
+	a, b := New()
+	defer a.Close()
+	defer b.Close()
+
+	a.DropEvery(2)
+	for i := range 4 {
+		_, err := a.WriteTo([]byte{byte(i)}, b.LocalAddr())
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+
+	err := b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	got := []byte{}
+	buf := make([]byte, 1)
+	for {
+		_, _, err := b.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+
+		got = append(got, buf[0])
+	}
+
+	diff := cmp.Diff([]byte{0, 2}, got)
+	if diff != "" {
+		t.Errorf("delivered mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	a, b := New()
+	defer a.Close()
+	defer b.Close()
+
+	// delayed datagrams are delivered once the clock of the link advances past the delay
+	fake := clock.NewFake(time.Unix(0, 0))
+	a.SetLink(Link{
+		Delay: time.Second,
+		Clock: fake,
+	})
+
+	_, err := a.WriteTo(data, b.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	err = b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	_, _, err = b.ReadFrom(make([]byte, 16))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read before delay error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	err = b.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	fake.Advance(time.Second)
+
+	buf := make([]byte, 16)
+	n, _, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	diff := cmp.Diff(data, buf[:n])
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestClose(t *testing.T) {
+	a, b := New()
+	defer b.Close()
+
+	done := make(chan error)
+	go func() {
+		_, _, err := a.ReadFrom(make([]byte, 1))
+		done <- err
+	}()
+
+	a.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read error = %v, want %v", err, net.ErrClosed)
+	}
+
+	_, err := a.WriteTo(data, b.LocalAddr())
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestMesh(t *testing.T) {
+	endpoints := Mesh(3)
+	for _, endpoint := range endpoints {
+		defer endpoint.Close()
+	}
+
+	for i, src := range endpoints {
+		dst := endpoints[(i+1)%len(endpoints)]
+		_, err := src.WriteTo([]byte{byte(i)}, dst.LocalAddr())
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+
+	buf := make([]byte, 1)
+	for i, dst := range endpoints {
+		src := endpoints[(i+len(endpoints)-1)%len(endpoints)]
+		_, addr, err := dst.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+
+		if addr != src.LocalAddr() || buf[0] != byte((i+len(endpoints)-1)%len(endpoints)) {
+			t.Errorf("endpoint %v received %d from %v, want from %v", dst.LocalAddr(), buf[0], addr, src.LocalAddr())
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package coap
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// optionJSON is the JSON representation of an Option.
+type optionJSON struct {
+	Name   string          `json:"name,omitempty"`
+	Code   uint16          `json:"code"`
+	Format ValueFormat     `json:"format"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// messageJSON is the JSON representation of a Message.
+type messageJSON struct {
+	Type          Type      `json:"type"`
+	Code          Code      `json:"code"`
+	ID            MessageID `json:"id"`
+	Token         Token     `json:"token,omitempty"`
+	Options       Options   `json:"options,omitempty"`
+	Payload       *string   `json:"payload,omitempty"`
+	PayloadBase64 []byte    `json:"payloadBase64,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+//
+// Message is encoded as an object with type, code, id, hex encoded token and options, see Token.MarshalText.
+// Payload is encoded as a string if it is valid UTF-8, otherwise it is base64 encoded as payloadBase64.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	v := messageJSON{
+		Type:    m.Type,
+		Code:    m.Code,
+		ID:      m.ID,
+		Token:   m.Token,
+		Options: m.Options,
+	}
+
+	switch {
+	case len(m.Payload) == 0:
+	case utf8.Valid(m.Payload):
+		payload := string(m.Payload)
+		v.Payload = &payload
+	default:
+		v.PayloadBase64 = m.Payload
+	}
+
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	v := messageJSON{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+
+	m.Header = Header{
+		Version: ProtocolVersion,
+		Type:    v.Type,
+		Code:    v.Code,
+		ID:      v.ID,
+		Token:   v.Token,
+	}
+	m.Options = v.Options
+
+	m.Payload = v.PayloadBase64
+	if v.Payload != nil {
+		m.Payload = []byte(*v.Payload)
+	}
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+//
+// Option is encoded as an object with name, code, format and value, where uint value is a number,
+// string value is a string and opaque value is base64 encoded. Unrecognized options have no name.
+func (o Option) MarshalJSON() ([]byte, error) {
+	v, err := o.json()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+//
+// Option definition is resolved by code using DefaultSchema.
+//
+// Returns OptionNameMismatch if the name does not match the option definition.
+//
+// Returns InvalidOptionValueFormat if the format does not match the option definition.
+//
+// Returns InvalidOptionValueLength if the value length does not match the option definition.
+func (o *Option) UnmarshalJSON(data []byte) error {
+	v := optionJSON{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+
+	opt, err := optionFromJSON(v, DefaultSchema)
+	if err != nil {
+		return err
+	}
+
+	*o = opt
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+//
+// Options are encoded as an array of options, see Option.MarshalJSON.
+func (o Options) MarshalJSON() ([]byte, error) {
+	data := make([]optionJSON, 0, len(o))
+	for _, opt := range o {
+		v, err := opt.json()
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, v)
+	}
+
+	return json.Marshal(data)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+//
+// Option definitions are resolved by code using DefaultSchema, see OptionsFromJSON.
+//
+// Returns OptionNameMismatch if a name does not match the option definition.
+//
+// Returns InvalidOptionValueFormat if the format does not match the option definition.
+//
+// Returns InvalidOptionValueLength if the value length does not match the option definition.
+func (o *Options) UnmarshalJSON(data []byte) error {
+	options, err := OptionsFromJSON(data, DefaultSchema)
+	if err != nil {
+		return err
+	}
+
+	*o = options
+	return nil
+}
+
+// OptionsFromJSON decodes options encoded by Options.MarshalJSON resolving option definitions by code
+// using the schema, DefaultSchema if nil. Names are optional, but must match the option definitions.
+//
+// Returns OptionNameMismatch if a name does not match the option definition.
+//
+// Returns InvalidOptionValueFormat if the format does not match the option definition.
+//
+// Returns InvalidOptionValueLength if the value length does not match the option definition.
+func OptionsFromJSON(data []byte, schema *Schema) (Options, error) {
+	if schema == nil {
+		schema = DefaultSchema
+	}
+
+	values := []optionJSON{}
+	err := json.Unmarshal(data, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	options := make(Options, 0, len(values))
+	for _, v := range values {
+		opt, err := optionFromJSON(v, schema)
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, opt)
+	}
+
+	return options, nil
+}
+
+// MarshalJSON implements json.Marshaler.
+//
+// Request is encoded as the Message carrying it, see Message.MarshalJSON.
+//
+// Returns InvalidType or InvalidCode if the request cannot be encoded.
+func (r *Request) MarshalJSON() ([]byte, error) {
+	msg, err := r.message()
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.MarshalJSON()
+}
+
+// MarshalJSON implements json.Marshaler.
+//
+// Response is encoded as the Message carrying it, see Message.MarshalJSON.
+//
+// Returns InvalidType or InvalidCode if the response cannot be encoded.
+func (r *Response) MarshalJSON() ([]byte, error) {
+	msg, err := r.message()
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.MarshalJSON()
+}
+
+// json returns the JSON representation of the option.
+func (o Option) json() (optionJSON, error) {
+	var value any
+	switch o.ValueFormat {
+	case ValueFormatUint:
+		value = o.uintValue
+	case ValueFormatOpaque:
+		value = o.opaqueValue
+	case ValueFormatString:
+		value = o.stringValue
+	}
+
+	v := optionJSON{
+		Name:   o.Name,
+		Code:   o.Code,
+		Format: o.ValueFormat,
+	}
+
+	if value != nil {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return optionJSON{}, err
+		}
+
+		v.Value = raw
+	}
+
+	return v, nil
+}
+
+// optionFromJSON builds the option from its JSON representation, validating format and length like the setters do.
+func optionFromJSON(v optionJSON, schema *Schema) (Option, error) {
+	opt := Option{
+		OptionDef: schema.Option(v.Code, MaxOptionLength),
+	}
+
+	if v.Name != "" && v.Name != opt.Name {
+		return Option{}, OptionNameMismatch{
+			OptionDef: opt.OptionDef,
+			Requested: v.Name,
+		}
+	}
+
+	if v.Format != opt.ValueFormat {
+		return Option{}, InvalidOptionValueFormat{
+			OptionDef: opt.OptionDef,
+			Requested: v.Format,
+		}
+	}
+
+	var err error
+	switch opt.ValueFormat {
+	case ValueFormatUint:
+		var value uint32
+		err = unmarshalValue(v.Value, &value)
+		if err == nil {
+			err = opt.SetUint(value)
+		}
+	case ValueFormatOpaque:
+		var value []byte
+		err = unmarshalValue(v.Value, &value)
+		if err == nil {
+			err = opt.SetOpaque(value)
+		}
+	case ValueFormatString:
+		var value string
+		err = unmarshalValue(v.Value, &value)
+		if err == nil {
+			err = opt.SetString(value)
+		}
+	}
+	if err != nil {
+		return Option{}, err
+	}
+
+	return opt, nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t Type) MarshalText() ([]byte, error) {
+	s, ok := typeString[t]
+	if !ok {
+		return nil, InvalidType{
+			Type: t,
+		}
+	}
+
+	return []byte(s), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *Type) UnmarshalText(data []byte) error {
+	for tpe, s := range typeString {
+		if s == string(data) {
+			*t = tpe
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown type %q", data)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (c Code) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (c *Code) UnmarshalText(data []byte) error {
+	var class, detail uint8
+	_, err := fmt.Sscanf(string(data), "%1d.%2d", &class, &detail)
+	if err != nil || class > 7 || detail > 31 {
+		return fmt.Errorf("invalid code %q", data)
+	}
+
+	*c = Code(class<<5 | detail)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t Token) MarshalText() ([]byte, error) {
+	return hex.AppendEncode(nil, t), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *Token) UnmarshalText(data []byte) error {
+	token, err := hex.AppendDecode(nil, data)
+	if err != nil {
+		return err
+	}
+
+	*t = token
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (f ValueFormat) MarshalText() ([]byte, error) {
+	s, ok := valueFormatString[f]
+	if !ok {
+		return nil, fmt.Errorf("unknown value format %d", f)
+	}
+
+	return []byte(s), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (f *ValueFormat) UnmarshalText(data []byte) error {
+	for format, s := range valueFormatString {
+		if s == string(data) {
+			*f = format
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown value format %q", data)
+}
+
+func unmarshalValue(data json.RawMessage, value any) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+// MarshalJSON implements json.Marshaler.
+//
+// Schema is encoded as its description, see Describe.
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Describe())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+//
+// Schema is decoded from its description, see MarshalJSON. Critical and unsafe properties are declared
+// as CriticalOverride and UnsafeOverride, so that a mistyped code is caught while loading.
+// The schema is replaced only if all options are consistent.
+//
+// Returns the errors of OptionDef.Validate of all inconsistent options joined.
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	description := SchemaDescription{}
+	err := json.Unmarshal(data, &description)
+	if err != nil {
+		return err
+	}
+
+	options := make([]OptionDef, 0, len(description.Options))
+	for _, option := range description.Options {
+		options = append(options, OptionDef{
+			Name:             option.Name,
+			Code:             option.Code,
+			ValueFormat:      option.Format,
+			Repeatable:       option.Repeatable,
+			MinLen:           option.MinLen,
+			MaxLen:           option.MaxLen,
+			CriticalOverride: DeclareProperty(option.Critical),
+			UnsafeOverride:   DeclareProperty(option.Unsafe),
+		})
+	}
+
+	schema := NewSchema()
+	err = schema.AddOptionsChecked(options...)
+	if err != nil {
+		return err
+	}
+
+	for _, mediaType := range description.MediaTypes {
+		schema.AddMediaTypes(MediaType{
+			Name: mediaType.Name,
+			Code: mediaType.Code,
+		})
+	}
+
+	*s = *schema
+	return nil
+}
@@ -0,0 +1,454 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOptionsJSON(t *testing.T) {
+	options := Options{
+		MustOptionValue(URIPath, "test"),
+		MustOptionValue(URIPort, uint32(5683)),
+		MustOptionValue(ETag, bytes4),
+		{OptionDef: IfNoneMatch},
+		MustOptionValue(UnrecognizedOptionDef(65001, MaxOptionLength), bytes4),
+	}
+
+	want := `[` +
+		`{"name":"URIPath","code":11,"format":"string","value":"test"},` +
+		`{"name":"URIPort","code":7,"format":"uint","value":5683},` +
+		`{"name":"ETag","code":4,"format":"opaque","value":"3q2+7w=="},` +
+		`{"name":"IfNoneMatch","code":5,"format":"empty"},` +
+		`{"code":65001,"format":"opaque","value":"3q2+7w=="}` +
+		`]`
+
+	data, err := json.Marshal(options)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	diff := cmp.Diff(want, string(data))
+	if diff != "" {
+		t.Errorf("json mismatch (-want +got):\n%s", diff)
+	}
+
+	decoded := Options{}
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	diff = cmp.Diff(options, decoded, EquateOptions())
+	if diff != "" {
+		t.Errorf("options mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestOptionsUnmarshalJSONError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{
+			name: "format mismatch",
+			data: `[{"code":7,"format":"string","value":"5683"}]`,
+			err: InvalidOptionValueFormat{
+				OptionDef: URIPort,
+				Requested: ValueFormatString,
+			},
+		},
+		{
+			name: "name mismatch",
+			data: `[{"name":"URIHost","code":7,"format":"uint","value":5683}]`,
+			err: OptionNameMismatch{
+				OptionDef: URIPort,
+				Requested: "URIHost",
+			},
+		},
+		{
+			name: "value too long",
+			data: `[{"code":7,"format":"uint","value":65536}]`,
+			err: InvalidOptionValueLength{
+				OptionDef: URIPort,
+				Length:    3,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := Options{}
+			err := json.Unmarshal([]byte(test.data), &options)
+			expectErr(t, err, test.err)
+		})
+	}
+}
+
+func TestMessageJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *Message
+		json string
+	}{
+		{
+			name: "text payload",
+			msg: &Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    Acknowledgement,
+					Code:    Code(Content),
+					ID:      0x13FD,
+					Token:   []byte{0xD0, 0xE2, 0x4D, 0xAC},
+				},
+				Options: Options{
+					MustOptionValue(ContentFormat, uint32(0)),
+				},
+				Payload: []byte("Hello"),
+			},
+			json: `{"type":"ACK","code":"2.05","id":5117,"token":"d0e24dac",` +
+				`"options":[{"name":"ContentFormat","code":12,"format":"uint","value":0}],` +
+				`"payload":"Hello"}`,
+		},
+		{
+			name: "binary payload",
+			msg: &Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    Confirmable,
+					Code:    Code(POST),
+					ID:      1,
+					Token:   bytes4,
+				},
+				Payload: []byte{0xff, 0xfe},
+			},
+			json: `{"type":"CON","code":"0.02","id":1,"token":"deadbeef","payloadBase64":"//4="}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := json.Marshal(test.msg)
+			if err != nil {
+				t.Fatal("marshal:", err)
+			}
+
+			diff := cmp.Diff(test.json, string(data))
+			if diff != "" {
+				t.Errorf("json mismatch (-want +got):\n%s", diff)
+			}
+
+			msg := &Message{}
+			err = json.Unmarshal(data, msg)
+			if err != nil {
+				t.Fatal("unmarshal:", err)
+			}
+
+			diff = cmp.Diff(test.msg, msg, EquateOptions())
+			if diff != "" {
+				t.Errorf("message mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestOptionJSON(t *testing.T) {
+	opt := MustOptionValue(URIPath, "test")
+
+	data, err := json.Marshal(opt)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	diff := cmp.Diff(`{"name":"URIPath","code":11,"format":"string","value":"test"}`, string(data))
+	if diff != "" {
+		t.Errorf("json mismatch (-want +got):\n%s", diff)
+	}
+
+	decoded := Option{}
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	diff = cmp.Diff(opt, decoded, EquateOptions())
+	if diff != "" {
+		t.Errorf("option mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestOptionsFromJSON(t *testing.T) {
+	custom := OptionDef{Code: 65001, Name: "Custom", ValueFormat: ValueFormatString, MaxLen: 8}
+	schema := NewSchema().AddOptions(URIPath, custom)
+
+	data := []byte(`[{"name":"URIPath","code":11,"format":"string","value":"test"},{"code":65001,"format":"string","value":"custom"}]`)
+
+	options, err := OptionsFromJSON(data, schema)
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	want := Options{
+		MustOptionValue(URIPath, "test"),
+		MustOptionValue(custom, "custom"),
+	}
+
+	diff := cmp.Diff(want, options, EquateOptions())
+	if diff != "" {
+		t.Errorf("options mismatch (-want +got):\n%s", diff)
+	}
+
+	// unrecognized by DefaultSchema, so the value is opaque
+	_, err = OptionsFromJSON(data, nil)
+	expectErr(t, err, InvalidOptionValueFormat{
+		OptionDef: UnrecognizedOptionDef(65001, MaxOptionLength),
+		Requested: ValueFormatString,
+	})
+
+	_, err = OptionsFromJSON([]byte(`[{"code":65001,"format":"string","value":"too long value"}]`), schema)
+	expectErr(t, err, InvalidOptionValueLength{
+		OptionDef: custom,
+		Length:    14,
+	})
+}
+
+func TestRequestResponseJSON(t *testing.T) {
+	req := &Request{
+		Type:      NonConfirmable,
+		Method:    GET,
+		MessageID: 1,
+		Token:     bytes4,
+		Path:      "/a",
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal("marshal request:", err)
+	}
+
+	want := `{"type":"NON","code":"0.01","id":1,"token":"deadbeef",` +
+		`"options":[{"name":"URIPath","code":11,"format":"string","value":"a"}]}`
+
+	diff := cmp.Diff(want, string(data))
+	if diff != "" {
+		t.Errorf("request json mismatch (-want +got):\n%s", diff)
+	}
+
+	resp := &Response{
+		Type:      Acknowledgement,
+		Code:      Content,
+		MessageID: 1,
+		Payload:   []byte{0x00, 0xff},
+	}
+
+	data, err = json.Marshal(resp)
+	if err != nil {
+		t.Fatal("marshal response:", err)
+	}
+
+	diff = cmp.Diff(`{"type":"ACK","code":"2.05","id":1,"payloadBase64":"AP8="}`, string(data))
+	if diff != "" {
+		t.Errorf("response json mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = json.Marshal(&Response{Code: ResponseCode(GET)})
+	if !isError[InvalidCode](err) {
+		t.Errorf("expected InvalidCode, got %v", err)
+	}
+}
+
+func TestTokenJSON(t *testing.T) {
+	req := &Request{
+		Type:      NonConfirmable,
+		Method:    GET,
+		MessageID: 1,
+		Token:     bytes4,
+	}
+
+	msg, err := req.message()
+	if err != nil {
+		t.Fatal("message:", err)
+	}
+
+	tokens := map[string]any{
+		"token":   req.Token,
+		"request": req,
+		"message": &msg,
+	}
+
+	for name, v := range tokens {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal %s: %v", name, err)
+		}
+
+		if !strings.Contains(string(data), `"deadbeef"`) {
+			t.Errorf("%s json %s, want hex token", name, data)
+		}
+	}
+
+	// the request is fed back as a message
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal("marshal request:", err)
+	}
+
+	decoded := &Message{}
+	err = json.Unmarshal(data, decoded)
+	if err != nil {
+		t.Fatal("unmarshal message:", err)
+	}
+
+	if !bytes.Equal(decoded.Token, req.Token) {
+		t.Errorf("token = %x, want %x", decoded.Token, req.Token)
+	}
+}
+
+func TestCodeUnmarshalText(t *testing.T) {
+	code := Code(0)
+	err := code.UnmarshalText([]byte("4.04"))
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	if code != Code(NotFound) {
+		t.Errorf("code = %s, want %s", code, Code(NotFound))
+	}
+
+	err = code.UnmarshalText([]byte("8.00"))
+	if err == nil {
+		t.Error("expected error for invalid class")
+	}
+}
+
+func TestSchemaJSON(t *testing.T) {
+	schema := NewSchema().
+		AddOptions(IfMatch, Size1).
+		AddMediaTypes(MediaTypeApplicationJSON, MediaTypeTextPlain)
+
+	want := `{"options":[` +
+		`{"name":"IfMatch","code":1,"format":"opaque","repeatable":true,"minLen":0,"maxLen":8,"critical":true,"unsafe":false,"noCacheKey":false,"display":"opaque[0..8]"},` +
+		`{"name":"Size1","code":60,"format":"uint","repeatable":false,"minLen":0,"maxLen":4,"critical":false,"unsafe":false,"noCacheKey":true,"display":"uint[0..4]"}` +
+		`],"mediaTypes":[` +
+		`{"name":"text/plain; charset=utf-8","code":0},` +
+		`{"name":"application/json","code":50}` +
+		`]}`
+
+	data, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	diff := cmp.Diff(want, string(data))
+	if diff != "" {
+		t.Errorf("json mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSchemaOverlayJSON(t *testing.T) {
+	schema := NewSchema().
+		AddOptions(IfMatch, ETag).
+		AddMediaTypes(MediaTypeTextPlain).
+		WithOverlay().
+		AddOptions(Size1).
+		MarkUnrecognized(ETag.Code).
+		AddMediaTypes(MediaTypeApplicationJSON)
+
+	want := `{"options":[` +
+		`{"name":"IfMatch","code":1,"format":"opaque","repeatable":true,"minLen":0,"maxLen":8,"critical":true,"unsafe":false,"noCacheKey":false,"display":"opaque[0..8]"},` +
+		`{"name":"Size1","code":60,"format":"uint","repeatable":false,"minLen":0,"maxLen":4,"critical":false,"unsafe":false,"noCacheKey":true,"display":"uint[0..4]"}` +
+		`],"mediaTypes":[` +
+		`{"name":"text/plain; charset=utf-8","code":0},` +
+		`{"name":"application/json","code":50}` +
+		`]}`
+
+	data, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	diff := cmp.Diff(want, string(data))
+	if diff != "" {
+		t.Errorf("json mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSchemaUnmarshalJSON(t *testing.T) {
+	schema := NewSchema().
+		AddOptions(IfMatch, Size1, UintOption(65001, "Vendor", 2)).
+		AddMediaTypes(MediaTypeApplicationJSON, MediaTypeTextPlain)
+
+	data, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	loaded := &Schema{}
+	err = json.Unmarshal(data, loaded)
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	diff := cmp.Diff(schema.Describe(), loaded.Describe())
+	if diff != "" {
+		t.Errorf("description mismatch (-want +got):\n%s", diff)
+	}
+
+	if loaded.Option(Size1.Code, 0).Name != "Size1" {
+		t.Errorf("Size1 not loaded")
+	}
+}
+
+func TestSchemaUnmarshalJSONError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{
+			name: "critical contradicts code",
+			data: `{"options":[{"name":"Vendor","code":65000,"format":"uint","maxLen":2,"critical":true}]}`,
+			err: OptionPropertyMismatch{
+				OptionDef: OptionDef{
+					Code:             65000,
+					Name:             "Vendor",
+					ValueFormat:      ValueFormatUint,
+					MaxLen:           2,
+					CriticalOverride: PropertyTrue,
+					UnsafeOverride:   PropertyFalse,
+				},
+				Property: "critical",
+			},
+		},
+		{
+			name: "inconsistent lengths",
+			data: `{"options":[{"name":"Vendor","code":65000,"format":"uint"}]}`,
+			err: InvalidOptionDef{
+				OptionDef: OptionDef{
+					Code:             65000,
+					Name:             "Vendor",
+					ValueFormat:      ValueFormatUint,
+					CriticalOverride: PropertyFalse,
+					UnsafeOverride:   PropertyFalse,
+				},
+				Reason: "uint format requires MaxLen between 1 and 4",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema := NewSchema().AddOptions(IfMatch)
+			err := json.Unmarshal([]byte(test.data), schema)
+			expectErr(t, err, test.err)
+
+			if schema.Option(IfMatch.Code, 0).Name != "IfMatch" {
+				t.Error("schema replaced on error")
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const (
+	// WellKnownCore is the path of the resource listing resources of a server in CoRE Link Format.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6690#section-4
+	WellKnownCore = "/.well-known/core"
+)
+
+// LinkValue is a link of a document in CoRE Link Format, such as a resource listed by WellKnownCore.
+//
+// https://datatracker.ietf.org/doc/html/rfc6690#section-2
+type LinkValue struct {
+	// Target is the URI reference of the link, usually a path of the server.
+	Target string
+
+	// Params holds link parameters in order of appearance, such as rt, if, ct or obs.
+	Params []LinkParam
+}
+
+// LinkParam is a parameter of a link.
+type LinkParam struct {
+	Name string
+
+	// Value is unquoted, empty if the parameter has no value, such as obs.
+	Value string
+}
+
+// Param returns the value of the first parameter with the name, compared case-insensitively.
+//
+// Returns false if the link has no such parameter.
+func (l LinkValue) Param(name string) (string, bool) {
+	i := slices.IndexFunc(l.Params, func(p LinkParam) bool {
+		return strings.EqualFold(p.Name, name)
+	})
+	if i == -1 {
+		return "", false
+	}
+
+	return l.Params[i].Value, true
+}
+
+// ParseLinkFormat parses a document in CoRE Link Format, whitespace between links is skipped.
+//
+// Returns MalformedLinkFormat if the document does not follow the format.
+//
+// https://datatracker.ietf.org/doc/html/rfc6690#section-2
+func ParseLinkFormat(data []byte) ([]LinkValue, error) {
+	p := linkParser{data: data}
+
+	p.skipSpace()
+	if p.eof() {
+		return nil, nil
+	}
+
+	links := []LinkValue{}
+	for {
+		link, err := p.link()
+		if err != nil {
+			return nil, err
+		}
+
+		links = append(links, link)
+
+		p.skipSpace()
+		if p.eof() {
+			return links, nil
+		}
+
+		if !p.consume(',') {
+			return nil, p.malformed("expected comma between links")
+		}
+
+		p.skipSpace()
+	}
+}
+
+// Discover requests the resources of the host listed by WellKnownCore and returns their links.
+//
+// The host may carry a port. Query parameters filter the links on the server, such as rt or if.
+// A response split in Block2 blocks is reassembled before it is parsed.
+//
+// Returns ResponseRejected if the server responds with a code other than Content.
+//
+// Returns MalformedLinkFormat if the response is not a document in CoRE Link Format.
+//
+// Returns PayloadTooLong if the reassembled response exceeds MaxReassemblyLength.
+//
+// Returns errors of ParseURL, Do and BlockTransferState.Check.
+//
+// https://datatracker.ietf.org/doc/html/rfc6690#section-4
+func (c *Client) Discover(ctx context.Context, host string, query url.Values) ([]LinkValue, error) {
+	u := &url.URL{
+		Scheme:   Scheme,
+		Host:     host,
+		Path:     WellKnownCore,
+		RawQuery: query.Encode(),
+	}
+
+	req, err := c.request(GET, u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	Must(req.Options.SetUint(Accept, uint32(MediaTypeApplicationLinkFormat.Code)))
+
+	resp, err := c.download(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseLinkFormat(resp.Payload)
+}
+
+// linkParser parses CoRE Link Format.
+type linkParser struct {
+	data   []byte
+	offset int
+}
+
+// link parses a link-value: "<" URI-Reference ">" *( ";" link-param ).
+func (p *linkParser) link() (LinkValue, error) {
+	if !p.consume('<') {
+		return LinkValue{}, p.malformed("expected link target")
+	}
+
+	end := bytes.IndexByte(p.data[p.offset:], '>')
+	if end == -1 {
+		return LinkValue{}, p.malformed("unterminated link target")
+	}
+
+	link := LinkValue{
+		Target: string(p.data[p.offset : p.offset+end]),
+	}
+	p.offset += end + 1
+
+	for p.consume(';') {
+		p.skipSpace()
+
+		param, err := p.param()
+		if err != nil {
+			return LinkValue{}, err
+		}
+
+		link.Params = append(link.Params, param)
+	}
+
+	return link, nil
+}
+
+// param parses a link-param: parmname [ "=" ( ptoken / quoted-string ) ].
+func (p *linkParser) param() (LinkParam, error) {
+	start := p.offset
+	for !p.eof() && isParamNameChar(p.data[p.offset]) {
+		p.offset++
+	}
+
+	if p.offset == start {
+		return LinkParam{}, p.malformed("expected parameter name")
+	}
+
+	param := LinkParam{
+		Name: string(p.data[start:p.offset]),
+	}
+
+	if !p.consume('=') {
+		return param, nil
+	}
+
+	if p.consume('"') {
+		value, err := p.quoted()
+		if err != nil {
+			return LinkParam{}, err
+		}
+
+		param.Value = value
+		return param, nil
+	}
+
+	start = p.offset
+	for !p.eof() && isParamTokenChar(p.data[p.offset]) {
+		p.offset++
+	}
+
+	if p.offset == start {
+		return LinkParam{}, p.malformed("expected parameter value")
+	}
+
+	param.Value = string(p.data[start:p.offset])
+
+	return param, nil
+}
+
+// quoted parses the rest of a quoted-string following the opening quote, resolving escapes.
+func (p *linkParser) quoted() (string, error) {
+	value := []byte{}
+	for !p.eof() {
+		b := p.data[p.offset]
+		p.offset++
+
+		switch {
+		case b == '"':
+			return string(value), nil
+		case b == '\\' && !p.eof():
+			value = append(value, p.data[p.offset])
+			p.offset++
+		default:
+			value = append(value, b)
+		}
+	}
+
+	return "", p.malformed("unterminated quoted string")
+}
+
+// consume advances past the byte if it is next.
+func (p *linkParser) consume(b byte) bool {
+	if p.eof() || p.data[p.offset] != b {
+		return false
+	}
+
+	p.offset++
+
+	return true
+}
+
+func (p *linkParser) skipSpace() {
+	for !p.eof() && strings.IndexByte(" \t\r\n", p.data[p.offset]) != -1 {
+		p.offset++
+	}
+}
+
+func (p *linkParser) eof() bool {
+	return p.offset >= len(p.data)
+}
+
+func (p *linkParser) malformed(reason string) error {
+	return MalformedLinkFormat{
+		Offset: uint(p.offset),
+		Reason: reason,
+	}
+}
+
+// isParamNameChar reports whether b may appear in a parameter name, including "*" of extended names.
+//
+// https://datatracker.ietf.org/doc/html/rfc5988#section-5
+func isParamNameChar(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' ||
+		strings.IndexByte("!#$&+-.^_`|~*", b) != -1
+}
+
+// isParamTokenChar reports whether b may appear in an unquoted parameter value.
+//
+// https://datatracker.ietf.org/doc/html/rfc6690#section-2
+func isParamTokenChar(b byte) bool {
+	return '!' <= b && b <= '~' && strings.IndexByte(`",;\`, b) == -1
+}
@@ -0,0 +1,256 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseLinkFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		links []LinkValue
+		err   error
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "well-known core",
+			data: `</sensors>;ct=40;title="Sensor Index",</sensors/temp>;rt="temperature-c";if="sensor";obs,` +
+				`<http://www.example.com/sensors/t123>;anchor="/sensors/temp";rel="describedby"`,
+			links: []LinkValue{
+				{
+					Target: "/sensors",
+					Params: []LinkParam{{"ct", "40"}, {"title", "Sensor Index"}},
+				},
+				{
+					Target: "/sensors/temp",
+					Params: []LinkParam{{"rt", "temperature-c"}, {"if", "sensor"}, {"obs", ""}},
+				},
+				{
+					Target: "http://www.example.com/sensors/t123",
+					Params: []LinkParam{{"anchor", "/sensors/temp"}, {"rel", "describedby"}},
+				},
+			},
+		},
+		{
+			name: "whitespace and escapes",
+			data: "</a>; title=\"say \\\"hi\\\"\",\n</b>;title*=UTF-8'de'n%c3%a4chstes\n",
+			links: []LinkValue{
+				{
+					Target: "/a",
+					Params: []LinkParam{{"title", `say "hi"`}},
+				},
+				{
+					Target: "/b",
+					Params: []LinkParam{{"title*", "UTF-8'de'n%c3%a4chstes"}},
+				},
+			},
+		},
+		{
+			name: "missing target",
+			data: "/a;rt=x",
+			err:  MalformedLinkFormat{Offset: 0, Reason: "expected link target"},
+		},
+		{
+			name: "unterminated target",
+			data: "</a;rt=x",
+			err:  MalformedLinkFormat{Offset: 1, Reason: "unterminated link target"},
+		},
+		{
+			name: "missing comma",
+			data: "</a></b>",
+			err:  MalformedLinkFormat{Offset: 4, Reason: "expected comma between links"},
+		},
+		{
+			name: "trailing comma",
+			data: "</a>,",
+			err:  MalformedLinkFormat{Offset: 5, Reason: "expected link target"},
+		},
+		{
+			name: "missing parameter name",
+			data: "</a>;=x",
+			err:  MalformedLinkFormat{Offset: 5, Reason: "expected parameter name"},
+		},
+		{
+			name: "missing parameter value",
+			data: "</a>;rt=,</b>",
+			err:  MalformedLinkFormat{Offset: 8, Reason: "expected parameter value"},
+		},
+		{
+			name: "unterminated quoted string",
+			data: `</a>;title="x`,
+			err:  MalformedLinkFormat{Offset: 13, Reason: "unterminated quoted string"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			links, err := ParseLinkFormat([]byte(test.data))
+			expectErr(t, err, test.err)
+
+			diff := cmp.Diff(test.links, links)
+			if diff != "" {
+				t.Errorf("links mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLinkValueParam(t *testing.T) {
+	link := LinkValue{
+		Target: "/temp",
+		Params: []LinkParam{{"rt", "temperature"}, {"obs", ""}, {"RT", "other"}},
+	}
+
+	value, ok := link.Param("Rt")
+	if !ok || value != "temperature" {
+		t.Errorf("Param(Rt) = %q, %v, want %q, true", value, ok, "temperature")
+	}
+
+	value, ok = link.Param("obs")
+	if !ok || value != "" {
+		t.Errorf("Param(obs) = %q, %v, want empty, true", value, ok)
+	}
+
+	_, ok = link.Param("ct")
+	if ok {
+		t.Error("Param(ct) found")
+	}
+}
+
+func TestClientDiscover(t *testing.T) {
+	// enough sensors for the document to span several blocks
+	sensors := []LinkValue{}
+	for i := range 40 {
+		rt := "temperature"
+		if i%4 == 0 {
+			rt = "light"
+		}
+
+		sensors = append(sensors, LinkValue{
+			Target: fmt.Sprintf("/sensors/%02d", i),
+			Params: []LinkParam{{"rt", rt}, {"if", "sensor"}, {"obs", ""}},
+		})
+	}
+
+	requests := atomic.Int32{}
+	mux := NewServeMux()
+	Must(mux.HandleFunc(WellKnownCore, func(_ context.Context, w ResponseWriter, req *Request) {
+		requests.Add(1)
+
+		accept, err := req.Options.GetUint(Accept)
+		if err != nil || accept != uint32(MediaTypeApplicationLinkFormat.Code) {
+			_ = w.Write(&Response{Code: NotAcceptable})
+			return
+		}
+
+		doc := []string{}
+		for _, link := range sensors {
+			rt, _ := link.Param("rt")
+			if len(req.Query) != 0 && !slices.Contains(req.Query, "rt="+rt) {
+				continue
+			}
+
+			doc = append(doc, fmt.Sprintf(`<%s>;rt="%s";if="sensor";obs`, link.Target, rt))
+		}
+
+		_ = w.Write(&Response{
+			Code:          Content,
+			ContentFormat: &MediaTypeApplicationLinkFormat,
+			Body:          bytes.NewReader([]byte(strings.Join(doc, ","))),
+		})
+	}))
+
+	host := strings.TrimPrefix(clientServer(t, mux), "coap://")
+
+	client := &Client{}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	links, err := client.Discover(ctx, host, nil)
+	if err != nil {
+		t.Fatal("discover:", err)
+	}
+
+	diff := cmp.Diff(sensors, links)
+	if diff != "" {
+		t.Errorf("links mismatch (-want +got):\n%s", diff)
+	}
+
+	if n := requests.Load(); n < 2 {
+		t.Errorf("requests = %d, want blockwise transfer", n)
+	}
+
+	links, err = client.Discover(ctx, host, url.Values{"rt": {"light"}})
+	if err != nil {
+		t.Fatal("discover:", err)
+	}
+
+	targets := []string{}
+	for _, link := range links {
+		targets = append(targets, link.Target)
+	}
+
+	diff = cmp.Diff([]string{"/sensors/00", "/sensors/04", "/sensors/08", "/sensors/12", "/sensors/16",
+		"/sensors/20", "/sensors/24", "/sensors/28", "/sensors/32", "/sensors/36"}, targets)
+	if diff != "" {
+		t.Errorf("filtered targets mismatch (-want +got):\n%s", diff)
+	}
+
+	links, err = client.Discover(ctx, host, url.Values{"rt": {"none"}})
+	if err != nil || len(links) != 0 {
+		t.Errorf("Discover() = %v, %v, want no links", links, err)
+	}
+
+	_, err = client.Discover(ctx, strings.TrimPrefix(clientServer(t, NewServeMux()), "coap://"), nil)
+	if !isError[ResponseRejected](err) {
+		t.Errorf("error = %v, want ResponseRejected", err)
+	}
+}
+
+func TestClientDiscoverTooLarge(t *testing.T) {
+	block := bytes.Repeat([]byte("x"), 1024)
+
+	// every block claims more to follow
+	mux := NewServeMux()
+	Must(mux.HandleFunc(WellKnownCore, func(_ context.Context, w ResponseWriter, req *Request) {
+		num := uint32(0)
+		if req.Block2 != nil {
+			num = req.Block2.Num
+		}
+
+		_ = w.Write(&Response{
+			Code:          Content,
+			ContentFormat: &MediaTypeApplicationLinkFormat,
+			Block2:        &BlockValue{Num: num, More: true, SZX: 6},
+			Payload:       block,
+		})
+	}))
+
+	host := strings.TrimPrefix(clientServer(t, mux), "coap://")
+
+	client := &Client{}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := client.Discover(ctx, host, nil)
+	expectErr(t, err, PayloadTooLong{
+		Limit:  MaxReassemblyLength,
+		Length: MaxReassemblyLength + 1024,
+	})
+}
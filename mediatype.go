@@ -1,6 +1,10 @@
 package coap
 
-import "fmt"
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
 
 // revive:disable:exported
 
@@ -27,10 +31,16 @@ var (
 	MediaTypeApplicationJSON        = MediaType{Code: 50, Name: `application/json`}
 	MediaTypeApplicationCBOR        = MediaType{Code: 60, Name: `application/cbor`}
 	MediaTypeApplicationCBORSeq     = MediaType{Code: 63, Name: `application/cbor-seq`}
+
+	// https://datatracker.ietf.org/doc/html/rfc9290#section-6.3
+	MediaTypeApplicationConciseProblemDetails = MediaType{Code: 257, Name: `application/concise-problem-details+cbor`}
 )
 
 // revive:enable:exported
 
+// SniffLength is the length of the payload prefix inspected by SniffMediaType.
+const SniffLength = 512
+
 // MediaType indicates payload media type.
 type MediaType struct {
 	Code uint16
@@ -57,3 +67,127 @@ func (m MediaType) String() string {
 
 	return m.Name
 }
+
+// checkContentFormat returns UnknownMediaType if StrictSemantics is set and the schema does not define
+// the media type.
+func checkContentFormat(mediaType *MediaType, opts MarshalOptions) error {
+	if mediaType == nil || !opts.StrictSemantics {
+		return nil
+	}
+
+	if opts.Schema == nil {
+		opts.Schema = DefaultSchema
+	}
+
+	if !opts.Schema.MediaType(mediaType.Code).Recognized() {
+		return UnknownMediaType{
+			Code: mediaType.Code,
+		}
+	}
+
+	return nil
+}
+
+// SniffMediaType guesses the media type of the payload from its first SniffLength bytes, for peers
+// omitting the ContentFormat option.
+//
+// A JSON object or array is detected as MediaTypeApplicationJSON, a CBOR array, map or tag as
+// MediaTypeApplicationCBOR, printable UTF-8 as MediaTypeTextPlain, in that order, anything else as
+// MediaTypeApplicationOctetStream.
+func SniffMediaType(payload []byte) MediaType {
+	prefix := payload[:min(len(payload), SniffLength)]
+
+	switch {
+	case sniffJSON(prefix):
+		return MediaTypeApplicationJSON
+	case sniffCBOR(prefix):
+		return MediaTypeApplicationCBOR
+	case sniffText(prefix):
+		return MediaTypeTextPlain
+	default:
+		return MediaTypeApplicationOctetStream
+	}
+}
+
+// sniffJSON indicates whether the data starts with a JSON object or array followed by the start
+// of a member or element.
+func sniffJSON(data []byte) bool {
+	data = skipJSONSpace(data)
+	if len(data) == 0 {
+		return false
+	}
+
+	open := data[0]
+	if open != '{' && open != '[' {
+		return false
+	}
+
+	data = skipJSONSpace(data[1:])
+	if len(data) == 0 {
+		return true // prefix ends within whitespace
+	}
+
+	switch c := data[0]; {
+	case open == '{':
+		return c == '"' || c == '}'
+	case c == ']', c == '{', c == '[', c == '"', c == '-', c >= '0' && c <= '9':
+		return true
+	default:
+		return c == 't' || c == 'f' || c == 'n'
+	}
+}
+
+// skipJSONSpace returns the data following JSON whitespace.
+func skipJSONSpace(data []byte) []byte {
+	for len(data) > 0 && (data[0] == ' ' || data[0] == '\t' || data[0] == '\n' || data[0] == '\r') {
+		data = data[1:]
+	}
+
+	return data
+}
+
+// sniffText indicates whether the data is printable UTF-8, a rune truncated at the end is allowed.
+func sniffText(data []byte) bool {
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			return true
+		}
+
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			return false
+		}
+
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+
+		data = data[size:]
+	}
+
+	return true
+}
+
+// sniffCBOR indicates whether the data starts with a well-formed CBOR array, map or tag head.
+//
+// https://datatracker.ietf.org/doc/html/rfc8949#section-3
+func sniffCBOR(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1F
+	switch {
+	case major < 4 || major > 6:
+		return false
+	case info >= 28 && info <= 30:
+		return false // reserved
+	case info == 31:
+		return major != 6 // indefinite length arrays and maps only
+	case info >= 24:
+		return len(data) >= 1+1<<(info-24) // argument follows
+	default:
+		return true
+	}
+}
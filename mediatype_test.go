@@ -1,6 +1,9 @@
 package coap
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
 
 func TestMediaType_RecognizedAndString(t *testing.T) {
 	tests := []struct {
@@ -34,3 +37,49 @@ func TestMediaType_RecognizedAndString(t *testing.T) {
 		})
 	}
 }
+
+func TestSniffMediaType(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		expect  MediaType
+	}{
+		{"json object", []byte(`{"temp": 21.5}`), MediaTypeApplicationJSON},
+		{"json empty object", []byte(`{}`), MediaTypeApplicationJSON},
+		{"json array with whitespace", []byte("\r\n [\n\t1, 2]"), MediaTypeApplicationJSON},
+		{"json array of literals", []byte(`[true]`), MediaTypeApplicationJSON},
+		{"json object without member", []byte(`{temp}`), MediaTypeTextPlain},
+		{"text", []byte("21.5 C"), MediaTypeTextPlain},
+		{"text utf-8", []byte("21,5 °C"), MediaTypeTextPlain},
+		{"cbor tag before text", []byte("é"), MediaTypeApplicationCBOR},
+		{"cbor map", []byte{0xA1, 0x61, 0x61, 0x01}, MediaTypeApplicationCBOR},
+		{"cbor indefinite array", []byte{0x9F, 0x01, 0xFF}, MediaTypeApplicationCBOR},
+		{"cbor self-described", []byte{0xD9, 0xD9, 0xF7, 0xA0}, MediaTypeApplicationCBOR},
+		{"cbor truncated argument", []byte{0x99, 0x01}, MediaTypeApplicationOctetStream},
+		{"cbor reserved", []byte{0x9C, 0x00}, MediaTypeApplicationOctetStream},
+		{"cbor indefinite tag", []byte{0xDF, 0x00}, MediaTypeApplicationOctetStream},
+		{"binary", []byte{0x00, 0x01, 0x02}, MediaTypeApplicationOctetStream},
+		{"invalid utf-8", []byte{0x61, 0xFF}, MediaTypeApplicationOctetStream},
+		{"prefix only", append(bytes.Repeat([]byte("a"), SniffLength), 0x00), MediaTypeTextPlain},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mediaType := SniffMediaType(test.payload)
+			if mediaType != test.expect {
+				t.Errorf("SniffMediaType() = %+v, want %+v", mediaType, test.expect)
+			}
+		})
+	}
+}
+
+func TestSniffMediaTypeAllocs(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = SniffMediaType(payload)
+	})
+	if allocs != 0 {
+		t.Errorf("allocs = %v, want 0", allocs)
+	}
+}
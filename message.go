@@ -1,6 +1,9 @@
 package coap
 
-import "slices"
+import (
+	"io"
+	"slices"
+)
 
 const (
 	// MaxMessageLength is the default maximum length of entire message.
@@ -19,11 +22,31 @@ const (
 	PayloadMarker = 0xFF
 )
 
+// readBody reads the body of a message sent in a single datagram, at most one byte more than
+// MaxPayloadLength and MaxMessageLength allow, so that Encode reports the overflow.
+func readBody(body io.Reader, opts MarshalOptions) ([]byte, error) {
+	limit := uint(MaxPayloadLength)
+	if opts.MaxPayloadLength != 0 {
+		limit = opts.MaxPayloadLength
+	}
+
+	if opts.MaxMessageLength != 0 {
+		limit = min(limit, opts.MaxMessageLength)
+	}
+
+	return io.ReadAll(io.LimitReader(body, int64(limit)+1))
+}
+
 // Message represents a CoAP message, which includes a header, options, and an optional payload.
 type Message struct {
 	Header
 	Options
 
+	// RawOptions holds encoded options when decoded with MarshalOptions.Lazy.
+	//
+	// RawOptions are encoded verbatim if Options is empty.
+	RawOptions RawOptions
+
 	Payload []byte
 }
 
@@ -43,8 +66,63 @@ type MarshalOptions struct {
 
 	// MaxOptionLength is the maximum size of an individual option.
 	MaxOptionLength uint16
+
+	// Lazy decodes options into RawOptions instead of Options.
+	Lazy bool
+
+	// Duplicates selects how encoding handles a non-repeatable option appearing more than once.
+	Duplicates DuplicatePolicy
+
+	// OnDuplicate is called for each occurrence dropped by DuplicateKeepLast.
+	OnDuplicate func(opt Option)
+
+	// StrictSemantics enables validation of option values against request/response semantics
+	// and rejects a payload on codes that forbid it.
+	StrictSemantics bool
+
+	// StrictPayloadMarker rejects a payload marker followed by an empty payload with MalformedPayloadMarker,
+	// which RFC 7252 requires to be processed as a message format error. Encoding never writes one.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7252#section-3
+	StrictPayloadMarker bool
+
+	// SniffContentFormat sets ContentFormat of decoded responses lacking the ContentFormat option
+	// but carrying a payload to the media type guessed by SniffMediaType.
+	SniffContentFormat bool
+
+	// LenientFormat keeps options whose value length does not match their definition as opaque
+	// under UnrecognizedOptionDef instead of failing decoding with InvalidOptionValueLength,
+	// for interoperability with noncompliant peers. Values exceeding MaxOptionLength are still rejected.
+	//
+	// Such options are kept even if elective, the critical ones are left to the application to reject.
+	LenientFormat bool
+
+	// Interner, if set, provides the values of string options decoded by Options.Decode, so that equal
+	// values such as URIPath segments share storage across messages. Opaque values are not interned.
+	Interner StringInterner
+
+	// OptionHook is called by Options.Decode for each decoded option in wire order, before
+	// unrecognized elective options are dropped. It is not called for Lazy decoding.
+	//
+	// The hook may rewrite the option in place, drop it by returning false, or abort decoding
+	// by returning an error. raw holds the encoded option and aliases the input only for the duration of the call.
+	OptionHook func(opt *Option, raw []byte) (keep bool, err error)
 }
 
+// DuplicatePolicy selects how encoding handles a recognized non-repeatable option appearing more than once.
+type DuplicatePolicy uint8
+
+const (
+	// DuplicateAllow encodes all occurrences as they are, receivers may treat the repeated option as unrecognized.
+	DuplicateAllow DuplicatePolicy = iota
+
+	// DuplicateReject fails encoding with OptionNotRepeateable.
+	DuplicateReject
+
+	// DuplicateKeepLast keeps only the last occurrence, dropped occurrences are passed to OnDuplicate.
+	DuplicateKeepLast
+)
+
 // MarshalBinary implements encoding.BinaryMarshaler
 func (m *Message) MarshalBinary() ([]byte, error) {
 	data, err := m.AppendBinary(nil)
@@ -53,21 +131,205 @@ func (m *Message) MarshalBinary() ([]byte, error) {
 
 // AppendBinary implements encoding.BinaryAppender
 func (m *Message) AppendBinary(data []byte) ([]byte, error) {
-	data, err := m.Header.AppendBinary(data)
+	return m.Encode(data, MarshalOptions{})
+}
+
+// Encode appends the CoAP message to the provided data slice using the given options.
+//
+// Limits are checked before anything is appended, data is returned unchanged on error.
+//
+// Returns OptionNotRepeateable if Duplicates is DuplicateReject and a non-repeatable option is repeated.
+//
+// Returns TooManyOptions if the number of options exceeds the maximum.
+//
+// Returns InvalidOptionValueLength if an option value length is out of bounds.
+//
+// Returns PayloadTooLong if the payload exceeds the maximum length.
+//
+// Returns PayloadNotAllowed if StrictSemantics is set and the code forbids a payload.
+//
+// Returns MessageTooLong if the encoded message exceeds the maximum length.
+func (m *Message) Encode(data []byte, opts MarshalOptions) ([]byte, error) {
+	if opts.MaxMessageLength == 0 {
+		opts.MaxMessageLength = MaxMessageLength
+	}
+
+	if opts.MaxPayloadLength == 0 {
+		opts.MaxPayloadLength = MaxPayloadLength
+	}
+
+	if opts.MaxOptions == 0 {
+		opts.MaxOptions = MaxOptions
+	}
+
+	if opts.MaxOptionLength == 0 {
+		opts.MaxOptionLength = MaxOptionLength
+	}
+
+	options, err := dedupOptions(m.Options, opts)
+	if err != nil {
+		return data, err
+	}
+
+	if len(options) > int(opts.MaxOptions) {
+		return data, TooManyOptions{
+			Limit:  opts.MaxOptions,
+			Length: uint(len(options)),
+		}
+	}
+
+	if len(options) == 0 {
+		_, err = checkRawOptions(m.RawOptions, opts)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	for _, opt := range options {
+		length := opt.Length()
+		if length < opt.MinLen || length > min(opt.MaxLen, opts.MaxOptionLength) {
+			return data, InvalidOptionValueLength{
+				OptionDef: opt.OptionDef,
+				Length:    length,
+			}
+		}
+	}
+
+	if len(m.Payload) > int(opts.MaxPayloadLength) {
+		return data, PayloadTooLong{
+			Limit:  opts.MaxPayloadLength,
+			Length: uint(len(m.Payload)),
+		}
+	}
+
+	if opts.StrictSemantics && len(m.Payload) != 0 && !m.Code.PayloadAllowed() {
+		return data, PayloadNotAllowed{
+			Code: m.Code,
+		}
+	}
+
+	start := len(data)
+	data, err = m.Header.AppendBinary(data)
 	if err != nil {
 		return data, err
 	}
 
-	data = m.Options.Encode(data)
+	if len(options) == 0 {
+		data = append(data, m.RawOptions...)
+	} else {
+		data = options.Encode(data)
+	}
 
 	if len(m.Payload) != 0 {
 		data = append(data, PayloadMarker)
 		data = append(data, m.Payload...)
 	}
 
+	length := len(data) - start
+	if length > int(opts.MaxMessageLength) {
+		return data[:start], MessageTooLong{
+			Limit:  opts.MaxMessageLength,
+			Length: uint(length),
+		}
+	}
+
 	return data, nil
 }
 
+// EncodedHeader returns the encoded 4-byte header followed by the token, exactly as put on the wire.
+//
+// Returns UnsupportedVersion or UnsupportedTokenLength if the header cannot be encoded.
+func (m *Message) EncodedHeader() ([]byte, error) {
+	return m.Header.AppendBinary(make([]byte, 0, HeaderLength+len(m.Token)))
+}
+
+// Size returns the length of the encoded message, limits are not checked.
+func (m *Message) Size() int {
+	size := HeaderLength + len(m.Token)
+
+	if len(m.Options) == 0 {
+		size += len(m.RawOptions)
+	} else {
+		size += len(m.Options.Encode(nil))
+	}
+
+	if len(m.Payload) != 0 {
+		size += 1 + len(m.Payload)
+	}
+
+	return size
+}
+
+// Method returns the code as a request method.
+//
+// Returns false if the code is not of the request class.
+func (m *Message) Method() (Method, bool) {
+	if !m.Code.IsRequest() {
+		return 0, false
+	}
+
+	return Method(m.Code), true
+}
+
+// ResponseCode returns the code as a response code.
+//
+// Returns false if the code is not of a response class.
+func (m *Message) ResponseCode() (ResponseCode, bool) {
+	if !m.Code.IsResponse() {
+		return 0, false
+	}
+
+	return ResponseCode(m.Code), true
+}
+
+// Reply rewrites the received message in place into the reply to it and returns it, reusing its storage
+// instead of allocating a new Message.
+//
+// A Confirmable message is answered by an Acknowledgement with the same MessageID, carrying a piggybacked
+// response or nothing if code is empty. Other messages are answered by a NonConfirmable message with zero
+// MessageID to be assigned when written. The Token slice is kept for responses, Options and RawOptions
+// are truncated keeping their capacity.
+//
+// The message must not be used as the request afterwards, decoded requests such as Request share its storage.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.2
+func (m *Message) Reply(code Code, payload []byte) *Message {
+	if m.Type == Confirmable {
+		m.Type = Acknowledgement
+	} else {
+		m.Type = NonConfirmable
+		m.ID = 0
+	}
+
+	if code.IsEmpty() {
+		m.Token = m.Token[:0]
+	}
+
+	m.Version = ProtocolVersion
+	m.Code = code
+	m.Options = m.Options[:0]
+	m.RawOptions = m.RawOptions[:0]
+	m.Payload = payload
+
+	return m
+}
+
+// Reject rewrites the received message in place into the Reset rejecting it and returns it,
+// reusing its storage like Reply.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-4.2
+func (m *Message) Reject() *Message {
+	m.Version = ProtocolVersion
+	m.Type = Reset
+	m.Code = 0
+	m.Token = m.Token[:0]
+	m.Options = m.Options[:0]
+	m.RawOptions = m.RawOptions[:0]
+	m.Payload = nil
+
+	return m
+}
+
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
 func (m *Message) UnmarshalBinary(data []byte) error {
 	_, err := m.Decode(data, MarshalOptions{})
@@ -76,13 +338,19 @@ func (m *Message) UnmarshalBinary(data []byte) error {
 
 // Decode decodes the CoAP message from the provided data slice using the given schema.
 //
-// Returns the remaining data after the message.
+// Returns the remaining data after the message. On error the remaining data follows the bytes consumed before
+// the error, len(data) minus its length, matching Offset of UnmarshalError, so that a stream framer knows where
+// decoding stopped. Remaining data starts at the payload for PayloadTooLong and PayloadNotAllowed, and is data
+// itself for MessageTooLong.
 //
 // Returns MessageTooLong if the message exceeds the maximum length.
 //
 // Returns PayloadTooLong if the payload exceeds the maximum length.
 //
-// Returns UnmarshalError if there is an error decoding the header or options.
+// Returns PayloadNotAllowed if StrictSemantics is set and the code forbids a payload.
+//
+// Returns UnmarshalError if there is an error decoding the header or options, or MalformedPayloadMarker
+// wrapped in UnmarshalError if the payload marker is malformed.
 func (m *Message) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 	if opts.MaxMessageLength == 0 {
 		opts.MaxMessageLength = MaxMessageLength
@@ -108,7 +376,13 @@ func (m *Message) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 		}
 	}
 
-	data, err = m.Options.Decode(data, opts)
+	if opts.Lazy {
+		m.Options = nil
+		data, err = m.RawOptions.Decode(data, opts)
+	} else {
+		m.RawOptions = nil
+		data, err = m.Options.Decode(data, opts)
+	}
 	if err != nil {
 		return data, UnmarshalError{
 			Offset: uint(length - len(data)),
@@ -120,7 +394,20 @@ func (m *Message) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 		return data, nil // no payload
 	}
 
-	data = data[1:] // remove payload marker
+	offset := uint(length - len(data))
+	data, err = decodePayloadMarker(data, opts.StrictPayloadMarker)
+	if err != nil {
+		return data, UnmarshalError{
+			Offset: offset,
+			Cause:  err,
+		}
+	}
+
+	if opts.StrictSemantics && !m.Code.PayloadAllowed() {
+		return data, PayloadNotAllowed{
+			Code: m.Code,
+		}
+	}
 
 	if len(data) > int(opts.MaxPayloadLength) {
 		return data, PayloadTooLong{
@@ -134,3 +421,69 @@ func (m *Message) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 
 	return data, nil
 }
+
+// decodePayloadMarker removes the payload marker following options.
+//
+// Returns MalformedPayloadMarker if the byte is not PayloadMarker, or if strict is set and no payload follows it.
+func decodePayloadMarker(data []byte, strict bool) ([]byte, error) {
+	if data[0] != PayloadMarker {
+		return data, MalformedPayloadMarker{
+			Byte: data[0],
+		}
+	}
+
+	if strict && len(data) == 1 {
+		return data, MalformedPayloadMarker{
+			Byte: data[0],
+		}
+	}
+
+	return data[1:], nil
+}
+
+// dedupOptions applies the duplicate policy to recognized non-repeatable options.
+func dedupOptions(options Options, opts MarshalOptions) (Options, error) {
+	if opts.Duplicates == DuplicateAllow {
+		return options, nil
+	}
+
+	var dropped []int
+	for i, opt := range options {
+		if opt.Repeatable || !opt.Recognized() {
+			continue
+		}
+
+		next := slices.IndexFunc(options[i+1:], func(o Option) bool {
+			return o.Code == opt.Code
+		})
+		if next == -1 {
+			continue
+		}
+
+		if opts.Duplicates == DuplicateReject {
+			return nil, OptionNotRepeateable{
+				OptionDef: opt.OptionDef,
+			}
+		}
+
+		dropped = append(dropped, i)
+	}
+
+	if len(dropped) == 0 {
+		return options, nil
+	}
+
+	kept := make(Options, 0, len(options)-len(dropped))
+	for i, opt := range options {
+		if slices.Contains(dropped, i) {
+			if opts.OnDuplicate != nil {
+				opts.OnDuplicate(opt)
+			}
+			continue
+		}
+
+		kept = append(kept, opt)
+	}
+
+	return kept, nil
+}
@@ -1,6 +1,9 @@
 package coap
 
 import (
+	"bytes"
+	"errors"
+	"runtime"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -22,7 +25,19 @@ func FuzzMessageDecode(f *testing.F) {
 			MaxOptions:       128,
 			MaxOptionLength:  1034,
 		}
-		_, err := msg.Decode(data, opts)
+		rest, err := msg.Decode(data, opts)
+
+		// remaining data is a suffix of data even on error, consumed bytes match the error offset
+		consumed := len(data) - len(rest)
+		if consumed < 0 || !bytes.Equal(data[consumed:], rest) {
+			t.Fatalf("remaining data is not a suffix of data")
+		}
+
+		var unmarshalErr UnmarshalError
+		if errors.As(err, &unmarshalErr) && int(unmarshalErr.Offset) != consumed {
+			t.Errorf("offset %d, consumed %d bytes", unmarshalErr.Offset, consumed)
+		}
+
 		if err != nil {
 			t.SkipNow()
 		}
@@ -157,14 +172,16 @@ func TestMessageRoundtrip(t *testing.T) {
 
 func TestMessageDecodeError(t *testing.T) {
 	tests := []struct {
-		name string
-		data []byte
-		opts MarshalOptions
-		err  error
+		name     string
+		data     []byte
+		consumed int
+		opts     MarshalOptions
+		err      error
 	}{
 		{
-			name: "unknown version",
-			data: []byte{0x84, 0x45, 0x13, 0xFD, 0xD0, 0xE2, 0x4D, 0xAC},
+			name:     "unknown version",
+			data:     []byte{0x84, 0x45, 0x13, 0xFD, 0xD0, 0xE2, 0x4D, 0xAC},
+			consumed: 0,
 			err: UnmarshalError{
 				Offset: 0,
 				Cause: UnsupportedVersion{
@@ -173,8 +190,9 @@ func TestMessageDecodeError(t *testing.T) {
 			},
 		},
 		{
-			name: "unsupported token length",
-			data: []byte{0x6c, 0x45, 0x13, 0xFD, 0xD0, 0xE2, 0x4D, 0xAC, 0x4D, 0xAC},
+			name:     "unsupported token length",
+			data:     []byte{0x6c, 0x45, 0x13, 0xFD, 0xD0, 0xE2, 0x4D, 0xAC, 0x4D, 0xAC},
+			consumed: 4,
 			err: UnmarshalError{
 				Offset: 4,
 				Cause: UnsupportedTokenLength{
@@ -183,8 +201,9 @@ func TestMessageDecodeError(t *testing.T) {
 			},
 		},
 		{
-			name: "truncated header",
-			data: []byte{0x64, 0x45},
+			name:     "truncated header",
+			data:     []byte{0x64, 0x45},
+			consumed: 0,
 			err: UnmarshalError{
 				Offset: 0,
 				Cause: TruncatedError{
@@ -193,8 +212,9 @@ func TestMessageDecodeError(t *testing.T) {
 			},
 		},
 		{
-			name: "truncated token",
-			data: []byte{0x64, 0x45, 0x13, 0xFD, 0xD0, 0xE2},
+			name:     "truncated token",
+			data:     []byte{0x64, 0x45, 0x13, 0xFD, 0xD0, 0xE2},
+			consumed: 4,
 			err: UnmarshalError{
 				Offset: 4,
 				Cause: TruncatedError{
@@ -208,6 +228,7 @@ func TestMessageDecodeError(t *testing.T) {
 				0x64, 0x45, 0x13, 0xFD, 0xD0, 0xE2, 0x4D, 0xAC, // Header
 				0xD3, 0x01, 0x42, // Truncated MaxAge
 			},
+			consumed: 10,
 			err: UnmarshalError{
 				Offset: 10,
 				Cause: TruncatedError{
@@ -215,12 +236,28 @@ func TestMessageDecodeError(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "repeated critical option",
+			data: []byte{
+				0x40, 0x01, 0x13, 0xFD, // Header
+				0x31, 0x61, // URIHost "a"
+				0x01, 0x62, // URIHost "b"
+			},
+			consumed: 8,
+			err: UnmarshalError{
+				Offset: 8,
+				Cause: OptionNotRepeateable{
+					OptionDef: URIHost,
+				},
+			},
+		},
 		{
 			name: "message too long",
 			data: []byte{
 				0x64, 0x45, 0x13, 0xFD, 0xD0, 0xE2, 0x4D, 0xAC, // Header
 				0xFF, 0x48, 0x65, 0x6C, 0x6C, 0x6F, // Payload "Hello"
 			},
+			consumed: 0,
 			opts: MarshalOptions{
 				MaxMessageLength: 10,
 			},
@@ -235,6 +272,7 @@ func TestMessageDecodeError(t *testing.T) {
 				0x64, 0x45, 0x13, 0xFD, 0xD0, 0xE2, 0x4D, 0xAC, // Header
 				0xFF, 0x48, 0x65, 0x6C, 0x6C, 0x6F, // Payload "Hello"
 			},
+			consumed: 9,
 			opts: MarshalOptions{
 				MaxPayloadLength: 2,
 			},
@@ -243,16 +281,88 @@ func TestMessageDecodeError(t *testing.T) {
 				Length: 5,
 			},
 		},
+		{
+			name: "payload on valid",
+			data: []byte{
+				0x64, 0x43, 0x13, 0xFD, 0xD0, 0xE2, 0x4D, 0xAC, // Header 2.03
+				0xFF, 0x48, 0x65, 0x6C, 0x6C, 0x6F, // Payload "Hello"
+			},
+			consumed: 9,
+			opts: MarshalOptions{
+				StrictSemantics: true,
+			},
+			err: PayloadNotAllowed{
+				Code: Code(Valid),
+			},
+		},
+		{
+			name: "payload on valid, lenient",
+			data: []byte{
+				0x64, 0x43, 0x13, 0xFD, 0xD0, 0xE2, 0x4D, 0xAC, // Header 2.03
+				0xFF, 0x48, 0x65, 0x6C, 0x6C, 0x6F, // Payload "Hello"
+			},
+			consumed: 14,
+		},
+		{
+			name: "payload on empty",
+			data: []byte{
+				0x60, 0x00, 0x13, 0xFD, // Header 0.00
+				0xFF, 0x48, 0x65, 0x6C, 0x6C, 0x6F, // Payload "Hello"
+			},
+			consumed: 5,
+			opts: MarshalOptions{
+				StrictSemantics: true,
+			},
+			err: PayloadNotAllowed{
+				Code: 0,
+			},
+		},
+		{
+			name: "payload marker without payload",
+			data: []byte{
+				0x40, 0x01, 0x13, 0xFD, // Header
+				0xB1, 0x61, // URIPath "a"
+				0xFF, // Payload marker
+			},
+			consumed: 6,
+			opts: MarshalOptions{
+				StrictPayloadMarker: true,
+			},
+			err: UnmarshalError{
+				Offset: 6,
+				Cause: MalformedPayloadMarker{
+					Byte: PayloadMarker,
+				},
+			},
+		},
+		{
+			name: "payload marker without payload, lenient",
+			data: []byte{
+				0x40, 0x01, 0x13, 0xFD, // Header
+				0xFF, // Payload marker
+			},
+			consumed: 5,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			msg := &Message{}
-			_, err := msg.Decode(test.data, test.opts)
+			rest, err := msg.Decode(test.data, test.opts)
 
 			diff := cmp.Diff(test.err, err, cmpopts.EquateErrors())
 			if diff != "" {
 				t.Errorf("error mismatch (-want +got):\n%s", diff)
 			}
+
+			consumed := len(test.data) - len(rest)
+			if consumed != test.consumed {
+				t.Errorf("consumed %d bytes, want %d", consumed, test.consumed)
+			}
+
+			var unmarshalErr UnmarshalError
+			if errors.As(err, &unmarshalErr) && int(unmarshalErr.Offset) != consumed {
+				t.Errorf("offset %d, consumed %d bytes", unmarshalErr.Offset, consumed)
+			}
 		})
 	}
 }
@@ -296,3 +406,540 @@ func TestMessageMarshalError(t *testing.T) {
 		}
 	}
 }
+
+func TestMessageEncodeError(t *testing.T) {
+	header := Header{
+		Version: ProtocolVersion,
+		Type:    Confirmable,
+		Code:    Code(GET),
+		ID:      0x4242,
+		Token:   bytes4,
+	}
+
+	tests := []struct {
+		name string
+		msg  *Message
+		opts MarshalOptions
+		err  error
+	}{
+		{
+			name: "too many options",
+			msg: &Message{
+				Header: header,
+				Options: Options{
+					MustOptionValue(URIPath, "a"),
+					MustOptionValue(URIPath, "b"),
+					MustOptionValue(URIPath, "c"),
+				},
+			},
+			opts: MarshalOptions{
+				MaxOptions: 2,
+			},
+			err: TooManyOptions{
+				Limit:  2,
+				Length: 3,
+			},
+		},
+		{
+			name: "option value too long",
+			msg: &Message{
+				Header: header,
+				Options: Options{
+					MustOptionValue(URIHost, string(bytes16)),
+				},
+			},
+			opts: MarshalOptions{
+				MaxOptionLength: 8,
+			},
+			err: InvalidOptionValueLength{
+				OptionDef: URIHost,
+				Length:    16,
+			},
+		},
+		{
+			name: "option value too short",
+			msg: &Message{
+				Header: header,
+				Options: Options{
+					{OptionDef: ETag},
+				},
+			},
+			err: InvalidOptionValueLength{
+				OptionDef: ETag,
+				Length:    0,
+			},
+		},
+		{
+			name: "payload too long",
+			msg: &Message{
+				Header:  header,
+				Payload: bytes16,
+			},
+			opts: MarshalOptions{
+				MaxPayloadLength: 8,
+			},
+			err: PayloadTooLong{
+				Limit:  8,
+				Length: 16,
+			},
+		},
+		{
+			name: "message too long",
+			msg: &Message{
+				Header:  header,
+				Payload: bytes16,
+			},
+			opts: MarshalOptions{
+				MaxMessageLength: 16,
+			},
+			err: MessageTooLong{
+				Limit:  16,
+				Length: 25,
+			},
+		},
+		{
+			name: "repeated non-repeatable option",
+			msg: &Message{
+				Header: header,
+				Options: Options{
+					MustOptionValue(ContentFormat, uint32(MediaTypeApplicationJSON.Code)),
+					MustOptionValue(ContentFormat, uint32(MediaTypeApplicationCBOR.Code)),
+				},
+			},
+			opts: MarshalOptions{
+				Duplicates: DuplicateReject,
+			},
+			err: OptionNotRepeateable{
+				OptionDef: ContentFormat,
+			},
+		},
+		{
+			name: "payload on valid",
+			msg: &Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    Acknowledgement,
+					Code:    Code(Valid),
+					ID:      0x4242,
+					Token:   bytes4,
+				},
+				Payload: bytes4,
+			},
+			opts: MarshalOptions{
+				StrictSemantics: true,
+			},
+			err: PayloadNotAllowed{
+				Code: Code(Valid),
+			},
+		},
+		{
+			name: "payload on empty",
+			msg: &Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    Reset,
+					ID:      0x4242,
+				},
+				Payload: bytes4,
+			},
+			opts: MarshalOptions{
+				StrictSemantics: true,
+			},
+			err: PayloadNotAllowed{
+				Code: 0,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := test.msg.Encode(nil, test.opts)
+
+			diff := cmp.Diff(test.err, err, cmpopts.EquateErrors())
+			if diff != "" {
+				t.Errorf("error mismatch (-want +got):\n%s", diff)
+			}
+
+			if len(data) != 0 {
+				t.Errorf("unexpected data on error: %x", data)
+			}
+		})
+	}
+}
+
+// TestMessageEncodedHeader pins header encoding, changes break deployed signatures.
+func TestMessageEncodedHeader(t *testing.T) {
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			ID:      0x1234,
+			Token:   bytes4,
+		},
+		Options: Options{
+			MustOptionValue(URIPath, "a"),
+		},
+		Payload: bytes4,
+	}
+
+	data, err := msg.EncodedHeader()
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	diff := cmp.Diff([]byte{0x44, 0x01, 0x12, 0x34, 0xde, 0xad, 0xbe, 0xef}, data)
+	if diff != "" {
+		t.Error("encoded header mismatch (-want +got):\n", diff)
+	}
+
+	msg.Token = bytes16
+	_, err = msg.EncodedHeader()
+	expectErr(t, err, UnsupportedTokenLength{
+		Length: 16,
+	})
+}
+
+func TestMessageCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     Code
+		method   Method
+		isMethod bool
+		response ResponseCode
+		isResp   bool
+	}{
+		{
+			name: "empty",
+			code: 0,
+		},
+		{
+			name:     "method",
+			code:     Code(POST),
+			method:   POST,
+			isMethod: true,
+		},
+		{
+			name:     "response",
+			code:     Code(NotFound),
+			response: NotFound,
+			isResp:   true,
+		},
+		{
+			name: "signaling",
+			code: 0xe1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := &Message{
+				Header: Header{
+					Code: test.code,
+				},
+			}
+
+			method, ok := msg.Method()
+			if method != test.method || ok != test.isMethod {
+				t.Errorf("Method() = %v, %v, want %v, %v", method, ok, test.method, test.isMethod)
+			}
+
+			response, ok := msg.ResponseCode()
+			if response != test.response || ok != test.isResp {
+				t.Errorf("ResponseCode() = %v, %v, want %v, %v", response, ok, test.response, test.isResp)
+			}
+		})
+	}
+}
+
+func TestMessageSize(t *testing.T) {
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(Content),
+			Token:   bytes4,
+		},
+		Options: Options{
+			MustOptionValue(Size2, uint32(1000)),
+			MustOptionValue(ETag, bytes8),
+		},
+		Payload: bytes.Repeat([]byte{0x42}, MaxMessageLength),
+	}
+
+	data, err := msg.Encode(nil, MarshalOptions{
+		MaxMessageLength: 2 * MaxMessageLength,
+		MaxPayloadLength: MaxMessageLength,
+	})
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	if msg.Size() != len(data) {
+		t.Errorf("Size() = %d, want %d", msg.Size(), len(data))
+	}
+}
+
+func TestMessageDecodePayloadTooLongAllocs(t *testing.T) {
+	opts := MarshalOptions{
+		MaxPayloadLength: 1024,
+	}
+
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(Content),
+		},
+		Payload: make([]byte, 1025),
+	}
+
+	data, err := msg.AppendBinary(nil)
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	_, err = msg.Decode(data, opts)
+	expectErr(t, err, PayloadTooLong{
+		Limit:  1024,
+		Length: 1025,
+	})
+
+	// payload must not be cloned before the limit check
+	const runs = 100
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+	for range runs {
+		_, _ = msg.Decode(data, opts)
+	}
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&after)
+
+	perRun := (after.TotalAlloc - before.TotalAlloc) / runs
+	if perRun >= 1024 {
+		t.Errorf("decode allocated %d bytes per run, want less than payload limit", perRun)
+	}
+}
+
+func TestResponseEncodePayloadLimit(t *testing.T) {
+	resp := &Response{
+		Type:    Acknowledgement,
+		Code:    Content,
+		Payload: make([]byte, 200*1024),
+	}
+
+	data, err := resp.Encode(nil, MarshalOptions{})
+	expectErr(t, err, PayloadTooLong{
+		Limit:  MaxPayloadLength,
+		Length: 200 * 1024,
+	})
+
+	if len(data) != 0 {
+		t.Errorf("encoded %d bytes on error", len(data))
+	}
+
+	req := &Request{
+		Type:    Confirmable,
+		Method:  POST,
+		Payload: bytes16,
+	}
+
+	_, err = req.Encode(nil, MarshalOptions{
+		MaxPayloadLength: 8,
+	})
+	expectErr(t, err, PayloadTooLong{
+		Limit:  8,
+		Length: 16,
+	})
+}
+
+func TestMessageEncodeDuplicates(t *testing.T) {
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(POST),
+			ID:      0x4242,
+		},
+		Options: Options{
+			MustOptionValue(ContentFormat, uint32(MediaTypeApplicationJSON.Code)),
+			MustOptionValue(URIPath, "a"),
+			MustOptionValue(URIPath, "b"),
+			MustOptionValue(ContentFormat, uint32(MediaTypeApplicationCBOR.Code)),
+		},
+	}
+
+	allowed, err := msg.Encode(nil, MarshalOptions{})
+	if err != nil {
+		t.Fatal("encode allow:", err)
+	}
+
+	dropped := []Option{}
+	data, err := msg.Encode(nil, MarshalOptions{
+		Duplicates: DuplicateKeepLast,
+		OnDuplicate: func(opt Option) {
+			dropped = append(dropped, opt)
+		},
+	})
+	if err != nil {
+		t.Fatal("encode keep last:", err)
+	}
+
+	if len(data) >= len(allowed) {
+		t.Errorf("expected duplicate to be dropped, got %d bytes, allowed %d bytes", len(data), len(allowed))
+	}
+
+	decoded := &Message{}
+	_, err = decoded.Decode(data, MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	want := Options{
+		MustOptionValue(URIPath, "a"),
+		MustOptionValue(URIPath, "b"),
+		MustOptionValue(ContentFormat, uint32(MediaTypeApplicationCBOR.Code)),
+	}
+
+	diff := cmp.Diff(want, decoded.Options, EquateOptions())
+	if diff != "" {
+		t.Errorf("options mismatch (-want +got):\n%s", diff)
+	}
+
+	diff = cmp.Diff(Options{msg.Options[0]}, Options(dropped), EquateOptions())
+	if diff != "" {
+		t.Errorf("dropped mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestMessageReply(t *testing.T) {
+	request := func(typ Type) *Message {
+		return &Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    typ,
+				Code:    Code(GET),
+				ID:      0x4242,
+				Token:   bytes4,
+			},
+			Options: Options{
+				MustOptionValue(URIPath, "temp"),
+			},
+			Payload: []byte("request"),
+		}
+	}
+
+	tests := []struct {
+		name  string
+		reply func(msg *Message) *Message
+		req   *Message
+		want  []byte
+	}{
+		{
+			name: "piggybacked",
+			reply: func(msg *Message) *Message {
+				return msg.Reply(Code(Content), []byte("21.5"))
+			},
+			req:  request(Confirmable),
+			want: append([]byte{0x64, 0x45, 0x42, 0x42, 0xde, 0xad, 0xbe, 0xef, 0xff}, "21.5"...),
+		},
+		{
+			name: "empty acknowledgement",
+			reply: func(msg *Message) *Message {
+				return msg.Reply(0, nil)
+			},
+			req:  request(Confirmable),
+			want: []byte{0x60, 0x00, 0x42, 0x42},
+		},
+		{
+			name: "non-confirmable",
+			reply: func(msg *Message) *Message {
+				return msg.Reply(Code(Content), nil)
+			},
+			req:  request(NonConfirmable),
+			want: []byte{0x54, 0x45, 0x00, 0x00, 0xde, 0xad, 0xbe, 0xef},
+		},
+		{
+			name: "reset",
+			reply: func(msg *Message) *Message {
+				return msg.Reject()
+			},
+			req:  request(NonConfirmable),
+			want: []byte{0x70, 0x00, 0x42, 0x42},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := cap(test.req.Options)
+
+			reply := test.reply(test.req)
+			if reply != test.req {
+				t.Error("expected reply to reuse the message")
+			}
+
+			if cap(reply.Options) != options {
+				t.Errorf("options capacity = %d, want %d", cap(reply.Options), options)
+			}
+
+			data, err := reply.MarshalBinary()
+			if err != nil {
+				t.Fatal("marshal:", err)
+			}
+
+			diff := cmp.Diff(test.want, data)
+			if diff != "" {
+				t.Errorf("reply mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDecodePayloadMarker(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		strict bool
+		rest   []byte
+		err    error
+	}{
+		{
+			name: "payload",
+			data: []byte{0xFF, 0x42},
+			rest: []byte{0x42},
+		},
+		{
+			name: "empty payload",
+			data: []byte{0xFF},
+			rest: []byte{},
+		},
+		{
+			name:   "empty payload, strict",
+			data:   []byte{0xFF},
+			strict: true,
+			rest:   []byte{0xFF},
+			err: MalformedPayloadMarker{
+				Byte: PayloadMarker,
+			},
+		},
+		{
+			name: "not a marker",
+			data: []byte{0xFE, 0x42},
+			rest: []byte{0xFE, 0x42},
+			err: MalformedPayloadMarker{
+				Byte: 0xFE,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rest, err := decodePayloadMarker(test.data, test.strict)
+			expectErr(t, err, test.err)
+
+			diff := cmp.Diff(test.rest, rest)
+			if diff != "" {
+				t.Errorf("remaining data mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package coap
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Synthetic routes of exchanges not attributed to a registered pattern.
+const (
+	// UnmatchedRoute is the route of requests matching no ServeMux pattern, or served by a handler
+	// which is not a ServeMux.
+	UnmatchedRoute = "(unmatched)"
+
+	// RejectedRoute is the route of requests answered by the server without running the handler,
+	// such as requests with invalid options or requests shed after MaxQueueLatency.
+	RejectedRoute = "(rejected)"
+)
+
+// DefaultLatencyBuckets are upper bounds of latency buckets of MemoryMetrics by default.
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// MetricsSink collects metrics of exchanges handled by Server.
+//
+// Observe is called once the handler returns, or once the server answers the request by itself.
+// Route is the ServeMux pattern matched by the request, such as "/fw/{id}", or one of UnmatchedRoute
+// and RejectedRoute, so that the number of routes is bounded. Code is zero if the request was
+// acknowledged without a response, respBytes is the size of the response. Observe is called
+// concurrently from handler goroutines.
+type MetricsSink interface {
+	Observe(route string, method Method, code ResponseCode, duration time.Duration, reqBytes, respBytes int)
+}
+
+// MetricsKey identifies a series of MemoryMetrics.
+type MetricsKey struct {
+	Route  string
+	Method Method
+	Code   ResponseCode
+}
+
+// RouteMetrics holds metrics of a series of MemoryMetrics.
+type RouteMetrics struct {
+	Count         uint64
+	RequestBytes  uint64
+	ResponseBytes uint64
+
+	// Latency holds counts of exchanges by latency bucket, the last one counts exchanges
+	// exceeding all bucket bounds.
+	Latency []uint64
+}
+
+// MemoryMetrics is a MetricsSink keeping metrics in memory for tests and debug endpoints.
+type MemoryMetrics struct {
+	buckets []time.Duration
+
+	mtx    sync.Mutex
+	series map[MetricsKey]*RouteMetrics
+}
+
+type exchangeKey struct{}
+
+// NewMemoryMetrics instantiates MemoryMetrics with the given ascending latency bucket bounds,
+// defaults to DefaultLatencyBuckets.
+func NewMemoryMetrics(buckets ...time.Duration) *MemoryMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+
+	return &MemoryMetrics{
+		buckets: slices.Clone(buckets),
+		series:  map[MetricsKey]*RouteMetrics{},
+	}
+}
+
+// Observe implements MetricsSink.
+func (m *MemoryMetrics) Observe(route string, method Method, code ResponseCode, duration time.Duration, reqBytes, respBytes int) {
+	key := MetricsKey{
+		Route:  route,
+		Method: method,
+		Code:   code,
+	}
+
+	// first bucket with bound not less than the duration, or the overflow bucket
+	bucket, _ := slices.BinarySearch(m.buckets, duration)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	series, ok := m.series[key]
+	if !ok {
+		series = &RouteMetrics{
+			Latency: make([]uint64, len(m.buckets)+1),
+		}
+		m.series[key] = series
+	}
+
+	series.Count++
+	series.RequestBytes += uint64(reqBytes)
+	series.ResponseBytes += uint64(respBytes)
+	series.Latency[bucket]++
+}
+
+// Buckets returns upper bounds of latency buckets.
+func (m *MemoryMetrics) Buckets() []time.Duration {
+	return slices.Clone(m.buckets)
+}
+
+// Snapshot returns a copy of the metrics collected so far.
+func (m *MemoryMetrics) Snapshot() map[MetricsKey]RouteMetrics {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	snapshot := make(map[MetricsKey]RouteMetrics, len(m.series))
+	for key, series := range m.series {
+		copied := *series
+		copied.Latency = slices.Clone(series.Latency)
+		snapshot[key] = copied
+	}
+
+	return snapshot
+}
+
+// setRoute attributes the exchange handled with the context to the pattern, if metrics are enabled.
+func setRoute(ctx context.Context, pattern string) {
+	e, ok := ctx.Value(exchangeKey{}).(*exchange)
+	if ok {
+		e.route = pattern
+	}
+}
+
+// observe passes metrics of the exchange to the sink, if metrics are enabled.
+func (e *exchange) observe() {
+	if e.opts.Metrics == nil {
+		return
+	}
+
+	e.mtx.Lock()
+	code, respBytes := e.code, e.respBytes
+	e.mtx.Unlock()
+
+	route := e.route
+	if route == "" {
+		route = UnmatchedRoute
+	}
+
+	duration := e.conn.opts.Clock.Now().Sub(e.received)
+	e.opts.Metrics.Observe(route, e.method, code, duration, e.reqBytes, respBytes)
+}
@@ -0,0 +1,177 @@
+package coap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// waitMetrics waits for the number of observed exchanges, observed after the response is sent.
+func waitMetrics(t *testing.T, metrics *MemoryMetrics, count uint64) map[MetricsKey]RouteMetrics {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		snapshot := metrics.Snapshot()
+
+		total := uint64(0)
+		for _, series := range snapshot {
+			total += series.Count
+		}
+
+		if total >= count {
+			return snapshot
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%d exchanges observed, want %d", total, count)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func metricsRequest(t *testing.T, path string) *Message {
+	t.Helper()
+
+	req := &Request{
+		Type:   Confirmable,
+		Method: GET,
+		Path:   path,
+	}
+
+	msg, err := req.message()
+	if err != nil {
+		t.Fatal("message:", err)
+	}
+
+	msg.ID = 0x4242
+	msg.Token = []byte{0x01, 0x02, 0x03, 0x04}
+
+	return &msg
+}
+
+func TestServerMetrics(t *testing.T) {
+	mux := NewServeMux()
+	err := mux.HandleFunc("/fw/{id}", func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code:    Content,
+			Payload: []byte("1.2.3"),
+		})
+	})
+	if err != nil {
+		t.Fatal("handle:", err)
+	}
+
+	metrics := NewMemoryMetrics()
+	opts := testConnOptions()
+	opts.StrictSemantics = true
+	s := newServerTest(t, opts, ServerOptions{
+		Metrics: metrics,
+	}, mux)
+
+	latency := func(count uint64) []uint64 {
+		buckets := make([]uint64, len(DefaultLatencyBuckets)+1)
+		buckets[0] = count // the fake clock does not advance
+
+		return buckets
+	}
+
+	reqs := []*Message{
+		metricsRequest(t, "/fw/1"),
+		metricsRequest(t, "/fw/2"),
+		metricsRequest(t, "/missing"),
+	}
+
+	// invalid Observe value is rejected before the handler runs
+	invalid := metricsRequest(t, "/fw/3")
+	invalid.Options = append(invalid.Options, MustOptionValue(Observe, uint32(42)))
+	reqs = append(reqs, invalid)
+
+	respBytes := []int{}
+	for i, req := range reqs {
+		// distinct IDs, duplicates would be answered without handling
+		req.ID += MessageID(i)
+		s.send(req)
+
+		resp := s.receive()
+		if resp == nil {
+			t.Fatal("expected response")
+		}
+
+		respBytes = append(respBytes, resp.Size())
+	}
+
+	want := map[MetricsKey]RouteMetrics{
+		{Route: "/fw/{id}", Method: GET, Code: Content}: {
+			Count:         2,
+			RequestBytes:  uint64(reqs[0].Size() + reqs[1].Size()),
+			ResponseBytes: uint64(respBytes[0] + respBytes[1]),
+			Latency:       latency(2),
+		},
+		{Route: UnmatchedRoute, Method: GET, Code: NotFound}: {
+			Count:         1,
+			RequestBytes:  uint64(reqs[2].Size()),
+			ResponseBytes: uint64(respBytes[2]),
+			Latency:       latency(1),
+		},
+		{Route: RejectedRoute, Method: GET, Code: BadRequest}: {
+			Count:         1,
+			RequestBytes:  uint64(reqs[3].Size()),
+			ResponseBytes: uint64(respBytes[3]),
+			Latency:       latency(1),
+		},
+	}
+
+	got := waitMetrics(t, metrics, 4)
+	diff := cmp.Diff(want, got)
+	if diff != "" {
+		t.Errorf("metrics mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestMemoryMetricsBuckets(t *testing.T) {
+	metrics := NewMemoryMetrics(time.Millisecond, 10*time.Millisecond)
+
+	for _, duration := range []time.Duration{0, time.Millisecond, 2 * time.Millisecond, time.Second} {
+		metrics.Observe("/a", POST, Changed, duration, 10, 4)
+	}
+
+	want := map[MetricsKey]RouteMetrics{
+		{Route: "/a", Method: POST, Code: Changed}: {
+			Count:         4,
+			RequestBytes:  40,
+			ResponseBytes: 16,
+			Latency:       []uint64{2, 1, 1},
+		},
+	}
+
+	diff := cmp.Diff(want, metrics.Snapshot())
+	if diff != "" {
+		t.Errorf("metrics mismatch (-want +got):\n%s", diff)
+	}
+
+	diff = cmp.Diff([]time.Duration{time.Millisecond, 10 * time.Millisecond}, metrics.Buckets())
+	if diff != "" {
+		t.Errorf("buckets mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestServerMetricsDisabled(t *testing.T) {
+	e := &exchange{}
+	ctx := context.Background()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		setRoute(ctx, "/fw/{id}")
+		e.observe()
+	})
+	if allocs != 0 {
+		t.Errorf("disabled metrics allocated %v times, want 0", allocs)
+	}
+
+	if e.route != "" {
+		t.Errorf("route = %q, want unset", e.route)
+	}
+}
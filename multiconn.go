@@ -0,0 +1,257 @@
+package coap
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/uramaki-io/coap/internal/deadline"
+)
+
+// MultiConnOptions holds options for MultiConn.
+type MultiConnOptions struct {
+	// ReceiveBufferSize is the size of the receive buffer of each delegate, defaults to ReceiveBufferSize.
+	ReceiveBufferSize uint
+
+	// FailFast closes all delegates when reading from one of them fails,
+	// otherwise only the failed delegate is closed and the others keep serving.
+	FailFast bool
+}
+
+// MultiConn is a net.PacketConn aggregating several PacketConns, such as IPv4 and IPv6 sockets
+// or sockets on different interfaces, into one logical endpoint.
+//
+// A Conn created over MultiConn shares retransmission, budgets and handlers across all sockets.
+// Datagrams read from any delegate are returned with a MultiAddr recording the delegate, so that
+// replies and their retransmissions leave through the socket the request arrived on.
+type MultiConn struct {
+	delegates []net.PacketConn
+	opts      MultiConnOptions
+
+	rx     chan deadline.Datagram
+	reader *deadline.Reader
+	errs   chan error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mtx    sync.Mutex
+	failed []bool
+}
+
+// MultiAddr is the address of a peer reached through a MultiConn delegate.
+type MultiAddr struct {
+	net.Addr
+
+	// Index of the delegate the peer was received on.
+	Index int
+}
+
+// NewMultiConn instantiates a new MultiConn reading from all delegates.
+//
+// Returns NoDelegates if delegates is empty.
+func NewMultiConn(delegates []net.PacketConn, opts MultiConnOptions) (*MultiConn, error) {
+	if len(delegates) == 0 {
+		return nil, NoDelegates{}
+	}
+
+	if opts.ReceiveBufferSize == 0 {
+		opts.ReceiveBufferSize = ReceiveBufferSize
+	}
+
+	c := &MultiConn{
+		delegates: slices.Clone(delegates),
+		opts:      opts,
+		rx:        make(chan deadline.Datagram),
+		errs:      make(chan error, len(delegates)),
+		closed:    make(chan struct{}),
+		failed:    make([]bool, len(delegates)),
+	}
+	c.reader = deadline.NewReader(c.rx, c.closed)
+
+	for i := range c.delegates {
+		go c.read(i)
+	}
+
+	return c, nil
+}
+
+// Errors returns the channel receiving a DelegateError for each failed delegate.
+func (c *MultiConn) Errors() <-chan error {
+	return c.errs
+}
+
+// ReadFrom implements net.PacketConn.
+//
+// Returns MultiAddr of the peer. Datagrams larger than the buffer are truncated.
+func (c *MultiConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.reader.ReadFrom(b)
+}
+
+// WriteTo implements net.PacketConn.
+//
+// Datagrams to a MultiAddr are written by the delegate it was received on, otherwise by the first
+// delegate whose local address family matches the destination, or the first delegate if none matches.
+//
+// Returns net.ErrClosed if the selected delegate has failed.
+func (c *MultiConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	i, addr := c.route(addr)
+
+	c.mtx.Lock()
+	failed := c.failed[i]
+	c.mtx.Unlock()
+
+	if failed {
+		return 0, net.ErrClosed
+	}
+
+	return c.delegates[i].WriteTo(b, addr)
+}
+
+// route selects the delegate for the destination and unwraps MultiAddr.
+func (c *MultiConn) route(addr net.Addr) (int, net.Addr) {
+	if multi, ok := addr.(MultiAddr); ok {
+		return multi.Index, multi.Addr
+	}
+
+	family := addrFamily(addr)
+	for i, delegate := range c.delegates {
+		c.mtx.Lock()
+		failed := c.failed[i]
+		c.mtx.Unlock()
+
+		if !failed && addrFamily(delegate.LocalAddr()) == family {
+			return i, addr
+		}
+	}
+
+	return 0, addr
+}
+
+// Close implements net.PacketConn, it closes all delegates.
+func (c *MultiConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		for _, delegate := range c.delegates {
+			closeErr := delegate.Close()
+			if err == nil {
+				err = closeErr
+			}
+		}
+	})
+
+	return err
+}
+
+// LocalAddr implements net.PacketConn, it returns the local address of the first delegate.
+func (c *MultiConn) LocalAddr() net.Addr {
+	return c.delegates[0].LocalAddr()
+}
+
+// SetDeadline implements net.PacketConn.
+func (c *MultiConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+//
+// Deadline applies to pending and subsequent ReadFrom calls.
+func (c *MultiConn) SetReadDeadline(t time.Time) error {
+	c.reader.SetDeadline(t)
+
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn, it sets the write deadline of all delegates.
+func (c *MultiConn) SetWriteDeadline(t time.Time) error {
+	for _, delegate := range c.delegates {
+		err := delegate.SetWriteDeadline(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// read forwards datagrams of the delegate until it fails or MultiConn is closed.
+func (c *MultiConn) read(i int) {
+	delegate := c.delegates[i]
+	buf := make([]byte, c.opts.ReceiveBufferSize)
+
+	for {
+		n, addr, err := delegate.ReadFrom(buf)
+		if err != nil {
+			c.fail(i, err)
+			return
+		}
+
+		d := deadline.Datagram{
+			Data: slices.Clone(buf[:n]),
+			Addr: MultiAddr{
+				Addr:  addr,
+				Index: i,
+			},
+		}
+
+		select {
+		case <-c.closed:
+			return
+		case c.rx <- d:
+		}
+	}
+}
+
+// fail reports the delegate failure and closes it, or all delegates if FailFast is set.
+func (c *MultiConn) fail(i int, err error) {
+	select {
+	case <-c.closed:
+		return // closed by Close
+	default:
+	}
+
+	c.mtx.Lock()
+	c.failed[i] = true
+	alive := slices.Contains(c.failed, false)
+	c.mtx.Unlock()
+
+	c.errs <- DelegateError{
+		Index: i,
+		Addr:  c.delegates[i].LocalAddr(),
+		Err:   err,
+	}
+
+	if c.opts.FailFast || !alive {
+		_ = c.Close()
+		return
+	}
+
+	_ = c.delegates[i].Close()
+}
+
+// addrFamily returns 4 or 6 for IP addresses and 0 for other addresses.
+func addrFamily(addr net.Addr) int {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	default:
+		return 0
+	}
+
+	if ip.To4() != nil {
+		return 4
+	}
+
+	return 6
+}
@@ -0,0 +1,228 @@
+package coap
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultiConnReplyAffinity(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	opts := ConnOptions{
+		Clock: clock,
+	}
+
+	v4, v4Server := newPipe()
+	v6, v6Server := newPipe()
+	delegate, err := NewMultiConn([]net.PacketConn{v4Server, v6Server}, MultiConnOptions{})
+	if err != nil {
+		t.Fatal("multi conn:", err)
+	}
+
+	server := NewConn(delegate, opts)
+	defer server.Close()
+
+	msg := testRequest()
+	data, err := msg.AppendBinary(nil)
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	_, err = v6.WriteTo(data, v6Server.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	req := &Message{}
+	addr, err := server.Read(req)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	multi, ok := addr.(MultiAddr)
+	if !ok || multi.Index != 1 {
+		t.Fatalf("addr = %#v, want MultiAddr of delegate 1", addr)
+	}
+
+	err = server.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(Content),
+			Token:   req.Token,
+		},
+	}, addr)
+	if err != nil {
+		t.Fatal("write response:", err)
+	}
+
+	// retransmission leaves through the same delegate
+	clock.Advance(ACKTimeout * 3 / 2)
+
+	for range 2 {
+		_, from := receiveDatagram(t, v6)
+		if from == nil {
+			t.Fatal("expected response on delegate 1")
+		}
+	}
+
+	if _, from := receiveDatagram(t, v4); from != nil {
+		t.Errorf("unexpected datagram on delegate 0 from %s", from)
+	}
+}
+
+func TestMultiConnRouteFamily(t *testing.T) {
+	a, _ := newPipe()
+	b, _ := newPipe()
+	v4 := &familyConn{PacketConn: a, local: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: DefaultPort}}
+	v6 := &familyConn{PacketConn: b, local: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: DefaultPort}}
+
+	conn, err := NewMultiConn([]net.PacketConn{v4, v6}, MultiConnOptions{})
+	if err != nil {
+		t.Fatal("multi conn:", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteTo(bytes4, &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: DefaultPort})
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	_, err = conn.WriteTo(bytes4, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: DefaultPort})
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	_, err = conn.WriteTo(bytes4, &net.UDPAddr{IP: net.ParseIP("2001:db8::3"), Port: DefaultPort})
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	if v4.Writes() != 1 || v6.Writes() != 2 {
+		t.Errorf("writes = %d, %d, want 1, 2", v4.Writes(), v6.Writes())
+	}
+}
+
+func TestMultiConnFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		failFast bool
+	}{
+		{
+			name: "independent",
+		},
+		{
+			name:     "fail fast",
+			failFast: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errBroken := errors.New("broken")
+			a, aServer := newPipe()
+			_, bServer := newPipe()
+			broken := &familyConn{PacketConn: bServer, local: bServer.LocalAddr(), readErr: make(chan error)}
+
+			conn, err := NewMultiConn([]net.PacketConn{aServer, broken}, MultiConnOptions{
+				FailFast: test.failFast,
+			})
+			if err != nil {
+				t.Fatal("multi conn:", err)
+			}
+			defer conn.Close()
+
+			broken.readErr <- errBroken
+
+			err = <-conn.Errors()
+			expectErr(t, err, DelegateError{Index: 1, Addr: bServer.LocalAddr(), Err: errBroken})
+
+			_, err = a.WriteTo(bytes4, aServer.LocalAddr())
+			if err != nil {
+				t.Fatal("write:", err)
+			}
+
+			err = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			if err != nil {
+				t.Fatal("set deadline:", err)
+			}
+
+			buf := make([]byte, MaxMessageLength)
+			_, _, err = conn.ReadFrom(buf)
+			if test.failFast {
+				expectErr(t, err, net.ErrClosed)
+				return
+			}
+
+			if err != nil {
+				t.Fatal("read from healthy delegate:", err)
+			}
+
+			_, err = conn.WriteTo(bytes4, MultiAddr{Addr: a.LocalAddr(), Index: 1})
+			expectErr(t, err, net.ErrClosed)
+		})
+	}
+}
+
+func TestMultiConnNoDelegates(t *testing.T) {
+	_, err := NewMultiConn(nil, MultiConnOptions{})
+	expectErr(t, err, NoDelegates{})
+}
+
+// familyConn overrides the local address and counts writes, reads fail with errors sent to readErr.
+type familyConn struct {
+	net.PacketConn
+
+	local   net.Addr
+	readErr chan error
+
+	mtx    sync.Mutex
+	writes int
+}
+
+func (c *familyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *familyConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.readErr != nil {
+		return 0, nil, <-c.readErr
+	}
+
+	return c.PacketConn.ReadFrom(b)
+}
+
+func (c *familyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mtx.Lock()
+	c.writes++
+	c.mtx.Unlock()
+
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *familyConn) Writes() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.writes
+}
+
+// receiveDatagram returns the next datagram received by the pipe endpoint, or nil if none arrives in time.
+func receiveDatagram(t *testing.T, conn *pipeConn) ([]byte, net.Addr) {
+	t.Helper()
+
+	err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	buf := make([]byte, MaxMessageLength)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil, nil
+	}
+
+	return buf[:n], from
+}
@@ -0,0 +1,384 @@
+package coap
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// WildcardSegment matches exactly one path segment.
+	WildcardSegment = "+"
+
+	// WildcardRest matches all remaining path segments, it must be the last segment of a pattern.
+	WildcardRest = "#"
+)
+
+// Handler responds to a CoAP request.
+type Handler interface {
+	ServeCOAP(ctx context.Context, w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts a function to the Handler interface.
+type HandlerFunc func(ctx context.Context, w ResponseWriter, r *Request)
+
+// ResponseWriter sends a response to the request being handled.
+type ResponseWriter interface {
+	// Write sends the response.
+	Write(resp *Response) error
+}
+
+// ServeMux dispatches requests to handlers registered by path patterns.
+//
+// Patterns are matched against URIPath segments. A segment is either a literal,
+// WildcardSegment matching any single segment, `{name}` matching any single segment and
+// capturing it as a route parameter, or WildcardRest matching all remaining segments.
+//
+// The most specific pattern wins: at each segment literals take precedence over single segment
+// wildcards and parameters, which take precedence over WildcardRest.
+type ServeMux struct {
+	mtx  sync.RWMutex
+	root *route
+}
+
+type route struct {
+	literal map[string]*route
+	param   *route
+	rest    *endpoint
+
+	// name of the captured parameter, empty for WildcardSegment
+	name string
+
+	// origin is the first pattern registered through this route
+	origin   string
+	endpoint *endpoint
+}
+
+type endpoint struct {
+	pattern string
+	handler Handler
+
+	// produces lists content formats the handler can respond with, empty if not declared
+	produces []MediaType
+}
+
+// HandleOption configures a handler registered with ServeMux.
+type HandleOption func(ep *endpoint)
+
+type routeParamsKey struct{}
+
+// NewServeMux instantiates a new empty ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{
+		root: &route{},
+	}
+}
+
+// Produces declares content formats the handler can respond with.
+//
+// Requests with an Accept option matching none of them are answered with NotAcceptable
+// without invoking the handler, requests without Accept are always passed to the handler.
+// Handlers without Produces are responsible for checking Accept themselves.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.10.4
+func Produces(mediaTypes ...MediaType) HandleOption {
+	return func(ep *endpoint) {
+		ep.produces = append(ep.produces, mediaTypes...)
+	}
+}
+
+// ServeCOAP implements Handler.
+func (f HandlerFunc) ServeCOAP(ctx context.Context, w ResponseWriter, r *Request) {
+	f(ctx, w, r)
+}
+
+// Handle registers the handler for the given pattern configured by options.
+//
+// Returns InvalidPattern if the pattern is malformed.
+//
+// Returns PatternConflict if the pattern matches the same paths as already registered pattern.
+func (m *ServeMux) Handle(pattern string, handler Handler, opts ...HandleOption) error {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	ep := &endpoint{
+		pattern: pattern,
+		handler: handler,
+	}
+	for _, opt := range opts {
+		opt(ep)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	node := m.root
+	for _, segment := range segments {
+		switch {
+		case segment == WildcardRest:
+			if node.rest != nil {
+				return PatternConflict{
+					Pattern:  pattern,
+					Existing: node.rest.pattern,
+				}
+			}
+
+			node.rest = ep
+
+			return nil
+		case segment == WildcardSegment || isParam(segment):
+			name := strings.Trim(segment, "{}")
+			if segment == WildcardSegment {
+				name = ""
+			}
+
+			if node.param == nil {
+				node.param = &route{
+					name:   name,
+					origin: pattern,
+				}
+			}
+
+			if node.param.name != name {
+				return PatternConflict{
+					Pattern:  pattern,
+					Existing: node.param.origin,
+				}
+			}
+
+			node = node.param
+		default:
+			if node.literal == nil {
+				node.literal = map[string]*route{}
+			}
+
+			next, ok := node.literal[segment]
+			if !ok {
+				next = &route{}
+				node.literal[segment] = next
+			}
+
+			node = next
+		}
+	}
+
+	if node.endpoint != nil {
+		return PatternConflict{
+			Pattern:  pattern,
+			Existing: node.endpoint.pattern,
+		}
+	}
+
+	node.endpoint = ep
+
+	return nil
+}
+
+// HandleFunc registers the handler function for the given pattern configured by options.
+func (m *ServeMux) HandleFunc(
+	pattern string,
+	handler func(ctx context.Context, w ResponseWriter, r *Request),
+	opts ...HandleOption,
+) error {
+	return m.Handle(pattern, HandlerFunc(handler), opts...)
+}
+
+// Handler returns the handler and pattern matching the request path, along with route parameters.
+//
+// Returns nil handler if no pattern matches.
+func (m *ServeMux) Handler(r *Request) (Handler, string, map[string]string) {
+	ep, params := m.endpoint(r)
+	if ep == nil {
+		return nil, "", nil
+	}
+
+	return ep.handler, ep.pattern, params
+}
+
+// ServeCOAP implements Handler by dispatching the request to the most specific matching handler.
+//
+// Route parameters are available to the handler via RouteParams.
+//
+// The exchange is attributed to the matched pattern in ServerOptions.Metrics.
+//
+// Responds with NotFound if no pattern matches.
+//
+// Responds with NotAcceptable if the handler declares Produces and none matches the Accept option.
+//
+// Both carry problem details if enabled by ServerOptions.ProblemDetails and accepted by the request.
+func (m *ServeMux) ServeCOAP(ctx context.Context, w ResponseWriter, r *Request) {
+	ep, params := m.endpoint(r)
+	if ep == nil {
+		_ = w.Write(problemResponse(ctx, &Response{Code: NotFound}, r.Options, "no handler for /"+strings.Join(PathSegments(r), "/")))
+		return
+	}
+
+	setRoute(ctx, ep.pattern)
+
+	if !ep.acceptable(r) {
+		resp := notAcceptable(ep.produces)
+		_ = w.Write(problemResponse(ctx, resp, r.Options, string(resp.Payload)))
+		return
+	}
+
+	if params != nil {
+		ctx = context.WithValue(ctx, routeParamsKey{}, params)
+	}
+
+	ep.handler.ServeCOAP(ctx, w, r)
+}
+
+func (m *ServeMux) endpoint(r *Request) (*endpoint, map[string]string) {
+	segments := PathSegments(r)
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.root.match(segments, nil)
+}
+
+// RouteParams returns route parameters captured by ServeMux pattern.
+//
+// Parameters are keyed by name, segments matched by WildcardRest are joined under WildcardRest key.
+func RouteParams(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(routeParamsKey{}).(map[string]string)
+	return params
+}
+
+// PathSegments returns the request path segments.
+//
+// URIPath options are preferred when Path is the path decoded from them, so that segments of a received
+// request containing slashes are preserved. Path is used otherwise, as it overrides the options when
+// the request is encoded.
+func PathSegments(r *Request) []string {
+	segments := slices.Collect(MustValue(r.Options.GetAllString(URIPath)))
+	if r.Path == "" || len(segments) != 0 && DecodePath(slices.Values(segments)) == r.Path {
+		return segments
+	}
+
+	return splitPath(r.Path)
+}
+
+func (n *route) match(segments []string, params map[string]string) (*endpoint, map[string]string) {
+	if len(segments) == 0 && n.endpoint != nil {
+		return n.endpoint, params
+	}
+
+	if len(segments) != 0 {
+		next, ok := n.literal[segments[0]]
+		if ok {
+			ep, p := next.match(segments[1:], params)
+			if ep != nil {
+				return ep, p
+			}
+		}
+
+		if n.param != nil {
+			p := params
+			if n.param.name != "" {
+				p = clonedParams(params)
+				p[n.param.name] = segments[0]
+			}
+
+			ep, p := n.param.match(segments[1:], p)
+			if ep != nil {
+				return ep, p
+			}
+		}
+	}
+
+	if n.rest != nil {
+		params = clonedParams(params)
+		params[WildcardRest] = strings.Join(segments, "/")
+		return n.rest, params
+	}
+
+	return nil, nil
+}
+
+// acceptable checks the Accept option of the request against declared content formats.
+func (ep *endpoint) acceptable(r *Request) bool {
+	if len(ep.produces) == 0 {
+		return true
+	}
+
+	accept, err := r.Options.GetUint(Accept)
+	if err != nil {
+		return true // no Accept option
+	}
+
+	return slices.ContainsFunc(ep.produces, func(m MediaType) bool {
+		return uint32(m.Code) == accept
+	})
+}
+
+// notAcceptable returns NotAcceptable response with diagnostic payload listing supported content formats.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.5.2
+func notAcceptable(produces []MediaType) *Response {
+	codes := make([]string, 0, len(produces))
+	for _, m := range produces {
+		codes = append(codes, fmt.Sprint(m.Code))
+	}
+
+	return &Response{
+		Code:    NotAcceptable,
+		Payload: []byte("supported content-formats: " + strings.Join(codes, ", ")),
+	}
+}
+
+func clonedParams(params map[string]string) map[string]string {
+	cloned := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		cloned[k] = v
+	}
+
+	return cloned
+}
+
+func parsePattern(pattern string) ([]string, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, InvalidPattern{
+			Pattern: pattern,
+		}
+	}
+
+	segments := splitPath(pattern)
+	for i, segment := range segments {
+		switch {
+		case segment == WildcardRest && i != len(segments)-1:
+			return nil, InvalidPattern{
+				Pattern: pattern,
+			}
+		case strings.ContainsAny(segment, "{}") && !isParam(segment):
+			return nil, InvalidPattern{
+				Pattern: pattern,
+			}
+		}
+	}
+
+	return segments, nil
+}
+
+func isParam(segment string) bool {
+	name, ok := strings.CutPrefix(segment, "{")
+	if !ok {
+		return false
+	}
+
+	name, ok = strings.CutSuffix(name, "}")
+	return ok && name != "" && !strings.ContainsAny(name, "{}")
+}
+
+func splitPath(path string) []string {
+	segments := EncodePath(path)
+	if segments == nil {
+		return nil
+	}
+
+	return slices.Collect(segments)
+}
@@ -0,0 +1,338 @@
+package coap
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// recorder is a ResponseWriter recording written responses.
+type recorder struct {
+	responses []*Response
+}
+
+func (r *recorder) Write(resp *Response) error {
+	r.responses = append(r.responses, resp)
+	return nil
+}
+
+func TestServeMuxMatch(t *testing.T) {
+	patterns := []string{
+		"/",
+		"/fw",
+		"/fw/latest",
+		"/fw/+",
+		"/fw/+/status",
+		"/fw/#",
+		"/dev/{id}",
+		"/dev/{id}/sensor/{sensor}",
+		"/dev/{id}/#",
+		"/#",
+	}
+
+	mux := NewServeMux()
+	for _, pattern := range patterns {
+		err := mux.Handle(pattern, HandlerFunc(func(_ context.Context, _ ResponseWriter, _ *Request) {}))
+		if err != nil {
+			t.Fatalf("handle %q: %v", pattern, err)
+		}
+	}
+
+	tests := []struct {
+		path    string
+		options Options
+		pattern string
+		params  map[string]string
+	}{
+		{path: "/", pattern: "/"},
+		{path: "/fw", pattern: "/fw"},
+		{path: "/fw/latest", pattern: "/fw/latest"},
+		{path: "/fw/1.0", pattern: "/fw/+"},
+		{path: "/fw/1.0/status", pattern: "/fw/+/status"},
+		{path: "/fw/latest/status", pattern: "/fw/+/status"},
+		{path: "/fw/1.0/image/0", pattern: "/fw/#", params: map[string]string{"#": "1.0/image/0"}},
+		{path: "/dev/42", pattern: "/dev/{id}", params: map[string]string{"id": "42"}},
+		{
+			path:    "/dev/42/sensor/temp",
+			pattern: "/dev/{id}/sensor/{sensor}",
+			params:  map[string]string{"id": "42", "sensor": "temp"},
+		},
+		{
+			path:    "/dev/42/sensor",
+			pattern: "/dev/{id}/#",
+			params:  map[string]string{"id": "42", "#": "sensor"},
+		},
+		{path: "/other/path", pattern: "/#", params: map[string]string{"#": "other/path"}},
+		{
+			options: Options{
+				MustOptionValue(URIPath, "dev"),
+				MustOptionValue(URIPath, "a/b"),
+			},
+			pattern: "/dev/{id}",
+			params:  map[string]string{"id": "a/b"},
+		},
+		{
+			path: "/fw/latest",
+			options: Options{
+				MustOptionValue(URIPath, "dev"),
+				MustOptionValue(URIPath, "42"),
+			},
+			pattern: "/fw/latest",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			req := &Request{
+				Path:    test.path,
+				Options: test.options,
+			}
+
+			handler, pattern, params := mux.Handler(req)
+			if handler == nil {
+				t.Fatal("expected handler")
+			}
+
+			if pattern != test.pattern {
+				t.Errorf("pattern = %q, want %q", pattern, test.pattern)
+			}
+
+			diff := cmp.Diff(test.params, params)
+			if diff != "" {
+				t.Errorf("params mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServeMuxHandleError(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		pattern  string
+		err      error
+	}{
+		{
+			name:    "relative",
+			pattern: "fw",
+			err:     InvalidPattern{Pattern: "fw"},
+		},
+		{
+			name:    "rest not last",
+			pattern: "/fw/#/status",
+			err:     InvalidPattern{Pattern: "/fw/#/status"},
+		},
+		{
+			name:    "empty parameter",
+			pattern: "/dev/{}",
+			err:     InvalidPattern{Pattern: "/dev/{}"},
+		},
+		{
+			name:    "malformed parameter",
+			pattern: "/dev/{id",
+			err:     InvalidPattern{Pattern: "/dev/{id"},
+		},
+		{
+			name:     "duplicate",
+			existing: "/fw",
+			pattern:  "/fw",
+			err:      PatternConflict{Pattern: "/fw", Existing: "/fw"},
+		},
+		{
+			name:     "wildcard and parameter",
+			existing: "/dev/+",
+			pattern:  "/dev/{id}",
+			err:      PatternConflict{Pattern: "/dev/{id}", Existing: "/dev/+"},
+		},
+		{
+			name:     "parameter names",
+			existing: "/dev/{id}/status",
+			pattern:  "/dev/{name}",
+			err:      PatternConflict{Pattern: "/dev/{name}", Existing: "/dev/{id}/status"},
+		},
+		{
+			name:     "rest",
+			existing: "/fw/#",
+			pattern:  "/fw/#",
+			err:      PatternConflict{Pattern: "/fw/#", Existing: "/fw/#"},
+		},
+	}
+
+	handler := HandlerFunc(func(_ context.Context, _ ResponseWriter, _ *Request) {})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mux := NewServeMux()
+			if test.existing != "" {
+				err := mux.Handle(test.existing, handler)
+				if err != nil {
+					t.Fatal("handle existing:", err)
+				}
+			}
+
+			err := mux.Handle(test.pattern, handler)
+			expectErr(t, err, test.err)
+		})
+	}
+}
+
+func TestServeMuxServeCOAP(t *testing.T) {
+	mux := NewServeMux()
+	err := mux.HandleFunc("/dev/{id}", func(ctx context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code:    Content,
+			Payload: []byte(RouteParams(ctx)["id"]),
+		})
+	})
+	if err != nil {
+		t.Fatal("handle:", err)
+	}
+
+	w := &recorder{}
+	mux.ServeCOAP(context.Background(), w, &Request{Path: "/dev/42"})
+	mux.ServeCOAP(context.Background(), w, &Request{Path: "/missing"})
+
+	want := []*Response{
+		{Code: Content, Payload: []byte("42")},
+		{Code: NotFound},
+	}
+
+	diff := cmp.Diff(want, w.responses)
+	if diff != "" {
+		t.Errorf("responses mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestServeMuxProduces(t *testing.T) {
+	mux := NewServeMux()
+	err := mux.HandleFunc("/sensor", func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code: Content,
+		})
+	}, Produces(MediaTypeApplicationCBOR, MediaTypeApplicationJSON))
+	if err != nil {
+		t.Fatal("handle:", err)
+	}
+
+	err = mux.HandleFunc("/any", func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code: Content,
+		})
+	})
+	if err != nil {
+		t.Fatal("handle:", err)
+	}
+
+	accept := func(path string, mediaType MediaType) *Request {
+		return &Request{
+			Path: path,
+			Options: Options{
+				MustOptionValue(Accept, uint32(mediaType.Code)),
+			},
+		}
+	}
+
+	tests := []struct {
+		name string
+		req  *Request
+		want *Response
+	}{
+		{
+			name: "match",
+			req:  accept("/sensor", MediaTypeApplicationJSON),
+			want: &Response{Code: Content},
+		},
+		{
+			name: "no match",
+			req:  accept("/sensor", MediaTypeTextPlain),
+			want: &Response{
+				Code:    NotAcceptable,
+				Payload: []byte("supported content-formats: 60, 50"),
+			},
+		},
+		{
+			name: "no accept",
+			req:  &Request{Path: "/sensor"},
+			want: &Response{Code: Content},
+		},
+		{
+			name: "produces not declared",
+			req:  accept("/any", MediaTypeTextPlain),
+			want: &Response{Code: Content},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &recorder{}
+			mux.ServeCOAP(context.Background(), w, test.req)
+
+			diff := cmp.Diff([]*Response{test.want}, w.responses)
+			if diff != "" {
+				t.Errorf("responses mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func BenchmarkServeMuxHandler(b *testing.B) {
+	mux := NewServeMux()
+	handler := HandlerFunc(func(_ context.Context, _ ResponseWriter, _ *Request) {})
+	for i := range 100 {
+		Must(mux.Handle(fmt.Sprintf("/static/%d", i), handler))
+		Must(mux.Handle(fmt.Sprintf("/dev%d/{id}/status", i), handler))
+		Must(mux.Handle(fmt.Sprintf("/fw%d/#", i), handler))
+	}
+
+	requests := map[string]*Request{
+		"literal":   {Path: "/static/99"},
+		"parameter": {Path: "/dev99/42/status"},
+		"rest":      {Path: "/fw99/1.0/image"},
+	}
+
+	for name, req := range requests {
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				handler, _, _ := mux.Handler(req)
+				if handler == nil {
+					b.Fatal("expected handler")
+				}
+			}
+		})
+	}
+}
+
+func TestServeMuxDecodedSlash(t *testing.T) {
+	mux := NewServeMux()
+	err := mux.HandleFunc("/dev/{id}", func(_ context.Context, _ ResponseWriter, _ *Request) {})
+	if err != nil {
+		t.Fatal("handle:", err)
+	}
+
+	msg := testRequest()
+	msg.Options = Options{
+		MustOptionValue(URIPath, "dev"),
+		MustOptionValue(URIPath, "a/b"),
+	}
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	req := &Request{}
+	_, err = req.Decode(data, MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	handler, pattern, params := mux.Handler(req)
+	if handler == nil {
+		t.Fatal("expected handler")
+	}
+
+	if pattern != "/dev/{id}" || params["id"] != "a/b" {
+		t.Errorf("pattern = %q, params = %v, want /dev/{id} with id a/b", pattern, params)
+	}
+}
@@ -0,0 +1,508 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ObserveSequenceWindow is the distance within which a greater Observe sequence number is newer.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7641#section-3.4
+	ObserveSequenceWindow = 1 << 23
+
+	// ObserveFreshness is the time after which a notification is newer regardless of its sequence number.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7641#section-3.4
+	ObserveFreshness = 128 * time.Second
+
+	// MaxObserveSequence is the largest Observe sequence number, sequence numbers are 24-bit.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7641#section-3.4
+	MaxObserveSequence = 1<<24 - 1
+)
+
+// ObserveCounter generates Observe sequence numbers of notifications, wrapping at MaxObserveSequence
+// so that every number fits the 3-byte Observe option. The zero value is ready to use and safe for
+// concurrent use.
+//
+// https://datatracker.ietf.org/doc/html/rfc7641#section-4.4
+type ObserveCounter struct {
+	sequence atomic.Uint32
+}
+
+// Next returns the next sequence number, 1 for the first call on the zero value, 0 after MaxObserveSequence.
+func (c *ObserveCounter) Next() uint32 {
+	for {
+		current := c.sequence.Load()
+		next := (current + 1) & MaxObserveSequence
+		if c.sequence.CompareAndSwap(current, next) {
+			return next
+		}
+	}
+}
+
+// ObservationInfo describes an active observation of Client.
+type ObservationInfo struct {
+	Token Token
+	URL   string
+
+	// Sequence is the Observe sequence number of the last notification accepted.
+	Sequence uint32
+
+	// Updated is the time the last notification was accepted.
+	Updated time.Time
+
+	// Registrations counts the registrations of the observation, including the initial one.
+	Registrations uint
+}
+
+// ObservationManager records active observations of Client, so that an observation is re-registered
+// when the server loses it.
+//
+// The zero value is an empty ObservationManager.
+type ObservationManager struct {
+	mtx          sync.Mutex
+	observations map[string]*observation
+}
+
+// observation is an active observation with the registration request, re-issued with the same token.
+type observation struct {
+	ctx    context.Context
+	req    *Request
+	notify func(resp *Response, err error)
+
+	// conn is the Conn of the observation, released once the observation is forgotten
+	conn    *Conn
+	release func()
+
+	// fields below are guarded by ObservationManager mtx
+	info ObservationInfo
+
+	// registering is set while a registration is in flight
+	registering bool
+
+	// ended is set if the observation ended while registering, to be re-registered once registered
+	ended         bool
+	endedResponse *Response
+
+	// canceling is set once CancelObserve is called, lazy if it awaits the next notification,
+	// canceled is closed once the cancellation completes
+	canceling bool
+	lazy      bool
+	canceled  chan struct{}
+}
+
+// CancelObserveOptions configures Client.CancelObserve.
+type CancelObserveOptions struct {
+	// Lazy cancels the observation by answering the next notification with a Reset instead of sending
+	// a GET with Observe set to ObserveDeregister.
+	Lazy bool
+
+	// Timeout is the time a lazy cancellation awaits the next notification before the observation
+	// is forgotten anyway, measured by the Clock of the Conn, defaults to MaxTransmitWait of the Conn.
+	Timeout time.Duration
+}
+
+// List returns active observations ordered by URL.
+func (m *ObservationManager) List() []ObservationInfo {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	list := make([]ObservationInfo, 0, len(m.observations))
+	for _, obs := range m.observations {
+		info := obs.info
+		info.Token = slices.Clone(info.Token)
+		list = append(list, info)
+	}
+
+	slices.SortFunc(list, func(a, b ObservationInfo) int {
+		if a.URL != b.URL {
+			return strings.Compare(a.URL, b.URL)
+		}
+
+		return bytes.Compare(a.Token, b.Token)
+	})
+
+	return list
+}
+
+func (m *ObservationManager) add(obs *observation) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.observations == nil {
+		m.observations = map[string]*observation{}
+	}
+
+	m.observations[string(obs.info.Token)] = obs
+}
+
+func (m *ObservationManager) get(token Token) *observation {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.observations[string(token)]
+}
+
+// remove forgets the observation, unless the token was reused by another one.
+func (m *ObservationManager) remove(obs *observation) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	key := string(obs.info.Token)
+	if m.observations[key] == obs {
+		delete(m.observations, key)
+	}
+}
+
+// cancel marks the observation as canceling.
+//
+// Returns false if it is already canceling.
+func (m *ObservationManager) cancel(obs *observation, lazy bool) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if obs.canceling {
+		return false
+	}
+
+	obs.canceling = true
+	obs.lazy = lazy
+	obs.canceled = make(chan struct{})
+
+	return true
+}
+
+// canceling reports whether the observation is canceling, and whether lazily.
+func (m *ObservationManager) canceling(obs *observation) (bool, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return obs.canceling, obs.lazy
+}
+
+// canceled forgets the canceling observation and closes canceled.
+//
+// Returns false if the cancellation already completed.
+func (m *ObservationManager) canceled(obs *observation) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	select {
+	case <-obs.canceled:
+		return false
+	default:
+	}
+
+	close(obs.canceled)
+
+	key := string(obs.info.Token)
+	if m.observations[key] == obs {
+		delete(m.observations, key)
+	}
+
+	return true
+}
+
+// registered records a successful registration with the sequence number of its response.
+//
+// Returns true with the ending response if the observation ended while registering and is to be re-registered.
+func (m *ObservationManager) registered(obs *observation, sequence uint32, now time.Time) (bool, *Response) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	obs.info.Sequence = sequence
+	obs.info.Updated = now
+	obs.info.Registrations++
+
+	if obs.ended {
+		ended := obs.endedResponse
+		obs.ended = false
+		obs.endedResponse = nil
+
+		return true, ended
+	}
+
+	obs.registering = false
+
+	return false, nil
+}
+
+// accept records the notification if it is newer than the last one accepted.
+//
+// https://datatracker.ietf.org/doc/html/rfc7641#section-3.4
+func (m *ObservationManager) accept(obs *observation, sequence uint32, now time.Time) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if !newerNotification(obs.info.Sequence, sequence, obs.info.Updated, now) {
+		return false
+	}
+
+	obs.info.Sequence = sequence
+	obs.info.Updated = now
+
+	return true
+}
+
+// reregister marks the observation ended by the response as registering.
+//
+// Returns false if a registration is already in flight, the observation is re-registered once it completes.
+func (m *ObservationManager) reregister(obs *observation, ended *Response) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if obs.registering {
+		obs.ended = true
+		obs.endedResponse = ended
+
+		return false
+	}
+
+	obs.registering = true
+
+	return true
+}
+
+// Observe registers an observation of the resource at the coap URL and returns the first response.
+//
+// Notifications are passed to notify in the order they are accepted, notifications older than the last
+// one accepted are dropped. Notify is called by the goroutine reading responses and must not block.
+//
+// If a notification ends the observation, such as an error response or a response without Observe
+// sent by a server which lost the registration in a restart, the registration is re-issued with the same
+// token and its response passed to notify, resuming the stream. If the re-registration is answered without
+// Observe, notify is called with its response, if it fails, notify is called with the ending response and
+// the error, and the observation is forgotten.
+//
+// The observation is forgotten when the context is done, the server only learns about it from the Reset
+// answering its next notification, or the ICMP error once the connection created by the client is closed.
+// CancelObserve cancels the observation on the server instead, either proactively or lazily,
+// see CancelObserveOptions.
+//
+// If the response does not carry Observe, the resource is not observable and the response is returned
+// without registering an observation.
+//
+// Returns errors of Get.
+//
+// https://datatracker.ietf.org/doc/html/rfc7641#section-3.3.1
+func (c *Client) Observe(ctx context.Context, rawURL string, notify func(resp *Response, err error)) (*Response, error) {
+	req, err := c.request(GET, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	release := sync.OnceFunc(func() {
+		c.release(conn)
+	})
+
+	addr, err := c.resolve(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	req.SetObserve(true)
+	req.Token, err = c.ConnOptions.TokenPolicy.check(conn.token(addr))
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	obs := &observation{
+		ctx:     ctx,
+		req:     req,
+		notify:  notify,
+		conn:    conn,
+		release: release,
+		info: ObservationInfo{
+			Token: req.Token,
+			URL:   rawURL,
+		},
+		registering: true,
+	}
+
+	// notifications may follow the response before Do returns
+	c.observations.add(obs)
+
+	resp, err := c.Do(ctx, req)
+	if err != nil {
+		c.forget(obs)
+		return nil, err
+	}
+
+	if resp.Observe == nil || Code(resp.Code).Class() != 2 {
+		c.forget(obs)
+		return resp, nil
+	}
+
+	context.AfterFunc(ctx, func() {
+		c.forget(obs)
+	})
+
+	again, ended := c.observations.registered(obs, *resp.Observe, obs.conn.opts.Clock.Now())
+	if again {
+		go c.reregister(obs, ended)
+	}
+
+	return resp, nil
+}
+
+// CancelObserve cancels the observation registered by Observe with the token, see Observations.
+//
+// RFC 7641 allows two ways to cancel an observation, both supported:
+//
+//   - proactively, the default, by sending the registration request again with Observe set to
+//     ObserveDeregister, see Request.CancelObserve, the observation ends once the server responds,
+//   - lazily, with Lazy set, by answering the next notification with a Reset using Conn.Reset, for
+//     servers that prefer lazy cancellation, the observation ends once the Reset is sent or Timeout passes.
+//
+// Notifications received while canceling are dropped. Once the observation ends, notify is called a last
+// time with ObservationCanceled and the observation is forgotten, later notifications are answered with Reset.
+//
+// Returns UnknownObservation if there is no active observation with the token.
+//
+// Returns errors of Do for the deregistration request, the observation ends regardless.
+//
+// Returns the context error if the context is done before the observation ends, the observation ends regardless.
+//
+// https://datatracker.ietf.org/doc/html/rfc7641#section-3.6
+func (c *Client) CancelObserve(ctx context.Context, token Token, opts CancelObserveOptions) error {
+	obs := c.observations.get(token)
+	if obs == nil {
+		return UnknownObservation{
+			Token: token,
+		}
+	}
+
+	if !c.observations.cancel(obs, opts.Lazy) {
+		// canceled concurrently, await its end
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-obs.canceled:
+			return nil
+		}
+	}
+	defer c.canceled(obs)
+
+	if !opts.Lazy {
+		_, err := c.Do(ctx, obs.req.CancelObserve())
+		return err
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = obs.conn.opts.MaxTransmitWait
+	}
+
+	timer := obs.conn.opts.Clock.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+	case <-obs.canceled:
+	}
+
+	return nil
+}
+
+// Observations returns active observations of the client.
+func (c *Client) Observations() []ObservationInfo {
+	return c.observations.List()
+}
+
+// notify passes the notification to the observation, or re-registers the observation ended by it.
+//
+// Notifications of canceling observations are dropped.
+func (c *Client) notify(obs *observation, msg *Message) {
+	if canceling, _ := c.observations.canceling(obs); canceling {
+		return
+	}
+
+	resp := &Response{}
+	err := resp.fromMessage(msg, obs.conn.opts.MarshalOptions)
+	if err != nil {
+		return
+	}
+
+	if resp.Observe != nil && Code(resp.Code).Class() == 2 {
+		if c.observations.accept(obs, *resp.Observe, obs.conn.opts.Clock.Now()) {
+			obs.notify(resp, nil)
+		}
+
+		return
+	}
+
+	if c.observations.reregister(obs, resp) {
+		go c.reregister(obs, resp)
+	}
+}
+
+// reregister re-issues the registration of the observation ended by the response.
+func (c *Client) reregister(obs *observation, ended *Response) {
+	resp, err := c.Do(obs.ctx, obs.req)
+	if canceling, _ := c.observations.canceling(obs); canceling {
+		return
+	}
+
+	if err == nil && resp.Observe != nil && Code(resp.Code).Class() == 2 {
+		again, next := c.observations.registered(obs, *resp.Observe, obs.conn.opts.Clock.Now())
+		obs.notify(resp, nil)
+
+		if again {
+			go c.reregister(obs, next)
+		}
+
+		return
+	}
+
+	c.forget(obs)
+
+	switch {
+	case obs.ctx.Err() != nil:
+		// observation forgotten meanwhile
+	case err != nil:
+		obs.notify(ended, err)
+	default:
+		obs.notify(resp, nil)
+	}
+}
+
+// forget removes the observation and releases its Conn.
+func (c *Client) forget(obs *observation) {
+	c.observations.remove(obs)
+	obs.release()
+}
+
+// canceled ends the canceling observation, notify is called with ObservationCanceled once.
+func (c *Client) canceled(obs *observation) {
+	if c.observations.canceled(obs) {
+		obs.release()
+		obs.notify(nil, ObservationCanceled{
+			Token: obs.info.Token,
+		})
+	}
+}
+
+// newerNotification reports whether notification with sequence v2 received at t2 is newer than
+// the one with sequence v1 received at t1.
+//
+// https://datatracker.ietf.org/doc/html/rfc7641#section-3.4
+func newerNotification(v1, v2 uint32, t1, t2 time.Time) bool {
+	return (v1 < v2 && v2-v1 < ObserveSequenceWindow) ||
+		(v1 > v2 && v1-v2 > ObserveSequenceWindow) ||
+		t2.After(t1.Add(ObserveFreshness))
+}
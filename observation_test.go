@@ -0,0 +1,612 @@
+package coap
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// observeServer is a server answering observations by hand.
+type observeServer struct {
+	t    *testing.T
+	conn net.PacketConn
+	msgs chan observeReceived
+}
+
+type observeReceived struct {
+	msg  *Message
+	addr net.Addr
+}
+
+func newObserveServer(t *testing.T) *observeServer {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	s := &observeServer{
+		t:    t,
+		conn: conn,
+		msgs: make(chan observeReceived, 16),
+	}
+
+	go func() {
+		buf := make([]byte, MaxMessageLength)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			msg := &Message{}
+			_, err = msg.Decode(buf[:n], MarshalOptions{})
+			if err != nil {
+				continue
+			}
+
+			s.msgs <- observeReceived{msg, addr}
+		}
+	}()
+
+	return s
+}
+
+func (s *observeServer) url() string {
+	return "coap://" + s.conn.LocalAddr().String() + "/temp"
+}
+
+// receive returns the next message of the type.
+func (s *observeServer) receive(typ Type) observeReceived {
+	s.t.Helper()
+
+	select {
+	case received := <-s.msgs:
+		if received.msg.Type != typ {
+			s.t.Fatalf("received %s, want %s", received.msg.Type, typ)
+		}
+
+		return received
+	case <-time.After(time.Second):
+		s.t.Fatal("no message received")
+		return observeReceived{}
+	}
+}
+
+// send sends the response with the token to the client, Observe is omitted if sequence is negative.
+func (s *observeServer) send(to observeReceived, typ Type, id MessageID, code ResponseCode, sequence int, payload string) {
+	s.t.Helper()
+
+	resp := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    typ,
+			Code:    Code(code),
+			ID:      id,
+			Token:   to.msg.Token,
+		},
+		Payload: []byte(payload),
+	}
+	if sequence >= 0 {
+		Must(resp.Options.SetUint(Observe, uint32(sequence)))
+	}
+
+	data, err := resp.MarshalBinary()
+	if err != nil {
+		s.t.Fatal("marshal:", err)
+	}
+
+	_, err = s.conn.WriteTo(data, to.addr)
+	if err != nil {
+		s.t.Fatal("write:", err)
+	}
+}
+
+// register answers the registration with the sequence number.
+func (s *observeServer) register(sequence int, payload string) observeReceived {
+	s.t.Helper()
+
+	req := s.receive(Confirmable)
+	observe, err := req.msg.Options.GetUint(Observe)
+	if err != nil || observe != ObserveRegister {
+		s.t.Fatalf("registration observe = %d, %v", observe, err)
+	}
+
+	s.send(req, Acknowledgement, req.msg.ID, Content, sequence, payload)
+
+	return req
+}
+
+// listenPacket returns a connection listening on a random local port, closed by the client using it.
+func listenPacket(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+
+	return conn
+}
+
+func notifications(t *testing.T, ch <-chan *Response, expect ...string) {
+	t.Helper()
+
+	for _, payload := range expect {
+		select {
+		case resp := <-ch:
+			if string(resp.Payload) != payload {
+				t.Errorf("notification %q, want %q", resp.Payload, payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("notification %q not received", payload)
+		}
+	}
+}
+
+func TestClientObserve(t *testing.T) {
+	server := newObserveServer(t)
+
+	// the Conn over PacketConn outlives the observation to reject later notifications
+	client := &Client{
+		PacketConn: listenPacket(t),
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notified := make(chan *Response, 8)
+	registered := make(chan *Response, 1)
+	go func() {
+		resp, err := client.Observe(ctx, server.url(), func(resp *Response, err error) {
+			if err != nil {
+				t.Error("notify:", err)
+				return
+			}
+
+			notified <- resp
+		})
+		if err != nil {
+			t.Error("observe:", err)
+		}
+
+		registered <- resp
+	}()
+
+	req := server.register(5, "20C")
+	resp := <-registered
+	if resp == nil || string(resp.Payload) != "20C" {
+		t.Fatalf("registration response = %v", resp)
+	}
+
+	server.send(req, NonConfirmable, 0x0101, Content, 6, "21C")
+	server.send(req, NonConfirmable, 0x0102, Content, 4, "stale")
+	server.send(req, Confirmable, 0x0103, Content, 7, "22C")
+
+	notifications(t, notified, "21C", "22C")
+
+	ack := server.receive(Acknowledgement)
+	if ack.msg.ID != 0x0103 {
+		t.Errorf("ack ID = %#x, want 0x0103", ack.msg.ID)
+	}
+
+	expect := []ObservationInfo{
+		{
+			Token:         req.msg.Token,
+			URL:           server.url(),
+			Sequence:      7,
+			Registrations: 1,
+		},
+	}
+
+	diff := cmp.Diff(expect, client.Observations(), cmpopts.IgnoreFields(ObservationInfo{}, "Updated"))
+	if diff != "" {
+		t.Errorf("observations mismatch (-want +got):\n%s", diff)
+	}
+
+	cancel()
+	for len(client.Observations()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// notifications of forgotten observations are rejected
+	server.send(req, Confirmable, 0x0104, Content, 8, "23C")
+
+	reset := server.receive(Reset)
+	if reset.msg.ID != 0x0104 {
+		t.Errorf("reset ID = %#x, want 0x0104", reset.msg.ID)
+	}
+}
+
+func TestClientObserveReregister(t *testing.T) {
+	server := newObserveServer(t)
+
+	client := &Client{}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notified := make(chan *Response, 8)
+	go func() {
+		_, err := client.Observe(ctx, server.url(), func(resp *Response, err error) {
+			if err != nil {
+				t.Error("notify:", err)
+				return
+			}
+
+			notified <- resp
+		})
+		if err != nil {
+			t.Error("observe:", err)
+		}
+	}()
+
+	first := server.register(5, "20C")
+
+	// server restarted and lost the registration
+	server.send(first, NonConfirmable, 0x0201, Content, -1, "restarted")
+
+	second := server.register(1, "resumed")
+	if string(second.msg.Token) != string(first.msg.Token) {
+		t.Errorf("re-registration token %x, want %x", second.msg.Token, first.msg.Token)
+	}
+
+	notifications(t, notified, "resumed")
+
+	observations := client.Observations()
+	if len(observations) != 1 || observations[0].Registrations != 2 || observations[0].Sequence != 1 {
+		t.Errorf("observations = %+v, want one with 2 registrations and sequence 1", observations)
+	}
+
+	// resource removed, re-registration fails and the observation ends
+	server.send(first, NonConfirmable, 0x0202, NotFound, -1, "")
+
+	third := server.receive(Confirmable)
+	server.send(third, Acknowledgement, third.msg.ID, NotFound, -1, "gone")
+
+	notifications(t, notified, "gone")
+
+	if len(client.Observations()) != 0 {
+		t.Errorf("observations = %+v, want none", client.Observations())
+	}
+}
+
+func TestClientObserveReregisterError(t *testing.T) {
+	server := newObserveServer(t)
+
+	client := &Client{}
+	defer client.Close()
+
+	type notification struct {
+		resp *Response
+		err  error
+	}
+
+	notified := make(chan notification, 8)
+	go func() {
+		_, err := client.Observe(context.Background(), server.url(), func(resp *Response, err error) {
+			notified <- notification{resp, err}
+		})
+		if err != nil {
+			t.Error("observe:", err)
+		}
+	}()
+
+	first := server.register(5, "20C")
+
+	// the stream ends and the re-registration is rejected
+	server.send(first, NonConfirmable, 0x0601, ServiceUnavailable, -1, "ended")
+
+	second := server.receive(Confirmable)
+	server.send(second, Reset, second.msg.ID, 0, -1, "")
+
+	select {
+	case got := <-notified:
+		if got.resp == nil || string(got.resp.Payload) != "ended" {
+			t.Errorf("notified %v, want the ending response", got.resp)
+		}
+
+		if !isError[ExchangeReset](got.err) {
+			t.Errorf("error = %v, want ExchangeReset", got.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failed re-registration not notified")
+	}
+
+	if len(client.Observations()) != 0 {
+		t.Errorf("observations = %+v, want none", client.Observations())
+	}
+}
+
+func TestClientObserveNotObservable(t *testing.T) {
+	server := newObserveServer(t)
+
+	client := &Client{}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	go func() {
+		req := server.receive(Confirmable)
+		server.send(req, Acknowledgement, req.msg.ID, Content, -1, "20C")
+	}()
+
+	resp, err := client.Observe(ctx, server.url(), func(_ *Response, _ error) {
+		t.Error("notified")
+	})
+	if err != nil {
+		t.Fatal("observe:", err)
+	}
+
+	if resp.Observe != nil || string(resp.Payload) != "20C" {
+		t.Errorf("response = %+v", resp)
+	}
+
+	if len(client.Observations()) != 0 {
+		t.Errorf("observations = %+v, want none", client.Observations())
+	}
+}
+
+// observed registers an observation of the server with the client, notifications and errors passed
+// to notify are sent to the returned channel.
+func observed(t *testing.T, client *Client, server *observeServer) (observeReceived, <-chan any) {
+	t.Helper()
+
+	notified := make(chan any, 8)
+	go func() {
+		_, err := client.Observe(context.Background(), server.url(), func(resp *Response, err error) {
+			if err != nil {
+				notified <- err
+				return
+			}
+
+			notified <- resp
+		})
+		if err != nil {
+			t.Error("observe:", err)
+		}
+	}()
+
+	req := server.register(5, "20C")
+	for len(client.Observations()) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	return req, notified
+}
+
+// canceledNotification expects the last call of notify with ObservationCanceled.
+func canceledNotification(t *testing.T, notified <-chan any, token Token) {
+	t.Helper()
+
+	select {
+	case got := <-notified:
+		canceled, ok := got.(ObservationCanceled)
+		if !ok || string(canceled.Token) != string(token) {
+			t.Errorf("notified %v, want ObservationCanceled", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancellation not notified")
+	}
+}
+
+// awaitCanceling waits until the observation with the token is canceling.
+func awaitCanceling(t *testing.T, client *Client, token Token) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		obs := client.observations.get(token)
+		if obs != nil {
+			if canceling, _ := client.observations.canceling(obs); canceling {
+				return
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("observation not canceling")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClientCancelObserve(t *testing.T) {
+	server := newObserveServer(t)
+
+	client := &Client{}
+	defer client.Close()
+
+	req, notified := observed(t, client, server)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.CancelObserve(context.Background(), req.msg.Token, CancelObserveOptions{})
+	}()
+
+	deregister := server.receive(Confirmable)
+	observe, err := deregister.msg.Options.GetUint(Observe)
+	if err != nil || observe != ObserveDeregister {
+		t.Errorf("deregistration observe = %d, %v", observe, err)
+	}
+
+	if string(deregister.msg.Token) != string(req.msg.Token) {
+		t.Errorf("deregistration token %x, want %x", deregister.msg.Token, req.msg.Token)
+	}
+
+	// notifications sent meanwhile are dropped
+	server.send(req, NonConfirmable, 0x0301, Content, 6, "21C")
+	server.send(deregister, Acknowledgement, deregister.msg.ID, Content, -1, "21C")
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Error("cancel:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancellation not acknowledged")
+	}
+
+	canceledNotification(t, notified, req.msg.Token)
+
+	if len(client.Observations()) != 0 {
+		t.Errorf("observations = %+v, want none", client.Observations())
+	}
+
+	// canceled observations are unknown
+	err = client.CancelObserve(context.Background(), req.msg.Token, CancelObserveOptions{})
+	if !isError[UnknownObservation](err) {
+		t.Errorf("error = %v, want UnknownObservation", err)
+	}
+}
+
+func TestClientCancelObserveLazy(t *testing.T) {
+	server := newObserveServer(t)
+
+	client := &Client{}
+	defer client.Close()
+
+	req, notified := observed(t, client, server)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.CancelObserve(context.Background(), req.msg.Token, CancelObserveOptions{
+			Lazy: true,
+		})
+	}()
+
+	awaitCanceling(t, client, req.msg.Token)
+
+	// the next notification is rejected, whether Confirmable or not
+	server.send(req, NonConfirmable, 0x0401, Content, 6, "21C")
+
+	reset := server.receive(Reset)
+	if reset.msg.ID != 0x0401 {
+		t.Errorf("reset ID = %#x, want 0x0401", reset.msg.ID)
+	}
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Error("cancel:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancellation not completed")
+	}
+
+	canceledNotification(t, notified, req.msg.Token)
+
+	if len(client.Observations()) != 0 {
+		t.Errorf("observations = %+v, want none", client.Observations())
+	}
+}
+
+func TestClientCancelObserveLazyTimeout(t *testing.T) {
+	server := newObserveServer(t)
+
+	clock := newFakeClock(time.Unix(0, 0))
+	client := &Client{
+		ConnOptions: ConnOptions{
+			Clock: clock,
+		},
+		PacketConn: listenPacket(t),
+	}
+	defer client.Close()
+
+	req, notified := observed(t, client, server)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.CancelObserve(context.Background(), req.msg.Token, CancelObserveOptions{
+			Lazy:    true,
+			Timeout: time.Minute,
+		})
+	}()
+
+	awaitCanceling(t, client, req.msg.Token)
+
+	// no notification follows, the observation ends with the timeout
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Error("cancel:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancellation not timed out")
+	}
+
+	canceledNotification(t, notified, req.msg.Token)
+
+	// later notifications of the forgotten observation are rejected
+	server.send(req, NonConfirmable, 0x0501, Content, 6, "21C")
+
+	reset := server.receive(Reset)
+	if reset.msg.ID != 0x0501 {
+		t.Errorf("reset ID = %#x, want 0x0501", reset.msg.ID)
+	}
+}
+
+func TestNewerNotification(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		v1    uint32
+		v2    uint32
+		t2    time.Time
+		newer bool
+	}{
+		{"greater", 5, 6, now, true},
+		{"same", 5, 5, now, false},
+		{"smaller", 6, 5, now, false},
+		{"wrapped", ObserveSequenceWindow*2 - 1, 1, now, true},
+		{"far ahead", 1, ObserveSequenceWindow + 2, now, false},
+		{"stale after freshness", 6, 5, now.Add(ObserveFreshness + time.Second), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newer := newerNotification(test.v1, test.v2, now, test.t2)
+			if newer != test.newer {
+				t.Errorf("newerNotification(%d, %d) = %v, want %v", test.v1, test.v2, newer, test.newer)
+			}
+		})
+	}
+}
+
+func TestObserveCounter(t *testing.T) {
+	counter := &ObserveCounter{}
+	if next := counter.Next(); next != 1 {
+		t.Errorf("Next() = %d, want 1", next)
+	}
+
+	counter.sequence.Store(MaxObserveSequence - 1)
+
+	expect := []uint32{MaxObserveSequence, 0, 1}
+	for _, sequence := range expect {
+		next := counter.Next()
+		if next != sequence {
+			t.Errorf("Next() = %d, want %d", next, sequence)
+		}
+
+		opts := Options{}
+		err := opts.SetUint(Observe, next)
+		if err != nil {
+			t.Errorf("SetUint(Observe, %d): %v", next, err)
+		}
+	}
+}
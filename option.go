@@ -2,6 +2,8 @@ package coap
 
 import (
 	"fmt"
+	"math"
+	"math/bits"
 	"reflect"
 	"slices"
 	"strconv"
@@ -62,6 +64,9 @@ func MustOptionValue(def OptionDef, value any) Option {
 // OptionValue creates an Option from the provided definition and value.
 //
 // Returns an error if the value does not match the expected format or length defined in OptionDef.
+//
+// Returns InvalidOptionDef instead if the value is rejected because the definition itself is inconsistent,
+// such as a uint option with zero MaxLen.
 func OptionValue(def OptionDef, value any) (Option, error) {
 	opt := Option{
 		OptionDef: def,
@@ -69,6 +74,11 @@ func OptionValue(def OptionDef, value any) (Option, error) {
 
 	err := opt.SetValue(value)
 	if err != nil {
+		defErr := def.Validate()
+		if isError[InvalidOptionDef](defErr) {
+			return Option{}, defErr
+		}
+
 		return Option{}, err
 	}
 
@@ -96,6 +106,33 @@ func (o Option) String() string {
 	}
 }
 
+// StringWithSchema returns a string representation of the Option like String, rendering values of ContentFormat
+// and Accept as names of media types defined by the schema and values of Block1 and Block2 as their fields,
+// such as Block2(num=3,more=true,szx=2). Schema defaults to DefaultSchema.
+func (o Option) StringWithSchema(schema *Schema) string {
+	if schema == nil {
+		schema = DefaultSchema
+	}
+
+	if o.ValueFormat != ValueFormatUint || o.Name == "" {
+		return o.String()
+	}
+
+	switch o.Code {
+	case ContentFormat.Code, Accept.Code:
+		return fmt.Sprintf("%s(%s)", o.Name, schema.MediaType(uint16(o.uintValue)))
+	case Block1.Code, Block2.Code:
+		block, err := ParseBlockValue(o.uintValue)
+		if err != nil {
+			return o.String()
+		}
+
+		return fmt.Sprintf("%s(num=%d,more=%t,szx=%d)", o.Name, block.Num, block.More, block.SZX)
+	default:
+		return o.String()
+	}
+}
+
 // GetValue returns the value of the option based on its ValueFormat.
 //
 // Prefer using specific getter methods like GetUint, GetOpaque, or GetString to ensure type safety and avoid reflect overhead.
@@ -122,15 +159,27 @@ func (o Option) GetValue() any {
 //
 // The value can be of type `uint32`, `[]byte`, or `string` depending on the ValueFormat.
 //
-// Note that if value is of other integer type it will be rejected.
+// Values of type `int`, `uint`, `uint8`, `uint16` and `uint64` are converted to uint32 for ValueFormatUint.
 //
 // Returns InvalidOptionValueFormat if the value type does not match the expected value format.
 //
-// Returns InvalidOptionValueLength if the value length does not match the expected length.
+// Returns InvalidOptionValueLength if the value length does not match the expected length,
+// or an integer value is negative or does not fit 32 bits.
 func (o *Option) SetValue(value any) error {
 	switch v := value.(type) {
 	case uint32:
 		return o.SetUint(v)
+	case int:
+		// negative values convert to 8 bytes long values
+		return o.setUint64(uint64(v))
+	case uint:
+		return o.setUint64(uint64(v))
+	case uint8:
+		return o.SetUint(uint32(v))
+	case uint16:
+		return o.SetUint(uint32(v))
+	case uint64:
+		return o.setUint64(v)
 	case []byte:
 		return o.SetOpaque(v)
 	case string:
@@ -143,6 +192,25 @@ func (o *Option) SetValue(value any) error {
 	}
 }
 
+// setUint64 sets the value of the option checking that it fits uint32.
+func (o *Option) setUint64(value uint64) error {
+	if o.ValueFormat != ValueFormatUint {
+		return InvalidOptionValueFormat{
+			OptionDef: o.OptionDef,
+			Requested: ValueFormatUint,
+		}
+	}
+
+	if value > math.MaxUint32 {
+		return InvalidOptionValueLength{
+			OptionDef: o.OptionDef,
+			Length:    uint16((bits.Len64(value) + 7) / 8),
+		}
+	}
+
+	return o.SetUint(uint32(value))
+}
+
 // Length returns the encoded length of the option value.
 func (o Option) Length() uint16 {
 	switch o.ValueFormat {
@@ -277,8 +345,31 @@ func (o *Option) SetString(value string) error {
 	return nil
 }
 
+// AppendBinary appends the encoded option to the provided data slice, using the previous option code
+// to compute the delta.
+//
+// Returns the updated data slice and the option code to be passed as prev to the next option.
+//
+// Returns InvalidOptionDelta if the option code precedes the previous option code.
+func (o Option) AppendBinary(data []byte, prev uint16) ([]byte, uint16, error) {
+	if o.Code < prev {
+		return data, prev, InvalidOptionDelta{
+			Code: o.Code,
+			Prev: prev,
+		}
+	}
+
+	return o.encode(data, prev), o.Code, nil
+}
+
 // Encode appends the encoded option to the provided data slice.
+//
+// The delta is not checked, options have to be sorted by the caller, see AppendBinary.
 func (o Option) Encode(data []byte, prev uint16) []byte {
+	return o.encode(data, prev)
+}
+
+func (o Option) encode(data []byte, prev uint16) []byte {
 	// reserve space for delta/length header
 	header := len(data)
 	data = append(data, 0)
@@ -298,16 +389,32 @@ func (o Option) Encode(data []byte, prev uint16) []byte {
 		return data
 	}
 
+	return o.appendValue(data)
+}
+
+// appendValue appends the value of the option as it is put on the wire.
+func (o Option) appendValue(data []byte) []byte {
 	switch o.ValueFormat {
 	case ValueFormatOpaque:
-		data = append(data, o.opaqueValue...)
+		return append(data, o.opaqueValue...)
 	case ValueFormatString:
-		data = append(data, o.stringValue...)
+		return append(data, o.stringValue...)
 	case ValueFormatUint:
-		data = Encode32(o.uintValue, data)
+		if o.uintValue == 0 {
+			return data
+		}
+
+		return Encode32(o.uintValue, data)
+	default:
+		return data
 	}
+}
 
-	return data
+// AppendWire appends the option exactly as it is put on the wire by Encode.
+//
+// Intended for computing signatures and MACs over encoded options, the encoding is stable across releases.
+func (o Option) AppendWire(data []byte, prev uint16) []byte {
+	return o.Encode(data, prev)
 }
 
 // Decode decodes the option from the provided data slice, using the previous option code and schema.
@@ -316,7 +423,8 @@ func (o Option) Encode(data []byte, prev uint16) []byte {
 //
 // Returns TruncatedError if the data is too short to decode the option.
 //
-// Returns InvalidOptionValueLength if the decoded length does not match the expected length.
+// Returns InvalidOptionValueLength if the decoded length does not match the expected length,
+// unless LenientFormat is set and the length does not exceed MaxOptionLength.
 func (o *Option) Decode(data []byte, prev uint16, opts MarshalOptions) ([]byte, error) {
 	if opts.Schema == nil {
 		opts.Schema = DefaultSchema
@@ -326,26 +434,7 @@ func (o *Option) Decode(data []byte, prev uint16, opts MarshalOptions) ([]byte,
 		opts.MaxOptionLength = MaxOptionLength
 	}
 
-	if len(data) == 0 {
-		return data, TruncatedError{
-			Expected: 1,
-		}
-	}
-
-	header := data[0]
-	data = data[1:]
-
-	// decode delta
-	var delta uint16
-	var err error
-	delta, data, err = DecodeExtend(data, header>>4)
-	if err != nil {
-		return data, err
-	}
-
-	// decode length
-	var length uint16
-	length, data, err = DecodeExtend(data, header&0x0F)
+	delta, length, data, err := decodeOptionHeader(data)
 	if err != nil {
 		return data, err
 	}
@@ -356,31 +445,82 @@ func (o *Option) Decode(data []byte, prev uint16, opts MarshalOptions) ([]byte,
 
 	// check length against option definition
 	o.MaxLen = min(o.OptionDef.MaxLen, opts.MaxOptionLength)
+	malformed := length < o.MinLen || length > o.MaxLen || o.ValueFormat == ValueFormatEmpty && length != 0
 	switch {
 	case len(data) < int(length):
 		return data, TruncatedError{
 			Expected: uint(length),
 		}
+	case malformed && opts.LenientFormat && length <= opts.MaxOptionLength:
+		// keep raw value of the option not matching its definition
+		o.OptionDef = UnrecognizedOptionDef(code, opts.MaxOptionLength)
 	case length < o.MinLen || length > o.MaxLen:
 		return data, InvalidOptionValueLength{
 			OptionDef: o.OptionDef,
 			Length:    length,
 		}
-	case length == 0:
-		return data, nil
+	case o.ValueFormat == ValueFormatEmpty && length != 0:
+		// empty options have no value regardless of the length limits of the definition
+		return data, InvalidOptionValueLength{
+			OptionDef: o.OptionDef,
+			Length:    length,
+		}
+	}
+
+	o.decodeValue(data[:length], opts.Interner)
+
+	return data[length:], nil
+}
+
+// decodeOptionHeader decodes option delta and value length.
+//
+// Returns the remaining data starting at option value.
+func decodeOptionHeader(data []byte) (uint16, uint16, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, data, TruncatedError{
+			Expected: 1,
+		}
+	}
+
+	header := data[0]
+	data = data[1:]
+
+	// decode delta
+	delta, data, err := DecodeExtend(data, header>>4)
+	if err != nil {
+		return 0, 0, data, err
+	}
+
+	// decode length
+	length, data, err := DecodeExtend(data, header&0x0F)
+	if err != nil {
+		return 0, 0, data, err
+	}
+
+	return delta, length, data, nil
+}
+
+// decodeValue decodes value according to value format, length has to be checked by caller.
+//
+// String values are taken from interner if set.
+func (o *Option) decodeValue(value []byte, interner StringInterner) {
+	if len(value) == 0 {
+		return
 	}
 
-	// decode value
 	switch o.ValueFormat {
 	case ValueFormatOpaque:
-		o.opaqueValue = slices.Clone(data[:length])
+		o.opaqueValue = slices.Clone(value)
 	case ValueFormatString:
-		o.stringValue = string(data[:length])
+		if interner != nil {
+			o.stringValue = interner.Get(value)
+			break
+		}
+
+		o.stringValue = string(value)
 	case ValueFormatUint:
-		o.uintValue = Decode32(data[:length])
+		o.uintValue = Decode32(value)
 	}
-
-	return data[length:], nil
 }
 
 // Len32 returns minimum number of bytes required to encode a uint32 value in big-endian format
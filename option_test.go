@@ -1,6 +1,7 @@
 package coap
 
 import (
+	"math"
 	"reflect"
 	"slices"
 	"testing"
@@ -170,6 +171,76 @@ func TestOptionSetValue(t *testing.T) {
 				Length:    4,
 			},
 		},
+		{
+			name:   "valid int value",
+			option: URIPort,
+			value:  5683,
+		},
+		{
+			name:   "valid uint8 value",
+			option: URIPort,
+			value:  uint8(0x42),
+		},
+		{
+			name:   "valid uint16 value",
+			option: URIPort,
+			value:  uint16(0x4242),
+		},
+		{
+			name:   "valid uint value",
+			option: MaxAge,
+			value:  uint(math.MaxUint32),
+		},
+		{
+			name:   "valid uint64 value",
+			option: MaxAge,
+			value:  uint64(math.MaxUint32),
+		},
+		{
+			name:   "int value too long",
+			option: URIPort,
+			value:  0x424242,
+			err: InvalidOptionValueLength{
+				OptionDef: URIPort,
+				Length:    3,
+			},
+		},
+		{
+			name:   "negative int value",
+			option: MaxAge,
+			value:  -1,
+			err: InvalidOptionValueLength{
+				OptionDef: MaxAge,
+				Length:    8,
+			},
+		},
+		{
+			name:   "int value overflow",
+			option: MaxAge,
+			value:  math.MaxUint32 + 1,
+			err: InvalidOptionValueLength{
+				OptionDef: MaxAge,
+				Length:    5,
+			},
+		},
+		{
+			name:   "uint64 value overflow",
+			option: MaxAge,
+			value:  uint64(math.MaxUint64),
+			err: InvalidOptionValueLength{
+				OptionDef: MaxAge,
+				Length:    8,
+			},
+		},
+		{
+			name:   "int value not a uint option",
+			option: URIHost,
+			value:  math.MaxUint32 + 1,
+			err: InvalidOptionValueFormat{
+				OptionDef: URIHost,
+				Requested: ValueFormatUint,
+			},
+		},
 		{
 			name:   "valid opaque value",
 			option: IfMatch,
@@ -243,10 +314,16 @@ func TestOptionSetValue(t *testing.T) {
 }
 
 func TestOptionDecodeError(t *testing.T) {
+	// empty option allowing values by mistake, AddOptions panics on it so it is registered directly
+	empty := OptionDef{Code: 65000, Name: "Empty", ValueFormat: ValueFormatEmpty, MaxLen: 8}
+	inconsistent := NewSchema()
+	inconsistent.options[empty.Code] = empty
+
 	tests := []struct {
-		name  string
-		input []byte
-		err   error
+		name   string
+		input  []byte
+		schema *Schema
+		err    error
 	}{
 		{
 			name:  "empty input",
@@ -301,12 +378,29 @@ func TestOptionDecodeError(t *testing.T) {
 				Length:    3,
 			},
 		},
+		{
+			name:  "empty value format with value",
+			input: []byte{0x51, 0x00},
+			err: InvalidOptionValueLength{
+				OptionDef: IfNoneMatch,
+				Length:    1,
+			},
+		},
+		{
+			name:   "empty value format with value within max length",
+			input:  []byte{0xE2, 0xFC, 0xDB, 0x42, 0x42},
+			schema: inconsistent,
+			err: InvalidOptionValueLength{
+				OptionDef: empty,
+				Length:    2,
+			},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			opt := Option{}
-			_, err := opt.Decode(test.input, 0, MarshalOptions{})
+			_, err := opt.Decode(test.input, 0, MarshalOptions{Schema: test.schema})
 			diff := cmp.Diff(test.err, err, cmpopts.EquateErrors())
 			if diff != "" {
 				t.Errorf("error mismatch (-want +got):\n%s", diff)
@@ -323,3 +417,108 @@ func expectErr(t testing.TB, err error, expected error) {
 		t.Errorf("error mismatch (-want +got):\n%s", diff)
 	}
 }
+
+// TestOptionAppendWire pins wire encoding, changes break deployed signatures.
+func TestOptionAppendWire(t *testing.T) {
+	tests := []struct {
+		name   string
+		option Option
+		prev   uint16
+		data   []byte
+	}{
+		{
+			name:   "uint",
+			option: MustOptionValue(URIPort, uint32(5683)),
+			data:   []byte{0x72, 0x16, 0x33},
+		},
+		{
+			name:   "string after previous",
+			option: MustOptionValue(URIPath, "a"),
+			prev:   URIHost.Code,
+			data:   []byte{0x81, 0x61},
+		},
+		{
+			name:   "delta extend byte",
+			option: MustOptionValue(ProxyURI, "coap://x"),
+			data:   append([]byte{0xD8, 0x16}, "coap://x"...),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.option.AppendWire([]byte{0xff}, test.prev)
+			diff := cmp.Diff(append([]byte{0xff}, test.data...), data)
+			if diff != "" {
+				t.Error("wire data mismatch (-want +got):\n", diff)
+			}
+
+			diff = cmp.Diff(test.option.Encode(nil, test.prev), data[1:])
+			if diff != "" {
+				t.Error("wire data differs from Encode (-want +got):\n", diff)
+			}
+		})
+	}
+}
+
+func TestOptionAppendBinary(t *testing.T) {
+	path := MustOptionValue(URIPath, "a")
+	query := MustOptionValue(URIQuery, "b")
+
+	data, prev, err := path.AppendBinary(nil, 0)
+	if err != nil {
+		t.Fatal("append path:", err)
+	}
+
+	data, prev, err = query.AppendBinary(data, prev)
+	if err != nil {
+		t.Fatal("append query:", err)
+	}
+
+	if prev != URIQuery.Code {
+		t.Errorf("prev = %d, want %d", prev, URIQuery.Code)
+	}
+
+	diff := cmp.Diff([]byte{0xb1, 0x61, 0x41, 0x62}, data)
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+
+	out, prev, err := path.AppendBinary(data, prev)
+	expectErr(t, err, InvalidOptionDelta{
+		Code: URIPath.Code,
+		Prev: URIQuery.Code,
+	})
+
+	if prev != URIQuery.Code || len(out) != len(data) {
+		t.Errorf("expected data and prev unchanged on error, got %x, %d", out, prev)
+	}
+}
+
+func TestOptionStringWithSchema(t *testing.T) {
+	schema := DefaultSchema.WithOverlay().AddMediaTypes(MediaType{Code: 65000, Name: "application/vnd.example"})
+
+	tests := []struct {
+		name   string
+		option Option
+		expect string
+	}{
+		{"content format", MustOptionValue(ContentFormat, uint32(MediaTypeApplicationJSON.Code)), "ContentFormat(application/json)"},
+		{"accept", MustOptionValue(Accept, uint32(MediaTypeApplicationCBOR.Code)), "Accept(application/cbor)"},
+		{"vendor media type", MustOptionValue(ContentFormat, uint32(65000)), "ContentFormat(application/vnd.example)"},
+		{"unknown media type", MustOptionValue(ContentFormat, uint32(65001)), "ContentFormat(MediaType(65001))"},
+		{"block2", MustOptionValue(Block2, BlockValue{Num: 3, More: true, SZX: 2}.Uint()), "Block2(num=3,more=true,szx=2)"},
+		{"block1", MustOptionValue(Block1, BlockValue{SZX: 6}.Uint()), "Block1(num=0,more=false,szx=6)"},
+		{"reserved block size", MustOptionValue(Block1, uint32(0x17)), "Block1(23)"},
+		{"other", MustOptionValue(URIPath, "temp"), `URIPath("temp")`},
+		{"unrecognized", MustOptionValue(UnrecognizedOptionDef(ContentFormat.Code, 8), []byte{0x32}), "12(32)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := test.option.StringWithSchema(schema)
+			if s != test.expect {
+				t.Errorf("StringWithSchema() = %q, want %q", s, test.expect)
+			}
+		})
+	}
+}
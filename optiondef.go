@@ -25,6 +25,7 @@ var (
 	Size1         = OptionDef{Code: 60, Name: "Size1", ValueFormat: ValueFormatUint, MaxLen: 4}
 	Size2         = OptionDef{Code: 28, Name: "Size2", ValueFormat: ValueFormatUint, MaxLen: 4}
 	NoResponse    = OptionDef{Code: 258, Name: "NoResponse", ValueFormat: ValueFormatUint, MaxLen: 1}
+	RequestTag    = OptionDef{Code: 292, Name: "RequestTag", ValueFormat: ValueFormatOpaque, Repeatable: true, MaxLen: 8}
 )
 
 // revive:enable:exported
@@ -39,6 +40,40 @@ type OptionDef struct {
 	Repeatable  bool
 	MinLen      uint16
 	MaxLen      uint16
+
+	// CriticalOverride declares the documented criticality, Schema.AddOptions checks it against the code.
+	CriticalOverride PropertyOverride
+
+	// UnsafeOverride declares the documented unsafe property, Schema.AddOptions checks it against the code.
+	UnsafeOverride PropertyOverride
+}
+
+// PropertyOverride declares an option property, so that OptionDef stays comparable.
+type PropertyOverride uint8
+
+const (
+	// PropertyUndeclared leaves the property to be derived from the code.
+	PropertyUndeclared PropertyOverride = 0x00
+
+	// PropertyTrue declares the property as set.
+	PropertyTrue PropertyOverride = 0x01
+
+	// PropertyFalse declares the property as not set.
+	PropertyFalse PropertyOverride = 0x02
+)
+
+// DeclareProperty returns the PropertyOverride declaring the value.
+func DeclareProperty(value bool) PropertyOverride {
+	if value {
+		return PropertyTrue
+	}
+
+	return PropertyFalse
+}
+
+// contradicts reports whether the property is declared with a value other than derived.
+func (p PropertyOverride) contradicts(derived bool) bool {
+	return p != PropertyUndeclared && p != DeclareProperty(derived)
 }
 
 // ValueFormat indicates the format of the option value.
@@ -58,6 +93,62 @@ const (
 	ValueFormatString ValueFormat = 0x03
 )
 
+// DefaultOptionMaxLen is the default maximum value length of options created by StringOption and OpaqueOption.
+const DefaultOptionMaxLen = 255
+
+// UintOption creates an OptionDef with uint value format.
+//
+// If maxLen is 0 or greater than 4, it defaults to 4 bytes.
+func UintOption(code uint16, name string, maxLen uint16) OptionDef {
+	if maxLen == 0 || maxLen > 4 {
+		maxLen = 4
+	}
+
+	return OptionDef{
+		Code:        code,
+		Name:        name,
+		ValueFormat: ValueFormatUint,
+		MaxLen:      maxLen,
+	}
+}
+
+// StringOption creates an OptionDef with string value format.
+//
+// If maxLen is 0, it defaults to DefaultOptionMaxLen. If minLen is greater than maxLen, it is capped to maxLen.
+func StringOption(code uint16, name string, minLen uint16, maxLen uint16) OptionDef {
+	return lengthOption(code, name, ValueFormatString, minLen, maxLen)
+}
+
+// OpaqueOption creates an OptionDef with opaque value format.
+//
+// If maxLen is 0, it defaults to DefaultOptionMaxLen. If minLen is greater than maxLen, it is capped to maxLen.
+func OpaqueOption(code uint16, name string, minLen uint16, maxLen uint16) OptionDef {
+	return lengthOption(code, name, ValueFormatOpaque, minLen, maxLen)
+}
+
+// EmptyOption creates an OptionDef with empty value format.
+func EmptyOption(code uint16, name string) OptionDef {
+	return OptionDef{
+		Code:        code,
+		Name:        name,
+		ValueFormat: ValueFormatEmpty,
+	}
+}
+
+func lengthOption(code uint16, name string, format ValueFormat, minLen uint16, maxLen uint16) OptionDef {
+	if maxLen == 0 {
+		maxLen = DefaultOptionMaxLen
+	}
+
+	return OptionDef{
+		Code:        code,
+		Name:        name,
+		ValueFormat: format,
+		MinLen:      min(minLen, maxLen),
+		MaxLen:      maxLen,
+	}
+}
+
 // UnrecognizedOptionDef creates an OptionDef for an unrecognized option code.
 func UnrecognizedOptionDef(code uint16, maxLen uint16) OptionDef {
 	return OptionDef{
@@ -87,6 +178,119 @@ func (o OptionDef) NoCacheKey() bool {
 	return o.Code&0x1E == 0x1c
 }
 
+// Properties returns critical, unsafe and no cache key properties derived from the code.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.4.6
+func (o OptionDef) Properties() (critical, unsafe, noCacheKey bool) {
+	return o.Critical(), o.Unsafe(), o.NoCacheKey()
+}
+
+// ForwardingClass classifies an option by how a proxy not recognizing it treats it.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.7.1
+type ForwardingClass uint8
+
+const (
+	// SafeToForward options are forwarded unchanged even if not recognized.
+	SafeToForward ForwardingClass = iota
+
+	// UnsafeCritical options not recognized cause the request to be rejected with BadOption.
+	UnsafeCritical
+
+	// UnsafeElective options not recognized are stripped from the forwarded request.
+	UnsafeElective
+)
+
+var forwardingClassString = map[ForwardingClass]string{
+	SafeToForward:  "SafeToForward",
+	UnsafeCritical: "UnsafeCritical",
+	UnsafeElective: "UnsafeElective",
+}
+
+// ForwardingClass returns the forwarding class derived from the code.
+func (o OptionDef) ForwardingClass() ForwardingClass {
+	switch {
+	case !o.Unsafe():
+		return SafeToForward
+	case o.Critical():
+		return UnsafeCritical
+	default:
+		return UnsafeElective
+	}
+}
+
+// String implements fmt.Stringer.
+func (c ForwardingClass) String() string {
+	s, ok := forwardingClassString[c]
+	if !ok {
+		return fmt.Sprintf("ForwardingClass(%d)", c)
+	}
+
+	return s
+}
+
+// MaxUintOptionLength is the maximum MaxLen of uint options, values are limited to 32 bits.
+const MaxUintOptionLength = 4
+
+// Validate checks the definition for internal consistency.
+//
+// Returns InvalidOptionDef if value length bounds do not fit the value format: empty format requires MinLen and MaxLen 0,
+// uint format requires MaxLen between 1 and MaxUintOptionLength, string and opaque formats require MaxLen of at least 1.
+// MinLen must not exceed MaxLen.
+//
+// Returns OptionPropertyMismatch if declared CriticalOverride or UnsafeOverride contradicts the option code.
+func (o OptionDef) Validate() error {
+	reason := ""
+	switch o.ValueFormat {
+	case ValueFormatEmpty:
+		if o.MinLen != 0 || o.MaxLen != 0 {
+			reason = "empty format requires zero MinLen and MaxLen"
+		}
+	case ValueFormatUint:
+		if o.MaxLen == 0 || o.MaxLen > MaxUintOptionLength {
+			reason = fmt.Sprintf("uint format requires MaxLen between 1 and %d", MaxUintOptionLength)
+		}
+	case ValueFormatOpaque, ValueFormatString:
+		if o.MaxLen == 0 {
+			reason = fmt.Sprintf("%s format requires non-zero MaxLen", o.ValueFormat)
+		}
+	default:
+		reason = fmt.Sprintf("unknown value format %d", o.ValueFormat)
+	}
+
+	if reason == "" && o.MinLen > o.MaxLen {
+		reason = "MinLen exceeds MaxLen"
+	}
+
+	if reason != "" {
+		return InvalidOptionDef{
+			OptionDef: o,
+			Reason:    reason,
+		}
+	}
+
+	return o.validateProperties()
+}
+
+// validateProperties checks declared properties against properties derived from the code.
+func (o OptionDef) validateProperties() error {
+	if o.CriticalOverride.contradicts(o.Critical()) {
+		return OptionPropertyMismatch{
+			OptionDef: o,
+			Property:  "critical",
+		}
+	}
+
+	if o.UnsafeOverride.contradicts(o.Unsafe()) {
+		return OptionPropertyMismatch{
+			OptionDef: o,
+			Property:  "unsafe",
+		}
+	}
+
+	return nil
+}
+
 // String implements fmt.Stringer.
 func (o OptionDef) String() string {
 	switch {
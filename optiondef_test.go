@@ -1,6 +1,11 @@
 package coap
 
-import "testing"
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
 
 func TestOptionDefMethods(t *testing.T) {
 	tests := []struct {
@@ -58,3 +63,288 @@ func TestOptionDefMethods(t *testing.T) {
 		})
 	}
 }
+
+func TestOptionDefProperties(t *testing.T) {
+	critical, unsafe, noCacheKey := Size1.Properties()
+	if critical || unsafe || !noCacheKey {
+		t.Errorf("Properties() = %v, %v, %v, want false, false, true", critical, unsafe, noCacheKey)
+	}
+}
+
+func TestOptionDefForwardingClass(t *testing.T) {
+	for code := uint16(1); code <= 1000; code++ {
+		def := UnrecognizedOptionDef(code, MaxOptionLength)
+
+		expect := SafeToForward
+		switch {
+		case code&2 != 0 && code&1 != 0:
+			expect = UnsafeCritical
+		case code&2 != 0:
+			expect = UnsafeElective
+		}
+
+		got := def.ForwardingClass()
+		if got != expect {
+			t.Errorf("code %d: ForwardingClass() = %s, want %s", code, got, expect)
+		}
+
+		_, unsafe, _ := def.Properties()
+		if unsafe != (got != SafeToForward) {
+			t.Errorf("code %d: ForwardingClass() = %s, Unsafe() = %v", code, got, unsafe)
+		}
+	}
+
+	tests := []struct {
+		def    OptionDef
+		expect ForwardingClass
+	}{
+		{IfMatch, SafeToForward},
+		{URIHost, UnsafeCritical},
+		{ETag, SafeToForward},
+		{URIPath, UnsafeCritical},
+		{ContentFormat, SafeToForward},
+		{MaxAge, UnsafeElective},
+		{Accept, SafeToForward},
+		{ProxyURI, UnsafeCritical},
+		{Size1, SafeToForward},
+		{Block2, UnsafeCritical},
+	}
+
+	for _, test := range tests {
+		t.Run(test.def.Name, func(t *testing.T) {
+			got := test.def.ForwardingClass()
+			if got != test.expect {
+				t.Errorf("ForwardingClass() = %s, want %s", got, test.expect)
+			}
+		})
+	}
+
+	if s := ForwardingClass(7).String(); s != "ForwardingClass(7)" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestSchemaAddOptionsOverride(t *testing.T) {
+	tests := []struct {
+		name string
+		def  OptionDef
+		err  error
+	}{
+		{
+			name: "matching overrides",
+			def:  OptionDef{Code: 65001, Name: "Vendor", CriticalOverride: PropertyTrue, UnsafeOverride: PropertyFalse},
+		},
+		{
+			name: "inconsistent lengths",
+			def:  OptionDef{Code: 65004, Name: "Broken", ValueFormat: ValueFormatUint},
+			err: InvalidOptionDef{
+				OptionDef: OptionDef{Code: 65004, Name: "Broken", ValueFormat: ValueFormatUint},
+				Reason:    "uint format requires MaxLen between 1 and 4",
+			},
+		},
+		{
+			name: "critical contradicts code",
+			def:  OptionDef{Code: 65000, Name: "Vendor", CriticalOverride: PropertyTrue},
+			err: OptionPropertyMismatch{
+				OptionDef: OptionDef{Code: 65000, Name: "Vendor", CriticalOverride: PropertyTrue},
+				Property:  "critical",
+			},
+		},
+		{
+			name: "unsafe contradicts code",
+			def:  OptionDef{Code: 65002, Name: "Vendor", UnsafeOverride: PropertyFalse},
+			err: OptionPropertyMismatch{
+				OptionDef: OptionDef{Code: 65002, Name: "Vendor", UnsafeOverride: PropertyFalse},
+				Property:  "unsafe",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			func() {
+				defer func() {
+					recovered := recover()
+					if recovered != nil {
+						err = recovered.(error)
+					}
+				}()
+
+				NewSchema().AddOptions(test.def)
+			}()
+
+			expectErr(t, err, test.err)
+		})
+	}
+}
+
+func TestOptionDefConstructors(t *testing.T) {
+	tests := []struct {
+		name string
+		def  OptionDef
+		want OptionDef
+	}{
+		{
+			name: "uint",
+			def:  UintOption(65000, "Vendor", 2),
+			want: OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatUint, MaxLen: 2},
+		},
+		{
+			name: "uint default width",
+			def:  UintOption(65000, "Vendor", 0),
+			want: OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatUint, MaxLen: 4},
+		},
+		{
+			name: "uint too wide",
+			def:  UintOption(65000, "Vendor", 8),
+			want: OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatUint, MaxLen: 4},
+		},
+		{
+			name: "string",
+			def:  StringOption(65000, "Vendor", 1, 16),
+			want: OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatString, MinLen: 1, MaxLen: 16},
+		},
+		{
+			name: "string default length",
+			def:  StringOption(65000, "Vendor", 1, 0),
+			want: OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatString, MinLen: 1, MaxLen: DefaultOptionMaxLen},
+		},
+		{
+			name: "opaque min capped",
+			def:  OpaqueOption(65000, "Vendor", 16, 8),
+			want: OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatOpaque, MinLen: 8, MaxLen: 8},
+		},
+		{
+			name: "empty",
+			def:  EmptyOption(65000, "Vendor"),
+			want: OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatEmpty},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := cmp.Diff(test.want, test.def)
+			if diff != "" {
+				t.Errorf("option mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestOptionDefValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		def    OptionDef
+		reason string
+		err    error
+	}{
+		{
+			name: "uint",
+			def:  UintOption(65000, "Vendor", 2),
+		},
+		{
+			name: "empty",
+			def:  EmptyOption(65000, "Vendor"),
+		},
+		{
+			name:   "empty with max length",
+			def:    OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatEmpty, MaxLen: 8},
+			reason: "empty format requires zero MinLen and MaxLen",
+		},
+		{
+			name:   "uint with zero max length",
+			def:    OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatUint},
+			reason: "uint format requires MaxLen between 1 and 4",
+		},
+		{
+			name:   "uint too wide",
+			def:    OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatUint, MaxLen: 8},
+			reason: "uint format requires MaxLen between 1 and 4",
+		},
+		{
+			name:   "string with zero max length",
+			def:    OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatString},
+			reason: "string format requires non-zero MaxLen",
+		},
+		{
+			name:   "opaque min exceeds max",
+			def:    OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatOpaque, MinLen: 16, MaxLen: 8},
+			reason: "MinLen exceeds MaxLen",
+		},
+		{
+			name:   "unknown format",
+			def:    OptionDef{Code: 65000, Name: "Vendor", ValueFormat: 7, MaxLen: 8},
+			reason: "unknown value format 7",
+		},
+		{
+			name: "property mismatch",
+			def:  OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatEmpty, CriticalOverride: PropertyTrue},
+			err: OptionPropertyMismatch{
+				OptionDef: OptionDef{Code: 65000, Name: "Vendor", ValueFormat: ValueFormatEmpty, CriticalOverride: PropertyTrue},
+				Property:  "critical",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expect := test.err
+			if test.reason != "" {
+				expect = InvalidOptionDef{
+					OptionDef: test.def,
+					Reason:    test.reason,
+				}
+			}
+
+			expectErr(t, test.def.Validate(), expect)
+		})
+	}
+}
+
+func TestDefaultSchemaValid(t *testing.T) {
+	options, _ := DefaultSchema.flatten()
+	for _, def := range options {
+		err := def.Validate()
+		if err != nil {
+			t.Errorf("%s: %v", def.Name, err)
+		}
+	}
+}
+
+func TestSchemaAddOptionsChecked(t *testing.T) {
+	valid := UintOption(65000, "Vendor", 2)
+	invalid := OptionDef{Code: 65004, Name: "Broken", ValueFormat: ValueFormatUint}
+
+	schema := NewSchema()
+	err := schema.AddOptionsChecked(valid, invalid)
+	if !errors.As(err, &InvalidOptionDef{}) {
+		t.Fatalf("AddOptionsChecked() = %v, want InvalidOptionDef", err)
+	}
+
+	diff := cmp.Diff(valid, schema.Option(valid.Code, 0))
+	if diff != "" {
+		t.Errorf("valid option mismatch (-want +got):\n%s", diff)
+	}
+
+	if schema.Option(invalid.Code, 0).Recognized() {
+		t.Error("invalid option registered")
+	}
+}
+
+func TestOptionValueInvalidDef(t *testing.T) {
+	broken := OptionDef{Code: 65000, Name: "Broken", ValueFormat: ValueFormatUint}
+
+	_, err := OptionValue(broken, uint32(42))
+	expectErr(t, err, InvalidOptionDef{
+		OptionDef: broken,
+		Reason:    "uint format requires MaxLen between 1 and 4",
+	})
+
+	// value-level problems of consistent definitions are reported as such
+	_, err = OptionValue(URIPort, uint32(0x42424242))
+	expectErr(t, err, InvalidOptionValueLength{
+		OptionDef: URIPort,
+		Length:    4,
+	})
+}
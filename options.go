@@ -2,6 +2,7 @@ package coap
 
 import (
 	"cmp"
+	"errors"
 	"iter"
 	"slices"
 )
@@ -11,16 +12,18 @@ type Options []Option
 
 // SortOptions sorts the options by their code in ascending order.
 //
-// Returns a new slice of options sorted by code.
+// Returns a new slice of options sorted by code, repeated options keep their relative order.
 func SortOptions(options Options) Options {
 	options = slices.Clone(options)
-	slices.SortFunc(options, func(l, r Option) int {
-		return cmp.Compare(l.Code, r.Code)
-	})
+	slices.SortStableFunc(options, compareOptions)
 
 	return options
 }
 
+func compareOptions(l, r Option) int {
+	return cmp.Compare(l.Code, r.Code)
+}
+
 // Contains checks if the given option is present.
 func (o Options) Contains(def OptionDef) bool {
 	i := Index(o, def)
@@ -63,6 +66,28 @@ func (o Options) GetAll(def OptionDef) iter.Seq[Option] {
 	}
 }
 
+// Group returns an iterator over options grouped by code in ascending order.
+//
+// Each code is yielded once with the definition of its first occurrence and all occurrences
+// in their relative order. The yielded slices share a sorted copy of the options.
+func (o Options) Group() iter.Seq2[OptionDef, []Option] {
+	return func(yield func(OptionDef, []Option) bool) {
+		options := SortOptions(o)
+		for len(options) > 0 {
+			end := 1
+			for end < len(options) && options[end].Code == options[0].Code {
+				end++
+			}
+
+			if !yield(options[0].OptionDef, options[:end:end]) {
+				return
+			}
+
+			options = options[end:]
+		}
+	}
+}
+
 // Clear removes all occurrences of the option with matching code.
 //
 // Returns number of options removed.
@@ -87,6 +112,32 @@ func (o Options) GetValue(def OptionDef) (any, bool) {
 	return opt.GetValue(), true
 }
 
+// GetAs retrieves the value of the first option matching the definition as T, delegating to GetUint,
+// GetString or GetOpaque.
+//
+// Returns OptionNotFound if the option is not present.
+//
+// Returns InvalidOptionValueFormat if the option value format does not match T.
+func GetAs[T uint32 | string | []byte](o Options, def OptionDef) (T, error) {
+	var zero T
+
+	var value any
+	var err error
+	switch any(zero).(type) {
+	case uint32:
+		value, err = o.GetUint(def)
+	case string:
+		value, err = o.GetString(def)
+	case []byte:
+		value, err = o.GetOpaque(def)
+	}
+	if err != nil {
+		return zero, err
+	}
+
+	return value.(T), nil
+}
+
 // SetValue creates or updates an option with the given value.
 //
 // Prefer to use specific methods SetUint, SetOpaque, SetString to ensure type safety and avoid reflect overhead.
@@ -187,6 +238,36 @@ func (o *Options) SetAllUint(def OptionDef, values iter.Seq[uint32]) error {
 	})
 }
 
+// ReplaceAllUint replaces all options matching the definition with the given sequence of uint32 values, in order.
+//
+// Options are left unchanged on error.
+//
+// Returns InvalidOptionValueFormat if the value format is not ValueFormatUint.
+//
+// Returns OptionNotRepeateable if more than one value is given for a non-repeatable option.
+//
+// Returns InvalidOptionValueLength if a value length is out of bounds.
+func (o *Options) ReplaceAllUint(def OptionDef, values iter.Seq[uint32]) error {
+	if def.ValueFormat != ValueFormatUint {
+		return InvalidOptionValueFormat{
+			OptionDef: def,
+			Requested: ValueFormatUint,
+		}
+	}
+
+	return o.replaceAll(def, func(yield func(Option) bool) {
+		for v := range values {
+			opt := Option{
+				OptionDef: def,
+				uintValue: v,
+			}
+			if !yield(opt) {
+				return
+			}
+		}
+	})
+}
+
 // GetOpaque retrieves the value of the first option matching the definition as []byte.
 //
 // Returns OptionNotFound if the option is not present.
@@ -269,6 +350,36 @@ func (o *Options) SetAllOpaque(def OptionDef, values iter.Seq[[]byte]) error {
 	})
 }
 
+// ReplaceAllOpaque replaces all options matching the definition with the given sequence of []byte values, in order.
+//
+// Options are left unchanged on error.
+//
+// Returns InvalidOptionValueFormat if the value format is not ValueFormatOpaque.
+//
+// Returns OptionNotRepeateable if more than one value is given for a non-repeatable option.
+//
+// Returns InvalidOptionValueLength if a value length is out of bounds.
+func (o *Options) ReplaceAllOpaque(def OptionDef, values iter.Seq[[]byte]) error {
+	if def.ValueFormat != ValueFormatOpaque {
+		return InvalidOptionValueFormat{
+			OptionDef: def,
+			Requested: ValueFormatOpaque,
+		}
+	}
+
+	return o.replaceAll(def, func(yield func(Option) bool) {
+		for v := range values {
+			opt := Option{
+				OptionDef:   def,
+				opaqueValue: v,
+			}
+			if !yield(opt) {
+				return
+			}
+		}
+	})
+}
+
 // GetString retrieves the value of the first option matching the definition as string.
 //
 // Returns OptionNotFound if the option is not present.
@@ -349,6 +460,36 @@ func (o *Options) SetAllString(def OptionDef, values iter.Seq[string]) error {
 	})
 }
 
+// ReplaceAllString replaces all options matching the definition with the given sequence of string values, in order.
+//
+// Options are left unchanged on error.
+//
+// Returns InvalidOptionValueFormat if the value format is not ValueFormatString.
+//
+// Returns OptionNotRepeateable if more than one value is given for a non-repeatable option.
+//
+// Returns InvalidOptionValueLength if a value length is out of bounds.
+func (o *Options) ReplaceAllString(def OptionDef, values iter.Seq[string]) error {
+	if def.ValueFormat != ValueFormatString {
+		return InvalidOptionValueFormat{
+			OptionDef: def,
+			Requested: ValueFormatString,
+		}
+	}
+
+	return o.replaceAll(def, func(yield func(Option) bool) {
+		for v := range values {
+			opt := Option{
+				OptionDef:   def,
+				stringValue: v,
+			}
+			if !yield(opt) {
+				return
+			}
+		}
+	})
+}
+
 // Encode encodes options into the data slice.
 //
 // If there are no options to encode, it returns the data slice unchanged.
@@ -357,7 +498,12 @@ func (o Options) Encode(data []byte) []byte {
 		return data // no options to encode
 	}
 
-	options := SortOptions(o)
+	// options are usually sorted already, skip the copy of SortOptions
+	options := o
+	if !slices.IsSortedFunc(o, compareOptions) {
+		options = SortOptions(o)
+	}
+
 	prev := uint16(0)
 	for _, opt := range options {
 		data = opt.Encode(data, prev)
@@ -367,21 +513,207 @@ func (o Options) Encode(data []byte) []byte {
 	return data
 }
 
+// EncodeSubset encodes only options selected by include into the data slice.
+//
+// Options are sorted by code and deltas are computed within the subset, so the encoding
+// does not depend on options left out. Intended for computing signatures and MACs,
+// the encoding is stable across releases.
+func (o Options) EncodeSubset(data []byte, include func(def OptionDef) bool) []byte {
+	subset := Options{}
+	for _, opt := range o {
+		if include(opt.OptionDef) {
+			subset = append(subset, opt)
+		}
+	}
+
+	return subset.Encode(data)
+}
+
+// CacheKey encodes the options forming the cache key into the data slice.
+//
+// Options marked NoCacheKey, such as Size1, are left out. Options are encoded as by EncodeSubset,
+// so that options equal up to order produce the same key.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.6
+func (o Options) CacheKey(data []byte) []byte {
+	return o.EncodeSubset(data, func(def OptionDef) bool {
+		return !def.NoCacheKey()
+	})
+}
+
+// Validate checks every option against the definition of its code in the schema, regardless of the OptionDef
+// the option carries, so that options supplied by users can be rejected before they are sent. Schema defaults
+// to DefaultSchema.
+//
+// Returns an OptionError with the index and code of the option for each violation, wrapping
+// InvalidOptionValueFormat if the value format disagrees with the definition, InvalidOptionValueLength
+// if the value length is out of bounds, OptionNotRepeateable for each repeated occurrence of a non-repeatable
+// option, or UnrecognizedOption for a critical option the schema does not define. Unrecognized elective options
+// are not checked.
+func (o Options) Validate(schema *Schema) []error {
+	if schema == nil {
+		schema = DefaultSchema
+	}
+
+	var errs []error
+	for i, opt := range o {
+		def := schema.Option(opt.Code, MaxOptionLength)
+		if !def.Recognized() {
+			if opt.Critical() {
+				errs = append(errs, OptionError{
+					Index: i,
+					Code:  opt.Code,
+					Cause: UnrecognizedOption{
+						Code: opt.Code,
+					},
+				})
+			}
+
+			continue
+		}
+
+		var causes []error
+		if opt.ValueFormat != def.ValueFormat {
+			causes = append(causes, InvalidOptionValueFormat{
+				OptionDef: def,
+				Requested: opt.ValueFormat,
+			})
+		} else if err := checkOptionLength(def, opt.Length()); err != nil {
+			causes = append(causes, err)
+		}
+
+		repeated := slices.ContainsFunc(o[:i], func(prev Option) bool {
+			return prev.Code == opt.Code
+		})
+		if repeated && !def.Repeatable {
+			causes = append(causes, OptionNotRepeateable{
+				OptionDef: def,
+			})
+		}
+
+		for _, cause := range causes {
+			errs = append(errs, OptionError{
+				Index: i,
+				Code:  opt.Code,
+				Cause: cause,
+			})
+		}
+	}
+
+	return errs
+}
+
+// Normalize returns a copy of the options bound to the definitions of their codes in the schema, so that values
+// decoded under an old schema can be validated under a new one. Values are reinterpreted from their wire form,
+// such as an opaque value under a definition with string format. Options the schema does not define are bound
+// to UnrecognizedOptionDef. Schema defaults to DefaultSchema.
+//
+// Returns OptionError wrapping InvalidOptionValueLength for values not fitting their new definition,
+// otherwise the errors of Validate of the normalized options, joined.
+func (o Options) Normalize(schema *Schema) (Options, error) {
+	if schema == nil {
+		schema = DefaultSchema
+	}
+
+	var errs []error
+	normalized := make(Options, len(o))
+	for i, opt := range o {
+		def := schema.Option(opt.Code, MaxOptionLength)
+		value := opt.appendValue(nil)
+
+		err := checkOptionLength(def, uint16(len(value)))
+		if err != nil {
+			errs = append(errs, OptionError{
+				Index: i,
+				Code:  opt.Code,
+				Cause: err,
+			})
+			continue
+		}
+
+		normalized[i] = Option{
+			OptionDef: def,
+		}
+		normalized[i].decodeValue(value, nil)
+	}
+
+	if len(errs) == 0 {
+		errs = normalized.Validate(schema)
+	}
+
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return normalized, nil
+}
+
+// PartitionForForwarding partitions the options of a request to be forwarded by a proxy according
+// to the definitions of their codes in the schema, defaulting to DefaultSchema.
+//
+// Options recognized by the schema and unrecognized SafeToForward options are forwarded, the latter
+// unchanged, their NoCacheKey property still applying to the cache key. Unrecognized UnsafeElective
+// options are stripped, unrecognized UnsafeCritical options require the request to be rejected with BadOption.
+// Options keep their order within each partition.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.7.1
+func (o Options) PartitionForForwarding(schema *Schema) (forward Options, strippedUnsafe Options, rejectCritical Options) {
+	if schema == nil {
+		schema = DefaultSchema
+	}
+
+	for _, opt := range o {
+		def := schema.Option(opt.Code, MaxOptionLength)
+		switch {
+		case def.Recognized(), def.ForwardingClass() == SafeToForward:
+			forward = append(forward, opt)
+		case def.ForwardingClass() == UnsafeCritical:
+			rejectCritical = append(rejectCritical, opt)
+		default:
+			strippedUnsafe = append(strippedUnsafe, opt)
+		}
+	}
+
+	return forward, strippedUnsafe, rejectCritical
+}
+
+// checkOptionLength returns InvalidOptionValueLength if the length is out of bounds of the definition.
+func checkOptionLength(def OptionDef, length uint16) error {
+	if length < def.MinLen || length > def.MaxLen {
+		return InvalidOptionValueLength{
+			OptionDef: def,
+			Length:    length,
+		}
+	}
+
+	return nil
+}
+
 // Decode decodes options from data using schema.
 //
-// Returns the remaining data after options have been decoded.
+// Returns the remaining data after options have been decoded, on error the data following the bytes consumed
+// before the error.
 //
 // Returns TruncatedError if the data is too short to decode the option.
 //
-// Returns InvalidOptionValueLength if the decoded length does not match the expected length defined in OptionDef.
+// Returns InvalidOptionValueLength if the decoded length does not match the expected length defined in OptionDef,
+// unless LenientFormat is set.
+//
+// Returns OptionNotRepeateable if a non-repeatable critical option occurs more than once.
+//
+// Returns the error of OptionHook with the remaining data starting at the option it was called for.
 //
-// Multiple occurrences of non-repeatable options are treated as unrecognized options.
+// Multiple occurrences of non-repeatable elective options are treated as unrecognized options.
 // Unrecognized options are silently ignored if they are elective.
 func (o *Options) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 	if opts.MaxOptions == 0 {
 		opts.MaxOptions = MaxOptions
 	}
 
+	if opts.Schema == nil {
+		opts.Schema = DefaultSchema
+	}
+
 	prev := uint16(0)
 	options := []Option{}
 	for len(data) > 0 && data[0] != PayloadMarker {
@@ -393,22 +725,44 @@ func (o *Options) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 
 		var err error
 		var option Option
+		start := data
 		data, err = option.Decode(data, prev, opts)
 		if err != nil {
 			return data, err
 		}
 
-		// Each occurence of non-repeatable option has to be treated as unrecognized
+		// option kept by LenientFormat although its value does not match the definition
+		malformed := opts.LenientFormat && !option.Recognized() && opts.Schema.Option(option.Code, 0).Recognized()
+
+		// Each occurence of non-repeatable option has to be treated as unrecognized,
+		// unrecognized critical option has to be rejected
 		// https://datatracker.ietf.org/doc/html/rfc7252#section-5.4.5
-		if !option.Repeatable && option.Code == prev {
+		if !malformed && !option.Repeatable && option.Code == prev {
+			if option.Critical() {
+				return data, OptionNotRepeateable{
+					OptionDef: option.OptionDef,
+				}
+			}
+
 			option.OptionDef = UnrecognizedOptionDef(option.Code, opts.MaxOptionLength)
 		}
 
 		prev = option.Code
 
+		if opts.OptionHook != nil {
+			keep, err := opts.OptionHook(&option, start[:len(start)-len(data)])
+			if err != nil {
+				return start, err
+			}
+
+			if !keep {
+				continue
+			}
+		}
+
 		// Unrecognized elective options MUST be silently ignored
 		// https://datatracker.ietf.org/doc/html/rfc7252#section-5.4.1
-		if !option.Recognized() && !option.Critical() {
+		if !option.Recognized() && !option.Critical() && !malformed {
 			continue
 		}
 
@@ -419,6 +773,31 @@ func (o *Options) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 	return data, nil
 }
 
+// replaceAll validates all options before clearing the definition and appending them.
+func (o *Options) replaceAll(def OptionDef, options iter.Seq[Option]) error {
+	replacement := slices.Collect(options)
+	if len(replacement) > 1 && !def.Repeatable {
+		return OptionNotRepeateable{
+			OptionDef: def,
+		}
+	}
+
+	for _, opt := range replacement {
+		length := opt.Length()
+		if length < def.MinLen || length > def.MaxLen {
+			return InvalidOptionValueLength{
+				OptionDef: def,
+				Length:    length,
+			}
+		}
+	}
+
+	o.Clear(def)
+	*o = append(*o, replacement...)
+
+	return nil
+}
+
 func (o *Options) setAll(def OptionDef, options iter.Seq[Option]) error {
 	if !def.Repeatable {
 		return OptionNotRepeateable{
@@ -2,6 +2,7 @@ package coap
 
 import (
 	"bytes"
+	"errors"
 	"slices"
 	"testing"
 
@@ -254,6 +255,271 @@ func TestOptionsGetSetAll(t *testing.T) {
 	}
 }
 
+func TestOptionsReplaceAll(t *testing.T) {
+	opts := Options{
+		MustOptionValue(URIPath, "old"),
+		MustOptionValue(URIHost, "example.com"),
+		MustOptionValue(URIPath, "path"),
+	}
+
+	err := opts.ReplaceAllString(URIPath, slices.Values([]string{"a", "b", "a"}))
+	if err != nil {
+		t.Fatal("replace all:", err)
+	}
+
+	path := slices.Collect(MustValue(opts.GetAllString(URIPath)))
+	diff := cmp.Diff([]string{"a", "b", "a"}, path)
+	if diff != "" {
+		t.Errorf("path mismatch (-want +got):\n%s", diff)
+	}
+
+	if host := MustValue(opts.GetString(URIHost)); host != "example.com" {
+		t.Errorf("host = %q, want example.com", host)
+	}
+
+	err = opts.ReplaceAllString(URIPath, slices.Values([]string{"c", string(make([]byte, 300))}))
+	expectErr(t, err, InvalidOptionValueLength{
+		OptionDef: URIPath,
+		Length:    300,
+	})
+
+	err = opts.ReplaceAllUint(URIPort, slices.Values([]uint32{1, 2}))
+	expectErr(t, err, OptionNotRepeateable{
+		OptionDef: URIPort,
+	})
+
+	err = opts.ReplaceAllOpaque(URIPath, slices.Values([][]byte{bytes4}))
+	expectErr(t, err, InvalidOptionValueFormat{
+		OptionDef: URIPath,
+		Requested: ValueFormatOpaque,
+	})
+
+	path = slices.Collect(MustValue(opts.GetAllString(URIPath)))
+	diff = cmp.Diff([]string{"a", "b", "a"}, path)
+	if diff != "" {
+		t.Errorf("expected options unchanged on error (-want +got):\n%s", diff)
+	}
+
+	err = opts.ReplaceAllOpaque(ETag, slices.Values([][]byte{bytes4, bytes8}))
+	if err != nil {
+		t.Fatal("replace all etag:", err)
+	}
+
+	err = opts.ReplaceAllUint(URIPort, slices.Values([]uint32{5683}))
+	if err != nil {
+		t.Fatal("replace all port:", err)
+	}
+
+	if n := len(opts); n != 7 {
+		t.Errorf("len = %d, want 7", n)
+	}
+}
+
+func TestOptionsGroup(t *testing.T) {
+	opts := Options{
+		MustOptionValue(URIQuery, "a=1"),
+		MustOptionValue(URIPath, "a"),
+		MustOptionValue(URIHost, "example.com"),
+		MustOptionValue(URIPath, "b"),
+		MustOptionValue(URIQuery, "b=2"),
+	}
+
+	got := map[string][]string{}
+	codes := []uint16{}
+	for def, group := range opts.Group() {
+		codes = append(codes, def.Code)
+		for _, opt := range group {
+			got[def.Name] = append(got[def.Name], opt.String())
+		}
+	}
+
+	want := map[string][]string{
+		"URIHost":  {MustOptionValue(URIHost, "example.com").String()},
+		"URIPath":  {MustOptionValue(URIPath, "a").String(), MustOptionValue(URIPath, "b").String()},
+		"URIQuery": {MustOptionValue(URIQuery, "a=1").String(), MustOptionValue(URIQuery, "b=2").String()},
+	}
+
+	diff := cmp.Diff(want, got)
+	if diff != "" {
+		t.Errorf("groups mismatch (-want +got):\n%s", diff)
+	}
+
+	diff = cmp.Diff([]uint16{URIHost.Code, URIPath.Code, URIQuery.Code}, codes)
+	if diff != "" {
+		t.Errorf("order mismatch (-want +got):\n%s", diff)
+	}
+
+	for range Options(nil).Group() {
+		t.Error("expected no groups")
+	}
+}
+
+func TestOptionsDecodeHook(t *testing.T) {
+	legacy := OptionDef{Code: 2048, Name: "Legacy", ValueFormat: ValueFormatOpaque, MaxLen: 8}
+	errAbort := errors.New("abort")
+
+	msg := Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+		},
+		Options: Options{
+			MustOptionValue(URIHost, "h"),
+			MustOptionValue(URIPath, "a"),
+			MustOptionValue(legacy, []byte("q")),
+		},
+	}
+	data := MustValue(msg.MarshalBinary())
+
+	tests := []struct {
+		name    string
+		hook    func(opt *Option, raw []byte) (bool, error)
+		options Options
+		err     error
+	}{
+		{
+			name: "veto",
+			hook: func(opt *Option, _ []byte) (bool, error) {
+				return opt.Code != URIPath.Code, nil
+			},
+			options: Options{
+				MustOptionValue(URIHost, "h"),
+			},
+		},
+		{
+			name: "rewrite",
+			hook: func(opt *Option, raw []byte) (bool, error) {
+				if opt.Code == legacy.Code {
+					*opt = MustOptionValue(URIQuery, string(raw[len(raw)-1:]))
+				}
+
+				return true, nil
+			},
+			options: Options{
+				MustOptionValue(URIHost, "h"),
+				MustOptionValue(URIPath, "a"),
+				MustOptionValue(URIQuery, "q"),
+			},
+		},
+		{
+			name: "abort",
+			hook: func(opt *Option, _ []byte) (bool, error) {
+				if opt.Code == URIPath.Code {
+					return false, errAbort
+				}
+
+				return true, nil
+			},
+			err: UnmarshalError{
+				Offset: 6,
+				Cause:  errAbort,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codes := []uint16{}
+			hook := func(opt *Option, raw []byte) (bool, error) {
+				codes = append(codes, opt.Code)
+				return test.hook(opt, raw)
+			}
+
+			decoded := Message{}
+			_, err := decoded.Decode(data, MarshalOptions{OptionHook: hook})
+			expectErr(t, err, test.err)
+			if err != nil {
+				return
+			}
+
+			diff := cmp.Diff(test.options, decoded.Options, EquateOptions())
+			if diff != "" {
+				t.Errorf("options mismatch (-want +got):\n%s", diff)
+			}
+
+			diff = cmp.Diff([]uint16{URIHost.Code, URIPath.Code, legacy.Code}, codes)
+			if diff != "" {
+				t.Errorf("hook order mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestOptionsDecodeLenient(t *testing.T) {
+	data := []byte{
+		0x51, 0xAA, // IfNoneMatch with value
+		0x23, 0x01, 0x02, 0x03, // URIPort too long
+		0x03, 0x04, 0x05, 0x06, // URIPort too long, repeated
+		0x75, 0x01, 0x02, 0x03, 0x04, 0x05, // MaxAge too long
+		0x31, 0x42, // Accept
+	}
+
+	unrecognized := func(code uint16, value []byte) Option {
+		return MustOptionValue(UnrecognizedOptionDef(code, MaxOptionLength), value)
+	}
+
+	tests := []struct {
+		name    string
+		opts    MarshalOptions
+		options Options
+		err     error
+	}{
+		{
+			name: "strict",
+			err: InvalidOptionValueLength{
+				OptionDef: IfNoneMatch,
+				Length:    1,
+			},
+		},
+		{
+			name: "lenient",
+			opts: MarshalOptions{
+				LenientFormat: true,
+			},
+			options: Options{
+				unrecognized(IfNoneMatch.Code, []byte{0xAA}),
+				unrecognized(URIPort.Code, []byte{0x01, 0x02, 0x03}),
+				unrecognized(URIPort.Code, []byte{0x04, 0x05, 0x06}),
+				unrecognized(MaxAge.Code, []byte{0x01, 0x02, 0x03, 0x04, 0x05}),
+				MustOptionValue(Accept, uint32(0x42)),
+			},
+		},
+		{
+			name: "lenient over max option length",
+			opts: MarshalOptions{
+				LenientFormat:   true,
+				MaxOptionLength: 4,
+			},
+			err: InvalidOptionValueLength{
+				OptionDef: OptionDef{
+					Code:        MaxAge.Code,
+					Name:        MaxAge.Name,
+					ValueFormat: ValueFormatUint,
+					MaxLen:      4,
+				},
+				Length: 5,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := Options{}
+			_, err := options.Decode(data, test.opts)
+			expectErr(t, err, test.err)
+			if err != nil {
+				return
+			}
+
+			diff := cmp.Diff(test.options, options, EquateOptions())
+			if diff != "" {
+				t.Errorf("options mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func EquateOptions() cmp.Option {
 	return cmp.Options{
 		cmp.Transformer("Options", func(o Options) []string {
@@ -268,3 +534,288 @@ func EquateOptions() cmp.Option {
 		cmpopts.IgnoreUnexported(Option{}),
 	}
 }
+
+// TestOptionsEncodeSubset pins canonical subset encoding, changes break deployed signatures.
+func TestOptionsEncodeSubset(t *testing.T) {
+	options := Options{
+		MustOptionValue(URIQuery, "q"),
+		MustOptionValue(URIPath, "a"),
+		MustOptionValue(URIHost, "h"),
+		MustOptionValue(URIPath, "b"),
+		MustOptionValue(ContentFormat, uint32(0)),
+	}
+
+	tests := []struct {
+		name    string
+		include func(def OptionDef) bool
+		data    []byte
+	}{
+		{
+			name: "path and query",
+			include: func(def OptionDef) bool {
+				return def.Code == URIPath.Code || def.Code == URIQuery.Code
+			},
+			data: []byte{
+				0xB1, 0x61, // URIPath "a"
+				0x01, 0x62, // URIPath "b"
+				0x41, 0x71, // URIQuery "q"
+			},
+		},
+		{
+			name: "none",
+			include: func(_ OptionDef) bool {
+				return false
+			},
+			data: []byte{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := options.EncodeSubset([]byte{}, test.include)
+			diff := cmp.Diff(test.data, data)
+			if diff != "" {
+				t.Error("encoded data mismatch (-want +got):\n", diff)
+			}
+		})
+	}
+}
+
+func TestOptionsCacheKey(t *testing.T) {
+	options := Options{
+		MustOptionValue(Size1, uint32(1024)),
+		MustOptionValue(URIPath, "a"),
+		MustOptionValue(URIQuery, "q"),
+	}
+
+	expect := []byte{
+		0xB1, 0x61, // URIPath "a"
+		0x41, 0x71, // URIQuery "q"
+	}
+
+	data := options.CacheKey([]byte{})
+	diff := cmp.Diff(expect, data)
+	if diff != "" {
+		t.Error("cache key mismatch (-want +got):\n", diff)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	vendor := StringOption(65000, "Vendor", 1, 8)
+	schema := DefaultSchema.WithOverlay().AddOptions(vendor)
+
+	// option constructed under an older definition of the vendor option
+	stale := MustOptionValue(OpaqueOption(vendor.Code, "Vendor", 0, 8), []byte("abc"))
+	widePort := MustOptionValue(UintOption(URIPort.Code, "URIPort", 4), uint32(0x10000))
+	critical := MustOptionValue(UnrecognizedOptionDef(65001, 8), []byte{0x01})
+	elective := MustOptionValue(UnrecognizedOptionDef(65002, 8), []byte{0x01})
+
+	tests := []struct {
+		name    string
+		options Options
+		errs    []error
+	}{
+		{
+			name: "valid",
+			options: Options{
+				MustOptionValue(URIPath, "a"),
+				MustOptionValue(URIPath, "b"),
+				MustOptionValue(vendor, "abc"),
+				elective,
+			},
+		},
+		{
+			name:    "format disagrees with schema",
+			options: Options{MustOptionValue(URIPath, "a"), stale},
+			errs: []error{
+				OptionError{
+					Index: 1,
+					Code:  vendor.Code,
+					Cause: InvalidOptionValueFormat{
+						OptionDef: vendor,
+						Requested: ValueFormatOpaque,
+					},
+				},
+			},
+		},
+		{
+			name:    "length out of bounds",
+			options: Options{widePort},
+			errs: []error{
+				OptionError{
+					Index: 0,
+					Code:  URIPort.Code,
+					Cause: InvalidOptionValueLength{
+						OptionDef: URIPort,
+						Length:    3,
+					},
+				},
+			},
+		},
+		{
+			name:    "repeated",
+			options: Options{MustOptionValue(URIHost, "a"), MustOptionValue(URIHost, "b"), MustOptionValue(URIHost, "c")},
+			errs: []error{
+				OptionError{Index: 1, Code: URIHost.Code, Cause: OptionNotRepeateable{OptionDef: URIHost}},
+				OptionError{Index: 2, Code: URIHost.Code, Cause: OptionNotRepeateable{OptionDef: URIHost}},
+			},
+		},
+		{
+			name:    "unrecognized critical",
+			options: Options{critical},
+			errs: []error{
+				OptionError{Index: 0, Code: 65001, Cause: UnrecognizedOption{Code: 65001}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := test.options.Validate(schema)
+			diff := cmp.Diff(test.errs, errs, cmpopts.EquateErrors())
+			if diff != "" {
+				t.Errorf("errors mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestOptionsNormalize(t *testing.T) {
+	vendor := StringOption(65000, "Vendor", 1, 8)
+	schema := DefaultSchema.WithOverlay().AddOptions(vendor)
+	stale := MustOptionValue(OpaqueOption(vendor.Code, "Vendor", 0, 16), []byte("abc"))
+
+	normalized, err := Options{MustOptionValue(URIPath, "a"), stale}.Normalize(schema)
+	if err != nil {
+		t.Fatal("normalize:", err)
+	}
+
+	expect := Options{MustOptionValue(URIPath, "a"), MustOptionValue(vendor, "abc")}
+	diff := cmp.Diff(expect, normalized, EquateOptions())
+	if diff != "" {
+		t.Errorf("options mismatch (-want +got):\n%s", diff)
+	}
+
+	tooLong := MustOptionValue(OpaqueOption(vendor.Code, "Vendor", 0, 16), []byte("0123456789"))
+	_, err = Options{tooLong}.Normalize(schema)
+	expectErr(t, err, OptionError{
+		Index: 0,
+		Code:  vendor.Code,
+		Cause: InvalidOptionValueLength{
+			OptionDef: vendor,
+			Length:    10,
+		},
+	})
+
+	_, err = Options{MustOptionValue(URIHost, "a"), MustOptionValue(URIHost, "b")}.Normalize(schema)
+	expectErr(t, err, OptionNotRepeateable{
+		OptionDef: URIHost,
+	})
+}
+
+func TestOptionsPartitionForForwarding(t *testing.T) {
+	vendor := OpaqueOption(65003, "Vendor", 0, 8)
+	schema := DefaultSchema.WithOverlay().AddOptions(vendor)
+
+	safe := MustOptionValue(UnrecognizedOptionDef(65001, 8), []byte{0x01})
+	elective := MustOptionValue(UnrecognizedOptionDef(65002, 8), []byte{0x02})
+	critical := MustOptionValue(UnrecognizedOptionDef(65007, 8), []byte{0x03})
+	registered := MustOptionValue(UnrecognizedOptionDef(vendor.Code, 8), []byte{0x04})
+
+	tests := []struct {
+		name     string
+		schema   *Schema
+		options  Options
+		forward  Options
+		stripped Options
+		reject   Options
+	}{
+		{
+			name: "recognized",
+			options: Options{
+				MustOptionValue(URIHost, "example.com"),
+				MustOptionValue(ETag, []byte{0x01}),
+				MustOptionValue(URIPath, "a"),
+				MustOptionValue(MaxAge, uint32(60)),
+				MustOptionValue(Block2, uint32(0x02)),
+			},
+			forward: Options{
+				MustOptionValue(URIHost, "example.com"),
+				MustOptionValue(ETag, []byte{0x01}),
+				MustOptionValue(URIPath, "a"),
+				MustOptionValue(MaxAge, uint32(60)),
+				MustOptionValue(Block2, uint32(0x02)),
+			},
+		},
+		{
+			name:     "unrecognized",
+			options:  Options{MustOptionValue(URIPath, "a"), safe, elective, registered, critical},
+			forward:  Options{MustOptionValue(URIPath, "a"), safe},
+			stripped: Options{elective},
+			reject:   Options{registered, critical},
+		},
+		{
+			name:     "recognized by schema",
+			schema:   schema,
+			options:  Options{MustOptionValue(URIPath, "a"), safe, elective, registered, critical},
+			forward:  Options{MustOptionValue(URIPath, "a"), safe, registered},
+			stripped: Options{elective},
+			reject:   Options{critical},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forward, stripped, reject := test.options.PartitionForForwarding(test.schema)
+
+			diff := cmp.Diff(test.forward, forward, EquateOptions())
+			if diff != "" {
+				t.Errorf("forward mismatch (-want +got):\n%s", diff)
+			}
+
+			diff = cmp.Diff(test.stripped, stripped, EquateOptions())
+			if diff != "" {
+				t.Errorf("stripped mismatch (-want +got):\n%s", diff)
+			}
+
+			diff = cmp.Diff(test.reject, reject, EquateOptions())
+			if diff != "" {
+				t.Errorf("reject mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetAs(t *testing.T) {
+	options := Options{
+		MustOptionValue(URIHost, "example.com"),
+		MustOptionValue(URIPort, uint32(5683)),
+		MustOptionValue(ETag, []byte{0x01, 0x02}),
+	}
+
+	host, err := GetAs[string](options, URIHost)
+	if err != nil || host != "example.com" {
+		t.Errorf("GetAs[string] = %q, %v", host, err)
+	}
+
+	port, err := GetAs[uint32](options, URIPort)
+	if err != nil || port != 5683 {
+		t.Errorf("GetAs[uint32] = %d, %v", port, err)
+	}
+
+	etag, err := GetAs[[]byte](options, ETag)
+	if err != nil || !bytes.Equal(etag, []byte{0x01, 0x02}) {
+		t.Errorf("GetAs[[]byte] = %x, %v", etag, err)
+	}
+
+	_, err = GetAs[string](options, URIPort)
+	expectErr(t, err, InvalidOptionValueFormat{
+		OptionDef: URIPort,
+		Requested: ValueFormatString,
+	})
+
+	_, err = GetAs[uint32](options, MaxAge)
+	expectErr(t, err, OptionNotFound{
+		OptionDef: MaxAge,
+	})
+}
@@ -0,0 +1,234 @@
+package coap
+
+import (
+	"bytes"
+	"math"
+	"slices"
+)
+
+// Keys of standard problem detail entries.
+//
+// https://datatracker.ietf.org/doc/html/rfc9290#section-3.1
+const (
+	problemTitle        = -1
+	problemDetail       = -2
+	problemInstance     = -3
+	problemResponseCode = -4
+	problemBaseURI      = -5
+)
+
+// ProblemDetails holds Concise Problem Details carried by error responses with ContentFormat
+// MediaTypeApplicationConciseProblemDetails.
+//
+// Details are encoded as a CBOR map with deterministic encoding, using the subset of CBOR needed for
+// the standard entries and Extensions. Entries with empty values are omitted.
+//
+// https://datatracker.ietf.org/doc/html/rfc9290
+type ProblemDetails struct {
+	// Title is a short, human-readable summary of the problem shape.
+	Title string
+
+	// Detail is a human-readable explanation of this occurrence of the problem.
+	Detail string
+
+	// Instance is a URI reference identifying this occurrence of the problem.
+	Instance string
+
+	// ResponseCode is the response code the problem was generated with, intended for when the response
+	// is relayed with another code.
+	ResponseCode ResponseCode
+
+	// BaseURI is the base URI to resolve relative URI references in the details against.
+	BaseURI string
+
+	// Extensions holds custom problem detail entries keyed by their registered unsigned integer key.
+	// Values are unsigned or signed integers, string, []byte or bool, decoded as uint64, int64, string,
+	// []byte or bool. Entries keyed by URI are skipped when decoding.
+	Extensions map[uint64]any
+}
+
+// problemEntry is a key-value pair of the problem details map, encoded.
+type problemEntry struct {
+	key   []byte
+	value []byte
+}
+
+// ProblemResponse returns a Response with the code carrying the problem details.
+//
+// Panics if Extensions hold values of unsupported types.
+func ProblemResponse(code ResponseCode, pd ProblemDetails) *Response {
+	payload := MustValue(pd.AppendBinary(nil))
+	mediaType := MediaTypeApplicationConciseProblemDetails
+
+	return &Response{
+		Code:          code,
+		ContentFormat: &mediaType,
+		Payload:       payload,
+	}
+}
+
+// Problem returns problem details carried by the response.
+//
+// Reports false if the response ContentFormat is not MediaTypeApplicationConciseProblemDetails.
+//
+// Returns MalformedCBOR if the payload does not decode.
+func (r *Response) Problem() (ProblemDetails, bool, error) {
+	if r.ContentFormat == nil || r.ContentFormat.Code != MediaTypeApplicationConciseProblemDetails.Code {
+		return ProblemDetails{}, false, nil
+	}
+
+	pd := ProblemDetails{}
+	err := pd.UnmarshalBinary(r.Payload)
+
+	return pd, true, err
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (p ProblemDetails) MarshalBinary() ([]byte, error) {
+	return p.AppendBinary(nil)
+}
+
+// AppendBinary implements encoding.BinaryAppender.
+//
+// Returns UnsupportedCBORType if Extensions hold values of unsupported types.
+func (p ProblemDetails) AppendBinary(data []byte) ([]byte, error) {
+	entries := make([]problemEntry, 0, 5+len(p.Extensions))
+	appendText := func(key int64, value string) {
+		if value == "" {
+			return
+		}
+
+		entries = append(entries, problemEntry{
+			key:   appendCBORInt(nil, key),
+			value: append(appendCBORHead(nil, cborText, uint64(len(value))), value...),
+		})
+	}
+
+	appendText(problemTitle, p.Title)
+	appendText(problemDetail, p.Detail)
+	appendText(problemInstance, p.Instance)
+	appendText(problemBaseURI, p.BaseURI)
+
+	if p.ResponseCode != 0 {
+		entries = append(entries, problemEntry{
+			key:   appendCBORInt(nil, problemResponseCode),
+			value: appendCBORHead(nil, cborUint, uint64(p.ResponseCode)),
+		})
+	}
+
+	for key, value := range p.Extensions {
+		encoded, err := appendCBORValue(nil, value)
+		if err != nil {
+			return data, err
+		}
+
+		entries = append(entries, problemEntry{
+			key:   appendCBORHead(nil, cborUint, key),
+			value: encoded,
+		})
+	}
+
+	// deterministic encoding sorts keys by their encoding
+	// https://datatracker.ietf.org/doc/html/rfc8949#section-4.2.1
+	slices.SortFunc(entries, func(a, b problemEntry) int {
+		return bytes.Compare(a.key, b.key)
+	})
+
+	data = appendCBORHead(data, cborMap, uint64(len(entries)))
+	for _, entry := range entries {
+		data = append(data, entry.key...)
+		data = append(data, entry.value...)
+	}
+
+	return data, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+//
+// Unknown standard entries and entries keyed by URI are skipped.
+//
+// Returns MalformedCBOR if the data is not a single map of the supported subset, or a standard entry
+// has a value of the wrong type.
+func (p *ProblemDetails) UnmarshalBinary(data []byte) error {
+	d := &cborDecoder{
+		data: data,
+	}
+
+	major, n, err := d.head()
+	if err != nil {
+		return err
+	}
+
+	if major != cborMap {
+		return MalformedCBOR{
+			Reason: "problem details not a map",
+		}
+	}
+
+	pd := ProblemDetails{}
+	seen := map[any]struct{}{}
+	for range n {
+		start := d.offset
+		key, err := d.value()
+		if err != nil {
+			return err
+		}
+
+		switch key.(type) {
+		case uint64, int64, string:
+		default:
+			d.offset = start
+			return d.malformed("unsupported key")
+		}
+
+		if _, ok := seen[key]; ok {
+			d.offset = start
+			return d.malformed("duplicate key")
+		}
+		seen[key] = struct{}{}
+
+		valueStart := d.offset
+		value, err := d.value()
+		if err != nil {
+			return err
+		}
+
+		ok := true
+		switch key := key.(type) {
+		case uint64:
+			if pd.Extensions == nil {
+				pd.Extensions = map[uint64]any{}
+			}
+			pd.Extensions[key] = value
+		case int64:
+			switch key {
+			case problemTitle:
+				pd.Title, ok = value.(string)
+			case problemDetail:
+				pd.Detail, ok = value.(string)
+			case problemInstance:
+				pd.Instance, ok = value.(string)
+			case problemBaseURI:
+				pd.BaseURI, ok = value.(string)
+			case problemResponseCode:
+				var code uint64
+				code, ok = value.(uint64)
+				ok = ok && code <= math.MaxUint8
+				pd.ResponseCode = ResponseCode(code)
+			}
+		}
+
+		if !ok {
+			d.offset = valueStart
+			return d.malformed("invalid standard entry value")
+		}
+	}
+
+	if d.offset != len(data) {
+		return d.malformed("trailing data")
+	}
+
+	*p = pd
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package coap
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestProblemDetailsWire pins the encoding, changes break interoperability with other implementations.
+func TestProblemDetailsWire(t *testing.T) {
+	tests := []struct {
+		name string
+		pd   ProblemDetails
+		data []byte
+	}{
+		{
+			name: "empty",
+			data: []byte{0xa0},
+		},
+		{
+			name: "standard entries",
+			pd: ProblemDetails{
+				Title:        "Not Found",
+				Detail:       "no such sensor",
+				ResponseCode: NotFound,
+				Extensions: map[uint64]any{
+					0: uint64(7),
+				},
+			},
+			data: []byte{
+				0xa4,
+				0x00, 0x07, // 0: 7
+				0x20, 0x69, 'N', 'o', 't', ' ', 'F', 'o', 'u', 'n', 'd', // title
+				0x21, 0x6e, 'n', 'o', ' ', 's', 'u', 'c', 'h', ' ', 's', 'e', 'n', 's', 'o', 'r', // detail
+				0x23, 0x18, 0x84, // response-code 4.04
+			},
+		},
+		{
+			name: "extensions",
+			pd: ProblemDetails{
+				Instance: "/a",
+				BaseURI:  "coap://x",
+				Extensions: map[uint64]any{
+					1:  int64(-5),
+					2:  true,
+					24: []byte{0xde, 0xad},
+				},
+			},
+			data: []byte{
+				0xa5,
+				0x01, 0x24, // 1: -5
+				0x02, 0xf5, // 2: true
+				0x18, 0x18, 0x42, 0xde, 0xad, // 24: h'dead'
+				0x22, 0x62, '/', 'a', // instance
+				0x24, 0x68, 'c', 'o', 'a', 'p', ':', '/', '/', 'x', // base-uri
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := test.pd.MarshalBinary()
+			if err != nil {
+				t.Fatal("marshal:", err)
+			}
+
+			diff := cmp.Diff(test.data, data)
+			if diff != "" {
+				t.Errorf("data mismatch (-want +got):\n%s", diff)
+			}
+
+			pd := ProblemDetails{}
+			err = pd.UnmarshalBinary(test.data)
+			if err != nil {
+				t.Fatal("unmarshal:", err)
+			}
+
+			diff = cmp.Diff(test.pd, pd)
+			if diff != "" {
+				t.Errorf("problem details mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProblemDetailsUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		pd   ProblemDetails
+		err  error
+	}{
+		{
+			name: "tagged instance",
+			data: []byte{0xa1, 0x22, 0xd8, 0x20, 0x62, '/', 'a'},
+			pd:   ProblemDetails{Instance: "/a"},
+		},
+		{
+			name: "unknown entries skipped",
+			data: []byte{
+				0xa3,
+				0x20, 0x61, 't', // title
+				0x26, 0xf4, // base-rtl
+				0x6f, 'h', 't', 't', 'p', 's', ':', '/', '/', 'e', 'x', '.', 'o', 'r', 'g', '/', 0x01,
+			},
+			pd: ProblemDetails{Title: "t"},
+		},
+		{
+			name: "not a map",
+			data: []byte{0x80},
+			err:  MalformedCBOR{Offset: 0, Reason: "problem details not a map"},
+		},
+		{
+			name: "indefinite map",
+			data: []byte{0xbf, 0xff},
+			err:  MalformedCBOR{Offset: 0, Reason: "indefinite length not supported"},
+		},
+		{
+			name: "truncated",
+			data: []byte{0xa1, 0x20},
+			err:  MalformedCBOR{Offset: 2, Reason: "truncated data item"},
+		},
+		{
+			name: "title not text",
+			data: []byte{0xa1, 0x20, 0x01},
+			err:  MalformedCBOR{Offset: 2, Reason: "invalid standard entry value"},
+		},
+		{
+			name: "response code out of range",
+			data: []byte{0xa1, 0x23, 0x19, 0x01, 0x00},
+			err:  MalformedCBOR{Offset: 2, Reason: "invalid standard entry value"},
+		},
+		{
+			name: "duplicate key",
+			data: []byte{0xa2, 0x20, 0x61, 'a', 0x20, 0x61, 'b'},
+			err:  MalformedCBOR{Offset: 4, Reason: "duplicate key"},
+		},
+		{
+			name: "unsupported key",
+			data: []byte{0xa1, 0xf5, 0x00},
+			err:  MalformedCBOR{Offset: 1, Reason: "unsupported key"},
+		},
+		{
+			name: "nested array",
+			data: []byte{0xa1, 0x00, 0x80},
+			err:  MalformedCBOR{Offset: 2, Reason: "unsupported data item"},
+		},
+		{
+			name: "trailing data",
+			data: []byte{0xa0, 0x00},
+			err:  MalformedCBOR{Offset: 1, Reason: "trailing data"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pd := ProblemDetails{}
+			err := pd.UnmarshalBinary(test.data)
+			expectErr(t, err, test.err)
+
+			diff := cmp.Diff(test.pd, pd)
+			if diff != "" {
+				t.Errorf("problem details mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProblemResponse(t *testing.T) {
+	expect := ProblemDetails{
+		Title:  "Bad Request",
+		Detail: "missing query",
+	}
+
+	resp := ProblemResponse(BadRequest, expect)
+	if resp.Code != BadRequest {
+		t.Errorf("code = %s, want %s", resp.Code, BadRequest)
+	}
+
+	data, err := resp.AppendBinary(nil)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	decoded := &Response{}
+	_, err = decoded.Decode(data, MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	pd, ok, err := decoded.Problem()
+	if err != nil || !ok {
+		t.Fatalf("Problem() = %v, %v", ok, err)
+	}
+
+	diff := cmp.Diff(expect, pd)
+	if diff != "" {
+		t.Errorf("problem details mismatch (-want +got):\n%s", diff)
+	}
+
+	plain := &Response{
+		Code:          BadRequest,
+		ContentFormat: &MediaTypeTextPlain,
+		Payload:       []byte("missing query"),
+	}
+
+	_, ok, err = plain.Problem()
+	if ok || err != nil {
+		t.Errorf("Problem() = %v, %v, want false, nil", ok, err)
+	}
+
+	malformed := &Response{
+		Code:          BadRequest,
+		ContentFormat: &MediaTypeApplicationConciseProblemDetails,
+		Payload:       []byte{0x80},
+	}
+
+	_, ok, err = malformed.Problem()
+	if !ok {
+		t.Error("Problem() not ok")
+	}
+
+	expectErr(t, err, MalformedCBOR{Reason: "problem details not a map"})
+}
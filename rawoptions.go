@@ -0,0 +1,178 @@
+package coap
+
+import (
+	"iter"
+	"slices"
+)
+
+// RawOptions holds encoded options which are decoded on demand.
+//
+// Useful for proxies inspecting only a few options and forwarding the rest untouched.
+type RawOptions []byte
+
+// Decode validates framing of options in data and stores them without decoding values.
+//
+// Returns the remaining data after options.
+//
+// Returns TooManyOptions if the number of options exceeds the maximum.
+//
+// Returns TruncatedError if the data is too short to decode the option.
+//
+// Returns InvalidOptionValueLength if the value length exceeds MaxOptionLength.
+func (r *RawOptions) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
+	rest, err := checkRawOptions(data, opts)
+	if err != nil {
+		return rest, err
+	}
+
+	*r = slices.Clone(data[:len(data)-len(rest)])
+	return rest, nil
+}
+
+// checkRawOptions validates framing of options in data against the limits in opts.
+//
+// Returns the remaining data after options.
+func checkRawOptions(data []byte, opts MarshalOptions) ([]byte, error) {
+	if opts.MaxOptions == 0 {
+		opts.MaxOptions = MaxOptions
+	}
+
+	if opts.MaxOptionLength == 0 {
+		opts.MaxOptionLength = MaxOptionLength
+	}
+
+	count := uint(0)
+	prev := uint16(0)
+	for len(data) > 0 && data[0] != PayloadMarker {
+		if count >= opts.MaxOptions {
+			return data, TooManyOptions{
+				Limit: opts.MaxOptions,
+			}
+		}
+
+		delta, length, rest, err := decodeOptionHeader(data)
+		if err != nil {
+			return rest, err
+		}
+
+		prev += delta
+		switch {
+		case len(rest) < int(length):
+			return rest, TruncatedError{
+				Expected: uint(length),
+			}
+		case length > opts.MaxOptionLength:
+			return rest, InvalidOptionValueLength{
+				OptionDef: UnrecognizedOptionDef(prev, opts.MaxOptionLength),
+				Length:    length,
+			}
+		}
+
+		data = rest[length:]
+		count++
+	}
+
+	return data, nil
+}
+
+// Contains checks if option matching the definition is present.
+func (r RawOptions) Contains(def OptionDef) bool {
+	for code := range r.all() {
+		if code == def.Code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get decodes the first option matching the definition.
+//
+// Returns OptionNotFound if the option is not present.
+//
+// Returns InvalidOptionValueLength if the value length does not match the definition.
+func (r RawOptions) Get(def OptionDef) (Option, error) {
+	for opt, err := range r.GetAll(def) {
+		return opt, err
+	}
+
+	return Option{}, OptionNotFound{
+		OptionDef: def,
+	}
+}
+
+// GetAll decodes all options matching the definition.
+//
+// Iteration yields InvalidOptionValueLength for values not matching the definition.
+func (r RawOptions) GetAll(def OptionDef) iter.Seq2[Option, error] {
+	return func(yield func(Option, error) bool) {
+		for code, value := range r.all() {
+			if code != def.Code {
+				continue
+			}
+
+			opt := Option{
+				OptionDef: def,
+			}
+
+			length := uint16(len(value))
+			if length < def.MinLen || length > def.MaxLen {
+				yield(opt, InvalidOptionValueLength{
+					OptionDef: def,
+					Length:    length,
+				})
+				return
+			}
+
+			opt.decodeValue(value, nil)
+			if !yield(opt, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Options decodes all options as Options.Decode does.
+func (r RawOptions) Options(opts MarshalOptions) (Options, error) {
+	options := Options{}
+	_, err := options.Decode(r, opts)
+
+	return options, err
+}
+
+// uriOptions decodes the URI options, so that lazily decoded requests can be routed.
+func (r RawOptions) uriOptions() (Options, error) {
+	options := Options{}
+	for _, def := range []OptionDef{URIHost, URIPort, URIPath, URIQuery} {
+		for opt, err := range r.GetAll(def) {
+			if err != nil {
+				return nil, err
+			}
+
+			options = append(options, opt)
+		}
+	}
+
+	return options, nil
+}
+
+// all iterates over option codes and values, stopping at malformed option.
+func (r RawOptions) all() iter.Seq2[uint16, []byte] {
+	return func(yield func(uint16, []byte) bool) {
+		data := []byte(r)
+		prev := uint16(0)
+		for len(data) > 0 && data[0] != PayloadMarker {
+			delta, length, rest, err := decodeOptionHeader(data)
+			if err != nil || len(rest) < int(length) {
+				return
+			}
+
+			prev += delta
+			if !yield(prev, rest[:length]) {
+				return
+			}
+
+			data = rest[length:]
+		}
+	}
+}
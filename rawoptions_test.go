@@ -0,0 +1,195 @@
+package coap
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRawOptions(t *testing.T) {
+	data := []byte{
+		0x44, 0x01, 0x84, 0x9e, 0x51, 0x55, 0x77, 0xe8, // Header
+		0x72, 0x16, 0x33, // URIPort 5683
+		0x42, 0x66, 0x77, // URIPath "fw"
+		0x03, 0x31, 0x2e, 0x30, // URIPath "1.0"
+		0x43, 0x61, 0x3d, 0x31, // URIQuery "a=1"
+		0xFF, 0x48, 0x69, // Payload "Hi"
+	}
+
+	msg := &Message{}
+	_, err := msg.Decode(data, MarshalOptions{Lazy: true})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	if len(msg.Options) != 0 {
+		t.Errorf("expected options not to be decoded, got %v", msg.Options)
+	}
+
+	if !msg.RawOptions.Contains(URIQuery) {
+		t.Error("expected URIQuery to be present")
+	}
+
+	port, err := msg.RawOptions.Get(URIPort)
+	if err != nil {
+		t.Fatal("get port:", err)
+	}
+
+	if v := MustValue(port.GetUint()); v != 5683 {
+		t.Errorf("port = %d, want 5683", v)
+	}
+
+	path := []string{}
+	for opt, err := range msg.RawOptions.GetAll(URIPath) {
+		if err != nil {
+			t.Fatal("get path:", err)
+		}
+
+		path = append(path, MustValue(opt.GetString()))
+	}
+
+	diff := cmp.Diff([]string{"fw", "1.0"}, path)
+	if diff != "" {
+		t.Errorf("path mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = msg.RawOptions.Get(URIHost)
+	expectErr(t, err, OptionNotFound{OptionDef: URIHost})
+
+	_, err = msg.RawOptions.Get(OptionDef{Code: URIPort.Code, ValueFormat: ValueFormatUint, MaxLen: 1})
+	expectErr(t, err, InvalidOptionValueLength{
+		OptionDef: OptionDef{Code: URIPort.Code, ValueFormat: ValueFormatUint, MaxLen: 1},
+		Length:    2,
+	})
+
+	options, err := msg.RawOptions.Options(MarshalOptions{})
+	if err != nil {
+		t.Fatal("options:", err)
+	}
+
+	full := &Message{}
+	_, err = full.Decode(data, MarshalOptions{})
+	if err != nil {
+		t.Fatal("full decode:", err)
+	}
+
+	diff = cmp.Diff(full.Options, options, EquateOptions())
+	if diff != "" {
+		t.Errorf("options mismatch (-want +got):\n%s", diff)
+	}
+
+	encoded, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	diff = cmp.Diff(data, encoded)
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRawOptionsEncodeError(t *testing.T) {
+	msg := &Message{
+		Header: Header{
+			Type: Confirmable,
+			Code: Code(GET),
+		},
+		RawOptions: RawOptions{
+			0xb2, 0x66, 0x77, // URIPath "fw"
+			0x03, 0x31, 0x2e, 0x30, // URIPath "1.0"
+		},
+	}
+
+	_, err := msg.Encode(nil, MarshalOptions{MaxOptions: 1})
+	expectErr(t, err, TooManyOptions{Limit: 1})
+
+	_, err = msg.Encode(nil, MarshalOptions{MaxOptionLength: 2})
+	expectErr(t, err, InvalidOptionValueLength{
+		OptionDef: UnrecognizedOptionDef(URIPath.Code, 2),
+		Length:    3,
+	})
+}
+
+func TestRawOptionsDecodeError(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		opts MarshalOptions
+		err  error
+	}{
+		{
+			name: "too many options",
+			data: []byte{0xb1, 0x61, 0x01, 0x62},
+			opts: MarshalOptions{MaxOptions: 1},
+			err:  TooManyOptions{Limit: 1},
+		},
+		{
+			name: "truncated",
+			data: []byte{0xb3, 0x61},
+			err:  TruncatedError{Expected: 3},
+		},
+		{
+			name: "option too long",
+			data: []byte{0xb3, 0x61, 0x62, 0x63},
+			opts: MarshalOptions{MaxOptionLength: 2},
+			err: InvalidOptionValueLength{
+				OptionDef: UnrecognizedOptionDef(URIPath.Code, 2),
+				Length:    3,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := RawOptions{}
+			_, err := raw.Decode(test.data, test.opts)
+			expectErr(t, err, test.err)
+		})
+	}
+}
+
+func BenchmarkProxyDecode(b *testing.B) {
+	data := []byte{
+		0x44, 0x01, 0x84, 0x9e, 0x51, 0x55, 0x77, 0xe8, // Header
+		0x3b, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x2e, 0x63, 0x6f, 0x6d, // URIHost "example.com"
+		0x42, 0x16, 0x33, // URIPort 5683
+		0x42, 0x66, 0x77, // URIPath "fw"
+		0x03, 0x31, 0x2e, 0x30, // URIPath "1.0"
+		0x11, 0x32, // ContentFormat 50
+		0x33, 0x61, 0x3d, 0x31, // URIQuery "a=1"
+		0x03, 0x62, 0x3d, 0x32, // URIQuery "b=2"
+		0x21, 0x32, // Accept 50
+		0xFF, 0x48, 0x69, // Payload "Hi"
+	}
+
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			msg := Message{}
+			_, err := msg.Decode(data, MarshalOptions{})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			_ = MustValue(msg.GetAllString(URIPath))
+		}
+	})
+
+	b.Run("lazy", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			msg := Message{}
+			_, err := msg.Decode(data, MarshalOptions{Lazy: true})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for _, err := range msg.RawOptions.GetAll(URIPath) {
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,297 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// ReassemblyIdleTimeout is the default time after which a partial Block1 transfer receiving no block
+	// is discarded, EXCHANGE_LIFETIME with default transmission parameters.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-2.5
+	ReassemblyIdleTimeout = 247 * time.Second
+
+	// MaxReassemblyLength is the default limit of the reassembled body length.
+	MaxReassemblyLength = 1 << 20
+)
+
+// ReassemblyOptions holds options for Reassembler.
+type ReassemblyOptions struct {
+	// IdleTimeout is the time after which a partial transfer receiving no block is discarded,
+	// defaults to ReassemblyIdleTimeout.
+	IdleTimeout time.Duration
+
+	// MaxLength is the limit of the reassembled body length, longer transfers are answered with
+	// RequestEntityTooLarge. Defaults to MaxReassemblyLength.
+	MaxLength uint
+
+	// MaxTransfers is the limit of partial transfers, the transfer receiving no block for the longest time
+	// is discarded when full. Defaults to MaxExchanges.
+	MaxTransfers uint
+
+	// Clock measures idle time of transfers, defaults to RealClock.
+	Clock Clock
+}
+
+// ReassemblyStats holds statistics of a Reassembler.
+type ReassemblyStats struct {
+	// ActiveTransfers is the number of partial transfers awaiting further blocks.
+	ActiveTransfers uint
+
+	// ExpiredTransfers is the number of partial transfers discarded after IdleTimeout or when MaxTransfers
+	// was reached.
+	ExpiredTransfers uint
+
+	// CompletedTransfers is the number of transfers passed to the handler.
+	CompletedTransfers uint
+}
+
+// Reassembler is a Handler reassembling Block1 transfers into a single request passed to the next handler,
+// answering intermediate blocks with Continue.
+//
+// Transfers in progress are held in an ExchangeStore keyed by the peer, the path and the Request-Tag of the request, so that uploads
+// from one peer to one resource distinguished by Request-Tag are reassembled independently. Untagged uploads
+// to the same resource share one transfer per peer, a new first block restarts it.
+//
+// A block repeating the last block added, sent again after its Continue was lost, is answered with Continue again.
+// A block that does not continue the transfer with its key, or continues a transfer discarded after
+// IdleTimeout, is answered with RequestEntityIncomplete. The final response carries Block1 of the last block.
+// The body is preallocated from Size1 of the first block, if any.
+//
+// https://datatracker.ietf.org/doc/html/rfc7959#section-2.5
+//
+// https://datatracker.ietf.org/doc/html/rfc9175#section-3
+type Reassembler struct {
+	next Handler
+	opts ReassemblyOptions
+
+	// mtx guards transfers in the store and counters, which are also updated by evictions from the store
+	mtx       sync.Mutex
+	transfers *ExchangeStore[*transfer]
+	expired   uint
+	completed uint
+}
+
+// transferKey identifies a Block1 transfer.
+type transferKey struct {
+	peer PeerID
+	path string
+
+	// tag holds Request-Tag values, each prefixed with its length, tagged tells an absent Request-Tag
+	// from an empty one
+	tag    string
+	tagged bool
+}
+
+// token encodes the key as the token of the transfer in the store, each field prefixed with its length.
+func (k transferKey) token() Token {
+	token := binary.AppendUvarint(nil, uint64(len(k.peer)))
+	token = append(token, k.peer...)
+	token = binary.AppendUvarint(token, uint64(len(k.path)))
+	token = append(token, k.path...)
+	if k.tagged {
+		token = append(token, 1)
+		token = append(token, k.tag...)
+	}
+
+	return token
+}
+
+// transfer is a Block1 transfer in progress.
+type transfer struct {
+	state BlockTransferState
+	body  []byte
+}
+
+// NewReassembler instantiates a new Reassembler passing reassembled requests to next.
+func NewReassembler(next Handler, opts ReassemblyOptions) *Reassembler {
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = ReassemblyIdleTimeout
+	}
+
+	if opts.MaxLength == 0 {
+		opts.MaxLength = MaxReassemblyLength
+	}
+
+	if opts.Clock == nil {
+		opts.Clock = RealClock
+	}
+
+	r := &Reassembler{
+		next: next,
+		opts: opts,
+	}
+	r.transfers = NewExchangeStore(ExchangeStoreOptions[*transfer]{
+		MaxEntries: opts.MaxTransfers,
+		Clock:      opts.Clock,
+		OnEvict: func(Token, *transfer, EvictionReason) {
+			r.expired++
+		},
+	})
+
+	return r
+}
+
+// Stats returns statistics of the reassembler.
+func (r *Reassembler) Stats() ReassemblyStats {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return ReassemblyStats{
+		ActiveTransfers:    uint(r.transfers.Len()),
+		ExpiredTransfers:   r.expired,
+		CompletedTransfers: r.completed,
+	}
+}
+
+// ServeCOAP implements Handler.
+//
+// Requests without Block1 are passed to the next handler unchanged.
+func (r *Reassembler) ServeCOAP(ctx context.Context, w ResponseWriter, req *Request) {
+	block, err := req.Options.GetBlock(Block1)
+	if isError[OptionNotFound](err) {
+		r.next.ServeCOAP(ctx, w, req)
+		return
+	}
+
+	if err != nil {
+		_ = w.Write(&Response{
+			Code: BadOption,
+		})
+		return
+	}
+
+	peer, _ := Peer(ctx)
+	key := transferKey{
+		peer: peer,
+		path: req.Path,
+	}
+	tags, err := req.Options.GetAllOpaque(RequestTag)
+	if err == nil {
+		for tag := range tags {
+			key.tag += string(binary.AppendUvarint(nil, uint64(len(tag)))) + string(tag)
+			key.tagged = true
+		}
+	}
+
+	body, code := r.add(key, block, req)
+	if code != 0 {
+		_ = w.Write(&Response{
+			Code: code,
+		})
+		return
+	}
+
+	echo := Options{}
+	Must(echo.SetBlock(Block1, block))
+
+	if block.More {
+		_ = w.Write(&Response{
+			Code:    Continue,
+			Options: echo,
+		})
+		return
+	}
+
+	reassembled := *req
+	reassembled.Options = slices.Clone(req.Options)
+	reassembled.Options.Clear(Block1)
+	reassembled.Options.Clear(Size1)
+	reassembled.Size1 = nil
+	reassembled.Block1 = nil
+	reassembled.Payload = body
+	reassembled.Body = nil
+
+	r.next.ServeCOAP(ctx, &reassemblyWriter{ResponseWriter: w, echo: echo[0]}, &reassembled)
+}
+
+// add adds the block of the request to the transfer with the key.
+//
+// Returns the body once the last block is added, or the response code rejecting the block.
+func (r *Reassembler) add(key transferKey, block BlockValue, req *Request) ([]byte, ResponseCode) {
+	token := key.token()
+	deadline := r.opts.Clock.Now().Add(r.opts.IdleTimeout)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	t, ok := r.transfers.Get(token)
+	if ok && block.More && t.repeats(block, req.Payload) {
+		// the Continue of the last block added was lost and the block is sent again
+		r.transfers.Extend(token, deadline)
+		return nil, 0
+	}
+
+	if block.Num == 0 {
+		// first block starts a new transfer, replacing the one in progress with the same key
+		t = &transfer{}
+		r.transfers.Put(token, t, deadline)
+	}
+
+	if t == nil {
+		return nil, RequestEntityIncomplete
+	}
+
+	end := uint(block.Offset()) + uint(len(req.Payload))
+	size := transferSize(req.Size1, req.Options, Size1)
+	if end > r.opts.MaxLength || size != nil && uint(*size) > r.opts.MaxLength {
+		r.transfers.Delete(token)
+		return nil, RequestEntityTooLarge
+	}
+
+	var prev *BlockTransferState
+	if block.Num != 0 {
+		prev = &t.state
+	} else if size != nil {
+		// https://datatracker.ietf.org/doc/html/rfc7959#section-4
+		t.body = make([]byte, 0, *size)
+	}
+
+	err := t.state.CheckRequest(req, prev)
+	if err != nil || uint(block.Offset()) != uint(len(t.body)) {
+		r.transfers.Delete(token)
+		return nil, RequestEntityIncomplete
+	}
+
+	t.body = append(t.body, req.Payload...)
+
+	if block.More {
+		r.transfers.Extend(token, deadline)
+		return nil, 0
+	}
+
+	r.transfers.Delete(token)
+	r.completed++
+
+	return t.body, 0
+}
+
+// repeats reports whether the block is the last block added to the transfer.
+func (t *transfer) repeats(block BlockValue, payload []byte) bool {
+	offset := uint(block.Offset())
+	return offset < uint(len(t.body)) && offset+uint(len(payload)) == uint(len(t.body)) && bytes.Equal(t.body[offset:], payload)
+}
+
+// reassemblyWriter adds Block1 of the last block to the response of the reassembled request.
+type reassemblyWriter struct {
+	ResponseWriter
+
+	echo Option
+}
+
+// Write implements ResponseWriter.
+func (w *reassemblyWriter) Write(resp *Response) error {
+	if resp.Options.Contains(Block1) {
+		return w.ResponseWriter.Write(resp)
+	}
+
+	echoed := *resp
+	echoed.Options = append(slices.Clone(resp.Options), w.echo)
+
+	return w.ResponseWriter.Write(&echoed)
+}
@@ -0,0 +1,343 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// reassemblyTest serves a Reassembler over a pipe, reassembled payloads are sent to the returned channel.
+func reassemblyTest(t *testing.T, opts ReassemblyOptions) (*serverTest, *Reassembler, <-chan []byte) {
+	t.Helper()
+
+	reassembled := make(chan []byte, 4)
+	next := HandlerFunc(func(_ context.Context, w ResponseWriter, req *Request) {
+		reassembled <- req.Payload
+		_ = w.Write(&Response{
+			Code: Changed,
+		})
+	})
+
+	// reassembler is bound once the clock of the server is known, before any request is sent
+	var reassembler *Reassembler
+	s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(ctx context.Context, w ResponseWriter, req *Request) {
+		reassembler.ServeCOAP(ctx, w, req)
+	}))
+
+	opts.Clock = s.clock
+	reassembler = NewReassembler(next, opts)
+
+	return s, reassembler, reassembled
+}
+
+// blockRequest returns the block of the upload to /upload, tag is omitted if nil.
+func blockRequest(id MessageID, tag []byte, body []byte, num uint32) *Message {
+	block := BlockValue{Num: num, SZX: 0}
+	end := min(int(block.Offset())+int(block.Size()), len(body))
+	block.More = end < len(body)
+
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(POST),
+			ID:      id,
+			Token:   Token{byte(id >> 8), byte(id)},
+		},
+		Payload: body[block.Offset():end],
+	}
+	Must(msg.Options.SetString(URIPath, "upload"))
+	Must(msg.Options.SetBlock(Block1, block))
+	if tag != nil {
+		Must(msg.Options.SetOpaque(RequestTag, tag))
+	}
+
+	return msg
+}
+
+// expectBlockResponse receives the response and checks its code and Block1.
+func expectBlockResponse(s *serverTest, code ResponseCode, block *BlockValue) {
+	s.t.Helper()
+
+	resp := s.receive()
+	if resp == nil {
+		s.t.Fatal("expected response")
+	}
+
+	if ResponseCode(resp.Code) != code {
+		s.t.Errorf("code = %s, want %s", ResponseCode(resp.Code), code)
+	}
+
+	var got *BlockValue
+	echo, err := resp.Options.GetBlock(Block1)
+	if err == nil {
+		got = &echo
+	}
+
+	diff := cmp.Diff(block, got)
+	if diff != "" {
+		s.t.Errorf("Block1 mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func expectReassembled(t *testing.T, reassembled <-chan []byte, body []byte) {
+	t.Helper()
+
+	select {
+	case payload := <-reassembled:
+		if !bytes.Equal(payload, body) {
+			t.Errorf("reassembled %q, want %q", payload, body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not reassembled")
+	}
+}
+
+func TestReassemblerInterleaved(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// sends is the number of times each block but the last is sent, blocks are sent again with
+		// a new MessageID as after all acknowledgements carrying Continue were lost
+		sends int
+	}{
+		{
+			name:  "reliable",
+			sends: 1,
+		},
+		{
+			name:  "lost continue",
+			sends: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, reassembler, reassembled := reassemblyTest(t, ReassemblyOptions{})
+
+			first := bytes.Repeat([]byte("a"), 40)
+			second := bytes.Repeat([]byte("b"), 40)
+
+			id := MessageID(0x1000)
+			for num := range uint32(3) {
+				for i, body := range [][]byte{first, second} {
+					if num == 2 {
+						id++
+						s.send(blockRequest(id, []byte{byte(i)}, body, num))
+						expectBlockResponse(s, Changed, &BlockValue{Num: num})
+						expectReassembled(t, reassembled, body)
+						continue
+					}
+
+					for range test.sends {
+						id++
+						s.send(blockRequest(id, []byte{byte(i)}, body, num))
+						expectBlockResponse(s, Continue, &BlockValue{Num: num, More: true})
+					}
+				}
+
+				if num == 0 {
+					stats := reassembler.Stats()
+					if stats.ActiveTransfers != 2 {
+						t.Errorf("active transfers = %d, want 2", stats.ActiveTransfers)
+					}
+				}
+			}
+
+			expect := ReassemblyStats{
+				CompletedTransfers: 2,
+			}
+
+			diff := cmp.Diff(expect, reassembler.Stats())
+			if diff != "" {
+				t.Errorf("stats mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReassemblerUntaggedCollision(t *testing.T) {
+	s, _, reassembled := reassemblyTest(t, ReassemblyOptions{})
+
+	first := bytes.Repeat([]byte("a"), 40)
+	second := bytes.Repeat([]byte("b"), 40)
+
+	// second upload restarts the single untagged transfer of the peer
+	s.send(blockRequest(0x1001, nil, first, 0))
+	expectBlockResponse(s, Continue, &BlockValue{Num: 0, More: true})
+	s.send(blockRequest(0x1002, nil, second, 0))
+	expectBlockResponse(s, Continue, &BlockValue{Num: 0, More: true})
+	s.send(blockRequest(0x1003, nil, second, 1))
+	expectBlockResponse(s, Continue, &BlockValue{Num: 1, More: true})
+	s.send(blockRequest(0x1004, nil, second, 2))
+	expectBlockResponse(s, Changed, &BlockValue{Num: 2})
+	expectReassembled(t, reassembled, second)
+
+	// continuation of the replaced upload
+	s.send(blockRequest(0x1005, nil, first, 1))
+	expectBlockResponse(s, RequestEntityIncomplete, nil)
+
+	// empty tag is distinct from an absent one
+	s.send(blockRequest(0x1006, []byte{}, first, 0))
+	expectBlockResponse(s, Continue, &BlockValue{Num: 0, More: true})
+	s.send(blockRequest(0x1007, nil, first, 1))
+	expectBlockResponse(s, RequestEntityIncomplete, nil)
+}
+
+func TestReassemblerRejected(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 40)
+
+	tests := []struct {
+		name    string
+		opts    ReassemblyOptions
+		advance time.Duration
+		num     uint32
+		code    ResponseCode
+		stats   ReassemblyStats
+	}{
+		{
+			name: "non-contiguous",
+			num:  2,
+			code: RequestEntityIncomplete,
+		},
+		{
+			name:    "expired",
+			opts:    ReassemblyOptions{IdleTimeout: time.Minute},
+			advance: time.Minute + time.Second,
+			num:     1,
+			code:    RequestEntityIncomplete,
+			stats:   ReassemblyStats{ExpiredTransfers: 1},
+		},
+		{
+			name: "too large",
+			opts: ReassemblyOptions{MaxLength: 24},
+			num:  1,
+			code: RequestEntityTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, reassembler, _ := reassemblyTest(t, test.opts)
+
+			s.send(blockRequest(0x1001, []byte{0x01}, body, 0))
+			expectBlockResponse(s, Continue, &BlockValue{Num: 0, More: true})
+
+			s.clock.Advance(test.advance)
+
+			s.send(blockRequest(0x1002, []byte{0x01}, body, test.num))
+			expectBlockResponse(s, test.code, nil)
+
+			diff := cmp.Diff(test.stats, reassembler.Stats())
+			if diff != "" {
+				t.Errorf("stats mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReassemblerPassThrough(t *testing.T) {
+	s, _, reassembled := reassemblyTest(t, ReassemblyOptions{})
+
+	msg := blockRequest(0x1001, nil, []byte("short"), 0)
+	msg.Options.Clear(Block1)
+	s.send(msg)
+
+	expectBlockResponse(s, Changed, nil)
+	expectReassembled(t, reassembled, []byte("short"))
+}
+
+func TestReassemblerPreallocated(t *testing.T) {
+	s, _, reassembled := reassemblyTest(t, ReassemblyOptions{})
+
+	body := bytes.Repeat([]byte("0123456789"), 5)
+	for num := uint32(0); num < 4; num++ {
+		msg := blockRequest(0x1001+MessageID(num), nil, body, num)
+		if num == 0 {
+			Must(msg.Options.SetUint(Size1, uint32(len(body))))
+		}
+		s.send(msg)
+
+		block := BlockValue{Num: num, More: num != 3, SZX: 0}
+		if block.More {
+			expectBlockResponse(s, Continue, &block)
+		} else {
+			expectBlockResponse(s, Changed, &block)
+		}
+	}
+
+	select {
+	case payload := <-reassembled:
+		if !bytes.Equal(payload, body) {
+			t.Errorf("reassembled %q, want %q", payload, body)
+		}
+
+		// the body is allocated once from Size1 of the first block
+		if cap(payload) != len(body) {
+			t.Errorf("capacity = %d, want %d", cap(payload), len(body))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not reassembled")
+	}
+}
+
+func TestReassemblerMaxTransfers(t *testing.T) {
+	s, reassembler, _ := reassemblyTest(t, ReassemblyOptions{MaxTransfers: 1})
+
+	body := bytes.Repeat([]byte("a"), 40)
+	s.send(blockRequest(0x1001, []byte{0x01}, body, 0))
+	expectBlockResponse(s, Continue, &BlockValue{Num: 0, More: true})
+
+	// the second transfer discards the first one
+	s.send(blockRequest(0x1002, []byte{0x02}, body, 0))
+	expectBlockResponse(s, Continue, &BlockValue{Num: 0, More: true})
+
+	s.send(blockRequest(0x1003, []byte{0x01}, body, 1))
+	expectBlockResponse(s, RequestEntityIncomplete, nil)
+
+	diff := cmp.Diff(ReassemblyStats{ActiveTransfers: 1, ExpiredTransfers: 1}, reassembler.Stats())
+	if diff != "" {
+		t.Errorf("stats mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReassemblerClientUpload(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 250)
+
+	received := make(chan []byte, 1)
+	rawURL := clientServer(t, NewReassembler(HandlerFunc(func(_ context.Context, w ResponseWriter, r *Request) {
+		received <- r.Payload
+		_ = w.Write(&Response{
+			Code: Changed,
+		})
+	}), ReassemblyOptions{}))
+
+	req, err := ParseURL(rawURL + "/firmware")
+	if err != nil {
+		t.Fatal("parse:", err)
+	}
+	req.Method = PUT
+	req.Body = onlyReader{bytes.NewReader(body)}
+
+	client := &Client{}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := client.Do(ctx, req)
+	if err != nil {
+		t.Fatal("do:", err)
+	}
+
+	if resp.Code != Changed {
+		t.Errorf("code = %s, want %s", resp.Code, Changed)
+	}
+
+	if got := <-received; !bytes.Equal(got, body) {
+		t.Errorf("received %d bytes, want %d", len(got), len(body))
+	}
+}
@@ -2,6 +2,7 @@ package coap
 
 import (
 	"fmt"
+	"io"
 	"iter"
 	"slices"
 	"strings"
@@ -41,8 +42,46 @@ type Request struct {
 	// ContentFormat overrides ContentFormat option.
 	ContentFormat *MediaType
 
+	// RequestSize2 asks the server to indicate resource size in Size2 option of the response.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-4
+	RequestSize2 bool
+
+	// Size1 overrides Size1 option indicating the total size of the request body if set,
+	// so that servers can reject oversized uploads early.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-4
+	Size1 *uint32
+
+	// Block1 overrides Block1 option carrying the block of the request body if set.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-2.2
+	Block1 *BlockValue
+
+	// Block2 overrides Block2 option requesting a block of the response body if set.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-2.2
+	Block2 *BlockValue
+
+	// IfNoneMatch adds the empty IfNoneMatch option making the request conditional on the target
+	// resource not existing, such as a PUT that creates the resource only if absent.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7252#section-5.10.8.2
+	IfNoneMatch bool
+
+	// IfMatch overrides IfMatch options if not empty, each value is an ETag of at most 8 bytes
+	// and an empty value matches any existing representation.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7252#section-5.10.8.1
+	IfMatch [][]byte
+
 	// Payload
 	Payload []byte
+
+	// Body is read instead of Payload if set, a block at a time by Client.Upload, which Client.Do uses
+	// for requests with Body. Encoding the request reads Body into the payload if Payload is empty,
+	// bounded by the maximum payload and message length. Body is not closed.
+	Body io.Reader
 }
 
 // Method represents a CoAP request method code.
@@ -60,6 +99,32 @@ const (
 	IPATCH Method = 0x07
 )
 
+// Observe option values in requests.
+//
+// https://datatracker.ietf.org/doc/html/rfc7641#section-2
+const (
+	// ObserveRegister adds the client to the list of observers of the resource.
+	ObserveRegister uint32 = 0
+
+	// ObserveDeregister removes the client from the list of observers of the resource.
+	ObserveDeregister uint32 = 1
+)
+
+// SetContentFormat sets ContentFormat to the media type.
+//
+// Returns UnknownMediaType if StrictSemantics is set and the media type is not defined by the schema
+// of opts, DefaultSchema if nil, as checked when encoding.
+func (r *Request) SetContentFormat(mediaType MediaType, opts MarshalOptions) error {
+	err := checkContentFormat(&mediaType, opts)
+	if err != nil {
+		return err
+	}
+
+	r.ContentFormat = &mediaType
+
+	return nil
+}
+
 // String implements fmt.Stringer.
 func (r *Request) String() string {
 	return fmt.Sprintf("Request(Type=%s, MessageID=%d, Method=%s, Path=%s)",
@@ -89,6 +154,20 @@ func (m Method) String() string {
 	return s
 }
 
+// Idempotent reports whether repeating a request with the method has the same effect as sending it once,
+// which is the case for all methods except POST and PATCH.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.8
+// https://datatracker.ietf.org/doc/html/rfc8132#section-2
+func (m Method) Idempotent() bool {
+	switch m {
+	case GET, PUT, DELETE, FETCH, IPATCH:
+		return true
+	default:
+		return false
+	}
+}
+
 // MarshalBinary implements encoding.BinaryMarshaler
 func (r *Request) MarshalBinary() ([]byte, error) {
 	data, err := r.AppendBinary(nil)
@@ -101,25 +180,102 @@ func (r *Request) MarshalBinary() ([]byte, error) {
 
 // AppendBinary implements encoding.BinaryAppender
 //
-// Host, Port, Path, and Query are set in final message options.
+// Host, Port, Path, and Query are set in final message options. Body is read into the payload
+// if Payload is empty, see Encode.
+//
+// Returns InvalidObserve if Observe option is not ObserveRegister or ObserveDeregister.
+//
+// Returns InvalidOptionValueLength if an IfMatch value is longer than 8 bytes.
+//
+// Returns InvalidBlockSize or InvalidBlockNum if Block1 or Block2 cannot be encoded.
 func (r *Request) AppendBinary(data []byte) ([]byte, error) {
+	return r.Encode(data, MarshalOptions{})
+}
+
+// Encode appends the Request to the provided data slice enforcing limits of the given options.
+//
+// Body is read into the payload if Payload is empty, at most one byte over MaxPayloadLength or MaxMessageLength.
+// Requests with a longer Body are sent with Client.Upload.
+//
+// Returns the error of reading Body.
+//
+// Returns UnknownMediaType if StrictSemantics is set and the schema does not define ContentFormat.
+//
+// Returns errors of AppendBinary and Message.Encode.
+func (r *Request) Encode(data []byte, opts MarshalOptions) ([]byte, error) {
+	err := checkContentFormat(r.ContentFormat, opts)
+	if err != nil {
+		return data, err
+	}
+
+	msg, err := r.message()
+	if err != nil {
+		return data, err
+	}
+
+	if len(msg.Payload) == 0 && r.Body != nil {
+		msg.Payload, err = readBody(r.Body, opts)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	return msg.Encode(data, opts)
+}
+
+// message builds the Message carrying the Request.
+func (r *Request) message() (Message, error) {
 	if r.Type != Confirmable && r.Type != NonConfirmable {
-		return data, InvalidType{
+		return Message{}, InvalidType{
 			Type: r.Type,
 		}
 	}
 
 	code := Code(r.Method)
-	if r.Method == 0 || code.Class() != 0 {
-		return data, InvalidCode{
+	if !code.IsRequest() {
+		return Message{}, InvalidCode{
 			Code: code,
 		}
 	}
 
+	err := validateObserve(r.Options)
+	if err != nil {
+		return Message{}, err
+	}
+
+	options, err := r.options()
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    r.Type,
+			Code:    code,
+			ID:      r.MessageID,
+			Token:   r.Token,
+		},
+		Options: options,
+		Payload: r.Payload,
+	}, nil
+}
+
+// options returns Options with the options carrying the fields of the Request.
+//
+// Fields which cannot be set, such as a Host longer than 255 bytes, are left out and the first error is returned.
+func (r *Request) options() (Options, error) {
 	options := slices.Clone(r.Options)
 
+	var errs []error
+	collect := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	if r.Host != "" {
-		Must(options.SetString(URIHost, r.Host))
+		collect(options.SetString(URIHost, r.Host))
 	}
 
 	if r.Port != 0 {
@@ -127,26 +283,48 @@ func (r *Request) AppendBinary(data []byte) ([]byte, error) {
 	}
 
 	if r.Path != "" {
-		Must(options.SetAllString(URIPath, EncodePath(r.Path)))
+		collect(options.ReplaceAllString(URIPath, EncodePath(r.Path)))
 	}
 
 	if len(r.Query) != 0 {
-		Must(options.SetAllString(URIQuery, slices.Values(r.Query)))
+		collect(options.ReplaceAllString(URIQuery, slices.Values(r.Query)))
 	}
 
-	msg := Message{
-		Header: Header{
-			Version: ProtocolVersion,
-			Type:    r.Type,
-			Code:    code,
-			ID:      r.MessageID,
-			Token:   r.Token,
-		},
-		Options: options,
-		Payload: r.Payload,
+	if r.ContentFormat != nil {
+		Must(options.SetUint(ContentFormat, uint32(r.ContentFormat.Code)))
+	}
+
+	if r.RequestSize2 {
+		Must(options.SetUint(Size2, 0))
+	}
+
+	if r.Size1 != nil {
+		Must(options.SetUint(Size1, *r.Size1))
+	}
+
+	if r.Block1 != nil {
+		collect(options.SetBlock(Block1, *r.Block1))
 	}
 
-	return msg.AppendBinary(data)
+	if r.Block2 != nil {
+		collect(options.SetBlock(Block2, *r.Block2))
+	}
+
+	if r.IfNoneMatch {
+		options.Set(Option{
+			OptionDef: IfNoneMatch,
+		})
+	}
+
+	if len(r.IfMatch) != 0 {
+		collect(options.ReplaceAllOpaque(IfMatch, slices.Values(r.IfMatch)))
+	}
+
+	if len(errs) != 0 {
+		return options, errs[0]
+	}
+
+	return options, nil
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
@@ -159,9 +337,15 @@ func (r *Request) UnmarshalBinary(data []byte) error {
 //
 // Returns UnmarshalError if the message cannot be decoded.
 //
-// Returns UnsupportedType error if the message type is not Confirmable or NonConfirmable.
+// Returns InvalidType error if the message type is not Confirmable or NonConfirmable.
+//
+// Returns InvalidCode error if the message code is not a valid request method (0.01-0.31).
 //
-// Returns UnsupportedCode error if the message code is not a valid request method (0.xx).
+// Returns InvalidObserve if StrictSemantics is set and Observe is not ObserveRegister or ObserveDeregister.
+//
+// Returns UnrecognizedOption if the message carries a critical option not defined by the schema.
+//
+// With Lazy set, only the URI options are decoded into the Request, the message options are left undecoded.
 func (r *Request) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 	msg := Message{}
 
@@ -170,18 +354,39 @@ func (r *Request) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 		return data, err
 	}
 
+	return data, r.fromMessage(&msg, opts)
+}
+
+// fromMessage sets the Request from a decoded message.
+func (r *Request) fromMessage(msg *Message, opts MarshalOptions) error {
 	if msg.Type != Confirmable && msg.Type != NonConfirmable {
-		return data, InvalidType{
+		return InvalidType{
 			Type: msg.Type,
 		}
 	}
 
-	if msg.Code.Class() != 0 {
-		return data, InvalidCode{
+	if !msg.Code.IsRequest() {
+		return InvalidCode{
 			Code: msg.Code,
 		}
 	}
 
+	if opts.StrictSemantics {
+		err := validateObserve(msg.Options)
+		if err != nil {
+			return err
+		}
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc7252#section-5.4.1
+	for _, opt := range msg.Options {
+		if !opt.Recognized() && opt.Critical() {
+			return UnrecognizedOption{
+				Code: opt.Code,
+			}
+		}
+	}
+
 	r.Type = msg.Type
 	r.Method = Method(msg.Code)
 	r.MessageID = msg.ID
@@ -189,23 +394,138 @@ func (r *Request) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 	r.Options = msg.Options
 	r.Payload = msg.Payload
 
-	host, ok := msg.Get(URIHost)
+	decoded := msg.Options
+	if opts.Lazy {
+		// only URI options are decoded from RawOptions, the others are left to the application
+		var err error
+		decoded, err = msg.RawOptions.uriOptions()
+		if err != nil {
+			return err
+		}
+	}
+
+	options := decoded.Compile()
+
+	// options masked or redefined by the schema are left in Options only
+	if options.decodedAs(URIHost) {
+		r.Host = MustValue(options.GetString(URIHost))
+	}
+
+	port, ok := options.lookupUint(URIPort)
+	if ok {
+		r.Port = uint16(port)
+	}
+
+	r.Path = ""
+	if options.decodedAs(URIPath) {
+		path := MustValue(options.GetAllString(URIPath))
+		r.Path = DecodePath(path)
+	}
+
+	r.Query = nil
+	if options.decodedAs(URIQuery) {
+		query := MustValue(options.GetAllString(URIQuery))
+		r.Query = slices.Collect(query)
+	}
+
+	size2, ok := options.lookupUint(Size2)
+	r.RequestSize2 = ok && size2 == 0
+
+	r.Size1 = nil
+	size1, ok := options.lookupUint(Size1)
 	if ok {
-		r.Host = MustValue(host.GetString())
+		r.Size1 = &size1
 	}
 
-	port, ok := msg.Get(URIPort)
+	r.Block1 = nil
+	block1, ok := options.lookupBlock(Block1)
 	if ok {
-		r.Port = uint16(MustValue(port.GetUint()))
+		r.Block1 = &block1
 	}
 
-	path := MustValue(msg.GetAllString(URIPath))
-	r.Path = DecodePath(path)
+	r.Block2 = nil
+	block2, ok := options.lookupBlock(Block2)
+	if ok {
+		r.Block2 = &block2
+	}
 
-	query := MustValue(msg.GetAllString(URIQuery))
-	r.Query = slices.Collect(query)
+	_, r.IfNoneMatch = options.Get(IfNoneMatch)
 
-	return data, nil
+	r.IfMatch = nil
+	if options.decodedAs(IfMatch) {
+		ifMatch := MustValue(options.GetAllOpaque(IfMatch))
+		r.IfMatch = slices.Collect(ifMatch)
+	}
+
+	return nil
+}
+
+// IsCreateOnly reports whether the request must only succeed if the target resource does not exist.
+func (r *Request) IsCreateOnly() bool {
+	if r.IfNoneMatch {
+		return true
+	}
+
+	_, ok := r.Options.Get(IfNoneMatch)
+	return ok
+}
+
+// Observe returns the Observe option value if present.
+func (r *Request) Observe() (uint32, bool) {
+	observe, err := r.Options.GetUint(Observe)
+	if err != nil {
+		return 0, false
+	}
+
+	return observe, true
+}
+
+// SetObserve sets the Observe option to ObserveRegister or ObserveDeregister.
+func (r *Request) SetObserve(register bool) {
+	value := ObserveDeregister
+	if register {
+		value = ObserveRegister
+	}
+
+	Must(r.Options.SetUint(Observe, value))
+}
+
+// CancelObserve returns a request cancelling the observation registered by r.
+//
+// RFC 7641 allows two ways to cancel an observation:
+//
+//   - proactively, by sending the returned request with the method, token and options of the
+//     registration and Observe set to ObserveDeregister, the server responds as to a normal GET,
+//   - lazily, by answering the next notification with a Reset using Conn.Reset with the
+//     MessageID of the notification, for servers that only learn about the cancellation then.
+//
+// MessageID of the returned request is cleared so that a new one is assigned when it is sent.
+//
+// https://datatracker.ietf.org/doc/html/rfc7641#section-3.6
+func (r *Request) CancelObserve() *Request {
+	cancel := *r
+	cancel.MessageID = 0
+	cancel.Token = slices.Clone(r.Token)
+	cancel.Options = slices.Clone(r.Options)
+	cancel.Query = slices.Clone(r.Query)
+	cancel.SetObserve(false)
+
+	return &cancel
+}
+
+func validateObserve(options Options) error {
+	observe, err := options.GetUint(Observe)
+	if err != nil {
+		return nil
+	}
+
+	if observe != ObserveRegister && observe != ObserveDeregister {
+		return InvalidObserve{
+			Value: observe,
+		}
+	}
+
+	return nil
 }
 
 // DecodePath decodes a sequence of path segments into a single path string.
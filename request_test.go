@@ -1,6 +1,7 @@
 package coap
 
 import (
+	"slices"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -41,6 +42,30 @@ func TestRequestRoundtrip(t *testing.T) {
 				MustOptionValue(URIQuery, "a=1"),
 			},
 		},
+		{
+			name: "repeated path and query",
+			data: []byte{
+				0x44, 0x01, 0x00, 0x01, 0xD0, 0xE2, 0x4D, 0xAC, // Header
+				0xB1, 0x61, 0x01, 0x62, // URIPath "/a/b"
+				0x43, 0x78, 0x3d, 0x31, 0x03, 0x79, 0x3d, 0x32, // URIQuery "x=1", "y=2"
+			},
+			request: &Request{
+				Method:    GET,
+				MessageID: 1,
+				Token:     []byte{0xD0, 0xE2, 0x4D, 0xAC},
+				Path:      "/a/b",
+				Query: []string{
+					"x=1",
+					"y=2",
+				},
+			},
+			options: Options{
+				MustOptionValue(URIPath, "a"),
+				MustOptionValue(URIPath, "b"),
+				MustOptionValue(URIQuery, "x=1"),
+				MustOptionValue(URIQuery, "y=2"),
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -70,6 +95,25 @@ func TestRequestRoundtrip(t *testing.T) {
 				t.Errorf("request mismatch (-want +got):\n%s", diff)
 			}
 		})
+
+		t.Run(test.name+"/reencode", func(t *testing.T) {
+			req := &Request{}
+
+			err := req.UnmarshalBinary(test.data)
+			if err != nil {
+				t.Fatal("unmarshal:", err)
+			}
+
+			data, err := req.MarshalBinary()
+			if err != nil {
+				t.Fatal("marshal:", err)
+			}
+
+			diff := cmp.Diff(test.data, data)
+			if diff != "" {
+				t.Errorf("data mismatch (-want +got):\n%s", diff)
+			}
+		})
 	}
 }
 
@@ -93,6 +137,13 @@ func TestRequestDecodeError(t *testing.T) {
 				Code: Code(Created),
 			},
 		},
+		{
+			name: "empty code",
+			data: []byte{0x40, 0x00, 0x42, 0x42},
+			err: InvalidCode{
+				Code: 0,
+			},
+		},
 		{
 			name: "truncated request",
 			data: []byte{0x44, 0x01, 0x00, 0x01, 0xD0, 0xE2, 0x4D},
@@ -103,6 +154,13 @@ func TestRequestDecodeError(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "unrecognized critical option",
+			data: []byte{0x40, 0x01, 0x00, 0x01, 0xD1, 0x1C, 0x42},
+			err: UnrecognizedOption{
+				Code: 41,
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -116,6 +174,40 @@ func TestRequestDecodeError(t *testing.T) {
 	}
 }
 
+func TestRequestDecodeLazy(t *testing.T) {
+	data := []byte{
+		0x44, 0x01, 0x84, 0x9e, 0x51, 0x55, 0x77, 0xe8, // Header
+		0x3b, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x2e, 0x6f, 0x72, 0x67, // URIHost "example.org"
+		0x42, 0x16, 0x33, // URIPort 5683
+		0x42, 0x66, 0x77, // URIPath "fw"
+		0x03, 0x31, 0x2e, 0x30, // URIPath "1.0"
+		0x43, 0x61, 0x3d, 0x31, // URIQuery "a=1"
+		0x21, 0x00, // Accept text/plain
+	}
+
+	req := &Request{}
+	_, err := req.Decode(data, MarshalOptions{Lazy: true})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	expected := &Request{
+		Type:      Confirmable,
+		Method:    GET,
+		MessageID: 0x849e,
+		Token:     Token{0x51, 0x55, 0x77, 0xe8},
+		Host:      "example.org",
+		Port:      5683,
+		Path:      "/fw/1.0",
+		Query:     []string{"a=1"},
+	}
+
+	diff := cmp.Diff(expected, req, EquateOptions())
+	if diff != "" {
+		t.Errorf("request mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func TestRequestAppendBinaryError(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -138,6 +230,20 @@ func TestRequestAppendBinaryError(t *testing.T) {
 			},
 			err: InvalidCode{Code: Code(Created)},
 		},
+		{
+			name: "empty code",
+			request: &Request{
+				Type: Confirmable,
+			},
+			err: InvalidCode{Code: 0},
+		},
+		{
+			name: "unassigned method",
+			request: &Request{
+				Type:   Confirmable,
+				Method: Method(0x08), // 0.08 is accepted for forward compatibility
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -163,3 +269,481 @@ func TestRequestString(t *testing.T) {
 		t.Errorf("String() = %q, want %q", got, want)
 	}
 }
+
+func TestRequestObserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		err     error
+	}{
+		{
+			name:    "register",
+			options: Options{MustOptionValue(Observe, ObserveRegister)},
+		},
+		{
+			name:    "deregister",
+			options: Options{MustOptionValue(Observe, ObserveDeregister)},
+		},
+		{
+			name:    "invalid",
+			options: Options{MustOptionValue(Observe, uint32(7))},
+			err:     InvalidObserve{Value: 7},
+		},
+		{
+			name:    "sequence number",
+			options: Options{MustOptionValue(Observe, uint32(0xFFFFFF))},
+			err:     InvalidObserve{Value: 0xFFFFFF},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name+"/encode", func(t *testing.T) {
+			req := &Request{
+				Method:  GET,
+				Options: test.options,
+			}
+
+			_, err := req.AppendBinary(nil)
+			expectErr(t, err, test.err)
+		})
+
+		t.Run(test.name+"/decode", func(t *testing.T) {
+			msg := &Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    Confirmable,
+					Code:    Code(GET),
+				},
+				Options: test.options,
+			}
+
+			data, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatal("marshal:", err)
+			}
+
+			req := &Request{}
+			_, err = req.Decode(data, MarshalOptions{})
+			if err != nil {
+				t.Fatal("lenient decode:", err)
+			}
+
+			_, err = req.Decode(data, MarshalOptions{StrictSemantics: true})
+			expectErr(t, err, test.err)
+		})
+	}
+
+	t.Run("accessors", func(t *testing.T) {
+		req := &Request{}
+		_, ok := req.Observe()
+		if ok {
+			t.Fatal("expected observe to be absent")
+		}
+
+		req.SetObserve(true)
+		observe, ok := req.Observe()
+		if !ok || observe != ObserveRegister {
+			t.Errorf("Observe() = %d, %v, want %d, true", observe, ok, ObserveRegister)
+		}
+
+		req.SetObserve(false)
+		observe, ok = req.Observe()
+		if !ok || observe != ObserveDeregister {
+			t.Errorf("Observe() = %d, %v, want %d, true", observe, ok, ObserveDeregister)
+		}
+
+		if len(req.Options) != 1 {
+			t.Errorf("expected single observe option, got %d", len(req.Options))
+		}
+	})
+}
+
+func TestRequestCancelObserve(t *testing.T) {
+	req := &Request{
+		Method:    GET,
+		MessageID: 0x4242,
+		Token:     bytes4,
+		Path:      "/sensor",
+	}
+	req.SetObserve(true)
+
+	cancel := req.CancelObserve()
+
+	want := &Request{
+		Method: GET,
+		Token:  bytes4,
+		Path:   "/sensor",
+		Options: Options{
+			MustOptionValue(Observe, ObserveDeregister),
+		},
+	}
+
+	diff := cmp.Diff(want, cancel, EquateOptions())
+	if diff != "" {
+		t.Errorf("request mismatch (-want +got):\n%s", diff)
+	}
+
+	if observe, _ := req.Observe(); observe != ObserveRegister {
+		t.Errorf("registration modified, Observe() = %d", observe)
+	}
+}
+
+func TestRequestSize2(t *testing.T) {
+	req := &Request{
+		Method:       GET,
+		RequestSize2: true,
+	}
+
+	data, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	want := []byte{
+		0x40, 0x01, 0x00, 0x00, // Header
+		0xd0, 0x0f, // Size2 0
+	}
+
+	diff := cmp.Diff(want, data)
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+
+	decoded := &Request{}
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	if !decoded.RequestSize2 {
+		t.Error("expected RequestSize2 to be set")
+	}
+}
+
+func TestRequestSize1(t *testing.T) {
+	size := uint32(1024)
+	req := &Request{
+		Method:  POST,
+		Size1:   &size,
+		Payload: []byte("ab"),
+	}
+
+	data, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	want := []byte{
+		0x40, 0x02, 0x00, 0x00, // Header
+		0xd2, 0x2f, 0x04, 0x00, // Size1 1024
+		0xff, 0x61, 0x62, // Payload
+	}
+
+	diff := cmp.Diff(want, data)
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+
+	decoded := &Request{}
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	if decoded.Size1 == nil || *decoded.Size1 != size {
+		t.Errorf("Size1 = %v, want %d", decoded.Size1, size)
+	}
+
+	err = decoded.UnmarshalBinary(data[:4])
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	// absent is distinguished from zero
+	if decoded.Size1 != nil {
+		t.Errorf("Size1 = %d, want nil", *decoded.Size1)
+	}
+}
+
+func TestRequestBlock(t *testing.T) {
+	req := &Request{
+		Method:  POST,
+		Block1:  &BlockValue{Num: 1, More: true, SZX: 2},
+		Block2:  &BlockValue{Num: 0, SZX: 6},
+		Payload: []byte("ab"),
+	}
+
+	data, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	want := []byte{
+		0x40, 0x02, 0x00, 0x00, // Header
+		0xd1, 0x0a, 0x06, // Block2 0/0/1024
+		0x41, 0x1a, // Block1 1/1/64
+		0xff, 0x61, 0x62, // Payload
+	}
+
+	diff := cmp.Diff(want, data)
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+
+	decoded := &Request{}
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	diff = cmp.Diff(req.Block1, decoded.Block1)
+	if diff != "" {
+		t.Errorf("Block1 mismatch (-want +got):\n%s", diff)
+	}
+
+	diff = cmp.Diff(req.Block2, decoded.Block2)
+	if diff != "" {
+		t.Errorf("Block2 mismatch (-want +got):\n%s", diff)
+	}
+
+	// reserved size exponent is left in Options only
+	err = decoded.UnmarshalBinary([]byte{0x40, 0x02, 0x00, 0x00, 0xd1, 0x0e, 0x07})
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	if decoded.Block1 != nil || decoded.Block2 != nil {
+		t.Errorf("Block1 = %v, Block2 = %v, want nil", decoded.Block1, decoded.Block2)
+	}
+}
+
+func TestRequestBlockError(t *testing.T) {
+	tests := []struct {
+		name  string
+		block BlockValue
+		err   error
+	}{
+		{
+			name:  "num",
+			block: BlockValue{Num: MaxBlockNum + 1},
+			err:   InvalidBlockNum{Num: MaxBlockNum + 1},
+		},
+		{
+			name:  "size",
+			block: BlockValue{SZX: 7},
+			err:   InvalidBlockSize{SZX: 7},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &Request{
+				Method: PUT,
+				Block1: &test.block,
+			}
+
+			_, err := req.MarshalBinary()
+			expectErr(t, err, test.err)
+
+			resp := &Response{
+				Code:   Continue,
+				Block1: &test.block,
+			}
+
+			_, err = resp.AppendBinary(nil)
+			expectErr(t, err, test.err)
+		})
+	}
+}
+
+func TestRequestIfNoneMatch(t *testing.T) {
+	req := &Request{
+		Method:      PUT,
+		IfNoneMatch: true,
+	}
+
+	data, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	want := []byte{
+		0x40, 0x03, 0x00, 0x00, // Header
+		0x50, // IfNoneMatch
+	}
+
+	diff := cmp.Diff(want, data)
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+
+	decoded := &Request{}
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	if !decoded.IfNoneMatch || !decoded.IsCreateOnly() {
+		t.Error("expected IfNoneMatch to be set")
+	}
+
+	err = decoded.UnmarshalBinary(data[:4])
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	if decoded.IfNoneMatch || decoded.IsCreateOnly() {
+		t.Error("expected IfNoneMatch to be cleared")
+	}
+
+	raw := &Request{
+		Method:  PUT,
+		Options: Options{{OptionDef: IfNoneMatch}},
+	}
+	if !raw.IsCreateOnly() {
+		t.Error("expected raw IfNoneMatch option to be create only")
+	}
+}
+
+func TestRequestIfMatch(t *testing.T) {
+	req := &Request{
+		Method:  PUT,
+		IfMatch: [][]byte{bytes4, {}},
+	}
+
+	data, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	want := []byte{
+		0x40, 0x03, 0x00, 0x00, // Header
+		0x14, 0xde, 0xad, 0xbe, 0xef, // IfMatch ETag
+		0x00, // IfMatch any
+	}
+
+	diff := cmp.Diff(want, data)
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+
+	decoded := &Request{}
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	diff = cmp.Diff(req.IfMatch, decoded.IfMatch, cmpopts.EquateEmpty())
+	if diff != "" {
+		t.Errorf("IfMatch mismatch (-want +got):\n%s", diff)
+	}
+
+	req.IfMatch = [][]byte{bytes16}
+	_, err = req.MarshalBinary()
+	expectErr(t, err, InvalidOptionValueLength{
+		OptionDef: IfMatch,
+		Length:    16,
+	})
+}
+
+func TestRequestIfMatchReencode(t *testing.T) {
+	req := &Request{
+		Method:  PUT,
+		IfMatch: [][]byte{{0x01}, {0x02}, bytes4},
+	}
+
+	data, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	// decoded options carry If-Match values, encoding must not repeat them
+	decoded := &Request{}
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	reencoded, err := decoded.MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal decoded:", err)
+	}
+
+	diff := cmp.Diff(data, reencoded)
+	if diff != "" {
+		t.Errorf("data mismatch (-want +got):\n%s", diff)
+	}
+
+	decoded.IfMatch = [][]byte{bytes16}
+	_, err = decoded.MarshalBinary()
+	expectErr(t, err, InvalidOptionValueLength{
+		OptionDef: IfMatch,
+		Length:    16,
+	})
+}
+
+func TestMethodIdempotent(t *testing.T) {
+	idempotent := []Method{GET, PUT, DELETE, FETCH, IPATCH}
+	for _, method := range []Method{GET, POST, PUT, DELETE, FETCH, PATCH, IPATCH} {
+		want := slices.Contains(idempotent, method)
+		if method.Idempotent() != want {
+			t.Errorf("%s.Idempotent() = %v, want %v", method, method.Idempotent(), want)
+		}
+	}
+}
+
+func TestRequestSetContentFormat(t *testing.T) {
+	req := &Request{
+		Type:   Confirmable,
+		Method: POST,
+	}
+
+	err := req.SetContentFormat(UnrecognizedMediaType(65000), MarshalOptions{StrictSemantics: true})
+	expectErr(t, err, UnknownMediaType{
+		Code: 65000,
+	})
+	if req.ContentFormat != nil {
+		t.Errorf("ContentFormat = %v, want unset", req.ContentFormat)
+	}
+
+	schema := DefaultSchema.WithOverlay().AddMediaTypes(MediaType{Code: 65000, Name: "application/vnd.example"})
+	err = req.SetContentFormat(UnrecognizedMediaType(65000), MarshalOptions{StrictSemantics: true, Schema: schema})
+	if err != nil {
+		t.Error("set with schema:", err)
+	}
+
+	err = req.SetContentFormat(UnrecognizedMediaType(65000), MarshalOptions{})
+	if err != nil {
+		t.Error("set without StrictSemantics:", err)
+	}
+
+	sniffed := SniffMediaType([]byte(`{}`))
+	err = req.SetContentFormat(sniffed, MarshalOptions{})
+	if err != nil {
+		t.Fatal("set:", err)
+	}
+
+	diff := cmp.Diff(&MediaTypeApplicationJSON, req.ContentFormat)
+	if diff != "" {
+		t.Errorf("content format mismatch (-want +got):\n%s", diff)
+	}
+
+	// unknown media types set directly are encoded unless StrictSemantics is set
+	unknown := UnrecognizedMediaType(65000)
+	req.ContentFormat = &unknown
+
+	_, err = req.Encode(nil, MarshalOptions{})
+	if err != nil {
+		t.Error("encode:", err)
+	}
+
+	_, err = req.Encode(nil, MarshalOptions{StrictSemantics: true})
+	expectErr(t, err, UnknownMediaType{
+		Code: 65000,
+	})
+
+	_, err = req.Encode(nil, MarshalOptions{StrictSemantics: true, Schema: schema})
+	if err != nil {
+		t.Error("encode with schema:", err)
+	}
+}
@@ -1,8 +1,13 @@
 package coap
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"net/url"
 	"slices"
+	"strings"
+	"sync"
 )
 
 // Response represents a CoAP response message.
@@ -22,9 +27,31 @@ type Response struct {
 	// Options
 	Options Options
 
-	// ContentFormat overrides ContentFormat option if set.
+	// ContentFormat overrides ContentFormat option if set, unless ContentFormatInferred.
 	ContentFormat *MediaType
 
+	// ContentFormatInferred indicates ContentFormat was guessed from the payload by SniffMediaType
+	// instead of declared by the ContentFormat option, see MarshalOptions.SniffContentFormat.
+	ContentFormatInferred bool
+
+	// Observe overrides Observe option sequence number if set.
+	Observe *uint32
+
+	// Size2 overrides Size2 option indicating total size of the resource representation if set.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-4
+	Size2 *uint32
+
+	// Block1 overrides Block1 option acknowledging a block of the request body if set.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-2.2
+	Block1 *BlockValue
+
+	// Block2 overrides Block2 option carrying the block of the response body if set.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-2.2
+	Block2 *BlockValue
+
 	// LocationPath overrides LocationPath option if not empty.
 	LocationPath string
 
@@ -33,6 +60,18 @@ type Response struct {
 
 	// Payload
 	Payload []byte
+
+	// Body is read instead of Payload if set. Server reads only the block requested by Block2 of the
+	// request, or the first block if the body does not fit in a single one, seeking if Body is an io.Seeker.
+	// Encoding the response reads Body into the payload if Payload is empty, bounded by the maximum
+	// payload and message length. Body is not closed.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-2.4
+	Body io.Reader
+
+	// Request is the request the response was received for, set by Conn.Do and Conn.Upload.
+	// It is not encoded, Location resolves location options against its URL.
+	Request *Request
 }
 
 // ResponseCode represents a CoAP response message code.
@@ -44,12 +83,16 @@ type ResponseCode uint8
 //
 // https://datatracker.ietf.org/doc/html/rfc7252#section-5.9.1
 const (
-	Created  ResponseCode = 0x41
-	Deleted  ResponseCode = 0x42
-	Valid    ResponseCode = 0x43
-	Changed  ResponseCode = 0x44
-	Content  ResponseCode = 0x45
-	Continue ResponseCode = 0x46
+	Created ResponseCode = 0x41
+	Deleted ResponseCode = 0x42
+	Valid   ResponseCode = 0x43
+	Changed ResponseCode = 0x44
+	Content ResponseCode = 0x45
+
+	// Continue is 2.31 defined by RFC 7959.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-2.9.1
+	Continue ResponseCode = 0x5f
 )
 
 // Client Error 4.xx Response Codes
@@ -85,6 +128,76 @@ const (
 	HopLimitReached      ResponseCode = 0xa8
 )
 
+// NewResponse returns a Response to the request with the given code.
+//
+// The response to a Confirmable request is a piggybacked Acknowledgement carrying the MessageID of the
+// request, the response to a NonConfirmable request is NonConfirmable and gets a MessageID when written.
+// The Token of the request is copied in both cases.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.2
+func NewResponse(req *Request, code ResponseCode) *Response {
+	resp := &Response{
+		Code:  code,
+		Token: slices.Clone(req.Token),
+	}
+
+	switch req.Type {
+	case NonConfirmable:
+		resp.Type = NonConfirmable
+	default:
+		resp.Type = Acknowledgement
+		resp.MessageID = req.MessageID
+	}
+
+	return resp
+}
+
+// ContentResponse returns a Content Response to the request carrying the body in the media type.
+//
+// Type, MessageID and Token follow the request as with NewResponse.
+func ContentResponse(req *Request, mediaType MediaType, body []byte) *Response {
+	resp := NewResponse(req, Content)
+	resp.ContentFormat = &mediaType
+	resp.Payload = body
+
+	return resp
+}
+
+// MatchesRequest reports whether the response belongs to the request, that is the Token echoes
+// the request Token and a piggybacked Acknowledgement carries the MessageID of the Confirmable request.
+//
+// It is a correctness aid to catch programming errors before sending, not a wire format rule,
+// Server sets Token and MessageID of written responses itself.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.3.2
+func (r *Response) MatchesRequest(req *Request) bool {
+	if !bytes.Equal(r.Token, req.Token) {
+		return false
+	}
+
+	if r.Type == Acknowledgement {
+		return req.Type == Confirmable && r.MessageID == req.MessageID
+	}
+
+	return true
+}
+
+// SetContentFormat sets ContentFormat to the media type, declared rather than inferred.
+//
+// Returns UnknownMediaType if StrictSemantics is set and the media type is not defined by the schema
+// of opts, DefaultSchema if nil, as checked when encoding.
+func (r *Response) SetContentFormat(mediaType MediaType, opts MarshalOptions) error {
+	err := checkContentFormat(&mediaType, opts)
+	if err != nil {
+		return err
+	}
+
+	r.ContentFormat = &mediaType
+	r.ContentFormatInferred = false
+
+	return nil
+}
+
 func (r *Response) String() string {
 	return fmt.Sprintf("Response(Type=%s, MessageID=%d, Code=%s)",
 		r.Type,
@@ -97,36 +210,121 @@ func (r *Response) String() string {
 //
 // Returns InvalidType if type is out of range.
 //
-// Returns InvalidCode if code is not a valid response code.
+// Returns InvalidCode if code class is not in the range of 2.xx to 5.xx.
+//
+// Returns InvalidOptionValueLength if Observe sequence number does not fit in 3 bytes.
+//
+// Returns InvalidLocation if LocationPath contains "." or ".." segment.
+//
+// Returns InvalidBlockSize or InvalidBlockNum if Block1 or Block2 cannot be encoded.
 func (r *Response) AppendBinary(data []byte) ([]byte, error) {
+	return r.Encode(data, MarshalOptions{})
+}
+
+// Encode appends the Response to the provided data slice enforcing limits of the given options.
+//
+// Body is read into the payload if Payload is empty, at most one byte over MaxPayloadLength or MaxMessageLength.
+//
+// Returns the error of reading Body.
+//
+// Returns UnknownMediaType if StrictSemantics is set and the schema does not define ContentFormat.
+//
+// Returns errors of AppendBinary and Message.Encode.
+func (r *Response) Encode(data []byte, opts MarshalOptions) ([]byte, error) {
+	err := checkContentFormat(r.ContentFormat, opts)
+	if err != nil {
+		return data, err
+	}
+
+	msg, err := r.message()
+	if err != nil {
+		return data, err
+	}
+
+	if len(msg.Payload) == 0 && r.Body != nil {
+		msg.Payload, err = readBody(r.Body, opts)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	return msg.Encode(data, opts)
+}
+
+// message builds the Message carrying the Response.
+func (r *Response) message() (Message, error) {
+	msg := Message{}
+	err := r.build(&msg)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return msg, nil
+}
+
+// build sets msg to carry the Response, options are appended to msg.Options truncated to reuse its capacity.
+func (r *Response) build(msg *Message) error {
 	if r.Type > Reset {
-		return data, InvalidType{
+		return InvalidType{
 			Type: r.Type,
 		}
 	}
 
 	code := Code(r.Code)
-	if code.Class() < 0x01 || code.Class() > 0x10 {
-		return data, InvalidCode{
+	if !code.IsResponse() {
+		return InvalidCode{
 			Code: code,
 		}
 	}
 
-	options := slices.Clone(r.Options)
+	options := append(msg.Options[:0], r.Options...)
 
-	if r.ContentFormat != nil {
-		options.SetUint(ContentFormat, uint32(r.ContentFormat.Code))
+	if r.ContentFormat != nil && !r.ContentFormatInferred {
+		err := options.SetUint(ContentFormat, uint32(r.ContentFormat.Code))
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Observe != nil {
+		err := options.SetUint(Observe, *r.Observe)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Size2 != nil {
+		Must(options.SetUint(Size2, *r.Size2))
+	}
+
+	if r.Block1 != nil {
+		err := options.SetBlock(Block1, *r.Block1)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Block2 != nil {
+		err := options.SetBlock(Block2, *r.Block2)
+		if err != nil {
+			return err
+		}
 	}
 
 	if r.LocationPath != "" {
-		Must(options.SetAllString(LocationPath, EncodePath(r.LocationPath)))
+		Must(options.ReplaceAllString(LocationPath, EncodePath(r.LocationPath)))
 	}
 
 	if r.LocationQuery != nil {
-		Must(options.SetAllString(LocationQuery, slices.Values(r.LocationQuery)))
+		Must(options.ReplaceAllString(LocationQuery, slices.Values(r.LocationQuery)))
+	}
+
+	err := validateLocation(options)
+	if err != nil {
+		return err
 	}
 
-	msg := Message{
+	*msg = Message{
 		Header: Header{
 			Version: ProtocolVersion,
 			Type:    r.Type,
@@ -138,12 +336,7 @@ func (r *Response) AppendBinary(data []byte) ([]byte, error) {
 		Payload: r.Payload,
 	}
 
-	data, err := msg.AppendBinary(data)
-	if err != nil {
-		return nil, err
-	}
-
-	return data, nil
+	return nil
 }
 
 // Decode decodes the Response from the given data using the provided options.
@@ -151,11 +344,9 @@ func (r *Response) AppendBinary(data []byte) ([]byte, error) {
 // Returns UnmarshalError if the message cannot be decoded.
 //
 // Returns InvalidCode if the message code class is not in the range of 2.xx to 5.xx.
+//
+// Returns InvalidLocation if StrictSemantics is set and LocationPath contains "." or ".." segment.
 func (r *Response) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
-	if opts.Schema == nil {
-		opts.Schema = DefaultSchema
-	}
-
 	msg := Message{}
 
 	data, err := msg.Decode(data, opts)
@@ -163,12 +354,28 @@ func (r *Response) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 		return data, err
 	}
 
-	if msg.Code.Class() < 2 || msg.Code.Class() > 5 {
-		return data, InvalidCode{
+	return data, r.fromMessage(&msg, opts)
+}
+
+// fromMessage sets the Response from a decoded message.
+func (r *Response) fromMessage(msg *Message, opts MarshalOptions) error {
+	if opts.Schema == nil {
+		opts.Schema = DefaultSchema
+	}
+
+	if !msg.Code.IsResponse() {
+		return InvalidCode{
 			Code: msg.Code,
 		}
 	}
 
+	if opts.StrictSemantics {
+		err := validateLocation(msg.Options)
+		if err != nil {
+			return err
+		}
+	}
+
 	r.Type = msg.Type
 	r.Code = ResponseCode(msg.Code)
 	r.MessageID = msg.ID
@@ -176,26 +383,215 @@ func (r *Response) Decode(data []byte, opts MarshalOptions) ([]byte, error) {
 	r.Options = msg.Options
 	r.Payload = msg.Payload
 
-	contentFormat, ok := r.Options.Get(ContentFormat)
-	if ok {
-		code := MustValue(contentFormat.GetUint())
+	options := r.Options.Compile()
+
+	// options masked or redefined by the schema are left in Options only
+	r.ContentFormatInferred = false
+	code, ok := options.lookupUint(ContentFormat)
+	switch {
+	case ok:
 		mediaType := opts.Schema.MediaType(uint16(code))
 		r.ContentFormat = &mediaType
+	case opts.SniffContentFormat && len(r.Payload) != 0 && !options.Contains(ContentFormat):
+		mediaType := SniffMediaType(r.Payload)
+		r.ContentFormat = &mediaType
+		r.ContentFormatInferred = true
+	}
+
+	sequence, ok := options.lookupUint(Observe)
+	if ok {
+		r.Observe = &sequence
+	}
+
+	size, ok := options.lookupUint(Size2)
+	if ok {
+		r.Size2 = &size
+	}
+
+	r.Block1 = nil
+	block1, ok := options.lookupBlock(Block1)
+	if ok {
+		r.Block1 = &block1
+	}
+
+	r.Block2 = nil
+	block2, ok := options.lookupBlock(Block2)
+	if ok {
+		r.Block2 = &block2
+	}
+
+	r.LocationPath = ""
+	if options.decodedAs(LocationPath) {
+		path := MustValue(options.GetAllString(LocationPath))
+		r.LocationPath = DecodePath(path)
+	}
+
+	r.LocationQuery = nil
+	if options.decodedAs(LocationQuery) {
+		query := MustValue(options.GetAllString(LocationQuery))
+		r.LocationQuery = slices.Collect(query)
+	}
+
+	return nil
+}
+
+// TotalSize returns the total size of the resource representation indicated by Size2.
+func (r *Response) TotalSize() (uint32, bool) {
+	if r.Size2 == nil {
+		return 0, false
+	}
+
+	return *r.Size2, true
+}
+
+// Location returns the URI of the created resource composed from location options.
+//
+// The location options carry an absolute path and replace the query of the request URI, the reference is
+// resolved against the URL of Request. Returns the unresolved reference if Request is nil.
+//
+// Returns nil if there are no location options.
+//
+// Returns InvalidLocation if LocationPath contains "." or ".." segment.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.10.7
+func (r *Response) Location() (*url.URL, error) {
+	path := slices.Collect(MustValue(r.Options.GetAllString(LocationPath)))
+	if r.LocationPath != "" {
+		path = slices.Collect(EncodePath(r.LocationPath))
+	}
+
+	query := slices.Collect(MustValue(r.Options.GetAllString(LocationQuery)))
+	if r.LocationQuery != nil {
+		query = r.LocationQuery
+	}
+
+	if len(path) == 0 && len(query) == 0 {
+		return nil, nil
+	}
+
+	escaped := make([]string, len(path))
+	for i, segment := range path {
+		if segment == "." || segment == ".." {
+			return nil, InvalidLocation{
+				Segment: segment,
+			}
+		}
+
+		escaped[i] = url.PathEscape(segment)
+	}
+
+	params := make([]string, len(query))
+	for i, param := range query {
+		key, value, ok := strings.Cut(param, "=")
+		params[i] = url.QueryEscape(key)
+		if ok {
+			params[i] += "=" + url.QueryEscape(value)
+		}
+	}
+
+	location := &url.URL{
+		RawQuery: strings.Join(params, "&"),
+	}
+
+	// query only reference keeps the request path
+	if len(path) != 0 {
+		location.Path = "/" + strings.Join(path, "/")
+		location.RawPath = "/" + strings.Join(escaped, "/")
 	}
 
-	path := MustValue(r.Options.GetAllString(LocationPath))
-	r.LocationPath = DecodePath(path)
+	if r.Request != nil {
+		return r.Request.URL().ResolveReference(location), nil
+	}
+
+	return location, nil
+}
+
+// validateLocation checks LocationPath segments for reserved values.
+func validateLocation(options Options) error {
+	// plain loop, validation is on the response hot path
+	for _, opt := range options {
+		if opt.Code != LocationPath.Code || opt.ValueFormat != ValueFormatString {
+			continue
+		}
+
+		if opt.stringValue == "." || opt.stringValue == ".." {
+			return InvalidLocation{
+				Segment: opt.stringValue,
+			}
+		}
+	}
+
+	return nil
+}
 
-	query := MustValue(r.Options.GetAllString(LocationQuery))
-	r.LocationQuery = slices.Collect(query)
+// responseCodeNames holds names of response codes rendered by ResponseCode.String.
+var responseCodeNames = struct {
+	mtx   sync.RWMutex
+	names map[ResponseCode]string
+}{
+	names: map[ResponseCode]string{
+		Created:                  "Created",
+		Deleted:                  "Deleted",
+		Valid:                    "Valid",
+		Changed:                  "Changed",
+		Content:                  "Content",
+		Continue:                 "Continue",
+		BadRequest:               "Bad Request",
+		Unauthorized:             "Unauthorized",
+		BadOption:                "Bad Option",
+		Forbidden:                "Forbidden",
+		NotFound:                 "Not Found",
+		MethodNotAllowed:         "Method Not Allowed",
+		NotAcceptable:            "Not Acceptable",
+		RequestEntityIncomplete:  "Request Entity Incomplete",
+		Conflict:                 "Conflict",
+		PreconditionFailed:       "Precondition Failed",
+		RequestEntityTooLarge:    "Request Entity Too Large",
+		UnsupportedContentFormat: "Unsupported Content-Format",
+		UnprocessableEntity:      "Unprocessable Entity",
+		TooManyRequests:          "Too Many Requests",
+		InternalServerError:      "Internal Server Error",
+		NotImplemented:           "Not Implemented",
+		BadGateway:               "Bad Gateway",
+		ServiceUnavailable:       "Service Unavailable",
+		GatewayTimeout:           "Gateway Timeout",
+		ProxyingNotSupported:     "Proxying Not Supported",
+		HopLimitReached:          "Hop Limit Reached",
+	},
+}
+
+// RegisterResponseCode registers the name of the response code rendered by ResponseCode.String,
+// replacing the name registered before, so that codes of extensions and vendors are logged readably.
+//
+// RegisterResponseCode is safe for concurrent use with String.
+func RegisterResponseCode(code ResponseCode, name string) {
+	responseCodeNames.mtx.Lock()
+	defer responseCodeNames.mtx.Unlock()
 
-	return data, nil
+	responseCodeNames.names[code] = name
 }
 
 // String implements fmt.Stringer.
+//
+// Registered codes are rendered with their name, such as "2.05 Content", others as "c.dd".
 func (c ResponseCode) String() string {
 	class := (c & 0xe0) >> 5
 	detail := c & 0x1f
 
-	return fmt.Sprintf("%d.%02d", class, detail)
+	name, ok := c.name()
+	if !ok {
+		return fmt.Sprintf("%d.%02d", class, detail)
+	}
+
+	return fmt.Sprintf("%d.%02d %s", class, detail, name)
+}
+
+// name returns the registered name of the code.
+func (c ResponseCode) name() (string, bool) {
+	responseCodeNames.mtx.RLock()
+	defer responseCodeNames.mtx.RUnlock()
+
+	name, ok := responseCodeNames.names[c]
+
+	return name, ok
 }
@@ -1,7 +1,9 @@
 package coap
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -64,6 +66,24 @@ func TestResponseRoundtrip(t *testing.T) {
 				t.Errorf("response mismatch (-want +got):\n%s", diff)
 			}
 		})
+
+		t.Run(test.name+"/reencode", func(t *testing.T) {
+			resp := &Response{}
+			_, err := resp.Decode(test.data, MarshalOptions{})
+			if err != nil {
+				t.Fatal("unmarshal:", err)
+			}
+
+			data, err := resp.AppendBinary(nil)
+			if err != nil {
+				t.Fatal("marshal:", err)
+			}
+
+			diff := cmp.Diff(test.data, data)
+			if diff != "" {
+				t.Errorf("data mismatch (-want +got):\n%s", diff)
+			}
+		})
 	}
 }
 
@@ -125,6 +145,30 @@ func TestResponseAppendBinaryError(t *testing.T) {
 			},
 			err: InvalidCode{Code: Code(0x01)},
 		},
+		{
+			name: "class 1 code",
+			response: &Response{
+				Type: Confirmable,
+				Code: ResponseCode(0x21), // 1.01 reserved
+			},
+			err: InvalidCode{Code: Code(0x21)},
+		},
+		{
+			name: "class 6 code",
+			response: &Response{
+				Type: Confirmable,
+				Code: ResponseCode(0xc1), // 6.01 reserved
+			},
+			err: InvalidCode{Code: Code(0xc1)},
+		},
+		{
+			name: "class 7 code",
+			response: &Response{
+				Type: Confirmable,
+				Code: ResponseCode(0xe1), // 7.01 signaling
+			},
+			err: InvalidCode{Code: Code(0xe1)},
+		},
 	}
 
 	for _, test := range tests {
@@ -144,8 +188,646 @@ func TestResponseString(t *testing.T) {
 		MessageID: 42,
 		Code:      Content,
 	}
-	want := "Response(Type=ACK, MessageID=42, Code=2.05)"
+	want := "Response(Type=ACK, MessageID=42, Code=2.05 Content)"
 	if got := resp.String(); got != want {
 		t.Errorf("String() = %q, want %q", got, want)
 	}
 }
+
+func TestResponseObserve(t *testing.T) {
+	tests := []struct {
+		name     string
+		sequence uint32
+		err      error
+	}{
+		{
+			name:     "zero",
+			sequence: 0,
+		},
+		{
+			name:     "sequence number",
+			sequence: 42,
+		},
+		{
+			name:     "max sequence number",
+			sequence: 0xFFFFFF,
+		},
+		{
+			name:     "sequence number too long",
+			sequence: 0x1000000,
+			err: InvalidOptionValueLength{
+				OptionDef: Observe,
+				Length:    4,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &Response{
+				Type:    NonConfirmable,
+				Code:    Content,
+				Observe: &test.sequence,
+			}
+
+			data, err := resp.AppendBinary(nil)
+			expectErr(t, err, test.err)
+			if err != nil {
+				return
+			}
+
+			decoded := &Response{}
+			_, err = decoded.Decode(data, MarshalOptions{StrictSemantics: true})
+			if err != nil {
+				t.Fatal("decode:", err)
+			}
+
+			if decoded.Observe == nil || *decoded.Observe != test.sequence {
+				t.Errorf("Observe = %v, want %d", decoded.Observe, test.sequence)
+			}
+		})
+	}
+}
+
+func TestResponseSize2(t *testing.T) {
+	resp := &Response{
+		Type: Acknowledgement,
+		Code: Content,
+	}
+
+	_, ok := resp.TotalSize()
+	if ok {
+		t.Fatal("expected total size to be absent")
+	}
+
+	size := uint32(1 << 20)
+	resp.Size2 = &size
+
+	data, err := resp.AppendBinary(nil)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	decoded := &Response{}
+	_, err = decoded.Decode(data, MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	total, ok := decoded.TotalSize()
+	if !ok || total != size {
+		t.Errorf("TotalSize() = %d, %v, want %d, true", total, ok, size)
+	}
+}
+
+func TestResponseBlock(t *testing.T) {
+	resp := &Response{
+		Type:    Acknowledgement,
+		Code:    Content,
+		Block1:  &BlockValue{Num: 3, SZX: 2},
+		Block2:  &BlockValue{Num: 2, More: true, SZX: 1},
+		Payload: bytes4,
+	}
+
+	data, err := resp.AppendBinary(nil)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	decoded := &Response{}
+	_, err = decoded.Decode(data, MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	diff := cmp.Diff(resp.Block1, decoded.Block1)
+	if diff != "" {
+		t.Errorf("Block1 mismatch (-want +got):\n%s", diff)
+	}
+
+	diff = cmp.Diff(resp.Block2, decoded.Block2)
+	if diff != "" {
+		t.Errorf("Block2 mismatch (-want +got):\n%s", diff)
+	}
+
+	block2, err := decoded.Options.GetBlock(Block2)
+	if err != nil || block2 != *resp.Block2 {
+		t.Errorf("Block2 option = %v, %v, want %v", block2, err, *resp.Block2)
+	}
+
+	// fields of a reused response are reset when absent
+	data, err = (&Response{Type: Acknowledgement, Code: Content}).AppendBinary(nil)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	_, err = decoded.Decode(data, MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	if decoded.Block1 != nil || decoded.Block2 != nil {
+		t.Errorf("Block1 = %v, Block2 = %v, want nil", decoded.Block1, decoded.Block2)
+	}
+}
+
+func TestResponseLocation(t *testing.T) {
+	req := &Request{
+		Host:  "example.com",
+		Path:  "/sensors/create",
+		Query: []string{"type=temp"},
+	}
+
+	tests := []struct {
+		name     string
+		response *Response
+		location string
+		err      error
+	}{
+		{
+			name:     "no location",
+			response: &Response{},
+		},
+		{
+			name: "path",
+			response: &Response{
+				LocationPath: "/sensors/42",
+			},
+			location: "coap://example.com/sensors/42",
+		},
+		{
+			name: "path and query",
+			response: &Response{
+				LocationPath:  "/sensors/42",
+				LocationQuery: []string{"a=1", "b"},
+			},
+			location: "coap://example.com/sensors/42?a=1&b",
+		},
+		{
+			name: "query only",
+			response: &Response{
+				LocationQuery: []string{"a=1"},
+			},
+			location: "coap://example.com/sensors/create?a=1",
+		},
+		{
+			name: "empty segment",
+			response: &Response{
+				LocationPath: "/sensors//42",
+			},
+			location: "coap://example.com/sensors//42",
+		},
+		{
+			name: "absolute looking segment",
+			response: &Response{
+				Options: Options{
+					MustOptionValue(LocationPath, "coap:"),
+					MustOptionValue(LocationPath, "evil.com"),
+				},
+			},
+			location: "coap://example.com/coap:/evil.com",
+		},
+		{
+			name: "escaped segment",
+			response: &Response{
+				Options: Options{
+					MustOptionValue(LocationPath, "a/b"),
+				},
+			},
+			location: "coap://example.com/a%2Fb",
+		},
+		{
+			name: "dot segment",
+			response: &Response{
+				LocationPath: "/sensors/./42",
+			},
+			err: InvalidLocation{
+				Segment: ".",
+			},
+		},
+		{
+			name: "dot dot segment",
+			response: &Response{
+				LocationPath: "/sensors/../admin",
+			},
+			err: InvalidLocation{
+				Segment: "..",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.response.Request = req
+
+			location, err := test.response.Location()
+			expectErr(t, err, test.err)
+			if err != nil {
+				return
+			}
+
+			got := ""
+			if location != nil {
+				got = location.String()
+			}
+
+			if got != test.location {
+				t.Errorf("location = %q, want %q", got, test.location)
+			}
+		})
+	}
+}
+
+func TestResponseLocationValidation(t *testing.T) {
+	resp := &Response{
+		Type:         Acknowledgement,
+		Code:         Created,
+		LocationPath: "/a/../b",
+	}
+
+	_, err := resp.AppendBinary(nil)
+	expectErr(t, err, InvalidLocation{
+		Segment: "..",
+	})
+
+	msg := Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Acknowledgement,
+			Code:    Code(Created),
+		},
+		Options: Options{
+			MustOptionValue(LocationPath, ".."),
+		},
+	}
+
+	data, err := msg.AppendBinary(nil)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	_, err = resp.Decode(data, MarshalOptions{})
+	expectErr(t, err, nil)
+
+	_, err = resp.Decode(data, MarshalOptions{
+		StrictSemantics: true,
+	})
+	expectErr(t, err, InvalidLocation{
+		Segment: "..",
+	})
+}
+
+func TestNewResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *Request
+		resp *Response
+	}{
+		{
+			name: "confirmable",
+			req: &Request{
+				Type:      Confirmable,
+				Method:    GET,
+				MessageID: 0x4242,
+				Token:     bytes4,
+			},
+			resp: &Response{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: 0x4242,
+				Token:     bytes4,
+			},
+		},
+		{
+			name: "non-confirmable",
+			req: &Request{
+				Type:      NonConfirmable,
+				Method:    GET,
+				MessageID: 0x4242,
+				Token:     bytes4,
+			},
+			resp: &Response{
+				Type:  NonConfirmable,
+				Code:  Content,
+				Token: bytes4,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := NewResponse(test.req, Content)
+			diff := cmp.Diff(test.resp, resp, EquateOptions())
+			if diff != "" {
+				t.Errorf("response mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestContentResponse(t *testing.T) {
+	req := &Request{
+		Type:      Confirmable,
+		Method:    GET,
+		MessageID: 0x4242,
+		Token:     bytes4,
+	}
+
+	expect := &Response{
+		Type:          Acknowledgement,
+		Code:          Content,
+		MessageID:     0x4242,
+		Token:         bytes4,
+		ContentFormat: &MediaTypeApplicationJSON,
+		Payload:       []byte(`{"temp":21}`),
+	}
+
+	resp := ContentResponse(req, MediaTypeApplicationJSON, []byte(`{"temp":21}`))
+	diff := cmp.Diff(expect, resp, EquateOptions())
+	if diff != "" {
+		t.Errorf("response mismatch (-want +got):\n%s", diff)
+	}
+
+	base := clientServer(t, HandlerFunc(func(_ context.Context, w ResponseWriter, req *Request) {
+		_ = w.Write(ContentResponse(req, MediaTypeApplicationJSON, []byte(`{"temp":21}`)))
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := Get(ctx, base+"/temp")
+	if err != nil {
+		t.Fatal("get:", err)
+	}
+
+	diff = cmp.Diff(expect.Payload, resp.Payload)
+	if diff != "" {
+		t.Errorf("payload mismatch (-want +got):\n%s", diff)
+	}
+
+	if resp.Code != Content || resp.ContentFormat == nil || resp.ContentFormat.Code != MediaTypeApplicationJSON.Code {
+		t.Errorf("response = %s %v, want %s %s", resp.Code, resp.ContentFormat, Content, MediaTypeApplicationJSON)
+	}
+}
+
+func TestResponseMatchesRequest(t *testing.T) {
+	req := &Request{
+		Type:      Confirmable,
+		Method:    GET,
+		MessageID: 0x4242,
+		Token:     bytes4,
+	}
+
+	tests := []struct {
+		name  string
+		req   *Request
+		resp  *Response
+		match bool
+	}{
+		{
+			name:  "piggybacked",
+			req:   req,
+			resp:  NewResponse(req, Content),
+			match: true,
+		},
+		{
+			name: "separate",
+			req:  req,
+			resp: &Response{
+				Type:      Confirmable,
+				Code:      Content,
+				MessageID: 0x1234,
+				Token:     bytes4,
+			},
+			match: true,
+		},
+		{
+			name: "empty token",
+			req: &Request{
+				Type:      NonConfirmable,
+				Method:    GET,
+				MessageID: 0x4242,
+			},
+			resp: &Response{
+				Type:  NonConfirmable,
+				Code:  Content,
+				Token: Token{},
+			},
+			match: true,
+		},
+		{
+			name: "token mismatch",
+			req:  req,
+			resp: &Response{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: 0x4242,
+				Token:     bytes8,
+			},
+		},
+		{
+			name: "token length mismatch",
+			req:  req,
+			resp: &Response{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: 0x4242,
+				Token:     bytes4[:2],
+			},
+		},
+		{
+			name: "acknowledgement message id mismatch",
+			req:  req,
+			resp: &Response{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: 0x4243,
+				Token:     bytes4,
+			},
+		},
+		{
+			name: "acknowledgement of non-confirmable",
+			req: &Request{
+				Type:      NonConfirmable,
+				Method:    GET,
+				MessageID: 0x4242,
+				Token:     bytes4,
+			},
+			resp: &Response{
+				Type:      Acknowledgement,
+				Code:      Content,
+				MessageID: 0x4242,
+				Token:     bytes4,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match := test.resp.MatchesRequest(test.req)
+			if match != test.match {
+				t.Errorf("MatchesRequest() = %v, want %v", match, test.match)
+			}
+		})
+	}
+}
+
+func TestResponseSniffContentFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  Options
+		payload  string
+		opts     MarshalOptions
+		expect   *MediaType
+		inferred bool
+	}{
+		{
+			name:     "sniffed",
+			payload:  `{"temp":21.5}`,
+			opts:     MarshalOptions{SniffContentFormat: true},
+			expect:   &MediaTypeApplicationJSON,
+			inferred: true,
+		},
+		{
+			name:    "declared wins",
+			options: Options{MustOptionValue(ContentFormat, uint32(MediaTypeTextPlain.Code))},
+			payload: `{"temp":21.5}`,
+			opts:    MarshalOptions{SniffContentFormat: true},
+			expect:  &MediaTypeTextPlain,
+		},
+		{
+			name:    "empty payload",
+			opts:    MarshalOptions{SniffContentFormat: true},
+			payload: "",
+		},
+		{
+			name:    "disabled",
+			payload: `{"temp":21.5}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := &Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    Acknowledgement,
+					Code:    Code(Content),
+				},
+				Options: test.options,
+				Payload: []byte(test.payload),
+			}
+
+			data, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatal("marshal:", err)
+			}
+
+			resp := &Response{}
+			_, err = resp.Decode(data, test.opts)
+			if err != nil {
+				t.Fatal("decode:", err)
+			}
+
+			diff := cmp.Diff(test.expect, resp.ContentFormat)
+			if diff != "" {
+				t.Errorf("content format mismatch (-want +got):\n%s", diff)
+			}
+
+			if resp.ContentFormatInferred != test.inferred {
+				t.Errorf("ContentFormatInferred = %v, want %v", resp.ContentFormatInferred, test.inferred)
+			}
+		})
+	}
+}
+
+func TestResponseInferredContentFormatNotEncoded(t *testing.T) {
+	mediaType := SniffMediaType([]byte(`{"temp":21.5}`))
+	resp := &Response{
+		Type:                  Acknowledgement,
+		Code:                  Content,
+		ContentFormat:         &mediaType,
+		ContentFormatInferred: true,
+		Payload:               []byte(`{"temp":21.5}`),
+	}
+
+	data, err := resp.AppendBinary(nil)
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	msg := &Message{}
+	_, err = msg.Decode(data, MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	if msg.Options.Contains(ContentFormat) {
+		t.Error("inferred content format encoded")
+	}
+}
+
+func TestResponseSetContentFormat(t *testing.T) {
+	resp := &Response{
+		Type: Acknowledgement,
+		Code: Content,
+	}
+
+	err := resp.SetContentFormat(DefaultSchema.MediaType(65000), MarshalOptions{StrictSemantics: true})
+	expectErr(t, err, UnknownMediaType{
+		Code: 65000,
+	})
+
+	err = resp.SetContentFormat(MediaTypeApplicationCBOR, MarshalOptions{StrictSemantics: true})
+	if err != nil {
+		t.Fatal("set:", err)
+	}
+
+	data, err := resp.Encode(nil, MarshalOptions{StrictSemantics: true})
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	decoded := &Response{}
+	_, err = decoded.Decode(data, MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	diff := cmp.Diff(&MediaTypeApplicationCBOR, decoded.ContentFormat)
+	if diff != "" {
+		t.Errorf("content format mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestResponseCodeString(t *testing.T) {
+	vendor := ResponseCode(0x9f) // 4.31, unassigned
+	if s := vendor.String(); s != "4.31" {
+		t.Errorf("unregistered String() = %q, want %q", s, "4.31")
+	}
+
+	RegisterResponseCode(vendor, "Vendor Quota Exceeded")
+	defer func() {
+		responseCodeNames.mtx.Lock()
+		delete(responseCodeNames.names, vendor)
+		responseCodeNames.mtx.Unlock()
+	}()
+
+	tests := []struct {
+		code   ResponseCode
+		expect string
+	}{
+		{Content, "2.05 Content"},
+		{Continue, "2.31 Continue"},
+		{RequestEntityIncomplete, "4.08 Request Entity Incomplete"},
+		{UnsupportedContentFormat, "4.15 Unsupported Content-Format"},
+		{HopLimitReached, "5.08 Hop Limit Reached"},
+		{vendor, "4.31 Vendor Quota Exceeded"},
+	}
+
+	for _, test := range tests {
+		if s := test.code.String(); s != test.expect {
+			t.Errorf("String() = %q, want %q", s, test.expect)
+		}
+	}
+}
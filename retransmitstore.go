@@ -0,0 +1,116 @@
+package coap
+
+import (
+	"math"
+	"net"
+	"time"
+)
+
+// RetransmitStore persists pending Confirmable messages, so that their retransmission survives a process restart.
+//
+// Conn saves a message when it is registered for retransmission and after each retransmission,
+// and deletes it once it is acknowledged, reset or given up on. Messages pending on Close are kept.
+// NewConn loads messages saved by a previous process and resumes their retransmission, restored messages
+// keep their MessageID, so MessageIDSource should not reissue it within EXCHANGE_LIFETIME.
+//
+// Store errors are passed to the ErrorHandler, errors loading or decoding messages to the ConnErrorHandler.
+type RetransmitStore interface {
+	Save(op SerializedWriteOp) error
+	Delete(id MessageID) error
+	Load() ([]SerializedWriteOp, error)
+}
+
+// SerializedWriteOp is a WriteOp in a form that can be persisted by RetransmitStore.
+type SerializedWriteOp struct {
+	ID MessageID
+
+	// Message is the encoded message.
+	Message []byte
+
+	// Network and Addr are the network and string form of the destination address.
+	Network string
+	Addr    string
+
+	Start      time.Time
+	Retransmit uint
+	Timeout    time.Duration
+	Next       time.Time
+	Deadline   time.Time
+}
+
+// NoopRetransmitStore persists nothing.
+var NoopRetransmitStore RetransmitStore = noopRetransmitStore{}
+
+type noopRetransmitStore struct{}
+
+// persistOptions encode and decode persisted messages, limits were enforced when the message was first written.
+var persistOptions = MarshalOptions{
+	MaxMessageLength: math.MaxUint32,
+	MaxPayloadLength: math.MaxUint32,
+	MaxOptions:       math.MaxUint32,
+	MaxOptionLength:  math.MaxUint16,
+}
+
+func (noopRetransmitStore) Save(_ SerializedWriteOp) error {
+	return nil
+}
+
+func (noopRetransmitStore) Delete(_ MessageID) error {
+	return nil
+}
+
+func (noopRetransmitStore) Load() ([]SerializedWriteOp, error) {
+	return nil, nil
+}
+
+// ResolveAddr resolves the destination address of a restored message with net.ResolveUDPAddr.
+func ResolveAddr(network string, address string) (net.Addr, error) {
+	return net.ResolveUDPAddr(network, address)
+}
+
+// serialize returns the persisted form of the op.
+func (op WriteOp) serialize() (SerializedWriteOp, error) {
+	data, err := op.Message.Encode(nil, persistOptions)
+	if err != nil {
+		return SerializedWriteOp{}, err
+	}
+
+	return SerializedWriteOp{
+		ID:         op.Message.ID,
+		Message:    data,
+		Network:    op.Addr.Network(),
+		Addr:       op.Addr.String(),
+		Start:      op.Start,
+		Retransmit: op.Retransmit,
+		Timeout:    op.Timeout,
+		Next:       op.Next,
+		Deadline:   op.Deadline,
+	}, nil
+}
+
+// writeOp decodes the persisted op using the schema and resolves its destination address.
+func (s SerializedWriteOp) writeOp(schema *Schema, resolve func(network, address string) (net.Addr, error)) (WriteOp, error) {
+	opts := persistOptions
+	opts.Schema = schema
+
+	msg := &Message{}
+	_, err := msg.Decode(s.Message, opts)
+	if err != nil {
+		return WriteOp{}, err
+	}
+
+	addr, err := resolve(s.Network, s.Addr)
+	if err != nil {
+		return WriteOp{}, err
+	}
+
+	return WriteOp{
+		Message:    msg,
+		Addr:       addr,
+		Start:      s.Start,
+		Retransmit: s.Retransmit,
+		Timeout:    s.Timeout,
+		Next:       s.Next,
+		Deadline:   s.Deadline,
+	}, nil
+}
@@ -0,0 +1,211 @@
+package coap
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uramaki-io/coap/internal/pipe"
+)
+
+// memoryStore is a RetransmitStore surviving Conn restarts within a test.
+type memoryStore struct {
+	mtx sync.Mutex
+	ops map[MessageID]SerializedWriteOp
+}
+
+func newMemoryStore(ops ...SerializedWriteOp) *memoryStore {
+	s := &memoryStore{
+		ops: map[MessageID]SerializedWriteOp{},
+	}
+
+	for _, op := range ops {
+		s.ops[op.ID] = op
+	}
+
+	return s
+}
+
+func (s *memoryStore) Save(op SerializedWriteOp) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.ops[op.ID] = op
+	return nil
+}
+
+func (s *memoryStore) Delete(id MessageID) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.ops, id)
+	return nil
+}
+
+func (s *memoryStore) Load() ([]SerializedWriteOp, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ops := []SerializedWriteOp{}
+	for _, op := range s.ops {
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+func (s *memoryStore) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return len(s.ops)
+}
+
+// waitLen waits for the store to hold n messages, as it is updated by the retransmit loop.
+func (s *memoryStore) waitLen(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for s.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("store holds %d messages, want %d", s.Len(), n)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnRetransmitStore(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	store := newMemoryStore()
+	opts := testConnOptions()
+	opts.Clock = clock
+	opts.Store = store
+	opts.ResolveAddr = pipe.Resolve
+
+	// first process, transmission is lost and the process stops
+	a, b := newPipe()
+	a.DropEvery(1)
+	client := NewConn(a, opts)
+
+	msg := testRequest()
+	err := client.Write(msg, b.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	store.waitLen(t, 1)
+
+	err = client.Close()
+	if err != nil {
+		t.Fatal("close:", err)
+	}
+
+	if store.Len() != 1 {
+		t.Fatal("expected pending message to be kept on close")
+	}
+
+	// second process resumes retransmission
+	a, b = newPipe()
+	client = NewConn(a, opts)
+	defer client.Close()
+
+	if pending := client.Stats().PendingExchanges; pending != 1 {
+		t.Fatalf("restored %d pending exchanges, want 1", pending)
+	}
+
+	go func() {
+		_, _ = client.Read(&Message{})
+	}()
+
+	// the retransmit timer is started asynchronously, advance until it fires
+	var (
+		data []byte
+		from net.Addr
+	)
+	for range 10 {
+		clock.Advance(opts.ACKTimeout)
+
+		data, from = receiveDatagram(t, b)
+		if data != nil {
+			break
+		}
+	}
+
+	if data == nil {
+		t.Fatal("restored message not retransmitted")
+	}
+
+	received := &Message{}
+	err = received.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal("unmarshal:", err)
+	}
+
+	if received.ID != msg.ID || string(received.Token) != string(msg.Token) {
+		t.Errorf("retransmitted %#x %x, want %#x %x", received.ID, received.Token, msg.ID, msg.Token)
+	}
+
+	ack, err := (&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Acknowledgement,
+			ID:      received.ID,
+		},
+	}).MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	_, err = b.WriteTo(ack, from)
+	if err != nil {
+		t.Fatal("write ack:", err)
+	}
+
+	store.waitLen(t, 0)
+}
+
+func TestConnRestoreExpired(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0).Add(time.Hour))
+	data, err := testRequest().MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	store := newMemoryStore(SerializedWriteOp{
+		ID:      0x4242,
+		Message: data,
+		Network: "pipe",
+		Addr:    "pipe-b",
+		Start:   time.Unix(0, 0),
+		Timeout: 10 * time.Millisecond,
+		Next:    time.Unix(0, 0).Add(10 * time.Millisecond),
+	})
+
+	errs := []error{}
+	opts := testConnOptions()
+	opts.Clock = clock
+	opts.Store = store
+	opts.ResolveAddr = pipe.Resolve
+	opts.ErrorHandler = func(_ *Message, err error) {
+		errs = append(errs, err)
+	}
+
+	a, _ := newPipe()
+	client := NewConn(a, opts)
+	defer client.Close()
+
+	if store.Len() != 0 {
+		t.Error("expected expired message to be deleted")
+	}
+
+	if !slices.ContainsFunc(errs, isError[RetransmitWaitLimit]) {
+		t.Errorf("errors = %v, want RetransmitWaitLimit", errs)
+	}
+
+	if pending := client.Stats().PendingExchanges; pending != 0 {
+		t.Errorf("restored %d pending exchanges, want 0", pending)
+	}
+}
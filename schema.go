@@ -1,5 +1,12 @@
 package coap
 
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
 // DefaultSchema defines well-known CoAP options and media types.
 //
 // https://www.iana.org/assignments/core-parameters/core-parameters.xhtml#content-formats
@@ -25,6 +32,7 @@ var DefaultSchema = NewSchema().
 		Size1,
 		Size2,
 		NoResponse,
+		RequestTag,
 	).
 	AddMediaTypes(
 		MediaTypeTextPlain,
@@ -41,12 +49,47 @@ var DefaultSchema = NewSchema().
 		MediaTypeApplicationJSON,
 		MediaTypeApplicationCBOR,
 		MediaTypeApplicationCBORSeq,
+		MediaTypeApplicationConciseProblemDetails,
 	)
 
 // Schema contains definitions of CoAP options and media types.
+//
+// A Schema created by WithOverlay is layered over its base, lookups check the overlay first and then
+// the base, so that per-tenant schemas share definitions without copying them.
 type Schema struct {
 	options    map[uint16]OptionDef
 	mediaTypes map[uint16]MediaType
+
+	// base is consulted for codes not defined by this layer, nil for a root schema.
+	base *Schema
+}
+
+// SchemaDescription describes definitions of a Schema for display, see Schema.Describe.
+type SchemaDescription struct {
+	Options    []OptionDescription    `json:"options"`
+	MediaTypes []MediaTypeDescription `json:"mediaTypes"`
+}
+
+// OptionDescription describes an OptionDef along with properties derived from its code.
+type OptionDescription struct {
+	Name       string      `json:"name"`
+	Code       uint16      `json:"code"`
+	Format     ValueFormat `json:"format"`
+	Repeatable bool        `json:"repeatable"`
+	MinLen     uint16      `json:"minLen"`
+	MaxLen     uint16      `json:"maxLen"`
+	Critical   bool        `json:"critical"`
+	Unsafe     bool        `json:"unsafe"`
+	NoCacheKey bool        `json:"noCacheKey"`
+
+	// Display is the value format with length bounds for humans, such as "opaque[1..8]", or "empty".
+	Display string `json:"display"`
+}
+
+// MediaTypeDescription describes a MediaType.
+type MediaTypeDescription struct {
+	Name string `json:"name"`
+	Code uint16 `json:"code"`
 }
 
 // NewSchema creates a new Schema instance with empty options and media types.
@@ -57,15 +100,62 @@ func NewSchema() *Schema {
 	}
 }
 
+// WithOverlay creates an empty Schema layered over s.
+//
+// Definitions added to the overlay take precedence over s and never mutate it, s can be shared read-only
+// by goroutines building overlays as long as it is not modified itself.
+func (s *Schema) WithOverlay() *Schema {
+	overlay := NewSchema()
+	overlay.base = s
+
+	return overlay
+}
+
 // AddOptions adds options.
+//
+// Panics with the error of OptionDef.Validate if an option is inconsistent, such as OptionPropertyMismatch
+// if declared CriticalOverride or UnsafeOverride contradicts the option code, so that a mistyped definition
+// is caught at registration. Use AddOptionsChecked to skip inconsistent options instead.
 func (s *Schema) AddOptions(options ...OptionDef) *Schema {
 	for _, option := range options {
+		Must(option.Validate())
 		s.options[option.Code] = option
 	}
 
 	return s
 }
 
+// AddOptionsChecked adds valid options and skips inconsistent ones.
+//
+// Returns the errors of OptionDef.Validate of all skipped options joined.
+func (s *Schema) AddOptionsChecked(options ...OptionDef) error {
+	var errs []error
+	for _, option := range options {
+		err := option.Validate()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		s.options[option.Code] = option
+	}
+
+	return errors.Join(errs...)
+}
+
+// MarkUnrecognized masks options with given codes, so that they are treated as unrecognized
+// even if defined by the base schema.
+func (s *Schema) MarkUnrecognized(codes ...uint16) *Schema {
+	for _, code := range codes {
+		// unrecognized definition without name is a mask, max length is set on lookup
+		s.options[code] = OptionDef{
+			Code: code,
+		}
+	}
+
+	return s
+}
+
 // AddMediaTypes adds media types.
 func (s *Schema) AddMediaTypes(mediaTypes ...MediaType) *Schema {
 	for _, mediaType := range mediaTypes {
@@ -79,22 +169,110 @@ func (s *Schema) AddMediaTypes(mediaTypes ...MediaType) *Schema {
 //
 // If the option is not recognized, it returns an UnrecognizedOptionDef with given code.
 func (s *Schema) Option(code uint16, maxLen uint16) OptionDef {
-	option, ok := s.options[code]
-	if !ok {
-		return UnrecognizedOptionDef(code, maxLen)
+	for layer := s; layer != nil; layer = layer.base {
+		option, ok := layer.options[code]
+		if !ok {
+			continue
+		}
+
+		if !option.Recognized() {
+			break
+		}
+
+		return option
 	}
 
-	return option
+	return UnrecognizedOptionDef(code, maxLen)
 }
 
 // MediaType retrieves a media type by code.
 //
 // If the media type is not recognized, it returns an UnrecognizedMediaType with given code.
 func (s *Schema) MediaType(code uint16) MediaType {
-	mediaType, ok := s.mediaTypes[code]
-	if !ok {
-		return UnrecognizedMediaType(code)
+	for layer := s; layer != nil; layer = layer.base {
+		mediaType, ok := layer.mediaTypes[code]
+		if ok {
+			return mediaType
+		}
+	}
+
+	return UnrecognizedMediaType(code)
+}
+
+// Lookup retrieves a recognized option by name, overlays taking precedence over their base.
+//
+// If several options share the name, the one with the lowest code is returned.
+func (s *Schema) Lookup(name string) (OptionDef, bool) {
+	options, _ := s.flatten()
+	for _, code := range slices.Sorted(maps.Keys(options)) {
+		if options[code].Name == name {
+			return options[code], true
+		}
+	}
+
+	return OptionDef{}, false
+}
+
+// Describe returns a description of options and media types with overlays applied, both sorted by code,
+// for tooling presenting the definitions to humans. The description is also the JSON encoding of the schema.
+func (s *Schema) Describe() SchemaDescription {
+	options, mediaTypes := s.flatten()
+	description := SchemaDescription{
+		Options:    make([]OptionDescription, 0, len(options)),
+		MediaTypes: make([]MediaTypeDescription, 0, len(mediaTypes)),
+	}
+
+	for _, code := range slices.Sorted(maps.Keys(options)) {
+		def := options[code]
+		critical, unsafe, noCacheKey := def.Properties()
+
+		display := def.ValueFormat.String()
+		if def.ValueFormat != ValueFormatEmpty {
+			display = fmt.Sprintf("%s[%d..%d]", display, def.MinLen, def.MaxLen)
+		}
+
+		description.Options = append(description.Options, OptionDescription{
+			Name:       def.Name,
+			Code:       def.Code,
+			Format:     def.ValueFormat,
+			Repeatable: def.Repeatable,
+			MinLen:     def.MinLen,
+			MaxLen:     def.MaxLen,
+			Critical:   critical,
+			Unsafe:     unsafe,
+			NoCacheKey: noCacheKey,
+			Display:    display,
+		})
 	}
 
-	return mediaType
+	for _, code := range slices.Sorted(maps.Keys(mediaTypes)) {
+		description.MediaTypes = append(description.MediaTypes, MediaTypeDescription{
+			Name: mediaTypes[code].Name,
+			Code: code,
+		})
+	}
+
+	return description
+}
+
+// flatten returns definitions of all layers with overlays applied and masked options removed.
+func (s *Schema) flatten() (map[uint16]OptionDef, map[uint16]MediaType) {
+	options := map[uint16]OptionDef{}
+	mediaTypes := map[uint16]MediaType{}
+	if s.base != nil {
+		options, mediaTypes = s.base.flatten()
+	}
+
+	for code, option := range s.options {
+		if !option.Recognized() {
+			delete(options, code)
+			continue
+		}
+
+		options[code] = option
+	}
+
+	maps.Copy(mediaTypes, s.mediaTypes)
+
+	return options, mediaTypes
 }
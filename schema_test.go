@@ -0,0 +1,282 @@
+package coap
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+func TestSchemaOverlay(t *testing.T) {
+	vendor := OpaqueOption(65000, "Vendor", 0, 8)
+	tenantPort := UintOption(7, "TenantPort", 4)
+	tenantType := MediaType{Code: 65000, Name: "application/vnd.tenant"}
+
+	base := NewSchema().
+		AddOptions(URIHost, URIPort, ETag).
+		AddMediaTypes(MediaTypeTextPlain)
+
+	overlay := base.WithOverlay().
+		AddOptions(vendor, tenantPort).
+		MarkUnrecognized(ETag.Code).
+		AddMediaTypes(tenantType)
+
+	nested := overlay.WithOverlay().
+		AddOptions(ETag)
+
+	tests := []struct {
+		name   string
+		schema *Schema
+		code   uint16
+		want   OptionDef
+	}{
+		{
+			name:   "base",
+			schema: overlay,
+			code:   URIHost.Code,
+			want:   URIHost,
+		},
+		{
+			name:   "added",
+			schema: overlay,
+			code:   vendor.Code,
+			want:   vendor,
+		},
+		{
+			name:   "overridden",
+			schema: overlay,
+			code:   URIPort.Code,
+			want:   tenantPort,
+		},
+		{
+			name:   "masked",
+			schema: overlay,
+			code:   ETag.Code,
+			want:   UnrecognizedOptionDef(ETag.Code, 42),
+		},
+		{
+			name:   "unmasked by nested overlay",
+			schema: nested,
+			code:   ETag.Code,
+			want:   ETag,
+		},
+		{
+			name:   "nested overlay falls through",
+			schema: nested,
+			code:   vendor.Code,
+			want:   vendor,
+		},
+		{
+			name:   "base is not mutated",
+			schema: base,
+			code:   URIPort.Code,
+			want:   URIPort,
+		},
+		{
+			name:   "base is not masked",
+			schema: base,
+			code:   ETag.Code,
+			want:   ETag,
+		},
+		{
+			name:   "unrecognized",
+			schema: nested,
+			code:   65002,
+			want:   UnrecognizedOptionDef(65002, 42),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := cmp.Diff(test.want, test.schema.Option(test.code, 42))
+			if diff != "" {
+				t.Errorf("option mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if got := nested.MediaType(tenantType.Code); got != tenantType {
+		t.Errorf("MediaType() = %v, want %v", got, tenantType)
+	}
+
+	if got := nested.MediaType(MediaTypeTextPlain.Code); got != MediaTypeTextPlain {
+		t.Errorf("MediaType() = %v, want %v", got, MediaTypeTextPlain)
+	}
+
+	if got := base.MediaType(tenantType.Code); got.Recognized() {
+		t.Errorf("base MediaType() = %v, want unrecognized", got)
+	}
+}
+
+func TestSchemaOverlayDecode(t *testing.T) {
+	overlay := DefaultSchema.WithOverlay().MarkUnrecognized(Size1.Code)
+
+	size1 := uint32(1024)
+	data, err := (&Request{
+		Type:   Confirmable,
+		Method: PUT,
+		Size1:  &size1,
+	}).MarshalBinary()
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+
+	req := &Request{}
+	_, err = req.Decode(data, MarshalOptions{Schema: overlay})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	if req.Size1 != nil {
+		t.Errorf("Size1 = %d, want masked Size1 to be unrecognized", *req.Size1)
+	}
+
+	if req.Options.Contains(Size1) {
+		t.Errorf("expected masked elective Size1 to be dropped, got %v", req.Options)
+	}
+}
+
+func TestSchemaOverlayConcurrent(t *testing.T) {
+	base := NewSchema().AddOptions(URIHost, URIPort)
+
+	wg := sync.WaitGroup{}
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			code := 65000 + uint16(i)*2
+			overlay := base.WithOverlay().
+				AddOptions(OpaqueOption(code, "Tenant", 0, 8)).
+				MarkUnrecognized(URIPort.Code)
+
+			for range 100 {
+				if !overlay.Option(code, MaxOptionLength).Recognized() {
+					t.Error("expected tenant option to be recognized")
+				}
+
+				if !overlay.Option(URIHost.Code, MaxOptionLength).Recognized() {
+					t.Error("expected base option to be recognized")
+				}
+
+				if overlay.Option(URIPort.Code, MaxOptionLength).Recognized() {
+					t.Error("expected masked option to be unrecognized")
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// BenchmarkSchemaOption compares lookups in a root schema and in an overlay falling through to its base,
+// which costs one extra map probe.
+func BenchmarkSchemaOption(b *testing.B) {
+	overlay := DefaultSchema.WithOverlay().AddOptions(OpaqueOption(65000, "Vendor", 0, 8))
+
+	b.Run("root", func(b *testing.B) {
+		for b.Loop() {
+			_ = DefaultSchema.Option(URIPath.Code, MaxOptionLength)
+		}
+	})
+
+	b.Run("overlay", func(b *testing.B) {
+		for b.Loop() {
+			_ = overlay.Option(URIPath.Code, MaxOptionLength)
+		}
+	})
+}
+
+// TestDefaultSchemaDescribe compares the description of DefaultSchema against the golden file, run with -update
+// to accept changes of the registry.
+func TestDefaultSchemaDescribe(t *testing.T) {
+	path := filepath.Join("testdata", "default_schema.json")
+
+	data, err := json.MarshalIndent(DefaultSchema.Describe(), "", "  ")
+	if err != nil {
+		t.Fatal("marshal:", err)
+	}
+	data = append(data, '\n')
+
+	if *updateGolden {
+		err = os.WriteFile(path, data, 0o644)
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+	}
+
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	diff := cmp.Diff(string(golden), string(data))
+	if diff != "" {
+		t.Errorf("description mismatch (-golden +got), run with -update to accept:\n%s", diff)
+	}
+}
+
+func TestSchemaDescribeOverlay(t *testing.T) {
+	vendor := OpaqueOption(65020, "Vendor", 1, 8)
+	schema := NewSchema().
+		AddOptions(URIHost, IfNoneMatch).
+		AddMediaTypes(MediaTypeApplicationJSON).
+		WithOverlay().
+		AddOptions(vendor).
+		MarkUnrecognized(URIHost.Code)
+
+	expect := SchemaDescription{
+		Options: []OptionDescription{
+			{Name: "IfNoneMatch", Code: 5, Format: ValueFormatEmpty, Critical: true, Display: "empty"},
+			{Name: "Vendor", Code: 65020, Format: ValueFormatOpaque, MinLen: 1, MaxLen: 8, NoCacheKey: true, Display: "opaque[1..8]"},
+		},
+		MediaTypes: []MediaTypeDescription{
+			{Name: "application/json", Code: 50},
+		},
+	}
+
+	diff := cmp.Diff(expect, schema.Describe())
+	if diff != "" {
+		t.Errorf("description mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSchemaLookup(t *testing.T) {
+	vendor := StringOption(65000, "URIPath", 0, 255)
+	schema := DefaultSchema.WithOverlay().
+		AddOptions(vendor).
+		MarkUnrecognized(URIHost.Code)
+
+	tests := []struct {
+		name   string
+		lookup string
+		def    OptionDef
+		ok     bool
+	}{
+		{"defined", "URIPort", URIPort, true},
+		{"lowest code of shared name", "URIPath", URIPath, true},
+		{"masked", "URIHost", OptionDef{}, false},
+		{"case sensitive", "uripath", OptionDef{}, false},
+		{"unknown", "Nope", OptionDef{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			def, ok := schema.Lookup(test.lookup)
+			if ok != test.ok {
+				t.Errorf("ok = %v, want %v", ok, test.ok)
+			}
+
+			diff := cmp.Diff(test.def, def)
+			if diff != "" {
+				t.Errorf("definition mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
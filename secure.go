@@ -0,0 +1,36 @@
+package coap
+
+import (
+	"net"
+)
+
+// packetConn adapts a connection to a single peer to net.PacketConn.
+type packetConn struct {
+	net.Conn
+}
+
+// NewPacketConn adapts a connection to a single peer, such as a DTLS connection, to net.PacketConn
+// so that it can be used with NewConn for coaps.
+//
+// The connection must provide datagram semantics: each Write sends exactly one message and each Read
+// returns exactly one message, as DTLS records do. Stream connections such as TLS are not supported.
+//
+// Reads report the remote address of the connection, writes ignore the destination address.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-9
+func NewPacketConn(conn net.Conn) net.PacketConn {
+	return packetConn{
+		Conn: conn,
+	}
+}
+
+// ReadFrom implements net.PacketConn.
+func (c packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo implements net.PacketConn.
+func (c packetConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
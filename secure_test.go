@@ -0,0 +1,48 @@
+package coap
+
+import (
+	"fmt"
+	"net"
+)
+
+func ExampleNewPacketConn() {
+	// conn is usually returned by a DTLS stack, for example github.com/pion/dtls:
+	//
+	//	conn, err := dtls.Dial("udp", addr, config)
+	//
+	// net.Pipe stands in for a connection with datagram semantics here.
+	conn, peer := net.Pipe()
+
+	opts := ConnOptions{
+		MarshalOptions: MarshalOptions{
+			MaxMessageLength: MaxMessageLength,
+		},
+	}
+
+	client := NewConn(NewPacketConn(conn), opts)
+	defer client.Close()
+	server := NewConn(NewPacketConn(peer), opts)
+	defer server.Close()
+
+	req, _ := ParseURL("coaps://example.com/hello")
+	req.Type = NonConfirmable
+	req.Method = GET
+	data, _ := req.AppendBinary(nil)
+
+	msg := &Message{}
+	_, _ = msg.Decode(data, MarshalOptions{})
+
+	go func() {
+		_ = client.Write(msg, nil)
+	}()
+
+	received := &Message{}
+	_, _ = server.Read(received)
+
+	host, _ := received.Options.GetString(URIHost)
+	port, _ := received.Options.GetUint(URIPort)
+	path, _ := received.Options.GetAllString(URIPath)
+
+	fmt.Println(host, port, DecodePath(path))
+	// Output: example.com 5684 /hello
+}
@@ -0,0 +1,588 @@
+package coap
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// PiggybackDeadline is the default time a handler has to respond for the response to be piggybacked
+// on the acknowledgement of a Confirmable request, well under ACKTimeout of the peer.
+const PiggybackDeadline = 1500 * time.Millisecond
+
+// ExchangeLifetime is the default time duplicates of a Confirmable request are answered from its exchange,
+// EXCHANGE_LIFETIME with default transmission parameters.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-4.8.2
+const ExchangeLifetime = 247 * time.Second
+
+// ServerOptions holds options for serving requests.
+type ServerOptions struct {
+	// PiggybackDeadline is the time a handler has to respond for the response to be piggybacked
+	// on the acknowledgement, defaults to PiggybackDeadline.
+	PiggybackDeadline time.Duration
+
+	// MaxHandlers is the maximum number of handlers running at once, requests wait for a free
+	// handler in a queue. Zero disables the limit.
+	MaxHandlers uint
+
+	// MaxQueueLatency is the maximum time a request may wait for a free handler, requests waiting
+	// longer are answered with ServiceUnavailable instead. Zero disables shedding.
+	MaxQueueLatency time.Duration
+
+	// PathMTU is the maximum size of an encoded response, larger responses are trimmed with FitResponse
+	// according to TrimPolicy. Zero disables trimming.
+	PathMTU int
+
+	// TrimPolicy selects the elements removed from responses exceeding PathMTU.
+	TrimPolicy TrimPolicy
+
+	// ProblemDetails enables Concise Problem Details in error responses generated by the server, such as
+	// for requests failing to decode, and by ServeMux, sent to requests with Accept of
+	// MediaTypeApplicationConciseProblemDetails.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc9290
+	ProblemDetails bool
+
+	// Metrics collects metrics of handled exchanges, attributed to ServeMux patterns. Nil disables metrics.
+	Metrics MetricsSink
+
+	// ExchangeLifetime is the time duplicates of a Confirmable request are answered from its exchange
+	// instead of being handled again, defaults to ExchangeLifetime.
+	ExchangeLifetime time.Duration
+
+	// MaxRecentExchanges is the number of exchanges remembered for deduplication, the oldest is forgotten
+	// when full. Defaults to MaxExchanges.
+	MaxRecentExchanges uint
+}
+
+// Server dispatches requests read from a Conn to a Handler.
+type Server struct {
+	conn    *Conn
+	handler Handler
+	opts    ServerOptions
+
+	// handlers limits running handlers if MaxHandlers is set
+	handlers chan struct{}
+
+	// recent holds exchanges of Confirmable requests for deduplication, keyed by recentToken
+	recent *ExchangeStore[*exchange]
+
+	// bodies holds the rest of response bodies continuing in further blocks, keyed by bodyToken
+	bodies *ExchangeStore[*blockBody]
+}
+
+type (
+	receivedAtKey struct{}
+	remoteAddrKey struct{}
+	localAddrKey  struct{}
+	connKey       struct{}
+
+	// problemDetailsKey is set if ServerOptions.ProblemDetails is enabled
+	problemDetailsKey struct{}
+)
+
+// exchange is the ResponseWriter of a single request.
+//
+// Responses to Confirmable requests are piggybacked on the acknowledgement if the handler responds
+// before PiggybackDeadline, otherwise an empty acknowledgement is sent and the response follows
+// as a separate Confirmable message.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.2
+type exchange struct {
+	conn *Conn
+	req  Header
+	addr net.Addr
+	opts ServerOptions
+
+	mtx       sync.Mutex
+	acked     bool
+	responded bool
+
+	// block2 is the block requested by Block2 of the request, nil if none
+	block2 *BlockValue
+
+	// reqOptions and bodies continue bodies which cannot seek from the previous block
+	reqOptions Options
+	bodies     *ExchangeStore[*blockBody]
+
+	// metrics of the exchange, code and respBytes are guarded by mtx
+	route     string
+	method    Method
+	received  time.Time
+	reqBytes  int
+	code      ResponseCode
+	respBytes int
+
+	// reply is the response message with inline storage for the options of typical responses,
+	// so that piggybacked responses do not allocate a Message and Options of their own
+	reply   Message
+	options [2]Option
+
+	// done is closed when the response is written or the handler returns
+	doneOnce sync.Once
+	done     chan struct{}
+}
+
+// NewServer instantiates a new Server reading requests from the connection.
+func NewServer(conn *Conn, handler Handler, opts ServerOptions) *Server {
+	if opts.PiggybackDeadline == 0 {
+		opts.PiggybackDeadline = PiggybackDeadline
+	}
+
+	if opts.ExchangeLifetime == 0 {
+		opts.ExchangeLifetime = ExchangeLifetime
+	}
+
+	if opts.MaxRecentExchanges == 0 {
+		opts.MaxRecentExchanges = MaxExchanges
+	}
+
+	s := &Server{
+		conn:    conn,
+		handler: handler,
+		opts:    opts,
+		recent: NewExchangeStore(ExchangeStoreOptions[*exchange]{
+			MaxEntries: opts.MaxRecentExchanges,
+			Clock:      conn.opts.Clock,
+		}),
+		bodies: NewExchangeStore(ExchangeStoreOptions[*blockBody]{
+			MaxEntries: opts.MaxRecentExchanges,
+			Clock:      conn.opts.Clock,
+		}),
+	}
+
+	if opts.MaxHandlers != 0 {
+		s.handlers = make(chan struct{}, opts.MaxHandlers)
+	}
+
+	return s
+}
+
+// ReceivedAt returns the time the request being handled was read from the connection.
+//
+// Handlers can use it to detect requests that waited in the queue for too long.
+func ReceivedAt(ctx context.Context) (time.Time, bool) {
+	received, ok := ctx.Value(receivedAtKey{}).(time.Time)
+	return received, ok
+}
+
+// RemoteAddr returns the address of the peer that sent the request being handled.
+func RemoteAddr(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(remoteAddrKey{}).(net.Addr)
+	return addr, ok
+}
+
+// Peer returns the PeerID of the peer that sent the request being handled, as used by PeerTable.
+func Peer(ctx context.Context) (PeerID, bool) {
+	addr, ok := RemoteAddr(ctx)
+	if !ok {
+		return "", false
+	}
+
+	return PeerID(addr.String()), true
+}
+
+// Transport returns the network of the connection the request being handled arrived on, such as "udp".
+func Transport(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(localAddrKey{}).(net.Addr)
+	if !ok {
+		return "", false
+	}
+
+	return addr.Network(), true
+}
+
+// IsMulticast reports whether the request being handled arrived on a connection bound to a multicast group.
+//
+// The destination address of a single datagram is not available through net.PacketConn,
+// so requests are classified by the local address of the connection.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-8
+func IsMulticast(ctx context.Context) bool {
+	addr, ok := ctx.Value(localAddrKey{}).(net.Addr)
+	if !ok {
+		return false
+	}
+
+	udp, ok := addr.(*net.UDPAddr)
+	return ok && udp.IP.IsMulticast()
+}
+
+// Serve reads requests from the connection and dispatches each to the handler in its own goroutine.
+//
+// If MaxHandlers is set, requests wait in a queue for a free handler and requests waiting longer
+// than MaxQueueLatency are answered with ServiceUnavailable.
+//
+// Messages that cannot be decoded are skipped as by Conn.ReadLoop, requests with invalid semantics
+// are answered with the response code of the error. Non-confirmable requests with a critical option
+// not defined by the schema are rejected with a Reset as by RFC 7252 section 5.4.1.
+//
+// Duplicates of a Confirmable request received within ExchangeLifetime are not handled again,
+// they are answered with the acknowledgement already sent.
+//
+// Handler contexts are derived from ctx and canceled when Serve returns.
+//
+// Returns the context error if the context is done, otherwise the error of reading from the connection,
+// such as net.ErrClosed.
+func (s *Server) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ctx = context.WithValue(ctx, localAddrKey{}, s.conn.LocalAddr())
+	ctx = context.WithValue(ctx, connKey{}, s.conn)
+	if s.opts.ProblemDetails {
+		ctx = context.WithValue(ctx, problemDetailsKey{}, true)
+	}
+
+	return s.conn.ReadLoop(ctx, func(msg *Message, addr net.Addr) {
+		if !msg.Code.IsRequest() {
+			return
+		}
+
+		s.dispatch(ctx, msg, addr)
+	})
+}
+
+// dispatch starts the piggyback deadline and runs the handler once a handler slot is free.
+func (s *Server) dispatch(ctx context.Context, msg *Message, addr net.Addr) {
+	e := &exchange{
+		conn: s.conn,
+		req:  msg.Header,
+		addr: addr,
+		opts: s.opts,
+		done: make(chan struct{}),
+	}
+
+	received := s.conn.opts.Clock.Now()
+	if msg.Type == Confirmable {
+		// duplicates are read by the same loop, so none can be stored between Get and Put
+		token := recentToken(addr, msg.ID)
+		prev, ok := s.recent.Get(token)
+		if ok {
+			prev.replay()
+			return
+		}
+
+		s.recent.Put(token, e, received.Add(s.opts.ExchangeLifetime))
+	}
+
+	if s.opts.Metrics != nil {
+		e.method = Method(msg.Code)
+		e.received = received
+		e.reqBytes = msg.Size()
+		ctx = context.WithValue(ctx, exchangeKey{}, e)
+	}
+
+	req := &Request{}
+	err := req.fromMessage(msg, s.conn.opts.MarshalOptions)
+	if err != nil {
+		e.route = RejectedRoute
+		if msg.Type == NonConfirmable && isError[UnrecognizedOption](err) {
+			// https://datatracker.ietf.org/doc/html/rfc7252#section-5.4.1
+			_ = s.conn.Reset(msg.ID, addr)
+			e.observe()
+			return
+		}
+
+		_ = e.Write(problemResponse(ctx, &Response{Code: ResponseCodeForError(err)}, msg.Options, err.Error()))
+		e.observe()
+		return
+	}
+
+	e.block2 = req.Block2
+	e.reqOptions = req.Options
+	e.bodies = s.bodies
+
+	// counted once decoded, released by finish whether or not the handler responds
+	s.conn.peers.Start(PeerID(addr.String()))
+
+	if msg.Type == Confirmable {
+		// timer is started before the handler, so deadline is measured from dispatch
+		timer := s.conn.opts.Clock.NewTimer(s.opts.PiggybackDeadline)
+		go e.deferAck(timer)
+	}
+
+	ctx = context.WithValue(ctx, receivedAtKey{}, received)
+	ctx = context.WithValue(ctx, remoteAddrKey{}, addr)
+
+	go func() {
+		defer e.finish()
+
+		if s.handlers != nil {
+			s.handlers <- struct{}{}
+			defer func() {
+				<-s.handlers
+			}()
+		}
+
+		if s.opts.MaxQueueLatency != 0 && s.conn.opts.Clock.Now().Sub(received) > s.opts.MaxQueueLatency {
+			// https://datatracker.ietf.org/doc/html/rfc7252#section-5.9.3.4
+			e.route = RejectedRoute
+			_ = e.Write(problemResponse(ctx, &Response{Code: ServiceUnavailable}, req.Options, ""))
+			return
+		}
+
+		s.handler.ServeCOAP(ctx, e, req)
+	}()
+}
+
+// problemResponse returns the error response generated for the request with the options, or a response
+// with its code carrying problem details with the detail if ServerOptions.ProblemDetails is enabled
+// and the request accepts them.
+func problemResponse(ctx context.Context, resp *Response, options Options, detail string) *Response {
+	enabled, _ := ctx.Value(problemDetailsKey{}).(bool)
+	accept, err := options.GetUint(Accept)
+	if !enabled || err != nil || accept != uint32(MediaTypeApplicationConciseProblemDetails.Code) {
+		return resp
+	}
+
+	title, _ := resp.Code.name()
+	pd := ProblemDetails{
+		Title:        title,
+		Detail:       detail,
+		ResponseCode: resp.Code,
+	}
+
+	return ProblemResponse(resp.Code, pd)
+}
+
+// Write implements ResponseWriter.
+//
+// Type, MessageID and Token of the response are set by the exchange. If the response has Body,
+// a copy of the response carries the block requested by the request as Payload. If PathMTU is set,
+// a copy of the response is trimmed to fit.
+//
+// Returns ResponseAlreadyWritten if the response was already written.
+//
+// Returns CannotFit if the response exceeds PathMTU after trimming.
+//
+// Returns the error of reading Body.
+func (e *exchange) Write(resp *Response) error {
+	if resp.Body != nil {
+		var err error
+		resp, err = e.block(resp)
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.opts.PathMTU != 0 {
+		fitted := *resp
+		fitted.Token = e.req.Token
+
+		_, err := FitResponse(&fitted, e.opts.PathMTU, e.opts.TrimPolicy)
+		if err != nil {
+			return err
+		}
+
+		resp = &fitted
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.responded {
+		return ResponseAlreadyWritten{}
+	}
+
+	msg := &e.reply
+	msg.Options = e.options[:0]
+	err := resp.build(msg)
+	if err != nil {
+		return err
+	}
+
+	msg.Token = e.req.Token
+	switch {
+	case e.req.Type == NonConfirmable:
+		msg.Type = NonConfirmable
+		msg.ID = 0
+	case !e.acked:
+		msg.Type = Acknowledgement
+		msg.ID = e.req.ID
+	default:
+		msg.Type = Confirmable
+		msg.ID = 0
+	}
+
+	err = e.conn.Write(msg, e.addr)
+	if err != nil {
+		return err
+	}
+
+	e.code = resp.Code
+	if e.opts.Metrics != nil {
+		e.respBytes = msg.Size()
+	}
+
+	e.responded = true
+	e.close()
+
+	return nil
+}
+
+// block returns a copy of the response carrying the block of Body requested by Block2 of the request,
+// or the first block of MaxBlockSZX. Block2 is omitted if the body fits in the first block and none was requested.
+//
+// Unless set by the handler, Size2 of the first of several blocks, or of any response if the request asks
+// for it, declares the size of a Body which can seek.
+//
+// The rest of a Body which cannot seek is kept for ExchangeLifetime for the request of the next block,
+// which reads it instead of its own Body.
+//
+// https://datatracker.ietf.org/doc/html/rfc7959#section-2.4
+func (e *exchange) block(resp *Response) (*Response, error) {
+	block := BlockValue{
+		SZX: MaxBlockSZX,
+	}
+	if e.block2 != nil {
+		block = *e.block2
+	}
+
+	body, read := resp.Body, uint32(0)
+	seeker, seekable := body.(io.Seeker)
+
+	var size *uint32
+	if seekable {
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+
+		total := uint32(end)
+		size = &total
+	}
+
+	var token Token
+	if !seekable {
+		token = e.bodyToken()
+		kept, ok := e.bodies.Delete(token)
+		if ok && kept.offset == block.Offset() {
+			body, read = kept.rest, kept.offset
+		}
+	}
+
+	payload, rest, err := readBlock(body, read, block)
+	if err != nil {
+		return nil, err
+	}
+
+	if !seekable && rest != nil {
+		e.bodies.Put(token, &blockBody{
+			rest:   rest,
+			offset: block.Offset() + uint32(len(payload)),
+		}, e.conn.opts.Clock.Now().Add(e.opts.ExchangeLifetime))
+	}
+
+	blockwise := *resp
+	blockwise.Body = nil
+	blockwise.Payload = payload
+
+	// https://datatracker.ietf.org/doc/html/rfc7959#section-4
+	if blockwise.Size2 == nil && (block.Num == 0 && rest != nil || e.requestsSize2()) {
+		blockwise.Size2 = size
+	}
+
+	if e.block2 == nil && rest == nil {
+		return &blockwise, nil
+	}
+
+	block.More = rest != nil
+	blockwise.Block2 = &block
+
+	return &blockwise, nil
+}
+
+// requestsSize2 reports whether the request asks for the size of the response body with Size2 of 0.
+func (e *exchange) requestsSize2() bool {
+	size, err := e.reqOptions.GetUint(Size2)
+	return err == nil && size == 0
+}
+
+// recentToken returns the token of a Confirmable request in the store of recent exchanges,
+// the peer followed by the MessageID.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-4.5
+func recentToken(addr net.Addr, id MessageID) Token {
+	token := Token(addr.String())
+	return binary.BigEndian.AppendUint16(token, uint16(id))
+}
+
+// bodyToken returns the token of the body requested by the request in the store of bodies, the peer
+// prefixed with its length followed by the method and the options forming the cache key except Block2.
+func (e *exchange) bodyToken() Token {
+	peer := e.addr.String()
+	token := binary.AppendUvarint(nil, uint64(len(peer)))
+	token = append(token, peer...)
+	token = append(token, byte(e.req.Code))
+
+	return e.reqOptions.EncodeSubset(token, func(def OptionDef) bool {
+		return !def.NoCacheKey() && def.Code != Block2.Code
+	})
+}
+
+// deferAck sends an empty acknowledgement if the handler does not respond before the timer fires.
+func (e *exchange) deferAck(timer Timer) {
+	defer timer.Stop()
+
+	select {
+	case <-e.done:
+		return
+	case <-timer.C():
+	}
+
+	e.ack()
+}
+
+// finish acknowledges Confirmable request if the handler returned without responding
+// and releases the request from the in-flight budget of the peer.
+func (e *exchange) finish() {
+	if e.req.Type == Confirmable {
+		e.ack()
+	}
+
+	e.close()
+	e.conn.peers.Done(PeerID(e.addr.String()))
+	e.observe()
+}
+
+func (e *exchange) close() {
+	e.doneOnce.Do(func() {
+		close(e.done)
+	})
+}
+
+// replay answers a duplicate of the request with the acknowledgement already sent, the empty one or
+// the piggybacked response. Duplicates received before either was sent are ignored.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-4.5
+func (e *exchange) replay() {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	switch {
+	case e.acked:
+		ack := Message{Header: e.req}
+		_ = e.conn.Write(ack.Reply(0, nil), e.addr)
+	case e.responded:
+		_ = e.conn.Write(&e.reply, e.addr)
+	}
+}
+
+// ack sends an empty acknowledgement unless the request was already acknowledged or responded to.
+func (e *exchange) ack() {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.acked || e.responded {
+		return
+	}
+
+	e.acked = true
+	ack := Message{Header: e.req}
+	_ = e.conn.Write(ack.Reply(0, nil), e.addr)
+}
@@ -0,0 +1,907 @@
+package coap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// serverTest serves handler over a pipe, the client side is read directly from the pipe endpoint.
+type serverTest struct {
+	t      *testing.T
+	clock  *fakeClock
+	client *pipeConn
+	server *Conn
+}
+
+func newServerTest(t *testing.T, opts ConnOptions, serverOpts ServerOptions, handler Handler) *serverTest {
+	t.Helper()
+
+	a, b := newPipe()
+	clock := newFakeClock(time.Unix(0, 0))
+	opts.Clock = clock
+
+	server := NewConn(b, opts)
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = a.Close()
+	})
+
+	go func() {
+		_ = NewServer(server, handler, serverOpts).Serve(context.Background())
+	}()
+
+	return &serverTest{
+		t:      t,
+		clock:  clock,
+		client: a,
+		server: server,
+	}
+}
+
+func (s *serverTest) send(msg *Message) {
+	s.t.Helper()
+
+	data, err := msg.AppendBinary(nil)
+	if err != nil {
+		s.t.Fatal("encode:", err)
+	}
+
+	_, err = s.client.WriteTo(data, s.server.LocalAddr())
+	if err != nil {
+		s.t.Fatal("write:", err)
+	}
+}
+
+// receive returns the next message received by the client, or nil if none arrives in time.
+func (s *serverTest) receive() *Message {
+	s.t.Helper()
+
+	err := s.client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		s.t.Fatal("set deadline:", err)
+	}
+
+	buf := make([]byte, MaxMessageLength)
+	n, _, err := s.client.ReadFrom(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		s.t.Fatal("read:", err)
+	}
+
+	msg := &Message{}
+	_, err = msg.Decode(buf[:n], MarshalOptions{})
+	if err != nil {
+		s.t.Fatal("decode:", err)
+	}
+
+	return msg
+}
+
+func testRequest() *Message {
+	return &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(GET),
+			ID:      0x4242,
+			Token:   bytes4,
+		},
+	}
+}
+
+func TestServerPiggyback(t *testing.T) {
+	s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code:    Content,
+			Payload: bytes4,
+		})
+	}))
+
+	s.send(testRequest())
+
+	resp := s.receive()
+	if resp == nil {
+		t.Fatal("no response")
+	}
+
+	if resp.Type != Acknowledgement || resp.Code != Code(Content) || resp.ID != 0x4242 || string(resp.Token) != string(bytes4) {
+		t.Errorf("response = %v %v %#x %x, want piggybacked Content", resp.Type, resp.Code, resp.ID, resp.Token)
+	}
+
+	if extra := s.receive(); extra != nil {
+		t.Errorf("unexpected message %v %v", extra.Type, extra.Code)
+	}
+}
+
+func TestServerSeparateResponse(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+		close(started)
+		<-release
+		_ = w.Write(&Response{
+			Code: Content,
+		})
+	}))
+
+	s.send(testRequest())
+	<-started
+
+	s.clock.Advance(PiggybackDeadline)
+
+	ack := s.receive()
+	if ack == nil {
+		t.Fatal("no acknowledgement")
+	}
+
+	if ack.Type != Acknowledgement || !ack.Code.IsEmpty() || ack.ID != 0x4242 || len(ack.Token) != 0 {
+		t.Errorf("ack = %v %v %#x %x, want empty acknowledgement", ack.Type, ack.Code, ack.ID, ack.Token)
+	}
+
+	close(release)
+
+	resp := s.receive()
+	if resp == nil {
+		t.Fatal("no separate response")
+	}
+
+	if resp.Type != Confirmable || resp.Code != Code(Content) || resp.ID == 0x4242 || string(resp.Token) != string(bytes4) {
+		t.Errorf("response = %v %v %#x %x, want separate Content", resp.Type, resp.Code, resp.ID, resp.Token)
+	}
+}
+
+func TestServerDeferralRace(t *testing.T) {
+	for range 10 {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+			close(started)
+			<-release
+			_ = w.Write(&Response{
+				Code: Content,
+			})
+		}))
+
+		s.send(testRequest())
+		<-started
+
+		// handler completes as the deferral fires
+		go close(release)
+		s.clock.Advance(PiggybackDeadline)
+
+		first := s.receive()
+		if first == nil {
+			t.Fatal("no response")
+		}
+
+		responses := 0
+		for msg := first; msg != nil; msg = s.receive() {
+			if msg.Code == Code(Content) {
+				responses++
+			}
+		}
+
+		if responses != 1 {
+			t.Fatalf("responses = %d, want 1", responses)
+		}
+	}
+}
+
+func TestServerHandlerNeverCompletes(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(_ context.Context, _ ResponseWriter, _ *Request) {
+		close(started)
+		<-release
+	}))
+
+	s.send(testRequest())
+	<-started
+
+	if msg := s.receive(); msg != nil {
+		t.Fatalf("unexpected message before deadline %v %v", msg.Type, msg.Code)
+	}
+
+	s.clock.Advance(PiggybackDeadline)
+
+	ack := s.receive()
+	if ack == nil || ack.Type != Acknowledgement || !ack.Code.IsEmpty() {
+		t.Fatal("expected empty acknowledgement")
+	}
+
+	if msg := s.receive(); msg != nil {
+		t.Errorf("unexpected message %v %v", msg.Type, msg.Code)
+	}
+}
+
+func TestServerInvalidRequest(t *testing.T) {
+	opts := testConnOptions()
+	opts.StrictSemantics = true
+	s := newServerTest(t, opts, ServerOptions{}, HandlerFunc(func(_ context.Context, _ ResponseWriter, _ *Request) {
+		t.Error("handler called")
+	}))
+
+	req := testRequest()
+	req.Options = Options{
+		MustOptionValue(Observe, uint32(42)),
+	}
+
+	s.send(req)
+
+	resp := s.receive()
+	if resp == nil || resp.Type != Acknowledgement || resp.Code != Code(BadRequest) {
+		t.Fatal("expected piggybacked Bad Request")
+	}
+}
+
+func TestServerUnrecognizedOption(t *testing.T) {
+	tests := []struct {
+		name     string
+		msgType  Type
+		wantType Type
+		wantCode Code
+	}{
+		{
+			name:     "confirmable",
+			msgType:  Confirmable,
+			wantType: Acknowledgement,
+			wantCode: Code(BadOption),
+		},
+		{
+			name:     "non-confirmable",
+			msgType:  NonConfirmable,
+			wantType: Reset,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(_ context.Context, _ ResponseWriter, _ *Request) {
+				t.Error("handler called")
+			}))
+
+			req := testRequest()
+			req.Type = test.msgType
+			req.Options = Options{
+				{
+					OptionDef: UnrecognizedOptionDef(65001, MaxOptionLength),
+				},
+			}
+
+			s.send(req)
+
+			resp := s.receive()
+			if resp == nil {
+				t.Fatal("no response")
+			}
+
+			if resp.Type != test.wantType || resp.Code != test.wantCode || resp.ID != req.ID {
+				t.Errorf("response = %v %v %#x, want %v %v %#x", resp.Type, resp.Code, resp.ID, test.wantType, test.wantCode, req.ID)
+			}
+		})
+	}
+}
+
+func TestServerProblemDetails(t *testing.T) {
+	opts := testConnOptions()
+	opts.StrictSemantics = true
+	s := newServerTest(t, opts, ServerOptions{ProblemDetails: true}, HandlerFunc(func(_ context.Context, _ ResponseWriter, _ *Request) {
+		t.Error("handler called")
+	}))
+
+	tests := []struct {
+		name    string
+		accept  *MediaType
+		problem bool
+	}{
+		{"accepted", &MediaTypeApplicationConciseProblemDetails, true},
+		{"other accepted", &MediaTypeApplicationJSON, false},
+		{"no accept", nil, false},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := testRequest()
+			req.ID += MessageID(i)
+			req.Options = Options{
+				MustOptionValue(Observe, uint32(42)),
+			}
+			if test.accept != nil {
+				Must(req.Options.SetUint(Accept, uint32(test.accept.Code)))
+			}
+
+			s.send(req)
+
+			msg := s.receive()
+			if msg == nil {
+				t.Fatal("no response")
+			}
+
+			resp := &Response{}
+			err := resp.fromMessage(msg, MarshalOptions{})
+			if err != nil {
+				t.Fatal("response:", err)
+			}
+
+			if resp.Code != BadRequest {
+				t.Errorf("code = %s, want %s", resp.Code, BadRequest)
+			}
+
+			pd, ok, err := resp.Problem()
+			if err != nil || ok != test.problem {
+				t.Fatalf("Problem() = %v, %v, want %v", ok, err, test.problem)
+			}
+
+			if !ok {
+				return
+			}
+
+			expect := ProblemDetails{
+				Title:        "Bad Request",
+				Detail:       InvalidObserve{Value: 42}.Error(),
+				ResponseCode: BadRequest,
+			}
+
+			diff := cmp.Diff(expect, pd)
+			if diff != "" {
+				t.Errorf("problem details mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServerProblemDetailsServeMux(t *testing.T) {
+	mux := NewServeMux()
+	Must(mux.Handle("/json", HandlerFunc(func(_ context.Context, _ ResponseWriter, _ *Request) {
+		t.Error("handler called")
+	}), Produces(MediaTypeApplicationJSON)))
+
+	s := newServerTest(t, testConnOptions(), ServerOptions{ProblemDetails: true}, mux)
+
+	tests := []struct {
+		path   string
+		code   ResponseCode
+		detail string
+	}{
+		{"missing", NotFound, "no handler for /missing"},
+		{"json", NotAcceptable, "supported content-formats: 50"},
+	}
+
+	for i, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			req := testRequest()
+			req.ID += MessageID(i)
+			Must(req.Options.SetString(URIPath, test.path))
+			Must(req.Options.SetUint(Accept, uint32(MediaTypeApplicationConciseProblemDetails.Code)))
+
+			s.send(req)
+
+			msg := s.receive()
+			if msg == nil {
+				t.Fatal("no response")
+			}
+
+			resp := &Response{}
+			err := resp.fromMessage(msg, MarshalOptions{})
+			if err != nil {
+				t.Fatal("response:", err)
+			}
+
+			pd, ok, err := resp.Problem()
+			if err != nil || !ok {
+				t.Fatalf("Problem() = %v, %v, want problem details", ok, err)
+			}
+
+			title, _ := test.code.name()
+			expect := ProblemDetails{
+				Title:        title,
+				Detail:       test.detail,
+				ResponseCode: test.code,
+			}
+
+			diff := cmp.Diff(expect, pd)
+			if diff != "" {
+				t.Errorf("problem details mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExchangeWriteTwice(t *testing.T) {
+	errs := make(chan error, 1)
+	s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code: Content,
+		})
+		errs <- w.Write(&Response{
+			Code: Content,
+		})
+	}))
+
+	s.send(testRequest())
+	expectErr(t, <-errs, ResponseAlreadyWritten{})
+}
+
+func TestServerShedding(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	opts := ServerOptions{
+		MaxHandlers:     1,
+		MaxQueueLatency: time.Second,
+	}
+
+	s := newServerTest(t, testConnOptions(), opts, HandlerFunc(func(ctx context.Context, w ResponseWriter, _ *Request) {
+		received, ok := ReceivedAt(ctx)
+		if !ok || !received.Equal(time.Unix(0, 0)) {
+			t.Errorf("ReceivedAt() = %v, %v, want start of clock", received, ok)
+		}
+
+		started <- struct{}{}
+		<-release
+		_ = w.Write(&Response{
+			Code: Content,
+		})
+	}))
+
+	stalled := testRequest()
+	stalled.Type = NonConfirmable
+	s.send(stalled)
+	<-started
+
+	queued := testRequest()
+	queued.Type = NonConfirmable
+	queued.ID = 0x4343
+	queued.Token = bytes8
+	s.send(queued)
+
+	// let the server read the queued request before the clock moves
+	time.Sleep(20 * time.Millisecond)
+	s.clock.Advance(2 * time.Second)
+	close(release)
+
+	codes := map[string]Code{}
+	for msg := s.receive(); msg != nil; msg = s.receive() {
+		codes[string(msg.Token)] = msg.Code
+	}
+
+	want := map[string]Code{
+		string(bytes4): Code(Content),
+		string(bytes8): Code(ServiceUnavailable),
+	}
+
+	diff := cmp.Diff(want, codes)
+	if diff != "" {
+		t.Errorf("responses mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestServerDuplicateRequest(t *testing.T) {
+	handled := make(chan struct{}, 3)
+	release := make(chan struct{})
+	s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(_ context.Context, w ResponseWriter, r *Request) {
+		handled <- struct{}{}
+		if r.Path == "/slow" {
+			<-release
+		}
+
+		_ = w.Write(&Response{
+			Code:    Content,
+			Payload: bytes4,
+		})
+	}))
+	defer close(release)
+
+	// piggybacked response is replayed
+	s.send(testRequest())
+	first := s.receive()
+	s.send(testRequest())
+	second := s.receive()
+
+	if first == nil || second == nil {
+		t.Fatal("no response")
+	}
+
+	diff := cmp.Diff(first, second, EquateOptions())
+	if diff != "" {
+		t.Errorf("replayed response mismatch (-first +second):\n%s", diff)
+	}
+
+	// empty acknowledgement is replayed, the separate response is not sent twice
+	slow := testRequest()
+	slow.ID = 0x4343
+	slow.Options = Options{
+		MustOptionValue(URIPath, "slow"),
+	}
+	s.send(slow)
+	<-handled
+	<-handled
+
+	s.clock.Advance(PiggybackDeadline)
+	ack := s.receive()
+	s.send(slow)
+	replayed := s.receive()
+
+	for _, msg := range []*Message{ack, replayed} {
+		if msg == nil || msg.Type != Acknowledgement || !msg.Code.IsEmpty() || msg.ID != 0x4343 {
+			t.Fatal("expected empty acknowledgement")
+		}
+	}
+
+	// duplicates are handled again after ExchangeLifetime
+	s.clock.Advance(ExchangeLifetime)
+	s.send(testRequest())
+	if resp := s.receive(); resp == nil || resp.Code != Code(Content) {
+		t.Fatal("expected response after exchange lifetime")
+	}
+
+	if len(handled) != 1 {
+		t.Errorf("handled %d times after exchange lifetime, want 1", len(handled))
+	}
+}
+
+func TestServerInFlightBudget(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	opts := testConnOptions()
+	opts.BudgetOptions = BudgetOptions{
+		MaxInFlight: 1,
+	}
+
+	s := newServerTest(t, opts, ServerOptions{}, HandlerFunc(func(_ context.Context, _ ResponseWriter, _ *Request) {
+		started <- struct{}{}
+		<-release
+	}))
+
+	// datagrams failing to decode are never counted in flight
+	_, err := s.client.WriteTo([]byte{0x50, 0x01, 0x41, 0x41, 0xB1}, s.server.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	unanswered := testRequest()
+	unanswered.Type = NonConfirmable
+	s.send(unanswered)
+	<-started
+
+	over := testRequest()
+	over.ID = 0x4343
+	s.send(over)
+
+	resp := s.receive()
+	if resp == nil || resp.Type != Acknowledgement || resp.Code != Code(ServiceUnavailable) || resp.ID != 0x4343 {
+		t.Fatal("expected Service Unavailable over budget")
+	}
+
+	// the slot is released when the handler returns without responding
+	close(release)
+
+	for id := MessageID(0x4444); ; id++ {
+		if id == 0x4444+10 {
+			t.Fatal("slot not released")
+		}
+
+		next := testRequest()
+		next.ID = id
+		s.send(next)
+
+		resp := s.receive()
+		if resp != nil && resp.Type == Acknowledgement && resp.Code.IsEmpty() {
+			break
+		}
+
+		// give the handler goroutine time to finish
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestServerVirtualTime runs a separate response exchange with retransmission on a shared FakeClock.
+func TestServerVirtualTime(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	opts := ConnOptions{
+		Clock: clock,
+	}
+
+	a, b := newPipe()
+	client := NewConn(a, opts)
+	defer client.Close()
+	server := NewConn(b, opts)
+	defer server.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_ = NewServer(server, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+			close(started)
+			<-release
+			_ = w.Write(&Response{
+				Code:    Content,
+				Payload: []byte("separate"),
+			})
+		}), ServerOptions{}).Serve(context.Background())
+	}()
+
+	err := a.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	// first transmission is dropped
+	wall := time.Now()
+	a.DropEvery(1)
+	err = client.Write(testRequest(), b.LocalAddr())
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+	a.DropEvery(0)
+
+	// initial timeout is at most ACK_TIMEOUT * ACK_RANDOM_FACTOR
+	clock.Advance(ACKTimeout * 3 / 2)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("retransmission not received")
+	}
+
+	// handler misses the piggyback deadline
+	clock.Advance(PiggybackDeadline)
+
+	ack := &Message{}
+	_, err = client.Read(ack)
+	if err != nil {
+		t.Fatal("read ack:", err)
+	}
+
+	if ack.Type != Acknowledgement || !ack.Code.IsEmpty() || ack.ID != 0x4242 {
+		t.Fatalf("expected empty acknowledgement, got %v %v %d", ack.Type, ack.Code, ack.ID)
+	}
+
+	close(release)
+
+	resp := &Message{}
+	addr, err := client.Read(resp)
+	if err != nil {
+		t.Fatal("read response:", err)
+	}
+
+	if resp.Type != Confirmable || resp.Code != Code(Content) || string(resp.Token) != string(bytes4) {
+		t.Fatalf("expected separate response, got %v %v %x", resp.Type, resp.Code, resp.Token)
+	}
+
+	err = client.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Acknowledgement,
+			ID:      resp.ID,
+		},
+	}, addr)
+	if err != nil {
+		t.Fatal("write ack:", err)
+	}
+
+	for server.Stats().PendingExchanges != 0 {
+		if time.Since(wall) > time.Second {
+			t.Fatal("separate response not acknowledged")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// nothing is retransmitted once both exchanges are acknowledged
+	clock.Advance(93 * time.Second)
+
+	err = a.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if err != nil {
+		t.Fatal("set deadline:", err)
+	}
+
+	_, err = client.Read(&Message{})
+	expectErr(t, err, os.ErrDeadlineExceeded)
+
+	if elapsed := time.Since(wall); elapsed > time.Second {
+		t.Errorf("wall time = %v, want well below a second", elapsed)
+	}
+}
+
+func TestServerContext(t *testing.T) {
+	type middlewareKey struct{}
+
+	type values struct {
+		Remote    string
+		Peer      PeerID
+		Transport string
+		Multicast bool
+		Attached  any
+	}
+
+	got := make(chan values, 1)
+	handler := HandlerFunc(func(ctx context.Context, _ ResponseWriter, _ *Request) {
+		remote, _ := RemoteAddr(ctx)
+		peer, _ := Peer(ctx)
+		transport, _ := Transport(ctx)
+		got <- values{
+			Remote:    remote.String(),
+			Peer:      peer,
+			Transport: transport,
+			Multicast: IsMulticast(ctx),
+			Attached:  ctx.Value(middlewareKey{}),
+		}
+
+		// wait for shutdown
+		<-ctx.Done()
+		close(got)
+	})
+
+	middleware := HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+		handler.ServeCOAP(context.WithValue(ctx, middlewareKey{}, "attached"), w, r)
+	})
+
+	s := newServerTest(t, testConnOptions(), ServerOptions{}, middleware)
+	s.send(testRequest())
+
+	want := values{
+		Remote:    s.client.LocalAddr().String(),
+		Peer:      PeerID(s.client.LocalAddr().String()),
+		Transport: s.server.LocalAddr().Network(),
+		Attached:  "attached",
+	}
+
+	diff := cmp.Diff(want, <-got)
+	if diff != "" {
+		t.Errorf("context mismatch (-want +got):\n%s", diff)
+	}
+
+	err := s.server.Close()
+	if err != nil {
+		t.Fatal("close:", err)
+	}
+
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("handler not canceled on shutdown")
+	}
+
+	ctx := context.Background()
+	if _, ok := RemoteAddr(ctx); ok {
+		t.Error("expected no remote address outside of handler")
+	}
+
+	if IsMulticast(ctx) {
+		t.Error("expected no multicast outside of handler")
+	}
+
+	// All CoAP Nodes
+	ctx = context.WithValue(ctx, localAddrKey{}, &net.UDPAddr{IP: net.IPv4(224, 0, 1, 187), Port: DefaultPort})
+	if !IsMulticast(ctx) {
+		t.Error("expected multicast on group address")
+	}
+}
+
+// BenchmarkExchangeWrite measures the piggybacked response hot path of the server.
+func BenchmarkExchangeWrite(b *testing.B) {
+	a, p := newPipe()
+	conn := NewConn(a, testConnOptions())
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, MaxMessageLength)
+		for {
+			_, _, err := p.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	defer p.Close()
+
+	contentFormat := MediaTypeApplicationJSON
+	resp := &Response{
+		Code:          Content,
+		ContentFormat: &contentFormat,
+		Payload:       []byte(`{"temp":21.5}`),
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		e := &exchange{
+			conn: conn,
+			req:  testRequest().Header,
+			addr: p.LocalAddr(),
+			done: make(chan struct{}),
+		}
+
+		err := e.Write(resp)
+		if err != nil {
+			b.Fatal("write:", err)
+		}
+	}
+}
+
+// TestServerResponseGolden checks that responses written through the exchange encode exactly as
+// the Response with the header set by the exchange.
+func TestServerResponseGolden(t *testing.T) {
+	contentFormat := MediaTypeApplicationJSON
+	observe := uint32(7)
+
+	tests := []struct {
+		name string
+		resp *Response
+	}{
+		{
+			name: "code only",
+			resp: &Response{
+				Code: Deleted,
+			},
+		},
+		{
+			name: "content format",
+			resp: &Response{
+				Code:          Content,
+				ContentFormat: &contentFormat,
+				Payload:       []byte(`{"temp":21.5}`),
+			},
+		},
+		{
+			name: "options and overrides",
+			resp: &Response{
+				Code: Content,
+				Options: Options{
+					MustOptionValue(MaxAge, uint32(60)),
+					MustOptionValue(ETag, bytes4),
+				},
+				ContentFormat: &contentFormat,
+				Observe:       &observe,
+				Payload:       []byte(`{}`),
+			},
+		},
+		{
+			name: "location",
+			resp: &Response{
+				Code:          Created,
+				LocationPath:  "/items/42",
+				LocationQuery: []string{"rev=1"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newServerTest(t, testConnOptions(), ServerOptions{}, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+				_ = w.Write(test.resp)
+			}))
+
+			s.send(testRequest())
+
+			data, _ := receiveDatagram(t, s.client)
+			if data == nil {
+				t.Fatal("no response")
+			}
+
+			naive := *test.resp
+			naive.Type = Acknowledgement
+			naive.MessageID = 0x4242
+			naive.Token = bytes4
+
+			want, err := naive.AppendBinary(nil)
+			if err != nil {
+				t.Fatal("encode:", err)
+			}
+
+			diff := cmp.Diff(want, data)
+			if diff != "" {
+				t.Errorf("response mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
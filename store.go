@@ -0,0 +1,313 @@
+package coap
+
+import (
+	"iter"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MaxExchanges is the default number of entries held by ExchangeStore.
+const MaxExchanges = 4096
+
+// EvictionReason indicates why an entry was removed from ExchangeStore.
+type EvictionReason uint8
+
+const (
+	// EvictionExpired indicates that the entry deadline passed.
+	EvictionExpired EvictionReason = iota + 1
+
+	// EvictionCapacity indicates that the entry was the oldest when the store was full.
+	EvictionCapacity
+)
+
+// ExchangeStoreOptions holds options for ExchangeStore.
+type ExchangeStoreOptions[T any] struct {
+	// MaxEntries is the maximum number of entries, the oldest entry is evicted when full, defaults to MaxExchanges.
+	MaxEntries uint
+
+	// Clock is used to expire entries, defaults to RealClock.
+	Clock Clock
+
+	// OnEvict is called for each entry removed by expiry or capacity, but not by Delete
+	// or replaced by Put of the same token.
+	//
+	// It is called without holding the store lock, so it may access the store.
+	OnEvict func(token Token, value T, reason EvictionReason)
+}
+
+// ExchangeStore holds per-exchange state keyed by token with a deadline per entry.
+//
+// Expired entries are swept lazily on access, so the store needs no goroutine and
+// abandoned exchanges are released as soon as the store is used again or Sweep is called.
+type ExchangeStore[T any] struct {
+	opts ExchangeStoreOptions[T]
+
+	mtx     sync.Mutex
+	entries map[string]*storeEntry[T]
+	next    time.Time
+
+	// oldest and newest link entries in insertion order, so that the oldest is evicted in constant time
+	oldest *storeEntry[T]
+	newest *storeEntry[T]
+}
+
+type storeEntry[T any] struct {
+	token    Token
+	value    T
+	deadline time.Time
+
+	prev *storeEntry[T]
+	next *storeEntry[T]
+}
+
+type eviction[T any] struct {
+	entry  *storeEntry[T]
+	reason EvictionReason
+}
+
+// NewExchangeStore instantiates a new ExchangeStore with the given options.
+func NewExchangeStore[T any](opts ExchangeStoreOptions[T]) *ExchangeStore[T] {
+	if opts.MaxEntries == 0 {
+		opts.MaxEntries = MaxExchanges
+	}
+
+	if opts.Clock == nil {
+		opts.Clock = RealClock
+	}
+
+	return &ExchangeStore[T]{
+		opts:    opts,
+		entries: map[string]*storeEntry[T]{},
+	}
+}
+
+// Put stores the value for the token until the deadline, replacing any previous value.
+//
+// If the store is full, the oldest entry is evicted with EvictionCapacity.
+func (s *ExchangeStore[T]) Put(token Token, value T, deadline time.Time) {
+	s.mtx.Lock()
+	evicted := s.sweep()
+
+	prev, ok := s.entries[string(token)]
+	switch {
+	case ok:
+		s.remove(prev)
+	case uint(len(s.entries)) >= s.opts.MaxEntries:
+		oldest := s.oldest
+		s.remove(oldest)
+		evicted = append(evicted, eviction[T]{
+			entry:  oldest,
+			reason: EvictionCapacity,
+		})
+	}
+
+	entry := &storeEntry[T]{
+		token:    slices.Clone(token),
+		value:    value,
+		deadline: deadline,
+		prev:     s.newest,
+	}
+	s.entries[string(entry.token)] = entry
+
+	if s.newest != nil {
+		s.newest.next = entry
+	} else {
+		s.oldest = entry
+	}
+	s.newest = entry
+
+	if s.next.IsZero() || deadline.Before(s.next) {
+		s.next = deadline
+	}
+	s.mtx.Unlock()
+
+	s.notify(evicted)
+}
+
+// Get returns the value stored for the token.
+//
+// Returns false if there is no entry or it has expired.
+func (s *ExchangeStore[T]) Get(token Token) (T, bool) {
+	s.mtx.Lock()
+	evicted := s.sweep()
+	entry, ok := s.entries[string(token)]
+	s.mtx.Unlock()
+
+	s.notify(evicted)
+
+	if !ok {
+		var zero T
+		return zero, false
+	}
+
+	return entry.value, true
+}
+
+// Delete removes the entry for the token and returns its value.
+//
+// Returns false if there is no entry or it has expired.
+func (s *ExchangeStore[T]) Delete(token Token) (T, bool) {
+	s.mtx.Lock()
+	evicted := s.sweep()
+	entry, ok := s.entries[string(token)]
+	if ok {
+		s.remove(entry)
+	}
+	s.mtx.Unlock()
+
+	s.notify(evicted)
+
+	if !ok {
+		var zero T
+		return zero, false
+	}
+
+	return entry.value, true
+}
+
+// Extend moves the deadline of the entry for the token.
+//
+// Returns false if there is no entry or it has expired.
+func (s *ExchangeStore[T]) Extend(token Token, deadline time.Time) bool {
+	s.mtx.Lock()
+	evicted := s.sweep()
+	entry, ok := s.entries[string(token)]
+	if ok {
+		entry.deadline = deadline
+		if deadline.Before(s.next) {
+			s.next = deadline
+		}
+	}
+	s.mtx.Unlock()
+
+	s.notify(evicted)
+
+	return ok
+}
+
+// Sweep removes expired entries.
+func (s *ExchangeStore[T]) Sweep() {
+	s.mtx.Lock()
+	evicted := s.sweep()
+	s.mtx.Unlock()
+
+	s.notify(evicted)
+}
+
+// Len returns the number of entries which have not expired.
+func (s *ExchangeStore[T]) Len() int {
+	s.mtx.Lock()
+	evicted := s.sweep()
+	n := len(s.entries)
+	s.mtx.Unlock()
+
+	s.notify(evicted)
+
+	return n
+}
+
+// All returns an iterator over a snapshot of entries which have not expired, in insertion order.
+//
+// Intended for debugging endpoints.
+func (s *ExchangeStore[T]) All() iter.Seq2[Token, T] {
+	s.mtx.Lock()
+	evicted := s.sweep()
+	entries := make([]*storeEntry[T], 0, len(s.entries))
+	for entry := s.oldest; entry != nil; entry = entry.next {
+		entries = append(entries, entry)
+	}
+	s.mtx.Unlock()
+
+	s.notify(evicted)
+
+	return func(yield func(Token, T) bool) {
+		for _, entry := range entries {
+			if !yield(entry.token, entry.value) {
+				return
+			}
+		}
+	}
+}
+
+// remove unlinks the entry and deletes it from the map.
+func (s *ExchangeStore[T]) remove(entry *storeEntry[T]) {
+	delete(s.entries, string(entry.token))
+
+	if entry.prev != nil {
+		entry.prev.next = entry.next
+	} else {
+		s.oldest = entry.next
+	}
+
+	if entry.next != nil {
+		entry.next.prev = entry.prev
+	} else {
+		s.newest = entry.prev
+	}
+
+	entry.prev = nil
+	entry.next = nil
+}
+
+// sweep removes expired entries once the earliest deadline has passed.
+func (s *ExchangeStore[T]) sweep() []eviction[T] {
+	now := s.opts.Clock.Now()
+	if s.next.IsZero() || now.Before(s.next) {
+		return nil
+	}
+
+	var (
+		expired []eviction[T]
+		next    time.Time
+	)
+
+	for entry := s.oldest; entry != nil; {
+		following := entry.next
+		if !now.Before(entry.deadline) {
+			s.remove(entry)
+			expired = append(expired, eviction[T]{
+				entry:  entry,
+				reason: EvictionExpired,
+			})
+			entry = following
+			continue
+		}
+
+		if next.IsZero() || entry.deadline.Before(next) {
+			next = entry.deadline
+		}
+		entry = following
+	}
+
+	s.next = next
+
+	// maps never shrink, replace an empty map to release memory after a burst of exchanges
+	if len(s.entries) == 0 {
+		s.entries = map[string]*storeEntry[T]{}
+	}
+
+	return expired
+}
+
+func (s *ExchangeStore[T]) notify(evicted []eviction[T]) {
+	if s.opts.OnEvict == nil {
+		return
+	}
+
+	for _, e := range evicted {
+		s.opts.OnEvict(e.entry.token, e.entry.value, e.reason)
+	}
+}
+
+// String returns a string representation of the EvictionReason.
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionExpired:
+		return "expired"
+	case EvictionCapacity:
+		return "capacity"
+	default:
+		return "unknown"
+	}
+}
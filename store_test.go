@@ -0,0 +1,142 @@
+package coap
+
+import (
+	"encoding/binary"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExchangeStore(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	evicted := map[string]EvictionReason{}
+	store := NewExchangeStore(ExchangeStoreOptions[int]{
+		MaxEntries: 2,
+		Clock:      clock,
+		OnEvict: func(token Token, _ int, reason EvictionReason) {
+			evicted[string(token)] = reason
+		},
+	})
+
+	store.Put(Token("a"), 1, clock.Now().Add(time.Second))
+	store.Put(Token("b"), 2, clock.Now().Add(3*time.Second))
+
+	if v, ok := store.Get(Token("a")); !ok || v != 1 {
+		t.Errorf("Get(a) = %d, %v, want 1, true", v, ok)
+	}
+
+	if !store.Extend(Token("a"), clock.Now().Add(2*time.Second)) {
+		t.Error("Extend(a) = false, want true")
+	}
+
+	clock.Advance(time.Second)
+	if _, ok := store.Get(Token("a")); !ok {
+		t.Error("expected extended entry to be present")
+	}
+
+	// store is full, a is the oldest
+	store.Put(Token("c"), 3, clock.Now().Add(time.Second))
+	if _, ok := store.Get(Token("a")); ok {
+		t.Error("expected oldest entry to be evicted")
+	}
+
+	tokens := []string{}
+	for token := range store.All() {
+		tokens = append(tokens, string(token))
+	}
+
+	diff := cmp.Diff([]string{"b", "c"}, tokens)
+	if diff != "" {
+		t.Errorf("tokens mismatch (-want +got):\n%s", diff)
+	}
+
+	if v, ok := store.Delete(Token("b")); !ok || v != 2 {
+		t.Errorf("Delete(b) = %d, %v, want 2, true", v, ok)
+	}
+
+	clock.Advance(time.Second)
+	if n := store.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+
+	diff = cmp.Diff(map[string]EvictionReason{"a": EvictionCapacity, "c": EvictionExpired}, evicted)
+	if diff != "" {
+		t.Errorf("evicted mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestExchangeStoreSoak(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	store := NewExchangeStore(ExchangeStoreOptions[[]byte]{
+		MaxEntries: 200_000,
+		Clock:      clock,
+	})
+
+	goroutines := runtime.NumGoroutine()
+	before := heapAlloc()
+
+	for i := range uint32(100_000) {
+		token := binary.BigEndian.AppendUint32(nil, i)
+		store.Put(token, make([]byte, 64), clock.Now().Add(time.Millisecond))
+	}
+
+	if n := store.Len(); n != 100_000 {
+		t.Fatalf("Len() = %d, want 100000", n)
+	}
+
+	clock.Advance(time.Millisecond)
+
+	if n := store.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("goroutines = %d, want at most %d", n, goroutines)
+	}
+
+	// the entries and their values take several MiB, all of it is released after expiry
+	after := heapAlloc()
+	runtime.KeepAlive(store)
+	if after > before+1<<20 {
+		t.Errorf("heap grew by %d bytes after expiry, want at most 1 MiB", after-before)
+	}
+}
+
+func TestExchangeStoreReplace(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	evicted := map[string]EvictionReason{}
+	store := NewExchangeStore(ExchangeStoreOptions[int]{
+		MaxEntries: 2,
+		Clock:      clock,
+		OnEvict: func(token Token, _ int, reason EvictionReason) {
+			evicted[string(token)] = reason
+		},
+	})
+
+	deadline := clock.Now().Add(time.Second)
+	store.Put(Token("a"), 1, deadline)
+	store.Put(Token("b"), 2, deadline)
+
+	// replacing a makes b the oldest
+	store.Put(Token("a"), 3, deadline)
+	store.Put(Token("c"), 4, deadline)
+
+	if v, ok := store.Get(Token("a")); !ok || v != 3 {
+		t.Errorf("Get(a) = %d, %v, want 3, true", v, ok)
+	}
+
+	diff := cmp.Diff(map[string]EvictionReason{"b": EvictionCapacity}, evicted)
+	if diff != "" {
+		t.Errorf("evicted mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func heapAlloc() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+
+	return stats.HeapAlloc
+}
@@ -0,0 +1,176 @@
+// See RFC 8323, Section 3.2 for details on message framing over reliable transports.
+//
+// https://datatracker.ietf.org/doc/html/rfc8323#section-3.2
+
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// StreamHeaderLength is the minimum length of the header of a message framed for reliable transports,
+	// the length and token length byte followed by the code.
+	StreamHeaderLength = 2
+
+	// StreamExtendByte indicates that the length is 13 plus the following byte.
+	StreamExtendByte = 13
+
+	// StreamExtendWord indicates that the length is 269 plus the following 2 bytes.
+	StreamExtendWord = 14
+
+	// StreamExtendDword indicates that the length is 65805 plus the following 4 bytes.
+	StreamExtendDword = 15
+
+	// StreamExtendByteOffset is the offset added to the 1-byte extended length.
+	StreamExtendByteOffset = 13
+
+	// StreamExtendWordOffset is the offset added to the 2-byte extended length.
+	StreamExtendWordOffset = 269
+
+	// StreamExtendDwordOffset is the offset added to the 4-byte extended length.
+	StreamExtendDwordOffset = 65805
+)
+
+// EncodeStream appends the message framed for reliable transports, where the header carries the length
+// of options and payload in place of the version, type and message ID. Framed messages can be concatenated
+// and decoded in turn by DecodeStream.
+//
+// Type and ID are not encoded. Returns errors of Encode, data is returned unchanged on error.
+func (m *Message) EncodeStream(data []byte, opts MarshalOptions) ([]byte, error) {
+	encoded, err := m.Encode(nil, opts)
+	if err != nil {
+		return data, err
+	}
+
+	body := encoded[HeaderLength+len(m.Token):]
+	length := uint64(len(body))
+	tkl := uint8(len(m.Token))
+
+	switch {
+	case length < StreamExtendByteOffset:
+		data = append(data, uint8(length)<<4|tkl)
+	case length < StreamExtendWordOffset:
+		data = append(data, StreamExtendByte<<4|tkl, uint8(length-StreamExtendByteOffset))
+	case length < StreamExtendDwordOffset:
+		data = append(data, StreamExtendWord<<4|tkl)
+		data = binary.BigEndian.AppendUint16(data, uint16(length-StreamExtendWordOffset))
+	default:
+		data = append(data, StreamExtendDword<<4|tkl)
+		data = binary.BigEndian.AppendUint32(data, uint32(length-StreamExtendDwordOffset))
+	}
+
+	data = append(data, uint8(m.Code))
+	data = append(data, m.Token...)
+	data = append(data, body...)
+
+	return data, nil
+}
+
+// DecodeStream decodes a message framed for reliable transports from the provided data slice.
+//
+// Version is set to ProtocolVersion, Type and ID are not carried and decoded as zero. Options and payload
+// are decoded and checked as by Decode.
+//
+// Returns the remaining data after the message, data is returned unchanged on error.
+//
+// Returns MessageTooLong if the framed length exceeds the maximum message length.
+//
+// Returns UnmarshalError with TruncatedError if data ends before the framed length, or with
+// UnsupportedTokenLength if the token length exceeds the maximum.
+//
+// Returns errors of Decode for options and payload, offsets of UnmarshalError are relative to data.
+func (m *Message) DecodeStream(data []byte, opts MarshalOptions) ([]byte, error) {
+	if opts.MaxMessageLength == 0 {
+		opts.MaxMessageLength = MaxMessageLength
+	}
+
+	if len(data) < StreamHeaderLength {
+		return data, UnmarshalError{
+			Cause: TruncatedError{
+				Expected: StreamHeaderLength,
+			},
+		}
+	}
+
+	nibble := data[0] >> 4
+	tkl := uint64(data[0] & 0x0F)
+	if tkl > TokenMaxLength {
+		return data, UnmarshalError{
+			Cause: UnsupportedTokenLength{
+				Length: uint(tkl),
+			},
+		}
+	}
+
+	extend := uint64(0)
+	switch nibble {
+	case StreamExtendByte:
+		extend = 1
+	case StreamExtendWord:
+		extend = 2
+	case StreamExtendDword:
+		extend = 4
+	}
+
+	header := StreamHeaderLength + extend
+	if uint64(len(data)) < header {
+		return data, UnmarshalError{
+			Cause: TruncatedError{
+				Expected: uint(header),
+			},
+		}
+	}
+
+	length := uint64(nibble)
+	switch nibble {
+	case StreamExtendByte:
+		length = uint64(data[1]) + StreamExtendByteOffset
+	case StreamExtendWord:
+		length = uint64(binary.BigEndian.Uint16(data[1:])) + StreamExtendWordOffset
+	case StreamExtendDword:
+		length = uint64(binary.BigEndian.Uint32(data[1:])) + StreamExtendDwordOffset
+	}
+
+	size := header + tkl + length
+	if size > uint64(opts.MaxMessageLength) {
+		return data, MessageTooLong{
+			Limit:  opts.MaxMessageLength,
+			Length: uint(size),
+		}
+	}
+
+	if uint64(len(data)) < size {
+		return data, UnmarshalError{
+			Cause: TruncatedError{
+				Expected: uint(size),
+			},
+		}
+	}
+
+	// options and payload are decoded behind the equivalent datagram header, so they are checked as in Decode
+	datagram := make([]byte, 0, HeaderLength+tkl+length)
+	datagram = append(datagram, ProtocolVersion<<6|uint8(tkl), data[header-1], 0, 0)
+	datagram = append(datagram, data[header:size]...)
+
+	opts.MaxMessageLength = uint(len(datagram))
+	_, err := m.Decode(datagram, opts)
+	if err != nil {
+		return data, shiftUnmarshalError(err, int(header)-HeaderLength)
+	}
+
+	return data[size:], nil
+}
+
+// shiftUnmarshalError moves the offset of UnmarshalError by delta, other errors are returned as they are.
+func shiftUnmarshalError(err error, delta int) error {
+	var unmarshal UnmarshalError
+	if !errors.As(err, &unmarshal) {
+		return err
+	}
+
+	unmarshal.Offset = uint(int(unmarshal.Offset) + delta)
+
+	return unmarshal
+}
@@ -0,0 +1,169 @@
+package coap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMessageStreamRoundtrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    Message
+		header []byte
+	}{
+		{
+			name: "empty",
+			msg: Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Token:   Token{},
+				},
+			},
+			header: []byte{0x00, 0x00},
+		},
+		{
+			name: "token and options",
+			msg: Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Code:    Code(GET),
+					Token:   bytes4,
+				},
+				Options: Options{
+					MustOptionValue(URIPath, "a"),
+				},
+			},
+			header: []byte{0x24, 0x01},
+		},
+		{
+			name: "byte extended length",
+			msg: Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Code:    Code(Content),
+					Token:   Token{},
+				},
+				Payload: bytes.Repeat([]byte{0x42}, 12),
+			},
+			header: []byte{0xD0, 0x00, 0x45},
+		},
+		{
+			name: "word extended length",
+			msg: Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Code:    Code(Content),
+					Token:   Token{},
+				},
+				Payload: bytes.Repeat([]byte{0x42}, 299),
+			},
+			header: []byte{0xE0, 0x00, 0x1F, 0x45},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := test.msg.EncodeStream(nil, MarshalOptions{})
+			if err != nil {
+				t.Fatal("encode:", err)
+			}
+
+			if !bytes.HasPrefix(data, test.header) {
+				t.Errorf("header = %x, want %x", data[:min(len(data), len(test.header))], test.header)
+			}
+
+			msg := Message{}
+			rest, err := msg.DecodeStream(append(data, 0x42), MarshalOptions{})
+			if err != nil {
+				t.Fatal("decode:", err)
+			}
+
+			if !bytes.Equal(rest, []byte{0x42}) {
+				t.Errorf("rest = %x, want 42", rest)
+			}
+
+			diff := cmp.Diff(test.msg, msg, EquateOptions())
+			if diff != "" {
+				t.Errorf("message mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMessageDecodeStreamError(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		opts MarshalOptions
+		err  error
+	}{
+		{
+			name: "truncated header",
+			data: []byte{0x00},
+			err: UnmarshalError{
+				Cause: TruncatedError{
+					Expected: StreamHeaderLength,
+				},
+			},
+		},
+		{
+			name: "truncated extended length",
+			data: []byte{0xE0, 0x00},
+			err: UnmarshalError{
+				Cause: TruncatedError{
+					Expected: StreamHeaderLength + 2,
+				},
+			},
+		},
+		{
+			name: "truncated body",
+			data: []byte{0x24, 0x01, 0x01, 0x02},
+			err: UnmarshalError{
+				Cause: TruncatedError{
+					Expected: StreamHeaderLength + 4 + 2,
+				},
+			},
+		},
+		{
+			name: "unsupported token length",
+			data: []byte{0x09, 0x01},
+			err: UnmarshalError{
+				Cause: UnsupportedTokenLength{
+					Length: 9,
+				},
+			},
+		},
+		{
+			name: "message too long",
+			data: []byte{0xF0, 0x00, 0x00, 0x00, 0x00, 0x45},
+			err: MessageTooLong{
+				Limit:  MaxMessageLength,
+				Length: StreamHeaderLength + 4 + StreamExtendDwordOffset,
+			},
+		},
+		{
+			name: "option offset",
+			data: []byte{0x10, 0x01, 0xB1},
+			err: UnmarshalError{
+				Offset: 3,
+				Cause: TruncatedError{
+					Expected: 1,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := Message{}
+			rest, err := msg.DecodeStream(test.data, test.opts)
+			expectErr(t, err, test.err)
+
+			if !bytes.Equal(rest, test.data) {
+				t.Errorf("rest = %x, want data unchanged", rest)
+			}
+		})
+	}
+}
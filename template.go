@@ -0,0 +1,142 @@
+package coap
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// MessageTemplate encodes a message once and instantiates it for many targets differing only in
+// MessageID, Token and Observe sequence number, such as notifications fanned out to the observers
+// of a resource or a command sent to a group of devices.
+//
+// Instances are byte-for-byte equal to the message encoded with Message.Encode carrying the MessageID,
+// Token and Observe sequence number of the instance.
+type MessageTemplate struct {
+	// first is the first header byte without token length
+	first uint8
+	code  Code
+
+	// prefix holds options preceding Observe
+	prefix []byte
+
+	// observe tells whether the message carries Observe, observeDelta is its delta from the preceding option
+	observe      bool
+	observeDelta uint8
+
+	// suffix holds options following Observe, with deltas relative to Observe, and the payload
+	suffix []byte
+
+	maxMessageLength uint
+}
+
+// Build encodes the message into the template, replacing the message built before.
+//
+// The Token and MessageID of the message are ignored. If the message carries Observe, its value
+// is replaced by the sequence number of each instance, otherwise the sequence number is ignored.
+//
+// Returns errors of Message.Encode if the message cannot be encoded.
+func (t *MessageTemplate) Build(msg *Message, opts MarshalOptions) error {
+	if opts.MaxMessageLength == 0 {
+		opts.MaxMessageLength = MaxMessageLength
+	}
+
+	invariant := *msg
+	invariant.ID = 0
+	invariant.Token = nil
+
+	data, err := invariant.Encode(nil, opts)
+	if err != nil {
+		return err
+	}
+
+	// locate Observe in the encoded options, deltas of the following options are relative to its code
+	// and do not depend on its value
+	options := data[HeaderLength:]
+	rest := options
+	code := uint16(0)
+	prev := uint16(0)
+	observeStart, observeEnd := -1, -1
+	for len(rest) != 0 && rest[0] != PayloadMarker {
+		start := len(options) - len(rest)
+
+		delta, length, value, err := decodeOptionHeader(rest)
+		if err != nil {
+			return err
+		}
+
+		if int(length) > len(value) {
+			return TruncatedError{
+				Expected: uint(length),
+			}
+		}
+
+		prev, code = code, code+delta
+		rest = value[length:]
+
+		if code == Observe.Code {
+			observeStart, observeEnd = start, len(options)-len(rest)
+			t.observeDelta = uint8(code - prev)
+		}
+	}
+
+	t.first = data[0] & 0xF0
+	t.code = Code(data[1])
+	t.observe = observeStart >= 0
+	t.maxMessageLength = opts.MaxMessageLength
+
+	if !t.observe {
+		t.prefix = append(t.prefix[:0], options...)
+		t.suffix = t.suffix[:0]
+		return nil
+	}
+
+	t.prefix = append(t.prefix[:0], options[:observeStart]...)
+	t.suffix = append(t.suffix[:0], options[observeEnd:]...)
+
+	return nil
+}
+
+// Instantiate appends the message of the template carrying the MessageID, Token and Observe
+// sequence number to buf. Sequence numbers wrap at MaxObserveSequence.
+//
+// Returns UnsupportedTokenLength if the token exceeds TokenMaxLength.
+//
+// Returns MessageTooLong if the instance exceeds the maximum message length the template was built with,
+// buf is returned unchanged.
+func (t *MessageTemplate) Instantiate(id MessageID, token Token, sequence uint32, buf []byte) ([]byte, error) {
+	if len(token) > TokenMaxLength {
+		return buf, UnsupportedTokenLength{
+			Length: uint(len(token)),
+		}
+	}
+
+	start := len(buf)
+	buf = slices.Grow(buf, HeaderLength+len(token)+len(t.prefix)+4+len(t.suffix))
+	buf = append(buf, t.first|uint8(len(token)), uint8(t.code))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(id))
+	buf = append(buf, token...)
+	buf = append(buf, t.prefix...)
+
+	if t.observe {
+		// value is encoded in the minimum number of bytes, zero in none
+		sequence &= MaxObserveSequence
+		header := len(buf)
+		buf = append(buf, 0)
+		if sequence != 0 {
+			buf = Encode32(sequence, buf)
+		}
+		buf[header] = t.observeDelta<<4 | uint8(len(buf)-header-1)
+	}
+
+	buf = append(buf, t.suffix...)
+
+	length := len(buf) - start
+	if length > int(t.maxMessageLength) {
+		return buf[:start], MessageTooLong{
+			Limit:  t.maxMessageLength,
+			Length: uint(length),
+		}
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,228 @@
+package coap
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// notification returns a notification carrying options around Observe and a payload.
+func notification(sequence uint32) *Message {
+	msg := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(Content),
+		},
+		Payload: []byte("21.5"),
+	}
+	Must(msg.Options.SetOpaque(ETag, []byte{0x01, 0x02}))
+	Must(msg.Options.SetUint(Observe, sequence))
+	Must(msg.Options.SetUint(ContentFormat, uint32(MediaTypeTextPlain.Code)))
+	Must(msg.Options.SetUint(MaxAge, 30))
+	Must(msg.Options.SetUint(Size2, 4))
+
+	return msg
+}
+
+func TestMessageTemplateWire(t *testing.T) {
+	template := &MessageTemplate{}
+	err := template.Build(notification(0), MarshalOptions{})
+	if err != nil {
+		t.Fatal("build:", err)
+	}
+
+	tests := []struct {
+		name     string
+		sequence uint32
+		data     []byte
+	}{
+		{
+			name:     "empty Observe",
+			sequence: 0,
+			data: []byte{
+				0x52, 0x45, 0x12, 0x34, 0xaa, 0xbb, // Header, Token
+				0x42, 0x01, 0x02, // ETag
+				0x20,       // Observe 0
+				0x60,       // ContentFormat 0
+				0x21, 0x1e, // MaxAge 30
+				0xd1, 0x01, 0x04, // Size2 4
+				0xff, '2', '1', '.', '5',
+			},
+		},
+		{
+			name:     "3-byte Observe",
+			sequence: 0x010203,
+			data: []byte{
+				0x52, 0x45, 0x12, 0x34, 0xaa, 0xbb, // Header, Token
+				0x42, 0x01, 0x02, // ETag
+				0x23, 0x01, 0x02, 0x03, // Observe 0x010203
+				0x60,       // ContentFormat 0
+				0x21, 0x1e, // MaxAge 30
+				0xd1, 0x01, 0x04, // Size2 4
+				0xff, '2', '1', '.', '5',
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := template.Instantiate(0x1234, Token{0xaa, 0xbb}, test.sequence, nil)
+			if err != nil {
+				t.Fatal("instantiate:", err)
+			}
+
+			diff := cmp.Diff(test.data, data)
+			if diff != "" {
+				t.Errorf("data mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestMessageTemplateEncode compares instances with messages encoded with Message.Encode across
+// transitions of the Observe value length.
+func TestMessageTemplateEncode(t *testing.T) {
+	only := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    Confirmable,
+			Code:    Code(Content),
+		},
+	}
+	Must(only.Options.SetUint(Observe, 1))
+
+	extended := notification(1)
+	Must(extended.Options.SetString(LocationPath, "a"))
+	Must(extended.Options.SetUint(Size1, 1))
+	extended.Options.Set(MustOptionValue(UnrecognizedOptionDef(2049, 8), []byte{0x01}))
+
+	group := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(POST),
+		},
+		Payload: []byte("on"),
+	}
+	Must(group.Options.SetString(URIPath, "light"))
+
+	messages := map[string]*Message{
+		"notification":    notification(1),
+		"observe only":    only,
+		"extended deltas": extended,
+		"without observe": group,
+	}
+
+	sequences := []uint32{0, 1, 0xff, 0x100, 0xffff, 0x10000, MaxObserveSequence}
+	tokens := []Token{nil, {0x01}, {0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}}
+
+	for name, msg := range messages {
+		t.Run(name, func(t *testing.T) {
+			template := &MessageTemplate{}
+			err := template.Build(msg, MarshalOptions{})
+			if err != nil {
+				t.Fatal("build:", err)
+			}
+
+			for _, sequence := range sequences {
+				for _, token := range tokens {
+					expect := *msg
+					expect.ID = MessageID(sequence)
+					expect.Token = token
+					expect.Options = append(Options{}, msg.Options...)
+					if msg.Options.Contains(Observe) {
+						Must(expect.Options.SetUint(Observe, sequence))
+					}
+
+					want, err := expect.Encode(nil, MarshalOptions{})
+					if err != nil {
+						t.Fatal("encode:", err)
+					}
+
+					got, err := template.Instantiate(MessageID(sequence), token, sequence, []byte{0xee})
+					if err != nil {
+						t.Fatal("instantiate:", err)
+					}
+
+					diff := cmp.Diff(append([]byte{0xee}, want...), got)
+					if diff != "" {
+						t.Errorf("sequence %#x, token %x mismatch (-want +got):\n%s", sequence, token, diff)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMessageTemplateErrors(t *testing.T) {
+	template := &MessageTemplate{}
+
+	msg := notification(1)
+	msg.Payload = make([]byte, 64)
+	opts := MarshalOptions{
+		MaxMessageLength: 89,
+	}
+
+	err := template.Build(msg, opts)
+	if err != nil {
+		t.Fatal("build:", err)
+	}
+
+	_, err = template.Instantiate(1, make(Token, 9), 1, nil)
+	expectErr(t, err, UnsupportedTokenLength{Length: 9})
+
+	// header, ETag, Observe, ContentFormat, MaxAge, Size2 and payload add up to 90 bytes with 8-byte token
+	// and 3-byte Observe
+	buf := []byte{0xee}
+	buf, err = template.Instantiate(1, make(Token, 8), MaxObserveSequence, buf)
+	expectErr(t, err, MessageTooLong{Limit: 89, Length: 90})
+
+	diff := cmp.Diff([]byte{0xee}, buf)
+	if diff != "" {
+		t.Errorf("buf mismatch (-want +got):\n%s", diff)
+	}
+
+	opts.MaxMessageLength = 60
+	err = template.Build(msg, opts)
+	expectErr(t, err, MessageTooLong{Limit: 60, Length: 80})
+}
+
+func BenchmarkMessageTemplate(b *testing.B) {
+	const observers = 5000
+
+	tokens := make([]Token, observers)
+	for i := range tokens {
+		tokens[i] = Token{0x01, 0x02, 0x03, byte(i >> 8), byte(i)}
+	}
+
+	msg := notification(0)
+	msg.Payload = make([]byte, 256)
+
+	b.Run("template", func(b *testing.B) {
+		buf := make([]byte, 0, MaxMessageLength)
+		for b.Loop() {
+			template := &MessageTemplate{}
+			Must(template.Build(msg, MarshalOptions{}))
+
+			for i, token := range tokens {
+				buf = MustValue(template.Instantiate(MessageID(i), token, uint32(i), buf[:0]))
+			}
+		}
+	})
+
+	b.Run("naive", func(b *testing.B) {
+		buf := make([]byte, 0, MaxMessageLength)
+		for b.Loop() {
+			for i, token := range tokens {
+				notification := *msg
+				notification.ID = MessageID(i)
+				notification.Token = token
+				notification.Options = append(Options{}, msg.Options...)
+				Must(notification.Options.SetUint(Observe, uint32(i)))
+
+				buf = MustValue(notification.Encode(buf[:0], MarshalOptions{}))
+			}
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package coap
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// MinAdaptiveTimeout is the default floor of timeouts computed by AdaptiveTimeout.
+	MinAdaptiveTimeout = 200 * time.Millisecond
+
+	// MaxAdaptiveTimeout is the default ceiling of timeouts computed by AdaptiveTimeout.
+	MaxAdaptiveTimeout = 60 * time.Second
+)
+
+// TimeoutStrategy computes initial retransmission timeouts of Confirmable messages per destination.
+//
+// Conn randomizes the initial timeout by ACKRandomFactor and doubles it on each retransmission.
+type TimeoutStrategy interface {
+	// Initial returns the initial timeout of a Confirmable message sent to the address.
+	Initial(addr net.Addr) time.Duration
+
+	// Observe is called with the round-trip time of an exchange with the address completed by an
+	// Acknowledgement or Reset. Exchanges with retransmitted messages are ambiguous and not observed.
+	Observe(addr net.Addr, rtt time.Duration)
+}
+
+// FixedTimeout is a TimeoutStrategy using the same initial timeout for all destinations, as specified by RFC 7252.
+type FixedTimeout time.Duration
+
+// Initial implements TimeoutStrategy.
+func (t FixedTimeout) Initial(_ net.Addr) time.Duration {
+	return time.Duration(t)
+}
+
+// Observe implements TimeoutStrategy, round-trip times are ignored.
+func (t FixedTimeout) Observe(_ net.Addr, _ time.Duration) {}
+
+// AdaptiveTimeoutOptions holds options for AdaptiveTimeout.
+type AdaptiveTimeoutOptions struct {
+	// MinTimeout is the floor of computed timeouts, defaults to MinAdaptiveTimeout.
+	MinTimeout time.Duration
+
+	// MaxTimeout is the ceiling of computed timeouts, defaults to MaxAdaptiveTimeout.
+	MaxTimeout time.Duration
+
+	// DefaultTimeout is the timeout of destinations without observed round-trip time, defaults to ACKTimeout.
+	DefaultTimeout time.Duration
+}
+
+// AdaptiveTimeout is a TimeoutStrategy estimating the round-trip time of each destination, so that
+// failures are detected quickly on fast networks and slow links are not flooded with retransmissions.
+//
+// The initial timeout is SRTT + 4*RTTVAR of the destination clamped to MinTimeout and MaxTimeout,
+// smoothed round-trip time and its variance are maintained in the PeerTable of the Conn using the strategy
+// as specified by RFC 6298, so each Conn keeps its own estimates. Until used by a Conn, all destinations
+// get DefaultTimeout.
+//
+// https://datatracker.ietf.org/doc/html/draft-ietf-core-cocoa
+type AdaptiveTimeout struct {
+	opts  AdaptiveTimeoutOptions
+	peers *PeerTable
+}
+
+// NewAdaptiveTimeout instantiates a new AdaptiveTimeout with the given options.
+func NewAdaptiveTimeout(opts AdaptiveTimeoutOptions) *AdaptiveTimeout {
+	if opts.MinTimeout == 0 {
+		opts.MinTimeout = MinAdaptiveTimeout
+	}
+
+	if opts.MaxTimeout == 0 {
+		opts.MaxTimeout = MaxAdaptiveTimeout
+	}
+
+	if opts.DefaultTimeout == 0 {
+		opts.DefaultTimeout = ACKTimeout
+	}
+
+	return &AdaptiveTimeout{
+		opts: opts,
+	}
+}
+
+// Initial implements TimeoutStrategy.
+func (t *AdaptiveTimeout) Initial(addr net.Addr) time.Duration {
+	if addr == nil || t.peers == nil {
+		return t.opts.DefaultTimeout
+	}
+
+	srtt, rttvar, ok := t.peers.RTT(PeerID(addr.String()))
+	if !ok {
+		return t.opts.DefaultTimeout
+	}
+
+	return min(max(srtt+4*rttvar, t.opts.MinTimeout), t.opts.MaxTimeout)
+}
+
+// Observe implements TimeoutStrategy.
+func (t *AdaptiveTimeout) Observe(addr net.Addr, rtt time.Duration) {
+	if addr == nil || rtt < 0 || t.peers == nil {
+		return
+	}
+
+	t.peers.ObserveRTT(PeerID(addr.String()), rtt)
+}
+
+// withPeers returns a copy of the strategy keeping estimates in the PeerTable of a Conn.
+func (t *AdaptiveTimeout) withPeers(peers *PeerTable) TimeoutStrategy {
+	return &AdaptiveTimeout{
+		opts:  t.opts,
+		peers: peers,
+	}
+}
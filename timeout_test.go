@@ -0,0 +1,245 @@
+package coap
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTimeoutInitial(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: DefaultPort}
+
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		timeout time.Duration
+	}{
+		{
+			name:    "unknown peer",
+			timeout: ACKTimeout,
+		},
+		{
+			name:    "first sample",
+			samples: []time.Duration{100 * time.Millisecond},
+			timeout: 300 * time.Millisecond,
+		},
+		{
+			name:    "second sample",
+			samples: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+			timeout: 362500 * time.Microsecond,
+		},
+		{
+			name:    "floor",
+			samples: []time.Duration{10 * time.Millisecond},
+			timeout: MinAdaptiveTimeout,
+		},
+		{
+			name:    "ceiling",
+			samples: []time.Duration{30 * time.Second},
+			timeout: MaxAdaptiveTimeout,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peers := NewPeerTable(BudgetOptions{}, newFakeClock(time.Unix(0, 0)))
+			strategy := NewAdaptiveTimeout(AdaptiveTimeoutOptions{}).withPeers(peers)
+			for _, rtt := range test.samples {
+				strategy.Observe(addr, rtt)
+			}
+
+			timeout := strategy.Initial(addr)
+			if timeout != test.timeout {
+				t.Errorf("Initial() = %v, want %v", timeout, test.timeout)
+			}
+		})
+	}
+}
+
+func TestAdaptiveTimeoutConverges(t *testing.T) {
+	fast := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: DefaultPort}
+	slow := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: DefaultPort}
+
+	peers := NewPeerTable(BudgetOptions{}, newFakeClock(time.Unix(0, 0)))
+	strategy := NewAdaptiveTimeout(AdaptiveTimeoutOptions{
+		MinTimeout: time.Millisecond,
+	}).withPeers(peers)
+
+	// estimates start far off and settle on the round-trip time of each peer
+	strategy.Observe(fast, time.Second)
+	strategy.Observe(slow, 10*time.Millisecond)
+	for range 100 {
+		strategy.Observe(fast, 5*time.Millisecond)
+		strategy.Observe(slow, 600*time.Millisecond)
+	}
+
+	tests := []struct {
+		addr     net.Addr
+		min, max time.Duration
+	}{
+		{fast, 5 * time.Millisecond, 6 * time.Millisecond},
+		{slow, 600 * time.Millisecond, 610 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		timeout := strategy.Initial(test.addr)
+		if timeout < test.min || timeout > test.max {
+			t.Errorf("%s: Initial() = %v, want between %v and %v", test.addr, timeout, test.min, test.max)
+		}
+	}
+
+	timeout := strategy.Initial(nil)
+	if timeout != ACKTimeout {
+		t.Errorf("Initial(nil) = %v, want %v", timeout, ACKTimeout)
+	}
+}
+
+func TestConnAdaptiveTimeout(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: DefaultPort}
+	strategy := NewAdaptiveTimeout(AdaptiveTimeoutOptions{})
+
+	opts := testConnOptions()
+	opts.TimeoutStrategy = strategy
+
+	a, b := newPipe()
+	defer b.Close()
+	conn := NewConn(a, opts)
+	defer conn.Close()
+
+	other := NewConn(b, opts)
+	defer other.Close()
+
+	conn.opts.TimeoutStrategy.Observe(addr, 100*time.Millisecond)
+
+	// estimates are kept in the PeerTable of the Conn
+	srtt, _, ok := conn.peers.RTT(PeerID(addr.String()))
+	if !ok || srtt != 100*time.Millisecond {
+		t.Errorf("RTT() = %v, %v, want 100ms", srtt, ok)
+	}
+
+	if timeout := conn.opts.TimeoutStrategy.Initial(addr); timeout != 300*time.Millisecond {
+		t.Errorf("Initial() = %v, want 300ms", timeout)
+	}
+
+	// strategies shared by connections do not share estimates
+	if timeout := other.opts.TimeoutStrategy.Initial(addr); timeout != ACKTimeout {
+		t.Errorf("Initial() of other Conn = %v, want %v", timeout, ACKTimeout)
+	}
+
+	if timeout := strategy.Initial(addr); timeout != ACKTimeout {
+		t.Errorf("Initial() of unused strategy = %v, want %v", timeout, ACKTimeout)
+	}
+}
+
+// recordingTimeout is a FixedTimeout passing observed round-trip times to rtts.
+type recordingTimeout struct {
+	FixedTimeout
+
+	rtts chan time.Duration
+}
+
+func (r recordingTimeout) Observe(_ net.Addr, rtt time.Duration) {
+	r.rtts <- rtt
+}
+
+func TestConnTimeoutStrategy(t *testing.T) {
+	clock := newFakeClock(time.Unix(0, 0))
+	strategy := recordingTimeout{
+		FixedTimeout: FixedTimeout(10 * time.Millisecond),
+		rtts:         make(chan time.Duration, 4),
+	}
+
+	opts := testConnOptions()
+	opts.Clock = clock
+	opts.TimeoutStrategy = strategy
+
+	a, b := newPipe()
+	defer b.Close()
+	client := NewConn(a, opts)
+	defer client.Close()
+
+	buf := make([]byte, MaxMessageLength)
+
+	// exchange sends a Confirmable message acknowledged after the clock advances, transmissions are read
+	// from the peer after each advance of the clock
+	exchange := func(id MessageID, advances ...time.Duration) {
+		err := client.Write(&Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Confirmable,
+				Code:    Code(POST),
+				ID:      id,
+				Token:   bytes4,
+			},
+		}, b.LocalAddr())
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+
+		_, addr, err := b.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+
+		if len(advances) > 1 {
+			// let the connection arm the retransmit timer before the clock moves
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		for i, d := range advances {
+			clock.Advance(d)
+			if i == len(advances)-1 {
+				break
+			}
+
+			// retransmission
+			_, _, err = b.ReadFrom(buf)
+			if err != nil {
+				t.Fatal("read:", err)
+			}
+		}
+
+		ack := &Message{
+			Header: Header{
+				Version: ProtocolVersion,
+				Type:    Acknowledgement,
+				ID:      id,
+			},
+		}
+		_, err = b.WriteTo(MustValue(ack.MarshalBinary()), addr)
+		if err != nil {
+			t.Fatal("write:", err)
+		}
+
+		_, err = client.Read(&Message{})
+		if err != nil {
+			t.Fatal("read:", err)
+		}
+	}
+
+	observed := func(want time.Duration) {
+		select {
+		case rtt := <-strategy.rtts:
+			if rtt != want {
+				t.Errorf("rtt = %v, want %v", rtt, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no rtt observed")
+		}
+	}
+
+	exchange(1, 7*time.Millisecond)
+	observed(7 * time.Millisecond)
+
+	// acknowledgement of a retransmitted message is ambiguous, so the exchange is not observed
+	exchange(2, 15*time.Millisecond, 3*time.Millisecond)
+
+	exchange(3, 4*time.Millisecond)
+	observed(4 * time.Millisecond)
+
+	select {
+	case rtt := <-strategy.rtts:
+		t.Errorf("unexpected rtt %v", rtt)
+	default:
+	}
+}
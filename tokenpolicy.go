@@ -0,0 +1,75 @@
+package coap
+
+import (
+	"crypto/rand"
+	"net"
+)
+
+// TokenPolicy holds options for tokens of requests, intended for requests traversing untrusted paths
+// where short or predictable tokens ease spoofing of responses.
+//
+// https://datatracker.ietf.org/doc/html/rfc9175#section-4
+type TokenPolicy struct {
+	// MinLength is the minimum length of request tokens, including explicit ones. Zero disables the check.
+	MinLength uint
+
+	// Extend extends shorter tokens with random bytes to MinLength instead of rejecting the request
+	// with TokenTooShort.
+	Extend bool
+
+	// Derive generates tokens for requests written without one from their destination, such as
+	// PRFTokenSource.Token. It takes precedence over TokenSource if set.
+	Derive func(addr net.Addr) Token
+
+	// OnCollision is called by Client with a response whose token matches a request awaiting its response
+	// from another address, indicating a token collision or a spoofed response. The response is not
+	// delivered and the request keeps awaiting its response. Responses are matched by token only if nil.
+	OnCollision func(collision TokenCollision)
+}
+
+// TokenCollision describes a response withheld by TokenPolicy.OnCollision.
+type TokenCollision struct {
+	// Token is the token shared by the request and the response.
+	Token Token
+
+	// RequestAddr and RequestID identify the request awaiting its response.
+	RequestAddr net.Addr
+	RequestID   MessageID
+
+	// ResponseAddr, ResponseID and ResponseCode describe the withheld response.
+	ResponseAddr net.Addr
+	ResponseID   MessageID
+	ResponseCode Code
+}
+
+// source returns the token for a request to the address, derived if Derive is set, from tokenSource otherwise.
+func (p TokenPolicy) source(tokenSource TokenSource, addr net.Addr) Token {
+	if p.Derive != nil {
+		return p.Derive(addr)
+	}
+
+	return tokenSource()
+}
+
+// check returns the token extended to MinLength if Extend is set.
+//
+// Returns TokenTooShort if the token is shorter than MinLength and Extend is not set.
+func (p TokenPolicy) check(token Token) (Token, error) {
+	minLength := min(p.MinLength, TokenMaxLength)
+	if uint(len(token)) >= minLength {
+		return token, nil
+	}
+
+	if !p.Extend {
+		return token, TokenTooShort{
+			Length:    uint(len(token)),
+			MinLength: minLength,
+		}
+	}
+
+	extended := make(Token, minLength)
+	copy(extended, token)
+	_, _ = rand.Read(extended[len(token):]) // rand.Read never returns an error
+
+	return extended, nil
+}
@@ -0,0 +1,249 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestTokenPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy TokenPolicy
+		token  Token
+		length int
+		err    error
+	}{
+		{
+			name:   "disabled",
+			token:  Token{},
+			length: 0,
+		},
+		{
+			name:   "long enough",
+			policy: TokenPolicy{MinLength: 4},
+			token:  Token{0x01, 0x02, 0x03, 0x04},
+			length: 4,
+		},
+		{
+			name:   "rejected",
+			policy: TokenPolicy{MinLength: 8},
+			token:  Token{0x01, 0x02, 0x03, 0x04},
+			length: 4,
+			err:    TokenTooShort{Length: 4, MinLength: 8},
+		},
+		{
+			name:   "extended",
+			policy: TokenPolicy{MinLength: 8, Extend: true},
+			token:  Token{0x01, 0x02, 0x03, 0x04},
+			length: 8,
+		},
+		{
+			name:   "minimum beyond maximum",
+			policy: TokenPolicy{MinLength: 12, Extend: true},
+			token:  Token{0x01},
+			length: TokenMaxLength,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := test.policy.check(test.token)
+			expectErr(t, err, test.err)
+
+			if len(token) != test.length {
+				t.Errorf("length = %d, want %d", len(token), test.length)
+			}
+
+			if !bytes.HasPrefix(token, test.token) {
+				t.Errorf("token %x does not extend %x", token, test.token)
+			}
+		})
+	}
+}
+
+func TestConnTokenPolicy(t *testing.T) {
+	a, b := newPipe()
+	defer b.Close()
+
+	opts := testConnOptions()
+	opts.TokenSource = RandTokenSource(2)
+	opts.TokenPolicy = TokenPolicy{
+		MinLength: 8,
+		Extend:    true,
+	}
+	conn := NewConn(a, opts)
+	defer conn.Close()
+
+	tests := []struct {
+		name  string
+		token Token
+	}{
+		{"assigned", nil},
+		{"explicit", Token{0xaa, 0xbb}},
+	}
+
+	buf := make([]byte, MaxMessageLength)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := &Message{
+				Header: Header{
+					Version: ProtocolVersion,
+					Type:    NonConfirmable,
+					Code:    Code(GET),
+					Token:   test.token,
+				},
+			}
+
+			err := conn.Write(msg, b.LocalAddr())
+			if err != nil {
+				t.Fatal("write:", err)
+			}
+
+			n, _, err := b.ReadFrom(buf)
+			if err != nil {
+				t.Fatal("read:", err)
+			}
+
+			received := &Message{}
+			_, err = received.Decode(buf[:n], MarshalOptions{})
+			if err != nil {
+				t.Fatal("decode:", err)
+			}
+
+			if len(received.Token) != 8 || !bytes.HasPrefix(received.Token, test.token) {
+				t.Errorf("token = %x, want 8 bytes extending %x", received.Token, test.token)
+			}
+		})
+	}
+
+	opts.TokenPolicy.Extend = false
+	strict := NewConn(a, opts)
+	defer strict.Close()
+
+	err := strict.Write(&Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(GET),
+		},
+	}, b.LocalAddr())
+	expectErr(t, err, TokenTooShort{Length: 2, MinLength: 8})
+}
+
+func TestClientTokenCollision(t *testing.T) {
+	legit, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	defer legit.Close()
+
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("listen:", err)
+	}
+	defer spoofer.Close()
+
+	prf := NewPRFTokenSource([]byte("key"), 8)
+	collisions := make(chan TokenCollision, 1)
+
+	opts := testConnOptions()
+	opts.TokenPolicy = TokenPolicy{
+		Derive: prf.Token,
+		OnCollision: func(collision TokenCollision) {
+			collisions <- collision
+		},
+	}
+
+	client := &Client{
+		ConnOptions: opts,
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	type result struct {
+		resp *Response
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := client.Get(ctx, "coap://"+legit.LocalAddr().String()+"/temp")
+		results <- result{resp, err}
+	}()
+
+	buf := make([]byte, MaxMessageLength)
+	_ = legit.SetReadDeadline(time.Now().Add(time.Second))
+	n, clientAddr, err := legit.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+
+	req := &Message{}
+	_, err = req.Decode(buf[:n], MarshalOptions{})
+	if err != nil {
+		t.Fatal("decode:", err)
+	}
+
+	diff := cmp.Diff(prf.TokenAt(legit.LocalAddr(), 0), req.Token)
+	if diff != "" {
+		t.Errorf("token mismatch (-want +got):\n%s", diff)
+	}
+
+	// response from another address carrying the token of the pending request
+	spoofed := &Message{
+		Header: Header{
+			Version: ProtocolVersion,
+			Type:    NonConfirmable,
+			Code:    Code(Content),
+			ID:      0x7777,
+			Token:   req.Token,
+		},
+		Payload: []byte("spoofed"),
+	}
+	_, err = spoofer.WriteTo(MustValue(spoofed.MarshalBinary()), clientAddr)
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	select {
+	case collision := <-collisions:
+		expect := TokenCollision{
+			Token:        req.Token,
+			RequestAddr:  legit.LocalAddr(),
+			ResponseAddr: spoofer.LocalAddr(),
+			ResponseID:   0x7777,
+			ResponseCode: Code(Content),
+		}
+
+		// MessageID of the request is recorded once the write returns, possibly after the collision
+		diff := cmp.Diff(expect, collision, cmpopts.IgnoreFields(TokenCollision{}, "RequestID"), cmp.Comparer(func(a, b net.Addr) bool {
+			return a.String() == b.String()
+		}))
+		if diff != "" {
+			t.Errorf("collision mismatch (-want +got):\n%s", diff)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no collision")
+	}
+
+	_, err = legit.WriteTo(MustValue(req.Reply(Code(Content), []byte("legit")).MarshalBinary()), clientAddr)
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+
+	res := <-results
+	if res.err != nil {
+		t.Fatal("get:", res.err)
+	}
+
+	if string(res.resp.Payload) != "legit" {
+		t.Errorf("payload = %q, want %q", res.resp.Payload, "legit")
+	}
+}
@@ -0,0 +1,142 @@
+package coap
+
+import (
+	"slices"
+	"unicode/utf8"
+)
+
+// TrimStep is a class of sacrificial response elements removed by FitResponse.
+type TrimStep uint8
+
+const (
+	// TrimDiagnosticPayload truncates the diagnostic payload of 4.xx and 5.xx responses at a rune boundary.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7252#section-5.5.2
+	TrimDiagnosticPayload TrimStep = iota
+
+	// TrimNoCacheKeyOptions removes elective options that are not part of the cache key, such as Size2.
+	TrimNoCacheKeyOptions
+
+	// TrimElectiveOptions removes elective options, such as MaxAge and LocationQuery.
+	TrimElectiveOptions
+)
+
+// DefaultTrimSteps is the order in which FitResponse removes elements by default.
+var DefaultTrimSteps = []TrimStep{
+	TrimDiagnosticPayload,
+	TrimNoCacheKeyOptions,
+	TrimElectiveOptions,
+}
+
+// TrimPolicy selects the elements FitResponse may remove, critical options, the code and the token
+// are never removed.
+type TrimPolicy struct {
+	// Steps are applied in order until the response fits, defaults to DefaultTrimSteps if nil.
+	//
+	// Within a step options with the highest code are removed first, repeated options from the last.
+	Steps []TrimStep
+}
+
+// FitResponse trims the response so that its encoded size does not exceed budget,
+// removing elements in the order of the policy and recomputing the size after each removal.
+//
+// If the response is trimmed, option overriding fields such as Size2 or LocationQuery are folded
+// into Options. The response is left unchanged if it already fits or cannot fit.
+//
+// Returns CannotFit with the smallest achievable size if the response exceeds the budget after
+// all steps of the policy.
+func FitResponse(resp *Response, budget int, policy TrimPolicy) (trimmed bool, err error) {
+	msg, err := resp.message()
+	if err != nil {
+		return false, err
+	}
+
+	if msg.Size() <= budget {
+		return false, nil
+	}
+
+	steps := policy.Steps
+	if steps == nil {
+		steps = DefaultTrimSteps
+	}
+
+	msg.Options = SortOptions(msg.Options)
+	for _, step := range steps {
+		if trimMessage(&msg, step, budget) {
+			break
+		}
+	}
+
+	size := msg.Size()
+	if size > budget {
+		return false, CannotFit{
+			Budget: budget,
+			Size:   size,
+		}
+	}
+
+	*resp = Response{
+		Type:      resp.Type,
+		Code:      resp.Code,
+		MessageID: resp.MessageID,
+		Token:     resp.Token,
+		Options:   msg.Options,
+		Payload:   msg.Payload,
+	}
+
+	return true, nil
+}
+
+// trimMessage removes elements of the step from the message until it fits the budget.
+//
+// Returns true if the message fits.
+func trimMessage(msg *Message, step TrimStep, budget int) bool {
+	switch step {
+	case TrimDiagnosticPayload:
+		class := msg.Code.Class()
+		if class != 4 && class != 5 {
+			return false
+		}
+
+		keep := len(msg.Payload) - (msg.Size() - budget)
+		if keep <= 0 {
+			msg.Payload = nil
+			return msg.Size() <= budget
+		}
+
+		for keep > 0 && !utf8.RuneStart(msg.Payload[keep]) {
+			keep--
+		}
+
+		msg.Payload = msg.Payload[:keep:keep]
+		return msg.Size() <= budget
+	case TrimNoCacheKeyOptions:
+		return trimOptions(msg, budget, func(def OptionDef) bool {
+			return !def.Critical() && def.NoCacheKey()
+		})
+	case TrimElectiveOptions:
+		return trimOptions(msg, budget, func(def OptionDef) bool {
+			return !def.Critical()
+		})
+	default:
+		return false
+	}
+}
+
+// trimOptions removes sorted options matching sacrificial from the last until the message fits the budget.
+//
+// Returns true if the message fits.
+func trimOptions(msg *Message, budget int, sacrificial func(def OptionDef) bool) bool {
+	for i := len(msg.Options) - 1; i >= 0; i-- {
+		if !sacrificial(msg.Options[i].OptionDef) {
+			continue
+		}
+
+		msg.Options = slices.Delete(msg.Options, i, i+1)
+		if msg.Size() <= budget {
+			return true
+		}
+	}
+
+	return msg.Size() <= budget
+}
@@ -0,0 +1,175 @@
+package coap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFitResponse(t *testing.T) {
+	size := func(v uint32) *uint32 {
+		return &v
+	}
+
+	// critical options are never removed
+	critical := OptionDef{Code: 65001, ValueFormat: ValueFormatOpaque, MaxLen: 8}
+
+	tests := []struct {
+		name    string
+		budget  int
+		policy  TrimPolicy
+		resp    *Response
+		want    *Response
+		trimmed bool
+		err     error
+	}{
+		{
+			name:   "fits",
+			budget: 38,
+			resp: &Response{
+				Code:    Content,
+				Token:   bytes4,
+				Options: Options{MustOptionValue(MaxAge, uint32(3600))},
+			},
+			want: &Response{
+				Code:    Content,
+				Token:   bytes4,
+				Options: Options{MustOptionValue(MaxAge, uint32(3600))},
+			},
+		},
+		{
+			name:   "drop size2 and last location query",
+			budget: 32,
+			resp: &Response{
+				Code:  Created,
+				Token: bytes4,
+				Options: Options{
+					MustOptionValue(ETag, bytes4),
+					MustOptionValue(MaxAge, uint32(3600)),
+				},
+				LocationQuery: []string{"a=1", "b=2"},
+				Size2:         size(1000),
+				Payload:       []byte("0123456789"),
+			},
+			want: &Response{
+				Code:  Created,
+				Token: bytes4,
+				Options: Options{
+					MustOptionValue(ETag, bytes4),
+					MustOptionValue(MaxAge, uint32(3600)),
+					MustOptionValue(LocationQuery, "a=1"),
+				},
+				Payload: []byte("0123456789"),
+			},
+			trimmed: true,
+		},
+		{
+			name:   "diagnostic payload at rune boundary",
+			budget: 11,
+			resp: &Response{
+				Code:    BadRequest,
+				Payload: []byte("bad vérité"),
+			},
+			want: &Response{
+				Code:    BadRequest,
+				Payload: []byte("bad v"),
+			},
+			trimmed: true,
+		},
+		{
+			name:   "success payload is kept",
+			budget: 10,
+			resp: &Response{
+				Code:    Content,
+				Payload: []byte("0123456789"),
+			},
+			err: CannotFit{
+				Budget: 10,
+				Size:   15,
+			},
+		},
+		{
+			name:   "policy without elective options",
+			budget: 7,
+			policy: TrimPolicy{
+				Steps: []TrimStep{TrimNoCacheKeyOptions},
+			},
+			resp: &Response{
+				Code:    Content,
+				Options: Options{MustOptionValue(MaxAge, uint32(3600))},
+				Size2:   size(1000),
+			},
+			err: CannotFit{
+				Budget: 7,
+				Size:   8,
+			},
+		},
+		{
+			name:   "cannot fit",
+			budget: 12,
+			resp: &Response{
+				Code:  NotFound,
+				Token: bytes8,
+				Options: Options{
+					MustOptionValue(critical, bytes4),
+					MustOptionValue(MaxAge, uint32(60)),
+				},
+				Payload: []byte("not found"),
+			},
+			err: CannotFit{
+				Budget: 12,
+				Size:   19,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := *test.resp
+			trimmed, err := FitResponse(&resp, test.budget, test.policy)
+			expectErr(t, err, test.err)
+
+			if trimmed != test.trimmed {
+				t.Errorf("trimmed = %v, want %v", trimmed, test.trimmed)
+			}
+
+			want := test.want
+			if want == nil {
+				// response is left unchanged
+				want = test.resp
+			}
+
+			diff := cmp.Diff(want, &resp, EquateOptions())
+			if diff != "" {
+				t.Errorf("response mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServerPathMTU(t *testing.T) {
+	size := uint32(1000)
+	s := newServerTest(t, testConnOptions(), ServerOptions{PathMTU: 13}, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+		_ = w.Write(&Response{
+			Code:    Content,
+			Size2:   &size,
+			Payload: bytes4,
+		})
+	}))
+
+	s.send(testRequest())
+
+	resp := s.receive()
+	if resp == nil {
+		t.Fatal("no response")
+	}
+
+	if resp.Size() != 13 {
+		t.Errorf("response size = %d, want %d", resp.Size(), 13)
+	}
+
+	if _, ok := resp.Options.Get(Size2); ok {
+		t.Error("expected Size2 to be trimmed")
+	}
+}
@@ -0,0 +1,312 @@
+package coap
+
+import (
+	"cmp"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Scheme is the URI scheme of CoAP over UDP.
+	Scheme = "coap"
+
+	// SecureScheme is the URI scheme of CoAP over DTLS.
+	SecureScheme = "coaps"
+
+	// DefaultPort is the default port of Scheme.
+	DefaultPort = 5683
+
+	// DefaultSecurePort is the default port of SecureScheme.
+	DefaultSecurePort = 5684
+)
+
+// ParseURL parses a coap or coaps URL into a Request with Host, Port, URIPath options and Query set.
+//
+// Port defaults to DefaultPort for coap and DefaultSecurePort for coaps scheme.
+// Path segments and query parameters are percent-decoded, path segments are kept as URIPath options
+// so that segments containing slashes are preserved.
+//
+// Returns UnsupportedScheme if the URL scheme is neither coap nor coaps.
+//
+// Returns InvalidURL if the URL has no host, an invalid authority or a fragment.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-6.4
+func ParseURL(rawURL string) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	port := uint16(0)
+	switch u.Scheme {
+	case Scheme:
+		port = DefaultPort
+	case SecureScheme:
+		port = DefaultSecurePort
+	default:
+		return nil, UnsupportedScheme{
+			Scheme: u.Scheme,
+		}
+	}
+
+	if u.Hostname() == "" || u.Fragment != "" {
+		return nil, InvalidURL{
+			URL: rawURL,
+		}
+	}
+
+	req := &Request{}
+	err = SetAuthority(req, u.Host)
+	if err != nil {
+		return nil, InvalidURL{
+			URL: rawURL,
+		}
+	}
+
+	if req.Port == 0 {
+		req.Port = port
+	}
+
+	for _, segment := range splitPath(u.EscapedPath()) {
+		segment, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+
+		option, err := OptionValue(URIPath, segment)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Options = append(req.Options, option)
+	}
+
+	if u.RawQuery != "" {
+		for param := range strings.SplitSeq(u.RawQuery, "&") {
+			param, err := url.QueryUnescape(param)
+			if err != nil {
+				return nil, err
+			}
+
+			req.Query = append(req.Query, param)
+		}
+	}
+
+	return req, nil
+}
+
+// SetAuthority sets Host and Port of the request from a host[:port] authority.
+//
+// IPv6 literals have to be enclosed in brackets and are stored in Host without them. The authority is
+// expected in the decoded form of url.URL.Host, so a zone follows a single '%' as in "[fe80::1%eth0]".
+// Port is left unset when absent, so that the default applies.
+//
+// Returns InvalidAuthority if the host is neither a valid reg-name nor an IP literal, the IP literal has
+// a zone but is not link-local, or the port is not a number.
+//
+// https://datatracker.ietf.org/doc/html/rfc3986#section-3.2.2
+//
+// https://datatracker.ietf.org/doc/html/rfc6874
+func SetAuthority(req *Request, authority string) error {
+	invalid := InvalidAuthority{
+		Authority: authority,
+	}
+
+	host, port := authority, ""
+	literal := false
+	switch {
+	case strings.HasPrefix(authority, "[") && strings.HasSuffix(authority, "]"):
+		host = authority[1 : len(authority)-1]
+		literal = true
+	case strings.HasPrefix(authority, "["), strings.Count(authority, ":") == 1:
+		var err error
+		host, port, err = net.SplitHostPort(authority)
+		if err != nil {
+			return invalid
+		}
+
+		literal = strings.HasPrefix(authority, "[")
+	case strings.Contains(authority, ":"):
+		return invalid // IPv6 literal without brackets
+	}
+
+	switch {
+	case literal:
+		if !isIPv6Literal(host) {
+			return invalid
+		}
+	case !isRegName(host):
+		return invalid
+	}
+
+	p := uint64(0)
+	if port != "" {
+		var err error
+		p, err = strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return invalid
+		}
+	}
+
+	req.Host = host
+	req.Port = uint16(p)
+
+	return nil
+}
+
+// isIPv6Literal checks that host is an IPv6 address, with a zone only if the address is link-local.
+func isIPv6Literal(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return false
+	}
+
+	if addr.Zone() == "" {
+		return true
+	}
+
+	return addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast()
+}
+
+// URL returns the coap URL of the request composed of Host, Port, Path and Query, falling back
+// to URIHost, URIPort, URIPath and URIQuery options.
+//
+// IPv6 literals are enclosed in brackets and Port is omitted if it is DefaultPort.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-6.5
+func (r *Request) URL() *url.URL {
+	host := r.Host
+	if host == "" {
+		host, _ = r.Options.GetString(URIHost)
+	}
+
+	port := uint32(r.Port)
+	if port == 0 {
+		port, _ = r.Options.GetUint(URIPort)
+	}
+
+	switch {
+	case port != 0 && port != DefaultPort:
+		host = net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+	case strings.Contains(host, ":"):
+		host = "[" + host + "]"
+	}
+
+	segments := MustValue(r.Options.GetAllString(URIPath))
+	if path := EncodePath(r.Path); path != nil {
+		segments = path
+	}
+
+	query := r.Query
+	if len(query) == 0 {
+		query = slices.Collect(MustValue(r.Options.GetAllString(URIQuery)))
+	}
+
+	u := &url.URL{
+		Scheme: Scheme,
+		Host:   host,
+	}
+
+	for segment := range segments {
+		u.Path += "/" + segment
+		u.RawPath += "/" + url.PathEscape(segment)
+	}
+
+	escaped := make([]string, 0, len(query))
+	for _, param := range query {
+		// '+' is escaped as well, since it decodes as a space in queries
+		param = strings.NewReplacer("&", "%26", "+", "%2B").Replace(url.PathEscape(param))
+		escaped = append(escaped, param)
+	}
+	u.RawQuery = strings.Join(escaped, "&")
+
+	return u
+}
+
+// ProxyTarget returns the target of a forward-proxy request assembled from ProxyURI, or from ProxyScheme
+// and URIHost, URIPort, URIPath and URIQuery, each taking precedence over Host, Port, Path and Query.
+//
+// Authority is empty if ProxyScheme is used without URIHost, the proxy then uses the destination
+// address of the request. Port is included only if set explicitly, so that the default of the scheme applies.
+// Path and query are percent-encoded, path is "/" if empty.
+//
+// Returns ok false if the request is not a proxy request or ProxyURI is not an absolute URI.
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.7.1
+//
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.10.2
+func ProxyTarget(req *Request) (scheme, authority, path, query string, ok bool) {
+	proxyURI, err := req.Options.GetString(ProxyURI)
+	if err == nil {
+		u, err := url.Parse(proxyURI)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return "", "", "", "", false
+		}
+
+		return u.Scheme, u.Host, cmp.Or(u.EscapedPath(), "/"), u.RawQuery, true
+	}
+
+	scheme, err = req.Options.GetString(ProxyScheme)
+	if err != nil {
+		return "", "", "", "", false
+	}
+
+	// URL falls back to the options for fields left empty
+	target := *req
+	if req.Options.Contains(URIHost) {
+		target.Host = ""
+	}
+
+	// default port of the request URI does not apply to the proxy scheme
+	port, err := req.Options.GetUint(URIPort)
+	if err == nil {
+		target.Port = 0
+	} else {
+		port = uint32(req.Port)
+	}
+
+	if req.Options.Contains(URIPath) {
+		target.Path = ""
+	}
+
+	if req.Options.Contains(URIQuery) {
+		target.Query = nil
+	}
+
+	u := target.URL()
+	authority = u.Hostname()
+	switch {
+	case authority == "":
+	case port != 0:
+		authority = net.JoinHostPort(authority, strconv.FormatUint(uint64(port), 10))
+	case strings.Contains(authority, ":"):
+		authority = "[" + authority + "]"
+	}
+
+	return scheme, authority, cmp.Or(u.EscapedPath(), "/"), u.RawQuery, true
+}
+
+// isRegName checks that host is a non-empty reg-name, which includes IPv4 addresses.
+//
+// https://datatracker.ietf.org/doc/html/rfc3986#section-3.2.2
+func isRegName(host string) bool {
+	if host == "" {
+		return false
+	}
+
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("-._~!$&'()*+,;=%", c) != -1:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
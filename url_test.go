@@ -0,0 +1,355 @@
+package coap
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		req  *Request
+		err  error
+	}{
+		{
+			name: "coap default port",
+			url:  "coap://example.com/sensors/temp?unit=c&raw",
+			req: &Request{
+				Host: "example.com",
+				Port: DefaultPort,
+				Options: Options{
+					MustOptionValue(URIPath, "sensors"),
+					MustOptionValue(URIPath, "temp"),
+				},
+				Query: []string{"unit=c", "raw"},
+			},
+		},
+		{
+			name: "query escapes",
+			url:  "coap://example.com/?q=a+b&r=%2B%26",
+			req: &Request{
+				Host:  "example.com",
+				Port:  DefaultPort,
+				Query: []string{"q=a b", "r=+&"},
+			},
+		},
+		{
+			name: "coaps default port",
+			url:  "coaps://example.com",
+			req: &Request{
+				Host: "example.com",
+				Port: DefaultSecurePort,
+			},
+		},
+		{
+			name: "explicit port",
+			url:  "coaps://192.0.2.1:61616/",
+			req: &Request{
+				Host: "192.0.2.1",
+				Port: 61616,
+			},
+		},
+		{
+			name: "ipv6",
+			url:  "coap://[2001:db8::1]:61616/x",
+			req: &Request{
+				Host: "2001:db8::1",
+				Port: 61616,
+				Options: Options{
+					MustOptionValue(URIPath, "x"),
+				},
+			},
+		},
+		{
+			name: "ipv6 zone",
+			url:  "coap://[fe80::1%25eth0]:5683/x",
+			req: &Request{
+				Host: "fe80::1%eth0",
+				Port: DefaultPort,
+				Options: Options{
+					MustOptionValue(URIPath, "x"),
+				},
+			},
+		},
+		{
+			name: "ipv6 zone not link-local",
+			url:  "coap://[2001:db8::1%25eth0]:5683/x",
+			err: InvalidURL{
+				URL: "coap://[2001:db8::1%25eth0]:5683/x",
+			},
+		},
+		{
+			name: "escaped segments",
+			url:  "coap://example.com/a%2Fb/%C3%A4/",
+			req: &Request{
+				Host: "example.com",
+				Port: DefaultPort,
+				Options: Options{
+					MustOptionValue(URIPath, "a/b"),
+					MustOptionValue(URIPath, "ä"),
+					MustOptionValue(URIPath, ""),
+				},
+			},
+		},
+		{
+			name: "unsupported scheme",
+			url:  "http://example.com/",
+			err: UnsupportedScheme{
+				Scheme: "http",
+			},
+		},
+		{
+			name: "fragment",
+			url:  "coap://example.com/#frag",
+			err: InvalidURL{
+				URL: "coap://example.com/#frag",
+			},
+		},
+		{
+			name: "missing host",
+			url:  "coap:///path",
+			err: InvalidURL{
+				URL: "coap:///path",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := ParseURL(test.url)
+			expectErr(t, err, test.err)
+
+			diff := cmp.Diff(test.req, req, EquateOptions())
+			if diff != "" {
+				t.Errorf("request mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSetAuthority(t *testing.T) {
+	tests := []struct {
+		authority string
+		host      string
+		port      uint16
+		err       error
+	}{
+		{authority: "example.com", host: "example.com"},
+		{authority: "example.com:5683", host: "example.com", port: 5683},
+		{authority: "192.0.2.1:61616", host: "192.0.2.1", port: 61616},
+		{authority: "[2001:db8::1]", host: "2001:db8::1"},
+		{authority: "[2001:db8::1]:5684", host: "2001:db8::1", port: 5684},
+		{authority: "example.com:", host: "example.com"},
+		{authority: "[fe80::1%eth0]:5683", host: "fe80::1%eth0", port: 5683},
+		{authority: "[ff02::1%2]", host: "ff02::1%2"},
+		{authority: "[2001:db8::1%eth0]", err: InvalidAuthority{Authority: "[2001:db8::1%eth0]"}},
+		{authority: "[::ffff:192.0.2.1]", err: InvalidAuthority{Authority: "[::ffff:192.0.2.1]"}},
+		{authority: "2001:db8::1", err: InvalidAuthority{Authority: "2001:db8::1"}},
+		{authority: "[192.0.2.1]", err: InvalidAuthority{Authority: "[192.0.2.1]"}},
+		{authority: "[example.com]:1", err: InvalidAuthority{Authority: "[example.com]:1"}},
+		{authority: "example.com:port", err: InvalidAuthority{Authority: "example.com:port"}},
+		{authority: "example.com:70000", err: InvalidAuthority{Authority: "example.com:70000"}},
+		{authority: "exa mple.com", err: InvalidAuthority{Authority: "exa mple.com"}},
+		{authority: ":5683", err: InvalidAuthority{Authority: ":5683"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.authority, func(t *testing.T) {
+			req := &Request{}
+			err := SetAuthority(req, test.authority)
+			expectErr(t, err, test.err)
+
+			if req.Host != test.host || req.Port != test.port {
+				t.Errorf("SetAuthority() = %q, %d, want %q, %d", req.Host, req.Port, test.host, test.port)
+			}
+		})
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *Request
+		url  string
+	}{
+		{
+			name: "reg-name",
+			req: &Request{
+				Host:  "example.com",
+				Port:  DefaultPort,
+				Path:  "/sensors/temp",
+				Query: []string{"unit=c", "a&b"},
+			},
+			url: "coap://example.com/sensors/temp?unit=c&a%26b",
+		},
+		{
+			name: "query plus",
+			req: &Request{
+				Host:  "example.com",
+				Port:  DefaultPort,
+				Query: []string{"q=a+b c"},
+			},
+			url: "coap://example.com?q=a%2Bb%20c",
+		},
+		{
+			name: "ipv4",
+			req: &Request{
+				Host: "192.0.2.1",
+				Port: 61616,
+			},
+			url: "coap://192.0.2.1:61616",
+		},
+		{
+			name: "ipv6",
+			req: &Request{
+				Options: Options{
+					MustOptionValue(URIHost, "2001:db8::1"),
+					MustOptionValue(URIPath, "a/b"),
+				},
+			},
+			url: "coap://[2001:db8::1]/a%2Fb",
+		},
+		{
+			name: "ipv6 zone",
+			req: &Request{
+				Host: "fe80::1%eth0",
+				Port: 5684,
+				Path: "x",
+			},
+			url: "coap://[fe80::1%25eth0]:5684/x",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := test.req.URL()
+			if u.String() != test.url {
+				t.Errorf("URL() = %q, want %q", u, test.url)
+			}
+
+			// round trip
+			req, err := ParseURL(u.String())
+			if err != nil {
+				t.Fatal("parse:", err)
+			}
+
+			if req.URL().String() != test.url {
+				t.Errorf("round trip URL() = %q, want %q", req.URL(), test.url)
+			}
+		})
+	}
+}
+
+func TestProxyTarget(t *testing.T) {
+	type target struct {
+		Scheme    string
+		Authority string
+		Path      string
+		Query     string
+		OK        bool
+	}
+
+	tests := []struct {
+		name string
+		req  *Request
+		want target
+	}{
+		{
+			name: "proxy uri",
+			req: &Request{
+				Options: Options{
+					MustOptionValue(ProxyURI, "http://example.com:8080/a/b?x=1"),
+				},
+			},
+			want: target{"http", "example.com:8080", "/a/b", "x=1", true},
+		},
+		{
+			name: "proxy uri without path",
+			req: &Request{
+				Options: Options{
+					MustOptionValue(ProxyURI, "coaps://[2001:db8::1]"),
+				},
+			},
+			want: target{"coaps", "[2001:db8::1]", "/", "", true},
+		},
+		{
+			name: "proxy uri relative",
+			req: &Request{
+				Options: Options{
+					MustOptionValue(ProxyURI, "/a/b"),
+				},
+			},
+		},
+		{
+			name: "proxy scheme",
+			req: &Request{
+				Options: Options{
+					MustOptionValue(ProxyScheme, "http"),
+					MustOptionValue(URIHost, "example.com"),
+					MustOptionValue(URIPort, uint32(DefaultPort)),
+					MustOptionValue(URIPath, "a b"),
+					MustOptionValue(URIQuery, "a&b"),
+				},
+			},
+			want: target{"http", "example.com:5683", "/a%20b", "a%26b", true},
+		},
+		{
+			name: "proxy scheme overrides",
+			req: &Request{
+				Options: Options{
+					MustOptionValue(ProxyScheme, "coap+tcp"),
+				},
+				Host: "2001:db8::1",
+				Path: "/x",
+			},
+			want: target{"coap+tcp", "[2001:db8::1]", "/x", "", true},
+		},
+		{
+			name: "proxy scheme options over fields",
+			req: &Request{
+				Options: Options{
+					MustOptionValue(ProxyScheme, "http"),
+					MustOptionValue(URIHost, "example.com"),
+					MustOptionValue(URIPort, uint32(8080)),
+					MustOptionValue(URIPath, "a"),
+					MustOptionValue(URIQuery, "x=1"),
+				},
+				Host:  "example.org",
+				Port:  9090,
+				Path:  "/b",
+				Query: []string{"y=2"},
+			},
+			want: target{"http", "example.com:8080", "/a", "x=1", true},
+		},
+		{
+			name: "proxy scheme without host",
+			req: &Request{
+				Options: Options{
+					MustOptionValue(ProxyScheme, "http"),
+				},
+			},
+			want: target{"http", "", "/", "", true},
+		},
+		{
+			name: "not a proxy request",
+			req: &Request{
+				Host: "example.com",
+				Path: "/x",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := target{}
+			got.Scheme, got.Authority, got.Path, got.Query, got.OK = ProxyTarget(test.req)
+
+			diff := cmp.Diff(test.want, got)
+			if diff != "" {
+				t.Errorf("target mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}